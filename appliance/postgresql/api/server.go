@@ -5,6 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/render"
@@ -42,6 +45,8 @@ func main() {
 	m.Map(db)
 
 	r.Post("/databases", createDatabase)
+	r.Get("/databases", listDatabases)
+	r.Delete("/databases/:id", dropDatabase)
 	r.Get("/ping", ping)
 
 	port := os.Getenv("PORT")
@@ -60,8 +65,9 @@ func main() {
 }
 
 type resource struct {
-	ID  string            `json:"id"`
-	Env map[string]string `json:"env"`
+	ID        string            `json:"id"`
+	Env       map[string]string `json:"env"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
 }
 
 func createDatabase(db *postgres.DB, r render.Render) {
@@ -78,6 +84,11 @@ func createDatabase(db *postgres.DB, r render.Render) {
 		r.JSON(500, struct{}{})
 		return
 	}
+	// the creation time is recorded so that listDatabases can report it,
+	// a failure here only means the database won't be repaired by a sync
+	if err := db.Exec(fmt.Sprintf(`COMMENT ON DATABASE "%s" IS '%s'`, database, time.Now().UTC().Format(time.RFC3339))); err != nil {
+		log.Println(err)
+	}
 
 	r.JSON(200, &resource{
 		ID: fmt.Sprintf("/databases/%s:%s", username, database),
@@ -91,11 +102,83 @@ func createDatabase(db *postgres.DB, r render.Render) {
 	})
 }
 
-func ping(db *postgres.DB, w http.ResponseWriter) {
-	if err := db.Exec("SELECT 1"); err != nil {
+// hexName matches the user and database names generated by createDatabase
+var hexName = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// listDatabases responds with the databases created by createDatabase, their
+// env omits PGPASSWORD as it can't be recovered. The creation time is read
+// from the database comment, which databases created before it was recorded
+// don't have.
+func listDatabases(db *postgres.DB, r render.Render) {
+	rows, err := db.Query(`SELECT r.rolname, d.datname, shobj_description(d.oid, 'pg_database') FROM pg_database d JOIN pg_roles r ON d.datdba = r.oid WHERE NOT d.datistemplate`)
+	if err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	defer rows.Close()
+	resources := []*resource{}
+	for rows.Next() {
+		var username, database string
+		var comment *string
+		if err := rows.Scan(&username, &database, &comment); err != nil {
+			log.Println(err)
+			r.JSON(500, struct{}{})
+			return
+		}
+		if !hexName.MatchString(username) || !hexName.MatchString(database) {
+			continue
+		}
+		res := &resource{
+			ID: fmt.Sprintf("/databases/%s:%s", username, database),
+			Env: map[string]string{
+				"FLYNN_POSTGRES": serviceName,
+				"PGHOST":         serviceHost,
+				"PGUSER":         username,
+				"PGDATABASE":     database,
+			},
+		}
+		if comment != nil {
+			if t, err := time.Parse(time.RFC3339, *comment); err == nil {
+				res.CreatedAt = &t
+			}
+		}
+		resources = append(resources, res)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	r.JSON(200, resources)
+}
+
+func dropDatabase(db *postgres.DB, params martini.Params, r render.Render) {
+	parts := strings.SplitN(params["id"], ":", 2)
+	if len(parts) != 2 || !hexName.MatchString(parts[0]) || !hexName.MatchString(parts[1]) {
+		r.JSON(404, struct{}{})
+		return
+	}
+	username, database := parts[0], parts[1]
+	if err := db.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, database)); err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	if err := db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, username)); err != nil {
+		log.Println(err)
+		r.JSON(500, struct{}{})
+		return
+	}
+	r.JSON(200, struct{}{})
+}
+
+func ping(db *postgres.DB, r render.Render) {
+	var version string
+	if err := db.QueryRow("SHOW server_version").Scan(&version); err != nil {
 		log.Println(err)
-		w.WriteHeader(500)
+		r.JSON(500, struct{}{})
 		return
 	}
-	w.WriteHeader(200)
+	r.JSON(200, map[string]string{"version": "postgres " + version})
 }
@@ -48,6 +48,23 @@ Examples:
 	$ flynn -a turkeys-stupefy-perry delete
 	Are you sure you want to delete the app "turkeys-stupefy-perry"? (yes/no): yes
 	Deleted turkeys-stupefy-perry
+`)
+	register("rename", runRename, `
+usage: flynn rename [-r <remote>] <name>
+
+Rename an app.
+
+The app's default route is moved to the domain of the new name. If run from a
+git repository with a 'flynn' remote for the app, it will be updated to use
+the new name.
+
+Options:
+	-r, --remote <remote>  Name of git remote to update, empty string for none. [default: flynn]
+
+Examples:
+
+	$ flynn -a turkeys-stupefy-perry rename turkeys
+	Renamed turkeys-stupefy-perry to turkeys
 `)
 	register("apps", runApps, `
 usage: flynn apps
@@ -146,6 +163,27 @@ func runDelete(args *docopt.Args, client *controller.Client) error {
 	return nil
 }
 
+func runRename(args *docopt.Args, client *controller.Client) error {
+	appName := mustApp()
+	remote := args.String["--remote"]
+
+	app, err := client.RenameApp(appName, args.String["<name>"])
+	if err != nil {
+		return err
+	}
+
+	if remote != "" {
+		if remotes, err := gitRemotes(); err == nil {
+			if r, ok := remotes[remote]; ok && r.Name == appName {
+				exec.Command("git", "remote", "set-url", "--", remote, gitURLPre(r.Cluster.GitHost)+app.Name+gitURLSuf).Run()
+			}
+		}
+	}
+
+	log.Printf("Renamed %s to %s", appName, app.Name)
+	return nil
+}
+
 func runApps(args *docopt.Args, client *controller.Client) error {
 	apps, err := client.AppList()
 	if err != nil {
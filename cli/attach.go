@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/term"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	register("attach", runAttach, `
+usage: flynn attach [options] <job>
+
+Attach to a running job, streaming its output until it exits or the
+connection is interrupted. Interrupting the attach does not stop the job.
+
+Options:
+	-i, --stdin  forward stdin to the job
+	-l, --logs   print the buffered output of the job first
+	-t, --tty    attach to the terminal of a job which was started with a TTY
+`)
+}
+
+func runAttach(args *docopt.Args, client *controller.Client) error {
+	opts := &ct.JobAttachOptions{
+		Stdin: args.Bool["--stdin"],
+		Logs:  args.Bool["--logs"],
+	}
+	tty := args.Bool["--tty"]
+	if tty {
+		if !term.IsTerminal(os.Stdin.Fd()) || !term.IsTerminal(os.Stdout.Fd()) {
+			return errors.New("--tty requires stdin and stdout to be a terminal")
+		}
+		ws, err := term.GetWinsize(os.Stdin.Fd())
+		if err != nil {
+			return err
+		}
+		opts.Height = ws.Height
+		opts.Width = ws.Width
+	}
+
+	rwc, err := client.AttachJob(mustApp(), args.String["<job>"], opts)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+	attachClient := cluster.NewAttachClient(rwc)
+
+	if tty {
+		termState, err := term.MakeRaw(os.Stdin.Fd())
+		if err != nil {
+			return err
+		}
+		defer term.RestoreTerminal(os.Stdin.Fd(), termState)
+		go forwardResize(attachClient)
+	}
+	if opts.Stdin {
+		go func() {
+			io.Copy(attachClient, os.Stdin)
+			attachClient.CloseWrite()
+		}()
+	}
+
+	_, err = attachClient.Receive(os.Stdout, os.Stderr)
+	return err
+}
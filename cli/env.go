@@ -9,13 +9,14 @@ import (
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
 )
 
 func init() {
 	register("env", runEnv, `
 usage: flynn env [-t <proc>]
-       flynn env set [-t <proc>] <var>=<val>...
+       flynn env set [-s] [-t <proc>] <var>=<val>...
        flynn env unset [-t <proc>] <var>...
        flynn env get [-t <proc>] <var>
 
@@ -23,6 +24,7 @@ Manage app environment variables.
 
 Options:
 	-t, --process-type <proc>  set or read env for specified process type
+	-s, --secret               store the values encrypted, they are not shown again
 
 Commands:
 	With no arguments, shows a list of environment variables.
@@ -36,8 +38,12 @@ Examples:
 	$ flynn env set FOO=bar BAZ=foobar
 	Created release 5058ae7964f74c399a240bdd6e7d1bcb.
 
+	$ flynn env set --secret DATABASE_PASSWORD=hunter2
+	Created release 3f9a2a1e26cd4b2a9c4a0c1f9b6c8d47.
+
 	$ flynn env
 	BAZ=foobar
+	DATABASE_PASSWORD=<secret>
 	FOO=bar
 
 	$ flynn env get -t web FOO
@@ -80,7 +86,7 @@ func runEnv(args *docopt.Args, client *controller.Client) error {
 
 	vars := make([]string, 0, len(release.Env))
 	for k, v := range release.Env {
-		vars = append(vars, k+"="+v)
+		vars = append(vars, k+"="+envValue(v))
 	}
 	sort.Strings(vars)
 
@@ -100,7 +106,11 @@ func runEnvSet(args *docopt.Args, client *controller.Client) error {
 		}
 		env[v[0]] = &v[1]
 	}
-	id, err := setEnv(client, envProc, env)
+	secret := args.Bool["--secret"]
+	if secret && envProc != "" {
+		return errors.New("secrets can't be set for a process type")
+	}
+	id, err := setEnv(client, envProc, env, secret)
 	if err != nil {
 		return err
 	}
@@ -114,7 +124,7 @@ func runEnvUnset(args *docopt.Args, client *controller.Client) error {
 	for _, s := range vars {
 		env[s] = nil
 	}
-	id, err := setEnv(client, envProc, env)
+	id, err := setEnv(client, envProc, env, false)
 	if err != nil {
 		return err
 	}
@@ -134,7 +144,7 @@ func runEnvGet(args *docopt.Args, client *controller.Client) error {
 	}
 
 	if v, ok := release.Env[arg]; ok {
-		fmt.Println(v)
+		fmt.Println(envValue(v))
 		return nil
 	}
 	if v, ok := release.Processes[envProc].Env[arg]; ok {
@@ -145,7 +155,17 @@ func runEnvGet(args *docopt.Args, client *controller.Client) error {
 	return fmt.Errorf("var %q not found in release %q", arg, release.ID)
 }
 
-func setEnv(client *controller.Client, proc string, env map[string]*string) (string, error) {
+// envValue returns v, or a placeholder if it is a sealed secret.
+func envValue(v string) string {
+	if secrets.IsSealed(v) {
+		return "<secret>"
+	}
+	return v
+}
+
+// setEnv creates and deploys a release with env applied to the current
+// release, if secret is true the values set are release secrets.
+func setEnv(client *controller.Client, proc string, env map[string]*string, secret bool) (string, error) {
 	release, err := client.GetAppRelease(mustApp())
 	if err == controller.ErrNotFound {
 		release = &ct.Release{}
@@ -179,7 +199,18 @@ func setEnv(client *controller.Client, proc string, env map[string]*string) (str
 			delete(dest, k)
 		} else {
 			dest[k] = *v
+			if secret {
+				release.Secrets = append(release.Secrets, k)
+			}
+		}
+	}
+	if secret && release.AppID == "" {
+		// secrets are sealed for the app of the release
+		app, err := client.GetApp(mustApp())
+		if err != nil {
+			return "", err
 		}
+		release.AppID = app.ID
 	}
 
 	release.ID = ""
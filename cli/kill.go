@@ -2,21 +2,43 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/host/types"
 )
 
 func init() {
 	register("kill", runKill, `
-usage: flynn kill <job>
+usage: flynn kill [-s <signal>] [-g <grace-period>] <job>
 
-Kill a job.`)
+Kill a job.
+
+The job is sent the signal and killed if it hasn't exited after the grace
+period, which defaults to the kill timeout of its process type.
+
+Options:
+	-s, --signal <signal>              signal to send the job, TERM, QUIT or KILL [default: TERM]
+	-g, --grace-period <grace-period>  time to wait for the job to exit before killing it, e.g. 30s
+
+Examples:
+
+	$ flynn kill -s QUIT -g 1m flynn-bb8d56d3c4a8422c9e5e1fd6d1e0d8f4
+	Job flynn-bb8d56d3c4a8422c9e5e1fd6d1e0d8f4 killed.`)
 }
 
 func runKill(args *docopt.Args, client *controller.Client) error {
 	job := args.String["<job>"]
-	if err := client.DeleteJob(mustApp(), job); err != nil {
+	opts := &host.StopOptions{Signal: args.String["--signal"]}
+	if s := args.String["--grace-period"]; s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		opts.GracePeriod = d
+	}
+	if err := client.StopJob(mustApp(), job, opts); err != nil {
 		return err
 	}
 	log.Printf("Job %s killed.", job)
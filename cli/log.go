@@ -1,28 +1,59 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/logaggregator/types"
 	"github.com/flynn/flynn/pkg/cluster"
 )
 
 func init() {
 	register("log", runLog, `
-usage: flynn log [options] <job>
+usage: flynn log [options] [<job>]
 
-Stream log for a specific job.
+Stream the log of the app, or of a specific job.
+
+The log of the app contains the output of all of its jobs, ordered by the time
+it was written, with each line prefixed by the time, process type and ID of
+the job which wrote it. Deployment progress is included as flynn[deployer]
+lines.
 
 Options:
 	-s, --split-stderr  send stderr lines to stderr
 	-f, --follow        stream new lines after printing log buffer
+	-n, --lines=<n>     only print the most recent n lines of the log buffer
+	--since=<time>      only print lines written after an RFC3339 time
 `)
 }
 
 func runLog(args *docopt.Args, client *controller.Client) error {
-	rc, err := client.GetJobLog(mustApp(), args.String["<job>"], args.Bool["--follow"])
+	if args.String["<job>"] == "" {
+		return runAppLog(args, client)
+	}
+	opts := &ct.JobLogOptions{Follow: args.Bool["--follow"]}
+	if s := args.String["--lines"]; s != "" {
+		lines, err := strconv.Atoi(s)
+		if err != nil || lines < 1 {
+			return fmt.Errorf("invalid --lines %q", s)
+		}
+		opts.Lines = lines
+	}
+	if s := args.String["--since"]; s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("invalid --since %q, expected an RFC3339 time", s)
+		}
+		opts.Since = &since
+	}
+	rc, err := client.GetJobLogWithOptions(mustApp(), args.String["<job>"], opts)
 	if err != nil {
 		return err
 	}
@@ -37,3 +68,59 @@ func runLog(args *docopt.Args, client *controller.Client) error {
 	attachClient.Receive(os.Stdout, stderr)
 	return nil
 }
+
+func runAppLog(args *docopt.Args, client *controller.Client) error {
+	opts := &logagg.LogOpts{Follow: args.Bool["--follow"]}
+	if s := args.String["--lines"]; s != "" {
+		lines, err := strconv.Atoi(s)
+		if err != nil || lines < 1 {
+			return fmt.Errorf("invalid --lines %q", s)
+		}
+		opts.Lines = lines
+	}
+	var since time.Time
+	if s := args.String["--since"]; s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("invalid --since %q, expected an RFC3339 time", s)
+		}
+	}
+	rc, err := client.GetAppLog(mustApp(), opts)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var stderr io.Writer = os.Stdout
+	if args.Bool["--split-stderr"] {
+		stderr = os.Stderr
+	}
+	dec := json.NewDecoder(rc)
+	for {
+		msg := &logagg.Message{}
+		if err := dec.Decode(msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Timestamp.Before(since) {
+			continue
+		}
+		var w io.Writer = os.Stdout
+		if msg.Stream == logagg.StreamStderr {
+			w = stderr
+		}
+		typ, id := msg.ProcessType, msg.JobID
+		switch {
+		case msg.Source != "":
+			// messages written by the platform, such as deployment
+			// progress
+			typ, id = "flynn", msg.Source
+		case typ == "":
+			typ = "run"
+		}
+		fmt.Fprintf(w, "%s %s[%s]: %s\n", msg.Timestamp.Format(time.RFC3339), typ, id, msg.Msg)
+	}
+}
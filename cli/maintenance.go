@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("maintenance", runMaintenance, `
+usage: flynn maintenance
+       flynn maintenance on [--page=<file>]
+       flynn maintenance off
+
+Manage the maintenance mode of an app.
+
+While an app is in maintenance mode its HTTP routes return a 503 maintenance
+page rather than proxying requests to the app.
+
+Omitting the arguments will show whether maintenance mode is on.
+
+Options:
+	-p, --page=<file>  HTML file to return instead of the default maintenance page
+
+Examples:
+
+	$ flynn maintenance on
+	Maintenance mode on.
+
+	$ flynn maintenance
+	on
+
+	$ flynn maintenance off
+	Maintenance mode off.
+`)
+}
+
+func runMaintenance(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["on"] || args.Bool["off"] {
+		maintenance := &ct.AppMaintenance{Enabled: args.Bool["on"]}
+		if file := args.String["--page"]; file != "" {
+			page, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			maintenance.Page = string(page)
+		}
+		if err := client.SetAppMaintenance(mustApp(), maintenance); err != nil {
+			return err
+		}
+		if maintenance.Enabled {
+			log.Println("Maintenance mode on.")
+		} else {
+			log.Println("Maintenance mode off.")
+		}
+		return nil
+	}
+
+	app, err := client.GetApp(mustApp())
+	if err != nil {
+		return err
+	}
+	if app.Maintenance != nil {
+		fmt.Println("on")
+	} else {
+		fmt.Println("off")
+	}
+	return nil
+}
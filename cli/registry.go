@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("registry", runRegistry, `
+usage: flynn registry
+       flynn registry set <host> <username>
+       flynn registry unset <host>
+
+Manage the credentials used to pull images from private registries.
+
+Commands:
+	With no arguments, shows a list of the registries with credentials.
+
+	set    set the credentials of a registry
+
+		The password is read from $FLYNN_REGISTRY_PASSWORD. The credentials
+		are used for the images of artifacts on the registry which don't
+		have credentials of their own.
+
+	unset  remove the credentials of a registry
+
+Examples:
+
+	$ FLYNN_REGISTRY_PASSWORD=secret flynn registry set registry.example.com deploy
+	$ flynn registry
+	HOST                  USERNAME
+	registry.example.com  deploy
+`)
+}
+
+func runRegistry(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["set"] {
+		return runRegistrySet(args, client)
+	} else if args.Bool["unset"] {
+		return client.DeleteRegistry(args.String["<host>"])
+	}
+
+	registries, err := client.RegistryList()
+	if err != nil {
+		return err
+	}
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "HOST", "USERNAME")
+	for _, r := range registries {
+		listRec(w, r.Host, r.Username)
+	}
+	return nil
+}
+
+func runRegistrySet(args *docopt.Args, client *controller.Client) error {
+	password := os.Getenv("FLYNN_REGISTRY_PASSWORD")
+	if password == "" {
+		return errors.New("FLYNN_REGISTRY_PASSWORD must be set")
+	}
+	registry, err := client.SetRegistry(args.String["<host>"], args.String["<username>"], password)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Set credentials for %s.\n", registry.Host)
+	return nil
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
@@ -13,15 +15,20 @@ import (
 
 func init() {
 	register("release", runRelease, `
-usage: flynn release add [-t <type>] [-f <file>] <uri>
+usage: flynn release
+       flynn release add [-t <type>] [-f <file>] [-m <description>] [-u <username>] <uri>
 
 Manage app releases.
 
 Options:
-	-t <type>          type of the release. Currently only 'docker' is supported. [default: docker]
-	-f, --file <file>  release configuration file
+	-t <type>                      type of the release. Currently only 'docker' is supported. [default: docker]
+	-f, --file <file>              release configuration file
+	-m, --description <description>  summary of the changes in the release
+	-u, --username <username>      username to pull the image from a private registry with, the password is read from $FLYNN_REGISTRY_PASSWORD
 
 Commands:
+	With no arguments, shows a list of the app's deployed releases, newest first.
+
 	add   add a new release
 
 		Create a new release from a Docker image.
@@ -31,6 +38,10 @@ Commands:
 		release environment and processes (similar to a Procfile). It can take any
 		of the arguments the controller Release type can take.
 
+		Images on a private registry are pulled with the credentials given
+		by --username and $FLYNN_REGISTRY_PASSWORD, or else with those set for
+		the registry using 'flynn registry set'.
+
 Examples:
 
 	Release an echo server using the flynn/slugbuilder image as a base, running socat.
@@ -60,7 +71,36 @@ func runRelease(args *docopt.Args, client *controller.Client) error {
 			return fmt.Errorf("Release type %s not supported.", args.String["-t"])
 		}
 	}
-	return fmt.Errorf("Top-level command not implemented.")
+	return runReleaseList(client)
+}
+
+func runReleaseList(client *controller.Client) error {
+	deployments, err := client.DeploymentList(mustApp())
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "ID", "CREATED", "CREATED BY", "DESCRIPTION")
+	seen := make(map[string]struct{}, len(deployments))
+	for _, d := range deployments {
+		if _, ok := seen[d.NewReleaseID]; ok {
+			continue
+		}
+		seen[d.NewReleaseID] = struct{}{}
+		release, err := client.GetRelease(d.NewReleaseID)
+		if err != nil {
+			return err
+		}
+		var created string
+		if release.CreatedAt != nil {
+			created = release.CreatedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		listRec(w, release.ID, created, release.CreatedBy, release.Description)
+	}
+	return nil
 }
 
 func runReleaseAddDocker(args *docopt.Args, client *controller.Client) error {
@@ -79,11 +119,24 @@ func runReleaseAddDocker(args *docopt.Args, client *controller.Client) error {
 		Type: "docker",
 		URI:  args.String["<uri>"],
 	}
+	if username := args.String["--username"]; username != "" {
+		password := os.Getenv("FLYNN_REGISTRY_PASSWORD")
+		if password == "" {
+			return errors.New("FLYNN_REGISTRY_PASSWORD must be set when --username is given")
+		}
+		artifact.Credentials = &ct.RegistryCredentials{Username: username, Password: password}
+	}
 	if err := client.CreateArtifact(artifact); err != nil {
 		return err
 	}
 
 	release.ArtifactID = artifact.ID
+	if desc := args.String["--description"]; desc != "" {
+		release.Description = desc
+	}
+	if release.CreatedBy == "" {
+		release.CreatedBy = os.Getenv("USER")
+	}
 	if err := client.CreateRelease(release); err != nil {
 		return err
 	}
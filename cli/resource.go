@@ -41,7 +41,7 @@ func runResourceAdd(args *docopt.Args, client *controller.Client) error {
 		env[k] = &s
 	}
 
-	releaseID, err := setEnv(client, "", env)
+	releaseID, err := setEnv(client, "", env, false)
 	if err != nil {
 		return err
 	}
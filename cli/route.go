@@ -11,6 +11,7 @@ import (
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -24,7 +25,7 @@ usage: flynn route
 Manage routes for application.
 
 Options:
-	-s, --service <service>    service name to route domain to (defaults to APPNAME-web)
+	-s, --service <service>    service name to route domain to (defaults to the web service of the app)
 	-c, --tls-cert <tls-cert>  path to PEM encoded certificate for TLS, - for stdin (http only)
 	-k, --tls-key <tls-key>    path to PEM encoded private key for TLS, - for stdin (http only)
 	--sticky                   enable cookie-based sticky routing (http only)
@@ -88,9 +89,9 @@ func runRoute(args *docopt.Args, client *controller.Client) error {
 }
 
 func runRouteAddTCP(args *docopt.Args, client *controller.Client) error {
-	service := args.String["--service"]
-	if service == "" {
-		service = mustApp() + "-web"
+	service, err := routeService(args, client)
+	if err != nil {
+		return err
 	}
 
 	hr := &router.TCPRoute{Service: service}
@@ -107,9 +108,9 @@ func runRouteAddHTTP(args *docopt.Args, client *controller.Client) error {
 	var tlsCert []byte
 	var tlsKey []byte
 
-	service := args.String["--service"]
-	if service == "" {
-		service = mustApp() + "-web"
+	service, err := routeService(args, client)
+	if err != nil {
+		return err
 	}
 
 	tlsCertPath := args.String["--tls-cert"]
@@ -152,6 +153,29 @@ func runRouteAddHTTP(args *docopt.Args, client *controller.Client) error {
 	return nil
 }
 
+// routeService returns the --service argument, or the service of the web
+// process of the app's current release, which apps created before web services
+// were named after app IDs still use.
+func routeService(args *docopt.Args, client *controller.Client) (string, error) {
+	if service := args.String["--service"]; service != "" {
+		return service, nil
+	}
+	app, err := client.GetApp(mustApp())
+	if err != nil {
+		return "", err
+	}
+	release, err := client.GetAppRelease(app.ID)
+	if err != nil && err != controller.ErrNotFound {
+		return "", err
+	}
+	if release != nil {
+		if ports := release.Processes["web"].Ports; len(ports) > 0 && ports[0].Service != nil {
+			return ports[0].Service.Name, nil
+		}
+	}
+	return ct.AppWebService(app.ID), nil
+}
+
 func readPEM(typ string, path string, stdin []byte) ([]byte, error) {
 	if path == "-" {
 		var buf bytes.Buffer
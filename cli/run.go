@@ -20,7 +20,7 @@ import (
 
 func init() {
 	cmd := register("run", runRun, `
-usage: flynn run [-d] [-r <release>] [-e <entrypoint>] [--] <command> [<argument>...]
+usage: flynn run [-d] [-r <release>] [-e <entrypoint>] [-w <dir>] [-u <user>] [--] <command> [<argument>...]
 
 Run a job.
 
@@ -28,6 +28,14 @@ Options:
 	-d, --detached   run job without connecting io streams
 	-r <release>     id of release to run (defaults to current app release)
 	-e <entrypoint>  overwrite the default entrypoint of the release's image
+	-w <dir>         overwrite the working directory of the release's image
+	-u <user>        name or UID of the user to run the command as
+
+Examples:
+
+	Debug an image whose entrypoint doesn't run arbitrary commands:
+
+	$ flynn run -e /bin/sh -u root -- -c 'ls /app'
 `)
 	cmd.optsFirst = true
 }
@@ -57,6 +65,8 @@ func runRun(args *docopt.Args, client *controller.Client) error {
 	if args.String["-e"] != "" {
 		req.Entrypoint = []string{args.String["-e"]}
 	}
+	req.WorkingDir = args.String["-w"]
+	req.User = args.String["-u"]
 	if req.TTY {
 		ws, err := term.GetWinsize(os.Stdin.Fd())
 		if err != nil {
@@ -95,18 +105,7 @@ func runRun(args *docopt.Args, client *controller.Client) error {
 		}
 		// Restore the terminal if we return without calling os.Exit
 		defer term.RestoreTerminal(os.Stdin.Fd(), termState)
-		go func() {
-			ch := make(chan os.Signal, 1)
-			signal.Notify(ch, SIGWINCH)
-			for range ch {
-				ws, err := term.GetWinsize(os.Stdin.Fd())
-				if err != nil {
-					return
-				}
-				attachClient.ResizeTTY(ws.Height, ws.Width)
-				attachClient.Signal(int(SIGWINCH))
-			}
-		}()
+		go forwardResize(attachClient)
 	}
 
 	go func() {
@@ -139,3 +138,18 @@ func runRun(args *docopt.Args, client *controller.Client) error {
 
 	panic("unreached")
 }
+
+// forwardResize resizes the TTY of the attached job whenever the terminal is
+// resized.
+func forwardResize(attachClient cluster.AttachClient) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, SIGWINCH)
+	for range ch {
+		ws, err := term.GetWinsize(os.Stdin.Fd())
+		if err != nil {
+			return
+		}
+		attachClient.ResizeTTY(ws.Height, ws.Width)
+		attachClient.Signal(int(SIGWINCH))
+	}
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/name"
 	"github.com/flynn/flynn/controller/schema"
 	ct "github.com/flynn/flynn/controller/types"
-	"github.com/flynn/flynn/pkg/ctxhelper"
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
@@ -21,20 +24,26 @@ import (
 )
 
 type AppRepo struct {
-	router        routerc.Client
-	defaultDomain string
+	router   routerc.Client
+	settings *SettingsRepo
 
 	db *postgres.DB
 }
 
 type appUpdate map[string]interface{}
 
-func NewAppRepo(db *postgres.DB, defaultDomain string, router routerc.Client) *AppRepo {
-	return &AppRepo{db: db, defaultDomain: defaultDomain, router: router}
+func NewAppRepo(db *postgres.DB, settings *SettingsRepo, router routerc.Client) *AppRepo {
+	return &AppRepo{db: db, settings: settings, router: router}
 }
 
 var appNamePattern = regexp.MustCompile(`^[a-z\d]+(-[a-z\d]+)*$`)
 
+// validAppName reports whether name can be used as an app name. "import" is
+// reserved as POST /apps/import imports apps rather than updating an app.
+func validAppName(name string) bool {
+	return len(name) <= 100 && appNamePattern.MatchString(name) && name != "import"
+}
+
 func (r *AppRepo) Add(data interface{}) error {
 	app := data.(*ct.App)
 	if app.Name == "" {
@@ -44,24 +53,59 @@ func (r *AppRepo) Add(data interface{}) error {
 		}
 		app.Name = name.Get(nameID)
 	}
-	if len(app.Name) > 100 || !appNamePattern.MatchString(app.Name) {
+	if !validAppName(app.Name) {
 		return ct.ValidationError{Field: "name", Message: "is invalid"}
 	}
 	if app.ID == "" {
 		app.ID = random.UUID()
 	}
 	if app.Strategy == "" {
-		app.Strategy = "all-at-once"
+		app.Strategy = r.settings.Value(ct.SettingDefaultDeployStrategy)
+	}
+	if app.DeployBatchSize < 0 {
+		return ct.ValidationError{Field: "deploy_batch_size", Message: "must not be negative"}
+	}
+	var batchSize *int
+	if app.DeployBatchSize > 0 {
+		batchSize = &app.DeployBatchSize
+	}
+	var schedulingStrategy *string
+	if app.SchedulingStrategy != "" {
+		if !validSchedulingStrategy(app.SchedulingStrategy) {
+			return ct.ValidationError{Field: "scheduling_strategy", Message: "must be spread or bin-pack"}
+		}
+		schedulingStrategy = &app.SchedulingStrategy
 	}
 	meta := metaToHstore(app.Meta)
-	if err := r.db.QueryRow("INSERT INTO apps (app_id, name, protected, meta, strategy) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at", app.ID, app.Name, app.Protected, meta, app.Strategy).Scan(&app.CreatedAt, &app.UpdatedAt); err != nil {
+	quota, err := quotaJSON(app.Quota)
+	if err != nil {
+		return err
+	}
+	policy, err := policyJSON(app.Policy)
+	if err != nil {
+		return err
+	}
+	var namespaceID *string
+	var nsName string
+	if app.NamespaceID != "" {
+		if err := r.db.QueryRow("SELECT name FROM namespaces WHERE namespace_id = $1", app.NamespaceID).Scan(&nsName); err == sql.ErrNoRows {
+			return ct.ValidationError{Field: "namespace", Message: "does not exist"}
+		} else if err != nil {
+			return err
+		}
+		namespaceID = &app.NamespaceID
+	}
+	err = r.db.QueryRow("INSERT INTO apps (app_id, name, namespace_id, protected, meta, strategy, deploy_batch_size, quota, policy, scheduling_strategy) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING created_at, updated_at", app.ID, app.Name, namespaceID, app.Protected, meta, app.Strategy, batchSize, quota, policy, schedulingStrategy).Scan(&app.CreatedAt, &app.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ct.ValidationError{Field: "name", Message: "is already in use"}
+	} else if err != nil {
 		return err
 	}
 	app.ID = postgres.CleanUUID(app.ID)
-	if !app.Protected && r.defaultDomain != "" {
+	if domain := r.defaultRouteDomain(app.Name, nsName); !app.Protected && domain != "" {
 		route := (&router.HTTPRoute{
-			Domain:  fmt.Sprintf("%s.%s", app.Name, r.defaultDomain),
-			Service: app.Name + "-web",
+			Domain:  domain,
+			Service: ct.AppWebService(app.ID),
 		}).ToRoute()
 		route.ParentRef = routeParentRef(app.ID)
 		if err := r.router.CreateRoute(route); err != nil {
@@ -71,13 +115,267 @@ func (r *AppRepo) Add(data interface{}) error {
 	return nil
 }
 
+// defaultRouteDomain returns the domain of the default route of an app named
+// appName in the namespace named nsName, or an empty string if there is no
+// default route domain.
+func (r *AppRepo) defaultRouteDomain(appName, nsName string) string {
+	domain := r.settings.Value(ct.SettingDefaultRouteDomain)
+	if domain == "" {
+		return ""
+	}
+	if nsName != "" {
+		// app names are only unique within a namespace, so the
+		// namespace is included in the default domain
+		domain = nsName + "." + domain
+	}
+	return appName + "." + domain
+}
+
+// appDefaultRouteDomain returns the domain of the default route of app, or an
+// empty string if there is no default route domain.
+func (r *AppRepo) appDefaultRouteDomain(app *ct.App) (string, error) {
+	var nsName string
+	if app.NamespaceID != "" {
+		if err := r.db.QueryRow("SELECT name FROM namespaces WHERE namespace_id = $1", app.NamespaceID).Scan(&nsName); err != nil {
+			return "", err
+		}
+	}
+	return r.defaultRouteDomain(app.Name, nsName), nil
+}
+
+// Rename changes the name of the app and moves its default route to the
+// domain of the new name. The route keeps its service, which is named after
+// the app ID, so traffic to the app isn't interrupted, and an app which takes
+// the old name gets its own service.
+func (r *AppRepo) Rename(id, newName string) (*ct.App, error) {
+	if !validAppName(newName) {
+		return nil, ct.ValidationError{Field: "name", Message: "is invalid"}
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	app, err := selectApp(tx, id, "", true)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if app.Protected {
+		tx.Rollback()
+		return nil, ct.ValidationError{Field: "name", Message: "cannot be changed for protected apps"}
+	}
+	if app.Policy != nil && app.Policy.LockRoutes {
+		// renaming replaces the default route
+		tx.Rollback()
+		return nil, errRoutesLocked
+	}
+	if app.Name == newName {
+		tx.Rollback()
+		return app, nil
+	}
+	var nsName string
+	if app.NamespaceID != "" {
+		if err := tx.QueryRow("SELECT name FROM namespaces WHERE namespace_id = $1", app.NamespaceID).Scan(&nsName); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.QueryRow("UPDATE apps SET name = $2, updated_at = now() WHERE app_id = $1 RETURNING updated_at", app.ID, newName).Scan(&app.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		tx.Rollback()
+		return nil, ct.ValidationError{Field: "name", Message: "is already in use"}
+	} else if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	oldDomain := r.defaultRouteDomain(app.Name, nsName)
+	app.Name = newName
+	if newDomain := r.defaultRouteDomain(app.Name, nsName); oldDomain != "" {
+		r.moveDefaultRoute(app.ID, oldDomain, newDomain)
+	}
+	return app, nil
+}
+
+// moveDefaultRoute replaces the HTTP route of the app for oldDomain with an
+// identical one for newDomain, as the domain of a route can't be updated.
+func (r *AppRepo) moveDefaultRoute(appID, oldDomain, newDomain string) {
+	routes, err := r.router.ListRoutes(routeParentRef(appID))
+	if err != nil {
+		log.Printf("Error listing routes of renamed app %s: %s", appID, err)
+		return
+	}
+	for _, route := range routes {
+		if route.Type != "http" || !strings.EqualFold(route.Domain, oldDomain) {
+			continue
+		}
+		moved := *route
+		moved.ID = ""
+		moved.Domain = newDomain
+		moved.CreatedAt = time.Time{}
+		moved.UpdatedAt = time.Time{}
+		// create the new route first so the app stays reachable
+		if err := r.router.CreateRoute(&moved); err != nil {
+			log.Printf("Error creating default route %s of renamed app %s: %s", newDomain, appID, err)
+			return
+		}
+		if err := r.router.DeleteRoute(route.Type, route.ID); err != nil {
+			log.Printf("Error deleting default route %s of renamed app %s: %s", oldDomain, appID, err)
+		}
+	}
+}
+
+// quotaJSON encodes quota for storing in the apps table, an unset quota is
+// stored as NULL.
+func quotaJSON(quota *ct.AppQuota) (*string, error) {
+	if quota == nil || *quota == (ct.AppQuota{}) {
+		return nil, nil
+	}
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// policyJSON encodes policy for storing in the apps table, an unset policy is
+// stored as NULL.
+func policyJSON(policy *ct.AppPolicy) (*string, error) {
+	if policy == nil || len(policy.MinProcesses) == 0 && !policy.LockRelease && !policy.LockRoutes {
+		return nil, nil
+	}
+	for typ, n := range policy.MinProcesses {
+		if n < 0 {
+			return nil, ct.ValidationError{Field: "policy.min_processes." + typ, Message: "must not be negative"}
+		}
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// checkFormationPolicy returns a validation error if formation, the process
+// counts of a formation of release, or processes, the counts of the app's
+// processes from appProcesses, don't meet the policy of the app.
+func checkFormationPolicy(app *ct.App, release *ct.Release, formation, processes map[string]int) error {
+	for typ := range release.Processes {
+		if err := checkProcessPolicy(app, typ, formation[typ], processes[typ]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appProcesses returns the number of processes of each type the app of
+// formation runs across all of its formations once formation is set. The
+// policy is checked against these totals so that deployments can scale down
+// the formation of the old release as the new one is scaled up.
+func (c *controllerAPI) appProcesses(formation *ct.Formation) (map[string]int, error) {
+	formations, err := c.formationRepo.List(formation.AppID)
+	if err != nil {
+		return nil, err
+	}
+	processes := make(map[string]int, len(formation.Processes))
+	for typ, n := range formation.Processes {
+		processes[typ] += n
+	}
+	for _, f := range formations {
+		if f.ReleaseID == formation.ReleaseID {
+			continue
+		}
+		for typ, n := range f.Processes {
+			processes[typ] += n
+		}
+	}
+	return processes, nil
+}
+
+// checkProcessPolicy checks the n processes of type typ of a formation, of
+// which the app runs total across all of its formations. Protected apps must
+// run a process of each type in every formation, while the minimums of the
+// app's policy apply to the total, so that deployments can scale down the old
+// formation as the new one is scaled up.
+func checkProcessPolicy(app *ct.App, typ string, n, total int) error {
+	if app.Protected && n == 0 {
+		return ct.ValidationError{Message: "unable to scale to zero, app is protected"}
+	}
+	if min := app.MinProcessCount(typ); total < min {
+		return ct.ValidationError{
+			Field:   "processes." + typ,
+			Message: fmt.Sprintf("must be at least %d, required by the app policy", min),
+		}
+	}
+	return nil
+}
+
+// errReleaseLocked is returned when changing the release of an app whose
+// policy locks it.
+var errReleaseLocked = ct.ValidationError{Message: "the release of the app is locked by its policy"}
+
+// errRoutesLocked is returned when removing a route of an app whose policy
+// locks its routes.
+var errRoutesLocked = ct.ValidationError{Message: "the routes of the app are locked by its policy"}
+
+// checkFormationQuota returns a validation error if formation has more
+// processes than quota allows.
+func checkFormationQuota(quota *ct.AppQuota, formation *ct.Formation) error {
+	total := 0
+	for typ, n := range formation.Processes {
+		if quota.MaxProcessType > 0 && n > quota.MaxProcessType {
+			return ct.ValidationError{
+				Field:   "processes." + typ,
+				Message: fmt.Sprintf("exceeds the app quota of %d processes per type", quota.MaxProcessType),
+			}
+		}
+		total += n
+	}
+	if quota.MaxProcesses > 0 && total > quota.MaxProcesses {
+		return ct.ValidationError{
+			Field:   "processes",
+			Message: fmt.Sprintf("exceeds the app quota of %d processes", quota.MaxProcesses),
+		}
+	}
+	return nil
+}
+
 func scanApp(s postgres.Scanner) (*ct.App, error) {
 	app := &ct.App{}
 	var meta hstore.Hstore
-	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &app.Strategy, &app.CreatedAt, &app.UpdatedAt)
+	var namespaceID, quota, maintenance, policy, schedulingStrategy *string
+	var batchSize sql.NullInt64
+	err := s.Scan(&app.ID, &app.Name, &namespaceID, &app.Protected, &meta, &app.Strategy, &batchSize, &quota, &maintenance, &policy, &schedulingStrategy, &app.CreatedAt, &app.UpdatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
+	app.DeployBatchSize = int(batchSize.Int64)
+	if schedulingStrategy != nil {
+		app.SchedulingStrategy = *schedulingStrategy
+	}
+	if quota != nil {
+		app.Quota = &ct.AppQuota{}
+		if err := json.Unmarshal([]byte(*quota), app.Quota); err != nil {
+			return nil, err
+		}
+	}
+	if maintenance != nil {
+		app.Maintenance = &ct.AppMaintenance{}
+		if err := json.Unmarshal([]byte(*maintenance), app.Maintenance); err != nil {
+			return nil, err
+		}
+	}
+	if policy != nil {
+		app.Policy = &ct.AppPolicy{}
+		if err := json.Unmarshal([]byte(*policy), app.Policy); err != nil {
+			return nil, err
+		}
+	}
 	if len(meta.Map) > 0 {
 		app.Meta = make(map[string]string, len(meta.Map))
 		for k, v := range meta.Map {
@@ -85,6 +383,9 @@ func scanApp(s postgres.Scanner) (*ct.App, error) {
 		}
 	}
 	app.ID = postgres.CleanUUID(app.ID)
+	if namespaceID != nil {
+		app.NamespaceID = postgres.CleanUUID(*namespaceID)
+	}
 	return app, err
 }
 
@@ -94,23 +395,37 @@ type rowQueryer interface {
 	QueryRow(query string, args ...interface{}) postgres.Scanner
 }
 
-func selectApp(db rowQueryer, id string, update bool) (*ct.App, error) {
+// selectApp returns the app with the given ID or name. Names are resolved in
+// the namespace with namespaceID, or among apps without a namespace if it is
+// empty. If namespaceID is set, apps in other namespaces are not returned.
+func selectApp(db rowQueryer, id, namespaceID string, update bool) (*ct.App, error) {
 	var row postgres.Scanner
-	query := "SELECT app_id, name, protected, meta, strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
+	query := "SELECT app_id, name, namespace_id, protected, meta, strategy, deploy_batch_size, quota, maintenance, policy, scheduling_strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
 	var suffix string
 	if update {
 		suffix = " FOR UPDATE"
 	}
-	if idPattern.MatchString(id) {
-		row = db.QueryRow(query+"(app_id = $1 OR name = $2) LIMIT 1"+suffix, id, id)
-	} else {
-		row = db.QueryRow(query+"name = $1"+suffix, id)
+	switch {
+	case namespaceID == "" && idPattern.MatchString(id):
+		row = db.QueryRow(query+"(app_id = $1 OR (name = $2 AND namespace_id IS NULL)) LIMIT 1"+suffix, id, id)
+	case namespaceID == "":
+		row = db.QueryRow(query+"name = $1 AND namespace_id IS NULL"+suffix, id)
+	case idPattern.MatchString(id):
+		row = db.QueryRow(query+"(app_id = $1 OR name = $2) AND namespace_id = $3 LIMIT 1"+suffix, id, id, namespaceID)
+	default:
+		row = db.QueryRow(query+"name = $1 AND namespace_id = $2"+suffix, id, namespaceID)
 	}
 	return scanApp(row)
 }
 
 func (r *AppRepo) Get(id string) (interface{}, error) {
-	return selectApp(r.db, id, false)
+	return selectApp(r.db, id, "", false)
+}
+
+// Lookup returns the app with the given ID or name in the namespace with
+// namespaceID, see selectApp.
+func (r *AppRepo) Lookup(id, namespaceID string) (*ct.App, error) {
+	return selectApp(r.db, id, namespaceID, false)
 }
 
 func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, error) {
@@ -118,7 +433,7 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 	if err != nil {
 		return nil, err
 	}
-	app, err := selectApp(tx, id, true)
+	app, err := selectApp(tx, id, "", true)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -130,17 +445,66 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 			strategy, ok := v.(string)
 			if !ok {
 				tx.Rollback()
-				return nil, fmt.Errorf("controller: expected string, got %T", v)
+				return nil, ct.ValidationError{Field: "strategy", Message: fmt.Sprintf("must be a string, got %T", v)}
 			}
 			if _, err := tx.Exec("UPDATE apps SET strategy = $2, updated_at = now() WHERE app_id = $1", app.ID, strategy); err != nil {
 				tx.Rollback()
 				return nil, err
 			}
+		case "deploy_batch_size":
+			// zero resets the batch size to the default
+			var batchSize *int
+			if v != nil {
+				n, ok := v.(float64)
+				if !ok || n != float64(int(n)) || n < 0 {
+					tx.Rollback()
+					return nil, ct.ValidationError{Field: "deploy_batch_size", Message: "must be a positive integer"}
+				}
+				if n > 0 {
+					size := int(n)
+					batchSize = &size
+				}
+			}
+			if _, err := tx.Exec("UPDATE apps SET deploy_batch_size = $2, updated_at = now() WHERE app_id = $1", app.ID, batchSize); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			app.DeployBatchSize = 0
+			if batchSize != nil {
+				app.DeployBatchSize = *batchSize
+			}
+		case "scheduling_strategy":
+			// an empty strategy resets it to the cluster setting
+			var strategy *string
+			if v != nil {
+				s, ok := v.(string)
+				if !ok || (s != "" && !validSchedulingStrategy(s)) {
+					tx.Rollback()
+					return nil, ct.ValidationError{Field: "scheduling_strategy", Message: "must be spread or bin-pack"}
+				}
+				if s != "" {
+					strategy = &s
+				}
+			}
+			if _, err := tx.Exec("UPDATE apps SET scheduling_strategy = $2, updated_at = now() WHERE app_id = $1", app.ID, strategy); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			// touch the formations of the app so that the scheduler
+			// sees the new strategy in the formation stream
+			if _, err := tx.Exec("UPDATE formations SET updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", app.ID); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			app.SchedulingStrategy = ""
+			if strategy != nil {
+				app.SchedulingStrategy = *strategy
+			}
 		case "protected":
 			protected, ok := v.(bool)
 			if !ok {
 				tx.Rollback()
-				return nil, fmt.Errorf("controller: expected bool, got %T", v)
+				return nil, ct.ValidationError{Field: "protected", Message: fmt.Sprintf("must be a boolean, got %T", v)}
 			}
 			if app.Protected != protected {
 				if _, err := tx.Exec("UPDATE apps SET protected = $2, updated_at = now() WHERE app_id = $1", app.ID, protected); err != nil {
@@ -149,11 +513,59 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 				}
 				app.Protected = protected
 			}
+		case "quota":
+			data, err := json.Marshal(v)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			quota := &ct.AppQuota{}
+			if err := json.Unmarshal(data, quota); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			value, err := quotaJSON(quota)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if _, err := tx.Exec("UPDATE apps SET quota = $2, updated_at = now() WHERE app_id = $1", app.ID, value); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			app.Quota = nil
+			if value != nil {
+				app.Quota = quota
+			}
+		case "policy":
+			data, err := json.Marshal(v)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			policy := &ct.AppPolicy{}
+			if err := json.Unmarshal(data, policy); err != nil {
+				tx.Rollback()
+				return nil, ct.ValidationError{Field: "policy", Message: "is invalid"}
+			}
+			value, err := policyJSON(policy)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if _, err := tx.Exec("UPDATE apps SET policy = $2, updated_at = now() WHERE app_id = $1", app.ID, value); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			app.Policy = nil
+			if value != nil {
+				app.Policy = policy
+			}
 		case "meta":
 			data, ok := v.(map[string]interface{})
 			if !ok {
 				tx.Rollback()
-				return nil, fmt.Errorf("controller: expected map[string]interface{}, got %T", v)
+				return nil, ct.ValidationError{Field: "meta", Message: fmt.Sprintf("must be an object, got %T", v)}
 			}
 			var meta hstore.Hstore
 			meta.Map = make(map[string]sql.NullString, len(data))
@@ -162,7 +574,7 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 				s, ok := v.(string)
 				if !ok {
 					tx.Rollback()
-					return nil, fmt.Errorf("controller: expected string, got %T", v)
+					return nil, ct.ValidationError{Field: "meta." + k, Message: fmt.Sprintf("must be a string, got %T", v)}
 				}
 				meta.Map[k] = sql.NullString{String: s, Valid: true}
 				app.Meta[k] = s
@@ -184,7 +596,7 @@ func (r *AppRepo) Remove(id string) error {
 	}
 
 	if !idPattern.MatchString(id) {
-		app, err := selectApp(r.db, id, false)
+		app, err := selectApp(r.db, id, "", false)
 		if err != nil {
 			return err
 		}
@@ -209,21 +621,89 @@ func (r *AppRepo) Remove(id string) error {
 	return tx.Commit()
 }
 
-func (r *AppRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT app_id, name, protected, meta, strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *AppRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	query := "SELECT app_id, name, namespace_id, protected, meta, strategy, deploy_batch_size, quota, maintenance, policy, scheduling_strategy, created_at, updated_at FROM apps WHERE deleted_at IS NULL"
+	var args []interface{}
+	if len(opts.Labels) > 0 {
+		args = append(args, metaToHstore(opts.Labels))
+		query += fmt.Sprintf(" AND meta @> $%d", len(args))
+	}
+	if opts.Namespace != "" {
+		args = append(args, opts.Namespace)
+		query += fmt.Sprintf(" AND namespace_id = $%d", len(args))
+	}
+	query, args = opts.query(query, "app_id", args...)
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	apps := []*ct.App{}
 	for rows.Next() {
 		app, err := scanApp(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, nil, err
 		}
 		apps = append(apps, app)
 	}
-	return apps, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(apps)) {
+		apps = apps[:opts.Limit]
+		last := apps[len(apps)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return apps, next, nil
+}
+
+// SetMaintenance sets the maintenance mode of the app, which is cleared if
+// maintenance is not enabled.
+func (r *AppRepo) SetMaintenance(appID string, maintenance *ct.AppMaintenance) error {
+	var value *string
+	if maintenance.Enabled {
+		data, err := json.Marshal(maintenance)
+		if err != nil {
+			return err
+		}
+		s := string(data)
+		value = &s
+	}
+	return r.db.Exec("UPDATE apps SET maintenance = $2, updated_at = now() WHERE app_id = $1", appID, value)
+}
+
+// UpdateMeta merges meta into the metadata of the app, keys with a nil value
+// are removed. It returns the resulting metadata.
+func (r *AppRepo) UpdateMeta(appID string, meta map[string]*string) (map[string]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	app, err := selectApp(tx, appID, "", true)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if app.Meta == nil {
+		app.Meta = make(map[string]string, len(meta))
+	}
+	for k, v := range meta {
+		if k == "" {
+			tx.Rollback()
+			return nil, ct.ValidationError{Field: "meta", Message: "keys must not be empty"}
+		}
+		if v == nil {
+			delete(app.Meta, k)
+		} else {
+			app.Meta[k] = *v
+		}
+	}
+	if _, err := tx.Exec("UPDATE apps SET meta = $2, updated_at = now() WHERE app_id = $1", app.ID, metaToHstore(app.Meta)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return app.Meta, tx.Commit()
 }
 
 func (r *AppRepo) SetRelease(appID string, releaseID string) error {
@@ -235,9 +715,86 @@ func (r *AppRepo) GetRelease(id string) (*ct.Release, error) {
 	return scanRelease(row)
 }
 
-func (c *controllerAPI) UpdateApp(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
-	params, _ := ctxhelper.ParamsFromContext(ctx)
+// CreateApp creates an app. Apps created with a namespace scoped auth token
+// are always created in the token's namespace.
+func (c *controllerAPI) CreateApp(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var app ct.App
+	if err := httphelper.DecodeJSON(req, &app); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if namespaceID := tokenNamespace(ctx); namespaceID != "" {
+		app.NamespaceID = namespaceID
+	}
+	// quotas limit scoped tokens, so only full scope tokens can set them
+	if app.Quota != nil && !fullScope(ctx) {
+		respondWithError(w, errForbidden)
+		return
+	}
 
+	if err := schema.Validate(&app); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err := c.appRepo.Add(&app); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &app)
+}
+
+func (c *controllerAPI) GetApp(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	httphelper.JSON(w, 200, c.getApp(ctx))
+}
+
+// ListApps lists apps, only the apps in the namespace of a namespace scoped
+// auth token are listed.
+func (c *controllerAPI) ListApps(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if namespaceID := tokenNamespace(ctx); namespaceID != "" {
+		opts.Namespace = namespaceID
+	}
+	list, next, err := c.appRepo.List(opts)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if next != nil {
+		w.Header().Set("Link", nextPageLink(req, opts, next))
+	}
+	httphelper.JSON(w, 200, list)
+}
+
+func (c *controllerAPI) DeleteApp(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if err := c.appRepo.Remove(c.getApp(ctx).ID); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// RenameApp changes the name of the app, only the name of the request body is
+// used. Like other changes to the app, it emits an app event.
+func (c *controllerAPI) RenameApp(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var data ct.App
+	if err := httphelper.DecodeJSON(req, &data); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	app, err := c.appRepo.Rename(c.getApp(ctx).ID, data.Name)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, app)
+}
+
+func (c *controllerAPI) UpdateApp(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
 	var data appUpdate
 	if err := httphelper.DecodeJSON(req, &data); err != nil {
 		respondWithError(rw, err)
@@ -248,11 +805,107 @@ func (c *controllerAPI) UpdateApp(ctx context.Context, rw http.ResponseWriter, r
 		respondWithError(rw, err)
 		return
 	}
+	// quotas limit scoped tokens and policies protect apps from them, so
+	// only full scope tokens can change them. Clients send protected with
+	// every update, so it is only refused if it is changed.
+	if !fullScope(ctx) {
+		_, quota := data["quota"]
+		_, policy := data["policy"]
+		protected, ok := data["protected"]
+		if quota || policy || ok && protected != c.getApp(ctx).Protected {
+			respondWithError(rw, errForbidden)
+			return
+		}
+	}
 
-	app, err := c.appRepo.Update(params.ByName("apps_id"), data)
+	app, err := c.appRepo.Update(c.getApp(ctx).ID, data)
 	if err != nil {
 		respondWithError(rw, err)
 		return
 	}
 	httphelper.JSON(rw, 200, app)
 }
+
+// maxMaintenancePageSize is the maximum size of a custom maintenance page,
+// which is stored with the app and each of its HTTP routes.
+const maxMaintenancePageSize = 64 * 1024
+
+// PutAppMaintenance sets the maintenance mode of the app and propagates it to
+// the app's HTTP routes. The routes are updated before the app, and are
+// reverted if any of the updates fail.
+func (c *controllerAPI) PutAppMaintenance(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	app := c.getApp(ctx)
+
+	var maintenance ct.AppMaintenance
+	if err := httphelper.DecodeJSON(req, &maintenance); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !maintenance.Enabled {
+		maintenance.Page = ""
+	}
+	if len(maintenance.Page) > maxMaintenancePageSize {
+		respondWithError(w, ct.ValidationError{Field: "page", Message: fmt.Sprintf("must not be larger than %d bytes", maxMaintenancePageSize)})
+		return
+	}
+
+	routes, err := c.routerc.ListRoutes(routeParentRef(app.ID))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	// prev are the routes which have been updated, as they were before
+	var prev []*router.Route
+	revert := func() {
+		for _, route := range prev {
+			if err := c.routerc.UpdateRoute(route); err != nil {
+				log.Printf("Error reverting maintenance mode of route %s: %s", route.ID, err)
+			}
+		}
+	}
+	for _, route := range routes {
+		if route.Type != "http" {
+			continue
+		}
+		orig := *route
+		route.Maintenance = maintenance.Enabled
+		route.MaintenancePage = maintenance.Page
+		if err := c.routerc.UpdateRoute(route); err != nil {
+			revert()
+			respondWithError(w, err)
+			return
+		}
+		prev = append(prev, &orig)
+	}
+
+	if err := c.appRepo.SetMaintenance(app.ID, &maintenance); err != nil {
+		revert()
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &maintenance)
+}
+
+func (c *controllerAPI) GetAppMeta(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	meta := c.getApp(ctx).Meta
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	httphelper.JSON(w, 200, meta)
+}
+
+// PutAppMeta merges the key-value pairs in the request body into the app's
+// metadata, a key with a null value is removed.
+func (c *controllerAPI) PutAppMeta(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var meta map[string]*string
+	if err := httphelper.DecodeJSON(req, &meta); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	updated, err := c.appRepo.UpdateMeta(c.getApp(ctx).ID, meta)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, updated)
+}
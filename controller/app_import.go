@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+)
+
+// ImportApps creates or updates the apps in a list of app definitions. Each
+// app is imported independently, so the response contains a result for each
+// definition in the request and a failure to import one app doesn't prevent
+// the others from being imported.
+func (c *controllerAPI) ImportApps(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var defs []*ct.AppDefinition
+	if err := httphelper.DecodeJSON(req, &defs); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	names := make(map[string]struct{}, len(defs))
+	for i, def := range defs {
+		if def == nil || def.Name == "" {
+			respondWithError(w, ct.ValidationError{Field: fmt.Sprintf("%d.name", i), Message: "must not be blank"})
+			return
+		}
+		if _, ok := names[def.Name]; ok {
+			respondWithError(w, ct.ValidationError{Field: fmt.Sprintf("%d.name", i), Message: fmt.Sprintf("%q is defined more than once", def.Name)})
+			return
+		}
+		names[def.Name] = struct{}{}
+	}
+
+	results := make([]*ct.AppImportResult, len(defs))
+	for i, def := range defs {
+		result, err := c.importApp(ctx, def)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results[i] = result
+	}
+	httphelper.JSON(w, 200, results)
+}
+
+// importAppsOr handles POST /apps/import with ImportApps, and other requests
+// with handler, as the router can't route it separately from POST
+// /apps/:apps_id.
+func (c *controllerAPI) importAppsOr(handler httphelper.HandlerFunc) httphelper.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+		params, _ := ctxhelper.ParamsFromContext(ctx)
+		if params.ByName("apps_id") == "import" {
+			c.ImportApps(ctx, w, req)
+			return
+		}
+		handler(ctx, w, req)
+	}
+}
+
+// appImport is the set of changes needed to bring an app in line with its
+// definition, which are all checked before any of them are made.
+type appImport struct {
+	def    *ct.AppDefinition
+	result *ct.AppImportResult
+	actor  string
+
+	app         *ct.App
+	newApp      bool
+	prevRelease *ct.Release
+	release     *ct.Release
+	formation   *ct.Formation
+	routes      []*router.Route
+
+	// undo reverts the changes made so far, in reverse order
+	undo []func() error
+}
+
+func (c *controllerAPI) importApp(ctx context.Context, def *ct.AppDefinition) (*ct.AppImportResult, error) {
+	imp := &appImport{
+		def:    def,
+		result: &ct.AppImportResult{Name: def.Name},
+		actor:  requestActor(ctx),
+	}
+	if err := c.prepareAppImport(ctx, imp); err != nil {
+		return imp.result, err
+	}
+	if err := c.applyAppImport(imp); err != nil {
+		for i := len(imp.undo) - 1; i >= 0; i-- {
+			if err := imp.undo[i](); err != nil {
+				log.Printf("Error reverting import of app %s: %s", def.Name, err)
+			}
+		}
+		result := &ct.AppImportResult{Name: def.Name}
+		if !imp.newApp {
+			result.AppID = imp.app.ID
+		}
+		return result, err
+	}
+	return imp.result, nil
+}
+
+func (c *controllerAPI) prepareAppImport(ctx context.Context, imp *appImport) error {
+	def := imp.def
+	app, err := c.appRepo.Lookup(def.Name, tokenNamespace(ctx))
+	switch {
+	case err == ErrNotFound:
+		imp.newApp = true
+		// the ID is set here so that route domains can be verified
+		// before the app is created
+		app = &ct.App{ID: random.UUID(), Name: def.Name, NamespaceID: tokenNamespace(ctx)}
+		if !validAppName(app.Name) {
+			return ct.ValidationError{Field: "name", Message: "is invalid"}
+		}
+		if err := schema.Validate(app); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !authorizedForApp(ctx, app):
+		return errForbidden
+	default:
+		imp.prevRelease, err = c.appRepo.GetRelease(app.ID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	imp.app = app
+
+	release := &ct.Release{
+		ArtifactID: def.ArtifactID,
+		AppID:      app.ID,
+		Env:        def.Env,
+		Secrets:    def.Secrets,
+		Processes:  def.Processes,
+		CreatedBy:  imp.actor,
+	}
+	if prev := imp.prevRelease; prev != nil {
+		if release.ArtifactID == "" {
+			release.ArtifactID = prev.ArtifactID
+		}
+		if release.ArtifactID == prev.ArtifactID && reflect.DeepEqual(release.Env, prev.Env) && reflect.DeepEqual(release.Processes, prev.Processes) {
+			release = prev
+		}
+	}
+	if release != imp.prevRelease {
+		release.ID = random.UUID()
+		if release.ArtifactID == "" {
+			return ct.ValidationError{Field: "artifact", Message: "must be set"}
+		}
+		if _, err := c.artifactRepo.Get(release.ArtifactID); err == ErrNotFound {
+			return ct.ValidationError{Field: "artifact", Message: fmt.Sprintf("could not find artifact with ID %s", release.ArtifactID)}
+		} else if err != nil {
+			return err
+		}
+		if err := validateRelease(release); err != nil {
+			return err
+		}
+		if err := schema.Validate(release); err != nil {
+			return err
+		}
+		if app.Policy != nil && app.Policy.LockRelease {
+			return errReleaseLocked
+		}
+	}
+	imp.release = release
+
+	procs := def.Formation
+	if procs == nil && release != imp.prevRelease && imp.prevRelease != nil {
+		// keep the scale of the process types of the previous release
+		// which are still in the new one
+		prev, err := c.formationRepo.Get(app.ID, imp.prevRelease.ID)
+		if err == nil {
+			procs = make(map[string]int, len(prev.Processes))
+			for typ, n := range prev.Processes {
+				if _, ok := release.Processes[typ]; ok {
+					procs[typ] = n
+				}
+			}
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+	if procs != nil {
+		formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: procs}
+		for typ := range formation.Processes {
+			if _, ok := release.Processes[typ]; !ok {
+				return ct.ValidationError{Field: "formation." + typ, Message: "is not a process type of the release"}
+			}
+		}
+		// a new release of an existing app is deployed, which scales
+		// down the formation of the previous release, so only the new
+		// formation is counted
+		processes := formation.Processes
+		if release == imp.prevRelease {
+			processes, err = c.appProcesses(formation)
+			if err != nil {
+				return err
+			}
+		}
+		if err := checkFormationPolicy(app, release, formation.Processes, processes); err != nil {
+			return err
+		}
+		if app.Quota != nil {
+			if err := checkFormationQuota(app.Quota, formation); err != nil {
+				return err
+			}
+		}
+		imp.formation = formation
+	}
+
+	var existing []*router.Route
+	if !imp.newApp {
+		existing, err = c.routerc.ListRoutes(routeParentRef(app.ID))
+		if err != nil {
+			return err
+		}
+	}
+	for i, route := range def.Routes {
+		if route == nil {
+			continue
+		}
+		if routeExists(existing, route) {
+			continue
+		}
+		route.ID = ""
+		route.ParentRef = routeParentRef(app.ID)
+		if route.Type == "http" && app.Maintenance != nil {
+			route.Maintenance = true
+			route.MaintenancePage = app.Maintenance.Page
+		}
+		if err := schema.Validate(route); err != nil {
+			if e, ok := err.(ct.ValidationError); ok {
+				e.Field = fmt.Sprintf("routes.%d.%s", i, e.Field)
+				err = e
+			}
+			return err
+		}
+		if err := c.verifyRouteDomain(app, route); err != nil {
+			return err
+		}
+		imp.routes = append(imp.routes, route)
+		existing = append(existing, route)
+	}
+	return nil
+}
+
+// routeExists reports whether routes contains a route for the same domain as
+// route, or the same port for TCP routes.
+func routeExists(routes []*router.Route, route *router.Route) bool {
+	for _, r := range routes {
+		if r.Type != route.Type {
+			continue
+		}
+		if r.Type == "http" && strings.EqualFold(r.Domain, route.Domain) || r.Type == "tcp" && r.Port == route.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *controllerAPI) applyAppImport(imp *appImport) error {
+	app, result := imp.app, imp.result
+
+	if imp.newApp {
+		if err := c.appRepo.Add(app); err != nil {
+			return err
+		}
+		imp.undo = append(imp.undo, func() error {
+			if err := c.appRepo.Remove(app.ID); err != nil {
+				return err
+			}
+			return c.deleteAppRoutes(app.ID)
+		})
+		result.Created = true
+	}
+	result.AppID = app.ID
+
+	if imp.release != imp.prevRelease {
+		if err := c.releaseRepo.Add(imp.release); err != nil {
+			return err
+		}
+		release := imp.release
+		imp.undo = append(imp.undo, func() error {
+			return c.releaseRepo.RemoveUnused(release.ID)
+		})
+		result.ReleaseCreated = true
+	}
+	result.ReleaseID = imp.release.ID
+
+	routes := imp.routes
+	if imp.newApp {
+		// creating the app may have added a default route
+		existing, err := c.routerc.ListRoutes(routeParentRef(app.ID))
+		if err != nil {
+			return err
+		}
+		routes = make([]*router.Route, 0, len(imp.routes))
+		for _, route := range imp.routes {
+			if !routeExists(existing, route) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	result.Routes = []*router.Route{}
+	for _, route := range routes {
+		if err := c.createRoute(route); err != nil {
+			return err
+		}
+		route := route
+		imp.undo = append(imp.undo, func() error {
+			return c.routerc.DeleteRoute(route.Type, route.ID)
+		})
+		result.Routes = append(result.Routes, route)
+	}
+
+	// the release and formation are changed last, as a deployment can't
+	// be undone once it has been queued
+	switch {
+	case imp.newApp:
+		// new apps have nothing running, so the release is set
+		// immediately
+		if err := c.appRepo.SetRelease(app.ID, imp.release.ID); err != nil {
+			return err
+		}
+		if imp.formation != nil {
+			if err := c.formationRepo.Add(imp.formation, imp.actor); err != nil {
+				return err
+			}
+		}
+	case imp.release != imp.prevRelease:
+		// the new release of an existing app is deployed so that its
+		// running processes are replaced by the app's strategy
+		opts := &ct.DeploymentOptions{}
+		if imp.formation != nil {
+			opts.Processes = imp.formation.Processes
+		}
+		deployment, err := c.createDeployment(app, imp.release, opts, nil)
+		if err != nil {
+			return err
+		}
+		result.DeploymentID = deployment.ID
+	case imp.formation != nil:
+		if err := c.formationRepo.Add(imp.formation, imp.actor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
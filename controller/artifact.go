@@ -1,21 +1,42 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
 )
 
 type ArtifactRepo struct {
-	db *postgres.DB
+	db      *postgres.DB
+	secrets *secrets.Key
 }
 
-func NewArtifactRepo(db *postgres.DB) *ArtifactRepo {
-	return &ArtifactRepo{db}
+func NewArtifactRepo(db *postgres.DB, secretsKey *secrets.Key) *ArtifactRepo {
+	return &ArtifactRepo{db: db, secrets: secretsKey}
 }
 
+// artifactColumns doesn't include the registry password, which is only loaded
+// by PullCredentials so that it is never returned by the API.
+const artifactColumns = "artifact_id, type, uri, digest, registry_username, created_at"
+
+var artifactDigestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
 func (r *ArtifactRepo) Add(data interface{}) error {
 	a := data.(*ct.Artifact)
 	// TODO: actually validate
@@ -28,47 +49,292 @@ func (r *ArtifactRepo) Add(data interface{}) error {
 	if a.URI == "" {
 		return ct.ValidationError{"uri", "must not be empty"}
 	}
-	err := r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri) VALUES ($1, $2, $3) RETURNING created_at",
-		a.ID, a.Type, a.URI).Scan(&a.CreatedAt)
+	var digest *string
+	if a.Digest != "" {
+		if !artifactDigestPattern.MatchString(a.Digest) {
+			return ct.ValidationError{"digest", `must be in the form "sha256:<hex>"`}
+		}
+		digest = &a.Digest
+	}
+	var username, password *string
+	if c := a.Credentials; c != nil {
+		if c.Username == "" {
+			return ct.ValidationError{Field: "credentials.username", Message: "must not be empty"}
+		}
+		var err error
+		if c.Password, err = sealPassword(r.secrets, "credentials.password", utils.RegistryHost(a.URI), c.Password); err != nil {
+			return err
+		}
+		username, password = &c.Username, &c.Password
+	}
+	err := r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri, digest, registry_username, registry_password) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at",
+		a.ID, a.Type, a.URI, digest, username, password).Scan(&a.CreatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("SELECT artifact_id, created_at FROM artifacts WHERE type = $1 AND uri = $2",
-			a.Type, a.URI).Scan(&a.ID, &a.CreatedAt)
+		// the same image was already added, so return the existing
+		// artifact rather than storing another copy
+		var existing *ct.Artifact
+		if digest != nil {
+			existing, err = scanArtifact(r.db.QueryRow("SELECT "+artifactColumns+" FROM artifacts WHERE type = $1 AND digest = $2 AND deleted_at IS NULL", a.Type, a.Digest))
+		}
+		if digest == nil || err == ErrNotFound {
+			existing, err = scanArtifact(r.db.QueryRow("SELECT "+artifactColumns+" FROM artifacts WHERE type = $1 AND uri = $2 AND deleted_at IS NULL", a.Type, a.URI))
+		}
 		if err != nil {
 			return err
 		}
+		if a.Digest != "" && existing.Digest != a.Digest {
+			return ct.ValidationError{Field: "digest", Message: "does not match the digest of the existing artifact with the same uri"}
+		}
+		// the existing artifact is only returned to callers which have
+		// its credentials, so that others can't pull the image with
+		// them, and its credentials are never replaced as releases of
+		// other apps may use it
+		same, err := r.sameCredentials(existing, a)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return ct.ValidationError{Field: "credentials", Message: "must match those of the existing artifact of the image"}
+		}
+		*a = *existing
+	}
+	if a.Credentials != nil {
+		a.Credentials.Password = ""
 	}
 	a.ID = postgres.CleanUUID(a.ID)
 	return err
 }
 
+// credentials returns the credentials of the artifact with the given ID,
+// including the sealed password.
+func (r *ArtifactRepo) credentials(id string) (*ct.RegistryCredentials, error) {
+	var username, password *string
+	err := r.db.QueryRow("SELECT registry_username, registry_password FROM artifacts WHERE artifact_id = $1", id).Scan(&username, &password)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if username == nil || password == nil {
+		return nil, nil
+	}
+	return &ct.RegistryCredentials{Username: *username, Password: *password}, nil
+}
+
+// sameCredentials reports whether a, which is being added with a sealed
+// password if it has credentials, has the same credentials as existing. The
+// opened passwords are compared, as sealing uses a random nonce.
+func (r *ArtifactRepo) sameCredentials(existing, a *ct.Artifact) (bool, error) {
+	c, err := r.credentials(existing.ID)
+	if err != nil {
+		return false, err
+	}
+	if c == nil || a.Credentials == nil {
+		return c == nil && a.Credentials == nil, nil
+	}
+	if c.Username != a.Credentials.Username {
+		return false, nil
+	}
+	existingPassword, err := r.secrets.Open(secrets.RegistryContext(utils.RegistryHost(existing.URI)), c.Password)
+	if err != nil {
+		return false, err
+	}
+	password, err := r.secrets.Open(secrets.RegistryContext(utils.RegistryHost(a.URI)), a.Credentials.Password)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(existingPassword), []byte(password)) == 1, nil
+}
+
+// sealPassword seals a password of the registry host. Sealed passwords are
+// only accepted if they were sealed for the host, so that other secrets, such
+// as those of releases, can't be sent to a registry.
+func sealPassword(key *secrets.Key, field, host, password string) (string, error) {
+	if key == nil {
+		return "", ct.ValidationError{Field: field, Message: "can't be stored as secrets are not enabled in this cluster"}
+	}
+	if password == "" {
+		return "", ct.ValidationError{Field: field, Message: "must not be empty"}
+	}
+	context := secrets.RegistryContext(host)
+	if !secrets.IsSealed(password) {
+		return key.Seal(context, password), nil
+	}
+	if _, err := key.Open(context, password); err != nil {
+		return "", ct.ValidationError{Field: field, Message: "is not a valid sealed password of the registry"}
+	}
+	return password, nil
+}
+
 func scanArtifact(s postgres.Scanner) (*ct.Artifact, error) {
 	artifact := &ct.Artifact{}
-	err := s.Scan(&artifact.ID, &artifact.Type, &artifact.URI, &artifact.CreatedAt)
+	var digest, username *string
+	err := s.Scan(&artifact.ID, &artifact.Type, &artifact.URI, &digest, &username, &artifact.CreatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
+	if digest != nil {
+		artifact.Digest = *digest
+	}
+	if username != nil {
+		artifact.Credentials = &ct.RegistryCredentials{Username: *username}
+	}
 	artifact.ID = postgres.CleanUUID(artifact.ID)
 	return artifact, err
 }
 
+// Apps returns the apps which run or have deployed a release of the
+// artifact.
+func (r *ArtifactRepo) Apps(id string) ([]*ct.App, error) {
+	return selectReleaseApps(r.db, "SELECT release_id FROM releases WHERE artifact_id = $1", id)
+}
+
 func (r *ArtifactRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id)
+	row := r.db.QueryRow("SELECT "+artifactColumns+" FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id)
 	return scanArtifact(row)
 }
 
-func (r *ArtifactRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *ArtifactRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	query, args := opts.query("SELECT "+artifactColumns+" FROM artifacts WHERE deleted_at IS NULL", "artifact_id")
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	artifacts := []*ct.Artifact{}
 	for rows.Next() {
 		artifact, err := scanArtifact(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, nil, err
 		}
 		artifacts = append(artifacts, artifact)
 	}
-	return artifacts, nil
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(artifacts)) {
+		artifacts = artifacts[:opts.Limit]
+		last := artifacts[len(artifacts)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return artifacts, next, nil
+}
+
+// uploadArtifactTypes are the artifact types which can be uploaded.
+var uploadArtifactTypes = map[string]bool{
+	"docker": true,
+	"file":   true,
+}
+
+// maxArtifactUploadSize is the maximum size of an artifact upload.
+var maxArtifactUploadSize int64 = 1 << 30
+
+// blobstoreClient is used for requests to the blobstore, its timeout is the
+// default upload timeout of httpTimeouts as uploads can't take longer than
+// that anyway.
+var blobstoreClient = &http.Client{Timeout: 10 * time.Minute}
+
+// UploadArtifact stores the request body in the blobstore and creates an
+// artifact of the type given by the type query parameter which references
+// it. The blob is removed again if the artifact can't be created, or if an
+// artifact with the same digest already exists, which is then returned.
+//
+// Docker artifacts don't get the digest of the upload, as the digest of
+// docker artifacts is that of the image (see pinkerton.ImageDigest), which
+// hosts check when pulling it.
+func (c *controllerAPI) UploadArtifact(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	typ := req.URL.Query().Get("type")
+	if typ == "" {
+		respondWithError(w, ct.ValidationError{Field: "type", Message: "must not be empty"})
+		return
+	}
+	if !uploadArtifactTypes[typ] {
+		respondWithError(w, ct.ValidationError{Field: "type", Message: fmt.Sprintf("%q can't be uploaded", typ)})
+		return
+	}
+	if req.ContentLength > maxArtifactUploadSize {
+		respondWithError(w, uploadTooLarge())
+		return
+	}
+
+	uri := fmt.Sprintf("%s/artifacts/%s", c.blobstoreURL, random.UUID())
+	hash := sha256.New()
+	var size byteCounter
+	body := io.TeeReader(http.MaxBytesReader(w, req.Body, maxArtifactUploadSize), io.MultiWriter(hash, &size))
+	put, err := http.NewRequest("PUT", uri, body)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	put.ContentLength = req.ContentLength
+	put.Header.Set("Content-Type", req.Header.Get("Content-Type"))
+	res, err := blobstoreClient.Do(put)
+	if err != nil {
+		deleteBlob(uri)
+		if int64(size) >= maxArtifactUploadSize {
+			err = uploadTooLarge()
+		} else {
+			err = blobstoreError(err)
+		}
+		respondWithError(w, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		respondWithError(w, blobstoreError(fmt.Errorf("unexpected status %d", res.StatusCode)))
+		return
+	}
+
+	artifact := &ct.Artifact{
+		Type: typ,
+		URI:  uri,
+	}
+	if typ != "docker" {
+		artifact.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	}
+	if err := c.artifactRepo.Add(artifact); err != nil {
+		deleteBlob(uri)
+		respondWithError(w, err)
+		return
+	}
+	if artifact.URI != uri {
+		deleteBlob(uri)
+	}
+	httphelper.JSON(w, 200, artifact)
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	*b += byteCounter(len(p))
+	return len(p), nil
+}
+
+func uploadTooLarge() error {
+	return httphelper.JSONError{
+		Code:    httphelper.RequestTooLargeError,
+		Message: fmt.Sprintf("uploads must be at most %d bytes", maxArtifactUploadSize),
+	}
+}
+
+func blobstoreError(err error) error {
+	return httphelper.JSONError{
+		Code:    httphelper.ServiceUnavailableError,
+		Message: fmt.Sprintf("blobstore upload failed: %s", err),
+	}
+}
+
+func deleteBlob(uri string) {
+	req, err := http.NewRequest("DELETE", uri, nil)
+	if err != nil {
+		return
+	}
+	res, err := blobstoreClient.Do(req)
+	if err != nil {
+		log.Printf("Unable to delete blob %s: %s", uri, err)
+		return
+	}
+	res.Body.Close()
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+type AuthTokenRepo struct {
+	db *postgres.DB
+}
+
+func NewAuthTokenRepo(db *postgres.DB) *AuthTokenRepo {
+	return &AuthTokenRepo{db}
+}
+
+func hashAuthToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+func (r *AuthTokenRepo) Add(data interface{}) error {
+	token := data.(*ct.AuthToken)
+	appScoped := token.Scope == ct.AuthTokenScopeApp || token.Scope == ct.AuthTokenScopeDeploy
+	if appScoped && token.AppID == "" {
+		return ct.ValidationError{Field: "app", Message: "must be set for app and deploy scoped tokens"}
+	}
+	if !appScoped && token.AppID != "" {
+		return ct.ValidationError{Field: "app", Message: "must only be set for app and deploy scoped tokens"}
+	}
+	if token.Scope == ct.AuthTokenScopeNamespace && token.NamespaceID == "" {
+		return ct.ValidationError{Field: "namespace", Message: "must be set for namespace scoped tokens"}
+	}
+	if token.Scope != ct.AuthTokenScopeNamespace && token.NamespaceID != "" {
+		return ct.ValidationError{Field: "namespace", Message: "must only be set for namespace scoped tokens"}
+	}
+	if token.RateLimit < 0 {
+		return ct.ValidationError{Field: "rate_limit", Message: "must not be negative"}
+	}
+	if token.RateBurst < 0 {
+		return ct.ValidationError{Field: "rate_burst", Message: "must not be negative"}
+	}
+	if token.ID == "" {
+		token.ID = random.UUID()
+	}
+	token.Token = random.Hex(16)
+
+	var appID, namespaceID *string
+	if token.AppID != "" {
+		appID = &token.AppID
+	}
+	if token.NamespaceID != "" {
+		namespaceID = &token.NamespaceID
+	}
+	err := r.db.QueryRow("INSERT INTO auth_tokens (token_id, name, token_hash, scope, app_id, namespace_id, rate_limit, rate_burst, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING created_at",
+		token.ID, token.Name, hashAuthToken(token.Token), token.Scope, appID, namespaceID, token.RateLimit, token.RateBurst, token.ExpiresAt).Scan(&token.CreatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ct.ValidationError{Field: "name", Message: "is already in use"}
+	} else if ok && e.Code.Name() == "foreign_key_violation" && namespaceID != nil {
+		return ct.ValidationError{Field: "namespace", Message: "does not exist"}
+	}
+	token.ID = postgres.CleanUUID(token.ID)
+	return err
+}
+
+func scanAuthToken(s postgres.Scanner) (*ct.AuthToken, error) {
+	token := &ct.AuthToken{}
+	var appID, namespaceID *string
+	err := s.Scan(&token.ID, &token.Name, &token.Scope, &appID, &namespaceID, &token.RateLimit, &token.RateBurst, &token.ExpiresAt, &token.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	token.ID = postgres.CleanUUID(token.ID)
+	if appID != nil {
+		token.AppID = postgres.CleanUUID(*appID)
+	}
+	if namespaceID != nil {
+		token.NamespaceID = postgres.CleanUUID(*namespaceID)
+	}
+	return token, err
+}
+
+func (r *AuthTokenRepo) Get(id string) (interface{}, error) {
+	row := r.db.QueryRow("SELECT token_id, name, scope, app_id, namespace_id, rate_limit, rate_burst, expires_at, created_at FROM auth_tokens WHERE token_id = $1 AND deleted_at IS NULL", id)
+	return scanAuthToken(row)
+}
+
+// Lookup returns the unexpired, unrevoked token with the given secret.
+func (r *AuthTokenRepo) Lookup(secret string) (*ct.AuthToken, error) {
+	row := r.db.QueryRow("SELECT token_id, name, scope, app_id, namespace_id, rate_limit, rate_burst, expires_at, created_at FROM auth_tokens WHERE token_hash = $1 AND deleted_at IS NULL AND (expires_at IS NULL OR expires_at > now())", hashAuthToken(secret))
+	return scanAuthToken(row)
+}
+
+func (r *AuthTokenRepo) Remove(id string) error {
+	return r.db.Exec("UPDATE auth_tokens SET deleted_at = now() WHERE token_id = $1 AND deleted_at IS NULL", id)
+}
+
+// AppList returns the unrevoked tokens which are scoped to the app.
+func (r *AuthTokenRepo) AppList(appID string) ([]*ct.AuthToken, error) {
+	rows, err := r.db.Query("SELECT token_id, name, scope, app_id, namespace_id, rate_limit, rate_burst, expires_at, created_at FROM auth_tokens WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []*ct.AuthToken{}
+	for rows.Next() {
+		token, err := scanAuthToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (r *AuthTokenRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	query, args := opts.query("SELECT token_id, name, scope, app_id, namespace_id, rate_limit, rate_burst, expires_at, created_at FROM auth_tokens WHERE deleted_at IS NULL", "token_id")
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens := []*ct.AuthToken{}
+	for rows.Next() {
+		token, err := scanAuthToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(tokens)) {
+		tokens = tokens[:opts.Limit]
+		last := tokens[len(tokens)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return tokens, next, nil
+}
+
+// authenticate returns the token that password belongs to, the master key is
+// treated as a token with full scope.
+func authenticate(password, authKey string, tokens *AuthTokenRepo) (*ct.AuthToken, error) {
+	if password == "" {
+		return nil, ErrNotFound
+	}
+	if len(password) == len(authKey) && subtle.ConstantTimeCompare([]byte(password), []byte(authKey)) == 1 {
+		return &ct.AuthToken{Scope: ct.AuthTokenScopeFull}, nil
+	}
+	return tokens.Lookup(password)
+}
+
+// authorized reports whether token permits req. App scoped tokens can only
+// access the nested app endpoints, and namespace scoped tokens all of the app
+// endpoints, which are further checked by appLookup once the app is known.
+func authorized(token *ct.AuthToken, req *http.Request) bool {
+	switch token.Scope {
+	case ct.AuthTokenScopeFull:
+		return true
+	case ct.AuthTokenScopeReadOnly:
+		return req.Method == "GET" || req.Method == "HEAD"
+	case ct.AuthTokenScopeApp:
+		path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		switch path[0] {
+		case "apps":
+			// app scoped tokens can't create other tokens
+			return len(path) > 2 && path[2] != "tokens"
+		case "artifacts", "releases":
+			return artifactOrReleaseAllowed(req, path)
+		case "deployments":
+			return req.Method == "GET"
+		}
+	case ct.AuthTokenScopeDeploy:
+		path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		switch path[0] {
+		case "apps":
+			// deployments can be created and followed
+			if len(path) < 3 {
+				return false
+			}
+			switch path[2] {
+			case "deploy":
+				return req.Method == "POST" && len(path) == 3
+			case "deployments":
+				return req.Method == "POST" && len(path) == 3 || req.Method == "GET"
+			}
+		case "artifacts", "releases":
+			return artifactOrReleaseAllowed(req, path)
+		case "deployments":
+			return req.Method == "GET"
+		}
+	case ct.AuthTokenScopeNamespace:
+		path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		switch path[0] {
+		case "apps":
+			return true
+		case "artifacts", "releases":
+			return artifactOrReleaseAllowed(req, path)
+		case "deployments":
+			return req.Method == "GET"
+		case "jobs":
+			return req.Method == "GET" && len(path) == 1
+		}
+	}
+	return false
+}
+
+// artifactOrReleaseAllowed reports whether req creates, uploads or gets an
+// artifact or release, which scoped tokens need to deploy their apps. Gets
+// are further checked by authorizedForAppScoped once the ID is known.
+func artifactOrReleaseAllowed(req *http.Request, path []string) bool {
+	switch req.Method {
+	case "POST":
+		return len(path) == 1 || len(path) == 2 && path[0] == "artifacts" && path[1] == "upload"
+	case "GET":
+		return len(path) == 2
+	}
+	return false
+}
+
+// appScopedRepo is implemented by repositories of things which are shared by
+// apps, such as releases and artifacts. Scoped tokens can only get the things
+// which belong to an app they can access.
+type appScopedRepo interface {
+	Apps(id string) ([]*ct.App, error)
+}
+
+// releaseAppsQuery selects the apps which run, or have deployed, the releases
+// selected by the subquery it is formatted with.
+const releaseAppsQuery = `SELECT app_id, namespace_id FROM apps WHERE deleted_at IS NULL AND (
+    release_id IN (%[1]s)
+    OR app_id IN (SELECT app_id FROM formations WHERE release_id IN (%[1]s))
+    OR app_id IN (SELECT app_id FROM deployments WHERE new_release_id IN (%[1]s) OR old_release_id IN (%[1]s)))`
+
+// selectReleaseApps returns the apps of the releases selected by the subquery
+// releases, which takes id as its argument.
+func selectReleaseApps(db *postgres.DB, releases, id string) ([]*ct.App, error) {
+	if !idPattern.MatchString(id) {
+		return nil, nil
+	}
+	rows, err := db.Query(fmt.Sprintf(releaseAppsQuery, releases), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var apps []*ct.App
+	for rows.Next() {
+		var namespaceID *string
+		app := &ct.App{}
+		if err := rows.Scan(&app.ID, &namespaceID); err != nil {
+			return nil, err
+		}
+		app.ID = postgres.CleanUUID(app.ID)
+		if namespaceID != nil {
+			app.NamespaceID = postgres.CleanUUID(*namespaceID)
+		}
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// authorizedForAppScoped returns ErrNotFound unless the token of the request
+// can access one of the apps the thing with the given ID belongs to. Tokens
+// which aren't scoped to apps can access everything.
+func authorizedForAppScoped(ctx context.Context, repo appScopedRepo, id string) error {
+	token := authTokenFromContext(ctx)
+	if token == nil {
+		return nil
+	}
+	switch token.Scope {
+	case ct.AuthTokenScopeApp, ct.AuthTokenScopeDeploy, ct.AuthTokenScopeNamespace:
+	default:
+		return nil
+	}
+	apps, err := repo.Apps(id)
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		if authorizedForApp(ctx, app) {
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func authTokenFromContext(ctx context.Context) *ct.AuthToken {
+	token, _ := ctx.Value("auth_token").(*ct.AuthToken)
+	return token
+}
+
+// authorizedForApp reports whether the token of the request can access app.
+func authorizedForApp(ctx context.Context, app *ct.App) bool {
+	token := authTokenFromContext(ctx)
+	if token == nil {
+		return true
+	}
+	switch token.Scope {
+	case ct.AuthTokenScopeApp, ct.AuthTokenScopeDeploy:
+		return token.AppID == app.ID
+	case ct.AuthTokenScopeNamespace:
+		return token.NamespaceID == app.NamespaceID
+	}
+	return true
+}
+
+// requestActor returns the name of the auth token of the request, which is
+// empty for the master key.
+func requestActor(ctx context.Context) string {
+	if token := authTokenFromContext(ctx); token != nil {
+		return token.Name
+	}
+	return ""
+}
+
+// fullScope reports whether the request is made with the master key or a full
+// scope token.
+func fullScope(ctx context.Context) bool {
+	token := authTokenFromContext(ctx)
+	return token == nil || token.Scope == ct.AuthTokenScopeFull
+}
+
+// tokenNamespace returns the namespace of a namespace scoped token of the
+// request, or an empty string for other tokens.
+func tokenNamespace(ctx context.Context) string {
+	if token := authTokenFromContext(ctx); token != nil && token.Scope == ct.AuthTokenScopeNamespace {
+		return token.NamespaceID
+	}
+	return ""
+}
+
+// CreateAppToken creates a deploy scoped token for the app, which can only
+// create releases and deployments of it.
+func (c *controllerAPI) CreateAppToken(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	app := c.getApp(ctx)
+	var token ct.AuthToken
+	if err := httphelper.DecodeJSON(req, &token); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if token.Name == "" {
+		token.Name = fmt.Sprintf("%s-deploy-%s", app.Name, random.String(8))
+	}
+	token.Scope = ct.AuthTokenScopeDeploy
+	token.AppID = app.ID
+	// rate limits restrict scoped tokens, so only full scope tokens can
+	// set them, otherwise the token has the default limits
+	if !fullScope(ctx) {
+		token.RateLimit = 0
+		token.RateBurst = 0
+	}
+
+	if err := schema.Validate(&token); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err := c.authTokenRepo.Add(&token); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &token)
+}
+
+func (c *controllerAPI) ListAppTokens(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	tokens, err := c.authTokenRepo.AppList(c.getApp(ctx).ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, tokens)
+}
+
+// DeleteAppToken revokes a token which is scoped to the app.
+func (c *controllerAPI) DeleteAppToken(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	id := params.ByName("token_id")
+	if !idPattern.MatchString(id) {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	data, err := c.authTokenRepo.Get(id)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if data.(*ct.AuthToken).AppID != c.getApp(ctx).ID {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	if err := c.authTokenRepo.Remove(id); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) createTestAuthToken(c *C, in *ct.AuthToken) *ct.AuthToken {
+	c.Assert(s.c.CreateAuthToken(in), IsNil)
+	c.Assert(in.Token, Not(Equals), "")
+	return in
+}
+
+func (s *S) authTokenStatus(c *C, token *ct.AuthToken, method, path string) int {
+	req, err := http.NewRequest(method, s.srv.URL+path, nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", token.Token)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (s *S) TestAuthTokenReadOnly(c *C) {
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "read-only", Scope: ct.AuthTokenScopeReadOnly})
+	app := s.createTestApp(c, &ct.App{Name: "auth-token-read-only"})
+
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps"), Equals, 200)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+app.ID), Equals, 200)
+	c.Assert(s.authTokenStatus(c, token, "POST", "/apps"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "DELETE", "/apps/"+app.ID), Equals, 403)
+}
+
+func (s *S) TestAuthTokenAppScope(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "auth-token-app"})
+	other := s.createTestApp(c, &ct.App{Name: "auth-token-other-app"})
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "app", Scope: ct.AuthTokenScopeApp, AppID: app.ID})
+
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+app.ID+"/jobs"), Equals, 200)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+other.ID+"/jobs"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+app.ID), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/auth_tokens"), Equals, 403)
+
+	// app scoped tokens must reference an app
+	err := s.c.CreateAuthToken(&ct.AuthToken{Name: "no-app", Scope: ct.AuthTokenScopeApp})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestAppDeployTokens(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-deploy-token"})
+	other := s.createTestApp(c, &ct.App{Name: "app-deploy-token-other"})
+
+	token := &ct.AuthToken{}
+	c.Assert(s.c.CreateAppToken(app.ID, token), IsNil)
+	c.Assert(token.Token, Not(Equals), "")
+	c.Assert(token.Scope, Equals, ct.AuthTokenScopeDeploy)
+	c.Assert(token.AppID, Equals, app.ID)
+
+	tokens, err := s.c.AppTokenList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 1)
+	c.Assert(tokens[0].ID, Equals, token.ID)
+
+	// deploy tokens can create releases and deployments of the app
+	client, err := controller.NewClient(s.srv.URL, token.Token)
+	c.Assert(err, IsNil)
+	artifact := &ct.Artifact{Type: "docker", URI: "https://example.com/app-deploy-token"}
+	c.Assert(client.CreateArtifact(artifact), IsNil)
+	release := &ct.Release{ArtifactID: artifact.ID}
+	c.Assert(client.CreateRelease(release), IsNil)
+	_, err = client.CreateDeployment(app.ID, release.ID)
+	c.Assert(err, IsNil)
+
+	// but nothing else
+	c.Assert(s.authTokenStatus(c, token, "POST", "/apps/"+other.ID+"/deploy"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+app.ID+"/jobs"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "PUT", "/apps/"+app.ID+"/release"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "POST", "/apps/"+app.ID+"/tokens"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps"), Equals, 403)
+
+	// releases and artifacts can only be read if they belong to the app
+	c.Assert(s.authTokenStatus(c, token, "GET", "/releases/"+release.ID), Equals, 200)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/artifacts/"+artifact.ID), Equals, 200)
+	otherArtifact := s.createTestArtifact(c, &ct.Artifact{})
+	otherRelease := s.createTestRelease(c, &ct.Release{ArtifactID: otherArtifact.ID})
+	c.Assert(s.c.SetAppRelease(other.ID, otherRelease.ID), IsNil)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/releases/"+otherRelease.ID), Equals, 404)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/artifacts/"+otherArtifact.ID), Equals, 404)
+
+	// tokens of other apps can't be revoked through the app
+	c.Assert(s.c.DeleteAppToken(other.ID, token.ID), Equals, controller.ErrNotFound)
+	c.Assert(s.c.DeleteAppToken(app.ID, token.ID), IsNil)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+app.ID+"/deployments"), Equals, 401)
+	tokens, err = s.c.AppTokenList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 0)
+}
+
+func (s *S) TestAuthTokenNamespaceScope(c *C) {
+	team1 := &ct.Namespace{Name: "auth-token-team1"}
+	c.Assert(s.c.CreateNamespace(team1), IsNil)
+	team2 := &ct.Namespace{Name: "auth-token-team2"}
+	c.Assert(s.c.CreateNamespace(team2), IsNil)
+	other := s.createTestApp(c, &ct.App{Name: "auth-token-namespace", NamespaceID: team2.ID})
+
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "team1", Scope: ct.AuthTokenScopeNamespace, NamespaceID: team1.ID})
+	client, err := controller.NewClient(s.srv.URL, token.Token)
+	c.Assert(err, IsNil)
+
+	// apps are created in the token's namespace, and names only need to be
+	// unique within a namespace
+	app := &ct.App{Name: "auth-token-namespace", NamespaceID: team2.ID}
+	c.Assert(client.CreateApp(app), IsNil)
+	c.Assert(app.NamespaceID, Equals, team1.ID)
+	c.Assert(app.ID, Not(Equals), other.ID)
+	c.Assert(client.CreateApp(&ct.App{Name: "auth-token-namespace"}), NotNil)
+
+	gotApp, err := client.GetApp(app.Name)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.ID, Equals, app.ID)
+	apps, err := client.AppList()
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 1)
+	c.Assert(apps[0].ID, Equals, app.ID)
+
+	// quotas can only be set with full scope tokens
+	c.Assert(client.UpdateApp(&ct.App{ID: app.ID, Quota: &ct.AppQuota{MaxProcesses: 100}}), NotNil)
+	c.Assert(client.CreateApp(&ct.App{Name: "auth-token-namespace-quota", Quota: &ct.AppQuota{MaxProcesses: 100}}), NotNil)
+
+	// as can policies and protection
+	c.Assert(client.UpdateApp(&ct.App{ID: app.ID, Policy: &ct.AppPolicy{LockRelease: true}}), NotNil)
+	c.Assert(client.UpdateApp(&ct.App{ID: app.ID, Protected: true}), NotNil)
+	c.Assert(client.UpdateApp(&ct.App{ID: app.ID, Meta: map[string]string{"foo": "bar"}}), IsNil)
+
+	// as can the rate limits of app tokens
+	appToken := &ct.AuthToken{RateLimit: 1000, RateBurst: 1000}
+	c.Assert(client.CreateAppToken(app.ID, appToken), IsNil)
+	appTokens, err := s.c.AppTokenList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(appTokens, HasLen, 1)
+	c.Assert(appTokens[0].RateLimit, Equals, float64(0))
+	c.Assert(appTokens[0].RateBurst, Equals, 0)
+
+	// apps in other namespaces can't be seen or modified
+	_, err = client.GetApp(other.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(client.DeleteApp(other.ID), Equals, controller.ErrNotFound)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps/"+other.ID+"/jobs"), Equals, 404)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/namespaces"), Equals, 403)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/auth_tokens"), Equals, 403)
+
+	apps, err = s.c.AppListInNamespace(team2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 1)
+	c.Assert(apps[0].ID, Equals, other.ID)
+
+	// namespace scoped tokens must reference a namespace
+	err = s.c.CreateAuthToken(&ct.AuthToken{Name: "no-namespace", Scope: ct.AuthTokenScopeNamespace})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestAuthTokenRevokedAndExpired(c *C) {
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "revoked", Scope: ct.AuthTokenScopeFull})
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps"), Equals, 200)
+	c.Assert(s.c.DeleteAuthToken(token.ID), IsNil)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps"), Equals, 401)
+
+	tokens, err := s.c.AuthTokenList()
+	c.Assert(err, IsNil)
+	for _, t := range tokens {
+		c.Assert(t.ID, Not(Equals), token.ID)
+		c.Assert(t.Token, Equals, "")
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	expired := s.createTestAuthToken(c, &ct.AuthToken{Name: "expired", Scope: ct.AuthTokenScopeFull, ExpiresAt: &expiresAt})
+	c.Assert(s.authTokenStatus(c, expired, "GET", "/apps"), Equals, 401)
+}
+
+func (s *S) TestAuthTokenRateLimit(c *C) {
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "rate-limited", Scope: ct.AuthTokenScopeReadOnly, RateLimit: 0.01, RateBurst: 2})
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/apps", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", token.Token)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("X-RateLimit-Limit"), Equals, "2")
+	c.Assert(res.Header.Get("X-RateLimit-Remaining"), Equals, "1")
+	c.Assert(res.Header.Get("X-RateLimit-Reset"), Not(Equals), "")
+
+	c.Assert(s.authTokenStatus(c, token, "GET", "/apps"), Equals, 200)
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 429)
+	c.Assert(res.Header.Get("Retry-After"), Not(Equals), "")
+
+	// the master key is not limited
+	_, err = s.c.AppList()
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// checkFormationCapacity checks that the cluster can run the processes of
+// formation, as the scheduler accepts any formation but can't start processes
+// which don't fit. Depending on the formation_capacity_check setting, the
+// problems found are either returned as a capacity error or as warnings to be
+// set with setCapacityWarnings.
+func (c *controllerAPI) checkFormationCapacity(release *ct.Release, formation *ct.Formation) ([]string, error) {
+	mode := c.settingsRepo.Value(ct.SettingFormationCapacityCheck)
+	if mode != "warn" && mode != "reject" {
+		return nil, nil
+	}
+	hosts, err := c.clusterClient.ListHosts()
+	if err != nil {
+		// an unreachable cluster isn't a reason to reject the formation
+		log.Printf("Error listing hosts to check formation capacity: %s", err)
+		return []string{"unable to check cluster capacity"}, nil
+	}
+	capacity := c.hostsCapacity(hosts, formation)
+	problems := capacityProblems(release, formation, capacity)
+	if len(problems) > 0 && mode == "reject" {
+		return nil, httphelper.JSONError{
+			Code:    httphelper.CapacityError,
+			Message: strings.Join(problems, ", "),
+		}
+	}
+	return problems, nil
+}
+
+// hostCapacity is the memory and CPU shares of a host which aren't reserved
+// by jobs other than those of the formation being checked.
+type hostCapacity struct {
+	// known is false if the host's metrics couldn't be read, in which
+	// case its resources aren't checked
+	known     bool
+	memory    int64 // in bytes
+	cpuShares int64
+}
+
+// cpuSharesPerCPU is the CPU shares of a job which gets a whole CPU when the
+// host's CPUs are contended.
+const cpuSharesPerCPU = 1024
+
+// hostMetricsTimeout is how long hostsCapacity waits for the metrics of hosts.
+const hostMetricsTimeout = 5 * time.Second
+
+// hostsCapacity returns the capacity of each of hosts for the processes of
+// formation, reading their metrics in parallel. Hosts which don't respond
+// within hostMetricsTimeout are treated like hosts whose metrics can't be read.
+func (c *controllerAPI) hostsCapacity(hosts []host.Host, formation *ct.Formation) []*hostCapacity {
+	type result struct {
+		i        int
+		capacity *hostCapacity
+	}
+	// the channel is buffered so hosts which respond after the timeout
+	// don't block
+	results := make(chan result, len(hosts))
+	for i, h := range hosts {
+		go func(i int, h host.Host) {
+			results <- result{i, c.hostCapacity(h, formation)}
+		}(i, h)
+	}
+
+	capacity := make([]*hostCapacity, len(hosts))
+	for i := range capacity {
+		capacity[i] = &hostCapacity{}
+	}
+	timeout := time.After(hostMetricsTimeout)
+	for i := range hosts {
+		select {
+		case r := <-results:
+			capacity[r.i] = r.capacity
+		case <-timeout:
+			log.Printf("Timed out getting the metrics of %d hosts to check formation capacity", len(hosts)-i)
+			return capacity
+		}
+	}
+	return capacity
+}
+
+// hostCapacity returns the resources of h which are free for the processes of
+// formation. The memory of every other job is reserved like the scheduler
+// does, but only the CPU shares which are set explicitly, as jobs with the
+// default shares just get an equal share of contended CPUs.
+func (c *controllerAPI) hostCapacity(h host.Host, formation *ct.Formation) *hostCapacity {
+	client, err := c.clusterClient.DialHost(h.ID)
+	if err != nil {
+		log.Printf("Unable to connect to host %s to check formation capacity: %s", h.ID, err)
+		return &hostCapacity{}
+	}
+	metrics, err := client.Metrics()
+	if err != nil || metrics.MemoryTotal == 0 {
+		log.Printf("Unable to get metrics of host %s to check formation capacity: %v", h.ID, err)
+		return &hostCapacity{}
+	}
+	capacity := &hostCapacity{
+		known:     true,
+		memory:    int64(metrics.MemoryTotal),
+		cpuShares: int64(metrics.CPUs) * cpuSharesPerCPU,
+	}
+	for _, job := range h.Jobs {
+		// the formation's own jobs are replaced by its new processes
+		if job.Metadata["flynn-controller.app"] == formation.AppID && job.Metadata["flynn-controller.release"] == formation.ReleaseID {
+			continue
+		}
+		if job.Resources.Memory > 0 {
+			capacity.memory -= int64(job.Resources.Memory) * 1024
+		} else {
+			capacity.memory -= host.DefaultJobMemory
+		}
+		capacity.cpuShares -= job.Resources.CPUShares
+	}
+	return capacity
+}
+
+// capacityProblems returns the process types of formation which can't all be
+// run on hosts with the given capacity.
+func capacityProblems(release *ct.Release, formation *ct.Formation, hosts []*hostCapacity) []string {
+	types := make([]string, 0, len(formation.Processes))
+	for typ := range formation.Processes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	// the free resources of the hosts with known metrics
+	var known int
+	var memory, cpuShares, maxMemory, maxCPUShares int64
+	for _, h := range hosts {
+		if !h.known {
+			continue
+		}
+		known++
+		memory += h.memory
+		cpuShares += h.cpuShares
+		if h.memory > maxMemory {
+			maxMemory = h.memory
+		}
+		if h.cpuShares > maxCPUShares {
+			maxCPUShares = h.cpuShares
+		}
+	}
+
+	var problems []string
+	var totalMemory, totalCPUShares int64
+	for _, typ := range types {
+		n := formation.Processes[typ]
+		if n <= 0 {
+			continue
+		}
+		if len(hosts) == 0 {
+			problems = append(problems, fmt.Sprintf("there are no hosts to run %d %s processes", n, typ))
+			continue
+		}
+		proc := release.Processes[typ]
+		// omni processes run once on every host, and processes using
+		// the host network would conflict on their ports
+		if proc.HostNetwork && !proc.Omni && n > len(hosts) {
+			problems = append(problems, fmt.Sprintf("%s processes use the host network, so at most %d can run on %d hosts", typ, len(hosts), len(hosts)))
+		}
+		if known == 0 {
+			continue
+		}
+		// omni processes run on every host, including those with unknown
+		// metrics, which like for other processes don't add to the free
+		// resources
+		jobs := int64(n)
+		if proc.Omni {
+			jobs *= int64(len(hosts))
+		}
+		mem := proc.Memory
+		if mem <= 0 {
+			mem = host.DefaultJobMemory
+		}
+		if mem > maxMemory {
+			problems = append(problems, fmt.Sprintf("%s processes need %d MB of memory, but no host has that much free", typ, mem>>20))
+		}
+		if proc.CPUShares > maxCPUShares {
+			problems = append(problems, fmt.Sprintf("%s processes need %d CPU shares, but no host has that many free", typ, proc.CPUShares))
+		}
+		totalMemory += jobs * mem
+		totalCPUShares += jobs * proc.CPUShares
+	}
+	if known > 0 && totalMemory > memory {
+		problems = append(problems, fmt.Sprintf("the processes need %d MB of memory, but the hosts have %d MB free", totalMemory>>20, max64(memory, 0)>>20))
+	}
+	if known > 0 && totalCPUShares > cpuShares {
+		problems = append(problems, fmt.Sprintf("the processes need %d CPU shares, but the hosts have %d free", totalCPUShares, max64(cpuShares, 0)))
+	}
+	return problems
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// setCapacityWarnings adds the capacity warnings to the response.
+func setCapacityWarnings(w http.ResponseWriter, warnings []string) {
+	for _, msg := range warnings {
+		w.Header().Add("Warning", "199 flynn-controller "+strconv.Quote(msg))
+	}
+}
@@ -2,6 +2,7 @@
 package controller
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,8 @@ import (
 	"time"
 
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/logaggregator/types"
 	"github.com/flynn/flynn/pkg/httpclient"
 	"github.com/flynn/flynn/pkg/pinned"
 	"github.com/flynn/flynn/pkg/stream"
@@ -29,13 +32,16 @@ var ErrNotFound = errors.New("controller: resource not found")
 
 // newClient creates a generic Client object, additional attributes must
 // be set by the caller
-func newClient(key string, url string, http *http.Client) *Client {
+func newClient(key string, url string, httpClient *http.Client) *Client {
 	c := &Client{
 		Client: &httpclient.Client{
 			ErrNotFound: ErrNotFound,
 			Key:         key,
 			URL:         url,
-			HTTP:        http,
+			HTTP:        httpClient,
+			// requests are made against the API version the client
+			// was written for
+			Header: http.Header{ct.APIVersionHeader: {strconv.Itoa(ct.APIVersion)}},
 		},
 	}
 	return c
@@ -96,12 +102,31 @@ func (c *Client) CreateRelease(release *ct.Release) error {
 	return c.Post("/releases", release, release)
 }
 
+// CreateNamespace creates a new namespace.
+func (c *Client) CreateNamespace(ns *ct.Namespace) error {
+	return c.Post("/namespaces", ns, ns)
+}
+
+// GetNamespace returns the namespace identified by namespaceID, which may be
+// its ID or name.
+func (c *Client) GetNamespace(namespaceID string) (*ct.Namespace, error) {
+	ns := &ct.Namespace{}
+	return ns, c.Get(fmt.Sprintf("/namespaces/%s", namespaceID), ns)
+}
+
+// NamespaceList returns a list of all namespaces.
+func (c *Client) NamespaceList() ([]*ct.Namespace, error) {
+	var namespaces []*ct.Namespace
+	return namespaces, c.Get("/namespaces", &namespaces)
+}
+
 // CreateApp creates a new app.
 func (c *Client) CreateApp(app *ct.App) error {
 	return c.Post("/apps", app, app)
 }
 
-// UpdateApp updates the protected flag, meta and update strategy using app.ID.
+// UpdateApp updates the protected flag, meta, update strategy and quota using
+// app.ID.
 func (c *Client) UpdateApp(app *ct.App) error {
 	if app.ID == "" {
 		return errors.New("controller: missing id")
@@ -109,6 +134,32 @@ func (c *Client) UpdateApp(app *ct.App) error {
 	return c.Post(fmt.Sprintf("/apps/%s", app.ID), app, app)
 }
 
+// SetAppMaintenance sets the maintenance mode of an app. The routes of an app
+// in maintenance mode return a 503 maintenance page.
+func (c *Client) SetAppMaintenance(appID string, maintenance *ct.AppMaintenance) error {
+	return c.Put(fmt.Sprintf("/apps/%s/maintenance", appID), maintenance, maintenance)
+}
+
+// GetAppMeta returns the metadata of an app.
+func (c *Client) GetAppMeta(appID string) (map[string]string, error) {
+	var meta map[string]string
+	return meta, c.Get(fmt.Sprintf("/apps/%s/meta", appID), &meta)
+}
+
+// UpdateAppMeta merges meta into the metadata of an app, keys with a nil value
+// are removed. It returns the resulting metadata.
+func (c *Client) UpdateAppMeta(appID string, meta map[string]*string) (map[string]string, error) {
+	var res map[string]string
+	return res, c.Put(fmt.Sprintf("/apps/%s/meta", appID), meta, &res)
+}
+
+// RenameApp changes the name of an app and moves its default route to the
+// domain of the new name.
+func (c *Client) RenameApp(appID, name string) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.Post(fmt.Sprintf("/apps/%s/rename", appID), &ct.App{Name: name}, app)
+}
+
 // DeleteApp deletes an app.
 func (c *Client) DeleteApp(appID string) error {
 	return c.Delete(fmt.Sprintf("/apps/%s", appID))
@@ -125,6 +176,31 @@ func (c *Client) GetProvider(providerID string) (*ct.Provider, error) {
 	return provider, c.Get(fmt.Sprintf("/providers/%s", providerID), provider)
 }
 
+// UpdateProvider updates the URL and plans of the provider identified by
+// provider.ID. A blank URL or nil plans are left unchanged.
+func (c *Client) UpdateProvider(provider *ct.Provider) error {
+	return c.Post(fmt.Sprintf("/providers/%s", provider.ID), provider, provider)
+}
+
+// PingProvider checks that the provider identified by providerID is
+// reachable, returning the latency and version reported by the provider.
+func (c *Client) PingProvider(providerID string) (*ct.ProviderStatus, error) {
+	status := &ct.ProviderStatus{}
+	return status, c.Get(fmt.Sprintf("/providers/%s/ping", providerID), status)
+}
+
+// SyncProviderResources compares the resources of a provider with those
+// recorded by the controller, if repair is true resources found on only one
+// side are removed.
+func (c *Client) SyncProviderResources(providerID string, repair bool) (*ct.ResourceSync, error) {
+	path := fmt.Sprintf("/providers/%s/resources/sync", providerID)
+	if repair {
+		path += "?repair=true"
+	}
+	sync := &ct.ResourceSync{}
+	return sync, c.Post(path, nil, sync)
+}
+
 // ProvisionResource uses a provider to provision a new resource for the
 // application. Returns details about the resource.
 func (c *Client) ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error) {
@@ -136,6 +212,23 @@ func (c *Client) ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error) {
 	return res, err
 }
 
+// ProvisionResourceAsync starts provisioning a new resource for the provider
+// and returns the operation which can be used to wait for it, see
+// WaitOperation.
+func (c *Client) ProvisionResourceAsync(req *ct.ResourceReq) (*ct.Operation, error) {
+	if req.ProviderID == "" {
+		return nil, errors.New("controller: missing provider id")
+	}
+	op := &ct.Operation{}
+	header := http.Header{"Prefer": {"respond-async"}}
+	res, err := c.RawReq("POST", fmt.Sprintf("/providers/%s/resources", req.ProviderID), header, req, op)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return op, nil
+}
+
 // GetResource returns the resource identified by resourceID under providerID.
 func (c *Client) GetResource(providerID, resourceID string) (*ct.Resource, error) {
 	res := &ct.Resource{}
@@ -155,6 +248,19 @@ func (c *Client) AppResourceList(appID string) ([]*ct.Resource, error) {
 	return resources, c.Get(fmt.Sprintf("/apps/%s/resources", appID), &resources)
 }
 
+// AddResourceApp binds an existing resource to appID, deploying a new release
+// of the app with the resource's env.
+func (c *Client) AddResourceApp(appID, resourceID string) (*ct.Resource, error) {
+	res := &ct.Resource{}
+	return res, c.Put(fmt.Sprintf("/apps/%s/resources/%s", appID, resourceID), nil, res)
+}
+
+// DeleteResourceApp unbinds a resource from appID, deploying a new release of
+// the app without the resource's env.
+func (c *Client) DeleteResourceApp(appID, resourceID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/resources/%s", appID, resourceID))
+}
+
 // PutResource updates a resource.
 func (c *Client) PutResource(resource *ct.Resource) error {
 	if resource.ID == "" || resource.ProviderID == "" {
@@ -171,6 +277,13 @@ func (c *Client) PutFormation(formation *ct.Formation) error {
 	return c.Put(fmt.Sprintf("/apps/%s/formations/%s", formation.AppID, formation.ReleaseID), formation, formation)
 }
 
+// ScaleProcessType changes the number of processes of a single type in the
+// formation of the app's current release and returns the resulting formation.
+func (c *Client) ScaleProcessType(appID, typ string, scale *ct.ProcessScale) (*ct.Formation, error) {
+	formation := &ct.Formation{}
+	return formation, c.Put(fmt.Sprintf("/apps/%s/scale/%s", appID, typ), scale, formation)
+}
+
 // PutJob updates an existing job.
 func (c *Client) PutJob(job *ct.Job) error {
 	if job.ID == "" || job.AppID == "" {
@@ -181,7 +294,17 @@ func (c *Client) PutJob(job *ct.Job) error {
 
 // DeleteJob kills a specific job id under the specified app.
 func (c *Client) DeleteJob(appID, jobID string) error {
-	return c.Delete(fmt.Sprintf("/apps/%s/jobs/%s", appID, jobID))
+	return c.StopJob(appID, jobID, nil)
+}
+
+// StopJob stops a job, sending it the signal in opts and killing it if it
+// hasn't exited after the grace period. A nil opts sends SIGTERM.
+func (c *Client) StopJob(appID, jobID string, opts *host.StopOptions) error {
+	path := fmt.Sprintf("/apps/%s/jobs/%s", appID, jobID)
+	if q := opts.Query(); len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return c.Delete(path)
 }
 
 // SetAppRelease sets the specified release as the current release for an app.
@@ -195,6 +318,12 @@ func (c *Client) GetAppRelease(appID string) (*ct.Release, error) {
 	return release, c.Get(fmt.Sprintf("/apps/%s/release", appID), release)
 }
 
+// AppReleaseList returns the releases of an app, newest first.
+func (c *Client) AppReleaseList(appID string) ([]*ct.Release, error) {
+	var releases []*ct.Release
+	return releases, c.Get(fmt.Sprintf("/apps/%s/releases", appID), &releases)
+}
+
 // RouteList returns all routes for an app.
 func (c *Client) RouteList(appID string) ([]*router.Route, error) {
 	var routes []*router.Route
@@ -217,6 +346,29 @@ func (c *Client) DeleteRoute(appID string, routeID string) error {
 	return c.Delete(fmt.Sprintf("/apps/%s/routes/%s", appID, routeID))
 }
 
+// CollectRoutes removes routes whose app no longer exists and returns them. If
+// dryRun is true, the routes are returned without being removed.
+func (c *Client) CollectRoutes(dryRun bool) ([]*router.Route, error) {
+	var routes []*router.Route
+	return routes, c.Post(fmt.Sprintf("/routes/gc?dry_run=%t", dryRun), nil, &routes)
+}
+
+// CollectDeployments removes finished deployments beyond the most recent keep
+// of each app or older than maxAge and returns them, zero values use the
+// cluster's retention settings. If dryRun is true, the deployments are
+// returned without being removed.
+func (c *Client) CollectDeployments(keep int, maxAge time.Duration, dryRun bool) ([]*ct.Deployment, error) {
+	q := url.Values{"dry_run": {strconv.FormatBool(dryRun)}}
+	if keep > 0 {
+		q.Set("keep", strconv.Itoa(keep))
+	}
+	if maxAge > 0 {
+		q.Set("max_age", maxAge.String())
+	}
+	var deployments []*ct.Deployment
+	return deployments, c.Post("/deployments/gc?"+q.Encode(), nil, &deployments)
+}
+
 // GetFormation returns details for the specified formation under app and
 // release.
 func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
@@ -235,12 +387,33 @@ func (c *Client) DeleteFormation(appID, releaseID string) error {
 	return c.Delete(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID))
 }
 
+// FormationHistory returns the changes of the process counts of the formation
+// identified by appID and releaseID, newest first.
+func (c *Client) FormationHistory(appID, releaseID string) ([]*ct.FormationChange, error) {
+	var changes []*ct.FormationChange
+	return changes, c.Get(fmt.Sprintf("/apps/%s/formations/%s/history", appID, releaseID), &changes)
+}
+
 // GetRelease returns details for the specified release.
 func (c *Client) GetRelease(releaseID string) (*ct.Release, error) {
 	release := &ct.Release{}
 	return release, c.Get(fmt.Sprintf("/releases/%s", releaseID), release)
 }
 
+// DeleteRelease deletes a release which is not in use by any app.
+func (c *Client) DeleteRelease(releaseID string) error {
+	return c.Delete(fmt.Sprintf("/releases/%s", releaseID))
+}
+
+// UploadArtifact stores the contents of r in the blobstore and returns a new
+// artifact of the given type which references it.
+func (c *Client) UploadArtifact(typ string, r io.Reader) (*ct.Artifact, error) {
+	artifact := &ct.Artifact{}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	_, err := c.RawReq("POST", "/artifacts/upload?type="+url.QueryEscape(typ), header, r, artifact)
+	return artifact, err
+}
+
 // GetArtifact returns details for the specified artifact.
 func (c *Client) GetArtifact(artifactID string) (*ct.Artifact, error) {
 	artifact := &ct.Artifact{}
@@ -253,21 +426,197 @@ func (c *Client) GetApp(appID string) (*ct.App, error) {
 	return app, c.Get(fmt.Sprintf("/apps/%s", appID), app)
 }
 
+// CompleteDeployment sets the app release to the new release of a performed
+// deployment and marks the deployment as finished in a single transaction.
+func (c *Client) CompleteDeployment(appID, deploymentID string) error {
+	return c.Post(fmt.Sprintf("/apps/%s/deployments/%s/complete", appID, deploymentID), nil, nil)
+}
+
+// RollbackDeployment restores the old formation of a failed deployment,
+// removes its new formation and marks it as finished in a single
+// transaction.
+func (c *Client) RollbackDeployment(appID, deploymentID string) error {
+	return c.Post(fmt.Sprintf("/apps/%s/deployments/%s/rollback", appID, deploymentID), nil, nil)
+}
+
 // GetDeployment returns a deployment queued on the deployer.
 func (c *Client) GetDeployment(deploymentID string) (*ct.Deployment, error) {
 	res := &ct.Deployment{}
 	return res, c.Get(fmt.Sprintf("/deployments/%s", deploymentID), res)
 }
 
+// CreateDeployment creates a deployment of the release to the app.
 func (c *Client) CreateDeployment(appID, releaseID string) (*ct.Deployment, error) {
 	deployment := &ct.Deployment{}
-	return deployment, c.Post(fmt.Sprintf("/apps/%s/deploy", appID), &ct.Release{ID: releaseID}, deployment)
+	return deployment, c.Post(fmt.Sprintf("/apps/%s/deployments", appID), &ct.Release{ID: releaseID}, deployment)
+}
+
+// CreateDeploymentWithOptions creates a deployment of the release in opts.
+func (c *Client) CreateDeploymentWithOptions(appID string, opts *ct.DeploymentOptions) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	return deployment, c.Post(fmt.Sprintf("/apps/%s/deployments", appID), opts, deployment)
+}
+
+// CreateDeploymentWithLock creates a deployment of an app whose deploys are
+// locked by lockOwner.
+func (c *Client) CreateDeploymentWithLock(appID, releaseID, lockOwner string) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	path := fmt.Sprintf("/apps/%s/deployments?lock_owner=%s", appID, url.QueryEscape(lockOwner))
+	return deployment, c.Post(path, &ct.Release{ID: releaseID}, deployment)
+}
+
+// AcquireDeployLock locks deploys of an app by anyone other than lock.Owner,
+// or extends the lock if it is already held by lock.Owner. If
+// lock.ExpiresAt is not set, the lock expires after an hour.
+func (c *Client) AcquireDeployLock(appID string, lock *ct.DeployLock) error {
+	return c.Put(fmt.Sprintf("/apps/%s/deploy_lock", appID), lock, lock)
+}
+
+// GetDeployLock returns the deploy lock of an app, or ErrNotFound if deploys
+// are not locked.
+func (c *Client) GetDeployLock(appID string) (*ct.DeployLock, error) {
+	lock := &ct.DeployLock{}
+	return lock, c.Get(fmt.Sprintf("/apps/%s/deploy_lock", appID), lock)
+}
+
+// ReleaseDeployLock releases the deploy lock of an app held by owner and the
+// client's token. If owner is empty, the lock is force released, which
+// requires a full scope token.
+func (c *Client) ReleaseDeployLock(appID, owner string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/deploy_lock?owner=%s", appID, url.QueryEscape(owner)))
+}
+
+// DeploymentList returns a list of all deployments of an app, newest first.
+func (c *Client) DeploymentList(appID string) ([]*ct.Deployment, error) {
+	var deployments []*ct.Deployment
+	return deployments, c.Get(fmt.Sprintf("/apps/%s/deployments", appID), &deployments)
+}
+
+// DeploymentListWithFilter returns the deployments matching filter across all
+// apps which the client can access, newest first.
+func (c *Client) DeploymentListWithFilter(filter *ct.DeploymentFilter) ([]*ct.Deployment, error) {
+	q := make(url.Values)
+	if filter.AppID != "" {
+		q.Set("app", filter.AppID)
+	}
+	if filter.Status != "" {
+		q.Set("status", filter.Status)
+	}
+	if filter.Since != nil {
+		q.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if filter.Until != nil {
+		q.Set("until", filter.Until.Format(time.RFC3339))
+	}
+	if filter.Limit > 0 {
+		q.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	path := "/deployments"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var deployments []*ct.Deployment
+	return deployments, c.Get(path, &deployments)
 }
 
 func (c *Client) StreamDeployment(deploymentID string, output chan<- *ct.DeploymentEvent) (stream.Stream, error) {
 	return c.Stream("GET", fmt.Sprintf("/deployments/%s", deploymentID), nil, output)
 }
 
+// StreamDeploymentEvents streams the events of a deployment of an app to the
+// output channel. If sinceID is greater than zero only events created after
+// the event with that ID are sent, otherwise all the events of the deployment
+// are sent before new ones.
+func (c *Client) StreamDeploymentEvents(appID, deploymentID string, sinceID int64, output chan<- *ct.DeploymentEvent) (stream.Stream, error) {
+	path := fmt.Sprintf("/apps/%s/deployments/%s/events", appID, deploymentID)
+	if sinceID > 0 {
+		path += "?since_id=" + strconv.FormatInt(sinceID, 10)
+	}
+	return c.Stream("GET", path, nil, output)
+}
+
+// StreamEvents streams controller events to the output channel. If sinceID is
+// greater than zero, events created after the event with that ID are sent
+// first.
+func (c *Client) StreamEvents(sinceID int64, output chan<- *ct.Event) (stream.Stream, error) {
+	return c.StreamEventsWithOptions(&ct.StreamEventsOptions{SinceID: sinceID}, output)
+}
+
+// StreamEventsWithOptions streams the controller events matching opts to the
+// output channel, the events are filtered by the controller.
+func (c *Client) StreamEventsWithOptions(opts *ct.StreamEventsOptions, output chan<- *ct.Event) (stream.Stream, error) {
+	query := url.Values{}
+	if opts.SinceID > 0 {
+		query.Set("since_id", strconv.FormatInt(opts.SinceID, 10))
+	}
+	if len(opts.AppIDs) > 0 {
+		query.Set("app_id", strings.Join(opts.AppIDs, ","))
+	}
+	if len(opts.ObjectTypes) > 0 {
+		query.Set("object_type", strings.Join(opts.ObjectTypes, ","))
+	}
+	if len(opts.Kinds) > 0 {
+		query.Set("kind", strings.Join(opts.Kinds, ","))
+	}
+	path := "/events"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.Stream("GET", path, nil, output)
+}
+
+// GetOperation returns the operation identified by operationID.
+func (c *Client) GetOperation(operationID string) (*ct.Operation, error) {
+	op := &ct.Operation{}
+	return op, c.Get(fmt.Sprintf("/operations/%s", operationID), op)
+}
+
+// StreamOperation streams the operation identified by operationID to the
+// output channel each time its status changes, the stream ends once the
+// operation is complete or failed.
+func (c *Client) StreamOperation(operationID string, output chan<- *ct.Operation) (stream.Stream, error) {
+	return c.Stream("GET", fmt.Sprintf("/operations/%s", operationID), nil, output)
+}
+
+// WaitOperation waits for the operation identified by operationID to finish
+// and decodes its result into out. It returns an error if the operation
+// failed.
+func (c *Client) WaitOperation(operationID string, out interface{}) error {
+	ops := make(chan *ct.Operation)
+	stream, err := c.StreamOperation(operationID, ops)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	for op := range ops {
+		if op.Done() {
+			return operationResult(op, out)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	// the stream ended early, so poll the operation instead
+	op, err := c.GetOperation(operationID)
+	if err != nil {
+		return err
+	}
+	if !op.Done() {
+		return fmt.Errorf("controller: operation %s did not finish", op.ID)
+	}
+	return operationResult(op, out)
+}
+
+func operationResult(op *ct.Operation, out interface{}) error {
+	if op.Status == ct.OperationStatusFailed {
+		return fmt.Errorf("controller: operation %s failed: %s", op.ID, op.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(op.Result, out)
+}
+
 func (c *Client) DeployAppRelease(appID, releaseID string) error {
 	d, err := c.CreateDeployment(appID, releaseID)
 	if err != nil {
@@ -300,13 +649,16 @@ outer:
 	return nil
 }
 
-// StreamJobEvents streams job events to the output channel.
+// StreamJobEvents streams job events to the output channel. If lastID is
+// greater than zero, events created after the event with that ID are sent
+// first, so a stream can be resumed from the ID of the last event received.
 func (c *Client) StreamJobEvents(appID string, lastID int64, output chan<- *ct.JobEvent) (stream.Stream, error) {
-	header := http.Header{
-		"Accept":        []string{"text/event-stream"},
-		"Last-Event-Id": []string{strconv.FormatInt(lastID, 10)},
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	path := fmt.Sprintf("/apps/%s/jobs", appID)
+	if lastID > 0 {
+		path += "?since_id=" + strconv.FormatInt(lastID, 10)
 	}
-	res, err := c.RawReq("GET", fmt.Sprintf("/apps/%s/jobs", appID), header, nil, nil)
+	res, err := c.RawReq("GET", path, header, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -317,9 +669,35 @@ func (c *Client) StreamJobEvents(appID string, lastID int64, output chan<- *ct.J
 // under appID. If tail is true, new log lines are streamed after the buffered
 // log.
 func (c *Client) GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error) {
+	return c.GetJobLogWithOptions(appID, jobID, &ct.JobLogOptions{Follow: tail})
+}
+
+// GetJobLogWithWait waits until the job is created, then returns a ReadCloser
+// stream of the job with id of jobID, running under appID. If tail is true,
+// new log lines are streamed after the buffered log.
+func (c *Client) GetJobLogWithWait(appID, jobID string, tail bool) (io.ReadCloser, error) {
+	return c.GetJobLogWithOptions(appID, jobID, &ct.JobLogOptions{Follow: tail, Wait: true})
+}
+
+// GetJobLogWithOptions returns a ReadCloser stream of the job with id of
+// jobID, running under appID, filtered using opts.
+func (c *Client) GetJobLogWithOptions(appID, jobID string, opts *ct.JobLogOptions) (io.ReadCloser, error) {
+	params := url.Values{}
+	if opts.Wait {
+		params.Set("wait", "true")
+	}
+	if opts.Follow {
+		params.Set("follow", "true")
+	}
+	if opts.Lines > 0 {
+		params.Set("lines", strconv.Itoa(opts.Lines))
+	}
+	if opts.Since != nil {
+		params.Set("since", opts.Since.Format(time.RFC3339))
+	}
 	path := fmt.Sprintf("/apps/%s/jobs/%s/log", appID, jobID)
-	if tail {
-		path += "?tail=true"
+	if len(params) > 0 {
+		path += "?" + params.Encode()
 	}
 	res, err := c.RawReq("GET", path, nil, nil, nil)
 	if err != nil {
@@ -328,13 +706,22 @@ func (c *Client) GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error
 	return res.Body, nil
 }
 
-// GetJobLogWithWait waits until the job is created, then returns a ReadCloser
-// stream of the job with id of jobID, running under appID. If tail is true,
-// new log lines are streamed after the buffered log.
-func (c *Client) GetJobLogWithWait(appID, jobID string, tail bool) (io.ReadCloser, error) {
-	path := fmt.Sprintf("/apps/%s/jobs/%s/log?wait=true", appID, jobID)
-	if tail {
-		path += "&tail=true"
+// GetAppLog returns a ReadCloser stream of the log of the app from the log
+// aggregator, which contains the output of all of the app's jobs encoded as
+// newline separated JSON messages.
+func (c *Client) GetAppLog(appID string, opts *logagg.LogOpts) (io.ReadCloser, error) {
+	params := url.Values{}
+	if opts != nil {
+		if opts.Follow {
+			params.Set("follow", "true")
+		}
+		if opts.Lines > 0 {
+			params.Set("lines", strconv.Itoa(opts.Lines))
+		}
+	}
+	path := fmt.Sprintf("/apps/%s/log", appID)
+	if len(params) > 0 {
+		path += "?" + params.Encode()
 	}
 	res, err := c.RawReq("GET", path, nil, nil, nil)
 	if err != nil {
@@ -350,6 +737,13 @@ func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (httpclient.ReadWr
 	return c.Hijack("POST", fmt.Sprintf("/apps/%s/jobs", appID), http.Header{"Upgrade": {"flynn-attach/0"}}, job)
 }
 
+// AttachJob attaches to a running job of the app, returning a ReadWriteCloser
+// stream of the attach protocol, which can be wrapped with
+// cluster.NewAttachClient.
+func (c *Client) AttachJob(appID, jobID string, opts *ct.JobAttachOptions) (httpclient.ReadWriteCloser, error) {
+	return c.Hijack("POST", fmt.Sprintf("/apps/%s/jobs/%s/attach", appID, jobID), http.Header{"Upgrade": {"flynn-attach/0"}}, opts)
+}
+
 // RunJobDetached runs a new job under the specified app, returning the job's
 // details.
 func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
@@ -363,6 +757,35 @@ func (c *Client) GetJob(appID, jobID string) (*ct.Job, error) {
 	return job, c.Get(fmt.Sprintf("/apps/%s/jobs/%s", appID, jobID), job)
 }
 
+// AppUsage returns the resource usage of an app collected between since and
+// until.
+func (c *Client) AppUsage(appID string, since, until time.Time) (*ct.AppUsage, error) {
+	q := make(url.Values)
+	q.Set("since", since.Format(time.RFC3339))
+	q.Set("until", until.Format(time.RFC3339))
+	usage := &ct.AppUsage{}
+	return usage, c.Get(fmt.Sprintf("/apps/%s/usage?%s", appID, q.Encode()), usage)
+}
+
+// AppMetrics returns the current resource utilization of an app's running
+// jobs.
+func (c *Client) AppMetrics(appID string) (*ct.AppMetrics, error) {
+	metrics := &ct.AppMetrics{}
+	return metrics, c.Get(fmt.Sprintf("/apps/%s/metrics", appID), metrics)
+}
+
+// GetVersion returns the version of the controller.
+func (c *Client) GetVersion() (*ct.Version, error) {
+	v := &ct.Version{}
+	return v, c.Get("/version", v)
+}
+
+// ClusterJobList returns the running jobs of all apps.
+func (c *Client) ClusterJobList() ([]*ct.ClusterJob, error) {
+	var jobs []*ct.ClusterJob
+	return jobs, c.Get("/jobs", &jobs)
+}
+
 // JobList returns a list of all jobs.
 func (c *Client) JobList(appID string) ([]*ct.Job, error) {
 	var jobs []*ct.Job
@@ -375,12 +798,41 @@ func (c *Client) AppList() ([]*ct.App, error) {
 	return apps, c.Get("/apps", &apps)
 }
 
+// AppListWithLabels returns a list of apps that have all of the given meta
+// labels.
+func (c *Client) AppListWithLabels(labels map[string]string) ([]*ct.App, error) {
+	q := make(url.Values, len(labels))
+	for k, v := range labels {
+		q.Add("label", k+"="+v)
+	}
+	var apps []*ct.App
+	return apps, c.Get("/apps?"+q.Encode(), &apps)
+}
+
+// AppListInNamespace returns a list of the apps in the namespace identified by
+// namespaceID.
+func (c *Client) AppListInNamespace(namespaceID string) ([]*ct.App, error) {
+	var apps []*ct.App
+	return apps, c.Get("/apps?namespace="+url.QueryEscape(namespaceID), &apps)
+}
+
 // KeyList returns a list of all ssh public keys added.
 func (c *Client) KeyList() ([]*ct.Key, error) {
 	var keys []*ct.Key
 	return keys, c.Get("/keys", &keys)
 }
 
+// KeyListWithLabels returns a list of ssh public keys that have all of the
+// given labels.
+func (c *Client) KeyListWithLabels(labels map[string]string) ([]*ct.Key, error) {
+	q := make(url.Values, len(labels))
+	for k, v := range labels {
+		q.Add("label", k+"="+v)
+	}
+	var keys []*ct.Key
+	return keys, c.Get("/keys?"+q.Encode(), &keys)
+}
+
 // ArtifactList returns a list of all artifacts
 func (c *Client) ArtifactList() ([]*ct.Artifact, error) {
 	var artifacts []*ct.Artifact
@@ -399,19 +851,178 @@ func (c *Client) CreateKey(pubKey string) (*ct.Key, error) {
 	return key, c.Post("/keys", &ct.Key{Key: pubKey}, key)
 }
 
-// GetKey returns details for the keyID.
+// CreateKeys adds several ssh public keys at once, keys which already exist
+// are left unchanged. It returns the added keys.
+func (c *Client) CreateKeys(keys []*ct.Key) ([]*ct.Key, error) {
+	var res []*ct.Key
+	return res, c.Post("/keys", keys, &res)
+}
+
+// GetKey returns details for the keyID, which is the MD5 fingerprint of the
+// key with or without colons.
 func (c *Client) GetKey(keyID string) (*ct.Key, error) {
 	key := &ct.Key{}
 	return key, c.Get(fmt.Sprintf("/keys/%s", keyID), key)
 }
 
+// GetKeyByFingerprint returns the key with the given MD5 fingerprint, in the
+// hex format of key IDs or the MD5:aa:bb:... format printed by ssh-keygen.
+func (c *Client) GetKeyByFingerprint(fingerprint string) (*ct.Key, error) {
+	key := &ct.Key{}
+	return key, c.Get("/keys/fingerprint/"+fingerprint, key)
+}
+
 // DeleteKey deletes a key with the specified id.
 func (c *Client) DeleteKey(id string) error {
 	return c.Delete("/keys/" + strings.Replace(id, ":", "", -1))
 }
 
+// CreateAuthToken creates a new auth token, the secret is returned in the
+// Token field and cannot be retrieved again.
+func (c *Client) CreateAuthToken(token *ct.AuthToken) error {
+	return c.Post("/auth_tokens", token, token)
+}
+
+// AuthTokenList returns a list of all unrevoked auth tokens.
+func (c *Client) AuthTokenList() ([]*ct.AuthToken, error) {
+	var tokens []*ct.AuthToken
+	return tokens, c.Get("/auth_tokens", &tokens)
+}
+
+// DeleteAuthToken revokes the auth token with the specified id.
+func (c *Client) DeleteAuthToken(id string) error {
+	return c.Delete("/auth_tokens/" + id)
+}
+
+// CreateAppToken creates a deploy token for the app, which can only create
+// releases and deployments of the app. token.Token contains the secret once
+// it is created.
+func (c *Client) CreateAppToken(appID string, token *ct.AuthToken) error {
+	return c.Post(fmt.Sprintf("/apps/%s/tokens", appID), token, token)
+}
+
+// AppTokenList returns a list of the unrevoked tokens scoped to the app.
+func (c *Client) AppTokenList(appID string) ([]*ct.AuthToken, error) {
+	var tokens []*ct.AuthToken
+	return tokens, c.Get(fmt.Sprintf("/apps/%s/tokens", appID), &tokens)
+}
+
+// DeleteAppToken revokes a token scoped to the app.
+func (c *Client) DeleteAppToken(appID, tokenID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/tokens/%s", appID, tokenID))
+}
+
+// CreateVolume provisions a volume on vol.HostID for a process type of the
+// app, setting vol.ID.
+func (c *Client) CreateVolume(appID string, vol *ct.Volume) error {
+	return c.Post(fmt.Sprintf("/apps/%s/volumes", appID), vol, vol)
+}
+
+// VolumeList returns a list of the app's volumes.
+func (c *Client) VolumeList(appID string) ([]*ct.Volume, error) {
+	var volumes []*ct.Volume
+	return volumes, c.Get(fmt.Sprintf("/apps/%s/volumes", appID), &volumes)
+}
+
+// GetVolume returns the app's volume with the given ID.
+func (c *Client) GetVolume(appID, volumeID string) (*ct.Volume, error) {
+	vol := &ct.Volume{}
+	return vol, c.Get(fmt.Sprintf("/apps/%s/volumes/%s", appID, volumeID), vol)
+}
+
+// DeleteVolume destroys an app's volume and its data.
+func (c *Client) DeleteVolume(appID, volumeID string) error {
+	return c.Delete(fmt.Sprintf("/apps/%s/volumes/%s", appID, volumeID))
+}
+
 // ProviderList returns a list of all providers.
 func (c *Client) ProviderList() ([]*ct.Provider, error) {
 	var providers []*ct.Provider
 	return providers, c.Get("/providers", &providers)
 }
+
+// ExportCluster returns a copy of the apps, releases, artifacts, formations,
+// providers, resources and routes in the cluster.
+func (c *Client) ExportCluster() (*ct.ClusterExport, error) {
+	export := &ct.ClusterExport{}
+	return export, c.Get("/export", export)
+}
+
+// ImportCluster restores a cluster export, skipping objects which already
+// exist, and returns the objects which were created.
+func (c *Client) ImportCluster(export *ct.ClusterExport) (*ct.ClusterExport, error) {
+	imported := &ct.ClusterExport{}
+	return imported, c.Post("/import", export, imported)
+}
+
+// ImportApps creates or updates the apps in defs, returning the result of
+// importing each of them in the same order.
+func (c *Client) ImportApps(defs []*ct.AppDefinition) ([]*ct.AppImportResult, error) {
+	var results []*ct.AppImportResult
+	return results, c.Post("/apps/import", defs, &results)
+}
+
+// MigrationList returns the status of the controller database migrations.
+func (c *Client) MigrationList() ([]*ct.MigrationStatus, error) {
+	var list []*ct.MigrationStatus
+	return list, c.Get("/migrations", &list)
+}
+
+// RollbackMigrations reverts the controller database migrations applied after
+// version and returns their IDs, if dryRun is true the migrations are checked
+// but not reverted.
+func (c *Client) RollbackMigrations(version int, dryRun bool) ([]int, error) {
+	res := &ct.MigrationRollback{}
+	err := c.Post("/migrations/rollback", &ct.MigrationRollback{Version: version, DryRun: dryRun}, res)
+	return res.Migrations, err
+}
+
+// SettingList returns all cluster settings, including those which have not
+// been set and so have their default value.
+func (c *Client) SettingList() ([]*ct.Setting, error) {
+	var settings []*ct.Setting
+	return settings, c.Get("/settings", &settings)
+}
+
+// GetSetting returns the cluster setting with the given key.
+func (c *Client) GetSetting(key string) (*ct.Setting, error) {
+	setting := &ct.Setting{}
+	return setting, c.Get(fmt.Sprintf("/settings/%s", key), setting)
+}
+
+// SetSetting sets the value of a cluster setting.
+func (c *Client) SetSetting(key, value string) (*ct.Setting, error) {
+	setting := &ct.Setting{}
+	return setting, c.Put(fmt.Sprintf("/settings/%s", key), &ct.Setting{Value: value}, setting)
+}
+
+// DeleteSetting resets a cluster setting to its default.
+func (c *Client) DeleteSetting(key string) error {
+	return c.Delete(fmt.Sprintf("/settings/%s", key))
+}
+
+// RegistryList returns the registries with cluster wide pull credentials,
+// without their passwords.
+func (c *Client) RegistryList() ([]*ct.Registry, error) {
+	var registries []*ct.Registry
+	return registries, c.Get("/registries", &registries)
+}
+
+// SetRegistry sets the credentials used to pull the images of artifacts from
+// the registry at host which don't have credentials of their own.
+func (c *Client) SetRegistry(host, username, password string) (*ct.Registry, error) {
+	registry := &ct.Registry{}
+	return registry, c.Put(fmt.Sprintf("/registries/%s", host), &ct.Registry{Username: username, Password: password}, registry)
+}
+
+// DeleteRegistry removes the credentials of the registry at host.
+func (c *Client) DeleteRegistry(host string) error {
+	return c.Delete(fmt.Sprintf("/registries/%s", host))
+}
+
+// Search returns the apps, releases, routes and jobs matching q, which may be
+// an ID, an app name or part of one, or part of a route domain.
+func (c *Client) Search(q string) ([]*ct.SearchResult, error) {
+	var results []*ct.SearchResult
+	return results, c.Get("/search?q="+url.QueryEscape(q), &results)
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
-	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/bgentry/que-go"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
@@ -18,9 +20,12 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/name"
 	"github.com/flynn/flynn/controller/schema"
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/discoverd/client"
+	logaggc "github.com/flynn/flynn/logaggregator/client"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/cors"
 	"github.com/flynn/flynn/pkg/ctxhelper"
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
@@ -79,6 +84,7 @@ func main() {
 	}
 
 	sc := routerc.New()
+	lc := logaggc.New()
 
 	hb, err := discoverd.AddServiceAndRegister("flynn-controller", addr)
 	if err != nil {
@@ -89,19 +95,182 @@ func main() {
 		hb.Close()
 	})
 
-	handler := appHandler(handlerConfig{db: db, cc: cc, sc: sc, pgxpool: pgxpool, key: os.Getenv("AUTH_KEY")})
-	shutdown.Fatal(http.ListenAndServe(addr, handler))
+	var rateLimit float64
+	if s := os.Getenv("RATE_LIMIT"); s != "" {
+		rateLimit, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.Fatalln("error parsing RATE_LIMIT:", err)
+		}
+	}
+	var rateBurst int
+	if s := os.Getenv("RATE_LIMIT_BURST"); s != "" {
+		rateBurst, err = strconv.Atoi(s)
+		if err != nil {
+			log.Fatalln("error parsing RATE_LIMIT_BURST:", err)
+		}
+	}
+
+	secretsKey, err := secrets.ParseKey(os.Getenv("SECRETS_KEY"))
+	if err != nil {
+		log.Fatalln("error parsing SECRETS_KEY:", err)
+	}
+
+	blobstoreURL := os.Getenv("BLOBSTORE_URL")
+	if blobstoreURL == "" {
+		blobstoreURL = "http://blobstore.discoverd"
+	}
+
+	// the environment only provides defaults for settings, which can be
+	// changed at runtime through the settings API
+	notifier := newNotifier(db.DSN())
+	settings := NewSettingsRepo(db, notifier, map[string]string{
+		ct.SettingDefaultRouteDomain: os.Getenv("DEFAULT_ROUTE_DOMAIN"),
+		ct.SettingCORSAllowedOrigins: os.Getenv("CORS_ALLOWED_ORIGINS"),
+	})
+
+	collector := &usageCollector{
+		db:       db,
+		cc:       cc,
+		settings: settings,
+		interval: time.Minute,
+		routers:  discoverdRouters,
+	}
+	go collector.Run()
+
+	routeGC := &routeCollector{db: db, router: sc, interval: 10 * time.Minute}
+	go routeGC.Run()
+
+	deploymentGC := &deploymentCollector{db: db, settings: settings, interval: time.Hour}
+	go deploymentGC.Run()
+
+	opReaper := &operationReaper{repo: NewOperationRepo(db, nil, nil), interval: time.Minute}
+	go opReaper.Run()
+
+	var verifier *domainVerifier
+	if os.Getenv("VERIFY_ROUTE_DOMAINS") == "true" {
+		verifier = newDomainVerifier(os.Getenv("AUTH_KEY"), func() string {
+			return settings.Value(ct.SettingDefaultRouteDomain)
+		})
+	}
+
+	handler := appHandler(handlerConfig{
+		db:             db,
+		cc:             cc,
+		sc:             sc,
+		lc:             lc,
+		pgxpool:        pgxpool,
+		key:            os.Getenv("AUTH_KEY"),
+		rateLimit:      rateLimit,
+		rateBurst:      rateBurst,
+		cors:           corsOptionsFromEnv(),
+		blobstoreURL:   blobstoreURL,
+		domainVerifier: verifier,
+		settings:       settings,
+		notifier:       notifier,
+		secretsKey:     secretsKey,
+	})
+
+	timeouts := newHTTPTimeouts()
+	for env, timeout := range map[string]*time.Duration{
+		"HTTP_READ_TIMEOUT":   &timeouts.BodyTimeout,
+		"HTTP_UPLOAD_TIMEOUT": &timeouts.UploadTimeout,
+		"HTTP_WRITE_TIMEOUT":  &timeouts.WriteTimeout,
+	} {
+		if s := os.Getenv(env); s != "" {
+			*timeout, err = time.ParseDuration(s)
+			if err != nil {
+				log.Fatalf("error parsing %s: %s", env, err)
+			}
+		}
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:        timeouts.Handler(handler),
+		ConnState:      timeouts.ConnState,
+		MaxHeaderBytes: 1 << 20,
+	}
+	shutdown.Fatal(srv.Serve(timeouts.Listener(l)))
 }
 
 type handlerConfig struct {
 	db      *postgres.DB
 	cc      clusterClient
 	sc      routerc.Client
+	lc      logaggc.Client
 	pgxpool *pgx.ConnPool
 	key     string
+
+	// rateLimit and rateBurst are the default request rate limit of auth
+	// tokens, a rateLimit of zero disables it.
+	rateLimit float64
+	rateBurst int
+
+	// cors is the CORS policy, the httphelper policy is used if it is nil.
+	// Its origins are replaced by the cors_allowed_origins setting.
+	cors *cors.Options
+
+	// blobstoreURL is the URL of the blobstore which artifact uploads are
+	// stored in.
+	blobstoreURL string
+
+	// domainVerifier verifies the domains of new routes, it is nil if
+	// domain verification is disabled.
+	domainVerifier *domainVerifier
+
+	// settings are the cluster settings, if nil they are read from db
+	// without any defaults.
+	settings *SettingsRepo
+
+	// notifier is shared by the repos which listen for notifications, a
+	// new one is created if it is nil.
+	notifier *notifier
+
+	// secretsKey seals release secrets, it is nil if secrets are disabled.
+	secretsKey *secrets.Key
+}
+
+// corsOptionsFromEnv returns the CORS policy configured by the
+// CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS comma-separated lists, which
+// default to the httphelper policy. Allowed origins are a cluster setting
+// which defaults to CORS_ALLOWED_ORIGINS, see settingsCORSHandler.
+func corsOptionsFromEnv() *cors.Options {
+	opts := httphelper.CORSOptions()
+	if methods := splitEnvList("CORS_ALLOWED_METHODS"); len(methods) > 0 {
+		opts.AllowMethods = methods
+	}
+	if headers := splitEnvList("CORS_ALLOWED_HEADERS"); len(headers) > 0 {
+		opts.AllowHeaders = headers
+	}
+	return opts
 }
 
-// NOTE: this is temporary until httphelper supports custom errors
+func splitEnvList(name string) []string {
+	var list []string
+	for _, s := range strings.Split(os.Getenv(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+var (
+	errUnauthorized = httphelper.JSONError{
+		Code:    httphelper.UnauthorizedError,
+		Message: "a valid auth key or token is required",
+	}
+	errForbidden = httphelper.JSONError{
+		Code:    httphelper.ForbiddenError,
+		Message: "the auth token does not permit this request",
+	}
+)
+
+// respondWithError writes err as a JSON error response, translating
+// controller errors into their httphelper.JSONError equivalents so that all
+// errors have the same structure.
 func respondWithError(w http.ResponseWriter, err error) {
 	switch v := err.(type) {
 	case ct.ValidationError:
@@ -112,16 +281,18 @@ func respondWithError(w http.ResponseWriter, err error) {
 		err = httphelper.JSONError{
 			Code:    httphelper.ValidationError,
 			Message: fmt.Sprintf("%s %s", v.Field, v.Message),
+			Field:   v.Field,
 			Detail:  detail,
 		}
-		httphelper.Error(w, err)
 	default:
 		if err == ErrNotFound {
-			w.WriteHeader(404)
-			return
+			err = httphelper.JSONError{
+				Code:    httphelper.ObjectNotFoundError,
+				Message: "not found",
+			}
 		}
-		httphelper.Error(w, err)
 	}
+	httphelper.Error(w, err)
 }
 
 func appHandler(c handlerConfig) http.Handler {
@@ -130,43 +301,91 @@ func appHandler(c handlerConfig) http.Handler {
 		shutdown.Fatal(err)
 	}
 
+	namespaceRepo := NewNamespaceRepo(c.db)
 	providerRepo := NewProviderRepo(c.db)
 	keyRepo := NewKeyRepo(c.db)
 	resourceRepo := NewResourceRepo(c.db)
-	appRepo := NewAppRepo(c.db, os.Getenv("DEFAULT_ROUTE_DOMAIN"), c.sc)
-	artifactRepo := NewArtifactRepo(c.db)
-	releaseRepo := NewReleaseRepo(c.db)
-	jobRepo := NewJobRepo(c.db)
+	notifier := c.notifier
+	if notifier == nil {
+		notifier = newNotifier(c.db.DSN())
+	}
+	settingsRepo := c.settings
+	if settingsRepo == nil {
+		settingsRepo = NewSettingsRepo(c.db, notifier, nil)
+	}
+	appRepo := NewAppRepo(c.db, settingsRepo, c.sc)
+	artifactRepo := NewArtifactRepo(c.db, c.secretsKey)
+	registryRepo := NewRegistryRepo(c.db, c.secretsKey)
+	releaseRepo := NewReleaseRepo(c.db, c.secretsKey)
+	jobRepo := NewJobRepo(c.db, notifier)
 	formationRepo := NewFormationRepo(c.db, appRepo, releaseRepo, artifactRepo)
-	deploymentRepo := NewDeploymentRepo(c.db, c.pgxpool)
+	deploymentRepo := NewDeploymentRepo(c.db, c.pgxpool, notifier)
+	eventRepo := NewEventRepo(c.db, notifier)
+	authTokenRepo := NewAuthTokenRepo(c.db)
+	idempotencyRepo := NewIdempotencyRepo(c.db)
+	deployLockRepo := NewDeployLockRepo(c.db)
+	volumeRepo := NewVolumeRepo(c.db)
+	operationRepo := NewOperationRepo(c.db, notifier, c.secretsKey)
+	usageRepo := NewUsageRepo(c.db)
+	searchRepo := NewSearchRepo(c.db)
 
 	api := controllerAPI{
-		appRepo:        appRepo,
-		releaseRepo:    releaseRepo,
-		providerRepo:   providerRepo,
-		formationRepo:  formationRepo,
-		artifactRepo:   artifactRepo,
-		jobRepo:        jobRepo,
-		resourceRepo:   resourceRepo,
-		deploymentRepo: deploymentRepo,
-		clusterClient:  c.cc,
-		routerc:        c.sc,
+		namespaceRepo:       namespaceRepo,
+		appRepo:             appRepo,
+		releaseRepo:         releaseRepo,
+		providerRepo:        providerRepo,
+		formationRepo:       formationRepo,
+		artifactRepo:        artifactRepo,
+		keyRepo:             keyRepo,
+		registryRepo:        registryRepo,
+		jobRepo:             jobRepo,
+		resourceRepo:        resourceRepo,
+		deploymentRepo:      deploymentRepo,
+		deployLockRepo:      deployLockRepo,
+		volumeRepo:          volumeRepo,
+		eventRepo:           eventRepo,
+		authTokenRepo:       authTokenRepo,
+		operationRepo:       operationRepo,
+		usageRepo:           usageRepo,
+		settingsRepo:        settingsRepo,
+		searchRepo:          searchRepo,
+		routeCollector:      &routeCollector{db: c.db, router: c.sc},
+		deploymentCollector: &deploymentCollector{db: c.db, settings: settingsRepo},
+		clusterClient:       c.cc,
+		routerc:             c.sc,
+		logaggc:             c.lc,
+		blobstoreURL:        c.blobstoreURL,
+		domainVerifier:      c.domainVerifier,
+		secretsKey:          c.secretsKey,
 	}
 
 	httpRouter := httprouter.New()
 
-	crud(httpRouter, "apps", ct.App{}, appRepo)
+	crud(httpRouter, "namespaces", ct.Namespace{}, namespaceRepo)
 	crud(httpRouter, "releases", ct.Release{}, releaseRepo)
 	crud(httpRouter, "providers", ct.Provider{}, providerRepo)
 	crud(httpRouter, "artifacts", ct.Artifact{}, artifactRepo)
+	httpRouter.POST("/artifacts/upload", httphelper.WrapHandler(api.UploadArtifact))
 	crud(httpRouter, "keys", ct.Key{}, keyRepo)
-
-	httpRouter.POST("/apps/:apps_id", httphelper.WrapHandler(api.UpdateApp))
+	httpRouter.GET("/keys/:keys_id/:fingerprint", httphelper.WrapHandler(api.GetKeyByFingerprint))
+	crud(httpRouter, "auth_tokens", ct.AuthToken{}, authTokenRepo)
+
+	httpRouter.POST("/apps", httphelper.WrapHandler(api.CreateApp))
+	httpRouter.GET("/apps", httphelper.WrapHandler(api.ListApps))
+	httpRouter.GET("/apps/:apps_id", httphelper.WrapHandler(api.appLookup(api.GetApp)))
+	httpRouter.POST("/apps/:apps_id", httphelper.WrapHandler(api.importAppsOr(api.appLookup(api.UpdateApp))))
+	httpRouter.DELETE("/apps/:apps_id", httphelper.WrapHandler(api.appLookup(api.DeleteApp)))
+	httpRouter.POST("/apps/:apps_id/rename", httphelper.WrapHandler(api.appLookup(api.RenameApp)))
+	httpRouter.PUT("/apps/:apps_id/maintenance", httphelper.WrapHandler(api.appLookup(api.PutAppMaintenance)))
+	httpRouter.GET("/apps/:apps_id/meta", httphelper.WrapHandler(api.appLookup(api.GetAppMeta)))
+	httpRouter.PUT("/apps/:apps_id/meta", httphelper.WrapHandler(api.appLookup(api.PutAppMeta)))
 
 	httpRouter.PUT("/apps/:apps_id/formations/:releases_id", httphelper.WrapHandler(api.appLookup(api.PutFormation)))
 	httpRouter.GET("/apps/:apps_id/formations/:releases_id", httphelper.WrapHandler(api.appLookup(api.GetFormation)))
 	httpRouter.DELETE("/apps/:apps_id/formations/:releases_id", httphelper.WrapHandler(api.appLookup(api.DeleteFormation)))
+	httpRouter.GET("/apps/:apps_id/formations/:releases_id/history", httphelper.WrapHandler(api.appLookup(api.GetFormationHistory)))
 	httpRouter.GET("/apps/:apps_id/formations", httphelper.WrapHandler(api.appLookup(api.ListFormations)))
+	httpRouter.PUT("/apps/:apps_id/scale/:process_type", httphelper.WrapHandler(api.appLookup(api.ScaleProcessType)))
 	httpRouter.GET("/formations", httphelper.WrapHandler(api.GetFormations))
 
 	httpRouter.POST("/apps/:apps_id/jobs", httphelper.WrapHandler(api.appLookup(api.RunJob)))
@@ -175,58 +394,147 @@ func appHandler(c handlerConfig) http.Handler {
 	httpRouter.GET("/apps/:apps_id/jobs", httphelper.WrapHandler(api.appLookup(api.ListJobs)))
 	httpRouter.DELETE("/apps/:apps_id/jobs/:jobs_id", httphelper.WrapHandler(api.appLookup(api.KillJob)))
 	httpRouter.GET("/apps/:apps_id/jobs/:jobs_id/log", httphelper.WrapHandler(api.appLookup(api.JobLog)))
+	httpRouter.POST("/apps/:apps_id/jobs/:jobs_id/attach", httphelper.WrapHandler(api.appLookup(api.AttachJob)))
+	httpRouter.GET("/jobs", httphelper.WrapHandler(api.ListClusterJobs))
 
 	httpRouter.POST("/apps/:apps_id/deploy", httphelper.WrapHandler(api.appLookup(api.CreateDeployment)))
+	httpRouter.GET("/deployments", httphelper.WrapHandler(api.ListAllDeployments))
 	httpRouter.GET("/deployments/:deployment_id", httphelper.WrapHandler(api.GetDeployment))
+	httpRouter.POST("/deployments/gc", httphelper.WrapHandler(api.CollectDeployments))
+	httpRouter.POST("/apps/:apps_id/deployments", httphelper.WrapHandler(api.appLookup(api.CreateDeployment)))
+	httpRouter.GET("/apps/:apps_id/deployments", httphelper.WrapHandler(api.appLookup(api.ListDeployments)))
+	httpRouter.GET("/apps/:apps_id/deployments/:deployment_id", httphelper.WrapHandler(api.appLookup(api.GetDeployment)))
+	httpRouter.GET("/apps/:apps_id/deployments/:deployment_id/events", httphelper.WrapHandler(api.appLookup(api.StreamDeploymentEvents)))
+	httpRouter.POST("/apps/:apps_id/deployments/:deployment_id/complete", httphelper.WrapHandler(api.appLookup(api.CompleteDeployment)))
+	httpRouter.POST("/apps/:apps_id/deployments/:deployment_id/rollback", httphelper.WrapHandler(api.appLookup(api.RollbackDeployment)))
+	httpRouter.POST("/apps/:apps_id/tokens", httphelper.WrapHandler(api.appLookup(api.CreateAppToken)))
+	httpRouter.GET("/apps/:apps_id/tokens", httphelper.WrapHandler(api.appLookup(api.ListAppTokens)))
+	httpRouter.DELETE("/apps/:apps_id/tokens/:token_id", httphelper.WrapHandler(api.appLookup(api.DeleteAppToken)))
+
+	httpRouter.PUT("/apps/:apps_id/deploy_lock", httphelper.WrapHandler(api.appLookup(api.PutDeployLock)))
+	httpRouter.GET("/apps/:apps_id/deploy_lock", httphelper.WrapHandler(api.appLookup(api.GetDeployLock)))
+	httpRouter.DELETE("/apps/:apps_id/deploy_lock", httphelper.WrapHandler(api.appLookup(api.DeleteDeployLock)))
+
+	httpRouter.POST("/apps/:apps_id/volumes", httphelper.WrapHandler(api.appLookup(api.CreateVolume)))
+	httpRouter.GET("/apps/:apps_id/volumes", httphelper.WrapHandler(api.appLookup(api.ListVolumes)))
+	httpRouter.GET("/apps/:apps_id/volumes/:volume_id", httphelper.WrapHandler(api.appLookup(api.GetVolume)))
+	httpRouter.DELETE("/apps/:apps_id/volumes/:volume_id", httphelper.WrapHandler(api.appLookup(api.DeleteVolume)))
+
+	httpRouter.GET("/operations/:operation_id", httphelper.WrapHandler(api.GetOperation))
+
+	httpRouter.GET("/events", httphelper.WrapHandler(api.StreamEvents))
+
+	httpRouter.GET("/search", httphelper.WrapHandler(api.Search))
+
+	httpRouter.GET("/export", httphelper.WrapHandler(api.ExportCluster))
+	httpRouter.POST("/import", httphelper.WrapHandler(api.ImportCluster))
+
+	httpRouter.GET("/migrations", httphelper.WrapHandler(api.ListMigrations))
+	httpRouter.POST("/migrations/rollback", httphelper.WrapHandler(api.RollbackMigrations))
 
 	httpRouter.PUT("/apps/:apps_id/release", httphelper.WrapHandler(api.appLookup(api.SetAppRelease)))
 	httpRouter.GET("/apps/:apps_id/release", httphelper.WrapHandler(api.appLookup(api.GetAppRelease)))
-
+	httpRouter.GET("/apps/:apps_id/releases", httphelper.WrapHandler(api.appLookup(api.ListAppReleases)))
+	httpRouter.GET("/apps/:apps_id/usage", httphelper.WrapHandler(api.appLookup(api.GetAppUsage)))
+	httpRouter.GET("/apps/:apps_id/metrics", httphelper.WrapHandler(api.appLookup(api.GetAppMetrics)))
+	httpRouter.GET("/apps/:apps_id/log", httphelper.WrapHandler(api.appLookup(api.AppLog)))
+
+	httpRouter.GET("/settings", httphelper.WrapHandler(api.ListSettings))
+	httpRouter.GET("/settings/:settings_key", httphelper.WrapHandler(api.GetSetting))
+	httpRouter.PUT("/settings/:settings_key", httphelper.WrapHandler(api.PutSetting))
+	httpRouter.DELETE("/settings/:settings_key", httphelper.WrapHandler(api.DeleteSetting))
+
+	httpRouter.GET("/registries", httphelper.WrapHandler(api.ListRegistries))
+	httpRouter.PUT("/registries/:registry_host", httphelper.WrapHandler(api.PutRegistry))
+	httpRouter.DELETE("/registries/:registry_host", httphelper.WrapHandler(api.DeleteRegistry))
+
+	httpRouter.POST("/providers/:providers_id", httphelper.WrapHandler(api.UpdateProvider))
+	httpRouter.GET("/providers/:providers_id/ping", httphelper.WrapHandler(api.PingProvider))
 	httpRouter.POST("/providers/:providers_id/resources", httphelper.WrapHandler(api.ProvisionResource))
 	httpRouter.GET("/providers/:providers_id/resources", httphelper.WrapHandler(api.GetProviderResources))
+	httpRouter.POST("/providers/:providers_id/resources/sync", httphelper.WrapHandler(api.SyncProviderResources))
 	httpRouter.GET("/providers/:providers_id/resources/:resources_id", httphelper.WrapHandler(api.GetResource))
 	httpRouter.PUT("/providers/:providers_id/resources/:resources_id", httphelper.WrapHandler(api.PutResource))
 	httpRouter.GET("/apps/:apps_id/resources", httphelper.WrapHandler(api.appLookup(api.GetAppResources)))
+	httpRouter.PUT("/apps/:apps_id/resources/:resources_id", httphelper.WrapHandler(api.appLookup(api.PutAppResource)))
+	httpRouter.DELETE("/apps/:apps_id/resources/:resources_id", httphelper.WrapHandler(api.appLookup(api.DeleteAppResource)))
 
 	httpRouter.POST("/apps/:apps_id/routes", httphelper.WrapHandler(api.appLookup(api.CreateRoute)))
 	httpRouter.GET("/apps/:apps_id/routes", httphelper.WrapHandler(api.appLookup(api.GetRouteList)))
 	httpRouter.GET("/apps/:apps_id/routes/:routes_type/:routes_id", httphelper.WrapHandler(api.appLookup(api.GetRoute)))
 	httpRouter.DELETE("/apps/:apps_id/routes/:routes_type/:routes_id", httphelper.WrapHandler(api.appLookup(api.DeleteRoute)))
+	httpRouter.POST("/routes/gc", httphelper.WrapHandler(api.CollectRoutes))
+
+	corsOpts := c.cors
+	if corsOpts == nil {
+		corsOpts = httphelper.CORSOptions()
+	}
+	corsHandler := settingsCORSHandler(corsOpts, settingsRepo)
 
 	return httphelper.ContextInjector("controller",
-		httphelper.NewRequestLogger(muxHandler(httpRouter, c.key)))
+		httphelper.NewRequestLogger(muxHandler(apiVersionHandler(idempotencyHandler(httpRouter, idempotencyRepo)), c.key, authTokenRepo, newRateLimiter(c.rateLimit, c.rateBurst), corsHandler)))
 }
 
-func muxHandler(main http.Handler, authKey string) http.Handler {
+func muxHandler(main http.Handler, authKey string, tokens *AuthTokenRepo, limiter *rateLimiter, corsHandler http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		httphelper.CORSAllowAllHandler(w, r)
+		corsHandler(w, r)
 		if r.URL.Path == "/ping" || r.Method == "OPTIONS" {
 			w.WriteHeader(200)
 			return
 		}
-		_, password, _ := parseBasicAuth(r.Header)
-		if password == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-			password = r.URL.Query().Get("key")
+		if r.URL.Path == "/version" && r.Method == "GET" {
+			serveVersion(w)
+			return
+		}
+		token, err := authenticate(requestKey(r), authKey, tokens)
+		if err == ErrNotFound {
+			respondWithError(w, errUnauthorized)
+			return
+		} else if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		if !authorized(token, r) {
+			respondWithError(w, errForbidden)
+			return
 		}
-		if len(password) != len(authKey) || subtle.ConstantTimeCompare([]byte(password), []byte(authKey)) != 1 {
-			w.WriteHeader(401)
+		if !limiter.Allow(w, token) {
+			respondWithError(w, rateLimitedError(token))
 			return
 		}
-		main.ServeHTTP(w, r)
+		ctx := context.WithValue(w.(*httphelper.ResponseWriter).Context(), "auth_token", token)
+		main.ServeHTTP(httphelper.NewResponseWriter(w, ctx), r)
 	})
 }
 
 type controllerAPI struct {
-	appRepo        *AppRepo
-	releaseRepo    *ReleaseRepo
-	providerRepo   *ProviderRepo
-	formationRepo  *FormationRepo
-	artifactRepo   *ArtifactRepo
-	jobRepo        *JobRepo
-	resourceRepo   *ResourceRepo
-	deploymentRepo *DeploymentRepo
-	clusterClient  clusterClient
-	routerc        routerc.Client
+	namespaceRepo       *NamespaceRepo
+	appRepo             *AppRepo
+	releaseRepo         *ReleaseRepo
+	providerRepo        *ProviderRepo
+	formationRepo       *FormationRepo
+	artifactRepo        *ArtifactRepo
+	keyRepo             *KeyRepo
+	registryRepo        *RegistryRepo
+	jobRepo             *JobRepo
+	resourceRepo        *ResourceRepo
+	deploymentRepo      *DeploymentRepo
+	deployLockRepo      *DeployLockRepo
+	volumeRepo          *VolumeRepo
+	eventRepo           *EventRepo
+	authTokenRepo       *AuthTokenRepo
+	operationRepo       *OperationRepo
+	usageRepo           *UsageRepo
+	settingsRepo        *SettingsRepo
+	searchRepo          *SearchRepo
+	routeCollector      *routeCollector
+	deploymentCollector *deploymentCollector
+	clusterClient       clusterClient
+	routerc             routerc.Client
+	logaggc             logaggc.Client
+	blobstoreURL        string
+	domainVerifier      *domainVerifier
+	secretsKey          *secrets.Key
 }
 
 func (c *controllerAPI) getApp(ctx context.Context) *ct.App {
@@ -254,12 +562,16 @@ func (c *controllerAPI) getProvider(ctx context.Context) (*ct.Provider, error) {
 func (c *controllerAPI) appLookup(handler httphelper.HandlerFunc) httphelper.HandlerFunc {
 	return func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 		params, _ := ctxhelper.ParamsFromContext(ctx)
-		data, err := c.appRepo.Get(params.ByName("apps_id"))
+		app, err := c.appRepo.Lookup(params.ByName("apps_id"), tokenNamespace(ctx))
 		if err != nil {
 			respondWithError(w, err)
 			return
 		}
-		ctx = context.WithValue(ctx, "app", data.(*ct.App))
+		if !authorizedForApp(ctx, app) {
+			respondWithError(w, errForbidden)
+			return
+		}
+		ctx = context.WithValue(ctx, "app", app)
 		handler(ctx, w, req)
 	}
 }
@@ -280,6 +592,30 @@ func (c *controllerAPI) getRoute(ctx context.Context) (*router.Route, error) {
 	return route, err
 }
 
+// requestKey returns the auth key or token of the request, given either as a
+// bearer token or as the password of Basic auth. As EventSource can't set
+// headers, event streams may also give it in the key query parameter.
+func requestKey(r *http.Request) string {
+	if token := parseBearerAuth(r.Header); token != "" {
+		return token
+	}
+	_, password, _ := parseBasicAuth(r.Header)
+	if password == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		password = r.URL.Query().Get("key")
+	}
+	return password
+}
+
+// parseBearerAuth returns the token of a Bearer Authorization header, or an
+// empty string if the header uses another scheme.
+func parseBearerAuth(h http.Header) string {
+	s := strings.SplitN(h.Get("Authorization"), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(s[1])
+}
+
 func parseBasicAuth(h http.Header) (username, password string, err error) {
 	s := strings.SplitN(h.Get("Authorization"), " ", 2)
 
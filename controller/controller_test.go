@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/bgentry/que-go"
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
@@ -14,11 +25,16 @@ import (
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
 	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/secrets"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cors"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/testutils/postgres"
+	"github.com/flynn/flynn/router/types"
 )
 
 func init() {
@@ -29,16 +45,20 @@ func init() {
 func Test(t *testing.T) { TestingT(t) }
 
 type S struct {
-	cc  *tu.FakeCluster
-	srv *httptest.Server
-	hc  handlerConfig
-	c   *controller.Client
+	cc        *tu.FakeCluster
+	srv       *httptest.Server
+	hc        handlerConfig
+	c         *controller.Client
+	blobstore *fakeBlobstore
+	logagg    *fakeLogAggregator
 }
 
 var _ = Suite(&S{})
 
 var authKey = "test"
 
+var secretsKey = &secrets.Key{1, 2, 3}
+
 func (s *S) SetUpSuite(c *C) {
 	dbname := "controllertest"
 	if err := pgtestutils.SetupPostgres(dbname); err != nil {
@@ -67,7 +87,9 @@ func (s *S) SetUpSuite(c *C) {
 	}
 
 	s.cc = tu.NewFakeCluster()
-	s.hc = handlerConfig{db: pg, cc: s.cc, sc: newFakeRouter(), pgxpool: pgxpool, key: authKey}
+	s.blobstore = newFakeBlobstore()
+	s.logagg = newFakeLogAggregator()
+	s.hc = handlerConfig{db: pg, cc: s.cc, sc: newFakeRouter(), lc: s.logagg, pgxpool: pgxpool, key: authKey, blobstoreURL: s.blobstore.URL, secretsKey: secretsKey}
 	handler := appHandler(s.hc)
 	s.srv = httptest.NewServer(handler)
 	client, err := controller.NewClient(s.srv.URL, authKey)
@@ -78,8 +100,11 @@ func (s *S) SetUpSuite(c *C) {
 func (s *S) TestBadAuth(c *C) {
 	res, err := http.Get(s.srv.URL + "/apps")
 	c.Assert(err, IsNil)
+	var jsonErr httphelper.JSONError
+	c.Assert(json.NewDecoder(res.Body).Decode(&jsonErr), IsNil)
 	res.Body.Close()
 	c.Assert(res.StatusCode, Equals, 401)
+	c.Assert(jsonErr.Code, Equals, httphelper.UnauthorizedError)
 
 	req, err := http.NewRequest("GET", s.srv.URL+"/apps", nil)
 	c.Assert(err, IsNil)
@@ -88,6 +113,109 @@ func (s *S) TestBadAuth(c *C) {
 	c.Assert(err, IsNil)
 	res.Body.Close()
 	c.Assert(res.StatusCode, Equals, 401)
+
+	// the key can also be given as a bearer token
+	for key, status := range map[string]int{authKey: 200, authKey + "wrong": 401} {
+		req, err = http.NewRequest("GET", s.srv.URL+"/apps", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res, err = http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, status)
+	}
+}
+
+func (s *S) TestRequestTooLarge(c *C) {
+	defer func(n int64) { httphelper.MaxJSONBodySize = n }(httphelper.MaxJSONBodySize)
+	httphelper.MaxJSONBodySize = 64
+
+	err := s.c.CreateArtifact(&ct.Artifact{Type: "docker", URI: "https://example.com/" + strings.Repeat("a", 100)})
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.RequestTooLargeError)
+
+	// bodies without a content length are limited as they are read
+	body := strings.NewReader(`{"type":"docker","uri":"https://example.com/` + strings.Repeat("a", 100) + `"}`)
+	req, err := http.NewRequest("POST", s.srv.URL+"/artifacts", ioutil.NopCloser(body))
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 413)
+
+	// as are bodies buffered for idempotent retries
+	body = strings.NewReader(`{"type":"docker","uri":"https://example.com/` + strings.Repeat("a", 100) + `"}`)
+	req, err = http.NewRequest("POST", s.srv.URL+"/artifacts", ioutil.NopCloser(body))
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Idempotency-Key", random.UUID())
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 413)
+}
+
+func (s *S) TestHTTPTimeouts(c *C) {
+	timeouts := newHTTPTimeouts()
+	timeouts.ReadHeaderTimeout = 100 * time.Millisecond
+	timeouts.BodyTimeout = 100 * time.Millisecond
+	srv := httptest.NewUnstartedServer(timeouts.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var v interface{}
+		if err := httphelper.DecodeJSON(req, &v); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		w.WriteHeader(200)
+	})))
+	srv.Listener = timeouts.Listener(srv.Listener)
+	srv.Config.ConnState = timeouts.ConnState
+	srv.Start()
+	defer srv.Close()
+
+	send := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		c.Assert(err, IsNil)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, data)
+		c.Assert(err, IsNil)
+		return conn
+	}
+
+	// connections which don't send their request headers in time are closed
+	conn := send("POST / HTTP/1.1\r\nHost: example.com\r\n")
+	defer conn.Close()
+	_, err := conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// requests which don't send their body in time time out
+	conn = send("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 10\r\n\r\n{\"a\"")
+	defer conn.Close()
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 408)
+}
+
+func (s *S) TestCORSPolicy(c *C) {
+	opts := httphelper.CORSOptions()
+	opts.AllowAllOrigins = false
+	opts.AllowOrigins = []string{"https://dashboard.example.com"}
+	srv := httptest.NewServer(muxHandler(nil, authKey, nil, newRateLimiter(0, 0), cors.Allow(opts)))
+	defer srv.Close()
+
+	preflight := func(origin string) string {
+		req, err := http.NewRequest("OPTIONS", srv.URL+"/apps", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		return res.Header.Get("Access-Control-Allow-Origin")
+	}
+	c.Assert(preflight("https://dashboard.example.com"), Equals, "https://dashboard.example.com")
+	c.Assert(preflight("https://evil.example.com"), Equals, "")
 }
 
 func (s *S) createTestApp(c *C, in *ct.App) *ct.App {
@@ -144,6 +272,143 @@ func (s *S) TestUpdateApp(c *C) {
 	c.Assert(gotApp.Meta, DeepEquals, meta)
 }
 
+func (s *S) TestAppMeta(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-meta", Meta: map[string]string{"owner": "ops"}})
+
+	meta, err := s.c.GetAppMeta(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(meta, DeepEquals, map[string]string{"owner": "ops"})
+
+	repo := "https://github.com/flynn/flynn"
+	meta, err = s.c.UpdateAppMeta(app.ID, map[string]*string{"repo": &repo, "owner": nil})
+	c.Assert(err, IsNil)
+	c.Assert(meta, DeepEquals, map[string]string{"repo": repo})
+
+	gotApp, err := s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Meta, DeepEquals, meta)
+
+	meta, err = s.c.UpdateAppMeta(app.ID, map[string]*string{"repo": nil})
+	c.Assert(err, IsNil)
+	c.Assert(meta, DeepEquals, map[string]string{})
+}
+
+func (s *S) TestAppQuota(c *C) {
+	quota := &ct.AppQuota{MaxProcesses: 3, MaxProcessType: 2, MaxJobs: 1}
+	app := s.createTestApp(c, &ct.App{Name: "app-quota", Quota: quota})
+	gotApp, err := s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Quota, DeepEquals, quota)
+
+	release := s.createTestRelease(c, &ct.Release{})
+	for _, procs := range []map[string]int{
+		{"web": 3},
+		{"web": 2, "worker": 2},
+	} {
+		err := s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: procs})
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+	}
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2, "worker": 1}})
+
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	// jobs which are being started count towards the quota
+	_, err = s.c.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	c.Assert(err, IsNil)
+	_, err = s.c.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+
+	// an empty quota removes the limits
+	gotApp = &ct.App{ID: app.ID, Quota: &ct.AppQuota{}}
+	c.Assert(s.c.UpdateApp(gotApp), IsNil)
+	c.Assert(gotApp.Quota, IsNil)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 5}})
+}
+
+func (s *S) TestAppSchedulingStrategy(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-scheduling-strategy", SchedulingStrategy: ct.SchedulingStrategyBinPack})
+	gotApp, err := s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.SchedulingStrategy, Equals, ct.SchedulingStrategyBinPack)
+
+	_, err = s.c.RawReq("POST", "/apps/"+app.ID, nil, map[string]interface{}{"scheduling_strategy": "random"}, nil)
+	c.Assert(err, NotNil)
+
+	// null resets the strategy to the cluster setting
+	_, err = s.c.RawReq("POST", "/apps/"+app.ID, nil, map[string]interface{}{"scheduling_strategy": nil}, nil)
+	c.Assert(err, IsNil)
+	gotApp, err = s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.SchedulingStrategy, Equals, "")
+
+	c.Assert(s.c.CreateApp(&ct.App{Name: "app-scheduling-strategy-invalid", SchedulingStrategy: "random"}), NotNil)
+}
+
+func (s *S) TestDefaultRouteNamespaces(c *C) {
+	_, err := s.c.SetSetting(ct.SettingDefaultRouteDomain, "namespaces.example.com")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingDefaultRouteDomain)
+
+	// apps with the same name in different namespaces don't share a
+	// service
+	var services []string
+	for _, name := range []string{"default-route-team1", "default-route-team2"} {
+		ns := &ct.Namespace{Name: name}
+		c.Assert(s.c.CreateNamespace(ns), IsNil)
+		app := s.createTestApp(c, &ct.App{Name: "default-route-app", NamespaceID: ns.ID})
+		routes, err := s.c.RouteList(app.ID)
+		c.Assert(err, IsNil)
+		c.Assert(routes, HasLen, 1)
+		c.Assert(routes[0].Domain, Equals, "default-route-app."+name+".namespaces.example.com")
+		c.Assert(routes[0].Service, Equals, ct.AppWebService(app.ID))
+		services = append(services, routes[0].Service)
+	}
+	c.Assert(services[0], Not(Equals), services[1])
+}
+
+func (s *S) TestRenameApp(c *C) {
+	_, err := s.c.SetSetting(ct.SettingDefaultRouteDomain, "rename.example.com")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingDefaultRouteDomain)
+	app := s.createTestApp(c, &ct.App{Name: "rename-app"})
+	s.createTestApp(c, &ct.App{Name: "rename-app-taken"})
+
+	renamed, err := s.c.RenameApp(app.ID, "rename-app-new")
+	c.Assert(err, IsNil)
+	c.Assert(renamed.ID, Equals, app.ID)
+	c.Assert(renamed.Name, Equals, "rename-app-new")
+	gotApp, err := s.c.GetApp("rename-app-new")
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.ID, Equals, app.ID)
+	_, err = s.c.GetApp("rename-app")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// the default route moves to the new name but keeps its service
+	routes, err := s.c.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Domain, Equals, "rename-app-new.rename.example.com")
+	c.Assert(routes[0].Service, Equals, ct.AppWebService(app.ID))
+
+	// an app which takes the old name doesn't share the service
+	reused := s.createTestApp(c, &ct.App{Name: "rename-app"})
+	routes, err = s.c.RouteList(reused.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Domain, Equals, "rename-app.rename.example.com")
+	c.Assert(routes[0].Service, Not(Equals), ct.AppWebService(app.ID))
+
+	_, err = s.c.RenameApp(app.ID, "rename-app-taken")
+	c.Assert(err, NotNil)
+	_, err = s.c.RenameApp(app.ID, "Invalid Name")
+	c.Assert(err, NotNil)
+	protected := s.createTestApp(c, &ct.App{Name: "rename-app-protected", Protected: true})
+	_, err = s.c.RenameApp(protected.ID, "rename-app-unprotected")
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestDeleteApp(c *C) {
 	for i, useName := range []bool{false, true} {
 		app := s.createTestApp(c, &ct.App{Name: fmt.Sprintf("delete-app-%d", i)})
@@ -196,6 +461,76 @@ func (s *S) TestProtectedApp(c *C) {
 	}
 }
 
+func (s *S) TestAppPolicy(c *C) {
+	app := s.createTestApp(c, &ct.App{
+		Name:   "app-policy",
+		Policy: &ct.AppPolicy{MinProcesses: map[string]int{"web": 2}},
+	})
+	release := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {}, "worker": {}},
+	})
+	gotApp, err := s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Policy, DeepEquals, app.Policy)
+
+	// formations must keep the minimum processes
+	f := &ct.Formation{AppID: app.ID, ReleaseID: release.ID}
+	f.Processes = map[string]int{"web": 1}
+	c.Assert(s.c.PutFormation(f), NotNil)
+	f.Processes = map[string]int{"web": 2}
+	c.Assert(s.c.PutFormation(f), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	c.Assert(s.c.DeleteFormation(app.ID, release.ID), NotNil)
+
+	// the processes of all formations are counted, so deployments can
+	// scale the old formation down once the new one is up
+	next := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {}, "worker": {}},
+	})
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: next.ID, Processes: map[string]int{"web": 1}}), IsNil)
+	f.Processes = map[string]int{"web": 1}
+	c.Assert(s.c.PutFormation(f), IsNil)
+	f.Processes = map[string]int{"web": 0}
+	c.Assert(s.c.PutFormation(f), NotNil)
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: next.ID, Processes: map[string]int{"web": 2}}), IsNil)
+	c.Assert(s.c.PutFormation(f), IsNil)
+	c.Assert(s.c.DeleteFormation(app.ID, release.ID), IsNil)
+
+	// protected apps must keep a process of each type in the formation of
+	// the current release, regardless of other formations
+	protected := s.createTestApp(c, &ct.App{Name: "app-policy-protected", Protected: true})
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1, "worker": 1}}), IsNil)
+	c.Assert(s.c.SetAppRelease(protected.ID, release.ID), IsNil)
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: protected.ID, ReleaseID: next.ID, Processes: map[string]int{"web": 1, "worker": 1}}), IsNil)
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}), NotNil)
+	zero := 0
+	_, err = s.c.ScaleProcessType(protected.ID, "worker", &ct.ProcessScale{Count: &zero})
+	c.Assert(err, NotNil)
+
+	// the release can be locked
+	gotApp.Policy = &ct.AppPolicy{MinProcesses: map[string]int{"web": 2}, LockRelease: true}
+	c.Assert(s.c.UpdateApp(gotApp), IsNil)
+	other := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.SetAppRelease(app.ID, other.ID), NotNil)
+	_, err = s.c.CreateDeployment(app.ID, other.ID)
+	c.Assert(err, NotNil)
+
+	// and so can routes
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "app-policy"}).ToRoute())
+	gotApp.Policy = &ct.AppPolicy{LockRoutes: true}
+	c.Assert(s.c.UpdateApp(gotApp), IsNil)
+	c.Assert(s.c.DeleteRoute(app.ID, route.ID), NotNil)
+	_, err = s.c.RenameApp(app.ID, "app-policy-renamed")
+	c.Assert(err, NotNil)
+
+	// clearing the policy lifts the restrictions
+	gotApp.Policy = &ct.AppPolicy{}
+	c.Assert(s.c.UpdateApp(gotApp), IsNil)
+	c.Assert(gotApp.Policy, IsNil)
+	c.Assert(s.c.DeleteRoute(app.ID, route.ID), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, other.ID), IsNil)
+}
+
 func (s *S) createTestArtifact(c *C, in *ct.Artifact) *ct.Artifact {
 	if in.Type == "" {
 		in.Type = "docker"
@@ -232,6 +567,28 @@ func (s *S) TestCreateArtifact(c *C) {
 	}
 }
 
+func (s *S) TestCreateArtifactDigest(c *C) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	first := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://flynn/digest?id=1", Digest: digest})
+	c.Assert(first.Digest, Equals, digest)
+
+	// the same image at a different URI is deduplicated by digest
+	second := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://mirror/flynn/digest?id=1", Digest: digest})
+	c.Assert(second.ID, Equals, first.ID)
+	c.Assert(second.URI, Equals, first.URI)
+
+	gotArtifact, err := s.c.GetArtifact(first.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotArtifact.Digest, Equals, digest)
+
+	err = s.c.CreateArtifact(&ct.Artifact{Type: "docker", URI: "docker://flynn/digest?id=2", Digest: "md5:1234"})
+	c.Assert(err, NotNil)
+
+	// a different image at the same URI is rejected
+	err = s.c.CreateArtifact(&ct.Artifact{Type: "docker", URI: first.URI, Digest: "sha256:" + strings.Repeat("cd", 32)})
+	c.Assert(err, NotNil)
+}
+
 func (s *S) createTestRelease(c *C, in *ct.Release) *ct.Release {
 	if in.ArtifactID == "" {
 		in.ArtifactID = s.createTestArtifact(c, &ct.Artifact{}).ID
@@ -262,6 +619,143 @@ func (s *S) TestCreateRelease(c *C) {
 	}
 }
 
+func (s *S) TestCreateReleaseDescription(c *C) {
+	out := s.createTestRelease(c, &ct.Release{Description: "fix the frobnicator", CreatedBy: "ci"})
+	gotRelease, err := s.c.GetRelease(out.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.Description, Equals, "fix the frobnicator")
+	c.Assert(gotRelease.CreatedBy, Equals, "ci")
+
+	releases, err := s.c.ReleaseList()
+	c.Assert(err, IsNil)
+	c.Assert(releases[0].ID, Equals, out.ID)
+	c.Assert(releases[0].Description, Equals, "fix the frobnicator")
+
+	err = s.c.CreateRelease(&ct.Release{ArtifactID: out.ArtifactID, CreatedBy: strings.Repeat("a", 101)})
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+}
+
+func (s *S) TestCreateReleaseValidation(c *C) {
+	for _, t := range []struct {
+		field     string
+		processes map[string]ct.ProcessType
+		env       map[string]string
+	}{
+		{field: "processes.web server", processes: map[string]ct.ProcessType{"web server": {}}},
+		{field: "processes.web.env", processes: map[string]ct.ProcessType{"web": {Env: map[string]string{"A=B": "c"}}}},
+		{field: "env", env: map[string]string{"FLYNN_APP_ID": "foo"}},
+		{field: "processes.web.service", processes: map[string]ct.ProcessType{"web": {Service: "web"}}},
+		{field: "processes.web.service", processes: map[string]ct.ProcessType{"web": {Service: "Web Service", Ports: []ct.Port{{Proto: "tcp"}}}}},
+		{field: "processes.web.ports.0.proto", processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Proto: "http"}}}}},
+		{field: "processes.web.ports.0.port", processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 70000, Proto: "tcp"}}}}},
+		{field: "processes.web.ports.0.name", processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Name: "Metrics Port", Proto: "tcp"}}}}},
+		{field: "processes.web.ports.1.name", processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Name: "http", Proto: "tcp"}, {Name: "http", Proto: "tcp"}}}}},
+		{field: "processes.web.ports.0.service.name", processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Proto: "tcp", Service: &host.Service{}}}}}},
+		{field: "processes.web.ports.0.service.check.type", processes: map[string]ct.ProcessType{"web": {Ports: []ct.Port{{
+			Proto:   "tcp",
+			Service: &host.Service{Name: "web", Check: &host.HealthCheck{Type: "udp"}},
+		}}}}},
+		{field: "processes.web.start_timeout", processes: map[string]ct.ProcessType{"web": {StartTimeout: -time.Second}}},
+		{field: "processes.web.kill_timeout", processes: map[string]ct.ProcessType{"web": {KillTimeout: -time.Second}}},
+		{field: "processes.web.memory", processes: map[string]ct.ProcessType{"web": {Memory: -1}}},
+		{field: "processes.web.cpu_shares", processes: map[string]ct.ProcessType{"web": {CPUShares: 1}}},
+		{field: "processes.web.egress_bandwidth", processes: map[string]ct.ProcessType{"web": {EgressBandwidth: -1}}},
+		{field: "processes.web.ingress_bandwidth", processes: map[string]ct.ProcessType{"web": {IngressBandwidth: 1 << 20, HostNetwork: true}}},
+		{field: "processes.web.liveness.type", processes: map[string]ct.ProcessType{"web": {Liveness: &host.LivenessCheck{Type: "udp"}}}},
+		{field: "processes.web.liveness.port", processes: map[string]ct.ProcessType{"web": {Liveness: &host.LivenessCheck{Type: "tcp"}}}},
+		{field: "processes.web.liveness.cmd", processes: map[string]ct.ProcessType{"web": {Liveness: &host.LivenessCheck{Type: "exec"}}}},
+		{field: "processes.db.volumes.0.path", processes: map[string]ct.ProcessType{"db": {Volumes: []ct.VolumeReq{{Path: "data"}}}}},
+		{field: "processes.db.volumes.1.path", processes: map[string]ct.ProcessType{"db": {Volumes: []ct.VolumeReq{{Path: "/data"}, {Path: "/data"}}}}},
+		{field: "processes.web.readiness", processes: map[string]ct.ProcessType{"web": {Readiness: &ct.ReadinessCheck{Type: "tcp"}}}},
+		{field: "processes.web.readiness.type", processes: map[string]ct.ProcessType{"web": {
+			Service:   "web",
+			Ports:     []ct.Port{{Proto: "tcp"}},
+			Readiness: &ct.ReadinessCheck{Type: "udp"},
+		}}},
+		{field: "processes.web.readiness.path", processes: map[string]ct.ProcessType{"web": {
+			Service:   "web",
+			Ports:     []ct.Port{{Proto: "tcp"}},
+			Readiness: &ct.ReadinessCheck{Type: "http", Path: "status"},
+		}}},
+	} {
+		err := s.c.CreateRelease(&ct.Release{Processes: t.processes, Env: t.env})
+		jsonErr, ok := err.(httphelper.JSONError)
+		c.Assert(ok, Equals, true, Commentf("field = %s, err = %v", t.field, err))
+		c.Assert(jsonErr.Code, Equals, httphelper.ValidationError)
+		c.Assert(jsonErr.Field, Equals, t.field)
+	}
+
+	s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {
+		Service:   "release-validation-web",
+		Readiness: &ct.ReadinessCheck{Type: "http", Path: "/status", Timeout: time.Minute},
+		Ports: []ct.Port{{
+			Name:    "http",
+			Port:    8080,
+			Proto:   "tcp",
+			Service: &host.Service{Name: "release-validation-web", Create: true, Check: &host.HealthCheck{Type: "http"}},
+		}, {
+			Name:  "metrics",
+			Port:  9090,
+			Proto: "tcp",
+		}},
+	}}})
+}
+
+func (s *S) TestReleaseSecrets(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-secrets"})
+	release := s.createTestRelease(c, &ct.Release{
+		AppID:   app.ID,
+		Env:     map[string]string{"DB_PASSWORD": "hunter2", "FOO": "bar"},
+		Secrets: []string{"DB_PASSWORD", "UNSET"},
+	})
+	c.Assert(release.Secrets, DeepEquals, []string{"DB_PASSWORD"})
+	c.Assert(release.Env["FOO"], Equals, "bar")
+	sealed := release.Env["DB_PASSWORD"]
+	c.Assert(secrets.IsSealed(sealed), Equals, true)
+
+	// the value is never returned in the clear
+	gotRelease, err := s.c.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.Env["DB_PASSWORD"], Equals, sealed)
+	value, err := secretsKey.Open(secrets.AppContext(app.ID), sealed)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "hunter2")
+
+	// sealed values copied to a new release stay secret
+	next := s.createTestRelease(c, &ct.Release{ArtifactID: release.ArtifactID, AppID: app.ID, Env: gotRelease.Env})
+	c.Assert(next.Secrets, DeepEquals, []string{"DB_PASSWORD"})
+	c.Assert(next.Env["DB_PASSWORD"], Equals, sealed)
+
+	// releases with secrets must have an app
+	err = s.c.CreateRelease(&ct.Release{Env: map[string]string{"DB_PASSWORD": "hunter2"}, Secrets: []string{"DB_PASSWORD"}})
+	c.Assert(err, NotNil)
+
+	// sealed values must have been sealed with the cluster key
+	other := &secrets.Key{4, 5, 6}
+	err = s.c.CreateRelease(&ct.Release{AppID: app.ID, Env: map[string]string{"DB_PASSWORD": other.Seal(secrets.AppContext(app.ID), "hunter2")}})
+	c.Assert(err, NotNil)
+
+	// and for the app of the release
+	otherApp := s.createTestApp(c, &ct.App{Name: "release-secrets-other"})
+	err = s.c.CreateRelease(&ct.Release{AppID: otherApp.ID, Env: gotRelease.Env})
+	c.Assert(err, NotNil)
+
+	// the release can't be used by other apps
+	_, err = s.c.RunJobDetached(otherApp.ID, &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	c.Assert(err, NotNil)
+	c.Assert(s.c.SetAppRelease(otherApp.ID, release.ID), NotNil)
+
+	// jobs are started with the decrypted value
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	_, err = s.c.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	c.Assert(err, IsNil)
+	job := s.cc.GetHost(hostID).Jobs[0]
+	c.Assert(job.Config.Env["DB_PASSWORD"], Equals, "hunter2")
+}
+
 func (s *S) TestCreateFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, &ct.Release{})
@@ -296,6 +790,33 @@ func (s *S) createTestFormation(c *C, formation *ct.Formation) *ct.Formation {
 	return formation
 }
 
+func (s *S) TestFormationHistory(c *C) {
+	release := s.createTestRelease(c, &ct.Release{})
+	app := s.createTestApp(c, &ct.App{Name: "formation-history"})
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "formation-history", Scope: ct.AuthTokenScopeFull})
+	client, err := controller.NewClient(s.srv.URL, token.Token)
+	c.Assert(err, IsNil)
+
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	// formations which don't change any counts are not recorded
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1, "worker": 0}})
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 3}}), IsNil)
+	c.Assert(s.c.DeleteFormation(app.ID, release.ID), IsNil)
+
+	changes, err := s.c.FormationHistory(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(changes, HasLen, 3)
+	c.Assert(changes[0].OldProcesses, DeepEquals, map[string]int{"web": 3})
+	c.Assert(changes[0].NewProcesses, DeepEquals, map[string]int{})
+	c.Assert(changes[1].OldProcesses, DeepEquals, map[string]int{"web": 1})
+	c.Assert(changes[1].NewProcesses, DeepEquals, map[string]int{"web": 3})
+	c.Assert(changes[1].Actor, Equals, "formation-history")
+	c.Assert(changes[2].OldProcesses, DeepEquals, map[string]int{})
+	c.Assert(changes[2].NewProcesses, DeepEquals, map[string]int{"web": 1})
+	c.Assert(changes[2].Actor, Equals, "")
+	c.Assert(changes[2].CreatedAt, NotNil)
+}
+
 func (s *S) TestDeleteFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, &ct.Release{})
@@ -367,6 +888,53 @@ func (s *S) TestRecreateKey(c *C) {
 	c.Assert(newKey.Comment, Equals, "lewis@lmars.net")
 }
 
+func (s *S) TestCreateKeys(c *C) {
+	alice := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDGkVtR0/z7xSRkvc4D56F982LByxMHHXeTaW+ctszux60bHX9LeAvtbes5yF+F72FjlO0PBIfVyi4lgm1oXDKSF4OSCK2qe7KCgsfuavjP5vI/pO8kkb0U1XEYJf5t5kSKhFlnxqCOvo52uc60FQ2EURkff5tGTq4y1dAH6oe+EQ== alice@example.com"
+	bob := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC9cly5rE0M+tW/ketlKHwTY4I+xdnw6LGogdUEqU8cLOvvuLJsaW81lGRGx6zTNVfAqOiB2K4AvTBIbNQRtmzy0D1viVXitbkd6nUqvHy3PO9AEueUvlI2/pJmrIzFs/9wSI6seLWpUnQpupHY8DBasJYUgaFLMVhbb2eF7JcBTQ== bob@example.com"
+	labels := map[string]string{"source": "github"}
+
+	keys, err := s.c.CreateKeys([]*ct.Key{
+		{Key: alice, Labels: labels},
+		{Key: bob, Comment: "bob", Labels: labels},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 2)
+	c.Assert(keys[0].ID, Equals, "faf7d1c63687016fba7f18a54355e571")
+	c.Assert(keys[0].Comment, Equals, "alice@example.com")
+	c.Assert(keys[1].Comment, Equals, "bob")
+	c.Assert(keys[1].Labels, DeepEquals, labels)
+
+	// keys can be looked up by fingerprint in the format printed by ssh-keygen
+	key, err := s.c.GetKeyByFingerprint("MD5:80:f0:0f:49:fd:30:74:c2:05:24:8b:64:a7:a9:aa:61")
+	c.Assert(err, IsNil)
+	c.Assert(key.ID, Equals, keys[1].ID)
+	key, err = s.c.GetKeyByFingerprint(keys[0].ID)
+	c.Assert(err, IsNil)
+	c.Assert(key.ID, Equals, keys[0].ID)
+	_, err = s.c.GetKeyByFingerprint(keys[0].ID + "fail")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	list, err := s.c.KeyListWithLabels(labels)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+
+	// importing the same keys again doesn't create duplicates
+	keys, err = s.c.CreateKeys([]*ct.Key{{Key: alice}, {Key: bob}})
+	c.Assert(err, IsNil)
+	c.Assert(keys[0].Labels, DeepEquals, labels)
+	list, err = s.c.KeyListWithLabels(labels)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+
+	// invalid keys are rejected
+	_, err = s.c.CreateKeys([]*ct.Key{{Key: "ssh-rsa invalid"}})
+	c.Assert(err, NotNil)
+
+	for _, key := range keys {
+		c.Assert(s.c.DeleteKey(key.ID), IsNil)
+	}
+}
+
 func (s *S) TestAppList(c *C) {
 	s.createTestApp(c, &ct.App{Name: "list-test"})
 
@@ -377,6 +945,65 @@ func (s *S) TestAppList(c *C) {
 	c.Assert(list[0].ID, Not(Equals), "")
 }
 
+func (s *S) TestAppListWithLabels(c *C) {
+	a1 := s.createTestApp(c, &ct.App{Name: "label-test-1", Meta: map[string]string{"team": "label-test", "tier": "web"}})
+	a2 := s.createTestApp(c, &ct.App{Name: "label-test-2", Meta: map[string]string{"team": "label-test", "tier": "worker"}})
+	s.createTestApp(c, &ct.App{Name: "label-test-3"})
+
+	list, err := s.c.AppListWithLabels(map[string]string{"team": "label-test"})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, a2.ID)
+	c.Assert(list[1].ID, Equals, a1.ID)
+
+	list, err = s.c.AppListWithLabels(map[string]string{"team": "label-test", "tier": "web"})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, a1.ID)
+
+	list, err = s.c.AppListWithLabels(map[string]string{"team": "nonexistent"})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+
+	_, err = s.c.RawReq("GET", "/apps?label=invalid", nil, nil, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestAppListPagination(c *C) {
+	for i := 0; i < 3; i++ {
+		s.createTestApp(c, &ct.App{Name: fmt.Sprintf("list-page-test-%d", i)})
+	}
+
+	all, err := s.c.AppList()
+	c.Assert(err, IsNil)
+
+	// following the next links returns every app exactly once, in order
+	var paged []*ct.App
+	path := "/apps?limit=2"
+	for path != "" {
+		var page []*ct.App
+		res, err := s.c.RawReq("GET", path, nil, nil, &page)
+		c.Assert(err, IsNil)
+		c.Assert(len(page) <= 2, Equals, true)
+		paged = append(paged, page...)
+
+		path = ""
+		if link := res.Header.Get("Link"); link != "" {
+			c.Assert(strings.HasSuffix(link, `>; rel="next"`), Equals, true)
+			path = link[1:strings.Index(link, ">")]
+		}
+	}
+	c.Assert(paged, HasLen, len(all))
+	for i, app := range all {
+		c.Assert(paged[i].ID, Equals, app.ID)
+	}
+
+	_, err = s.c.RawReq("GET", "/apps?limit=0", nil, nil, nil)
+	c.Assert(err, NotNil)
+	_, err = s.c.RawReq("GET", "/apps?cursor=invalid", nil, nil, nil)
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestReleaseList(c *C) {
 	s.createTestRelease(c, &ct.Release{})
 
@@ -387,6 +1014,77 @@ func (s *S) TestReleaseList(c *C) {
 	c.Assert(list[0].ID, Not(Equals), "")
 }
 
+func (s *S) TestAppReleaseList(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-release-list"})
+	first := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: first.ID})
+	second := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.SetAppRelease(app.ID, second.ID), IsNil)
+	s.createTestRelease(c, &ct.Release{})
+
+	// only the releases used by the app are listed, newest first
+	list, err := s.c.AppReleaseList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, second.ID)
+	c.Assert(list[1].ID, Equals, first.ID)
+
+	var page []*ct.Release
+	res, err := s.c.RawReq("GET", fmt.Sprintf("/apps/%s/releases?limit=1", app.ID), nil, nil, &page)
+	c.Assert(err, IsNil)
+	c.Assert(page, HasLen, 1)
+	c.Assert(page[0].ID, Equals, second.ID)
+	link := res.Header.Get("Link")
+	c.Assert(link, Not(Equals), "")
+
+	page = nil
+	res, err = s.c.RawReq("GET", link[1:strings.Index(link, ">")], nil, nil, &page)
+	c.Assert(err, IsNil)
+	c.Assert(page, HasLen, 1)
+	c.Assert(page[0].ID, Equals, first.ID)
+	c.Assert(res.Header.Get("Link"), Equals, "")
+}
+
+func (s *S) TestDeleteRelease(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "delete-release"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	current := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	c.Assert(s.c.SetAppRelease(app.ID, current.ID), IsNil)
+	formation := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: formation.ID})
+	unused := s.createTestRelease(c, &ct.Release{})
+
+	// releases which are in use can't be deleted
+	err := s.c.DeleteRelease(current.ID)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+	err = s.c.DeleteRelease(formation.ID)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+
+	// nor can the old release of a running deployment
+	old := s.createTestRelease(c, &ct.Release{})
+	deployApp := s.createTestApp(c, &ct.App{Name: "delete-release-deploy"})
+	var deploymentID string
+	c.Assert(s.hc.db.QueryRow("INSERT INTO deployments (app_id, old_release_id, new_release_id, strategy) VALUES ($1, $2, $3, 'all-at-once') RETURNING deployment_id",
+		deployApp.ID, old.ID, current.ID).Scan(&deploymentID), IsNil)
+	err = s.c.DeleteRelease(old.ID)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+	c.Assert(s.hc.db.Exec("UPDATE deployments SET finished_at = now() WHERE deployment_id = $1", deploymentID), IsNil)
+	c.Assert(s.c.DeleteRelease(old.ID), IsNil)
+
+	c.Assert(s.c.DeleteRelease(unused.ID), IsNil)
+	_, err = s.c.GetRelease(unused.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = s.c.GetArtifact(unused.ArtifactID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(s.c.DeleteRelease(unused.ID), Equals, controller.ErrNotFound)
+
+	// artifacts are kept while another release uses them
+	c.Assert(s.c.DeleteFormation(app.ID, formation.ID), IsNil)
+	c.Assert(s.c.DeleteRelease(formation.ID), IsNil)
+	_, err = s.c.GetArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+}
+
 func (s *S) TestKeyList(c *C) {
 	s.createTestKey(c, "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCqE9AJti/17eigkIhA7+6TF9rdTVxjPv80UxIT6ELaNPHegqib5m94Wab4UoZAGtBPLKJs9o8LRO3H29X5q5eXCU5mwx4qQhcMEYkILWj0Y1T39Xi2RI3jiWcTsphAAYmy+uT2Nt740OK1FaQxfdzYx4cjsjtb8L82e35BkJE2TdjXWkeHxZWDZxMlZXme56jTNsqB2OuC0gfbAbrjSCkolvK1RJbBZSSBgKQrYXiyYjjLfcw2O0ZAKPBeS8ckVf6PO8s/+azZzJZ0Kl7YGHYEX3xRi6sJS0gsI4Y6+sddT1zT5kh0Bg3C8cKnZ1NiVXLH0pPKz68PhjWhwpOVUehD")
 
@@ -415,6 +1113,89 @@ func (s *S) TestArtifactList(c *C) {
 	c.Assert(list[0].ID, Not(Equals), "")
 }
 
+// fakeBlobstore is an in-memory blobstore for testing artifact uploads.
+type fakeBlobstore struct {
+	*httptest.Server
+	mtx   sync.Mutex
+	blobs map[string][]byte
+}
+
+func newFakeBlobstore() *fakeBlobstore {
+	b := &fakeBlobstore{blobs: make(map[string][]byte)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		switch req.Method {
+		case "PUT":
+			data, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				w.WriteHeader(500)
+				return
+			}
+			b.blobs[req.URL.Path] = data
+		case "DELETE":
+			delete(b.blobs, req.URL.Path)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	return b
+}
+
+func (b *fakeBlobstore) Get(uri string) ([]byte, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	data, ok := b.blobs[strings.TrimPrefix(uri, b.URL)]
+	return data, ok
+}
+
+func (s *S) TestUploadArtifact(c *C) {
+	data := []byte("upload-artifact-" + random.String(8))
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	artifact, err := s.c.UploadArtifact("file", bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(artifact.ID, Not(Equals), "")
+	c.Assert(artifact.Type, Equals, "file")
+	c.Assert(artifact.Digest, Equals, digest)
+	stored, ok := s.blobstore.Get(artifact.URI)
+	c.Assert(ok, Equals, true)
+	c.Assert(stored, DeepEquals, data)
+
+	gotArtifact, err := s.c.GetArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotArtifact.URI, Equals, artifact.URI)
+
+	// uploading the same data again returns the existing artifact without
+	// keeping a second copy
+	s.blobstore.mtx.Lock()
+	count := len(s.blobstore.blobs)
+	s.blobstore.mtx.Unlock()
+	again, err := s.c.UploadArtifact("file", bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Assert(again.ID, Equals, artifact.ID)
+	s.blobstore.mtx.Lock()
+	c.Assert(s.blobstore.blobs, HasLen, count)
+	s.blobstore.mtx.Unlock()
+
+	_, err = s.c.UploadArtifact("", bytes.NewReader(data))
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+	_, err = s.c.UploadArtifact("unknown", bytes.NewReader(data))
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+
+	// docker artifacts don't get the digest of the upload, as hosts check
+	// it against the digest of the image
+	image, err := s.c.UploadArtifact("docker", bytes.NewReader([]byte("upload-artifact-image-"+random.String(8))))
+	c.Assert(err, IsNil)
+	c.Assert(image.Digest, Equals, "")
+
+	defer func(size int64) { maxArtifactUploadSize = size }(maxArtifactUploadSize)
+	maxArtifactUploadSize = int64(len(data) - 1)
+	_, err = s.c.UploadArtifact("file", bytes.NewReader(data))
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.RequestTooLargeError)
+}
+
 func (s *S) TestFormationList(c *C) {
 	release := s.createTestRelease(c, &ct.Release{})
 	app := s.createTestApp(c, &ct.App{Name: "formation-list"})
@@ -490,3 +1271,49 @@ func (s *S) TestProviderList(c *C) {
 	c.Assert(len(list) > 0, Equals, true)
 	c.Assert(list[0].ID, Not(Equals), "")
 }
+
+func (s *S) TestErrorResponses(c *C) {
+	_, err := s.c.GetApp("nonexistent")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	err = s.c.CreateApp(&ct.App{Name: "Invalid Name"})
+	jsonErr, ok := err.(httphelper.JSONError)
+	c.Assert(ok, Equals, true)
+	c.Assert(jsonErr.Code, Equals, httphelper.ValidationError)
+	c.Assert(jsonErr.Field, Equals, "name")
+	c.Assert(httphelper.IsRetryable(err), Equals, false)
+}
+
+func (s *S) TestVersion(c *C) {
+	v, err := s.c.GetVersion()
+	c.Assert(err, IsNil)
+	c.Assert(v.Version, Not(Equals), "")
+	c.Assert(v.APIVersion, Equals, ct.APIVersion)
+	c.Assert(v.MinAPIVersion, Equals, ct.MinAPIVersion)
+
+	// the negotiated version is returned in the response header
+	for _, t := range []struct {
+		requested string
+		status    int
+		version   string
+	}{
+		{"", 200, strconv.Itoa(ct.APIVersion)},
+		{strconv.Itoa(ct.APIVersion), 200, strconv.Itoa(ct.APIVersion)},
+		{strconv.Itoa(ct.APIVersion + 1), 200, strconv.Itoa(ct.APIVersion)},
+		{strconv.Itoa(ct.MinAPIVersion - 1), 412, ""},
+		{"invalid", 412, ""},
+	} {
+		header := http.Header{}
+		if t.requested != "" {
+			header.Set(ct.APIVersionHeader, t.requested)
+		}
+		res, err := s.c.RawReq("GET", "/apps", header, nil, nil)
+		if t.status != 200 {
+			c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.PreconditionFailedError)
+			continue
+		}
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.Header.Get(ct.APIVersionHeader), Equals, t.version)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/ctxhelper"
 	"github.com/flynn/flynn/pkg/httphelper"
 )
@@ -14,18 +19,48 @@ import (
 type Repository interface {
 	Add(thing interface{}) error
 	Get(id string) (interface{}, error)
-	List() (interface{}, error)
+	List(opts *ListOptions) (interface{}, *ListCursor, error)
 }
 
 type Remover interface {
 	Remove(string) error
 }
 
+// BulkAdder is implemented by repositories which can add several things at
+// once. POST requests with a JSON array body are passed to AddAll as a slice
+// of pointers to the resource type.
+type BulkAdder interface {
+	AddAll(things interface{}) error
+}
+
+// indexValidationError prefixes the field of a validation error with the index
+// of the invalid item in a bulk request.
+func indexValidationError(i int, err error) error {
+	if e, ok := err.(ct.ValidationError); ok {
+		e.Field = fmt.Sprintf("%d.%s", i, e.Field)
+		return e
+	}
+	return err
+}
+
 func crud(r *httprouter.Router, resource string, example interface{}, repo Repository) {
 	resourceType := reflect.TypeOf(example)
 	prefix := "/" + resource
 
 	r.POST(prefix, httphelper.WrapHandler(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
+		if bulk, ok := repo.(BulkAdder); ok {
+			body, err := httphelper.ReadJSONBody(req)
+			if err != nil {
+				respondWithError(rw, err)
+				return
+			}
+			if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+				bulkCreate(rw, bulk, resourceType, body)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
 		thing := reflect.New(resourceType).Interface()
 		if err := httphelper.DecodeJSON(req, thing); err != nil {
 			respondWithError(rw, err)
@@ -46,7 +81,13 @@ func crud(r *httprouter.Router, resource string, example interface{}, repo Repos
 
 	lookup := func(ctx context.Context) (interface{}, error) {
 		params, _ := ctxhelper.ParamsFromContext(ctx)
-		return repo.Get(params.ByName(resource + "_id"))
+		id := params.ByName(resource + "_id")
+		if scoped, ok := repo.(appScopedRepo); ok {
+			if err := authorizedForAppScoped(ctx, scoped, id); err != nil {
+				return nil, err
+			}
+		}
+		return repo.Get(id)
 	}
 
 	singletonPath := prefix + "/:" + resource + "_id"
@@ -59,12 +100,20 @@ func crud(r *httprouter.Router, resource string, example interface{}, repo Repos
 		httphelper.JSON(rw, 200, thing)
 	}))
 
-	r.GET(prefix, httphelper.WrapHandler(func(ctx context.Context, rw http.ResponseWriter, _ *http.Request) {
-		list, err := repo.List()
+	r.GET(prefix, httphelper.WrapHandler(func(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
+		opts, err := parseListOptions(req)
 		if err != nil {
 			respondWithError(rw, err)
 			return
 		}
+		list, next, err := repo.List(opts)
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+		if next != nil {
+			rw.Header().Set("Link", nextPageLink(req, opts, next))
+		}
 		httphelper.JSON(rw, 200, list)
 	}))
 
@@ -84,3 +133,27 @@ func crud(r *httprouter.Router, resource string, example interface{}, repo Repos
 		}))
 	}
 }
+
+func bulkCreate(rw http.ResponseWriter, bulk BulkAdder, resourceType reflect.Type, body []byte) {
+	things := reflect.New(reflect.SliceOf(reflect.PtrTo(resourceType)))
+	if err := json.Unmarshal(body, things.Interface()); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+	list := things.Elem()
+	for i := 0; i < list.Len(); i++ {
+		if list.Index(i).IsNil() {
+			respondWithError(rw, ct.ValidationError{Field: fmt.Sprint(i), Message: "must not be null"})
+			return
+		}
+		if err := schema.Validate(list.Index(i).Interface()); err != nil {
+			respondWithError(rw, indexValidationError(i, err))
+			return
+		}
+	}
+	if err := bulk.AddAll(list.Interface()); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+	httphelper.JSON(rw, 200, list.Interface())
+}
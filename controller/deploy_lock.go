@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// defaultDeployLockTTL is how long a deploy lock is held if no expiry is
+// given.
+const defaultDeployLockTTL = time.Hour
+
+type DeployLockRepo struct {
+	db *postgres.DB
+}
+
+func NewDeployLockRepo(db *postgres.DB) *DeployLockRepo {
+	return &DeployLockRepo{db}
+}
+
+// Acquire locks deploys of the app, or extends the lock if it is already held
+// by the same owner and token. It returns an error if another owner holds the
+// lock.
+func (r *DeployLockRepo) Acquire(lock *ct.DeployLock) error {
+	if lock.Owner == "" {
+		return ct.ValidationError{Field: "owner", Message: "must not be empty"}
+	}
+	if lock.ExpiresAt == nil {
+		expiresAt := time.Now().Add(defaultDeployLockTTL)
+		lock.ExpiresAt = &expiresAt
+	} else if !lock.ExpiresAt.After(time.Now()) {
+		return ct.ValidationError{Field: "expires_at", Message: "must be in the future"}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	// lock the app row so that the lock can't be acquired while a
+	// deployment is being created, see DeploymentRepo.Add
+	var appID string
+	if err := tx.QueryRow("SELECT app_id FROM apps WHERE app_id = $1 AND deleted_at IS NULL FOR UPDATE", lock.AppID).Scan(&appID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	existing, err := selectDeployLock(tx, lock.AppID)
+	if err == nil && !deployLockHeldBy(existing, lock) {
+		tx.Rollback()
+		return deployLockedError(existing)
+	} else if err != nil && err != ErrNotFound {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM deploy_locks WHERE app_id = $1", lock.AppID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.QueryRow("INSERT INTO deploy_locks (app_id, owner, token_id, expires_at) VALUES ($1, $2, $3, $4) RETURNING created_at",
+		lock.AppID, lock.Owner, lock.TokenID, lock.ExpiresAt).Scan(&lock.CreatedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get returns the unexpired deploy lock of the app.
+func (r *DeployLockRepo) Get(appID string) (*ct.DeployLock, error) {
+	return selectDeployLock(r.db, appID)
+}
+
+// Release releases the deploy lock of the app. If holder is not nil, it
+// returns an error if the lock is held by another owner or token, otherwise
+// the lock is released regardless of its owner.
+func (r *DeployLockRepo) Release(appID string, holder *ct.DeployLock) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	lock, err := selectDeployLock(tx, appID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if holder != nil && !deployLockHeldBy(lock, holder) {
+		tx.Rollback()
+		return deployLockedError(lock)
+	}
+	if _, err := tx.Exec("DELETE FROM deploy_locks WHERE app_id = $1", appID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func selectDeployLock(db rowQueryer, appID string) (*ct.DeployLock, error) {
+	lock := &ct.DeployLock{}
+	err := db.QueryRow("SELECT app_id, owner, token_id, expires_at, created_at FROM deploy_locks WHERE app_id = $1 AND expires_at > now()", appID).Scan(
+		&lock.AppID, &lock.Owner, &lock.TokenID, &lock.ExpiresAt, &lock.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	lock.AppID = postgres.CleanUUID(lock.AppID)
+	return lock, nil
+}
+
+// deployLockHolder returns the holder of a deploy lock which is making the
+// request, identified by owner and the auth token of the request, or nil if
+// owner is empty.
+func deployLockHolder(ctx context.Context, owner string) *ct.DeployLock {
+	if owner == "" {
+		return nil
+	}
+	holder := &ct.DeployLock{Owner: owner}
+	if token := authTokenFromContext(ctx); token != nil {
+		holder.TokenID = token.ID
+	}
+	return holder
+}
+
+// deployLockHeldBy reports whether lock is held by holder, which may be nil.
+func deployLockHeldBy(lock, holder *ct.DeployLock) bool {
+	return holder != nil && lock.Owner == holder.Owner && lock.TokenID == holder.TokenID
+}
+
+// checkDeployLock returns an error if deploys of app are locked by anyone
+// other than holder, which may be nil.
+func (c *controllerAPI) checkDeployLock(app *ct.App, holder *ct.DeployLock) error {
+	lock, err := c.deployLockRepo.Get(app.ID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !deployLockHeldBy(lock, holder) {
+		return deployLockedError(lock)
+	}
+	return nil
+}
+
+func deployLockedError(lock *ct.DeployLock) error {
+	return httphelper.JSONError{
+		Code:    httphelper.ObjectExistsError,
+		Message: fmt.Sprintf("deploys of the app are locked by %q until %s", lock.Owner, lock.ExpiresAt.Format(time.RFC3339)),
+	}
+}
+
+func (c *controllerAPI) PutDeployLock(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var lock ct.DeployLock
+	if err := httphelper.DecodeJSON(req, &lock); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	lock.AppID = c.getApp(ctx).ID
+	lock.TokenID = ""
+	if holder := deployLockHolder(ctx, lock.Owner); holder != nil {
+		lock.TokenID = holder.TokenID
+	}
+	if err := c.deployLockRepo.Acquire(&lock); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &lock)
+}
+
+func (c *controllerAPI) GetDeployLock(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	lock, err := c.deployLockRepo.Get(c.getApp(ctx).ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, lock)
+}
+
+// DeleteDeployLock releases the deploy lock of the app. If the owner query
+// parameter is set, the lock is only released if it is held by that owner and
+// the token of the request. Otherwise the lock is force released, which
+// requires a full scope token.
+func (c *controllerAPI) DeleteDeployLock(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	holder := deployLockHolder(ctx, req.URL.Query().Get("owner"))
+	if holder == nil && !fullScope(ctx) {
+		respondWithError(w, errForbidden)
+		return
+	}
+	if err := c.deployLockRepo.Release(c.getApp(ctx).ID, holder); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+func (s *S) TestDeployLock(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "deploy-lock"})
+
+	_, err := s.c.GetDeployLock(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	lock := &ct.DeployLock{Owner: "ci-1"}
+	c.Assert(s.c.AcquireDeployLock(app.ID, lock), IsNil)
+	c.Assert(lock.AppID, Equals, app.ID)
+	c.Assert(lock.ExpiresAt, NotNil)
+	got, err := s.c.GetDeployLock(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Owner, Equals, "ci-1")
+
+	// another owner can't acquire or release the lock
+	err = s.c.AcquireDeployLock(app.ID, &ct.DeployLock{Owner: "ci-2"})
+	c.Assert(err, NotNil)
+	c.Assert(err.(hh.JSONError).Code, Equals, hh.ObjectExistsError)
+	err = s.c.ReleaseDeployLock(app.ID, "ci-2")
+	c.Assert(err, NotNil)
+	c.Assert(err.(hh.JSONError).Code, Equals, hh.ObjectExistsError)
+
+	// only the owner can deploy
+	release := s.createTestRelease(c, &ct.Release{})
+	_, err = s.c.CreateDeployment(app.ID, release.ID)
+	c.Assert(err, NotNil)
+	c.Assert(err.(hh.JSONError).Code, Equals, hh.ObjectExistsError)
+	d, err := s.c.CreateDeploymentWithLock(app.ID, release.ID, "ci-1")
+	c.Assert(err, IsNil)
+	c.Assert(d.NewReleaseID, Equals, release.ID)
+
+	// resources can't be bound while the app is locked
+	resource, _ := s.provisionTestResource(c, "deploy-lock", []string{})
+	_, err = s.c.AddResourceApp(app.ID, resource.ID)
+	c.Assert(err, NotNil)
+	c.Assert(err.(hh.JSONError).Code, Equals, hh.ObjectExistsError)
+
+	// the lock is tied to the token it was acquired with, and only full
+	// scope tokens can force release it
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "deploy-lock", Scope: ct.AuthTokenScopeApp, AppID: app.ID})
+	c.Assert(s.authTokenStatus(c, token, "DELETE", "/apps/"+app.ID+"/deploy_lock?owner=ci-1"), Equals, 409)
+	c.Assert(s.authTokenStatus(c, token, "DELETE", "/apps/"+app.ID+"/deploy_lock"), Equals, 403)
+
+	// the owner can extend the lock
+	expiresAt := time.Now().Add(time.Minute)
+	lock = &ct.DeployLock{Owner: "ci-1", ExpiresAt: &expiresAt}
+	c.Assert(s.c.AcquireDeployLock(app.ID, lock), IsNil)
+
+	c.Assert(s.c.ReleaseDeployLock(app.ID, "ci-1"), IsNil)
+	_, err = s.c.GetDeployLock(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = s.c.CreateDeployment(app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+	c.Assert(err, IsNil)
+
+	// expired locks are ignored
+	expiresAt = time.Now().Add(time.Second)
+	c.Assert(s.c.AcquireDeployLock(app.ID, &ct.DeployLock{Owner: "ci-1", ExpiresAt: &expiresAt}), IsNil)
+	time.Sleep(1500 * time.Millisecond)
+	c.Assert(s.c.AcquireDeployLock(app.ID, &ct.DeployLock{Owner: "ci-2"}), IsNil)
+
+	// full scope tokens can force release the lock
+	c.Assert(s.c.ReleaseDeployLock(app.ID, ""), IsNil)
+	_, err = s.c.GetDeployLock(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	logaggc "github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/logaggregator/types"
+)
+
+// appLogBufferSize is the number of progress messages which are held while the
+// log aggregator can't be reached, further messages are dropped so that
+// deployments are never blocked on writing their progress.
+const appLogBufferSize = 1000
+
+// appLog writes the progress of deployments to the logs of their apps in the
+// log aggregator, so that 'flynn log' shows what the platform is doing during a
+// deployment alongside the output of the app's jobs.
+type appLog struct {
+	msgs chan *logagg.Message
+}
+
+func newAppLog() *appLog {
+	l := &appLog{msgs: make(chan *logagg.Message, appLogBufferSize)}
+	go l.run()
+	return l
+}
+
+// run forwards messages to the log aggregator, reconnecting when the
+// connection fails.
+func (l *appLog) run() {
+	log := logger.New("fn", "appLog.run")
+	for {
+		if err := logaggc.New().Forward(l.msgs); err != nil {
+			log.Error("error forwarding deployment progress", "err", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Write adds a progress line for deployment to the log of its app.
+func (l *appLog) Write(deployment *ct.Deployment, format string, v ...interface{}) {
+	msg := &logagg.Message{
+		AppID:     deployment.AppID,
+		ReleaseID: deployment.NewReleaseID,
+		Stream:    logagg.StreamStdout,
+		Timestamp: time.Now(),
+		Msg:       fmt.Sprintf(format, v...),
+		Source:    logagg.SourceDeployer,
+	}
+	select {
+	case l.msgs <- msg:
+	default:
+	}
+}
+
+// WriteEvent adds a progress line for e, which has had its progress set, to
+// the log of the app of deployment. Events for jobs being started or stopped
+// are skipped as the state they reach is written instead.
+func (l *appLog) WriteEvent(deployment *ct.Deployment, e *ct.DeploymentEvent) {
+	switch {
+	case e.Status == "complete":
+		l.Write(deployment, "deployment %s complete", deployment.ID)
+	case e.Status == "failed":
+		// the failure is written with its cause by HandleJob
+	case e.Step == ct.DeploymentStepStart && e.JobState == "up":
+		l.Write(deployment, "%s job of the new release is up (%d/%d), deployment %d%% complete", e.JobType, e.Current[e.JobType], e.Expected[e.JobType], e.Percent)
+	case e.Step == ct.DeploymentStepStart && e.JobState == "down":
+		l.Write(deployment, "%s job of the new release went down or failed its readiness check", e.JobType)
+	case e.Step == ct.DeploymentStepStart && e.JobState == "failed":
+		l.Write(deployment, "%s job of the new release failed to start", e.JobType)
+	case e.Step == ct.DeploymentStepStop && e.JobState == "down":
+		l.Write(deployment, "%s job of the old release stopped, deployment %d%% complete", e.JobType, e.Percent)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// limitPollInterval is how often a deployment waiting for a free slot checks
+// again, picking up changes to the concurrency setting.
+var limitPollInterval = 5 * time.Second
+
+// concurrencyLimiter limits the number of deployments performed at once to
+// the deployment concurrency setting. Only the leading deployer performs
+// deployments, so the limit applies across the cluster.
+type concurrencyLimiter struct {
+	client *controller.Client
+
+	mtx     sync.Mutex
+	running int
+}
+
+// limit returns the current limit, zero means there is no limit.
+func (l *concurrencyLimiter) limit(log log15.Logger) int {
+	setting, err := l.client.GetSetting(ct.SettingDeploymentConcurrency)
+	if err != nil {
+		log.Error("error getting deployment concurrency setting", "err", err)
+		return 0
+	}
+	if setting.Value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(setting.Value)
+	if err != nil {
+		log.Error("error parsing deployment concurrency setting", "err", err)
+		return 0
+	}
+	return n
+}
+
+// acquire blocks until a deployment can be performed without exceeding the
+// limit, release must be called once it has finished.
+func (l *concurrencyLimiter) acquire(log log15.Logger) {
+	waiting := false
+	for {
+		limit := l.limit(log)
+		l.mtx.Lock()
+		if limit <= 0 || l.running < limit {
+			l.running++
+			l.mtx.Unlock()
+			return
+		}
+		l.mtx.Unlock()
+		if !waiting {
+			log.Info("waiting for a running deployment to finish", "limit", limit)
+			waiting = true
+		}
+		time.Sleep(limitPollInterval)
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	l.mtx.Lock()
+	l.running--
+	l.mtx.Unlock()
+}
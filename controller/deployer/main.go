@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/bgentry/que-go"
@@ -11,16 +12,28 @@ import (
 	"github.com/flynn/flynn/controller/client"
 	"github.com/flynn/flynn/controller/deployer/strategies"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/shutdown"
 )
 
 type context struct {
-	db     *postgres.DB
-	client *controller.Client
+	db      *postgres.DB
+	client  *controller.Client
+	limiter *concurrencyLimiter
+	appLog  *appLog
 }
 
-const workerCount = 10
+// defaultWorkerCount is the number of deployments performed concurrently
+// across the cluster unless DEPLOYER_WORKERS is set, the deployment
+// concurrency setting can lower it further. Deployments of the same app are
+// never performed concurrently, as an app can only have one unfinished
+// deployment.
+const defaultWorkerCount = 10
+
+// serviceName is the discoverd service used to elect the deployer which runs
+// the background workers.
+const serviceName = "flynn-deployer"
 
 var logger = log15.New("app", "deployer")
 
@@ -34,6 +47,16 @@ func main() {
 		shutdown.Fatal()
 	}
 
+	workerCount := defaultWorkerCount
+	if s := os.Getenv("DEPLOYER_WORKERS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			log.Error("invalid DEPLOYER_WORKERS, must be a positive integer", "value", s)
+			shutdown.Fatal()
+		}
+		workerCount = n
+	}
+
 	log.Info("connecting to postgres")
 	postgres.Wait("")
 	db, err := postgres.Open("", "")
@@ -59,7 +82,7 @@ func main() {
 	}
 	shutdown.BeforeExit(func() { pgxpool.Close() })
 
-	ctx := context{db: db, client: client}
+	ctx := context{db: db, client: client, limiter: &concurrencyLimiter{client: client}, appLog: newAppLog()}
 	workers := que.NewWorkerPool(
 		que.NewClient(pgxpool),
 		que.WorkMap{"deployment": ctx.HandleJob},
@@ -67,11 +90,59 @@ func main() {
 	)
 	workers.Interval = 5 * time.Second
 
+	// only the leader runs the workers so that multiple deployers don't
+	// perform the same work concurrently. Leaders are identified by their
+	// address, so each deployer needs its own port to register with.
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Error("PORT must be set to register with service discovery")
+		shutdown.Fatal()
+	}
+	log.Info("registering with service discovery")
+	hb, err := discoverd.AddServiceAndRegister(serviceName, ":"+port)
+	if err != nil {
+		log.Error("error registering with service discovery", "err", err)
+		shutdown.Fatal()
+	}
+	shutdown.BeforeExit(func() { hb.Close() })
+
+	leaders := make(chan *discoverd.Instance)
+	stream, err := discoverd.NewService(serviceName).Leaders(leaders)
+	if err != nil {
+		log.Error("error watching service leader", "err", err)
+		shutdown.Fatal()
+	}
+
+	log.Info("waiting for leadership")
+	isLeader := false
+	for leader := range leaders {
+		if leader.Addr == hb.Addr() {
+			isLeader = true
+			break
+		}
+	}
+	if !isLeader {
+		// the stream may close without an error, the deployer is
+		// only leader once it has seen itself elected
+		log.Error("leader stream closed while waiting for leadership", "err", stream.Err())
+		shutdown.Fatal()
+	}
+
 	log.Info("starting workers", "count", workerCount, "interval", workers.Interval)
 	go workers.Start()
 	shutdown.BeforeExit(func() { workers.Shutdown() })
 
-	<-make(chan bool) // block and keep running
+	// if leadership is lost (e.g. the discoverd registration expired),
+	// another deployer may already be running the workers, so stop them and
+	// exit to be restarted as a follower
+	for leader := range leaders {
+		if leader.Addr != hb.Addr() {
+			log.Error("lost leadership", "leader", leader.Addr)
+			shutdown.Fatal()
+		}
+	}
+	log.Error("leader stream closed", "err", stream.Err())
+	shutdown.Fatal()
 }
 
 func (c *context) HandleJob(job *que.Job) (e error) {
@@ -96,21 +167,50 @@ func (c *context) HandleJob(job *que.Job) (e error) {
 		"app_id", deployment.AppID,
 		"strategy", deployment.Strategy,
 	)
-	// for recovery purposes, fetch old formation
-	log.Info("getting old formation")
-	f, err := c.client.GetFormation(deployment.AppID, deployment.OldReleaseID)
-	if err != nil {
-		log.Error("error getting old formation", "err", err)
-		return err
+	// deployments are queued in postgres, so a job is performed again if the
+	// deployer stops before the job is removed from the queue
+	if deployment.FinishedAt != nil {
+		log.Info("deployment already finished", "status", deployment.Status)
+		return nil
+	}
+
+	// track progress against the old formation from when the deployment
+	// was created, as a resumed deployment has already changed it
+	f := &ct.Formation{
+		AppID:     deployment.AppID,
+		ReleaseID: deployment.OldReleaseID,
+		Processes: deployment.OldProcesses,
+	}
+	if deployment.OldProcesses == nil {
+		log.Info("getting old formation")
+		f, err = c.client.GetFormation(deployment.AppID, deployment.OldReleaseID)
+		if err != nil {
+			log.Error("error getting old formation", "err", err)
+			return err
+		}
 	}
 
+	if deployment.Status == "failed" {
+		// a previous attempt failed to roll back the deployment, so only
+		// retry the rollback
+		log.Info("retrying rollback of failed deployment")
+		return c.rollback(log, deployment)
+	}
+
+	c.limiter.acquire(log)
+	defer c.limiter.release()
+	c.appLog.Write(deployment, "deployment %s of release %s started using the %s strategy", deployment.ID, deployment.NewReleaseID, deployment.Strategy)
+
 	events := make(chan ct.DeploymentEvent)
 	defer close(events)
+	tracker := newProgress(deployment, f)
 	go func() {
 		log.Info("watching deployment events")
 		for ev := range events {
 			log.Info("received deployment event", "status", ev.Status, "type", ev.JobType, "state", ev.JobState)
 			ev.DeploymentID = deployment.ID
+			tracker.update(&ev)
+			c.appLog.WriteEvent(deployment, &ev)
 			if err := c.createDeploymentEvent(ev); err != nil {
 				log.Error("error creating deployment event record", "err", err)
 			}
@@ -120,12 +220,30 @@ func (c *context) HandleJob(job *que.Job) (e error) {
 	defer func() {
 		// rollback failed deploy
 		if e != nil {
-			log.Warn("rolling back deployment due to error", "err", e)
-			e = c.rollback(log, deployment, f)
+			c.appLog.Write(deployment, "deployment %s failed: %s", deployment.ID, e)
+			if deployment.NoRollback {
+				log.Warn("not rolling back failed deployment", "err", e)
+				e = nil
+			} else {
+				log.Warn("rolling back deployment due to error", "err", e)
+				e = c.rollback(log, deployment)
+				if e == nil {
+					c.appLog.Write(deployment, "deployment %s rolled back to release %s", deployment.ID, deployment.OldReleaseID)
+				} else {
+					c.appLog.Write(deployment, "error rolling back deployment %s, retrying: %s", deployment.ID, e)
+				}
+			}
 			events <- ct.DeploymentEvent{
 				ReleaseID: deployment.NewReleaseID,
 				Status:    "failed",
 			}
+			// if the rollback failed the job is retried, otherwise the
+			// deployment is finished so that the app can be deployed again
+			if e == nil && deployment.NoRollback {
+				if err := c.setDeploymentDone(deployment.ID); err != nil {
+					log.Error("error marking the deployment as done", "err", err)
+				}
+			}
 		}
 	}()
 	log.Info("performing deployment")
@@ -133,15 +251,13 @@ func (c *context) HandleJob(job *que.Job) (e error) {
 		log.Error("error performing deployment", "err", err)
 		return err
 	}
-	log.Info("setting the app release")
-	if err := c.client.SetAppRelease(deployment.AppID, deployment.NewReleaseID); err != nil {
-		log.Error("error setting the app release", "err", err)
+	// the app release is set and the deployment marked as done in a
+	// single controller transaction
+	log.Info("completing the deployment")
+	if err := c.client.CompleteDeployment(deployment.AppID, deployment.ID); err != nil {
+		log.Error("error completing the deployment", "err", err)
 		return err
 	}
-	log.Info("marking the deployment as done")
-	if err := c.setDeploymentDone(deployment.ID); err != nil {
-		log.Error("error marking the deployment as done", "err", err)
-	}
 	// signal success
 	events <- ct.DeploymentEvent{
 		ReleaseID: deployment.NewReleaseID,
@@ -151,21 +267,17 @@ func (c *context) HandleJob(job *que.Job) (e error) {
 	return nil
 }
 
-func (c *context) rollback(l log15.Logger, deployment *ct.Deployment, original *ct.Formation) error {
+// rollback restores the original formation, deletes the new formation and
+// marks the deployment as done in a single controller transaction.
+func (c *context) rollback(l log15.Logger, deployment *ct.Deployment) error {
 	log := l.New("fn", "rollback")
 
 	log.Info("restoring the original formation")
-	if err := c.client.PutFormation(original); err != nil {
+	if err := c.client.RollbackDeployment(deployment.AppID, deployment.ID); err != nil {
 		log.Error("error restoring the original formation", "err", err)
 		return err
 	}
 
-	log.Info("deleting the new formation")
-	if err := c.client.DeleteFormation(deployment.AppID, deployment.NewReleaseID); err != nil {
-		log.Error("error deleting the new formation:", "err", err)
-		return err
-	}
-
 	log.Info("rollback complete")
 	return nil
 }
@@ -178,6 +290,14 @@ func (c *context) createDeploymentEvent(e ct.DeploymentEvent) error {
 	if e.Status == "" {
 		e.Status = "running"
 	}
-	query := "INSERT INTO deployment_events (deployment_id, release_id, job_type, job_state, status) VALUES ($1, $2, $3, $4, $5)"
-	return c.db.Exec(query, e.DeploymentID, e.ReleaseID, e.JobType, e.JobState, e.Status)
+	expected, err := json.Marshal(e.Expected)
+	if err != nil {
+		return err
+	}
+	current, err := json.Marshal(e.Current)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO deployment_events (deployment_id, release_id, job_type, job_state, status, step, expected_jobs, current_jobs, percent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	return c.db.Exec(query, e.DeploymentID, e.ReleaseID, e.JobType, e.JobState, e.Status, e.Step, string(expected), string(current), e.Percent)
 }
@@ -0,0 +1,85 @@
+package main
+
+import ct "github.com/flynn/flynn/controller/types"
+
+// progress tracks the jobs started and stopped by a deployment so that its
+// events can report how far along the deployment is.
+type progress struct {
+	newReleaseID string
+	noRollback   bool
+	expected     map[string]int
+	started      map[string]int
+	stopped      int
+	// starts and stops are the number of jobs the deployment starts and
+	// stops in total
+	starts int
+	stops  int
+}
+
+// newProgress returns the progress of a deployment which replaces the
+// processes of formation.
+func newProgress(deployment *ct.Deployment, formation *ct.Formation) *progress {
+	processes := deployment.NewProcesses(formation.Processes)
+	p := &progress{
+		newReleaseID: deployment.NewReleaseID,
+		noRollback:   deployment.NoRollback,
+		expected:     make(map[string]int, len(processes)),
+		started:      make(map[string]int, len(processes)),
+	}
+	for typ, n := range processes {
+		if n > 0 {
+			p.expected[typ] = n
+			p.starts += n
+		}
+	}
+	for _, n := range formation.Processes {
+		p.stops += n
+	}
+	return p
+}
+
+// update records the job state in e and sets the resulting progress on e.
+func (p *progress) update(e *ct.DeploymentEvent) {
+	switch {
+	case e.Status == "complete":
+		e.Step = ct.DeploymentStepDone
+		for typ, n := range p.expected {
+			p.started[typ] = n
+		}
+		p.stopped = p.stops
+	case e.Status == "failed" && p.noRollback:
+		e.Step = ct.DeploymentStepFailed
+	case e.Status == "failed":
+		e.Step = ct.DeploymentStepRollback
+	case e.ReleaseID == p.newReleaseID:
+		e.Step = ct.DeploymentStepStart
+		if e.JobState == "up" {
+			p.started[e.JobType]++
+		}
+	default:
+		e.Step = ct.DeploymentStepStop
+		if e.JobState == "down" {
+			p.stopped++
+		}
+	}
+
+	e.Expected = p.expected
+	e.Current = make(map[string]int, len(p.started))
+	started := 0
+	for typ, n := range p.started {
+		e.Current[typ] = n
+		started += n
+	}
+	// the deployment is done once all new jobs are up and all old jobs are
+	// down
+	if p.starts+p.stops == 0 {
+		if e.Step == ct.DeploymentStepDone {
+			e.Percent = 100
+		}
+		return
+	}
+	e.Percent = (started + p.stopped) * 100 / (p.starts + p.stops)
+	if e.Percent > 100 {
+		e.Percent = 100
+	}
+}
@@ -14,19 +14,30 @@ func allAtOnce(d *Deploy) error {
 		return err
 	}
 
+	processes := d.targetProcesses(f)
 	nlog := log.New("release_id", d.NewReleaseID)
-	nlog.Info("creating new formation", "processes", f.Processes)
+	started, err := d.startedProcesses()
+	if err != nil {
+		nlog.Error("error getting new formation", "err", err)
+		return err
+	}
+	nlog.Info("creating new formation", "processes", processes)
 	if err := d.client.PutFormation(&ct.Formation{
 		AppID:     d.AppID,
 		ReleaseID: d.NewReleaseID,
-		Processes: f.Processes,
+		Processes: processes,
 	}); err != nil {
 		nlog.Error("error creating new formation", "err", err)
 		return err
 	}
 
 	expected := make(jobEvents)
-	for typ, n := range f.Processes {
+	for typ, n := range processes {
+		// jobs started before a resumed deployment aren't waited for
+		n -= started[typ]
+		if n < 0 {
+			n = 0
+		}
 		for i := 0; i < n; i++ {
 			d.deployEvents <- ct.DeploymentEvent{
 				ReleaseID: d.NewReleaseID,
@@ -42,6 +53,11 @@ func allAtOnce(d *Deploy) error {
 		return err
 	}
 
+	for typ, n := range f.Processes {
+		undrain := d.drainOld(typ, n, olog)
+		defer undrain()
+	}
+
 	olog.Info("scaling old formation to zero")
 	if err := d.client.PutFormation(&ct.Formation{
 		AppID:     d.AppID,
@@ -0,0 +1,116 @@
+package strategy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/cluster"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+// drainTimeout is how long to wait for the requests in flight to old jobs to
+// finish before the jobs are stopped.
+var drainTimeout = 30 * time.Second
+
+// drainOld drains the n old jobs of type typ which the scheduler will stop
+// next from every router, so they get no new requests, then waits up to
+// drainTimeout for their in-flight requests to finish. The returned function
+// undrains the jobs and should be called once they are down. Draining only
+// reduces dropped requests, so errors are logged rather than failing the
+// deployment.
+func (d *Deploy) drainOld(typ string, n int, log log15.Logger) func() {
+	service := d.oldServices[typ]
+	if service == "" || n <= 0 {
+		return func() {}
+	}
+
+	addrs, err := d.nextStoppedAddrs(typ, service, n)
+	if err != nil {
+		log.Error("error getting addresses of old jobs to drain", "type", typ, "err", err)
+		return func() {}
+	}
+	routerAddrs, err := discoverd.NewService("router-api").Addrs()
+	if err != nil {
+		log.Error("error getting router addresses", "err", err)
+		return func() {}
+	}
+	if len(addrs) == 0 || len(routerAddrs) == 0 {
+		return func() {}
+	}
+
+	routers := make([]routerc.Client, 0, len(routerAddrs))
+	for _, addr := range routerAddrs {
+		routers = append(routers, routerc.NewWithAddr(addr))
+	}
+	log.Info("draining old jobs", "type", typ, "addrs", addrs)
+	inFlight := routerc.DrainBackends(routers, addrs, drainTimeout, func(addr string, err error) {
+		log.Error("error draining old job", "addr", addr, "err", err)
+	})
+	if inFlight > 0 {
+		log.Warn("timed out draining old jobs", "type", typ, "in_flight", inFlight)
+	} else {
+		log.Info("drained old jobs", "type", typ)
+	}
+
+	return func() {
+		routerc.UndrainBackends(routers, addrs, func(addr string, err error) {
+			log.Error("error undraining old job", "addr", addr, "err", err)
+		})
+	}
+}
+
+// nextStoppedAddrs returns the service addresses of the n running old jobs of
+// type typ which the scheduler will stop next, which are those started most
+// recently.
+func (d *Deploy) nextStoppedAddrs(typ, service string, n int) ([]string, error) {
+	jobs, err := d.client.JobList(d.AppID)
+	if err != nil {
+		return nil, err
+	}
+	old := make(sortJobs, 0, len(jobs))
+	for _, job := range jobs {
+		if job.ReleaseID == d.OldReleaseID && job.Type == typ && job.State == "up" {
+			old = append(old, job)
+		}
+	}
+	sort.Sort(old)
+	if len(old) > n {
+		old = old[:n]
+	}
+
+	instances, err := discoverd.NewService(service).Instances()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]string, len(instances))
+	for _, inst := range instances {
+		addrs[inst.Meta["FLYNN_JOB_ID"]] = inst.Addr
+	}
+	res := make([]string, 0, len(old))
+	for _, job := range old {
+		_, jobID, err := cluster.ParseJobID(job.ID)
+		if err != nil {
+			continue
+		}
+		if addr, ok := addrs[jobID]; ok {
+			res = append(res, addr)
+		}
+	}
+	return res, nil
+}
+
+// sortJobs sorts jobs in reverse chronological order of creation, matching
+// the order in which the scheduler stops jobs.
+type sortJobs []*ct.Job
+
+func (s sortJobs) Len() int      { return len(s) }
+func (s sortJobs) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortJobs) Less(i, j int) bool {
+	if s[i].CreatedAt == nil || s[j].CreatedAt == nil {
+		return s[i].CreatedAt != nil
+	}
+	return s[i].CreatedAt.After(*s[j].CreatedAt)
+}
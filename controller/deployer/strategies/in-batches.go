@@ -0,0 +1,121 @@
+package strategy
+
+import (
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func inBatches(d *Deploy) error {
+	log := d.logger.New("fn", "inBatches")
+	log.Info("starting in-batches deployment")
+
+	olog := log.New("release_id", d.OldReleaseID)
+	olog.Info("getting old formation")
+	f, err := d.client.GetFormation(d.AppID, d.OldReleaseID)
+	if err != nil {
+		olog.Error("error getting old formation", "err", err)
+		return err
+	}
+
+	oldProcesses := f.Processes
+	processes := d.targetProcesses(f)
+	newProcesses, err := d.startedProcesses()
+	if err != nil {
+		log.Error("error getting new formation", "err", err)
+		return err
+	}
+
+	nlog := log.New("release_id", d.NewReleaseID)
+	for typ, num := range processes {
+		size := d.BatchSize
+		if size <= 0 {
+			total := num
+			if oldProcesses[typ] > total {
+				total = oldProcesses[typ]
+			}
+			size = ct.DefaultDeployBatchSize(total)
+		}
+		for newProcesses[typ] < num || oldProcesses[typ] > 0 {
+			if n := min(size, num-newProcesses[typ]); n > 0 {
+				if err := d.startBatch(typ, n, newProcesses, nlog); err != nil {
+					return err
+				}
+			}
+			if n := min(size, oldProcesses[typ]); n > 0 {
+				if err := d.stopBatch(typ, n, oldProcesses, olog); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	log.Info("finished in-batches deployment")
+	return nil
+}
+
+// startBatch scales the new formation up by n processes of type typ and waits
+// for the new jobs to come up.
+func (d *Deploy) startBatch(typ string, n int, processes map[string]int, log log15.Logger) error {
+	log.Info("scaling new formation up by batch", "type", typ, "count", n)
+	processes[typ] += n
+	if err := d.client.PutFormation(&ct.Formation{
+		AppID:     d.AppID,
+		ReleaseID: d.NewReleaseID,
+		Processes: processes,
+	}); err != nil {
+		log.Error("error scaling new formation up by batch", "type", typ, "err", err)
+		return err
+	}
+	for i := 0; i < n; i++ {
+		d.deployEvents <- ct.DeploymentEvent{
+			ReleaseID: d.NewReleaseID,
+			JobState:  "starting",
+			JobType:   typ,
+		}
+	}
+
+	log.Info("waiting for job up events", "type", typ, "count", n)
+	if err := d.waitForJobEvents(d.NewReleaseID, jobEvents{typ: {"up": n}}, log); err != nil {
+		log.Error("error waiting for job up events", "err", err)
+		return err
+	}
+	return nil
+}
+
+// stopBatch drains n old jobs of type typ, then scales the old formation down
+// by n processes of that type and waits for the jobs to go down.
+func (d *Deploy) stopBatch(typ string, n int, processes map[string]int, log log15.Logger) error {
+	undrain := d.drainOld(typ, n, log)
+	defer undrain()
+
+	log.Info("scaling old formation down by batch", "type", typ, "count", n)
+	processes[typ] -= n
+	if err := d.client.PutFormation(&ct.Formation{
+		AppID:     d.AppID,
+		ReleaseID: d.OldReleaseID,
+		Processes: processes,
+	}); err != nil {
+		log.Error("error scaling old formation down by batch", "type", typ, "err", err)
+		return err
+	}
+	for i := 0; i < n; i++ {
+		d.deployEvents <- ct.DeploymentEvent{
+			ReleaseID: d.OldReleaseID,
+			JobState:  "stopping",
+			JobType:   typ,
+		}
+	}
+
+	log.Info("waiting for job down events", "type", typ, "count", n)
+	if err := d.waitForJobEvents(d.OldReleaseID, jobEvents{typ: {"down": n}}, log); err != nil {
+		log.Error("error waiting for job down events", "err", err)
+		return err
+	}
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
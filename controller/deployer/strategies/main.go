@@ -8,6 +8,7 @@ import (
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/cluster"
 )
 
 type UnknownStrategyError struct {
@@ -25,7 +26,15 @@ type Deploy struct {
 	jobEvents     chan *ct.JobEvent
 	serviceEvents chan *discoverd.Event
 	useJobEvents  map[string]struct{}
+	readiness     map[string]*ct.ReadinessCheck
+	stopFirst     map[string]bool
+	startTimeouts map[string]time.Duration
+	killTimeouts  map[string]time.Duration
+	oldServices   map[string]string
 	logger        log15.Logger
+
+	// failures is the number of jobs which have failed so far
+	failures int
 }
 
 type PerformFunc func(d *Deploy) error
@@ -33,6 +42,7 @@ type PerformFunc func(d *Deploy) error
 var performFuncs = map[string]PerformFunc{
 	"all-at-once": allAtOnce,
 	"one-by-one":  oneByOne,
+	"in-batches":  inBatches,
 }
 
 func Perform(d *ct.Deployment, client *controller.Client, deployEvents chan<- ct.DeploymentEvent, logger log15.Logger) error {
@@ -52,6 +62,11 @@ func Perform(d *ct.Deployment, client *controller.Client, deployEvents chan<- ct
 		deployEvents:  deployEvents,
 		serviceEvents: make(chan *discoverd.Event),
 		useJobEvents:  make(map[string]struct{}),
+		readiness:     make(map[string]*ct.ReadinessCheck),
+		stopFirst:     make(map[string]bool),
+		startTimeouts: make(map[string]time.Duration),
+		killTimeouts:  make(map[string]time.Duration),
+		oldServices:   make(map[string]string),
 		logger:        logger.New("deployment_id", d.ID, "app_id", d.AppID),
 	}
 
@@ -61,7 +76,29 @@ func Perform(d *ct.Deployment, client *controller.Client, deployEvents chan<- ct
 		log.Error("error getting new release", "release_id", d.NewReleaseID, "err", err)
 		return err
 	}
+	if d.OldReleaseID != "" {
+		oldRelease, err := client.GetRelease(d.OldReleaseID)
+		if err != nil {
+			log.Error("error getting old release", "release_id", d.OldReleaseID, "err", err)
+			return err
+		}
+		// old jobs of types with a service are drained from the routers
+		// before they are stopped, and are given their kill timeout to
+		// exit
+		for typ, proc := range oldRelease.Processes {
+			deploy.oldServices[typ] = proc.Service
+			deploy.killTimeouts[typ] = proc.KillTimeout
+		}
+	}
+	// stop ends the watchers once the deployment has been performed
+	stop := make(chan struct{})
+	defer close(stop)
+
 	for typ, proc := range release.Processes {
+		deploy.stopFirst[typ] = proc.StopFirst
+		if proc.StartTimeout > 0 {
+			deploy.startTimeouts[typ] = proc.StartTimeout
+		}
 		if proc.Service == "" {
 			log.Info(fmt.Sprintf("using job events for %s process type, no service defined", typ))
 			deploy.useJobEvents[typ] = struct{}{}
@@ -69,60 +106,63 @@ func Perform(d *ct.Deployment, client *controller.Client, deployEvents chan<- ct
 		}
 
 		log.Info(fmt.Sprintf("using service discovery for %s process type", typ), "service", proc.Service)
-		events := make(chan *discoverd.Event)
-		stream, err := discoverd.NewService(proc.Service).Watch(events)
-		if err != nil {
+		if proc.Readiness != nil {
+			deploy.readiness[typ] = proc.Readiness
+		}
+		watcher := newServiceWatcher(proc.Service, deploy.serviceEvents, deploy.logger)
+		if err := watcher.connect(false, stop); err != nil {
 			log.Error("error creating service discovery watcher", "service", proc.Service, "err", err)
 			return err
 		}
-		defer stream.Close()
-
-	outer:
-		for {
-			select {
-			case event, ok := <-events:
-				if !ok {
-					log.Error("error creating service discovery watcher, channel closed", "service", proc.Service)
-					return fmt.Errorf("deployer: could not create watcher for service: %s", proc.Service)
-				}
-				if event.Kind == discoverd.EventKindCurrent {
-					break outer
-				}
-			case <-time.After(5 * time.Second):
-				log.Error("error creating service discovery watcher, timeout reached", "service", proc.Service)
-				return fmt.Errorf("deployer: could not create watcher for service: %s", proc.Service)
-			}
-		}
-		go func() {
-			for {
-				event, ok := <-events
-				if !ok {
-					// if this happens, it means defer cleanup is in progress
-
-					// TODO: this could also happen if the stream connection
-					// dropped. handle that case
-					return
-				}
-				deploy.serviceEvents <- event
-			}
-		}()
+		go watcher.run(stop)
 	}
 
 	if len(deploy.useJobEvents) > 0 {
 		log.Info("getting job event stream")
-		events := make(chan *ct.JobEvent)
-		stream, err := client.StreamJobEvents(d.AppID, 0, events)
-		if err != nil {
+		deploy.jobEvents = make(chan *ct.JobEvent)
+		watcher := &jobWatcher{
+			client: client,
+			appID:  d.AppID,
+			output: deploy.jobEvents,
+			log:    deploy.logger,
+		}
+		if err := watcher.connect(); err != nil {
 			log.Error("error getting job event stream", "err", err)
 			return err
 		}
-		defer stream.Close()
-		deploy.jobEvents = events
+		go watcher.run(stop)
 	}
 
 	return performFunc(deploy)
 }
 
+// targetProcesses returns the process counts the new release is scaled to.
+// They are based on the old formation from when the deployment was created if
+// it is known, as the old formation of a resumed deployment has already been
+// partly scaled down.
+func (d *Deploy) targetProcesses(old *ct.Formation) map[string]int {
+	if d.OldProcesses != nil {
+		return d.NewProcesses(d.OldProcesses)
+	}
+	return d.NewProcesses(old.Processes)
+}
+
+// startedProcesses returns the process counts of the new release's formation,
+// which are only non-zero if the deployment is being resumed after the
+// deployer stopped part way through it.
+func (d *Deploy) startedProcesses() (map[string]int, error) {
+	f, err := d.client.GetFormation(d.AppID, d.NewReleaseID)
+	if err == controller.ErrNotFound {
+		return make(map[string]int), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if f.Processes == nil {
+		f.Processes = make(map[string]int)
+	}
+	return f.Processes, nil
+}
+
 type jobEvents map[string]map[string]int
 
 // TODO: share with tests
@@ -147,10 +187,16 @@ func (d *Deploy) waitForJobEvents(releaseID string, expected jobEvents, log log1
 	type jobIDState struct{ jobID, state string }
 	sentEvents := make(map[jobIDState]struct{})
 
-	handleEvent := func(jobID, typ, state string) {
+	// jobs counted as up which then go down are uncounted again, so that
+	// their replacements have to come up
+	upJobs := make(map[string]struct{})
+
+	// handleEvent counts an event, returning false if it is a duplicate.
+	// Job IDs are the IDs jobs are started with, without the host ID.
+	handleEvent := func(jobID, typ, state string) bool {
 		// don't send duplicate events
 		if _, ok := sentEvents[jobIDState{jobID, state}]; ok {
-			return
+			return false
 		}
 		sentEvents[jobIDState{jobID, state}] = struct{}{}
 
@@ -158,13 +204,32 @@ func (d *Deploy) waitForJobEvents(releaseID string, expected jobEvents, log log1
 			actual[typ] = make(map[string]int)
 		}
 		actual[typ][state] += 1
+		switch state {
+		case "up":
+			upJobs[jobID] = struct{}{}
+		case "down", "failed":
+			if _, ok := upJobs[jobID]; ok && expected[typ]["up"] > 0 {
+				delete(upJobs, jobID)
+				actual[typ]["up"]--
+			}
+		}
 		d.deployEvents <- ct.DeploymentEvent{
 			ReleaseID: releaseID,
 			JobState:  state,
 			JobType:   typ,
 		}
+		return true
 	}
 
+	timeout := d.eventTimeout(expected)
+
+	// jobs of types with a readiness check are only counted as up once the
+	// check passes
+	ready := make(chan readinessResult)
+	pending := make(map[string]struct{})
+	done := make(chan struct{})
+	defer close(done)
+
 	for {
 		select {
 		case event := <-d.serviceEvents:
@@ -187,22 +252,47 @@ func (d *Deploy) waitForJobEvents(releaseID string, expected jobEvents, log log1
 			}
 			log.Info("got service event", "job_id", jobID, "type", typ, "state", event.Kind)
 			if event.Kind == discoverd.EventKindUp {
+				if check, ok := d.readiness[typ]; ok && releaseID == d.NewReleaseID {
+					if _, ok := pending[jobID]; !ok {
+						log.Info("waiting for readiness check", "job_id", jobID, "type", typ, "addr", event.Instance.Addr)
+						pending[jobID] = struct{}{}
+						go checkReadiness(check, jobID, typ, event.Instance.Addr, ready, done)
+					}
+					continue
+				}
 				handleEvent(jobID, typ, "up")
 			}
 			if jobEventsEqual(expected, actual) {
 				return nil
 			}
-		case event, ok := <-d.jobEvents:
-			if !ok {
-				// if this happens, it means defer cleanup is in progress
-
-				// TODO: this could also happen if the stream connection
-				// dropped. handle that case
+		case res := <-ready:
+			delete(pending, res.jobID)
+			if res.err != nil {
+				log.Error("job failed readiness check", "job_id", res.jobID, "type", res.typ, "err", res.err)
+				if !handleEvent(res.jobID, res.typ, "down") {
+					continue
+				}
+				if err := d.jobFailed(res.typ, log); err != nil {
+					return fmt.Errorf("%s process type failed readiness check: %s", res.typ, res.err)
+				}
+				// the job is still running, so it is stopped for the
+				// scheduler to replace it
+				d.stopJob(res.jobID, log)
+				continue
+			}
+			log.Info("job passed readiness check", "job_id", res.jobID, "type", res.typ)
+			handleEvent(res.jobID, res.typ, "up")
+			if jobEventsEqual(expected, actual) {
 				return nil
 			}
+		case event := <-d.jobEvents:
 			if event.Job.ReleaseID != releaseID {
 				continue
 			}
+			jobID := event.JobID
+			if _, id, err := cluster.ParseJobID(jobID); err == nil {
+				jobID = id
+			}
 
 			// if service discovery is being used for the job's type, ignore up events and fail
 			// the deployment if we get a down event when waiting for the job to come up.
@@ -211,8 +301,15 @@ func (d *Deploy) waitForJobEvents(releaseID string, expected jobEvents, log log1
 					continue
 				}
 				if expected[event.Type]["up"] > 0 && event.IsDown() {
-					handleEvent(event.JobID, event.Type, "down")
-					return fmt.Errorf("%s process type failed to start, got %s job event", event.Type, event.State)
+					// jobs which failed their readiness check
+					// were already counted as failed
+					if !handleEvent(jobID, event.Type, "down") {
+						continue
+					}
+					if err := d.jobFailed(event.Type, log); err != nil {
+						return fmt.Errorf("%s process type failed to start, got %s job event", event.Type, event.State)
+					}
+					continue
 				}
 			}
 
@@ -222,18 +319,82 @@ func (d *Deploy) waitForJobEvents(releaseID string, expected jobEvents, log log1
 			}
 			switch event.State {
 			case "up":
-				handleEvent(event.JobID, event.Type, "up")
+				handleEvent(jobID, event.Type, "up")
 			case "down", "crashed":
-				handleEvent(event.JobID, event.Type, "down")
+				handleEvent(jobID, event.Type, "down")
 			case "failed":
-				handleEvent(event.JobID, event.Type, "failed")
-				return fmt.Errorf("deployer: %s job failed to start", event.Type)
+				if handleEvent(jobID, event.Type, "failed") {
+					if err := d.jobFailed(event.Type, log); err != nil {
+						return err
+					}
+				}
 			}
 			if jobEventsEqual(expected, actual) {
 				return nil
 			}
-		case <-time.After(60 * time.Second):
+		case <-time.After(timeout):
+			if len(pending) > 0 {
+				// readiness checks have their own timeout
+				continue
+			}
 			return fmt.Errorf("timed out waiting for job events: %v", expected)
 		}
 	}
 }
+
+// eventTimeout returns how long to wait for the next of the expected events,
+// which is the longest start timeout of the expected types, extended by the
+// kill timeout of old jobs which are expected to go down.
+func (d *Deploy) eventTimeout(expected jobEvents) time.Duration {
+	var timeout time.Duration
+	for typ, events := range expected {
+		t, ok := d.startTimeouts[typ]
+		if !ok {
+			t = ct.DefaultStartTimeout
+		}
+		if events["down"] > 0 {
+			t += d.killTimeouts[typ]
+		}
+		if t > timeout {
+			timeout = t
+		}
+	}
+	if timeout == 0 {
+		timeout = ct.DefaultStartTimeout
+	}
+	return timeout
+}
+
+// stopJob stops the job started with the given ID, which doesn't include the
+// host ID, so that the scheduler replaces it. Errors are logged as the job is
+// then just left running.
+func (d *Deploy) stopJob(jobID string, log log15.Logger) {
+	jobs, err := d.client.JobList(d.AppID)
+	if err != nil {
+		log.Error("error listing jobs", "err", err)
+		return
+	}
+	for _, job := range jobs {
+		if _, id, err := cluster.ParseJobID(job.ID); err != nil || id != jobID {
+			continue
+		}
+		log.Info("stopping job", "job_id", job.ID)
+		if err := d.client.DeleteJob(d.AppID, job.ID); err != nil {
+			log.Error("error stopping job", "job_id", job.ID, "err", err)
+		}
+		return
+	}
+}
+
+// jobFailed records a failed job of the given type, returning an error if the
+// deployment has now had more failed jobs than it tolerates. Failed jobs are
+// replaced by the scheduler, so a tolerated failure just means waiting for the
+// replacement.
+func (d *Deploy) jobFailed(typ string, log log15.Logger) error {
+	d.failures++
+	if d.failures > d.MaxFailures {
+		return fmt.Errorf("deployer: %s job failed to start", typ)
+	}
+	log.Warn("tolerating failed job", "type", typ, "failures", d.failures, "max_failures", d.MaxFailures)
+	return nil
+}
@@ -1,6 +1,9 @@
 package strategy
 
-import ct "github.com/flynn/flynn/controller/types"
+import (
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	ct "github.com/flynn/flynn/controller/types"
+)
 
 func oneByOne(d *Deploy) error {
 	log := d.logger.New("fn", "oneByOne")
@@ -15,55 +18,99 @@ func oneByOne(d *Deploy) error {
 	}
 
 	oldProcesses := f.Processes
-	newProcesses := make(map[string]int, len(oldProcesses))
+	processes := d.targetProcesses(f)
+	newProcesses, err := d.startedProcesses()
+	if err != nil {
+		log.Error("error getting new formation", "err", err)
+		return err
+	}
 
 	nlog := log.New("release_id", d.NewReleaseID)
-	for typ, num := range f.Processes {
-		for i := 0; i < num; i++ {
-			nlog.Info("scaling new formation up by one", "type", typ)
-			newProcesses[typ]++
-			if err := d.client.PutFormation(&ct.Formation{
-				AppID:     d.AppID,
-				ReleaseID: d.NewReleaseID,
-				Processes: newProcesses,
-			}); err != nil {
-				nlog.Error("error scaling new formation up by one", "type", typ, "err", err)
-				return err
-			}
-			d.deployEvents <- ct.DeploymentEvent{
-				ReleaseID: d.NewReleaseID,
-				JobState:  "starting",
-				JobType:   typ,
-			}
-
-			nlog.Info("waiting for job up event", "type", typ)
-			if err := d.waitForJobEvents(d.NewReleaseID, jobEvents{typ: {"up": 1}}, nlog); err != nil {
-				nlog.Error("error waiting for job up event", "err", err)
-				return err
-			}
-
-			olog.Info("scaling old formation down by one", "type", typ)
-			oldProcesses[typ]--
-			if err := d.client.PutFormation(&ct.Formation{
-				AppID:     d.AppID,
-				ReleaseID: d.OldReleaseID,
-				Processes: oldProcesses,
-			}); err != nil {
-				olog.Error("error scaling old formation down by one", "type", typ, "err", err)
-				return err
+	for typ, num := range processes {
+		start := func() error {
+			if newProcesses[typ] >= num {
+				return nil
 			}
-			d.deployEvents <- ct.DeploymentEvent{
-				ReleaseID: d.OldReleaseID,
-				JobState:  "stopping",
-				JobType:   typ,
+			return d.startOne(typ, newProcesses, nlog)
+		}
+		stop := func() error {
+			if oldProcesses[typ] <= 0 {
+				return nil
 			}
-			olog.Info("waiting for job down event", "type", typ)
-			if err := d.waitForJobEvents(d.OldReleaseID, jobEvents{typ: {"down": 1}}, olog); err != nil {
-				olog.Error("error waiting for job down event", "err", err)
-				return err
+			return d.stopOne(typ, oldProcesses, olog)
+		}
+		steps := []func() error{start, stop}
+		if d.stopFirst[typ] {
+			// the process can't run two copies at once, so stop the old
+			// job before starting its replacement
+			steps = []func() error{stop, start}
+		}
+		for newProcesses[typ] < num || oldProcesses[typ] > 0 {
+			for _, step := range steps {
+				if err := step(); err != nil {
+					return err
+				}
 			}
 		}
 	}
 	log.Info("finished one-by-one deployment")
 	return nil
 }
+
+// startOne scales the new formation up by one process of type typ and waits
+// for the new job to come up.
+func (d *Deploy) startOne(typ string, processes map[string]int, log log15.Logger) error {
+	log.Info("scaling new formation up by one", "type", typ)
+	processes[typ]++
+	if err := d.client.PutFormation(&ct.Formation{
+		AppID:     d.AppID,
+		ReleaseID: d.NewReleaseID,
+		Processes: processes,
+	}); err != nil {
+		log.Error("error scaling new formation up by one", "type", typ, "err", err)
+		return err
+	}
+	d.deployEvents <- ct.DeploymentEvent{
+		ReleaseID: d.NewReleaseID,
+		JobState:  "starting",
+		JobType:   typ,
+	}
+
+	log.Info("waiting for job up event", "type", typ)
+	if err := d.waitForJobEvents(d.NewReleaseID, jobEvents{typ: {"up": 1}}, log); err != nil {
+		log.Error("error waiting for job up event", "err", err)
+		return err
+	}
+	return nil
+}
+
+// stopOne drains the old job of type typ which is stopped next, then scales the
+// old formation down by one process of that type and waits for the job to go
+// down.
+func (d *Deploy) stopOne(typ string, processes map[string]int, log log15.Logger) error {
+	undrain := d.drainOld(typ, 1, log)
+	defer undrain()
+
+	log.Info("scaling old formation down by one", "type", typ)
+	processes[typ]--
+	if err := d.client.PutFormation(&ct.Formation{
+		AppID:     d.AppID,
+		ReleaseID: d.OldReleaseID,
+		Processes: processes,
+	}); err != nil {
+		log.Error("error scaling old formation down by one", "type", typ, "err", err)
+		return err
+	}
+	d.deployEvents <- ct.DeploymentEvent{
+		ReleaseID: d.OldReleaseID,
+		JobState:  "stopping",
+		JobType:   typ,
+	}
+
+	log.Info("waiting for job down event", "type", typ)
+	if err := d.waitForJobEvents(d.OldReleaseID, jobEvents{typ: {"down": 1}}, log); err != nil {
+		log.Error("error waiting for job down event", "err", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package strategy
+
+import (
+	"fmt"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/health"
+)
+
+// readinessInterval is how long to wait between failed readiness checks.
+var readinessInterval = time.Second
+
+type readinessResult struct {
+	jobID, typ string
+	err        error
+}
+
+// checkReadiness runs check against the job at addr until it passes or times
+// out, and sends the result to ready unless done is closed first.
+func checkReadiness(check *ct.ReadinessCheck, jobID, typ, addr string, ready chan<- readinessResult, done <-chan struct{}) {
+	var c health.Check
+	switch check.Type {
+	case "http":
+		path := check.Path
+		if path == "" {
+			path = "/"
+		}
+		c = &health.HTTPCheck{URL: "http://" + addr + path, StatusCode: check.Status}
+	default:
+		c = &health.TCPCheck{Addr: addr}
+	}
+
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = ct.DefaultReadinessTimeout
+	}
+	deadline := time.After(timeout)
+
+	res := readinessResult{jobID: jobID, typ: typ}
+loop:
+	for {
+		err := c.Check()
+		if err == nil {
+			break
+		}
+		select {
+		case <-time.After(readinessInterval):
+		case <-deadline:
+			res.err = fmt.Errorf("timed out after %s: %s", timeout, err)
+			break loop
+		case <-done:
+			return
+		}
+	}
+	select {
+	case ready <- res:
+	case <-done:
+	}
+}
@@ -0,0 +1,205 @@
+package strategy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/inconshreveable/log15.v2"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// reconnectDelay is how long to wait before reconnecting a dropped event
+// stream. A deployment which doesn't get the events it is waiting for while
+// the stream is down fails once waitForJobEvents times out.
+var reconnectDelay = time.Second
+
+// errStopped is returned when a watcher is stopped while connecting.
+var errStopped = errors.New("deployer: watcher stopped")
+
+// serviceWatcher forwards the events of a service to a deployment, restarting
+// the watch with a fresh snapshot of the service if its stream is dropped.
+type serviceWatcher struct {
+	service string
+	output  chan<- *discoverd.Event
+	log     log15.Logger
+
+	events chan *discoverd.Event
+	stream stream.Stream
+
+	// up is the set of instances which are known to be up, so that they
+	// aren't sent again when the snapshot of a restarted watch lists them
+	up map[string]struct{}
+}
+
+func newServiceWatcher(service string, output chan<- *discoverd.Event, log log15.Logger) *serviceWatcher {
+	return &serviceWatcher{
+		service: service,
+		output:  output,
+		log:     log.New("service", service),
+		up:      make(map[string]struct{}),
+	}
+}
+
+// connect starts watching the service and waits for its current instances. If
+// forward is true, instances which weren't already known to be up are sent to
+// the output.
+func (w *serviceWatcher) connect(forward bool, stop <-chan struct{}) error {
+	events := make(chan *discoverd.Event)
+	stream, err := discoverd.NewService(w.service).Watch(events)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return fmt.Errorf("deployer: could not create watcher for service: %s", w.service)
+			}
+			switch event.Kind {
+			case discoverd.EventKindCurrent:
+				w.events, w.stream = events, stream
+				return nil
+			case discoverd.EventKindUp:
+				if _, ok := w.up[event.Instance.ID]; ok {
+					continue
+				}
+				w.up[event.Instance.ID] = struct{}{}
+				if forward && !w.send(event, stop) {
+					stream.Close()
+					return errStopped
+				}
+			}
+		case <-time.After(5 * time.Second):
+			stream.Close()
+			return fmt.Errorf("deployer: could not create watcher for service: %s", w.service)
+		case <-stop:
+			stream.Close()
+			return errStopped
+		}
+	}
+}
+
+// run forwards events until stop is closed, reconnecting the watch whenever
+// it is dropped.
+func (w *serviceWatcher) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				w.log.Warn("service discovery stream closed, reconnecting", "err", w.stream.Err())
+				if !w.reconnect(stop) {
+					return
+				}
+				continue
+			}
+			if event.Kind == discoverd.EventKindUp {
+				w.up[event.Instance.ID] = struct{}{}
+			}
+			if !w.send(event, stop) {
+				w.stream.Close()
+				return
+			}
+		case <-stop:
+			w.stream.Close()
+			return
+		}
+	}
+}
+
+func (w *serviceWatcher) reconnect(stop <-chan struct{}) bool {
+	for {
+		select {
+		case <-time.After(reconnectDelay):
+		case <-stop:
+			return false
+		}
+		err := w.connect(true, stop)
+		if err == nil {
+			w.log.Info("reconnected service discovery stream")
+			return true
+		} else if err == errStopped {
+			return false
+		}
+		w.log.Error("error reconnecting service discovery stream", "err", err)
+	}
+}
+
+func (w *serviceWatcher) send(event *discoverd.Event, stop <-chan struct{}) bool {
+	select {
+	case w.output <- event:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// jobWatcher forwards the job events of an app to a deployment, resuming the
+// stream after the last event received if it is dropped. Events created while
+// the stream is down before any event has been received are not resumed.
+type jobWatcher struct {
+	client *controller.Client
+	appID  string
+	output chan<- *ct.JobEvent
+	log    log15.Logger
+
+	events chan *ct.JobEvent
+	stream stream.Stream
+	lastID int64
+}
+
+func (w *jobWatcher) connect() error {
+	events := make(chan *ct.JobEvent)
+	stream, err := w.client.StreamJobEvents(w.appID, w.lastID, events)
+	if err != nil {
+		return err
+	}
+	w.events, w.stream = events, stream
+	return nil
+}
+
+// run forwards events until stop is closed, reconnecting the stream whenever
+// it is dropped.
+func (w *jobWatcher) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				w.log.Warn("job event stream closed, reconnecting", "last_id", w.lastID, "err", w.stream.Err())
+				if !w.reconnect(stop) {
+					return
+				}
+				continue
+			}
+			w.lastID = event.ID
+			select {
+			case w.output <- event:
+			case <-stop:
+				w.stream.Close()
+				return
+			}
+		case <-stop:
+			w.stream.Close()
+			return
+		}
+	}
+}
+
+func (w *jobWatcher) reconnect(stop <-chan struct{}) bool {
+	for {
+		select {
+		case <-time.After(reconnectDelay):
+		case <-stop:
+			return false
+		}
+		if err := w.connect(); err != nil {
+			w.log.Error("error reconnecting job event stream", "err", err)
+			continue
+		}
+		w.log.Info("reconnected job event stream", "last_id", w.lastID)
+		return true
+	}
+}
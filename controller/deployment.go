@@ -11,6 +11,7 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/bgentry/que-go"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/schema"
@@ -23,48 +24,117 @@ import (
 )
 
 type DeploymentRepo struct {
-	db *postgres.DB
-	q  *que.Client
+	db       *postgres.DB
+	q        *que.Client
+	notifier *notifier
 }
 
-func NewDeploymentRepo(db *postgres.DB, pgxpool *pgx.ConnPool) *DeploymentRepo {
+func NewDeploymentRepo(db *postgres.DB, pgxpool *pgx.ConnPool, notifier *notifier) *DeploymentRepo {
 	q := que.NewClient(pgxpool)
-	return &DeploymentRepo{db: db, q: q}
+	return &DeploymentRepo{db: db, q: q, notifier: notifier}
 }
 
-func (r *DeploymentRepo) Add(data interface{}) error {
-	d := data.(*ct.Deployment)
+// Add creates a deployment of d.NewReleaseID to d.AppID and queues it for the
+// deployer. If the app has no running processes the release is set
+// immediately and the deployment is complete. The app row is locked while its
+// current release and formation are read and updated, so concurrent
+// deployments and release changes can't leave the app inconsistent.
+//
+// If deploys of the app are locked by anyone other than lockHolder, which may
+// be nil, an error is returned.
+func (r *DeploymentRepo) Add(d *ct.Deployment, lockHolder *ct.DeployLock) error {
 	if d.ID == "" {
 		d.ID = random.UUID()
 	}
-	var oldReleaseID *string
-	if d.OldReleaseID != "" {
-		oldReleaseID = &d.OldReleaseID
-	}
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
-	query := "INSERT INTO deployments (deployment_id, app_id, old_release_id, new_release_id, strategy) VALUES ($1, $2, $3, $4, $5) RETURNING created_at"
-	if err := tx.QueryRow(query, d.ID, d.AppID, oldReleaseID, d.NewReleaseID, d.Strategy).Scan(&d.CreatedAt); err != nil {
+
+	var oldReleaseID *string
+	if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1 AND deleted_at IS NULL FOR UPDATE", d.AppID).Scan(&oldReleaseID); err != nil {
 		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
 		return err
 	}
-	d.ID = postgres.CleanUUID(d.ID)
-	d.OldReleaseID = postgres.CleanUUID(d.OldReleaseID)
-	d.NewReleaseID = postgres.CleanUUID(d.NewReleaseID)
-
-	// fake initial deployment
-	if d.FinishedAt != nil {
-		if _, err := tx.Exec("UPDATE deployments SET finished_at = $2 WHERE deployment_id = $1", d.ID, d.FinishedAt); err != nil {
+	lock, err := selectDeployLock(tx, d.AppID)
+	if err == nil && !deployLockHeldBy(lock, lockHolder) {
+		tx.Rollback()
+		return deployLockedError(lock)
+	} else if err != nil && err != ErrNotFound {
+		tx.Rollback()
+		return err
+	}
+	procCount := 0
+	var oldProcs map[string]int
+	d.OldReleaseID = ""
+	if oldReleaseID != nil {
+		d.OldReleaseID = postgres.CleanUUID(*oldReleaseID)
+		formation, err := selectFormation(tx, d.AppID, d.OldReleaseID)
+		if err != nil && err != ErrNotFound {
 			tx.Rollback()
 			return err
 		}
-		return tx.Commit()
+		if formation != nil {
+			oldProcs = formation.Processes
+			for _, n := range formation.Processes {
+				procCount += n
+			}
+		}
+	}
+	d.Status = "pending"
+	if procCount == 0 {
+		// nothing to deploy, so immediately set the app release and scale
+		// it to the requested process counts
+		if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", d.AppID, d.NewReleaseID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if d.Processes != nil {
+			f := &ct.Formation{AppID: d.AppID, ReleaseID: d.NewReleaseID, Processes: d.NewProcesses(oldProcs)}
+			if err := putFormation(tx, f, ""); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		now := time.Now()
+		d.FinishedAt = &now
+		d.Status = "complete"
+	}
+
+	var oldRelease *string
+	if d.OldReleaseID != "" {
+		oldRelease = &d.OldReleaseID
+	}
+	var batchSize *int
+	if d.BatchSize > 0 {
+		batchSize = &d.BatchSize
+	}
+	var procs, oldProcsHstore hstore.Hstore
+	if d.Processes != nil {
+		procs = procsHstore(d.Processes)
 	}
+	// the old formation is kept so that the deployer can roll back to it
+	// even if it resumes the deployment after the formation was changed
+	if oldProcs != nil {
+		d.OldProcesses = oldProcs
+		oldProcsHstore = procsHstore(oldProcs)
+	}
+	query := "INSERT INTO deployments (deployment_id, app_id, old_release_id, new_release_id, strategy, batch_size, max_failures, no_rollback, processes, old_processes, finished_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING created_at"
+	if err := tx.QueryRow(query, d.ID, d.AppID, oldRelease, d.NewReleaseID, d.Strategy, batchSize, d.MaxFailures, d.NoRollback, procs, oldProcsHstore, d.FinishedAt).Scan(&d.CreatedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	d.ID = postgres.CleanUUID(d.ID)
+	d.NewReleaseID = postgres.CleanUUID(d.NewReleaseID)
 	if err := tx.Commit(); err != nil {
 		return err
 	}
+	if d.FinishedAt != nil {
+		return nil
+	}
 
 	args, err := json.Marshal(ct.DeployID{ID: d.ID})
 	if err != nil {
@@ -80,18 +150,228 @@ func (r *DeploymentRepo) Add(data interface{}) error {
 	return nil
 }
 
+// Complete sets the release of the app to the new release of d, scales the
+// formation of the old release to zero if the deployment left any of its
+// processes, and marks d as finished, all in a single transaction so the app
+// is never left running a release other than the one it is set to.
+func (r *DeploymentRepo) Complete(d *ct.Deployment, actor string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var releaseID *string
+	if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1 FOR UPDATE", d.AppID).Scan(&releaseID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", d.AppID, d.NewReleaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if d.OldReleaseID != "" {
+		old, err := selectFormation(tx, d.AppID, d.OldReleaseID)
+		if err != nil && err != ErrNotFound {
+			tx.Rollback()
+			return err
+		}
+		if old != nil && processCount(old.Processes) > 0 {
+			if err := putFormation(tx, &ct.Formation{AppID: d.AppID, ReleaseID: d.OldReleaseID}, actor); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := setDeploymentFinished(tx, d.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rollback restores the formation of the old release of d, removes the
+// formation of the new release and marks d as finished in a single
+// transaction, so the processes of both releases are never scaled up at the
+// same time by a partial rollback.
+func (r *DeploymentRepo) Rollback(d *ct.Deployment, actor string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var releaseID *string
+	if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1 FOR UPDATE", d.AppID).Scan(&releaseID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if d.OldReleaseID != "" {
+		// the old formation from when the deployment was created is
+		// restored, as the deployment has scaled it down since
+		original := &ct.Formation{AppID: d.AppID, ReleaseID: d.OldReleaseID, Processes: d.OldProcesses}
+		if original.Processes == nil {
+			original, err = selectFormation(tx, d.AppID, d.OldReleaseID)
+			if err != nil && err != ErrNotFound {
+				tx.Rollback()
+				return err
+			}
+		}
+		if original != nil {
+			if err := putFormation(tx, original, actor); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if releaseID != nil && postgres.CleanUUID(*releaseID) == d.NewReleaseID {
+			if _, err := tx.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", d.AppID, d.OldReleaseID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := removeFormation(tx, d.AppID, d.NewReleaseID, actor); err != nil && err != ErrNotFound {
+		tx.Rollback()
+		return err
+	}
+	if err := setDeploymentFinished(tx, d.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func processCount(procs map[string]int) int {
+	n := 0
+	for _, count := range procs {
+		n += count
+	}
+	return n
+}
+
+func setDeploymentFinished(tx execer, id string) error {
+	_, err := tx.Exec("UPDATE deployments SET finished_at = now() WHERE deployment_id = $1 AND finished_at IS NULL", id)
+	return err
+}
+
+// The status of a deployment is the status of its most recent event, or
+// pending if the deployer has not started it yet.
+const deploymentStatus = `COALESCE(
+		(SELECT status::text FROM deployment_events e WHERE e.deployment_id = d.deployment_id ORDER BY event_id DESC LIMIT 1),
+		CASE WHEN d.finished_at IS NULL THEN 'pending' ELSE 'complete' END
+	)`
+
+const deploymentColumns = `d.deployment_id, d.app_id, d.old_release_id, d.new_release_id, d.strategy,
+	d.batch_size, d.max_failures, d.no_rollback, d.processes, d.old_processes, ` + deploymentStatus + `, d.created_at, d.finished_at`
+
 func (r *DeploymentRepo) Get(id string) (*ct.Deployment, error) {
-	query := "SELECT deployment_id, app_id, old_release_id, new_release_id, strategy, created_at, finished_at FROM deployments WHERE deployment_id = $1"
+	query := "SELECT " + deploymentColumns + " FROM deployments d WHERE deployment_id = $1"
 	row := r.db.QueryRow(query, id)
 	return scanDeployment(row)
 }
 
+// List returns the deployments matching filter, newest first. If namespaceID
+// is set, only deployments of apps in that namespace are returned.
+func (r *DeploymentRepo) List(filter *ct.DeploymentFilter, namespaceID string) ([]*ct.Deployment, error) {
+	query := "SELECT " + deploymentColumns + " FROM deployments d"
+	var args []interface{}
+	if namespaceID != "" {
+		args = append(args, namespaceID)
+		query += fmt.Sprintf(" JOIN apps a ON a.app_id = d.app_id AND a.namespace_id = $%d", len(args))
+	}
+	query += " WHERE true"
+	if filter.AppID != "" {
+		args = append(args, filter.AppID)
+		query += fmt.Sprintf(" AND d.app_id = $%d", len(args))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND %s = $%d", deploymentStatus, len(args))
+	}
+	if filter.Since != nil {
+		args = append(args, *filter.Since)
+		query += fmt.Sprintf(" AND d.created_at >= $%d", len(args))
+	}
+	if filter.Until != nil {
+		args = append(args, *filter.Until)
+		query += fmt.Sprintf(" AND d.created_at < $%d", len(args))
+	}
+	query += " ORDER BY d.created_at DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	deployments := []*ct.Deployment{}
+	for rows.Next() {
+		deployment, err := scanDeployment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		deployments = append(deployments, deployment)
+	}
+	return deployments, rows.Err()
+}
+
+// parseDeploymentFilter reads the status, since, until and limit query
+// parameters of req.
+func parseDeploymentFilter(req *http.Request) (*ct.DeploymentFilter, error) {
+	filter := &ct.DeploymentFilter{}
+	q := req.URL.Query()
+	switch status := q.Get("status"); status {
+	case "", ct.DeploymentStatusPending, ct.DeploymentStatusRunning, ct.DeploymentStatusComplete, ct.DeploymentStatusFailed:
+		filter.Status = status
+	default:
+		return nil, ct.ValidationError{Field: "status", Message: fmt.Sprintf("%q is not a valid deployment status", status)}
+	}
+	for _, param := range []struct {
+		name string
+		t    **time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		s := q.Get(param.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, ct.ValidationError{Field: param.name, Message: "must be an RFC 3339 timestamp"}
+		}
+		*param.t = &t
+	}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, ct.ValidationError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxListLimit)}
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
 func scanDeployment(s postgres.Scanner) (*ct.Deployment, error) {
 	d := &ct.Deployment{}
-	err := s.Scan(&d.ID, &d.AppID, &d.OldReleaseID, &d.NewReleaseID, &d.Strategy, &d.CreatedAt, &d.FinishedAt)
+	var batchSize sql.NullInt64
+	var procs, oldProcs hstore.Hstore
+	err := s.Scan(&d.ID, &d.AppID, &d.OldReleaseID, &d.NewReleaseID, &d.Strategy, &batchSize, &d.MaxFailures, &d.NoRollback, &procs, &oldProcs, &d.Status, &d.CreatedAt, &d.FinishedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
+	d.BatchSize = int(batchSize.Int64)
+	if procs.Map != nil {
+		d.Processes = hstoreProcs(procs)
+	}
+	if oldProcs.Map != nil {
+		d.OldProcesses = hstoreProcs(oldProcs)
+	}
 	d.ID = postgres.CleanUUID(d.ID)
 	d.AppID = postgres.CleanUUID(d.AppID)
 	d.OldReleaseID = postgres.CleanUUID(d.OldReleaseID)
@@ -106,8 +386,21 @@ func (c *controllerAPI) GetDeployment(ctx context.Context, w http.ResponseWriter
 		respondWithError(w, err)
 		return
 	}
+	if app, ok := ctx.Value("app").(*ct.App); ok && app.ID != deployment.AppID {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	app, err := c.appRepo.Get(deployment.AppID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if !authorizedForApp(ctx, app.(*ct.App)) {
+		respondWithError(w, errForbidden)
+		return
+	}
 	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
-		if err := streamDeploymentEvents(ctx, deployment.ID, w, c.deploymentRepo); err != nil {
+		if err := streamDeploymentEvents(ctx, deployment.ID, 0, w, c.deploymentRepo); err != nil {
 			respondWithError(w, err)
 		}
 		return
@@ -115,131 +408,277 @@ func (c *controllerAPI) GetDeployment(ctx context.Context, w http.ResponseWriter
 	httphelper.JSON(w, 200, deployment)
 }
 
-func (c *controllerAPI) CreateDeployment(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	var rid releaseID
-	if err := httphelper.DecodeJSON(req, &rid); err != nil {
+func (c *controllerAPI) ListDeployments(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	filter, err := parseDeploymentFilter(req)
+	if err != nil {
 		respondWithError(w, err)
 		return
 	}
+	filter.AppID = c.getApp(ctx).ID
+	list, err := c.deploymentRepo.List(filter, "")
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, list)
+}
 
-	rel, err := c.releaseRepo.Get(rid.ID)
+// ListAllDeployments lists the deployments of all apps which the auth token of
+// the request can access, optionally filtered by the app query parameter.
+func (c *controllerAPI) ListAllDeployments(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	filter, err := parseDeploymentFilter(req)
 	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if id := req.URL.Query().Get("app"); id != "" {
+		app, err := c.appRepo.Lookup(id, tokenNamespace(ctx))
 		if err == ErrNotFound {
-			err = ct.ValidationError{
-				Message: fmt.Sprintf("could not find release with ID %s", rid.ID),
-			}
+			err = ct.ValidationError{Field: "app", Message: "does not exist"}
 		}
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		if !authorizedForApp(ctx, app) {
+			respondWithError(w, errForbidden)
+			return
+		}
+		filter.AppID = app.ID
+	}
+	// tokens scoped to an app can only list its deployments
+	if token := authTokenFromContext(ctx); token != nil && token.AppID != "" {
+		if filter.AppID != "" && filter.AppID != token.AppID {
+			respondWithError(w, errForbidden)
+			return
+		}
+		filter.AppID = token.AppID
+	}
+	list, err := c.deploymentRepo.List(filter, tokenNamespace(ctx))
+	if err != nil {
 		respondWithError(w, err)
 		return
 	}
-	release := rel.(*ct.Release)
-	app := c.getApp(ctx)
+	httphelper.JSON(w, 200, list)
+}
 
-	// TODO: wrap all of this in a transaction
-	oldRelease, err := c.appRepo.GetRelease(app.ID)
-	if err == ErrNotFound {
-		oldRelease = &ct.Release{}
-	} else if err != nil {
+func (c *controllerAPI) CreateDeployment(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var opts ct.DeploymentOptions
+	if err := httphelper.DecodeJSON(req, &opts); err != nil {
 		respondWithError(w, err)
 		return
 	}
-	oldFormation, err := c.formationRepo.Get(app.ID, oldRelease.ID)
-	if err == ErrNotFound {
-		oldFormation = &ct.Formation{}
-	} else if err != nil {
+
+	rel, err := c.releaseRepo.Get(opts.ReleaseID)
+	if err != nil {
+		if err == ErrNotFound {
+			err = ct.ValidationError{
+				Message: fmt.Sprintf("could not find release with ID %s", opts.ReleaseID),
+			}
+		}
 		respondWithError(w, err)
 		return
 	}
-	procCount := 0
-	for _, i := range oldFormation.Processes {
-		procCount += i
+	release := rel.(*ct.Release)
+	deployment, err := c.createDeployment(c.getApp(ctx), release, &opts, deployLockHolder(ctx, req.URL.Query().Get("lock_owner")))
+	if err != nil {
+		respondWithError(w, err)
+		return
 	}
+	httphelper.JSON(w, 200, deployment)
+}
 
+// createDeployment deploys release to app using the app's strategy. If the
+// app has no running processes, the release is set immediately. opts may be
+// nil, lockHolder is the holder of the app's deploy lock, if any, that is
+// making the deployment.
+func (c *controllerAPI) createDeployment(app *ct.App, release *ct.Release, opts *ct.DeploymentOptions, lockHolder *ct.DeployLock) (*ct.Deployment, error) {
+	if app.Policy != nil && app.Policy.LockRelease {
+		return nil, errReleaseLocked
+	}
+	if err := checkReleaseApp(release, app); err != nil {
+		return nil, err
+	}
 	deployment := &ct.Deployment{
 		AppID:        app.ID,
 		NewReleaseID: release.ID,
 		Strategy:     app.Strategy,
-		OldReleaseID: oldRelease.ID,
+		BatchSize:    app.DeployBatchSize,
+	}
+	if opts != nil {
+		if opts.MaxFailures < 0 {
+			return nil, ct.ValidationError{Field: "max_failures", Message: "must not be negative"}
+		}
+		deployment.MaxFailures = opts.MaxFailures
+		deployment.NoRollback = opts.NoRollback
+		for typ, n := range opts.Processes {
+			if _, ok := release.Processes[typ]; !ok {
+				return nil, ct.ValidationError{Field: "processes", Message: fmt.Sprintf("%s is not a process type of the release", typ)}
+			}
+			if n < 0 {
+				return nil, ct.ValidationError{Field: "processes", Message: fmt.Sprintf("count of %s must not be negative", typ)}
+			}
+		}
+		deployment.Processes = opts.Processes
 	}
-
 	if err := schema.Validate(deployment); err != nil {
-		respondWithError(w, err)
-		return
+		return nil, err
 	}
-	if procCount == 0 {
-		// immediately set app release
-		if err := c.appRepo.SetRelease(app.ID, release.ID); err != nil {
-			respondWithError(w, err)
-			return
+	if deployment.Processes != nil {
+		if err := c.checkDeploymentProcesses(app, release, deployment); err != nil {
+			return nil, err
 		}
-		now := time.Now()
-		deployment.FinishedAt = &now
 	}
 
-	if err := c.deploymentRepo.Add(deployment); err != nil {
+	if err := c.deploymentRepo.Add(deployment, lockHolder); err != nil {
 		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" && e.Constraint == "isolate_deploys" {
-			httphelper.Error(w, httphelper.JSONError{
+			return nil, httphelper.JSONError{
 				Code:    httphelper.ValidationError,
 				Message: "Cannot create deploy, there is already one in progress for this app.",
-			})
-			return
+			}
 		}
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// CompleteDeployment sets the app release to the new release of a deployment
+// the deployer has performed and marks the deployment as finished.
+func (c *controllerAPI) CompleteDeployment(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	c.finishDeployment(ctx, w, c.deploymentRepo.Complete)
+}
+
+// RollbackDeployment restores the formation of the old release of a
+// deployment which failed and marks the deployment as finished.
+func (c *controllerAPI) RollbackDeployment(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	c.finishDeployment(ctx, w, c.deploymentRepo.Rollback)
+}
+
+// finishDeployment calls finish with the deployment of the request, which
+// only the deployer, using a full scope token, may finish.
+func (c *controllerAPI) finishDeployment(ctx context.Context, w http.ResponseWriter, finish func(*ct.Deployment, string) error) {
+	if !fullScope(ctx) {
+		respondWithError(w, errForbidden)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	deployment, err := c.deploymentRepo.Get(params.ByName("deployment_id"))
+	if err != nil {
 		respondWithError(w, err)
 		return
 	}
+	if deployment.AppID != c.getApp(ctx).ID {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	if deployment.FinishedAt != nil {
+		respondWithError(w, ct.ValidationError{Message: "deployment has already finished"})
+		return
+	}
+	if err := finish(deployment, requestActor(ctx)); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
 
-	httphelper.JSON(w, 200, deployment)
+// checkDeploymentProcesses checks the process counts the new release of d is
+// scaled to against the quota and policy of app before it is queued, as they
+// aren't checked again when the formation is scaled.
+func (c *controllerAPI) checkDeploymentProcesses(app *ct.App, release *ct.Release, d *ct.Deployment) error {
+	var old map[string]int
+	current, err := c.appRepo.GetRelease(app.ID)
+	if err == nil {
+		f, err := c.formationRepo.Get(app.ID, current.ID)
+		if err == nil {
+			old = f.Processes
+		} else if err != ErrNotFound {
+			return err
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+	f := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: d.NewProcesses(old)}
+	// the old formation is scaled down by the deployment, so only the new
+	// one is counted
+	if err := checkFormationPolicy(app, release, f.Processes, f.Processes); err != nil {
+		return err
+	}
+	if app.Quota != nil {
+		return checkFormationQuota(app.Quota, f)
+	}
+	return nil
 }
 
 // Deployment events
 
-// TODO: share with controller streamJobs
-func streamDeploymentEvents(ctx context.Context, deploymentID string, w http.ResponseWriter, repo *DeploymentRepo) (err error) {
+// StreamDeploymentEvents streams the events of a deployment, starting with
+// those already created. If the since_id parameter or the Last-Event-Id header
+// is set only events after that ID are sent, so that consumers which
+// reconnect during a deployment can resume the stream without missing events.
+func (c *controllerAPI) StreamDeploymentEvents(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	deployment, err := c.deploymentRepo.Get(params.ByName("deployment_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if deployment.AppID != c.getApp(ctx).ID {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	var sinceID int64
+	if s := req.FormValue("since_id"); s != "" {
+		sinceID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			respondWithError(w, ct.ValidationError{Field: "since_id", Message: "is invalid"})
+			return
+		}
+	} else if s := req.Header.Get("Last-Event-Id"); s != "" {
+		sinceID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			respondWithError(w, ct.ValidationError{Field: "Last-Event-Id", Message: "is invalid"})
+			return
+		}
+	}
+	if err := streamDeploymentEvents(ctx, deployment.ID, sinceID, w, c.deploymentRepo); err != nil {
+		respondWithError(w, err)
+	}
+}
+
+func streamDeploymentEvents(ctx context.Context, deploymentID string, sinceID int64, w http.ResponseWriter, repo *DeploymentRepo) (err error) {
 	l, _ := ctxhelper.LoggerFromContext(ctx)
 	ch := make(chan *ct.DeploymentEvent)
 	s := sse.NewStream(w, ch, l)
 	s.Serve()
 
-	connected := make(chan struct{})
-	done := make(chan struct{})
-	listenEvent := func(ev pq.ListenerEventType, listenErr error) {
-		switch ev {
-		case pq.ListenerEventConnected:
-			close(connected)
-		case pq.ListenerEventDisconnected:
-			close(done)
-		case pq.ListenerEventConnectionAttemptFailed:
-			err = listenErr
-			close(done)
-		}
-	}
-	listener := pq.NewListener(repo.db.DSN(), 10*time.Second, time.Minute, listenEvent)
-	defer listener.Close()
-	listener.Listen("deployment_events:" + postgres.FormatUUID(deploymentID))
-
-	var currID int64
-	events, err := repo.listEvents(deploymentID, 0)
+	channel := "deployment_events:" + postgres.FormatUUID(deploymentID)
+	notifications := make(chan *pq.Notification, notificationBufferSize)
+	if err := repo.notifier.Subscribe(channel, notifications); err != nil {
+		return err
+	}
+	defer repo.notifier.Unsubscribe(channel, notifications)
+
+	currID := sinceID
+	events, err := repo.listEvents(deploymentID, sinceID)
 	if err != nil {
-		return
+		return err
 	}
 	for _, e := range events {
-		currID = e.ID
 		ch <- e
-	}
-
-	select {
-	case <-done:
-		return
-	case <-connected:
+		currID = e.ID
 	}
 
 	for {
 		select {
 		case <-s.Done:
 			return
-		case <-done:
-			return
-		case n := <-listener.Notify:
+		case n, ok := <-notifications:
+			if !ok {
+				// notifications may have been missed, so end the stream
+				// and let the client resume using Last-Event-Id
+				return
+			}
 			id, err := strconv.ParseInt(n.Extra, 10, 64)
 			if err != nil {
 				return err
@@ -252,13 +691,13 @@ func streamDeploymentEvents(ctx context.Context, deploymentID string, w http.Res
 				return err
 			}
 			ch <- e
+			currID = id
 		}
 	}
-	return
 }
 
 func (r *DeploymentRepo) listEvents(deploymentID string, sinceID int64) ([]*ct.DeploymentEvent, error) {
-	query := "SELECT event_id, deployment_id, release_id, job_type, job_state, status, created_at FROM deployment_events WHERE deployment_id = $1 AND event_id > $2"
+	query := "SELECT event_id, deployment_id, release_id, job_type, job_state, status, step, expected_jobs, current_jobs, percent, created_at FROM deployment_events WHERE deployment_id = $1 AND event_id > $2 ORDER BY event_id"
 	rows, err := r.db.Query(query, deploymentID, sinceID)
 	if err != nil {
 		return nil, err
@@ -276,19 +715,33 @@ func (r *DeploymentRepo) listEvents(deploymentID string, sinceID int64) ([]*ct.D
 }
 
 func (r *DeploymentRepo) getEvent(id int64) (*ct.DeploymentEvent, error) {
-	row := r.db.QueryRow("SELECT event_id, deployment_id, release_id, job_type, job_state, status, created_at FROM deployment_events WHERE event_id = $1", id)
+	row := r.db.QueryRow("SELECT event_id, deployment_id, release_id, job_type, job_state, status, step, expected_jobs, current_jobs, percent, created_at FROM deployment_events WHERE event_id = $1", id)
 	return scanDeploymentEvent(row)
 }
 
 func scanDeploymentEvent(s postgres.Scanner) (*ct.DeploymentEvent, error) {
 	event := &ct.DeploymentEvent{}
-	err := s.Scan(&event.ID, &event.DeploymentID, &event.ReleaseID, &event.JobType, &event.JobState, &event.Status, &event.CreatedAt)
+	var step, expected, current *string
+	err := s.Scan(&event.ID, &event.DeploymentID, &event.ReleaseID, &event.JobType, &event.JobState, &event.Status, &step, &expected, &current, &event.Percent, &event.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if step != nil {
+		event.Step = *step
+	}
+	if expected != nil {
+		if err := json.Unmarshal([]byte(*expected), &event.Expected); err != nil {
+			return nil, err
+		}
+	}
+	if current != nil {
+		if err := json.Unmarshal([]byte(*current), &event.Current); err != nil {
+			return nil, err
+		}
+	}
 	event.DeploymentID = postgres.CleanUUID(event.DeploymentID)
 	event.ReleaseID = postgres.CleanUUID(event.ReleaseID)
 	return event, nil
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// deploymentRetention is how much deployment history is kept, a zero field
+// doesn't limit the history.
+type deploymentRetention struct {
+	// Keep is the number of finished deployments kept for each app.
+	Keep int
+	// MaxAge is how long finished deployments are kept.
+	MaxAge time.Duration
+}
+
+// deploymentCollector removes old finished deployments and their events
+// according to the deployment retention settings.
+type deploymentCollector struct {
+	db       *postgres.DB
+	settings *SettingsRepo
+	interval time.Duration
+}
+
+func (d *deploymentCollector) Run() {
+	for range time.Tick(d.interval) {
+		retention := d.retention()
+		if retention.Keep == 0 && retention.MaxAge == 0 {
+			continue
+		}
+		deployments, err := d.Collect(retention, false)
+		if err != nil {
+			log.Printf("Error removing old deployments: %s", err)
+		}
+		if len(deployments) > 0 {
+			log.Printf("Removed %d old deployments", len(deployments))
+		}
+	}
+}
+
+// retention returns the retention of the deployment retention settings.
+func (d *deploymentCollector) retention() deploymentRetention {
+	var r deploymentRetention
+	if s := d.settings.Value(ct.SettingDeploymentRetentionCount); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			log.Printf("Error parsing %s setting: %s", ct.SettingDeploymentRetentionCount, err)
+		}
+		r.Keep = n
+	}
+	if s := d.settings.Value(ct.SettingDeploymentRetentionAge); s != "" {
+		age, err := time.ParseDuration(s)
+		if err != nil {
+			log.Printf("Error parsing %s setting: %s", ct.SettingDeploymentRetentionAge, err)
+		}
+		r.MaxAge = age
+	}
+	return r
+}
+
+// Collect removes the finished deployments which exceed either limit of
+// retention and returns them, if dryRun is true they are returned without
+// being removed. Deployments which are pending or running are always kept.
+func (d *deploymentCollector) Collect(retention deploymentRetention, dryRun bool) ([]*ct.Deployment, error) {
+	deployments := []*ct.Deployment{}
+	if retention.Keep == 0 && retention.MaxAge == 0 {
+		return deployments, nil
+	}
+
+	var cutoff *time.Time
+	if retention.MaxAge > 0 {
+		t := time.Now().Add(-retention.MaxAge)
+		cutoff = &t
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`
+SELECT `+deploymentColumns+` FROM (
+  SELECT *, row_number() OVER (PARTITION BY app_id ORDER BY created_at DESC) AS n
+  FROM deployments WHERE finished_at IS NOT NULL
+) d
+WHERE ($1 > 0 AND d.n > $1) OR ($2::timestamptz IS NOT NULL AND d.created_at < $2)
+ORDER BY d.created_at`, retention.Keep, cutoff)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for rows.Next() {
+		deployment, err := scanDeployment(rows)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		deployments = append(deployments, deployment)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if dryRun {
+		return deployments, tx.Rollback()
+	}
+
+	for _, deployment := range deployments {
+		if _, err := tx.Exec("DELETE FROM deployment_events WHERE deployment_id = $1", deployment.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM deployments WHERE deployment_id = $1", deployment.ID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return deployments, tx.Commit()
+}
+
+// CollectDeployments removes old deployments and responds with the deployments
+// removed, or with those which would be removed if the dry_run parameter is
+// true. The keep and max_age parameters override the retention settings.
+func (c *controllerAPI) CollectDeployments(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	retention := c.deploymentCollector.retention()
+	q := req.URL.Query()
+	if s := q.Get("keep"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			respondWithError(w, ct.ValidationError{Field: "keep", Message: "must be a positive integer"})
+			return
+		}
+		retention.Keep = n
+	}
+	if s := q.Get("max_age"); s != "" {
+		age, err := time.ParseDuration(s)
+		if err != nil || age <= 0 {
+			respondWithError(w, ct.ValidationError{Field: "max_age", Message: "must be a positive duration such as 720h"})
+			return
+		}
+		retention.MaxAge = age
+	}
+	deployments, err := c.deploymentCollector.Collect(retention, q.Get("dry_run") == "true")
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, deployments)
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
 	hh "github.com/flynn/flynn/pkg/httphelper"
 )
@@ -41,6 +42,207 @@ func (s *S) TestCreateDeployment(c *C) {
 	c.Assert(err.(hh.JSONError).Message, Equals, "Cannot create deploy, there is already one in progress for this app.")
 }
 
+func (s *S) TestCreateBatchDeployment(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-batch-deployment", Strategy: "in-batches", DeployBatchSize: 2})
+	c.Assert(app.DeployBatchSize, Equals, 2)
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 4},
+	}), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+
+	// the deployment uses the batch size of the app
+	d, err := s.c.CreateDeployment(app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.Strategy, Equals, "in-batches")
+	c.Assert(d.BatchSize, Equals, 2)
+	d, err = s.c.GetDeployment(d.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.BatchSize, Equals, 2)
+
+	// the batch size can be reset to the default
+	_, err = s.c.RawReq("POST", "/apps/"+app.ID, nil, map[string]interface{}{"deploy_batch_size": 0}, nil)
+	c.Assert(err, IsNil)
+	app, err = s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(app.DeployBatchSize, Equals, 0)
+	_, err = s.c.RawReq("POST", "/apps/"+app.ID, nil, map[string]interface{}{"deploy_batch_size": -1}, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestCreateDeploymentWithOptions(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-deployment-options"})
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 2},
+	}), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	newRelease := s.createTestRelease(c, &ct.Release{})
+
+	_, err := s.c.CreateDeploymentWithOptions(app.ID, &ct.DeploymentOptions{ReleaseID: newRelease.ID, MaxFailures: -1})
+	c.Assert(err, NotNil)
+	c.Assert(err.(hh.JSONError).Field, Equals, "max_failures")
+
+	d, err := s.c.CreateDeploymentWithOptions(app.ID, &ct.DeploymentOptions{ReleaseID: newRelease.ID, MaxFailures: 3, NoRollback: true})
+	c.Assert(err, IsNil)
+	c.Assert(d.MaxFailures, Equals, 3)
+	c.Assert(d.NoRollback, Equals, true)
+	d, err = s.c.GetDeployment(d.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.MaxFailures, Equals, 3)
+	c.Assert(d.NoRollback, Equals, true)
+}
+
+func (s *S) TestCreateDeploymentWithProcesses(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "create-deployment-processes"})
+	release := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {}, "worker": {}},
+	})
+	c.Assert(s.c.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 3, "worker": 1},
+	}), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	newRelease := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {}, "worker": {}},
+	})
+
+	for _, procs := range []map[string]int{{"db": 1}, {"web": -1}} {
+		_, err := s.c.CreateDeploymentWithOptions(app.ID, &ct.DeploymentOptions{ReleaseID: newRelease.ID, Processes: procs})
+		c.Assert(err, NotNil)
+		c.Assert(err.(hh.JSONError).Field, Equals, "processes")
+	}
+
+	d, err := s.c.CreateDeploymentWithOptions(app.ID, &ct.DeploymentOptions{ReleaseID: newRelease.ID, Processes: map[string]int{"web": 5}})
+	c.Assert(err, IsNil)
+	c.Assert(d.Processes, DeepEquals, map[string]int{"web": 5})
+	c.Assert(d.NewProcesses(map[string]int{"web": 3, "worker": 1}), DeepEquals, map[string]int{"web": 5, "worker": 1})
+	d, err = s.c.GetDeployment(d.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.Processes, DeepEquals, map[string]int{"web": 5})
+	c.Assert(d.OldProcesses, DeepEquals, map[string]int{"web": 3, "worker": 1})
+
+	// an app without running processes is scaled immediately
+	app = s.createTestApp(c, &ct.App{Name: "create-deployment-processes-scale"})
+	d, err = s.c.CreateDeploymentWithOptions(app.ID, &ct.DeploymentOptions{ReleaseID: newRelease.ID, Processes: map[string]int{"web": 2}})
+	c.Assert(err, IsNil)
+	c.Assert(d.Status, Equals, "complete")
+	formation, err := s.c.GetFormation(app.ID, newRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// the process counts are checked against the quota and policy of the
+	// app, even if it is scaled immediately
+	app = s.createTestApp(c, &ct.App{
+		Name:   "create-deployment-processes-limits",
+		Quota:  &ct.AppQuota{MaxProcesses: 3},
+		Policy: &ct.AppPolicy{MinProcesses: map[string]int{"web": 1}},
+	})
+	for _, procs := range []map[string]int{{"web": 4}, {"web": 0}} {
+		_, err = s.c.CreateDeploymentWithOptions(app.ID, &ct.DeploymentOptions{ReleaseID: newRelease.ID, Processes: procs})
+		c.Assert(err, NotNil)
+	}
+	_, err = s.c.GetFormation(app.ID, newRelease.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestCompleteDeployment(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "complete-deployment"})
+	oldRelease := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 2}}), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, oldRelease.ID), IsNil)
+	newRelease := s.createTestRelease(c, &ct.Release{})
+	d, err := s.c.CreateDeployment(app.ID, newRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.Status, Equals, "pending")
+
+	c.Assert(s.c.CompleteDeployment(app.ID, d.ID), IsNil)
+	release, err := s.c.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(release.ID, Equals, newRelease.ID)
+	formation, err := s.c.GetFormation(app.ID, oldRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, HasLen, 0)
+	d, err = s.c.GetDeployment(d.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.FinishedAt, NotNil)
+
+	// finished deployments can't be completed or rolled back again
+	c.Assert(s.c.CompleteDeployment(app.ID, d.ID), NotNil)
+	c.Assert(s.c.RollbackDeployment(app.ID, d.ID), NotNil)
+}
+
+func (s *S) TestRollbackDeployment(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "rollback-deployment"})
+	oldRelease := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 2}}), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, oldRelease.ID), IsNil)
+	newRelease := s.createTestRelease(c, &ct.Release{})
+	d, err := s.c.CreateDeployment(app.ID, newRelease.ID)
+	c.Assert(err, IsNil)
+
+	// simulate a deployment which failed part way through
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{"web": 1}}), IsNil)
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}}), IsNil)
+
+	c.Assert(s.c.RollbackDeployment(app.ID, d.ID), IsNil)
+	release, err := s.c.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(release.ID, Equals, oldRelease.ID)
+	formation, err := s.c.GetFormation(app.ID, oldRelease.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	_, err = s.c.GetFormation(app.ID, newRelease.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	d, err = s.c.GetDeployment(d.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.FinishedAt, NotNil)
+}
+
+func (s *S) TestCollectDeployments(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "collect-deployments"})
+
+	// the app has no processes, so each deployment finishes immediately
+	var deployments []*ct.Deployment
+	for i := 0; i < 3; i++ {
+		d, err := s.c.CreateDeployment(app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+		c.Assert(err, IsNil)
+		c.Assert(d.FinishedAt, NotNil)
+		deployments = append(deployments, d)
+	}
+	appDeployments := func(list []*ct.Deployment) []string {
+		var ids []string
+		for _, d := range list {
+			if d.AppID == app.ID {
+				ids = append(ids, d.ID)
+			}
+		}
+		return ids
+	}
+
+	list, err := s.c.CollectDeployments(1, 0, true)
+	c.Assert(err, IsNil)
+	c.Assert(appDeployments(list), DeepEquals, []string{deployments[0].ID, deployments[1].ID})
+	_, err = s.c.GetDeployment(deployments[0].ID)
+	c.Assert(err, IsNil)
+
+	list, err = s.c.CollectDeployments(1, 0, false)
+	c.Assert(err, IsNil)
+	c.Assert(appDeployments(list), DeepEquals, []string{deployments[0].ID, deployments[1].ID})
+	_, err = s.c.GetDeployment(deployments[0].ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = s.c.GetDeployment(deployments[2].ID)
+	c.Assert(err, IsNil)
+
+	_, err = s.c.RawReq("POST", "/deployments/gc?keep=0", nil, nil, nil)
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestStreamDeployment(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "stream-deployment"})
 	release := s.createTestRelease(c, &ct.Release{})
@@ -67,16 +269,174 @@ func (s *S) TestStreamDeployment(c *C) {
 		if e.Status == "" {
 			e.Status = "running"
 		}
-		query := "INSERT INTO deployment_events (deployment_id, release_id, job_type, job_state, status) VALUES ($1, $2, $3, $4, $5)"
-		c.Assert(s.hc.db.Exec(query, e.DeploymentID, e.ReleaseID, e.JobType, e.JobState, e.Status), IsNil)
+		query := "INSERT INTO deployment_events (deployment_id, release_id, job_type, job_state, status, step, expected_jobs, current_jobs, percent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+		c.Assert(s.hc.db.Exec(query, e.DeploymentID, e.ReleaseID, e.JobType, e.JobState, e.Status, e.Step, `{"web":1}`, `{"web":1}`, e.Percent), IsNil)
 	}
 	fmt.Println(newRelease.ID)
-	createDeploymentEvent(ct.DeploymentEvent{DeploymentID: d.ID, ReleaseID: newRelease.ID})
+	createDeploymentEvent(ct.DeploymentEvent{DeploymentID: d.ID, ReleaseID: newRelease.ID, JobType: "web", JobState: "up", Step: ct.DeploymentStepStart, Percent: 50})
 
 	select {
 	case e := <-events:
 		c.Assert(e.ReleaseID, Equals, newRelease.ID)
+		c.Assert(e.Step, Equals, ct.DeploymentStepStart)
+		c.Assert(e.Expected, DeepEquals, map[string]int{"web": 1})
+		c.Assert(e.Current, DeepEquals, map[string]int{"web": 1})
+		c.Assert(e.Percent, Equals, 50)
 	case <-time.After(time.Second):
 		c.Fatal("Timed out waiting for event")
 	}
 }
+
+func (s *S) TestStreamDeploymentEventsResume(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "stream-deployment-events"})
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 1},
+	}), IsNil)
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	newRelease := s.createTestRelease(c, &ct.Release{})
+	d, err := s.c.CreateDeployment(app.ID, newRelease.ID)
+	c.Assert(err, IsNil)
+
+	query := "INSERT INTO deployment_events (deployment_id, release_id, job_type, job_state, status) VALUES ($1, $2, $3, $4, $5)"
+	for _, state := range []string{"starting", "up"} {
+		c.Assert(s.hc.db.Exec(query, d.ID, newRelease.ID, "web", state, "running"), IsNil)
+	}
+	receive := func(events chan *ct.DeploymentEvent) *ct.DeploymentEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for deployment event")
+		}
+		return nil
+	}
+
+	// the events created before the stream started are replayed
+	events := make(chan *ct.DeploymentEvent)
+	stream, err := s.c.StreamDeploymentEvents(app.ID, d.ID, 0, events)
+	c.Assert(err, IsNil)
+	first := receive(events)
+	c.Assert(first.JobState, Equals, "starting")
+	second := receive(events)
+	c.Assert(second.JobState, Equals, "up")
+	stream.Close()
+
+	// resuming sends only the events after the given ID
+	c.Assert(s.hc.db.Exec(query, d.ID, newRelease.ID, "web", "down", "running"), IsNil)
+	events = make(chan *ct.DeploymentEvent)
+	stream, err = s.c.StreamDeploymentEvents(app.ID, d.ID, first.ID, events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	c.Assert(receive(events).ID, Equals, second.ID)
+	c.Assert(receive(events).JobState, Equals, "down")
+	c.Assert(s.hc.db.Exec(query, d.ID, newRelease.ID, "", "", "complete"), IsNil)
+	c.Assert(receive(events).Status, Equals, "complete")
+
+	// deployments of other apps are not found
+	other := s.createTestApp(c, &ct.App{Name: "stream-deployment-events-other"})
+	_, err = s.c.StreamDeploymentEvents(other.ID, d.ID, 0, make(chan *ct.DeploymentEvent))
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestListDeployments(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "list-deployments"})
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 1},
+	}), IsNil)
+
+	d1, err := s.c.CreateDeployment(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d1.Status, Equals, "complete")
+
+	d2, err := s.c.CreateDeployment(app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+	c.Assert(err, IsNil)
+	c.Assert(d2.Status, Equals, "pending")
+
+	list, err := s.c.DeploymentList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, d2.ID)
+	c.Assert(list[0].Status, Equals, "pending")
+	c.Assert(list[0].CreatedAt, NotNil)
+	c.Assert(list[1].ID, Equals, d1.ID)
+	c.Assert(list[1].Status, Equals, "complete")
+	c.Assert(list[1].FinishedAt, NotNil)
+
+	// the status is taken from the latest deployment event
+	query := "INSERT INTO deployment_events (deployment_id, release_id, status) VALUES ($1, $2, $3)"
+	c.Assert(s.hc.db.Exec(query, d2.ID, d2.NewReleaseID, "running"), IsNil)
+	d, err := s.c.GetDeployment(d2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(d.Status, Equals, "running")
+
+	// deployments are only returned for their own app
+	other := s.createTestApp(c, &ct.App{Name: "list-deployments-other"})
+	list, err = s.c.DeploymentList(other.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+	var res ct.Deployment
+	err = s.c.Get(fmt.Sprintf("/apps/%s/deployments/%s", other.ID, d2.ID), &res)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestListDeploymentsWithFilter(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "filter-deployments"})
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"web": 1},
+	}), IsNil)
+	d1, err := s.c.CreateDeployment(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	d2, err := s.c.CreateDeployment(app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+	c.Assert(err, IsNil)
+	query := "INSERT INTO deployment_events (deployment_id, release_id, status) VALUES ($1, $2, $3)"
+	c.Assert(s.hc.db.Exec(query, d2.ID, d2.NewReleaseID, "failed"), IsNil)
+
+	list, err := s.c.DeploymentListWithFilter(&ct.DeploymentFilter{AppID: app.ID, Status: ct.DeploymentStatusFailed})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, d2.ID)
+
+	// failed deployments of all apps are listed without an app filter
+	list, err = s.c.DeploymentListWithFilter(&ct.DeploymentFilter{Status: ct.DeploymentStatusFailed})
+	c.Assert(err, IsNil)
+	var found bool
+	for _, d := range list {
+		c.Assert(d.Status, Equals, ct.DeploymentStatusFailed)
+		if d.ID == d2.ID {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	since := d1.CreatedAt.Add(time.Hour)
+	list, err = s.c.DeploymentListWithFilter(&ct.DeploymentFilter{AppID: app.ID, Since: &since})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+	until := d1.CreatedAt.Add(time.Hour)
+	list, err = s.c.DeploymentListWithFilter(&ct.DeploymentFilter{AppID: app.ID, Until: &until, Limit: 1})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, d2.ID)
+
+	_, err = s.c.DeploymentListWithFilter(&ct.DeploymentFilter{Status: "bogus"})
+	c.Assert(err.(hh.JSONError).Code, Equals, hh.ValidationError)
+
+	// app scoped tokens only see their own app's deployments
+	other := s.createTestApp(c, &ct.App{Name: "filter-deployments-other"})
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "filter-deployments", Scope: ct.AuthTokenScopeApp, AppID: other.ID})
+	client, err := controller.NewClient(s.srv.URL, token.Token)
+	c.Assert(err, IsNil)
+	list, err = client.DeploymentListWithFilter(&ct.DeploymentFilter{})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+	c.Assert(s.authTokenStatus(c, token, "GET", "/deployments?app="+app.ID), Equals, 403)
+}
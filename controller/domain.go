@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// domainVerificationPrefix is prepended to a domain to get the name of the TXT
+// record which proves ownership of it.
+const domainVerificationPrefix = "_flynn-verification."
+
+// domainVerifier checks that the owner of a custom domain intends to route it
+// to an app before the route is created, so in clusters shared by several
+// teams one team can't claim another's domain.
+//
+// A domain is verified if either it has a TXT record at
+// _flynn-verification.<domain> containing the app's verification token, or
+// it is a CNAME for a domain already routed to the app. The only domain under
+// the cluster's default route domain which can be routed is the app's own
+// default route domain, which doesn't need verifying.
+type domainVerifier struct {
+	// key is the secret which verification tokens are derived from.
+	key string
+	// defaultDomain returns the cluster's current default route domain.
+	defaultDomain func() string
+
+	lookupTXT   func(string) ([]string, error)
+	lookupCNAME func(string) (string, error)
+}
+
+func newDomainVerifier(key string, defaultDomain func() string) *domainVerifier {
+	return &domainVerifier{
+		key:           key,
+		defaultDomain: defaultDomain,
+		lookupTXT:     net.LookupTXT,
+		lookupCNAME:   net.LookupCNAME,
+	}
+}
+
+// Token returns the value of the TXT record which verifies domain for the app.
+func (v *domainVerifier) Token(appID, domain string) string {
+	mac := hmac.New(sha256.New, []byte(v.key))
+	mac.Write([]byte(appID + ":" + normalizeDomain(domain)))
+	return "flynn-verification=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns a validation error if domain is not verified for the app,
+// appDefaultDomain is the app's default route domain and appDomains are the
+// domains already routed to it.
+func (v *domainVerifier) Verify(appID, appDefaultDomain, domain string, appDomains []string) error {
+	wildcard := strings.HasPrefix(domain, "*.")
+	domain = normalizeDomain(domain)
+	if d := v.defaultDomain(); d != "" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+		// the other names under the default domain are the default
+		// route domains of other apps, including apps which don't
+		// exist yet
+		if !wildcard && appDefaultDomain != "" && domain == normalizeDomain(appDefaultDomain) {
+			return nil
+		}
+		return ct.ValidationError{
+			Field:   "domain",
+			Message: fmt.Sprintf("must not be under the default route domain %s, other than the app's own default domain", d),
+		}
+	}
+
+	token := v.Token(appID, domain)
+	if records, err := v.lookupTXT(domainVerificationPrefix + domain); err == nil {
+		for _, r := range records {
+			if r == token {
+				return nil
+			}
+		}
+	}
+	if cname, err := v.lookupCNAME(domain); err == nil {
+		cname = normalizeDomain(cname)
+		for _, d := range appDomains {
+			if cname != domain && cname == normalizeDomain(d) {
+				return nil
+			}
+		}
+	}
+	return ct.ValidationError{
+		Field:   "domain",
+		Message: fmt.Sprintf("is not verified, create a TXT record for %s%s containing %q or a CNAME to a domain already routed to the app", domainVerificationPrefix, domain, token),
+	}
+}
+
+// normalizeDomain lowercases domain and strips wildcard labels and the trailing
+// dot of fully qualified names.
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return strings.TrimPrefix(domain, "*.")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+type EventRepo struct {
+	db       *postgres.DB
+	notifier *notifier
+}
+
+func NewEventRepo(db *postgres.DB, notifier *notifier) *EventRepo {
+	return &EventRepo{db: db, notifier: notifier}
+}
+
+// eventObjectTypes are the types of object events are created for.
+var eventObjectTypes = map[string]struct{}{
+	"app":              {},
+	"release":          {},
+	"release_deletion": {},
+	"formation":        {},
+	"deployment":       {},
+	"job":              {},
+}
+
+// eventFilter restricts an event stream to events matching any of the values
+// of each of its non-empty fields.
+type eventFilter struct {
+	AppIDs      []string
+	ObjectTypes []string
+	Kinds       []string
+}
+
+func parseEventFilter(req *http.Request) (*eventFilter, error) {
+	q := req.URL.Query()
+	f := &eventFilter{
+		AppIDs:      splitQueryValues(q["app_id"]),
+		ObjectTypes: splitQueryValues(q["object_type"]),
+		Kinds:       splitQueryValues(q["kind"]),
+	}
+	for _, id := range f.AppIDs {
+		if !idPattern.MatchString(id) {
+			return nil, ct.ValidationError{Field: "app_id", Message: fmt.Sprintf("contains invalid ID %q", id)}
+		}
+	}
+	for _, typ := range f.ObjectTypes {
+		if _, ok := eventObjectTypes[typ]; !ok {
+			return nil, ct.ValidationError{Field: "object_type", Message: fmt.Sprintf("contains unknown object type %q", typ)}
+		}
+	}
+	for _, kind := range f.Kinds {
+		switch kind {
+		case ct.EventKindCreate, ct.EventKindUpdate, ct.EventKindDelete:
+		default:
+			return nil, ct.ValidationError{Field: "kind", Message: fmt.Sprintf("contains unknown kind %q", kind)}
+		}
+	}
+	return f, nil
+}
+
+// splitQueryValues splits comma separated query values, so that lists can be
+// given either as repeated parameters or in a single one.
+func splitQueryValues(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// arrayParam returns values as a postgres array literal, or nil if there are
+// none so that the filter matches everything. The values have been validated
+// by parseEventFilter, so don't need quoting.
+func arrayParam(values []string) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return "{" + strings.Join(values, ",") + "}"
+}
+
+// listEvents returns the events after sinceID which match filter. The filters
+// are passed as arrays so that the query is the same for every filter.
+func (r *EventRepo) listEvents(sinceID int64, filter *eventFilter) ([]*ct.Event, error) {
+	rows, err := r.db.Query("SELECT event_id, app_id, object_type, object_id, kind, created_at FROM events WHERE event_id > $1 AND ($2::uuid[] IS NULL OR app_id = ANY($2::uuid[])) AND ($3::text[] IS NULL OR object_type = ANY($3::text[])) AND ($4::text[] IS NULL OR kind = ANY($4::text[])) ORDER BY event_id",
+		sinceID, arrayParam(filter.AppIDs), arrayParam(filter.ObjectTypes), arrayParam(filter.Kinds))
+	if err != nil {
+		return nil, err
+	}
+	var events []*ct.Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func scanEvent(s postgres.Scanner) (*ct.Event, error) {
+	event := &ct.Event{}
+	var appID, kind *string
+	err := s.Scan(&event.ID, &appID, &event.ObjectType, &event.ObjectID, &kind, &event.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if appID != nil {
+		event.AppID = postgres.CleanUUID(*appID)
+	}
+	if kind != nil {
+		event.Kind = *kind
+	}
+	return event, nil
+}
+
+// StreamEvents streams events as they are created. If the since_id parameter
+// or the Last-Event-Id header is set, events after that ID are sent first so
+// that consumers can resume the stream without missing events. The app_id,
+// object_type and kind parameters restrict the stream to matching events.
+func (c *controllerAPI) StreamEvents(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var sinceID int64
+	if s := req.FormValue("since_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			respondWithError(w, ct.ValidationError{Field: "since_id", Message: "is invalid"})
+			return
+		}
+		sinceID = id
+	} else if s := req.Header.Get("Last-Event-Id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			respondWithError(w, ct.ValidationError{Field: "Last-Event-Id", Message: "is invalid"})
+			return
+		}
+		sinceID = id
+	}
+	filter, err := parseEventFilter(req)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := streamEvents(ctx, sinceID, filter, w, c.eventRepo); err != nil {
+		respondWithError(w, err)
+	}
+}
+
+func streamEvents(ctx context.Context, sinceID int64, filter *eventFilter, w http.ResponseWriter, repo *EventRepo) (err error) {
+	ch := make(chan *ct.Event)
+	l, _ := ctxhelper.LoggerFromContext(ctx)
+	s := sse.NewStream(w, ch, l)
+	s.Serve()
+
+	notifications := make(chan *pq.Notification, notificationBufferSize)
+	if err := repo.notifier.Subscribe("events", notifications); err != nil {
+		return err
+	}
+	defer repo.notifier.Unsubscribe("events", notifications)
+
+	currID := sinceID
+	if sinceID > 0 {
+		events, err := repo.listEvents(sinceID, filter)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			ch <- e
+			currID = e.ID
+		}
+	}
+
+	for {
+		select {
+		case <-s.Done:
+			return
+		case n, ok := <-notifications:
+			if !ok {
+				// notifications may have been missed, so end the stream
+				// and let the client resume using Last-Event-Id
+				return
+			}
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				return err
+			}
+			if id <= currID {
+				continue
+			}
+			if currID == 0 {
+				// only events from the first notification on are sent
+				currID = id - 1
+			}
+			events, err := repo.listEvents(currID, filter)
+			if err != nil {
+				return err
+			}
+			for _, e := range events {
+				ch <- e
+			}
+			// events up to the notified one have been sent, even if
+			// they don't match the filter
+			currID = id
+			if len(events) > 0 && events[len(events)-1].ID > currID {
+				currID = events[len(events)-1].ID
+			}
+		}
+	}
+}
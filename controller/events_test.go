@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestStreamEvents(c *C) {
+	events := make(chan *ct.Event)
+	stream, err := s.c.StreamEvents(0, events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	waitForEvent := func(events chan *ct.Event, objectType, objectID string) *ct.Event {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					c.Fatal("event stream closed unexpectedly")
+				}
+				if e.ObjectType == objectType && e.ObjectID == objectID {
+					return e
+				}
+			case <-timeout:
+				c.Fatalf("timed out waiting for %s %s event", objectType, objectID)
+			}
+		}
+	}
+
+	app := s.createTestApp(c, &ct.App{Name: "stream-events"})
+	appEvent := waitForEvent(events, "app", app.ID)
+	c.Assert(appEvent.AppID, Equals, app.ID)
+
+	release := s.createTestRelease(c, &ct.Release{})
+	releaseEvent := waitForEvent(events, "release", release.ID)
+	c.Assert(releaseEvent.ID > appEvent.ID, Equals, true)
+
+	// resuming from the app event sends the release event
+	resumed := make(chan *ct.Event)
+	stream2, err := s.c.StreamEvents(appEvent.ID, resumed)
+	c.Assert(err, IsNil)
+	defer stream2.Close()
+	e := waitForEvent(resumed, "release", release.ID)
+	c.Assert(e.ID, Equals, releaseEvent.ID)
+}
+
+func (s *S) TestStreamEventsFilter(c *C) {
+	app1 := s.createTestApp(c, &ct.App{Name: "stream-events-filter1"})
+	app2 := s.createTestApp(c, &ct.App{Name: "stream-events-filter2"})
+
+	events := make(chan *ct.Event)
+	stream, err := s.c.StreamEventsWithOptions(&ct.StreamEventsOptions{
+		AppIDs:      []string{app2.ID},
+		ObjectTypes: []string{"app"},
+		Kinds:       []string{ct.EventKindUpdate},
+	}, events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	// only the update of the second app matches
+	foo := "bar"
+	_, err = s.c.UpdateAppMeta(app1.ID, map[string]*string{"foo": &foo})
+	c.Assert(err, IsNil)
+	_, err = s.c.UpdateAppMeta(app2.ID, map[string]*string{"foo": &foo})
+	c.Assert(err, IsNil)
+	select {
+	case e, ok := <-events:
+		c.Assert(ok, Equals, true)
+		c.Assert(e.AppID, Equals, app2.ID)
+		c.Assert(e.ObjectType, Equals, "app")
+		c.Assert(e.Kind, Equals, ct.EventKindUpdate)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for app event")
+	}
+
+	// invalid filters are rejected
+	_, err = s.c.StreamEventsWithOptions(&ct.StreamEventsOptions{Kinds: []string{"upsert"}}, make(chan *ct.Event))
+	c.Assert(err, NotNil)
+	_, err = s.c.StreamEventsWithOptions(&ct.StreamEventsOptions{ObjectTypes: []string{"route"}}, make(chan *ct.Event))
+	c.Assert(err, NotNil)
+
+	// resuming a filtered stream only sends the matching past events
+	resumed := make(chan *ct.Event)
+	stream2, err := s.c.StreamEventsWithOptions(&ct.StreamEventsOptions{
+		SinceID:     1,
+		AppIDs:      []string{app1.ID},
+		ObjectTypes: []string{"app"},
+		Kinds:       []string{ct.EventKindUpdate},
+	}, resumed)
+	c.Assert(err, IsNil)
+	defer stream2.Close()
+	select {
+	case e, ok := <-resumed:
+		c.Assert(ok, Equals, true)
+		c.Assert(e.AppID, Equals, app1.ID)
+		c.Assert(e.Kind, Equals, ct.EventKindUpdate)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for app event")
+	}
+}
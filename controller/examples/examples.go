@@ -216,7 +216,7 @@ func (e *generator) listAppResources() {
 func (e *generator) createRoute() {
 	route := (&router.HTTPRoute{
 		Domain:  "http://example.com",
-		Service: e.resourceIds["app-name"] + "-web",
+		Service: ct.AppWebService(e.resourceIds["app"]),
 	}).ToRoute()
 	err := e.client.CreateRoute(e.resourceIds["app"], route)
 	if err == nil {
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/secrets"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/router/types"
+)
+
+// clusterExportVersion is the version of the export format produced by
+// ExportCluster, imports of other versions are rejected.
+const clusterExportVersion = 1
+
+func (c *controllerAPI) ExportCluster(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	export, err := c.exportCluster()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, export)
+}
+
+func (c *controllerAPI) exportCluster() (*ct.ClusterExport, error) {
+	export := &ct.ClusterExport{
+		Version:     clusterExportVersion,
+		AppReleases: make(map[string]string),
+		Formations:  []*ct.Formation{},
+		Resources:   []*ct.Resource{},
+		Routes:      []*router.Route{},
+	}
+	opts := &ListOptions{}
+
+	namespaces, _, err := c.namespaceRepo.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	export.Namespaces = namespaces.([]*ct.Namespace)
+
+	apps, _, err := c.appRepo.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	export.Apps = apps.([]*ct.App)
+
+	releases, _, err := c.releaseRepo.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	export.Releases = releases.([]*ct.Release)
+
+	artifacts, _, err := c.artifactRepo.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	export.Artifacts = artifacts.([]*ct.Artifact)
+
+	providers, _, err := c.providerRepo.List(opts)
+	if err != nil {
+		return nil, err
+	}
+	export.Providers = providers.([]*ct.Provider)
+
+	for _, app := range export.Apps {
+		release, err := c.appRepo.GetRelease(app.ID)
+		if err == nil {
+			export.AppReleases[app.ID] = release.ID
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+
+		formations, err := c.formationRepo.List(app.ID)
+		if err != nil {
+			return nil, err
+		}
+		export.Formations = append(export.Formations, formations...)
+
+		routes, err := c.routerc.ListRoutes(routeParentRef(app.ID))
+		if err != nil {
+			return nil, err
+		}
+		export.Routes = append(export.Routes, routes...)
+	}
+
+	for _, provider := range export.Providers {
+		resources, err := c.resourceRepo.ProviderList(provider.ID)
+		if err != nil {
+			return nil, err
+		}
+		export.Resources = append(export.Resources, resources...)
+	}
+
+	// resource env and route TLS keys are credentials, so they are sealed
+	// with the secrets key, or left out if secrets are disabled
+	for _, resource := range export.Resources {
+		if c.secretsKey == nil {
+			resource.Env = nil
+			continue
+		}
+		context := secrets.ExportContext("resource", resource.ID)
+		for k, v := range resource.Env {
+			resource.Env[k] = c.secretsKey.Seal(context, v)
+		}
+	}
+	for _, route := range export.Routes {
+		if route.TLSKey == "" {
+			continue
+		}
+		if c.secretsKey == nil {
+			route.TLSKey = ""
+			continue
+		}
+		route.TLSKey = c.secretsKey.Seal(secrets.ExportContext("route", route.ID), route.TLSKey)
+	}
+
+	return export, nil
+}
+
+// ImportCluster restores the objects in a cluster export. Objects which
+// already exist are skipped, so an export can be imported into a new cluster
+// which already runs the system apps, and the response contains only the
+// objects which were created. If the import fails, the apps and resources
+// which were created are removed again, and an import of the same export
+// restores them.
+func (c *controllerAPI) ImportCluster(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var export ct.ClusterExport
+	if err := httphelper.DecodeJSON(req, &export); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if export.Version != clusterExportVersion {
+		respondWithError(w, ct.ValidationError{Field: "version", Message: fmt.Sprintf("must be %d", clusterExportVersion)})
+		return
+	}
+	if err := validateClusterExport(&export); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.openClusterExportSecrets(&export); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	imported, err := c.importCluster(&export)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, imported)
+}
+
+// validateClusterExport checks the IDs in export and the references between
+// its objects, so that an import doesn't fail part way through because of
+// an inconsistent export.
+func validateClusterExport(export *ct.ClusterExport) error {
+	check := func(field, id string, ids map[string]struct{}) error {
+		if !idPattern.MatchString(id) {
+			return ct.ValidationError{Field: field, Message: fmt.Sprintf("contains invalid ID %q", id)}
+		}
+		ids[id] = struct{}{}
+		return nil
+	}
+	namespaces := make(map[string]struct{}, len(export.Namespaces))
+	for _, ns := range export.Namespaces {
+		if err := check("namespaces", ns.ID, namespaces); err != nil {
+			return err
+		}
+	}
+	apps := make(map[string]struct{}, len(export.Apps))
+	for _, app := range export.Apps {
+		if err := check("apps", app.ID, apps); err != nil {
+			return err
+		}
+		if _, ok := namespaces[app.NamespaceID]; app.NamespaceID != "" && !ok {
+			return ct.ValidationError{Field: "apps", Message: fmt.Sprintf("app %s has unknown namespace %s", app.ID, app.NamespaceID)}
+		}
+	}
+	artifacts := make(map[string]struct{}, len(export.Artifacts))
+	for _, artifact := range export.Artifacts {
+		if err := check("artifacts", artifact.ID, artifacts); err != nil {
+			return err
+		}
+	}
+	releases := make(map[string]struct{}, len(export.Releases))
+	for _, release := range export.Releases {
+		if err := check("releases", release.ID, releases); err != nil {
+			return err
+		}
+		if _, ok := artifacts[release.ArtifactID]; release.ArtifactID != "" && !ok {
+			return ct.ValidationError{Field: "releases", Message: fmt.Sprintf("release %s has unknown artifact %s", release.ID, release.ArtifactID)}
+		}
+	}
+	for appID, releaseID := range export.AppReleases {
+		if _, ok := releases[releaseID]; !ok {
+			return ct.ValidationError{Field: "app_releases", Message: fmt.Sprintf("app %s has unknown release %s", appID, releaseID)}
+		}
+	}
+	for _, formation := range export.Formations {
+		if _, ok := releases[formation.ReleaseID]; !ok {
+			return ct.ValidationError{Field: "formations", Message: fmt.Sprintf("formation of app %s has unknown release %s", formation.AppID, formation.ReleaseID)}
+		}
+	}
+	providers := make(map[string]struct{}, len(export.Providers))
+	for _, provider := range export.Providers {
+		if err := check("providers", provider.ID, providers); err != nil {
+			return err
+		}
+	}
+	resources := make(map[string]struct{}, len(export.Resources))
+	for _, resource := range export.Resources {
+		if err := check("resources", resource.ID, resources); err != nil {
+			return err
+		}
+		if _, ok := providers[resource.ProviderID]; !ok {
+			return ct.ValidationError{Field: "resources", Message: fmt.Sprintf("resource %s has unknown provider %s", resource.ID, resource.ProviderID)}
+		}
+	}
+	return nil
+}
+
+// openClusterExportSecrets opens the resource env and route TLS keys which
+// were sealed by exportCluster, which requires this cluster to have the
+// secrets key of the exporting cluster.
+func (c *controllerAPI) openClusterExportSecrets(export *ct.ClusterExport) error {
+	for _, resource := range export.Resources {
+		if err := secrets.OpenEnv(c.secretsKey, secrets.ExportContext("resource", resource.ID), resource.Env); err != nil {
+			return ct.ValidationError{Field: "resources", Message: fmt.Sprintf("resource %s has env which can't be opened with the secrets key of this cluster", resource.ID)}
+		}
+	}
+	for _, route := range export.Routes {
+		key, err := secrets.OpenValue(c.secretsKey, secrets.ExportContext("route", route.ID), route.TLSKey)
+		if err != nil {
+			return ct.ValidationError{Field: "routes", Message: fmt.Sprintf("route %s has a TLS key which can't be opened with the secrets key of this cluster", route.ID)}
+		}
+		route.TLSKey = key
+	}
+	return nil
+}
+
+func (c *controllerAPI) importCluster(export *ct.ClusterExport) (*ct.ClusterExport, error) {
+	// undo reverts the changes made so far, in reverse order
+	var undo []func() error
+	imported, err := c.applyClusterImport(export, &undo)
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				log.Printf("Error reverting cluster import: %s", err)
+			}
+		}
+		return nil, err
+	}
+	return imported, nil
+}
+
+// applyClusterImport creates the objects in export which don't exist, adding
+// functions which remove the apps and resources it creates to undo.
+// Namespaces, providers, artifacts and releases are left in place when an
+// import fails, as they are unused without the apps and another import of
+// the export reuses them.
+func (c *controllerAPI) applyClusterImport(export *ct.ClusterExport, undo *[]func() error) (*ct.ClusterExport, error) {
+	imported := &ct.ClusterExport{
+		Version:     clusterExportVersion,
+		Namespaces:  []*ct.Namespace{},
+		Apps:        []*ct.App{},
+		AppReleases: make(map[string]string),
+		Releases:    []*ct.Release{},
+		Artifacts:   []*ct.Artifact{},
+		Formations:  []*ct.Formation{},
+		Providers:   []*ct.Provider{},
+		Resources:   []*ct.Resource{},
+		Routes:      []*router.Route{},
+	}
+
+	// objects may already exist with a different ID (e.g. the system apps
+	// of the new cluster), so references to them are mapped to the IDs in
+	// this cluster
+	namespaceIDs := make(map[string]string, len(export.Namespaces))
+	for _, ns := range export.Namespaces {
+		data, err := c.namespaceRepo.Get(ns.Name)
+		if err == nil {
+			namespaceIDs[ns.ID] = data.(*ct.Namespace).ID
+			continue
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+		if err := c.namespaceRepo.Add(ns); err != nil {
+			return nil, err
+		}
+		namespaceIDs[ns.ID] = ns.ID
+		imported.Namespaces = append(imported.Namespaces, ns)
+	}
+
+	providerIDs := make(map[string]string, len(export.Providers))
+	for _, provider := range export.Providers {
+		data, err := c.providerRepo.Get(provider.Name)
+		if err == nil {
+			providerIDs[provider.ID] = data.(*ct.Provider).ID
+			continue
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+		if err := c.providerRepo.Add(provider); err != nil {
+			return nil, err
+		}
+		providerIDs[provider.ID] = provider.ID
+		imported.Providers = append(imported.Providers, provider)
+	}
+
+	artifactIDs := make(map[string]string, len(export.Artifacts))
+	for _, artifact := range export.Artifacts {
+		exists, err := rowExists(c.appRepo.db, "artifacts", "artifact_id", artifact.ID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			artifactIDs[artifact.ID] = artifact.ID
+			continue
+		}
+		id := artifact.ID
+		// passwords aren't exported, so the artifact is pulled with
+		// the credentials of its registry
+		if c := artifact.Credentials; c != nil && c.Password == "" {
+			artifact.Credentials = nil
+		}
+		// artifacts are unique by URI and digest, so Add may return an
+		// existing one
+		if err := c.artifactRepo.Add(artifact); err != nil {
+			return nil, err
+		}
+		artifactIDs[id] = artifact.ID
+		if artifact.ID == id {
+			imported.Artifacts = append(imported.Artifacts, artifact)
+		}
+	}
+
+	for _, release := range export.Releases {
+		exists, err := rowExists(c.appRepo.db, "releases", "release_id", release.ID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		if release.ArtifactID != "" {
+			release.ArtifactID = artifactIDs[release.ArtifactID]
+		}
+		if err := c.releaseRepo.Add(release); err != nil {
+			return nil, err
+		}
+		imported.Releases = append(imported.Releases, release)
+	}
+
+	appIDs := make(map[string]string, len(export.Apps))
+	newApps := make(map[string]struct{}, len(export.Apps))
+	for _, app := range export.Apps {
+		if app.NamespaceID != "" {
+			app.NamespaceID = namespaceIDs[app.NamespaceID]
+		}
+		existing, err := c.appRepo.Lookup(app.Name, app.NamespaceID)
+		if err == nil {
+			appIDs[app.ID] = existing.ID
+			continue
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+		// the app may have been deleted, e.g. by an import which
+		// failed, in which case it is restored
+		exists, restored, err := restoreRow(c.appRepo.db, "apps", "app_id", app.ID)
+		if err != nil {
+			return nil, err
+		}
+		if exists && !restored {
+			// the app exists with another name
+			appIDs[app.ID] = app.ID
+			continue
+		}
+		if !restored {
+			if err := c.appRepo.Add(app); err != nil {
+				return nil, err
+			}
+		}
+		id := app.ID
+		*undo = append(*undo, func() error {
+			if err := c.appRepo.Remove(id); err != nil {
+				return err
+			}
+			return c.deleteAppRoutes(id)
+		})
+		// the exported routes replace the default route
+		if err := c.deleteAppRoutes(app.ID); err != nil {
+			return nil, err
+		}
+		appIDs[app.ID] = app.ID
+		newApps[app.ID] = struct{}{}
+		imported.Apps = append(imported.Apps, app)
+
+		if releaseID, ok := export.AppReleases[app.ID]; ok {
+			if err := c.appRepo.SetRelease(app.ID, releaseID); err != nil {
+				return nil, err
+			}
+			imported.AppReleases[app.ID] = releaseID
+		}
+	}
+
+	for _, resource := range export.Resources {
+		apps := make([]string, 0, len(resource.Apps))
+		for _, id := range resource.Apps {
+			if appID, ok := appIDs[id]; ok {
+				apps = append(apps, appID)
+			}
+		}
+		exists, restored, err := restoreRow(c.appRepo.db, "resources", "resource_id", resource.ID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			// bindings to the apps created by this import are added,
+			// as removing an app removes its bindings
+			for _, appID := range apps {
+				if _, ok := newApps[appID]; !ok && !restored {
+					continue
+				}
+				if err := c.resourceRepo.AddApp(resource.ID, appID); err != nil {
+					return nil, err
+				}
+			}
+			if !restored {
+				continue
+			}
+		} else {
+			resource.ProviderID = providerIDs[resource.ProviderID]
+			resource.Apps = apps
+			if err := c.resourceRepo.Add(resource); err != nil {
+				return nil, err
+			}
+		}
+		id := resource.ID
+		*undo = append(*undo, func() error {
+			return c.resourceRepo.Remove(id)
+		})
+		imported.Resources = append(imported.Resources, resource)
+	}
+
+	// routes are created before formations, as jobs are started as soon as
+	// the formations are added
+	for _, route := range export.Routes {
+		appID := strings.TrimPrefix(route.ParentRef, routeParentRef(""))
+		if _, ok := newApps[appID]; !ok {
+			continue
+		}
+		route.ID = ""
+		if err := c.createRoute(route); err != nil {
+			return nil, err
+		}
+		imported.Routes = append(imported.Routes, route)
+	}
+
+	for _, formation := range export.Formations {
+		if _, ok := newApps[formation.AppID]; !ok {
+			continue
+		}
+		if err := c.formationRepo.Add(formation, "cluster import"); err != nil {
+			return nil, err
+		}
+		imported.Formations = append(imported.Formations, formation)
+	}
+
+	return imported, nil
+}
+
+func (c *controllerAPI) deleteAppRoutes(appID string) error {
+	routes, err := c.routerc.ListRoutes(routeParentRef(appID))
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := c.routerc.DeleteRoute(route.Type, route.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowExists reports whether table has a row with the given ID, including
+// deleted rows.
+func rowExists(db *postgres.DB, table, idColumn, id string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s = $1)", table, idColumn), id).Scan(&exists)
+	return exists, err
+}
+
+// restoreRow clears the deleted_at column of the row of table with the given
+// ID if it is set, reporting whether the row exists and whether it was
+// restored.
+func restoreRow(db *postgres.DB, table, idColumn, id string) (exists, restored bool, err error) {
+	err = db.QueryRow(fmt.Sprintf("UPDATE %s SET deleted_at = NULL WHERE %s = $1 AND deleted_at IS NOT NULL RETURNING true", table, idColumn), id).Scan(&restored)
+	if err == sql.ErrNoRows {
+		exists, err = rowExists(db, table, idColumn, id)
+		return exists, false, err
+	}
+	return restored, restored, err
+}
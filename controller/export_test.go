@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/secrets"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+)
+
+func (s *S) TestExportCluster(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "export-cluster"})
+	release := s.createTestRelease(c, &ct.Release{})
+	formation := s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "export-cluster"}).ToRoute())
+	resource, _ := s.provisionTestResource(c, "export-cluster", []string{app.ID})
+
+	export, err := s.c.ExportCluster()
+	c.Assert(err, IsNil)
+	c.Assert(export.Version, Equals, 1)
+	c.Assert(export.AppReleases[app.ID], Equals, release.ID)
+
+	var foundApp, foundRelease, foundArtifact, foundFormation, foundRoute bool
+	for _, a := range export.Apps {
+		foundApp = foundApp || a.ID == app.ID
+	}
+	for _, r := range export.Releases {
+		foundRelease = foundRelease || r.ID == release.ID
+	}
+	for _, a := range export.Artifacts {
+		foundArtifact = foundArtifact || a.ID == release.ArtifactID
+	}
+	for _, f := range export.Formations {
+		if f.AppID == formation.AppID && f.ReleaseID == formation.ReleaseID {
+			foundFormation = true
+			c.Assert(f.Processes, DeepEquals, formation.Processes)
+		}
+	}
+	for _, r := range export.Routes {
+		foundRoute = foundRoute || r.ID == route.ID
+	}
+	c.Assert(foundApp, Equals, true)
+	c.Assert(foundRelease, Equals, true)
+	c.Assert(foundArtifact, Equals, true)
+	c.Assert(foundFormation, Equals, true)
+	c.Assert(foundRoute, Equals, true)
+
+	// resource env is sealed
+	var foundResource bool
+	for _, r := range export.Resources {
+		if r.ID != resource.ID {
+			continue
+		}
+		foundResource = true
+		c.Assert(secrets.IsSealed(r.Env["foo"]), Equals, true)
+		value, err := secretsKey.Open(secrets.ExportContext("resource", r.ID), r.Env["foo"])
+		c.Assert(err, IsNil)
+		c.Assert(value, Equals, "baz")
+	}
+	c.Assert(foundResource, Equals, true)
+}
+
+func (s *S) TestImportCluster(c *C) {
+	artifact := &ct.Artifact{
+		ID:   postgres.CleanUUID(random.UUID()),
+		Type: "docker",
+		URI:  fmt.Sprintf("https://example.com/%s", random.String(8)),
+	}
+	release := &ct.Release{ID: postgres.CleanUUID(random.UUID()), ArtifactID: artifact.ID, Env: map[string]string{"FOO": "bar"}}
+	app := &ct.App{ID: postgres.CleanUUID(random.UUID()), Name: "import-cluster"}
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}}
+	route := (&router.HTTPRoute{Domain: "import-cluster.example.com", Service: "import-cluster-web"}).ToRoute()
+	route.ParentRef = routeParentRef(app.ID)
+	export := &ct.ClusterExport{
+		Version:     1,
+		Apps:        []*ct.App{app},
+		AppReleases: map[string]string{app.ID: release.ID},
+		Releases:    []*ct.Release{release},
+		Artifacts:   []*ct.Artifact{artifact},
+		Formations:  []*ct.Formation{formation},
+		Routes:      []*router.Route{route},
+	}
+
+	imported, err := s.c.ImportCluster(export)
+	c.Assert(err, IsNil)
+	c.Assert(imported.Apps, HasLen, 1)
+	c.Assert(imported.Releases, HasLen, 1)
+	c.Assert(imported.Artifacts, HasLen, 1)
+	c.Assert(imported.Formations, HasLen, 1)
+	c.Assert(imported.Routes, HasLen, 1)
+
+	gotApp, err := s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Name, Equals, app.Name)
+	gotRelease, err := s.c.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.ID, Equals, release.ID)
+	c.Assert(gotRelease.ArtifactID, Equals, artifact.ID)
+	c.Assert(gotRelease.Env, DeepEquals, release.Env)
+	gotFormation, err := s.c.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotFormation.Processes, DeepEquals, formation.Processes)
+	routes, err := s.c.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Domain, Equals, "import-cluster.example.com")
+
+	// objects which already exist are skipped
+	imported, err = s.c.ImportCluster(export)
+	c.Assert(err, IsNil)
+	c.Assert(imported.Apps, HasLen, 0)
+	c.Assert(imported.Releases, HasLen, 0)
+	c.Assert(imported.Routes, HasLen, 0)
+
+	// unknown export versions are rejected
+	_, err = s.c.ImportCluster(&ct.ClusterExport{Version: 2})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestImportClusterUndo(c *C) {
+	existing, provider := s.provisionTestResource(c, "import-cluster-undo", nil)
+	app := &ct.App{ID: postgres.CleanUUID(random.UUID()), Name: "import-cluster-undo"}
+	resource := &ct.Resource{
+		ID:         postgres.CleanUUID(random.UUID()),
+		ProviderID: provider.ID,
+		ExternalID: "/things/import-cluster-undo-2",
+		Apps:       []string{app.ID},
+	}
+	resource.Env = map[string]string{"FOO": secretsKey.Seal(secrets.ExportContext("resource", resource.ID), "bar")}
+	// the external ID of the existing resource fails to insert
+	conflict := &ct.Resource{
+		ID:         postgres.CleanUUID(random.UUID()),
+		ProviderID: provider.ID,
+		ExternalID: existing.ExternalID,
+	}
+	export := &ct.ClusterExport{
+		Version:   1,
+		Apps:      []*ct.App{app},
+		Providers: []*ct.Provider{provider},
+		Resources: []*ct.Resource{resource, conflict},
+	}
+
+	// the created app and resource are removed when the import fails
+	_, err := s.c.ImportCluster(export)
+	c.Assert(err, NotNil)
+	_, err = s.c.GetApp(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = s.c.GetResource(provider.ID, resource.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// importing the export without the conflict restores them
+	export.Resources = []*ct.Resource{resource}
+	imported, err := s.c.ImportCluster(export)
+	c.Assert(err, IsNil)
+	c.Assert(imported.Apps, HasLen, 1)
+	c.Assert(imported.Resources, HasLen, 1)
+	gotResource, err := s.c.GetResource(provider.ID, resource.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotResource.Env, DeepEquals, map[string]string{"FOO": "bar"})
+	c.Assert(gotResource.Apps, DeepEquals, []string{app.ID})
+
+	// env sealed with another key is rejected
+	resource.ID = postgres.CleanUUID(random.UUID())
+	_, err = s.c.ImportCluster(export)
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestImportApps(c *C) {
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	def := &ct.AppDefinition{
+		Name:       "import-apps",
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"FOO": "bar"},
+		Processes:  map[string]ct.ProcessType{"web": {Cmd: []string{"start", "web"}}},
+		Formation:  map[string]int{"web": 2},
+		Routes:     []*router.Route{(&router.HTTPRoute{Domain: "import-apps.example.com", Service: "import-apps-web"}).ToRoute()},
+	}
+	invalid := &ct.AppDefinition{
+		Name:       "import-apps-invalid",
+		ArtifactID: artifact.ID,
+		Processes:  map[string]ct.ProcessType{"web": {}},
+		Formation:  map[string]int{"worker": 1},
+	}
+
+	results, err := s.c.ImportApps([]*ct.AppDefinition{def, invalid})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	result := results[0]
+	c.Assert(result.Error, Equals, "")
+	c.Assert(result.Created, Equals, true)
+	c.Assert(result.ReleaseCreated, Equals, true)
+	c.Assert(result.Routes, HasLen, 1)
+
+	app, err := s.c.GetApp(def.Name)
+	c.Assert(err, IsNil)
+	c.Assert(app.ID, Equals, result.AppID)
+	release, err := s.c.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(release.ID, Equals, result.ReleaseID)
+	c.Assert(release.Env, DeepEquals, def.Env)
+	formation, err := s.c.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, def.Formation)
+
+	// apps which fail validation are not created
+	c.Assert(results[1].Error, Not(Equals), "")
+	c.Assert(results[1].Created, Equals, false)
+	_, err = s.c.GetApp(invalid.Name)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// importing the same definition again changes nothing
+	results, err = s.c.ImportApps([]*ct.AppDefinition{def})
+	c.Assert(err, IsNil)
+	c.Assert(results[0].Error, Equals, "")
+	c.Assert(results[0].Created, Equals, false)
+	c.Assert(results[0].ReleaseCreated, Equals, false)
+	c.Assert(results[0].ReleaseID, Equals, release.ID)
+	c.Assert(results[0].Routes, HasLen, 0)
+
+	// changing the env creates a new release which is deployed with the
+	// scale of the old one
+	def.Env = map[string]string{"FOO": "baz"}
+	def.Formation = nil
+	results, err = s.c.ImportApps([]*ct.AppDefinition{def})
+	c.Assert(err, IsNil)
+	c.Assert(results[0].Error, Equals, "")
+	c.Assert(results[0].ReleaseCreated, Equals, true)
+	c.Assert(results[0].DeploymentID, Not(Equals), "")
+	deployment, err := s.c.GetDeployment(results[0].DeploymentID)
+	c.Assert(err, IsNil)
+	c.Assert(deployment.OldReleaseID, Equals, release.ID)
+	c.Assert(deployment.NewReleaseID, Equals, results[0].ReleaseID)
+	c.Assert(deployment.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// the release is removed again if the import fails, here as the
+	// deployment is still in progress
+	releases, err := s.c.AppReleaseList(app.ID)
+	c.Assert(err, IsNil)
+	def.Env = map[string]string{"FOO": "qux"}
+	results, err = s.c.ImportApps([]*ct.AppDefinition{def})
+	c.Assert(err, IsNil)
+	c.Assert(results[0].Error, Not(Equals), "")
+	after, err := s.c.AppReleaseList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(after, HasLen, len(releases))
+	_, err = s.c.GetArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+
+	// import is reserved for the import endpoint
+	c.Assert(s.c.CreateApp(&ct.App{Name: "import"}), NotNil)
+}
+
+func (s *S) TestImportAppsNamespaceScope(c *C) {
+	team := &ct.Namespace{Name: "import-apps-team"}
+	c.Assert(s.c.CreateNamespace(team), IsNil)
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "import-apps-team", Scope: ct.AuthTokenScopeNamespace, NamespaceID: team.ID})
+	client, err := controller.NewClient(s.srv.URL, token.Token)
+	c.Assert(err, IsNil)
+	other := s.createTestApp(c, &ct.App{Name: "import-apps-other"})
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	def := &ct.AppDefinition{
+		Name:       "import-apps-team",
+		ArtifactID: artifact.ID,
+		Processes:  map[string]ct.ProcessType{"web": {}},
+	}
+	results, err := client.ImportApps([]*ct.AppDefinition{def})
+	c.Assert(err, IsNil)
+	c.Assert(results[0].Error, Equals, "")
+	app, err := s.c.GetApp(results[0].AppID)
+	c.Assert(err, IsNil)
+	c.Assert(app.NamespaceID, Equals, team.ID)
+
+	// apps of other namespaces are not found, so a new app is created in
+	// the token's namespace
+	def.Name = other.Name
+	results, err = client.ImportApps([]*ct.AppDefinition{def})
+	c.Assert(err, IsNil)
+	c.Assert(results[0].Error, Equals, "")
+	c.Assert(results[0].AppID, Not(Equals), other.ID)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -55,19 +56,203 @@ func procsHstore(m map[string]int) hstore.Hstore {
 
 }
 
-func (r *FormationRepo) Add(f *ct.Formation) error {
+// Add creates or updates the formation, recording the change in the
+// formation history with the given actor.
+func (r *FormationRepo) Add(f *ct.Formation, actor string) error {
 	// TODO: actually validate
-	procs := procsHstore(f.Processes)
-	err := r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
-		f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	err := r.add(f, actor)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
+		// the formation was created concurrently, so update it instead
+		err = r.add(f, actor)
+	}
+	return err
+}
+
+func (r *FormationRepo) add(f *ct.Formation, actor string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := putFormation(tx, f, actor); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type formationTx interface {
+	execer
+	rowQueryer
+}
+
+// putFormation creates or replaces the formation f and records the change in
+// the formation history as part of tx.
+func putFormation(tx formationTx, f *ct.Formation, actor string) error {
+	procs := procsHstore(f.Processes)
+	var oldProcs hstore.Hstore
+	err := tx.QueryRow("SELECT processes FROM formations WHERE app_id = $1 AND release_id = $2 FOR UPDATE", f.AppID, f.ReleaseID).Scan(&oldProcs)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
+			f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	} else if err == nil {
+		err = tx.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
 			f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
 	}
 	if err != nil {
 		return err
 	}
-	return nil
+	return addFormationChange(tx, f.AppID, f.ReleaseID, hstoreProcs(oldProcs), f.Processes, actor)
+}
+
+// Scale changes the number of processes of a single type in the formation,
+// creating the formation if it doesn't exist, so that concurrent changes to
+// other types, or concurrent deltas to the same type, are not lost. check is
+// called with the resulting formation before it is saved, the change is
+// aborted if it returns an error. check may be slow, so it is called before
+// the formation is locked, and the change is made again if the formation was
+// changed in the meantime.
+func (r *FormationRepo) Scale(appID, releaseID, typ string, scale *ct.ProcessScale, check func(*ct.Formation) error, actor string) (*ct.Formation, error) {
+	var f *ct.Formation
+	var err error
+	for i := 0; i < maxScaleAttempts; i++ {
+		f, err = r.scale(appID, releaseID, typ, scale, check, actor)
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			// the formation was created concurrently, so update it
+			// instead
+			continue
+		}
+		if err != errFormationChanged {
+			return f, err
+		}
+	}
+	return nil, httphelper.JSONError{
+		Code:    httphelper.ServiceUnavailableError,
+		Message: "the formation is being changed concurrently, try again",
+	}
+}
+
+// maxScaleAttempts is the number of times Scale makes a change of a formation
+// which is being changed concurrently.
+const maxScaleAttempts = 5
+
+// errFormationChanged is returned by scale if the formation was changed after
+// the change was checked.
+var errFormationChanged = errors.New("controller: formation changed concurrently")
+
+func (r *FormationRepo) scale(appID, releaseID, typ string, scale *ct.ProcessScale, check func(*ct.Formation) error, actor string) (*ct.Formation, error) {
+	old, exists, err := selectFormationProcs(r.db, appID, releaseID, false)
+	if err != nil {
+		return nil, err
+	}
+	f := &ct.Formation{AppID: appID, ReleaseID: releaseID, Processes: make(map[string]int, len(old)+1)}
+	for k, n := range old {
+		f.Processes[k] = n
+	}
+	n := old[typ] + scale.Delta
+	if scale.Count != nil {
+		n = *scale.Count
+	}
+	if n < 0 {
+		n = 0
+	}
+	f.Processes[typ] = n
+	if err := check(f); err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	locked, stillExists, err := selectFormationProcs(tx, appID, releaseID, true)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if stillExists != exists || !procsEqual(locked, old) {
+		tx.Rollback()
+		return nil, errFormationChanged
+	}
+
+	procs := procsHstore(f.Processes)
+	if exists {
+		err = tx.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
+			appID, releaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	} else {
+		err = tx.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
+			appID, releaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := addFormationChange(tx, appID, releaseID, old, f.Processes, actor); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return f, tx.Commit()
+}
+
+// selectFormationProcs returns the process counts of the formation, and
+// whether it exists, locking it if lock is set.
+func selectFormationProcs(q rowQueryer, appID, releaseID string, lock bool) (map[string]int, bool, error) {
+	query := "SELECT processes FROM formations WHERE app_id = $1 AND release_id = $2"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var procs hstore.Hstore
+	err := q.QueryRow(query, appID, releaseID).Scan(&procs)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return hstoreProcs(procs), true, nil
+}
+
+// hstoreProcs returns the process counts in procs, omitting zero counts.
+func hstoreProcs(procs hstore.Hstore) map[string]int {
+	res := make(map[string]int, len(procs.Map))
+	for k, v := range procs.Map {
+		n, _ := strconv.Atoi(v.String)
+		if n > 0 {
+			res[k] = n
+		}
+	}
+	return res
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// addFormationChange records a change of a formation's process counts in the
+// formation history, changes which don't alter any count are not recorded.
+func addFormationChange(tx execer, appID, releaseID string, oldProcs, newProcs map[string]int, actor string) error {
+	if procsEqual(oldProcs, newProcs) {
+		return nil
+	}
+	var actorValue *string
+	if actor != "" {
+		actorValue = &actor
+	}
+	_, err := tx.Exec("INSERT INTO formation_history (app_id, release_id, old_processes, new_processes, actor) VALUES ($1, $2, $3, $4, $5)",
+		appID, releaseID, procsHstore(oldProcs), procsHstore(newProcs), actorValue)
+	return err
+}
+
+func procsEqual(a, b map[string]int) bool {
+	for k, n := range a {
+		if b[k] != n {
+			return false
+		}
+	}
+	for k, n := range b {
+		if a[k] != n {
+			return false
+		}
+	}
+	return true
 }
 
 func scanFormation(s postgres.Scanner) (*ct.Formation, error) {
@@ -80,23 +265,21 @@ func scanFormation(s postgres.Scanner) (*ct.Formation, error) {
 		}
 		return nil, err
 	}
-	f.Processes = make(map[string]int, len(procs.Map))
-	for k, v := range procs.Map {
-		n, _ := strconv.Atoi(v.String)
-		if n > 0 {
-			f.Processes[k] = n
-		}
-	}
+	f.Processes = hstoreProcs(procs)
 	f.AppID = postgres.CleanUUID(f.AppID)
 	f.ReleaseID = postgres.CleanUUID(f.ReleaseID)
 	return f, nil
 }
 
-func (r *FormationRepo) Get(appID, releaseID string) (*ct.Formation, error) {
-	row := r.db.QueryRow("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
+func selectFormation(db rowQueryer, appID, releaseID string) (*ct.Formation, error) {
+	row := db.QueryRow("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
 	return scanFormation(row)
 }
 
+func (r *FormationRepo) Get(appID, releaseID string) (*ct.Formation, error) {
+	return selectFormation(r.db, appID, releaseID)
+}
+
 func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
 	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
 	if err != nil {
@@ -114,12 +297,61 @@ func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
 	return formations, nil
 }
 
-func (r *FormationRepo) Remove(appID, releaseID string) error {
-	err := r.db.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, releaseID)
+// Remove deletes the formation, recording the change in the formation history
+// with the given actor.
+func (r *FormationRepo) Remove(appID, releaseID, actor string) error {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := removeFormation(tx, appID, releaseID, actor); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeFormation deletes the formation and records the change in the
+// formation history as part of tx.
+func removeFormation(tx formationTx, appID, releaseID, actor string) error {
+	var procs hstore.Hstore
+	err := tx.QueryRow("SELECT processes FROM formations WHERE app_id = $1 AND release_id = $2 FOR UPDATE", appID, releaseID).Scan(&procs)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, releaseID); err != nil {
+		return err
+	}
+	return addFormationChange(tx, appID, releaseID, hstoreProcs(procs), nil, actor)
+}
+
+// History returns the changes of the formation, newest first.
+func (r *FormationRepo) History(appID, releaseID string) ([]*ct.FormationChange, error) {
+	rows, err := r.db.Query("SELECT app_id, release_id, old_processes, new_processes, actor, created_at FROM formation_history WHERE app_id = $1 AND release_id = $2 ORDER BY created_at DESC, change_id DESC", appID, releaseID)
+	if err != nil {
+		return nil, err
+	}
+	changes := []*ct.FormationChange{}
+	for rows.Next() {
+		change := &ct.FormationChange{}
+		var oldProcs, newProcs hstore.Hstore
+		var actor *string
+		if err := rows.Scan(&change.AppID, &change.ReleaseID, &oldProcs, &newProcs, &actor, &change.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		change.AppID = postgres.CleanUUID(change.AppID)
+		change.ReleaseID = postgres.CleanUUID(change.ReleaseID)
+		change.OldProcesses = hstoreProcs(oldProcs)
+		change.NewProcesses = hstoreProcs(newProcs)
+		if actor != nil {
+			change.Actor = *actor
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
 }
 
 func (r *FormationRepo) publish(appID, releaseID string) {
@@ -146,6 +378,29 @@ func (r *FormationRepo) publish(appID, releaseID string) {
 	}
 }
 
+func (r *FormationRepo) publishUpdatedSince(since time.Time) {
+	rows, err := r.db.Query("SELECT app_id, release_id FROM formations WHERE updated_at >= $1 ORDER BY updated_at", since)
+	if err != nil {
+		// TODO: log error
+		return
+	}
+	var keys []formationKey
+	for rows.Next() {
+		var key formationKey
+		if err := rows.Scan(&key.AppID, &key.ReleaseID); err != nil {
+			rows.Close()
+			return
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return
+	}
+	for _, key := range keys {
+		r.publish(key.AppID, key.ReleaseID)
+	}
+}
+
 func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFormation, error) {
 	app, err := r.apps.Get(formation.AppID)
 	if err == ErrNotFound {
@@ -157,14 +412,19 @@ func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFo
 	if err != nil {
 		return nil, err
 	}
-	artifact, err := r.artifacts.Get(release.(*ct.Release).ArtifactID)
+	data, err := r.artifacts.Get(release.(*ct.Release).ArtifactID)
 	if err != nil {
 		return nil, err
 	}
+	artifact := data.(*ct.Artifact)
+	// the scheduler opens the credentials when starting jobs
+	if artifact.Credentials, err = r.artifacts.PullCredentials(artifact); err != nil {
+		return nil, err
+	}
 	f := &ct.ExpandedFormation{
 		App:       app.(*ct.App),
 		Release:   release.(*ct.Release),
-		Artifact:  artifact.(*ct.Artifact),
+		Artifact:  artifact,
 		Processes: formation.Processes,
 		UpdatedAt: *formation.UpdatedAt,
 	}
@@ -172,11 +432,18 @@ func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFo
 }
 
 func (r *FormationRepo) startListener() error {
+	var disconnectedMtx sync.Mutex
+	var disconnectedAt time.Time
 	// TODO: get connection string from somewhere
 	listenerEvent := func(ev pq.ListenerEventType, err error) {
 		if err != nil {
 			fmt.Println("LISTENER error:", err)
 		}
+		if ev == pq.ListenerEventDisconnected {
+			disconnectedMtx.Lock()
+			disconnectedAt = time.Now()
+			disconnectedMtx.Unlock()
+		}
 		// TODO: handle errors
 	}
 	listener := pq.NewListener(r.db.DSN(), 10*time.Second, time.Minute, listenerEvent)
@@ -187,6 +454,16 @@ func (r *FormationRepo) startListener() error {
 		for {
 			select {
 			case n := <-listener.Notify:
+				if n == nil {
+					// the connection was re-established, so publish any
+					// formations which may have changed while disconnected,
+					// allowing for the disconnection taking a while to detect
+					disconnectedMtx.Lock()
+					since := disconnectedAt.Add(-time.Minute)
+					disconnectedMtx.Unlock()
+					go r.publishUpdatedSince(since)
+					continue
+				}
 				ids := strings.SplitN(n.Extra, ":", 2)
 				go r.publish(ids[0], ids[1])
 			case <-r.stopListener:
@@ -273,15 +550,21 @@ func (c *controllerAPI) PutFormation(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
+	if err := checkReleaseApp(release, app); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
 	formation.AppID = app.ID
 	formation.ReleaseID = release.ID
-	if app.Protected {
-		for typ := range release.Processes {
-			if formation.Processes[typ] == 0 {
-				respondWithError(w, ct.ValidationError{Message: "unable to scale to zero, app is protected"})
-				return
-			}
-		}
+	processes, err := c.appProcesses(&formation)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := checkFormationPolicy(app, release, formation.Processes, processes); err != nil {
+		respondWithError(w, err)
+		return
 	}
 
 	if err = schema.Validate(formation); err != nil {
@@ -289,13 +572,87 @@ func (c *controllerAPI) PutFormation(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
-	if err = c.formationRepo.Add(&formation); err != nil {
+	if app.Quota != nil {
+		if err := checkFormationQuota(app.Quota, &formation); err != nil {
+			respondWithError(w, err)
+			return
+		}
+	}
+
+	warnings, err := c.checkFormationCapacity(release, &formation)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err = c.formationRepo.Add(&formation, requestActor(ctx)); err != nil {
 		respondWithError(w, err)
 		return
 	}
+	setCapacityWarnings(w, warnings)
 	httphelper.JSON(w, 200, &formation)
 }
 
+// ScaleProcessType changes the number of processes of a single type in the
+// formation of the app's current release, responding with the resulting
+// formation.
+func (c *controllerAPI) ScaleProcessType(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	app := c.getApp(ctx)
+	typ := params.ByName("process_type")
+
+	var scale ct.ProcessScale
+	if err := httphelper.DecodeJSON(req, &scale); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if scale.Count != nil && *scale.Count < 0 {
+		respondWithError(w, ct.ValidationError{Field: "count", Message: "must not be negative"})
+		return
+	}
+
+	release, err := c.appRepo.GetRelease(app.ID)
+	if err == ErrNotFound {
+		respondWithError(w, ct.ValidationError{Message: "app has no release"})
+		return
+	} else if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if release.ArtifactID == "" {
+		respondWithError(w, ct.ValidationError{Message: "release is not deployable"})
+		return
+	}
+	if _, ok := release.Processes[typ]; !ok {
+		respondWithError(w, ct.ValidationError{Field: "type", Message: fmt.Sprintf("%q is not a process type of the current release", typ)})
+		return
+	}
+
+	var warnings []string
+	formation, err := c.formationRepo.Scale(app.ID, release.ID, typ, &scale, func(f *ct.Formation) error {
+		processes, err := c.appProcesses(f)
+		if err != nil {
+			return err
+		}
+		if err := checkProcessPolicy(app, typ, f.Processes[typ], processes[typ]); err != nil {
+			return err
+		}
+		if app.Quota != nil {
+			if err := checkFormationQuota(app.Quota, f); err != nil {
+				return err
+			}
+		}
+		warnings, err = c.checkFormationCapacity(release, f)
+		return err
+	}, requestActor(ctx))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	setCapacityWarnings(w, warnings)
+	httphelper.JSON(w, 200, formation)
+}
+
 func (c *controllerAPI) GetFormation(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	params, _ := ctxhelper.ParamsFromContext(ctx)
 
@@ -317,7 +674,22 @@ func (c *controllerAPI) DeleteFormation(ctx context.Context, w http.ResponseWrit
 		respondWithError(w, err)
 		return
 	}
-	err = c.formationRepo.Remove(app.ID, formation.ReleaseID)
+	// removing the formation of the current release scales it to zero
+	if current, err := c.appRepo.GetRelease(app.ID); err == nil && current.ID == formation.ReleaseID {
+		processes, err := c.appProcesses(&ct.Formation{AppID: app.ID, ReleaseID: formation.ReleaseID})
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		if err := checkFormationPolicy(app, current, nil, processes); err != nil {
+			respondWithError(w, err)
+			return
+		}
+	} else if err != nil && err != ErrNotFound {
+		respondWithError(w, err)
+		return
+	}
+	err = c.formationRepo.Remove(app.ID, formation.ReleaseID, requestActor(ctx))
 	if err != nil {
 		respondWithError(w, err)
 		return
@@ -325,6 +697,23 @@ func (c *controllerAPI) DeleteFormation(ctx context.Context, w http.ResponseWrit
 	w.WriteHeader(200)
 }
 
+// GetFormationHistory returns the changes of the formation's process counts,
+// newest first.
+func (c *controllerAPI) GetFormationHistory(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	app := c.getApp(ctx)
+	release, err := c.getRelease(ctx)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	changes, err := c.formationRepo.History(app.ID, release.ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, changes)
+}
+
 func (c *controllerAPI) ListFormations(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	app := c.getApp(ctx)
 	list, err := c.formationRepo.List(app.ID)
@@ -335,7 +724,14 @@ func (c *controllerAPI) ListFormations(ctx context.Context, w http.ResponseWrite
 	httphelper.JSON(w, 200, list)
 }
 
+// GetFormations streams the expanded formations to the scheduler. They include
+// the sealed pull credentials of the artifacts, so only full scope tokens can
+// stream them.
 func (c *controllerAPI) GetFormations(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if !fullScope(ctx) {
+		respondWithError(w, errForbidden)
+		return
+	}
 	ch := make(chan *ct.ExpandedFormation)
 	stopCh := make(chan struct{})
 	since, err := time.Parse(time.RFC3339, req.FormValue("since"))
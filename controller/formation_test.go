@@ -1,10 +1,15 @@
 package main
 
 import (
+	"sync"
 	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
 )
 
 func (s *S) TestFormationStreaming(c *C) {
@@ -62,3 +67,150 @@ func (s *S) TestFormationStreaming(c *C) {
 	c.Assert(out.App, DeepEquals, app)
 	c.Assert(out.Processes, IsNil)
 }
+
+func (s *S) TestScaleProcessType(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "scale-process-type"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "worker": {}}})
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	count := func(n int) *int { return &n }
+
+	formation, err := s.c.ScaleProcessType(app.ID, "web", &ct.ProcessScale{Delta: 2})
+	c.Assert(err, IsNil)
+	c.Assert(formation.AppID, Equals, app.ID)
+	c.Assert(formation.ReleaseID, Equals, release.ID)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// other types are left alone
+	formation, err = s.c.ScaleProcessType(app.ID, "worker", &ct.ProcessScale{Count: count(3)})
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2, "worker": 3})
+
+	// concurrent deltas are all applied
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.c.ScaleProcessType(app.ID, "web", &ct.ProcessScale{Delta: 1})
+			c.Check(err, IsNil)
+		}()
+	}
+	wg.Wait()
+	formation, err = s.c.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 7, "worker": 3})
+
+	// counts don't go below zero
+	formation, err = s.c.ScaleProcessType(app.ID, "worker", &ct.ProcessScale{Delta: -5})
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes["worker"], Equals, 0)
+
+	_, err = s.c.ScaleProcessType(app.ID, "clock", &ct.ProcessScale{Delta: 1})
+	c.Assert(err, NotNil)
+	_, err = s.c.ScaleProcessType(app.ID, "web", &ct.ProcessScale{Count: count(-1)})
+	c.Assert(err, NotNil)
+
+	// the app policy is enforced
+	app.Policy = &ct.AppPolicy{MinProcesses: map[string]int{"web": 2}}
+	c.Assert(s.c.UpdateApp(app), IsNil)
+	_, err = s.c.ScaleProcessType(app.ID, "web", &ct.ProcessScale{Count: count(1)})
+	c.Assert(err, NotNil)
+	formation, err = s.c.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes["web"], Equals, 7)
+}
+
+func (s *S) TestFormationCapacityCheck(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-capacity"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "router": {HostNetwork: true}}})
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+
+	// formations aren't checked by default
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"router": 2}}
+	c.Assert(s.c.PutFormation(formation), IsNil)
+
+	_, err := s.c.SetSetting(ct.SettingFormationCapacityCheck, "reject")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingFormationCapacityCheck)
+	err = s.c.PutFormation(formation)
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.CapacityError)
+
+	// processes which don't use the host network aren't limited
+	formation.Processes = map[string]int{"router": 1, "web": 5}
+	c.Assert(s.c.PutFormation(formation), IsNil)
+
+	// with no hosts nothing can run
+	s.cc.SetHosts(map[string]host.Host{})
+	err = s.c.PutFormation(formation)
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.CapacityError)
+
+	// warnings don't reject the formation
+	_, err = s.c.SetSetting(ct.SettingFormationCapacityCheck, "warn")
+	c.Assert(err, IsNil)
+	c.Assert(s.c.PutFormation(formation), IsNil)
+}
+
+func (s *S) TestFormationCapacityCheckResources(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-capacity-resources"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{
+		"web":    {},
+		"worker": {CPUShares: 1536},
+	}})
+	hostID := random.UUID()
+	// 2GiB of the host's 4GiB and 512 of its 2048 CPU shares are
+	// reserved by a job of another app
+	other := &host.Job{ID: random.UUID(), Resources: host.JobResources{Memory: 2 << 20, CPUShares: 512}}
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID, Jobs: []*host.Job{other}}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	hc := tu.NewFakeHostClient(hostID)
+	hc.SetMetrics(&host.HostMetrics{HostID: hostID, MemoryTotal: 4 << 30, CPUs: 2})
+	s.cc.SetHostClient(hostID, hc)
+
+	_, err := s.c.SetSetting(ct.SettingFormationCapacityCheck, "reject")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingFormationCapacityCheck)
+
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1, "worker": 1}}
+	c.Assert(s.c.PutFormation(formation), IsNil)
+
+	// jobs using the default 1GiB of memory
+	formation.Processes = map[string]int{"web": 2, "worker": 1}
+	err = s.c.PutFormation(formation)
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.CapacityError)
+
+	// jobs with explicit CPU shares
+	formation.Processes = map[string]int{"worker": 2}
+	err = s.c.PutFormation(formation)
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.CapacityError)
+}
+
+func (s *S) TestFormationCapacityCheckOmni(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-capacity-omni"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"agent": {Omni: true}}})
+	// only the metrics of one of the two hosts are known
+	knownID, unknownID := random.UUID(), random.UUID()
+	s.cc.SetHosts(map[string]host.Host{knownID: {ID: knownID}, unknownID: {ID: unknownID}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	hc := tu.NewFakeHostClient(knownID)
+	hc.SetMetrics(&host.HostMetrics{HostID: knownID, MemoryTotal: 4 << 30, CPUs: 2})
+	s.cc.SetHostClient(knownID, hc)
+
+	_, err := s.c.SetSetting(ct.SettingFormationCapacityCheck, "reject")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingFormationCapacityCheck)
+
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"agent": 2}}
+	c.Assert(s.c.PutFormation(formation), IsNil)
+
+	// omni jobs run on every host, so 3 need 6GiB
+	formation.Processes = map[string]int{"agent": 3}
+	err = s.c.PutFormation(formation)
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.CapacityError)
+}
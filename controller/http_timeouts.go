@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// httpTimeouts enforces the read and write timeouts of the controller's HTTP
+// server. The timeouts of http.Server apply to whole requests, which would cut
+// off event and log streams, so instead:
+//
+// - request headers must be read within ReadHeaderTimeout, and the next
+//   request on an idle connection must start within IdleTimeout
+// - request bodies must be read within BodyTimeout, or UploadTimeout for
+//   artifact uploads
+// - each write must complete within WriteTimeout, so clients which stop
+//   reading are disconnected while long running responses are not
+type httpTimeouts struct {
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	BodyTimeout       time.Duration
+	UploadTimeout     time.Duration
+	WriteTimeout      time.Duration
+
+	mtx sync.Mutex
+	// conns are the open connections keyed by remote address, so that the
+	// read deadline of the connection of a request can be set
+	conns map[string]net.Conn
+}
+
+func newHTTPTimeouts() *httpTimeouts {
+	return &httpTimeouts{
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		BodyTimeout:       time.Minute,
+		UploadTimeout:     10 * time.Minute,
+		WriteTimeout:      time.Minute,
+		conns:             make(map[string]net.Conn),
+	}
+}
+
+// Listener wraps l so that accepted connections have TCP keep-alives enabled
+// (like http.ListenAndServe does) and set a write deadline before each write.
+func (t *httpTimeouts) Listener(l net.Listener) net.Listener {
+	return &timeoutListener{Listener: l, writeTimeout: t.WriteTimeout}
+}
+
+// ConnState is used as the ConnState hook of the http.Server, it sets the read
+// deadline of new and idle connections to limit reading request headers.
+func (t *httpTimeouts) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		t.mtx.Lock()
+		t.conns[conn.RemoteAddr().String()] = conn
+		t.mtx.Unlock()
+		conn.SetReadDeadline(time.Now().Add(t.ReadHeaderTimeout))
+	case http.StateIdle:
+		conn.SetReadDeadline(time.Now().Add(t.IdleTimeout + t.ReadHeaderTimeout))
+	case http.StateHijacked, http.StateClosed:
+		t.mtx.Lock()
+		delete(t.conns, conn.RemoteAddr().String())
+		t.mtx.Unlock()
+	}
+}
+
+// Handler returns an http.Handler which sets the read deadline for the body
+// of requests before calling h. The deadline is cleared for requests without
+// a body, as streaming handlers rely on reads only failing once the client
+// has gone.
+func (t *httpTimeouts) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.mtx.Lock()
+		conn := t.conns[req.RemoteAddr]
+		t.mtx.Unlock()
+		if conn != nil {
+			switch {
+			case req.ContentLength == 0:
+				conn.SetReadDeadline(time.Time{})
+			case req.URL.Path == "/artifacts/upload":
+				conn.SetReadDeadline(time.Now().Add(t.UploadTimeout))
+			default:
+				conn.SetReadDeadline(time.Now().Add(t.BodyTimeout))
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+type timeoutListener struct {
+	net.Listener
+	writeTimeout time.Duration
+}
+
+func (l *timeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(3 * time.Minute)
+	}
+	return &timeoutConn{Conn: conn, writeTimeout: l.writeTimeout}, nil
+}
+
+// timeoutConn sets a write deadline before each write.
+type timeoutConn struct {
+	net.Conn
+	writeTimeout time.Duration
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return c.Conn.Write(p)
+}
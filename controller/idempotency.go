@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// idempotencyWindow is how long a response is kept for replaying to
+// retried requests with the same Idempotency-Key.
+const idempotencyWindow = 24 * time.Hour
+
+type IdempotencyRepo struct {
+	db *postgres.DB
+}
+
+func NewIdempotencyRepo(db *postgres.DB) *IdempotencyRepo {
+	return &IdempotencyRepo{db}
+}
+
+type idempotentResponse struct {
+	Fingerprint string
+	Status      int // zero while the original request is still in progress
+	ContentType string
+	Body        []byte
+}
+
+// Begin reserves key for owner. If the key has been used within the
+// idempotency window, the previously stored response is returned instead.
+func (r *IdempotencyRepo) Begin(owner, key, fingerprint string) (*idempotentResponse, error) {
+	if err := r.db.Exec("DELETE FROM idempotency_keys WHERE created_at < $1", time.Now().Add(-idempotencyWindow)); err != nil {
+		return nil, err
+	}
+	err := r.db.Exec("INSERT INTO idempotency_keys (owner, key, fingerprint) VALUES ($1, $2, $3)", owner, key, fingerprint)
+	if err == nil {
+		return nil, nil
+	}
+	if e, ok := err.(*pq.Error); !ok || e.Code.Name() != "unique_violation" {
+		return nil, err
+	}
+
+	res := &idempotentResponse{}
+	var status *int
+	var contentType *string
+	err = r.db.QueryRow("SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE owner = $1 AND key = $2", owner, key).Scan(&res.Fingerprint, &status, &contentType, &res.Body)
+	if err == sql.ErrNoRows {
+		// the original request failed and released the key, so try again
+		return r.Begin(owner, key, fingerprint)
+	} else if err != nil {
+		return nil, err
+	}
+	if status != nil {
+		res.Status = *status
+	}
+	if contentType != nil {
+		res.ContentType = *contentType
+	}
+	return res, nil
+}
+
+// Complete stores the response to the request that reserved key.
+func (r *IdempotencyRepo) Complete(owner, key string, status int, contentType string, body []byte) error {
+	return r.db.Exec("UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5 WHERE owner = $1 AND key = $2", owner, key, status, contentType, body)
+}
+
+// Release removes the reservation for key so that the request can be retried.
+func (r *IdempotencyRepo) Release(owner, key string) error {
+	return r.db.Exec("DELETE FROM idempotency_keys WHERE owner = $1 AND key = $2", owner, key)
+}
+
+func requestFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes writes through to the underlying ResponseWriter
+// while keeping a copy of the status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotencyHandler makes POST requests with an Idempotency-Key header safe
+// to retry. The response to the first request is stored and replayed for any
+// retries with the same key and request body within the idempotency window.
+// Keys are scoped to the auth token used to make the request.
+func idempotencyHandler(main http.Handler, repo *IdempotencyRepo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		// attached job requests hijack the connection so can't be
+		// replayed, and uploads are too large to buffer
+		if key == "" || req.Method != "POST" || req.Header.Get("Upgrade") != "" || req.URL.Path == "/artifacts/upload" {
+			main.ServeHTTP(w, req)
+			return
+		}
+		ctx := w.(*httphelper.ResponseWriter).Context()
+		var owner string
+		if token := authTokenFromContext(ctx); token != nil {
+			owner = token.ID
+		}
+
+		body, err := httphelper.ReadJSONBody(req)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(req, body)
+
+		existing, err := repo.Begin(owner, key, fingerprint)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				respondWithError(w, ct.ValidationError{Field: "Idempotency-Key", Message: "has already been used for a different request"})
+			case existing.Status == 0:
+				httphelper.Error(w, httphelper.JSONError{
+					Code:      httphelper.ObjectExistsError,
+					Message:   "a request with this Idempotency-Key is still in progress",
+					Retryable: true,
+				})
+			default:
+				if existing.ContentType != "" {
+					w.Header().Set("Content-Type", existing.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		l, _ := ctxhelper.LoggerFromContext(ctx)
+		rec := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := repo.Release(owner, key); err != nil {
+				l.Error("error releasing idempotency key", "key", key, "err", err)
+			}
+		}()
+
+		main.ServeHTTP(httphelper.NewResponseWriter(rec, ctx), req)
+
+		if rec.status == 0 {
+			rec.status = 200
+		}
+		// server errors may be transient, so don't prevent retries
+		if rec.status >= 500 {
+			return
+		}
+		if err := repo.Complete(owner, key, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes()); err != nil {
+			l.Error("error storing idempotent response", "key", key, "err", err)
+			return
+		}
+		completed = true
+	})
+}
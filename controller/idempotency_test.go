@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestIdempotentCreateRelease(c *C) {
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	header := http.Header{"Idempotency-Key": {random.UUID()}}
+
+	release := &ct.Release{ArtifactID: artifact.ID}
+	first := &ct.Release{}
+	res, err := s.c.RawReq("POST", "/releases", header, release, first)
+	c.Assert(err, IsNil)
+	c.Assert(res.Header.Get("Idempotent-Replayed"), Equals, "")
+
+	// a retry returns the original release rather than creating another
+	second := &ct.Release{}
+	res, err = s.c.RawReq("POST", "/releases", header, release, second)
+	c.Assert(err, IsNil)
+	c.Assert(res.Header.Get("Idempotent-Replayed"), Equals, "true")
+	c.Assert(second.ID, Equals, first.ID)
+
+	// reusing the key for a different request is an error
+	_, err = s.c.RawReq("POST", "/releases", header, &ct.Release{ArtifactID: artifact.ID, Env: map[string]string{"FOO": "bar"}}, nil)
+	c.Assert(err, NotNil)
+	jsonErr, ok := err.(httphelper.JSONError)
+	c.Assert(ok, Equals, true)
+	c.Assert(jsonErr.Code, Equals, httphelper.ValidationError)
+
+	// a new key creates a new release
+	third := &ct.Release{}
+	_, err = s.c.RawReq("POST", "/releases", http.Header{"Idempotency-Key": {random.UUID()}}, release, third)
+	c.Assert(err, IsNil)
+	c.Assert(third.ID, Not(Equals), first.ID)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -16,7 +17,9 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/schema"
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/ctxhelper"
@@ -48,11 +51,12 @@ type sseLogChunk struct {
 
 /* Job Stuff */
 type JobRepo struct {
-	db *postgres.DB
+	db       *postgres.DB
+	notifier *notifier
 }
 
-func NewJobRepo(db *postgres.DB) *JobRepo {
-	return &JobRepo{db}
+func NewJobRepo(db *postgres.DB, notifier *notifier) *JobRepo {
+	return &JobRepo{db: db, notifier: notifier}
 }
 
 func (r *JobRepo) Get(id string) (*ct.Job, error) {
@@ -86,6 +90,51 @@ func (r *JobRepo) Add(job *ct.Job) error {
 	return nil
 }
 
+// AddOneOff adds job, a one-off job which is about to be started, in the
+// starting state. If maxJobs is greater than zero and the app already has that
+// many one-off jobs starting or up, a validation error is returned instead.
+// The app row is locked while counting so that concurrent runs can't exceed
+// the quota.
+func (r *JobRepo) AddOneOff(job *ct.Job, maxJobs int) error {
+	hostID, jobID, err := cluster.ParseJobID(job.ID)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var appID string
+	if err := tx.QueryRow("SELECT app_id FROM apps WHERE app_id = $1 AND deleted_at IS NULL FOR UPDATE", job.AppID).Scan(&appID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if maxJobs > 0 {
+		var running int
+		if err := tx.QueryRow("SELECT count(*) FROM job_cache WHERE app_id = $1 AND (process_type IS NULL OR process_type = '') AND state IN ('starting', 'up')", job.AppID).Scan(&running); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if running >= maxJobs {
+			tx.Rollback()
+			return ct.ValidationError{
+				Field:   "jobs",
+				Message: fmt.Sprintf("exceeds the app quota of %d running one-off jobs", maxJobs),
+			}
+		}
+	}
+	job.State = "starting"
+	if err := tx.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, state, meta) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at",
+		jobID, hostID, job.AppID, job.ReleaseID, job.State, metaToHstore(job.Meta)).Scan(&job.CreatedAt, &job.UpdatedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func scanJob(s postgres.Scanner) (*ct.Job, error) {
 	job := &ct.Job{}
 	var meta hstore.Hstore
@@ -124,6 +173,32 @@ func (r *JobRepo) List(appID string) ([]*ct.Job, error) {
 	return jobs, nil
 }
 
+// ListActive returns the starting and up jobs of all apps, or only of the apps
+// in namespaceID if it is set.
+func (r *JobRepo) ListActive(namespaceID string) ([]*ct.Job, error) {
+	query := "SELECT concat(j.host_id, '-', j.job_id), j.app_id, j.release_id, j.process_type, j.state, j.meta, j.created_at, j.updated_at FROM job_cache j"
+	var args []interface{}
+	if namespaceID != "" {
+		query += " JOIN apps a ON a.app_id = j.app_id AND a.namespace_id = $1"
+		args = append(args, namespaceID)
+	}
+	query += " WHERE j.state IN ('starting', 'up') ORDER BY j.created_at DESC"
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*ct.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
 func (r *JobRepo) listEvents(appID string, sinceID int64, count int) ([]*ct.JobEvent, error) {
 	query := "SELECT event_id, concat(job_events.host_id, '-', job_events.job_id), job_events.app_id, job_cache.release_id, job_cache.process_type, job_events.state, job_events.created_at FROM job_events INNER JOIN job_cache ON job_events.job_id = job_cache.job_id AND job_events.host_id = job_cache.host_id WHERE job_events.app_id = $1 AND event_id > $2 ORDER BY event_id DESC"
 	args := []interface{}{appID, sinceID}
@@ -203,6 +278,89 @@ func (c *controllerAPI) ListJobs(ctx context.Context, w http.ResponseWriter, req
 	httphelper.JSON(w, 200, list)
 }
 
+// ListClusterJobs lists the running jobs of all apps, with the start time of
+// each job taken from the host it is running on. Hosts which can't be reached
+// in time are skipped so the jobs they run are still listed, just without an
+// uptime.
+func (c *controllerAPI) ListClusterJobs(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	jobs, err := c.jobRepo.ListActive(tokenNamespace(ctx))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	hosts, err := c.clusterClient.ListHosts()
+	if err != nil {
+		respondWithError(w, clusterError("list hosts failed", err))
+		return
+	}
+	active := make(map[string]host.ActiveJob)
+	for hostID, hostJobs := range c.listHostJobs(hosts) {
+		for id, job := range hostJobs {
+			active[hostID+"-"+id] = job
+		}
+	}
+
+	now := time.Now()
+	list := make([]*ct.ClusterJob, len(jobs))
+	for i, job := range jobs {
+		j := &ct.ClusterJob{Job: job}
+		j.HostID, _, _ = cluster.ParseJobID(job.ID)
+		if a, ok := active[job.ID]; ok && !a.StartedAt.IsZero() {
+			startedAt := a.StartedAt
+			j.StartedAt = &startedAt
+			j.Uptime = int64(now.Sub(startedAt) / time.Second)
+		}
+		list[i] = j
+	}
+	httphelper.JSON(w, 200, list)
+}
+
+// hostJobsTimeout is how long listHostJobs waits for hosts to list their jobs.
+const hostJobsTimeout = 5 * time.Second
+
+// listHostJobs lists the jobs of hosts in parallel, keyed by host ID. Hosts
+// which fail or don't respond within hostJobsTimeout are left out.
+func (c *controllerAPI) listHostJobs(hosts []host.Host) map[string]map[string]host.ActiveJob {
+	type result struct {
+		hostID string
+		jobs   map[string]host.ActiveJob
+	}
+	// the channel is buffered so hosts which respond after the timeout
+	// don't block
+	results := make(chan result, len(hosts))
+	for _, h := range hosts {
+		go func(hostID string) {
+			client, err := c.clusterClient.DialHost(hostID)
+			if err != nil {
+				log.Printf("Unable to connect to host %s: %s", hostID, err)
+				results <- result{hostID: hostID}
+				return
+			}
+			jobs, err := client.ListJobs()
+			if err != nil {
+				log.Printf("Unable to list jobs of host %s: %s", hostID, err)
+			}
+			results <- result{hostID, jobs}
+		}(h.ID)
+	}
+
+	jobs := make(map[string]map[string]host.ActiveJob, len(hosts))
+	timeout := time.After(hostJobsTimeout)
+	for i := range hosts {
+		select {
+		case r := <-results:
+			if r.jobs != nil {
+				jobs[r.hostID] = r.jobs
+			}
+		case <-timeout:
+			log.Printf("Timed out listing the jobs of %d hosts", len(hosts)-i)
+			return jobs
+		}
+	}
+	return jobs
+}
+
 func (c *controllerAPI) GetJob(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	params, _ := ctxhelper.ParamsFromContext(ctx)
 	job, err := c.jobRepo.Get(params.ByName("jobs_id"))
@@ -247,15 +405,39 @@ func (c *controllerAPI) JobLog(ctx context.Context, w http.ResponseWriter, req *
 		JobID: jobID,
 		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
 	}
-	tail := req.FormValue("tail") != ""
+	// tail is the original name of the follow parameter
+	tail := req.FormValue("follow") == "true" || req.FormValue("tail") != ""
 	if tail {
 		attachReq.Flags |= host.AttachFlagStream
 	}
+	if s := req.FormValue("lines"); s != "" {
+		lines, err := strconv.Atoi(s)
+		if err != nil || lines < 0 {
+			respondWithError(w, ct.ValidationError{Field: "lines", Message: "must be a non-negative integer"})
+			return
+		}
+		if lines > ct.MaxJobLogLines {
+			respondWithError(w, ct.ValidationError{Field: "lines", Message: fmt.Sprintf("must not be greater than %d", ct.MaxJobLogLines)})
+			return
+		}
+		if lines == 0 {
+			attachReq.Flags &^= host.AttachFlagLogs
+		}
+		attachReq.Lines = lines
+	}
+	if s := req.FormValue("since"); s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			respondWithError(w, ct.ValidationError{Field: "since", Message: "must be an RFC3339 timestamp"})
+			return
+		}
+		attachReq.Since = &since
+	}
 	wait := req.FormValue("wait") != ""
 	attachClient, err := hc.Attach(attachReq, wait)
 	if err != nil {
 		if err == cluster.ErrWouldWait {
-			w.WriteHeader(404)
+			respondWithError(w, ErrNotFound)
 		} else {
 			respondWithError(w, err)
 		}
@@ -305,10 +487,19 @@ func (c *controllerAPI) JobLog(ctx context.Context, w http.ResponseWriter, req *
 	}
 }
 
+// streamJobs streams the job events of app as they are created. If the
+// since_id parameter or the Last-Event-Id header is set, events after that ID
+// are sent first so that consumers can resume the stream without missing
+// events.
 func streamJobs(ctx context.Context, req *http.Request, w http.ResponseWriter, app *ct.App, repo *JobRepo) (err error) {
 	var lastID int64
-	if req.Header.Get("Last-Event-Id") != "" {
-		lastID, err = strconv.ParseInt(req.Header.Get("Last-Event-Id"), 10, 64)
+	if s := req.FormValue("since_id"); s != "" {
+		lastID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ct.ValidationError{Field: "since_id", Message: "is invalid"}
+		}
+	} else if s := req.Header.Get("Last-Event-Id"); s != "" {
+		lastID, err = strconv.ParseInt(s, 10, 64)
 		if err != nil {
 			return ct.ValidationError{Field: "Last-Event-Id", Message: "is invalid"}
 		}
@@ -326,30 +517,14 @@ func streamJobs(ctx context.Context, req *http.Request, w http.ResponseWriter, a
 	s := sse.NewStream(w, ch, l)
 	s.Serve()
 
-	connected := make(chan struct{})
-	done := make(chan struct{})
-	listenEvent := func(ev pq.ListenerEventType, listenErr error) {
-		switch ev {
-		case pq.ListenerEventConnected:
-			close(connected)
-		case pq.ListenerEventDisconnected:
-			if done != nil {
-				close(done)
-				done = nil
-			}
-		case pq.ListenerEventConnectionAttemptFailed:
-			err = listenErr
-			if done != nil {
-				close(done)
-				done = nil
-			}
-		}
+	channel := "job_events:" + postgres.FormatUUID(app.ID)
+	notifications := make(chan *pq.Notification, notificationBufferSize)
+	if err := repo.notifier.Subscribe(channel, notifications); err != nil {
+		return err
 	}
-	listener := pq.NewListener(repo.db.DSN(), 10*time.Second, time.Minute, listenEvent)
-	defer listener.Close()
-	listener.Listen("job_events:" + postgres.FormatUUID(app.ID))
+	defer repo.notifier.Unsubscribe(channel, notifications)
 
-	var currID int64
+	currID := lastID
 	if lastID > 0 || count > 0 {
 		events, err := repo.listEvents(app.ID, lastID, count)
 		if err != nil {
@@ -363,19 +538,16 @@ func streamJobs(ctx context.Context, req *http.Request, w http.ResponseWriter, a
 		}
 	}
 
-	select {
-	case <-done:
-		return
-	case <-connected:
-	}
-
 	for {
 		select {
 		case <-s.Done:
 			return
-		case <-done:
-			return
-		case n := <-listener.Notify:
+		case n, ok := <-notifications:
+			if !ok {
+				// notifications may have been missed, so end the stream
+				// and let the client resume using Last-Event-Id
+				return
+			}
 			id, err := strconv.ParseInt(n.Extra, 10, 64)
 			if err != nil {
 				return err
@@ -388,23 +560,36 @@ func streamJobs(ctx context.Context, req *http.Request, w http.ResponseWriter, a
 				return err
 			}
 			ch <- e
+			currID = id
 		}
 	}
 }
 
+// KillJob stops a job, the signal and grace_period parameters control the
+// signal it is sent and how long it is given to exit before it is killed.
 func (c *controllerAPI) KillJob(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	opts, err := host.StopOptionsFromQuery(req.URL.Query())
+	if err != nil {
+		respondWithError(w, ct.ValidationError{Message: err.Error()})
+		return
+	}
+
 	client, jobID, err := c.connectHost(ctx)
 	if err != nil {
 		respondWithError(w, err)
 		return
 	}
 
-	if err = client.StopJob(jobID); err != nil {
+	if err = client.StopJobWithOptions(jobID, opts); err != nil {
 		respondWithError(w, err)
 		return
 	}
 }
 
+// RunJob starts a one-off job. If the request has an "Upgrade: flynn-attach/0"
+// header, the job is started with stdin attached and, once it is running, the
+// connection is upgraded and proxied to the host's attach stream, which
+// multiplexes stdin, stdout, stderr, signals and TTY resizes.
 func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var newJob ct.NewJob
 	if err := httphelper.DecodeJSON(req, &newJob); err != nil {
@@ -416,6 +601,10 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		respondWithError(w, err)
 		return
 	}
+	if newJob.WorkingDir != "" && !path.IsAbs(newJob.WorkingDir) {
+		respondWithError(w, ct.ValidationError{Field: "working_dir", Message: "must be an absolute path"})
+		return
+	}
 
 	data, err := c.releaseRepo.Get(newJob.ReleaseID)
 	if err != nil {
@@ -423,12 +612,27 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		return
 	}
 	release := data.(*ct.Release)
+	app := c.getApp(ctx)
+	if err := checkReleaseApp(release, app); err != nil {
+		respondWithError(w, err)
+		return
+	}
 	data, err = c.artifactRepo.Get(release.ArtifactID)
 	if err != nil {
 		respondWithError(w, err)
 		return
 	}
 	artifact := data.(*ct.Artifact)
+	sealedCreds, err := c.artifactRepo.PullCredentials(artifact)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	creds, err := utils.OpenCredentials(c.secretsKey, artifact.URI, sealedCreds)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
 	attach := strings.Contains(req.Header.Get("Upgrade"), "flynn-attach/0")
 
 	env := make(map[string]string, len(release.Env)+len(newJob.Env))
@@ -438,11 +642,17 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 	for k, v := range newJob.Env {
 		env[k] = v
 	}
+	if err := secrets.OpenEnv(c.secretsKey, secrets.AppContext(app.ID), env); err != nil {
+		if err == secrets.ErrInvalid {
+			err = ct.ValidationError{Field: "env", Message: "has values which are not sealed for the app"}
+		}
+		respondWithError(w, err)
+		return
+	}
 	metadata := make(map[string]string, len(newJob.Meta)+3)
 	for k, v := range newJob.Meta {
 		metadata[k] = v
 	}
-	app := c.getApp(ctx)
 	metadata["flynn-controller.app"] = app.ID
 	metadata["flynn-controller.app_name"] = app.Name
 	metadata["flynn-controller.release"] = release.ID
@@ -450,8 +660,10 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		ID:       cluster.RandomJobID(""),
 		Metadata: metadata,
 		Artifact: host.Artifact{
-			Type: artifact.Type,
-			URI:  artifact.URI,
+			Type:        artifact.Type,
+			URI:         artifact.URI,
+			Digest:      artifact.Digest,
+			Credentials: creds,
 		},
 		Config: host.ContainerConfig{
 			Cmd:   newJob.Cmd,
@@ -463,6 +675,8 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 	if len(newJob.Entrypoint) > 0 {
 		job.Config.Entrypoint = newJob.Entrypoint
 	}
+	job.Config.WorkingDir = newJob.WorkingDir
+	job.Config.User = newJob.User
 
 	hosts, err := c.clusterClient.ListHosts()
 	if err != nil {
@@ -470,12 +684,35 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		return
 	}
 	if len(hosts) == 0 {
-		respondWithError(w, errors.New("no hosts found"))
+		respondWithError(w, clusterError("schedule failed", errors.New("no hosts found")))
 		return
 	}
 
 	hostID := schedutil.PickHost(hosts).ID
 
+	// the job is added before it is started so that it counts towards the
+	// quota of the app for concurrent runs
+	maxJobs := 0
+	if app.Quota != nil {
+		maxJobs = app.Quota.MaxJobs
+	}
+	cachedJob := &ct.Job{
+		ID:        hostID + "-" + job.ID,
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Meta:      metadata,
+	}
+	if err := c.jobRepo.AddOneOff(cachedJob, maxJobs); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	failed := func() {
+		cachedJob.State = "failed"
+		if err := c.jobRepo.Add(cachedJob); err != nil {
+			log.Printf("error marking job %s as failed: %s", cachedJob.ID, err)
+		}
+	}
+
 	var attachClient cluster.AttachClient
 	if attach {
 		attachReq := &host.AttachReq{
@@ -486,12 +723,14 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		}
 		client, err := c.clusterClient.DialHost(hostID)
 		if err != nil {
-			respondWithError(w, fmt.Errorf("host connect failed: %s", err.Error()))
+			failed()
+			respondWithError(w, clusterError("host connect failed", err))
 			return
 		}
 		attachClient, err = client.Attach(attachReq, true)
 		if err != nil {
-			respondWithError(w, fmt.Errorf("attach failed: %s", err.Error()))
+			failed()
+			respondWithError(w, clusterError("attach failed", err))
 			return
 		}
 		defer attachClient.Close()
@@ -499,34 +738,17 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 
 	_, err = c.clusterClient.AddJobs(map[string][]*host.Job{hostID: {job}})
 	if err != nil {
-		respondWithError(w, fmt.Errorf("schedule failed: %s", err.Error()))
+		failed()
+		respondWithError(w, clusterError("schedule failed", err))
 		return
 	}
 
 	if attach {
 		if err := attachClient.Wait(); err != nil {
-			respondWithError(w, fmt.Errorf("attach wait failed: %s", err.Error()))
+			respondWithError(w, clusterError("attach wait failed", err))
 			return
 		}
-		w.Header().Set("Connection", "upgrade")
-		w.Header().Set("Upgrade", "flynn-attach/0")
-		w.WriteHeader(http.StatusSwitchingProtocols)
-		conn, _, err := w.(http.Hijacker).Hijack()
-		if err != nil {
-			panic(err)
-		}
-		defer conn.Close()
-
-		done := make(chan struct{}, 2)
-		cp := func(to io.Writer, from io.Reader) {
-			io.Copy(to, from)
-			done <- struct{}{}
-		}
-		go cp(conn, attachClient.Conn())
-		go cp(attachClient.Conn(), conn)
-		<-done
-		<-done
-
+		serveAttach(ctx, w, attachClient, job.ID)
 		return
 	} else {
 		httphelper.JSON(w, 200, &ct.Job{
@@ -536,3 +758,88 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		})
 	}
 }
+
+// AttachJob attaches to a running job of the app, streaming its output and
+// optionally forwarding input to it over the multiplexed attach protocol of
+// the host, so that clients never connect to hosts directly.
+func (c *controllerAPI) AttachJob(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var opts ct.JobAttachOptions
+	if err := httphelper.DecodeJSON(req, &opts); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	job, err := c.jobRepo.Get(params.ByName("jobs_id"))
+	if err == nil && job.AppID != c.getApp(ctx).ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	hc, jobID, err := c.connectHost(ctx)
+	if err != nil {
+		respondWithError(w, clusterError("host connect failed", err))
+		return
+	}
+
+	attachReq := &host.AttachReq{
+		JobID:  jobID,
+		Flags:  host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagStream,
+		Height: opts.Height,
+		Width:  opts.Width,
+	}
+	if opts.Stdin {
+		attachReq.Flags |= host.AttachFlagStdin
+	}
+	if opts.Logs {
+		attachReq.Flags |= host.AttachFlagLogs
+	}
+	attachClient, err := hc.Attach(attachReq, false)
+	if err == cluster.ErrWouldWait {
+		respondWithError(w, ct.ValidationError{Field: "job", Message: "is not running"})
+		return
+	} else if err != nil {
+		respondWithError(w, clusterError("attach failed", err))
+		return
+	}
+	defer attachClient.Close()
+	serveAttach(ctx, w, attachClient, job.ID)
+}
+
+// serveAttach upgrades the request to the attach protocol and proxies the
+// connection to and from the host.
+func serveAttach(ctx context.Context, w http.ResponseWriter, attachClient cluster.AttachClient, jobID string) {
+	w.Header().Set("Connection", "upgrade")
+	w.Header().Set("Upgrade", "flynn-attach/0")
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		l, _ := ctxhelper.LoggerFromContext(ctx)
+		l.Error("error hijacking attach connection", "job.id", jobID, "err", err)
+		return
+	}
+	defer conn.Close()
+	// a body read deadline set by httpTimeouts still applies to the
+	// hijacked connection, which would cut off attached jobs running for
+	// longer
+	conn.SetReadDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	cp := func(to io.Writer, from io.Reader) {
+		io.Copy(to, from)
+		done <- struct{}{}
+	}
+	go cp(conn, attachClient.Conn())
+	go cp(attachClient.Conn(), conn)
+	<-done
+	<-done
+}
+
+// clusterError returns a retryable error for a failed request to the cluster.
+func clusterError(op string, err error) error {
+	return httphelper.JSONError{
+		Code:    httphelper.ServiceUnavailableError,
+		Message: fmt.Sprintf("%s: %s", op, err),
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/controller/client"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/logbuf"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/random"
@@ -39,6 +41,33 @@ func (s *S) TestJobList(c *C) {
 	c.Assert(job.Meta, DeepEquals, map[string]string{"some": "info"})
 }
 
+func (s *S) TestClusterJobList(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "cluster-job-list"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	s.createTestJob(c, &ct.Job{ID: "host0-cluster-job-up", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	s.createTestJob(c, &ct.Job{ID: "host0-cluster-job-down", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "down"})
+
+	list, err := s.c.ClusterJobList()
+	c.Assert(err, IsNil)
+	var found bool
+	for _, job := range list {
+		c.Assert(job.ID, Not(Equals), "host0-cluster-job-down")
+		if job.ID == "host0-cluster-job-up" {
+			found = true
+			c.Assert(job.HostID, Equals, "host0")
+			c.Assert(job.AppID, Equals, app.ID)
+			c.Assert(job.ReleaseID, Equals, release.ID)
+			c.Assert(job.Type, Equals, "web")
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	// app scoped tokens can't list the jobs of other apps
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "cluster-job-list", Scope: ct.AuthTokenScopeApp, AppID: app.ID})
+	c.Assert(s.authTokenStatus(c, token, "GET", "/jobs"), Equals, 403)
+}
+
 func (s *S) TestJobGet(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "job-get"})
 	release := s.createTestRelease(c, &ct.Release{})
@@ -66,6 +95,51 @@ func (l *fakeLog) Write([]byte) (int, error) {
 	return 0, io.ErrUnexpectedEOF
 }
 
+func (s *S) TestStreamJobEventsResume(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "stream-job-events-resume"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+
+	events := make(chan *ct.JobEvent)
+	stream, err := s.c.StreamJobEvents(app.ID, 0, events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	waitForEvent := func(events chan *ct.JobEvent, jobID, state string) *ct.JobEvent {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					c.Fatal("job event stream closed unexpectedly")
+				}
+				if e.JobID == jobID && e.State == state {
+					return e
+				}
+			case <-timeout:
+				c.Fatalf("timed out waiting for %s %s event", jobID, state)
+			}
+		}
+	}
+
+	s.createTestJob(c, &ct.Job{ID: "host0-resume0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	first := waitForEvent(events, "host0-resume0", "starting")
+	s.createTestJob(c, &ct.Job{ID: "host0-resume0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	second := waitForEvent(events, "host0-resume0", "up")
+	c.Assert(second.ID > first.ID, Equals, true)
+
+	// resuming from the first event replays the second, then streams new
+	// events
+	resumed := make(chan *ct.JobEvent)
+	stream2, err := s.c.StreamJobEvents(app.ID, first.ID, resumed)
+	c.Assert(err, IsNil)
+	defer stream2.Close()
+	e := waitForEvent(resumed, "host0-resume0", "up")
+	c.Assert(e.ID, Equals, second.ID)
+	s.createTestJob(c, &ct.Job{ID: "host0-resume0", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "down"})
+	e = waitForEvent(resumed, "host0-resume0", "down")
+	c.Assert(e.ID > second.ID, Equals, true)
+}
+
 func (s *S) TestKillJob(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "killjob"})
 	hostID, jobID := random.UUID(), random.UUID()
@@ -74,6 +148,18 @@ func (s *S) TestKillJob(c *C) {
 
 	c.Assert(s.c.DeleteJob(app.ID, hostID+"-"+jobID), IsNil)
 	c.Assert(hc.IsStopped(jobID), Equals, true)
+	c.Assert(hc.StopOptions(jobID), IsNil)
+
+	jobID = random.UUID()
+	opts := &host.StopOptions{Signal: "QUIT", GracePeriod: 30 * time.Second}
+	c.Assert(s.c.StopJob(app.ID, hostID+"-"+jobID, opts), IsNil)
+	c.Assert(hc.IsStopped(jobID), Equals, true)
+	c.Assert(hc.StopOptions(jobID), DeepEquals, opts)
+
+	// unknown signals are rejected
+	jobID = random.UUID()
+	c.Assert(s.c.StopJob(app.ID, hostID+"-"+jobID, &host.StopOptions{Signal: "HUP"}), NotNil)
+	c.Assert(hc.IsStopped(jobID), Equals, false)
 }
 
 func (s *S) createLogTestApp(c *C, name string, stream io.Reader) (*ct.App, string, string) {
@@ -98,6 +184,34 @@ func (s *S) TestJobLog(c *C) {
 	c.Assert(buf.String(), Equals, "foo")
 }
 
+func (s *S) TestJobLogOptions(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "joblog-options"})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	since := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	hc.SetAttachFunc(jobID, func(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
+		c.Assert(req.Flags, Equals, host.AttachFlagStdout|host.AttachFlagStderr|host.AttachFlagLogs|host.AttachFlagStream)
+		c.Assert(req.Lines, Equals, 10)
+		c.Assert(req.Since, NotNil)
+		c.Assert(req.Since.Equal(since), Equals, true)
+		return cluster.NewAttachClient(newFakeLog(strings.NewReader("foo"))), nil
+	})
+	s.cc.SetHostClient(hostID, hc)
+
+	res, err := s.c.GetJobLogWithOptions(app.ID, hostID+"-"+jobID, &ct.JobLogOptions{Follow: true, Lines: 10, Since: &since})
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(res)
+	res.Close()
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, "foo")
+
+	_, err = s.c.RawReq("GET", fmt.Sprintf("/apps/%s/jobs/%s-%s/log?lines=-1", app.ID, hostID, jobID), nil, nil, nil)
+	c.Assert(err, NotNil)
+	_, err = s.c.RawReq("GET", fmt.Sprintf("/apps/%s/jobs/%s-%s/log?lines=%d", app.ID, hostID, jobID, logbuf.MaxLines+1), nil, nil, nil)
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestJobLogWait(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "joblog-wait"})
 	hostID, jobID := random.UUID(), random.UUID()
@@ -225,6 +339,31 @@ func (s *S) TestRunJobDetached(c *C) {
 	c.Assert(job.Config.Stdin, Equals, false)
 }
 
+func (s *S) TestRunJobOverrides(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "run-overrides"})
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	release := s.createTestRelease(c, &ct.Release{})
+
+	_, err := s.c.RunJobDetached(app.ID, &ct.NewJob{
+		ReleaseID:  release.ID,
+		Entrypoint: []string{"/bin/sh"},
+		Cmd:        []string{"-c", "ls"},
+		WorkingDir: "/app",
+		User:       "nobody",
+	})
+	c.Assert(err, IsNil)
+	job := s.cc.GetHost(hostID).Jobs[0]
+	c.Assert(job.Config.Entrypoint, DeepEquals, []string{"/bin/sh"})
+	c.Assert(job.Config.Cmd, DeepEquals, []string{"-c", "ls"})
+	c.Assert(job.Config.WorkingDir, Equals, "/app")
+	c.Assert(job.Config.User, Equals, "nobody")
+
+	_, err = s.c.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: release.ID, WorkingDir: "app"})
+	c.Assert(err, NotNil)
+}
+
 func (s *S) TestRunJobAttached(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "run-attached"})
 	hostID := random.UUID()
@@ -296,3 +435,58 @@ func (s *S) TestRunJobAttached(c *C) {
 	c.Assert(job.Config.Env, DeepEquals, map[string]string{"FOO": "baz", "JOB": "true", "RELEASE": "true"})
 	c.Assert(job.Config.Stdin, Equals, true)
 }
+
+func (s *S) TestAttachJob(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "attach-job"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	hostID, jobID := "attachhost", random.UUID()
+	s.createTestJob(c, &ct.Job{ID: hostID + "-" + jobID, AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	hc := tu.NewFakeHostClient(hostID)
+
+	done := make(chan struct{})
+	hc.SetAttachFunc(jobID, func(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
+		c.Assert(wait, Equals, false)
+		c.Assert(req, DeepEquals, &host.AttachReq{
+			JobID:  jobID,
+			Flags:  host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagStream | host.AttachFlagStdin | host.AttachFlagLogs,
+			Height: 20,
+			Width:  10,
+		})
+		pipeR, pipeW := io.Pipe()
+		go func() {
+			stdin, err := ioutil.ReadAll(pipeR)
+			c.Assert(err, IsNil)
+			c.Assert(string(stdin), Equals, "test in")
+			close(done)
+		}()
+		return cluster.NewAttachClient(struct {
+			io.Reader
+			io.WriteCloser
+		}{strings.NewReader("test out"), pipeW}), nil
+	})
+	s.cc.SetHostClient(hostID, hc)
+
+	rwc, err := s.c.AttachJob(app.ID, hostID+"-"+jobID, &ct.JobAttachOptions{Stdin: true, Logs: true, Height: 20, Width: 10})
+	c.Assert(err, IsNil)
+	_, err = rwc.Write([]byte("test in"))
+	c.Assert(err, IsNil)
+	rwc.CloseWrite()
+	stdout, err := ioutil.ReadAll(rwc)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "test out")
+	rwc.Close()
+	<-done
+
+	// jobs of other apps can't be attached to
+	other := s.createTestApp(c, &ct.App{Name: "attach-job-other"})
+	_, err = s.c.AttachJob(other.ID, hostID+"-"+jobID, &ct.JobAttachOptions{})
+	c.Assert(err, NotNil)
+
+	// jobs which aren't running can't be attached to
+	hc.SetAttachFunc(jobID, func(*host.AttachReq, bool) (cluster.AttachClient, error) {
+		return nil, cluster.ErrWouldWait
+	})
+	_, err = s.c.AttachJob(app.ID, hostID+"-"+jobID, &ct.JobAttachOptions{})
+	c.Assert(err, NotNil)
+}
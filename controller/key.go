@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
-	"errors"
+	"net/http"
+	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 )
 
@@ -21,65 +26,160 @@ func NewKeyRepo(db *postgres.DB) *KeyRepo {
 	return &KeyRepo{db}
 }
 
-func (r *KeyRepo) Add(data interface{}) error {
-	key := data.(*ct.Key)
-
+// parseKey validates the public key of key and sets its fingerprint. The
+// comment of the public key is used if key has no comment.
+func parseKey(key *ct.Key) error {
 	if key.Key == "" {
-		return errors.New("controller: key must not be blank")
+		return ct.ValidationError{Field: "key", Message: "must not be blank"}
 	}
 
 	pubKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
 	if err != nil {
-		return err
+		return ct.ValidationError{Field: "key", Message: "is not a valid public key"}
 	}
 
 	key.ID = fingerprintKey(pubKey.Marshal())
 	key.Key = string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(pubKey)))
-	key.Comment = comment
+	if key.Comment == "" {
+		key.Comment = comment
+	}
+	return nil
+}
+
+func (r *KeyRepo) Add(data interface{}) error {
+	key := data.(*ct.Key)
+	if err := parseKey(key); err != nil {
+		return err
+	}
 
-	err = r.db.QueryRow("INSERT INTO keys (fingerprint, key, comment) VALUES ($1, $2, $3) RETURNING created_at", key.ID, key.Key, key.Comment).Scan(&key.CreatedAt)
+	err := r.db.QueryRow("INSERT INTO keys (fingerprint, key, comment, labels) VALUES ($1, $2, $3, $4) RETURNING created_at",
+		key.ID, key.Key, key.Comment, metaToHstore(key.Labels)).Scan(&key.CreatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
 		return nil
 	}
 	return err
 }
 
+// AddAll adds the keys in a single transaction, keys which already exist are
+// left unchanged.
+func (r *KeyRepo) AddAll(data interface{}) error {
+	keys := data.([]*ct.Key)
+	for i, key := range keys {
+		if err := parseKey(key); err != nil {
+			return indexValidationError(i, err)
+		}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		existing, err := scanKey(tx.QueryRow("SELECT fingerprint, key, comment, labels, created_at FROM keys WHERE fingerprint = $1 AND deleted_at IS NULL", key.ID))
+		if err == nil {
+			*key = *existing
+			continue
+		} else if err != ErrNotFound {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.QueryRow("INSERT INTO keys (fingerprint, key, comment, labels) VALUES ($1, $2, $3, $4) RETURNING created_at",
+			key.ID, key.Key, key.Comment, metaToHstore(key.Labels)).Scan(&key.CreatedAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func fingerprintKey(key []byte) string {
 	digest := md5.Sum(key)
 	return hex.EncodeToString(digest[:])
 }
 
+// normalizeFingerprint converts an MD5 fingerprint in the format printed by
+// ssh-keygen (e.g. "MD5:d4:1d:8c:...") to the format of key IDs.
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(fingerprint, "MD5:")
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
 func scanKey(s postgres.Scanner) (*ct.Key, error) {
 	key := &ct.Key{}
-	err := s.Scan(&key.ID, &key.Key, &key.Comment, &key.CreatedAt)
+	var comment *string
+	var labels hstore.Hstore
+	err := s.Scan(&key.ID, &key.Key, &comment, &labels, &key.CreatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
+	if comment != nil {
+		key.Comment = *comment
+	}
+	if len(labels.Map) > 0 {
+		key.Labels = make(map[string]string, len(labels.Map))
+		for k, v := range labels.Map {
+			key.Labels[k] = v.String
+		}
+	}
 	return key, err
 }
 
+// Get returns the key with the given fingerprint.
 func (r *KeyRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT fingerprint, key, comment, created_at FROM keys WHERE fingerprint = $1 AND deleted_at IS NULL", id)
+	row := r.db.QueryRow("SELECT fingerprint, key, comment, labels, created_at FROM keys WHERE fingerprint = $1 AND deleted_at IS NULL", normalizeFingerprint(id))
 	return scanKey(row)
 }
 
+// GetKeyByFingerprint serves GET /keys/fingerprint/:fingerprint. The router
+// can't tell the fingerprint segment apart from the :keys_id wildcard of the
+// keys routes, so any other segment is not found.
+func (c *controllerAPI) GetKeyByFingerprint(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	if params.ByName("keys_id") != "fingerprint" {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	key, err := c.keyRepo.Get(params.ByName("fingerprint"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, key)
+}
+
 func (r *KeyRepo) Remove(id string) error {
-	return r.db.Exec("UPDATE keys SET deleted_at = now() WHERE fingerprint = $1 AND deleted_at IS NULL", id)
+	return r.db.Exec("UPDATE keys SET deleted_at = now() WHERE fingerprint = $1 AND deleted_at IS NULL", normalizeFingerprint(id))
 }
 
-func (r *KeyRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT fingerprint, key, comment, created_at FROM keys WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *KeyRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	query := "SELECT fingerprint, key, comment, labels, created_at FROM keys WHERE deleted_at IS NULL"
+	var args []interface{}
+	if len(opts.Labels) > 0 {
+		query += " AND labels @> $1"
+		args = append(args, metaToHstore(opts.Labels))
+	}
+	query, args = opts.query(query, "fingerprint", args...)
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	keys := []*ct.Key{}
 	for rows.Next() {
 		key, err := scanKey(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, nil, err
 		}
 		keys = append(keys, key)
 	}
-	return keys, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(keys)) {
+		keys = keys[:opts.Limit]
+		last := keys[len(keys)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return keys, next, nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	logaggc "github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/logaggregator/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+// AppLog streams the log of the app from the log aggregator, which has the
+// output of all of the app's jobs in the order it was written. Messages are
+// sent as newline separated JSON objects, or as "message" events if the
+// client accepts an event stream.
+func (c *controllerAPI) AppLog(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	opts := &logagg.LogOpts{Follow: req.FormValue("follow") == "true"}
+	if s := req.FormValue("lines"); s != "" {
+		lines, err := strconv.Atoi(s)
+		if err != nil || lines < 1 {
+			respondWithError(w, ct.ValidationError{Field: "lines", Message: "must be a positive integer"})
+			return
+		}
+		opts.Lines = lines
+	}
+
+	rc, err := c.logaggc.GetLog(c.getApp(ctx).ID, opts)
+	if err == logaggc.ErrNotFound {
+		// the app hasn't written anything yet
+		rc, err = emptyLog{}, nil
+	}
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if cn, ok := w.(http.CloseNotifier); ok {
+		go func() {
+			<-cn.CloseNotify()
+			rc.Close()
+		}()
+	} else {
+		defer rc.Close()
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		ch := make(chan *sseLogChunk)
+		l, _ := ctxhelper.LoggerFromContext(ctx)
+		s := sse.NewStream(w, ch, l)
+		defer s.Close()
+		s.Serve()
+		dec := json.NewDecoder(rc)
+		for {
+			var msg json.RawMessage
+			if err := dec.Decode(&msg); err != nil {
+				break
+			}
+			ch <- &sseLogChunk{Event: "message", Data: msg}
+		}
+		ch <- &sseLogChunk{Event: "eof"}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	if wf, ok := w.(http.Flusher); ok && opts.Follow {
+		wf.Flush()
+	}
+	io.Copy(httphelper.FlushWriter{Writer: w, Enabled: opts.Follow}, rc)
+}
+
+type emptyLog struct{}
+
+func (emptyLog) Read([]byte) (int, error) { return 0, io.EOF }
+func (emptyLog) Close() error             { return nil }
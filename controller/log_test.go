@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	logaggc "github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/logaggregator/types"
+)
+
+func newFakeLogAggregator() *fakeLogAggregator {
+	return &fakeLogAggregator{messages: make(map[string][]*logagg.Message)}
+}
+
+// fakeLogAggregator is an in-memory log aggregator which serves the messages
+// added with Add.
+type fakeLogAggregator struct {
+	mtx      sync.RWMutex
+	messages map[string][]*logagg.Message
+}
+
+func (l *fakeLogAggregator) Add(msg *logagg.Message) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.messages[msg.AppID] = append(l.messages[msg.AppID], msg)
+}
+
+func (l *fakeLogAggregator) GetLog(appID string, opts *logagg.LogOpts) (io.ReadCloser, error) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	messages, ok := l.messages[appID]
+	if !ok {
+		return nil, logaggc.ErrNotFound
+	}
+	if opts != nil && opts.Lines > 0 && opts.Lines < len(messages) {
+		messages = messages[len(messages)-opts.Lines:]
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, msg := range messages {
+		enc.Encode(msg)
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (l *fakeLogAggregator) Forward(msgs <-chan *logagg.Message) error {
+	for msg := range msgs {
+		l.Add(msg)
+	}
+	return nil
+}
+
+func (s *S) TestAppLog(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-log"})
+
+	readLog := func(opts *logagg.LogOpts) []string {
+		rc, err := s.c.GetAppLog(app.ID, opts)
+		c.Assert(err, IsNil)
+		defer rc.Close()
+		var lines []string
+		dec := json.NewDecoder(rc)
+		for {
+			msg := &logagg.Message{}
+			err := dec.Decode(msg)
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			c.Assert(msg.AppID, Equals, app.ID)
+			lines = append(lines, msg.Msg)
+		}
+		return lines
+	}
+
+	// apps which haven't written anything have an empty log
+	c.Assert(readLog(nil), HasLen, 0)
+
+	now := time.Now().UTC()
+	for i, line := range []string{"one", "two", "three"} {
+		s.logagg.Add(&logagg.Message{
+			AppID:       app.ID,
+			JobID:       "host-job",
+			ProcessType: "web",
+			Stream:      logagg.StreamStdout,
+			Timestamp:   now.Add(time.Duration(i) * time.Second),
+			Msg:         line,
+		})
+	}
+	c.Assert(readLog(nil), DeepEquals, []string{"one", "two", "three"})
+	c.Assert(readLog(&logagg.LogOpts{Lines: 2}), DeepEquals, []string{"two", "three"})
+}
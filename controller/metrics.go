@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// GetAppMetrics samples the resource utilization of the app's running jobs
+// from each host they run on. Jobs on hosts which can't be reached are left
+// out.
+func (c *controllerAPI) GetAppMetrics(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	app := c.getApp(ctx)
+	hosts, err := c.clusterClient.ListHosts()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	metrics := &ct.AppMetrics{
+		AppID:     app.ID,
+		Time:      time.Now().UTC(),
+		Processes: make(map[string]*host.ResourceUsage),
+		Jobs:      []*ct.JobMetrics{},
+	}
+	for _, h := range hosts {
+		jobs := make(map[string]*host.Job)
+		for _, job := range h.Jobs {
+			if job.Metadata["flynn-controller.app"] == app.ID {
+				jobs[job.ID] = job
+			}
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		client, err := c.clusterClient.DialHost(h.ID)
+		if err != nil {
+			log.Printf("Unable to connect to host %s: %s", h.ID, err)
+			continue
+		}
+		hostMetrics, err := client.Metrics()
+		if err != nil {
+			log.Printf("Unable to get metrics of host %s: %s", h.ID, err)
+			continue
+		}
+		for id, job := range jobs {
+			usage, ok := hostMetrics.Jobs[id]
+			if !ok {
+				continue
+			}
+			typ := job.Metadata["flynn-controller.type"]
+			metrics.Jobs = append(metrics.Jobs, &ct.JobMetrics{
+				JobID:         h.ID + "-" + id,
+				HostID:        h.ID,
+				ReleaseID:     job.Metadata["flynn-controller.release"],
+				Type:          typ,
+				ResourceUsage: *usage,
+			})
+			if _, ok := metrics.Processes[typ]; !ok {
+				metrics.Processes[typ] = &host.ResourceUsage{}
+			}
+			addUsage(metrics.Processes[typ], usage)
+			addUsage(&metrics.Total, usage)
+		}
+	}
+	sort.Sort(sortedJobMetrics(metrics.Jobs))
+	httphelper.JSON(w, 200, metrics)
+}
+
+func addUsage(total, usage *host.ResourceUsage) {
+	total.CPUTime += usage.CPUTime
+	total.Memory += usage.Memory
+	total.Disk += usage.Disk
+	total.NetRxBytes += usage.NetRxBytes
+	total.NetTxBytes += usage.NetTxBytes
+}
+
+type sortedJobMetrics []*ct.JobMetrics
+
+func (s sortedJobMetrics) Len() int           { return len(s) }
+func (s sortedJobMetrics) Less(i, j int) bool { return s[i].JobID < s[j].JobID }
+func (s sortedJobMetrics) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
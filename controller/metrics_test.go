@@ -0,0 +1,43 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestAppMetrics(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "metrics"})
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+
+	meta := func(typ string) map[string]string {
+		return map[string]string{"flynn-controller.app": app.ID, "flynn-controller.type": typ}
+	}
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID, Jobs: []*host.Job{
+		{ID: "web1", Metadata: meta("web")},
+		{ID: "web2", Metadata: meta("web")},
+		{ID: "worker", Metadata: meta("worker")},
+		{ID: "other", Metadata: map[string]string{"flynn-controller.app": random.UUID()}},
+	}}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	hc.SetMetrics(&host.HostMetrics{HostID: hostID, Jobs: map[string]*host.ResourceUsage{
+		"web1":   {CPUTime: 10, Memory: 100},
+		"web2":   {CPUTime: 20, Memory: 200},
+		"worker": {CPUTime: 5, Memory: 50, NetRxBytes: 7},
+		"other":  {CPUTime: 1000, Memory: 1000},
+	}})
+
+	metrics, err := s.c.AppMetrics(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(metrics.AppID, Equals, app.ID)
+	c.Assert(metrics.Jobs, HasLen, 3)
+	c.Assert(metrics.Jobs[0].JobID, Equals, hostID+"-web1")
+	c.Assert(metrics.Jobs[0].Type, Equals, "web")
+	c.Assert(metrics.Processes["web"], DeepEquals, &host.ResourceUsage{CPUTime: 30, Memory: 300})
+	c.Assert(metrics.Processes["worker"], DeepEquals, &host.ResourceUsage{CPUTime: 5, Memory: 50, NetRxBytes: 7})
+	c.Assert(metrics.Total, DeepEquals, host.ResourceUsage{CPUTime: 35, Memory: 350, NetRxBytes: 7})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// ListMigrations responds with the status of the database migrations, which
+// includes those applied by a newer controller.
+func (c *controllerAPI) ListMigrations(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	statuses, err := migrations().Status(c.appRepo.db.DB)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	list := make([]*ct.MigrationStatus, len(statuses))
+	for i, s := range statuses {
+		list[i] = &ct.MigrationStatus{
+			ID:         s.ID,
+			Applied:    s.Applied,
+			Known:      s.Known,
+			Reversible: s.Reversible,
+		}
+	}
+	httphelper.JSON(w, 200, list)
+}
+
+// RollbackMigrations reverts the migrations applied after the requested
+// version, so that an older controller can be run against the database. The
+// running controller expects the current schema, so it should be replaced
+// with the older version straight after a rollback. With dry_run set, the
+// down migrations are run and then rolled back, which checks that they
+// succeed.
+func (c *controllerAPI) RollbackMigrations(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var rollback ct.MigrationRollback
+	if err := httphelper.DecodeJSON(req, &rollback); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if rollback.Version < 1 {
+		respondWithError(w, ct.ValidationError{Field: "version", Message: "must be at least 1"})
+		return
+	}
+
+	m := migrations()
+	statuses, err := m.Status(c.appRepo.db.DB)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	for _, s := range statuses {
+		if !s.Applied || s.ID <= rollback.Version {
+			continue
+		}
+		if !s.Known {
+			respondWithError(w, ct.ValidationError{Field: "version", Message: fmt.Sprintf("migration %d was applied by a newer controller and can't be rolled back", s.ID)})
+			return
+		}
+		if !s.Reversible {
+			respondWithError(w, ct.ValidationError{Field: "version", Message: fmt.Sprintf("migration %d can't be rolled back", s.ID)})
+			return
+		}
+	}
+
+	ids, err := m.Rollback(c.appRepo.db.DB, rollback.Version, rollback.DryRun)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	rollback.Migrations = ids
+	if rollback.Migrations == nil {
+		rollback.Migrations = []int{}
+	}
+	httphelper.JSON(w, 200, &rollback)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestMigrations(c *C) {
+	list, err := s.c.MigrationList()
+	c.Assert(err, IsNil)
+	c.Assert(len(list) > 0, Equals, true)
+	for _, m := range list {
+		c.Assert(m.Applied, Equals, true)
+		c.Assert(m.Known, Equals, true)
+	}
+	latest := list[len(list)-1]
+	c.Assert(latest.Reversible, Equals, true)
+
+	// a dry run reverts nothing
+	ids, err := s.c.RollbackMigrations(latest.ID-1, true)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int{latest.ID})
+	list, err = s.c.MigrationList()
+	c.Assert(err, IsNil)
+	c.Assert(list[len(list)-1].Applied, Equals, true)
+	_, err = s.c.GetApp(s.createTestApp(c, &ct.App{Name: "migrations-dry-run"}).ID)
+	c.Assert(err, IsNil)
+
+	// migrations without down migrations can't be rolled back
+	_, err = s.c.RollbackMigrations(1, true)
+	c.Assert(err, NotNil)
+}
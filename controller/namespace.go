@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+type NamespaceRepo struct {
+	db *postgres.DB
+}
+
+func NewNamespaceRepo(db *postgres.DB) *NamespaceRepo {
+	return &NamespaceRepo{db}
+}
+
+func (r *NamespaceRepo) Add(data interface{}) error {
+	ns := data.(*ct.Namespace)
+	if len(ns.Name) > 100 || !appNamePattern.MatchString(ns.Name) {
+		return ct.ValidationError{Field: "name", Message: "is invalid"}
+	}
+	if ns.ID == "" {
+		ns.ID = random.UUID()
+	}
+	err := r.db.QueryRow("INSERT INTO namespaces (namespace_id, name) VALUES ($1, $2) RETURNING created_at", ns.ID, ns.Name).Scan(&ns.CreatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ct.ValidationError{Field: "name", Message: "is already in use"}
+	}
+	ns.ID = postgres.CleanUUID(ns.ID)
+	return err
+}
+
+func scanNamespace(s postgres.Scanner) (*ct.Namespace, error) {
+	ns := &ct.Namespace{}
+	err := s.Scan(&ns.ID, &ns.Name, &ns.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	ns.ID = postgres.CleanUUID(ns.ID)
+	return ns, err
+}
+
+func (r *NamespaceRepo) Get(id string) (interface{}, error) {
+	var row postgres.Scanner
+	query := "SELECT namespace_id, name, created_at FROM namespaces WHERE "
+	if idPattern.MatchString(id) {
+		row = r.db.QueryRow(query+"(namespace_id = $1 OR name = $2) LIMIT 1", id, id)
+	} else {
+		row = r.db.QueryRow(query+"name = $1", id)
+	}
+	return scanNamespace(row)
+}
+
+func (r *NamespaceRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	query, args := opts.query("SELECT namespace_id, name, created_at FROM namespaces WHERE true", "namespace_id")
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	namespaces := []*ct.Namespace{}
+	for rows.Next() {
+		ns, err := scanNamespace(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(namespaces)) {
+		namespaces = namespaces[:opts.Limit]
+		last := namespaces[len(namespaces)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return namespaces, next, nil
+}
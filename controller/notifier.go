@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+)
+
+// notificationBufferSize is the buffer size of subscriber channels, a
+// subscriber which falls further behind is unsubscribed.
+const notificationBufferSize = 100
+
+// notifier shares a single postgres listener between all subscribers to
+// notification channels, so that each streaming request doesn't need its own
+// database connection.
+type notifier struct {
+	dsn string
+
+	mtx       sync.Mutex
+	listener  *pq.Listener
+	listening map[string]*listenState
+	subs      map[string]map[chan *pq.Notification]struct{}
+}
+
+type listenState struct {
+	ready chan struct{}
+	err   error
+}
+
+func newNotifier(dsn string) *notifier {
+	return &notifier{
+		dsn:       dsn,
+		listening: make(map[string]*listenState),
+		subs:      make(map[string]map[chan *pq.Notification]struct{}),
+	}
+}
+
+// Subscribe sends notifications on channel to ch. It returns once the
+// listener is listening on channel, so notifications sent after it returns
+// will not be missed.
+//
+// ch is closed if notifications may have been missed, either because the
+// database connection was lost or because ch was full, so it should be
+// buffered and subscribers should resume from their last known state.
+func (n *notifier) Subscribe(channel string, ch chan *pq.Notification) error {
+	n.mtx.Lock()
+	if n.listener == nil {
+		n.listener = pq.NewListener(n.dsn, 10*time.Second, time.Minute, nil)
+		go n.run(n.listener)
+	}
+	if n.subs[channel] == nil {
+		n.subs[channel] = make(map[chan *pq.Notification]struct{})
+	}
+	n.subs[channel][ch] = struct{}{}
+
+	// channels are never unlistened, as that could race with a new
+	// subscription to the same channel
+	state, ok := n.listening[channel]
+	if !ok {
+		state = &listenState{ready: make(chan struct{})}
+		n.listening[channel] = state
+		// the lock must not be held while listening, as notifications need
+		// to be delivered for the listen request to complete
+		go n.listen(n.listener, channel, state)
+	}
+	n.mtx.Unlock()
+
+	<-state.ready
+	if state.err != nil {
+		n.Unsubscribe(channel, ch)
+	}
+	return state.err
+}
+
+func (n *notifier) listen(listener *pq.Listener, channel string, state *listenState) {
+	err := listener.Listen(channel)
+	if err != nil && err != pq.ErrChannelAlreadyOpen {
+		n.mtx.Lock()
+		delete(n.listening, channel)
+		n.mtx.Unlock()
+		state.err = err
+	}
+	close(state.ready)
+}
+
+// Unsubscribe stops sending notifications on channel to ch.
+func (n *notifier) Unsubscribe(channel string, ch chan *pq.Notification) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	delete(n.subs[channel], ch)
+}
+
+func (n *notifier) run(listener *pq.Listener) {
+	for notification := range listener.Notify {
+		n.mtx.Lock()
+		if notification == nil {
+			// the connection was re-established, so notifications may
+			// have been missed
+			for channel, subs := range n.subs {
+				for ch := range subs {
+					close(ch)
+				}
+				delete(n.subs, channel)
+			}
+			n.mtx.Unlock()
+			continue
+		}
+		for ch := range n.subs[notification.Channel] {
+			select {
+			case ch <- notification:
+			default:
+				// don't block other subscribers on a slow one
+				close(ch)
+				delete(n.subs[notification.Channel], ch)
+			}
+		}
+		n.mtx.Unlock()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+)
+
+func (s *S) TestNotifier(c *C) {
+	n := newNotifier(s.hc.db.DSN())
+
+	receive := func(ch chan *pq.Notification) *pq.Notification {
+		select {
+		case notification, ok := <-ch:
+			c.Assert(ok, Equals, true)
+			return notification
+		case <-time.After(5 * time.Second):
+			c.Fatal("timed out waiting for notification")
+		}
+		return nil
+	}
+
+	// subscribers to the same channel share the listener
+	ch1 := make(chan *pq.Notification, notificationBufferSize)
+	ch2 := make(chan *pq.Notification, notificationBufferSize)
+	c.Assert(n.Subscribe("notifier_test", ch1), IsNil)
+	c.Assert(n.Subscribe("notifier_test", ch2), IsNil)
+	c.Assert(s.hc.db.Exec("SELECT pg_notify('notifier_test', 'foo')"), IsNil)
+	c.Assert(receive(ch1).Extra, Equals, "foo")
+	c.Assert(receive(ch2).Extra, Equals, "foo")
+
+	// unsubscribed channels don't receive notifications
+	n.Unsubscribe("notifier_test", ch1)
+	c.Assert(s.hc.db.Exec("SELECT pg_notify('notifier_test', 'bar')"), IsNil)
+	c.Assert(receive(ch2).Extra, Equals, "bar")
+	select {
+	case <-ch1:
+		c.Fatal("received notification after unsubscribing")
+	default:
+	}
+
+	// slow subscribers are closed rather than blocking others
+	slow := make(chan *pq.Notification)
+	c.Assert(n.Subscribe("notifier_test", slow), IsNil)
+	c.Assert(s.hc.db.Exec("SELECT pg_notify('notifier_test', 'baz')"), IsNil)
+	c.Assert(receive(ch2).Extra, Equals, "baz")
+	_, ok := <-slow
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/secrets"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+const (
+	// operationHeartbeatInterval is how often the updated_at time of a running
+	// operation is bumped by the controller running it.
+	operationHeartbeatInterval = 30 * time.Second
+
+	// operationStaleAfter is how long a running operation can go without a
+	// heartbeat before it is assumed the controller running it has exited.
+	operationStaleAfter = 5 * time.Minute
+
+	// operationRetention is how long finished operations are kept so that
+	// clients can fetch their results.
+	operationRetention = 24 * time.Hour
+)
+
+type OperationRepo struct {
+	db       *postgres.DB
+	notifier *notifier
+	secrets  *secrets.Key
+}
+
+// NewOperationRepo returns an OperationRepo which seals the results of
+// operations with secretsKey, they are stored in plaintext if it is nil.
+func NewOperationRepo(db *postgres.DB, notifier *notifier, secretsKey *secrets.Key) *OperationRepo {
+	return &OperationRepo{db: db, notifier: notifier, secrets: secretsKey}
+}
+
+func (r *OperationRepo) Add(op *ct.Operation) error {
+	if op.ID == "" {
+		op.ID = random.UUID()
+	}
+	var appID *string
+	if op.AppID != "" {
+		appID = &op.AppID
+	}
+	op.Status = ct.OperationStatusRunning
+	err := r.db.QueryRow("INSERT INTO operations (operation_id, type, app_id, status) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at",
+		op.ID, op.Type, appID, op.Status).Scan(&op.CreatedAt, &op.UpdatedAt)
+	op.ID = postgres.CleanUUID(op.ID)
+	return err
+}
+
+func (r *OperationRepo) Get(id string) (*ct.Operation, error) {
+	row := r.db.QueryRow("SELECT operation_id, type, app_id, status, result, error, created_at, updated_at FROM operations WHERE operation_id = $1", id)
+	op, err := scanOperation(row)
+	if err != nil {
+		return nil, err
+	}
+	if op.Result != nil {
+		result, err := secrets.OpenValue(r.secrets, secrets.OperationContext(op.ID), string(op.Result))
+		if err != nil {
+			return nil, err
+		}
+		op.Result = json.RawMessage(result)
+	}
+	return op, nil
+}
+
+// Complete marks the operation as complete with the given result, which is
+// sealed as it may contain credentials.
+func (r *OperationRepo) Complete(id string, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return r.Fail(id, err)
+	}
+	stored := string(data)
+	if r.secrets != nil {
+		stored = r.secrets.Seal(secrets.OperationContext(id), stored)
+	}
+	return r.db.Exec("UPDATE operations SET status = $2, result = $3, updated_at = now() WHERE operation_id = $1", id, ct.OperationStatusComplete, stored)
+}
+
+// Fail marks the operation as failed with the message of opErr.
+func (r *OperationRepo) Fail(id string, opErr error) error {
+	return r.db.Exec("UPDATE operations SET status = $2, error = $3, updated_at = now() WHERE operation_id = $1", id, ct.OperationStatusFailed, operationErrorMessage(opErr))
+}
+
+// Heartbeat bumps the updated_at time of the operation if it is still running.
+func (r *OperationRepo) Heartbeat(id string) error {
+	return r.db.Exec("UPDATE operations SET updated_at = now() WHERE operation_id = $1 AND status = $2", id, ct.OperationStatusRunning)
+}
+
+// ReapStale marks running operations which haven't had a heartbeat since
+// before cutoff as failed, and returns how many were marked.
+func (r *OperationRepo) ReapStale(cutoff time.Time) (int, error) {
+	var n int
+	err := r.db.QueryRow(`
+WITH reaped AS (
+  UPDATE operations SET status = $1, error = $2, updated_at = now()
+  WHERE status = $3 AND updated_at < $4
+  RETURNING operation_id
+)
+SELECT count(*) FROM reaped`,
+		ct.OperationStatusFailed, errOperationInterrupted, ct.OperationStatusRunning, cutoff).Scan(&n)
+	return n, err
+}
+
+const errOperationInterrupted = "the operation was interrupted, it may need to be retried"
+
+// RemoveFinished deletes complete and failed operations which finished before
+// cutoff, and returns how many were deleted.
+func (r *OperationRepo) RemoveFinished(cutoff time.Time) (int, error) {
+	var n int
+	err := r.db.QueryRow(`
+WITH removed AS (
+  DELETE FROM operations
+  WHERE status <> $1 AND updated_at < $2
+  RETURNING operation_id
+)
+SELECT count(*) FROM removed`,
+		ct.OperationStatusRunning, cutoff).Scan(&n)
+	return n, err
+}
+
+// operationReaper periodically fails operations which were left running by a
+// controller which exited before they finished, and deletes operations which
+// finished more than operationRetention ago.
+type operationReaper struct {
+	repo     *OperationRepo
+	interval time.Duration
+}
+
+func (o *operationReaper) Run() {
+	for range time.Tick(o.interval) {
+		n, err := o.repo.ReapStale(time.Now().Add(-operationStaleAfter))
+		if err != nil {
+			log.Printf("Error failing stale operations: %s", err)
+		}
+		if n > 0 {
+			log.Printf("Failed %d stale operations", n)
+		}
+		n, err = o.repo.RemoveFinished(time.Now().Add(-operationRetention))
+		if err != nil {
+			log.Printf("Error removing finished operations: %s", err)
+		}
+		if n > 0 {
+			log.Printf("Removed %d finished operations", n)
+		}
+	}
+}
+
+// operationErrorMessage returns the message of err which is safe to return
+// to clients, unknown errors are logged by respondWithError for synchronous
+// requests so they are not exposed here either.
+func operationErrorMessage(err error) string {
+	switch e := err.(type) {
+	case ct.ValidationError:
+		return e.Error()
+	case httphelper.JSONError:
+		return e.Message
+	case *httphelper.JSONError:
+		return e.Message
+	}
+	if err == ErrNotFound {
+		return "not found"
+	}
+	return "Something went wrong"
+}
+
+func scanOperation(s postgres.Scanner) (*ct.Operation, error) {
+	op := &ct.Operation{}
+	var appID, result, opErr *string
+	err := s.Scan(&op.ID, &op.Type, &appID, &op.Status, &result, &opErr, &op.CreatedAt, &op.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	op.ID = postgres.CleanUUID(op.ID)
+	if appID != nil {
+		op.AppID = postgres.CleanUUID(*appID)
+	}
+	if result != nil {
+		op.Result = json.RawMessage(*result)
+	}
+	if opErr != nil {
+		op.Error = *opErr
+	}
+	return op, nil
+}
+
+// runOperation starts an operation of the given type which runs fn in the
+// background, storing the value it returns as the operation's result. The
+// operation has a heartbeat while fn runs so that operationReaper can fail it
+// if the controller exits first.
+func (c *controllerAPI) runOperation(typ, appID string, fn func() (interface{}, error)) (*ct.Operation, error) {
+	op := &ct.Operation{Type: typ, AppID: appID}
+	if err := c.operationRepo.Add(op); err != nil {
+		return nil, err
+	}
+	go func() {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(operationHeartbeatInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					c.operationRepo.Heartbeat(op.ID)
+				case <-done:
+					return
+				}
+			}
+		}()
+		result, err := fn()
+		if err != nil {
+			c.operationRepo.Fail(op.ID, err)
+			return
+		}
+		c.operationRepo.Complete(op.ID, result)
+	}()
+	return op, nil
+}
+
+// respondAsync reports whether req asked for an asynchronous response using
+// the "Prefer: respond-async" header (RFC 7240).
+func respondAsync(req *http.Request) bool {
+	for _, pref := range strings.Split(req.Header.Get("Prefer"), ",") {
+		if strings.TrimSpace(pref) == "respond-async" {
+			return true
+		}
+	}
+	return false
+}
+
+// respondWithOperation writes a 202 response for an operation which has been
+// started, with a Location header that can be polled for its status.
+func respondWithOperation(w http.ResponseWriter, op *ct.Operation) {
+	w.Header().Set("Location", "/operations/"+op.ID)
+	httphelper.JSON(w, 202, op)
+}
+
+func (c *controllerAPI) GetOperation(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	id := params.ByName("operation_id")
+	if !idPattern.MatchString(id) {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		if err := streamOperation(ctx, id, w, c.operationRepo); err != nil {
+			respondWithError(w, err)
+		}
+		return
+	}
+	op, err := c.operationRepo.Get(id)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, op)
+}
+
+// streamOperation sends the operation each time its status changes, and ends
+// the stream once it is complete or failed.
+func streamOperation(ctx context.Context, id string, w http.ResponseWriter, repo *OperationRepo) error {
+	notifications := make(chan *pq.Notification, notificationBufferSize)
+	if err := repo.notifier.Subscribe("operations", notifications); err != nil {
+		return err
+	}
+	defer repo.notifier.Unsubscribe("operations", notifications)
+
+	op, err := repo.Get(id)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *ct.Operation)
+	l, _ := ctxhelper.LoggerFromContext(ctx)
+	s := sse.NewStream(w, ch, l)
+	s.Serve()
+	defer func() {
+		close(ch)
+		s.Wait()
+	}()
+
+	send := func(op *ct.Operation) bool {
+		select {
+		case ch <- op:
+			return true
+		case <-s.Done:
+			return false
+		}
+	}
+
+	if !send(op) {
+		return nil
+	}
+	for !op.Done() {
+		select {
+		case <-s.Done:
+			return nil
+		case n, ok := <-notifications:
+			if !ok {
+				// notifications may have been missed, so end the stream
+				// and let the client poll the operation
+				return nil
+			}
+			if postgres.CleanUUID(n.Extra) != op.ID {
+				continue
+			}
+			updated, err := repo.Get(id)
+			if err != nil {
+				s.Error(err)
+				return nil
+			}
+			// heartbeats of running operations don't change the status
+			if updated.Status == op.Status {
+				continue
+			}
+			op = updated
+			if !send(op) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/secrets"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestReapStaleOperations(c *C) {
+	repo := NewOperationRepo(s.hc.db, nil, nil)
+	stale := &ct.Operation{Type: "test"}
+	c.Assert(repo.Add(stale), IsNil)
+	c.Assert(s.hc.db.Exec("UPDATE operations SET updated_at = now() - interval '1 hour' WHERE operation_id = $1", stale.ID), IsNil)
+	running := &ct.Operation{Type: "test"}
+	c.Assert(repo.Add(running), IsNil)
+
+	_, err := repo.ReapStale(time.Now().Add(-operationStaleAfter))
+	c.Assert(err, IsNil)
+
+	op, err := repo.Get(stale.ID)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, ct.OperationStatusFailed)
+	c.Assert(op.Error, Equals, errOperationInterrupted)
+
+	// a heartbeat keeps an operation from being reaped
+	c.Assert(repo.Heartbeat(running.ID), IsNil)
+	op, err = repo.Get(running.ID)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, ct.OperationStatusRunning)
+}
+
+func (s *S) TestOperationResultSealed(c *C) {
+	repo := NewOperationRepo(s.hc.db, nil, secretsKey)
+	op := &ct.Operation{Type: "test"}
+	c.Assert(repo.Add(op), IsNil)
+	c.Assert(repo.Complete(op.ID, map[string]string{"PASSWORD": "secret"}), IsNil)
+
+	var stored string
+	c.Assert(s.hc.db.QueryRow("SELECT result FROM operations WHERE operation_id = $1", op.ID).Scan(&stored), IsNil)
+	c.Assert(secrets.IsSealed(stored), Equals, true)
+	op, err := repo.Get(op.ID)
+	c.Assert(err, IsNil)
+	c.Assert(string(op.Result), Equals, `{"PASSWORD":"secret"}`)
+}
+
+func (s *S) TestRemoveFinishedOperations(c *C) {
+	repo := NewOperationRepo(s.hc.db, nil, nil)
+	finished := &ct.Operation{Type: "test"}
+	c.Assert(repo.Add(finished), IsNil)
+	c.Assert(repo.Complete(finished.ID, nil), IsNil)
+	running := &ct.Operation{Type: "test"}
+	c.Assert(repo.Add(running), IsNil)
+	c.Assert(s.hc.db.Exec("UPDATE operations SET updated_at = now() - interval '2 days' WHERE operation_id IN ($1, $2)", finished.ID, running.ID), IsNil)
+
+	_, err := repo.RemoveFinished(time.Now().Add(-operationRetention))
+	c.Assert(err, IsNil)
+	_, err = repo.Get(finished.ID)
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = repo.Get(running.ID)
+	c.Assert(err, IsNil)
+}
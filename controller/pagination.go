@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// maxListLimit is the largest page size that can be requested.
+const maxListLimit = 1000
+
+// ListOptions controls which page of a list is returned. Lists are ordered by
+// creation time and then ID, newest first.
+type ListOptions struct {
+	// Limit is the maximum number of items to return, if zero all items are
+	// returned.
+	Limit int
+	// Cursor is the position after which items are returned, if nil the list
+	// starts with the newest item.
+	Cursor *ListCursor
+	// Labels restricts the list to items with all of the given meta values.
+	// It is only used when listing apps.
+	Labels map[string]string
+	// Namespace restricts the list to items in the namespace with the given
+	// ID. It is only used when listing apps.
+	Namespace string
+}
+
+// ListCursor is the position of an item in a list.
+type ListCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// String returns the cursor encoded as an opaque page token.
+func (c *ListCursor) String() string {
+	s := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID
+	return base64.URLEncoding.EncodeToString([]byte(s))
+}
+
+func parseListCursor(token string) (*ListCursor, error) {
+	data, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid cursor %q", token)
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &ListCursor{CreatedAt: time.Unix(0, nsec), ID: parts[1]}, nil
+}
+
+// parseListOptions reads the limit, cursor, label and namespace query
+// parameters of req.
+func parseListOptions(req *http.Request) (*ListOptions, error) {
+	opts := &ListOptions{}
+	q := req.URL.Query()
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, ct.ValidationError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxListLimit)}
+		}
+		opts.Limit = limit
+	}
+	if s := q.Get("cursor"); s != "" {
+		cursor, err := parseListCursor(s)
+		if err != nil {
+			return nil, ct.ValidationError{Field: "cursor", Message: "is invalid"}
+		}
+		opts.Cursor = cursor
+	}
+	for _, label := range q["label"] {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ct.ValidationError{Field: "label", Message: fmt.Sprintf("%q must be in the form key=value", label)}
+		}
+		if opts.Labels == nil {
+			opts.Labels = make(map[string]string)
+		}
+		opts.Labels[kv[0]] = kv[1]
+	}
+	if s := q.Get("namespace"); s != "" {
+		if !idPattern.MatchString(s) {
+			return nil, ct.ValidationError{Field: "namespace", Message: "is invalid"}
+		}
+		opts.Namespace = s
+	}
+	return opts, nil
+}
+
+// query returns query, which must select from a single table and end with a
+// WHERE clause, with the ordering, cursor and limit of opts applied.
+func (opts *ListOptions) query(query, idColumn string, args ...interface{}) (string, []interface{}) {
+	if opts.Cursor != nil {
+		query += fmt.Sprintf(" AND (created_at, %s) < ($%d, $%d)", idColumn, len(args)+1, len(args)+2)
+		args = append(args, opts.Cursor.CreatedAt, opts.Cursor.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC, %s DESC", idColumn)
+	if opts.Limit > 0 {
+		// fetch an extra row to determine whether there is another page
+		query += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+		args = append(args, opts.Limit+1)
+	}
+	return query, args
+}
+
+// hasMore reports whether a query with count rows has a page after the
+// requested one, in which case the extra row should be dropped.
+func (opts *ListOptions) hasMore(count int) bool {
+	return opts.Limit > 0 && count > opts.Limit
+}
+
+// nextPageLink returns a Link header value pointing at the page of req after
+// cursor.
+func nextPageLink(req *http.Request, opts *ListOptions, cursor *ListCursor) string {
+	q := req.URL.Query()
+	q.Set("limit", strconv.Itoa(opts.Limit))
+	q.Set("cursor", cursor.String())
+	u := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+	return fmt.Sprintf(`<%s>; rel="next"`, u.String())
+}
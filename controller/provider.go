@@ -1,11 +1,14 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
+	"reflect"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
 )
 
 type ProviderRepo struct {
@@ -19,30 +22,144 @@ func NewProviderRepo(db *postgres.DB) *ProviderRepo {
 func (r *ProviderRepo) Add(data interface{}) error {
 	p := data.(*ct.Provider)
 	if p.Name == "" {
-		return errors.New("controller: name must not be blank")
+		return ct.ValidationError{Field: "name", Message: "must not be blank"}
 	}
 	if p.URL == "" {
-		return errors.New("controler: url must not be blank")
+		return ct.ValidationError{Field: "url", Message: "must not be blank"}
+	}
+	plans, err := plansJSON(p.Plans)
+	if err != nil {
+		return err
+	}
+	if p.ID == "" {
+		p.ID = random.UUID()
 	}
 	// TODO: validate url
-	err := r.db.QueryRow("INSERT INTO providers (name, url) VALUES ($1, $2) RETURNING provider_id, created_at, updated_at", p.Name, p.URL).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	err = r.db.QueryRow("INSERT INTO providers (provider_id, name, url, plans) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at", p.ID, p.Name, p.URL, plans).Scan(&p.CreatedAt, &p.UpdatedAt)
 	p.ID = postgres.CleanUUID(p.ID)
 	return err
 }
 
+// plansJSON validates plans and returns them encoded as JSON, or nil if there
+// are none.
+func plansJSON(plans map[string]*json.RawMessage) (*string, error) {
+	if len(plans) == 0 {
+		return nil, nil
+	}
+	for name, config := range plans {
+		if name == "" {
+			return nil, ct.ValidationError{Field: "plans", Message: "must not have a blank name"}
+		}
+		if _, err := planConfig(config); err != nil {
+			return nil, ct.ValidationError{Field: "plans." + name, Message: "must be a JSON object"}
+		}
+	}
+	data, err := json.Marshal(plans)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// Update changes the URL and plans of the provider with the given ID or name.
+// The URL is left unchanged if it is blank, and the plans are replaced unless
+// they are nil, so that plans can be added to existing providers.
+func (r *ProviderRepo) Update(id string, p *ct.Provider) (*ct.Provider, error) {
+	data, err := r.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	provider := data.(*ct.Provider)
+	if p.URL != "" {
+		provider.URL = p.URL
+	}
+	if p.Plans != nil {
+		provider.Plans = p.Plans
+	}
+	plans, err := plansJSON(provider.Plans)
+	if err != nil {
+		return nil, err
+	}
+	err = r.db.QueryRow("UPDATE providers SET url = $2, plans = $3, updated_at = now() WHERE provider_id = $1 AND deleted_at IS NULL RETURNING updated_at", provider.ID, provider.URL, plans).Scan(&provider.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return provider, err
+}
+
 func scanProvider(s postgres.Scanner) (*ct.Provider, error) {
 	p := &ct.Provider{}
-	err := s.Scan(&p.ID, &p.Name, &p.URL, &p.CreatedAt, &p.UpdatedAt)
+	var plans *string
+	err := s.Scan(&p.ID, &p.Name, &p.URL, &plans, &p.CreatedAt, &p.UpdatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
 	p.ID = postgres.CleanUUID(p.ID)
-	return p, err
+	if plans != nil {
+		if err := json.Unmarshal([]byte(*plans), &p.Plans); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// planConfig decodes the provisioning config of a plan or resource request,
+// which must be a JSON object if it is set.
+func planConfig(data *json.RawMessage) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	if data == nil || string(*data) == "null" {
+		return config, nil
+	}
+	if err := json.Unmarshal(*data, &config); err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+	return config, nil
+}
+
+// applyPlan merges the config of the plan requested by rr into rr.Config,
+// returning a validation error if the provider has no such plan or rr.Config
+// overrides a value set by it.
+func applyPlan(p *ct.Provider, rr *ct.ResourceReq) error {
+	if rr.Plan == "" {
+		return nil
+	}
+	data, ok := p.Plans[rr.Plan]
+	if !ok {
+		return ct.ValidationError{Field: "plan", Message: fmt.Sprintf("%q is not a plan of provider %s", rr.Plan, p.Name)}
+	}
+	config, err := planConfig(data)
+	if err != nil {
+		return err
+	}
+	reqConfig, err := planConfig(rr.Config)
+	if err != nil {
+		return ct.ValidationError{Field: "config", Message: "must be a JSON object"}
+	}
+	for k, v := range reqConfig {
+		if planValue, ok := config[k]; ok && !reflect.DeepEqual(planValue, v) {
+			return ct.ValidationError{Field: "config." + k, Message: fmt.Sprintf("is set by plan %s", rr.Plan)}
+		}
+		config[k] = v
+	}
+	merged, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	raw := json.RawMessage(merged)
+	rr.Config = &raw
+	return nil
 }
 
 func (r *ProviderRepo) Get(id string) (interface{}, error) {
 	var row postgres.Scanner
-	query := "SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL AND "
+	query := "SELECT provider_id, name, url, plans, created_at, updated_at FROM providers WHERE deleted_at IS NULL AND "
 	if idPattern.MatchString(id) {
 		row = r.db.QueryRow(query+"(provider_id = $1 OR name = $2) LIMIT 1", id, id)
 	} else {
@@ -51,19 +168,29 @@ func (r *ProviderRepo) Get(id string) (interface{}, error) {
 	return scanProvider(row)
 }
 
-func (r *ProviderRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *ProviderRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	query, args := opts.query("SELECT provider_id, name, url, plans, created_at, updated_at FROM providers WHERE deleted_at IS NULL", "provider_id")
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	providers := []*ct.Provider{}
 	for rows.Next() {
 		provider, err := scanProvider(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, nil, err
 		}
 		providers = append(providers, provider)
 	}
-	return providers, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(providers)) {
+		providers = providers[:opts.Limit]
+		last := providers[len(providers)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return providers, next, nil
 }
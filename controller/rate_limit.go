@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// rateLimiter limits the request rate of each auth token using a token
+// bucket, so that a single misbehaving client can't starve the controller.
+type rateLimiter struct {
+	// rate is the default number of requests per second, and burst the
+	// default number of requests which can be made at once. A rate of zero
+	// disables the limit for tokens which don't set their own.
+	rate  float64
+	burst int
+
+	mtx       sync.Mutex
+	buckets   map[string]*rateBucket
+	lastPrune time.Time
+}
+
+// rateBucketPruneInterval is how often buckets which have refilled are
+// removed, so buckets of tokens which are no longer used don't accumulate.
+const rateBucketPruneInterval = time.Minute
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket has refilled, after which it is the same as a
+	// new bucket and can be removed.
+	full time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// limits returns the rate and burst which apply to token.
+func (l *rateLimiter) limits(token *ct.AuthToken) (float64, int) {
+	rate, burst := l.rate, l.burst
+	if token.RateLimit > 0 {
+		rate, burst = token.RateLimit, token.RateBurst
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return rate, burst
+}
+
+// Allow reports whether a request can be made with token, and sets the
+// X-RateLimit headers on w. The master key (which has no ID) is used by the
+// cluster components and is not limited.
+func (l *rateLimiter) Allow(w http.ResponseWriter, token *ct.AuthToken) bool {
+	if token.ID == "" {
+		return true
+	}
+	rate, burst := l.limits(token)
+	if rate <= 0 {
+		return true
+	}
+
+	l.mtx.Lock()
+	now := time.Now()
+	l.prune(now)
+	b, ok := l.buckets[token.ID]
+	if !ok {
+		b = &rateBucket{tokens: float64(burst), last: now}
+		l.buckets[token.ID] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	tokens := b.tokens
+	// the bucket is full again once the missing tokens have been refilled
+	reset := now.Add(time.Duration((float64(burst) - tokens) / rate * float64(time.Second)))
+	b.full = reset
+	l.mtx.Unlock()
+
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if !allowed {
+		retryAfter := math.Ceil((1 - tokens) / rate)
+		h.Set("Retry-After", strconv.Itoa(int(retryAfter)))
+	}
+	return allowed
+}
+
+// prune removes the buckets which have refilled, it must be called with mtx
+// held.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < rateBucketPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for id, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+func rateLimitedError(token *ct.AuthToken) error {
+	return httphelper.JSONError{
+		Code:    httphelper.RateLimitedError,
+		Message: fmt.Sprintf("the rate limit of auth token %q has been exceeded", token.Name),
+	}
+}
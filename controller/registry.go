@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/controller/secrets"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// RegistryRepo stores the cluster wide credentials of private registries,
+// which are used to pull the images of artifacts without credentials of their
+// own.
+type RegistryRepo struct {
+	db      *postgres.DB
+	secrets *secrets.Key
+}
+
+func NewRegistryRepo(db *postgres.DB, secretsKey *secrets.Key) *RegistryRepo {
+	return &RegistryRepo{db: db, secrets: secretsKey}
+}
+
+// List returns the registries with credentials, without their passwords.
+func (r *RegistryRepo) List() ([]*ct.Registry, error) {
+	rows, err := r.db.Query("SELECT host, username, updated_at FROM registries ORDER BY host")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	registries := []*ct.Registry{}
+	for rows.Next() {
+		reg := &ct.Registry{}
+		if err := rows.Scan(&reg.Host, &reg.Username, &reg.UpdatedAt); err != nil {
+			return nil, err
+		}
+		registries = append(registries, reg)
+	}
+	return registries, rows.Err()
+}
+
+// Set stores the credentials of a registry, replacing any existing ones. The
+// password is cleared from reg once it has been stored.
+func (r *RegistryRepo) Set(reg *ct.Registry) error {
+	reg.Host = strings.ToLower(reg.Host)
+	if reg.Host == "" || strings.ContainsAny(reg.Host, "/ ") {
+		return ct.ValidationError{Field: "host", Message: "must be a registry host name"}
+	}
+	if reg.Username == "" {
+		return ct.ValidationError{Field: "username", Message: "must not be empty"}
+	}
+	password, err := sealPassword(r.secrets, "password", reg.Host, reg.Password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("UPDATE registries SET username = $2, password = $3, updated_at = now() WHERE host = $1 RETURNING updated_at", reg.Host, reg.Username, password).Scan(&reg.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("INSERT INTO registries (host, username, password) VALUES ($1, $2, $3) RETURNING updated_at", reg.Host, reg.Username, password).Scan(&reg.UpdatedAt)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	reg.Password = ""
+	return nil
+}
+
+func (r *RegistryRepo) Delete(host string) error {
+	var deleted string
+	err := r.db.QueryRow("DELETE FROM registries WHERE host = $1 RETURNING host", strings.ToLower(host)).Scan(&deleted)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// PullCredentials returns the credentials hosts use to pull the image of a,
+// which are its own or else those of its registry, or nil if there are none.
+// The password is sealed.
+func (r *ArtifactRepo) PullCredentials(a *ct.Artifact) (*ct.RegistryCredentials, error) {
+	if a.Credentials != nil {
+		return r.credentials(a.ID)
+	}
+	host := utils.RegistryHost(a.URI)
+	if host == "" {
+		return nil, nil
+	}
+	c := &ct.RegistryCredentials{}
+	err := r.db.QueryRow("SELECT username, password FROM registries WHERE host = $1", host).Scan(&c.Username, &c.Password)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (c *controllerAPI) ListRegistries(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	registries, err := c.registryRepo.List()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, registries)
+}
+
+func (c *controllerAPI) PutRegistry(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var reg ct.Registry
+	if err := httphelper.DecodeJSON(req, &reg); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	reg.Host = params.ByName("registry_host")
+	if err := c.registryRepo.Set(&reg); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &reg)
+}
+
+func (c *controllerAPI) DeleteRegistry(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	if err := c.registryRepo.Delete(params.ByName("registry_host")); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/secrets"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestArtifactCredentials(c *C) {
+	artifact := s.createTestArtifact(c, &ct.Artifact{
+		Type:        "docker",
+		URI:         "https://private.example.com/flynn/creds?id=1",
+		Credentials: &ct.RegistryCredentials{Username: "deploy", Password: "hunter2"},
+	})
+	c.Assert(artifact.Credentials, DeepEquals, &ct.RegistryCredentials{Username: "deploy"})
+
+	// the password is never returned
+	gotArtifact, err := s.c.GetArtifact(artifact.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotArtifact.Credentials, DeepEquals, &ct.RegistryCredentials{Username: "deploy"})
+
+	// the artifact is only returned when it is added again with the same
+	// credentials
+	again := &ct.Artifact{
+		Type:        "docker",
+		URI:         artifact.URI,
+		Credentials: &ct.RegistryCredentials{Username: "deploy", Password: "hunter2"},
+	}
+	c.Assert(s.c.CreateArtifact(again), IsNil)
+	c.Assert(again.ID, Equals, artifact.ID)
+	c.Assert(again.Credentials, DeepEquals, &ct.RegistryCredentials{Username: "deploy"})
+	c.Assert(s.c.CreateArtifact(&ct.Artifact{Type: "docker", URI: artifact.URI}), NotNil)
+	c.Assert(s.c.CreateArtifact(&ct.Artifact{
+		Type:        "docker",
+		URI:         artifact.URI,
+		Credentials: &ct.RegistryCredentials{Username: "deploy", Password: "letmein"},
+	}), NotNil)
+
+	// passwords sealed for anything other than the registry are rejected
+	err = s.c.CreateArtifact(&ct.Artifact{
+		Type:        "docker",
+		URI:         "https://attacker.example.com/flynn/creds?id=1",
+		Credentials: &ct.RegistryCredentials{Username: "deploy", Password: secretsKey.Seal(secrets.AppContext(random.UUID()), "hunter2")},
+	})
+	c.Assert(err, NotNil)
+
+	err = s.c.CreateArtifact(&ct.Artifact{
+		Type:        "docker",
+		URI:         "https://private.example.com/flynn/creds?id=2",
+		Credentials: &ct.RegistryCredentials{Password: "hunter2"},
+	})
+	c.Assert(err, NotNil)
+
+	// jobs are started with the decrypted password
+	app := s.createTestApp(c, &ct.App{Name: "artifact-credentials"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	_, err = s.c.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	c.Assert(err, IsNil)
+	job := s.cc.GetHost(hostID).Jobs[0]
+	c.Assert(job.Artifact.Credentials, DeepEquals, &host.RegistryCredentials{Username: "deploy", Password: "hunter2"})
+}
+
+func (s *S) TestRegistries(c *C) {
+	registry, err := s.c.SetRegistry("Registry.Example.com", "deploy", "hunter2")
+	c.Assert(err, IsNil)
+	c.Assert(registry.Host, Equals, "registry.example.com")
+	c.Assert(registry.Password, Equals, "")
+	c.Assert(registry.UpdatedAt, NotNil)
+	defer s.c.DeleteRegistry("registry.example.com")
+
+	registries, err := s.c.RegistryList()
+	c.Assert(err, IsNil)
+	c.Assert(registries, HasLen, 1)
+	c.Assert(registries[0].Host, Equals, "registry.example.com")
+	c.Assert(registries[0].Username, Equals, "deploy")
+	c.Assert(registries[0].Password, Equals, "")
+
+	_, err = s.c.SetRegistry("registry.example.com", "", "hunter2")
+	c.Assert(err, NotNil)
+
+	// artifacts without credentials use those of their registry
+	app := s.createTestApp(c, &ct.App{Name: "registry-credentials"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://registry.example.com/flynn/app?id=1"})
+	c.Assert(artifact.Credentials, IsNil)
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	hostID := random.UUID()
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	_, err = s.c.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: release.ID, Cmd: []string{"true"}})
+	c.Assert(err, IsNil)
+	job := s.cc.GetHost(hostID).Jobs[0]
+	c.Assert(job.Artifact.Credentials, DeepEquals, &host.RegistryCredentials{Username: "deploy", Password: "hunter2"})
+
+	c.Assert(s.c.DeleteRegistry("registry.example.com"), IsNil)
+	c.Assert(s.c.DeleteRegistry("registry.example.com"), Equals, controller.ErrNotFound)
+}
@@ -4,11 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/schema"
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
@@ -16,10 +22,13 @@ import (
 
 type ReleaseRepo struct {
 	db *postgres.DB
+	// secrets is the key release secrets are sealed with, it is nil if
+	// secrets are disabled.
+	secrets *secrets.Key
 }
 
-func NewReleaseRepo(db *postgres.DB) *ReleaseRepo {
-	return &ReleaseRepo{db}
+func NewReleaseRepo(db *postgres.DB, secretsKey *secrets.Key) *ReleaseRepo {
+	return &ReleaseRepo{db: db, secrets: secretsKey}
 }
 
 func scanRelease(s postgres.Scanner) (*ct.Release, error) {
@@ -42,8 +51,199 @@ func scanRelease(s postgres.Scanner) (*ct.Release, error) {
 	return release, err
 }
 
+var (
+	processTypePattern = regexp.MustCompile(`^[a-zA-Z\d][a-zA-Z\d_-]*$`)
+	serviceNamePattern = regexp.MustCompile(`^[a-z\d]+([._-][a-z\d]+)*$`)
+	portNamePattern    = regexp.MustCompile(`^[a-z][a-z\d]*(-[a-z\d]+)*$`)
+)
+
+// reservedEnv are the environment variables which the controller sets in
+// every job, so they can't be set by releases.
+var reservedEnv = map[string]struct{}{
+	"FLYNN_APP_ID":       {},
+	"FLYNN_RELEASE_ID":   {},
+	"FLYNN_PROCESS_TYPE": {},
+	"FLYNN_JOB_ID":       {},
+}
+
+func validateLiveness(field string, check *host.LivenessCheck, ports []ct.Port) error {
+	switch check.Type {
+	case "tcp", "http":
+		if check.Port == 0 && len(ports) == 0 {
+			return ct.ValidationError{Field: field + ".port", Message: "must be set if the process has no ports"}
+		}
+		if check.Port < 0 || check.Port > 65535 {
+			return ct.ValidationError{Field: field + ".port", Message: "must be between 0 and 65535"}
+		}
+		if check.Type == "http" && check.Path != "" && !strings.HasPrefix(check.Path, "/") {
+			return ct.ValidationError{Field: field + ".path", Message: "must start with /"}
+		}
+	case "exec":
+		if len(check.Cmd) == 0 {
+			return ct.ValidationError{Field: field + ".cmd", Message: "must be set for exec checks"}
+		}
+	default:
+		return ct.ValidationError{Field: field + ".type", Message: "must be tcp, http or exec"}
+	}
+	switch {
+	case check.Interval < 0:
+		return ct.ValidationError{Field: field + ".interval", Message: "must not be negative"}
+	case check.Timeout < 0:
+		return ct.ValidationError{Field: field + ".timeout", Message: "must not be negative"}
+	case check.Threshold < 0:
+		return ct.ValidationError{Field: field + ".threshold", Message: "must not be negative"}
+	case check.StartTimeout < 0:
+		return ct.ValidationError{Field: field + ".start_timeout", Message: "must not be negative"}
+	}
+	return nil
+}
+
+// validateRelease checks that the env and process types of release can be
+// turned into valid job configs, see utils.JobConfig.
+func validateRelease(release *ct.Release) error {
+	if len(release.Description) > 1000 {
+		return ct.ValidationError{Field: "description", Message: "must be at most 1000 characters"}
+	}
+	if len(release.CreatedBy) > 100 {
+		return ct.ValidationError{Field: "created_by", Message: "must be at most 100 characters"}
+	}
+	if err := validateEnv("env", release.Env); err != nil {
+		return err
+	}
+	types := make([]string, 0, len(release.Processes))
+	for typ := range release.Processes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		field := "processes." + typ
+		portNames := make(map[string]struct{})
+		if len(typ) > 63 || !processTypePattern.MatchString(typ) {
+			return ct.ValidationError{Field: field, Message: "is not a valid process type name"}
+		}
+		proc := release.Processes[typ]
+		if err := validateEnv(field+".env", proc.Env); err != nil {
+			return err
+		}
+		if proc.Service != "" {
+			if !serviceNamePattern.MatchString(proc.Service) {
+				return ct.ValidationError{Field: field + ".service", Message: "is not a valid service name"}
+			}
+			if len(proc.Ports) == 0 {
+				return ct.ValidationError{Field: field + ".service", Message: "requires at least one port"}
+			}
+		}
+		if proc.StartTimeout < 0 {
+			return ct.ValidationError{Field: field + ".start_timeout", Message: "must not be negative"}
+		}
+		if proc.KillTimeout < 0 {
+			return ct.ValidationError{Field: field + ".kill_timeout", Message: "must not be negative"}
+		}
+		if proc.KillTimeout > host.MaxStopGracePeriod {
+			return ct.ValidationError{Field: field + ".kill_timeout", Message: fmt.Sprintf("must be at most %s", host.MaxStopGracePeriod)}
+		}
+		if proc.Memory < 0 {
+			return ct.ValidationError{Field: field + ".memory", Message: "must not be negative"}
+		}
+		if proc.CPUShares < 0 || proc.CPUShares == 1 {
+			// the kernel doesn't accept a cpu.shares value of 1
+			return ct.ValidationError{Field: field + ".cpu_shares", Message: "must be at least 2"}
+		}
+		for _, b := range []struct {
+			name  string
+			limit int64
+		}{{"ingress_bandwidth", proc.IngressBandwidth}, {"egress_bandwidth", proc.EgressBandwidth}} {
+			if b.limit < 0 {
+				return ct.ValidationError{Field: field + "." + b.name, Message: "must not be negative"}
+			}
+			if b.limit > 0 && proc.HostNetwork {
+				return ct.ValidationError{Field: field + "." + b.name, Message: "can't be limited for jobs using the host network"}
+			}
+		}
+		if check := proc.Liveness; check != nil {
+			if err := validateLiveness(field+".liveness", check, proc.Ports); err != nil {
+				return err
+			}
+		}
+		volumePaths := make(map[string]struct{}, len(proc.Volumes))
+		for i, v := range proc.Volumes {
+			if !path.IsAbs(v.Path) || path.Clean(v.Path) != v.Path || v.Path == "/" {
+				return ct.ValidationError{Field: fmt.Sprintf("%s.volumes.%d.path", field, i), Message: "must be a clean absolute path"}
+			}
+			if _, ok := volumePaths[v.Path]; ok || proc.Data && v.Path == "/data" {
+				return ct.ValidationError{Field: fmt.Sprintf("%s.volumes.%d.path", field, i), Message: "is already mounted"}
+			}
+			volumePaths[v.Path] = struct{}{}
+		}
+		if check := proc.Readiness; check != nil {
+			switch {
+			case proc.Service == "":
+				return ct.ValidationError{Field: field + ".readiness", Message: "requires a service"}
+			case check.Type != "http" && check.Type != "tcp":
+				return ct.ValidationError{Field: field + ".readiness.type", Message: `must be "http" or "tcp"`}
+			case check.Type == "http" && check.Path != "" && !strings.HasPrefix(check.Path, "/"):
+				return ct.ValidationError{Field: field + ".readiness.path", Message: `must start with "/"`}
+			case check.Status != 0 && (check.Status < 100 || check.Status > 599):
+				return ct.ValidationError{Field: field + ".readiness.status", Message: "is not a valid HTTP status"}
+			case check.Timeout < 0:
+				return ct.ValidationError{Field: field + ".readiness.timeout", Message: "must not be negative"}
+			}
+		}
+		for i, port := range proc.Ports {
+			field := fmt.Sprintf("%s.ports.%d", field, i)
+			if port.Proto != "tcp" && port.Proto != "udp" {
+				return ct.ValidationError{Field: field + ".proto", Message: `must be "tcp" or "udp"`}
+			}
+			if port.Port < 0 || port.Port > 65535 {
+				return ct.ValidationError{Field: field + ".port", Message: "must be between 0 and 65535"}
+			}
+			if port.Name != "" {
+				if len(port.Name) > 63 || !portNamePattern.MatchString(port.Name) {
+					return ct.ValidationError{Field: field + ".name", Message: "is not a valid port name"}
+				}
+				if _, ok := portNames[port.Name]; ok {
+					return ct.ValidationError{Field: field + ".name", Message: fmt.Sprintf("%q is used by another port", port.Name)}
+				}
+				portNames[port.Name] = struct{}{}
+			}
+			if port.Service == nil {
+				continue
+			}
+			if !serviceNamePattern.MatchString(port.Service.Name) {
+				return ct.ValidationError{Field: field + ".service.name", Message: "is not a valid service name"}
+			}
+			if check := port.Service.Check; check != nil {
+				switch check.Type {
+				case "", "tcp", "http", "https":
+				default:
+					return ct.ValidationError{Field: field + ".service.check.type", Message: `must be "tcp", "http" or "https"`}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateEnv(field string, env map[string]string) error {
+	for k := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return ct.ValidationError{Field: field, Message: fmt.Sprintf("contains invalid key %q", k)}
+		}
+		if _, ok := reservedEnv[k]; ok {
+			return ct.ValidationError{Field: field, Message: fmt.Sprintf("must not set %s, it is set by the controller", k)}
+		}
+	}
+	return nil
+}
+
 func (r *ReleaseRepo) Add(data interface{}) error {
 	release := data.(*ct.Release)
+	if err := validateRelease(release); err != nil {
+		return err
+	}
+	if err := r.sealSecrets(release); err != nil {
+		return err
+	}
 	releaseCopy := *release
 
 	releaseCopy.ID = ""
@@ -72,26 +272,165 @@ func (r *ReleaseRepo) Add(data interface{}) error {
 	return err
 }
 
+// sealSecrets encrypts the values of the secret env vars of release for the
+// release's app, leaving values which are already sealed for it, e.g. those
+// copied from a previous release. Vars with sealed values are always secret,
+// and secrets which aren't set are dropped.
+func (r *ReleaseRepo) sealSecrets(release *ct.Release) error {
+	release.AppID = postgres.CleanUUID(release.AppID)
+	context := secrets.AppContext(release.AppID)
+	secret := make(map[string]struct{}, len(release.Secrets))
+	for _, k := range release.Secrets {
+		secret[k] = struct{}{}
+	}
+	names := make([]string, 0, len(secret))
+	for k, v := range release.Env {
+		if _, ok := secret[k]; !ok && !secrets.IsSealed(v) {
+			continue
+		}
+		if r.secrets == nil {
+			return ct.ValidationError{Field: "secrets", Message: "are not enabled in this cluster"}
+		}
+		if release.AppID == "" {
+			return ct.ValidationError{Field: "app_id", Message: "must be set for releases with secrets"}
+		}
+		if secrets.IsSealed(v) {
+			// values sealed for other apps fail to open
+			if _, err := r.secrets.Open(context, v); err != nil {
+				return ct.ValidationError{Field: "env." + k, Message: "is not a valid sealed value of the app"}
+			}
+		} else {
+			release.Env[k] = r.secrets.Seal(context, v)
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	release.Secrets = nil
+	if len(names) > 0 {
+		release.Secrets = names
+	}
+	return nil
+}
+
+// checkReleaseApp returns a validation error if release belongs to an app
+// other than app, as its secrets can only be opened by jobs of that app.
+func checkReleaseApp(release *ct.Release, app *ct.App) error {
+	if release.AppID != "" && release.AppID != app.ID {
+		return ct.ValidationError{Field: "release", Message: "belongs to another app"}
+	}
+	return nil
+}
+
+// Apps returns the apps which run or have deployed the release.
+func (r *ReleaseRepo) Apps(id string) ([]*ct.App, error) {
+	return selectReleaseApps(r.db, "SELECT $1::uuid", id)
+}
+
 func (r *ReleaseRepo) Get(id string) (interface{}, error) {
 	row := r.db.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
 	return scanRelease(row)
 }
 
-func (r *ReleaseRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT release_id, artifact_id, data, created_at FROM releases WHERE deleted_at IS NULL ORDER BY created_at DESC")
+func (r *ReleaseRepo) List(opts *ListOptions) (interface{}, *ListCursor, error) {
+	return r.list(opts, "SELECT release_id, artifact_id, data, created_at FROM releases WHERE deleted_at IS NULL")
+}
+
+// AppList returns the releases which have been used by the app, either as its
+// current release, in a formation or as the target of a deployment.
+func (r *ReleaseRepo) AppList(appID string, opts *ListOptions) ([]*ct.Release, *ListCursor, error) {
+	return r.list(opts, `
+SELECT release_id, artifact_id, data, created_at FROM releases
+WHERE deleted_at IS NULL AND release_id IN (
+  SELECT release_id FROM apps WHERE app_id = $1 AND release_id IS NOT NULL
+  UNION SELECT release_id FROM formations WHERE app_id = $1
+  UNION SELECT new_release_id FROM deployments WHERE app_id = $1
+)`, appID)
+}
+
+func (r *ReleaseRepo) list(opts *ListOptions, query string, args ...interface{}) ([]*ct.Release, *ListCursor, error) {
+	query, args = opts.query(query, "release_id", args...)
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	releases := []*ct.Release{}
 	for rows.Next() {
 		release, err := scanRelease(rows)
 		if err != nil {
 			rows.Close()
-			return nil, err
+			return nil, nil, err
 		}
 		releases = append(releases, release)
 	}
-	return releases, rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	var next *ListCursor
+	if opts.hasMore(len(releases)) {
+		releases = releases[:opts.Limit]
+		last := releases[len(releases)-1]
+		next = &ListCursor{CreatedAt: *last.CreatedAt, ID: last.ID}
+	}
+	return releases, next, nil
+}
+
+// RemoveUnused deletes a release which was created but never used, e.g. when
+// a failed import is undone. Unlike Remove its artifact is kept, as the
+// artifact existed before the release.
+func (r *ReleaseRepo) RemoveUnused(id string) error {
+	return r.db.Exec("UPDATE releases SET deleted_at = now() WHERE release_id = $1 AND deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM apps WHERE release_id = $1 AND deleted_at IS NULL) AND NOT EXISTS (SELECT 1 FROM formations WHERE release_id = $1 AND deleted_at IS NULL) AND NOT EXISTS (SELECT 1 FROM deployments WHERE (new_release_id = $1 OR old_release_id = $1) AND finished_at IS NULL)", id)
+}
+
+// Remove deletes the release, which must not be the current release of an app,
+// have a formation or be the target or source of a running deployment. The artifact of
+// the release is also deleted if no other release uses it.
+func (r *ReleaseRepo) Remove(id string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var artifactID *string
+	err = tx.QueryRow("SELECT artifact_id FROM releases WHERE release_id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&artifactID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrNotFound
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, check := range []struct {
+		query   string
+		message string
+	}{
+		{"SELECT EXISTS (SELECT 1 FROM apps WHERE release_id = $1 AND deleted_at IS NULL)", "is the current release of an app"},
+		{"SELECT EXISTS (SELECT 1 FROM formations WHERE release_id = $1 AND deleted_at IS NULL)", "is referenced by a formation"},
+		{"SELECT EXISTS (SELECT 1 FROM deployments WHERE new_release_id = $1 AND finished_at IS NULL)", "is being deployed"},
+		{"SELECT EXISTS (SELECT 1 FROM deployments WHERE old_release_id = $1 AND finished_at IS NULL)", "is being replaced by a running deployment"},
+	} {
+		var inUse bool
+		if err := tx.QueryRow(check.query, id).Scan(&inUse); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if inUse {
+			tx.Rollback()
+			return ct.ValidationError{Field: "id", Message: check.message}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE releases SET deleted_at = now() WHERE release_id = $1", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if artifactID != nil {
+		_, err := tx.Exec("UPDATE artifacts SET deleted_at = now() WHERE artifact_id = $1 AND deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM releases WHERE artifact_id = $1 AND deleted_at IS NULL)", *artifactID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 type releaseID struct {
@@ -123,6 +462,14 @@ func (c *controllerAPI) SetAppRelease(ctx context.Context, w http.ResponseWriter
 	}
 
 	app := c.getApp(ctx)
+	if app.Policy != nil && app.Policy.LockRelease {
+		respondWithError(w, errReleaseLocked)
+		return
+	}
+	if err := checkReleaseApp(release, app); err != nil {
+		respondWithError(w, err)
+		return
+	}
 	c.appRepo.SetRelease(app.ID, release.ID)
 	httphelper.JSON(w, 200, release)
 }
@@ -135,3 +482,21 @@ func (c *controllerAPI) GetAppRelease(ctx context.Context, w http.ResponseWriter
 	}
 	httphelper.JSON(w, 200, release)
 }
+
+// ListAppReleases responds with the releases of the app, newest first.
+func (c *controllerAPI) ListAppReleases(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	opts, err := parseListOptions(req)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	list, next, err := c.releaseRepo.AppList(c.getApp(ctx).ID, opts)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if next != nil {
+		w.Header().Set("Link", nextPageLink(req, opts, next))
+	}
+	httphelper.JSON(w, 200, list)
+}
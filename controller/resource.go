@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
@@ -62,6 +65,56 @@ func (rr *ResourceRepo) Add(r *ct.Resource) error {
 	return tx.Commit()
 }
 
+// AddApp binds the resource to the app, restoring a previous binding if there
+// is one.
+func (rr *ResourceRepo) AddApp(resourceID, appID string) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE app_resources SET deleted_at = NULL, created_at = now() WHERE app_id = $1 AND resource_id = $2 AND deleted_at IS NOT NULL", appID, resourceID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO app_resources (app_id, resource_id) SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM app_resources WHERE app_id = $1 AND resource_id = $2)", appID, resourceID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove deletes the resource and its bindings to apps.
+func (rr *ResourceRepo) Remove(id string) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE app_resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveUnbound deletes the resource if it isn't bound to any apps, returning
+// whether it was deleted.
+func (rr *ResourceRepo) RemoveUnbound(id string) (bool, error) {
+	err := rr.db.QueryRow("UPDATE resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM app_resources WHERE resource_id = $1 AND deleted_at IS NULL) RETURNING resource_id", id).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RemoveApp unbinds the resource from the app.
+func (rr *ResourceRepo) RemoveApp(resourceID, appID string) error {
+	return rr.db.Exec("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND resource_id = $2 AND deleted_at IS NULL", appID, resourceID)
+}
+
 func envHstore(m map[string]string) hstore.Hstore {
 	res := hstore.Hstore{Map: make(map[string]sql.NullString, len(m))}
 	for k, v := range m {
@@ -150,7 +203,7 @@ func (r *ResourceRepo) AppList(appID string) ([]*ct.Resource, error) {
 									r.created_at
 							 FROM resources r
 							 JOIN app_resources a USING (resource_id)
-							 WHERE a.app_id = $1 AND r.deleted_at IS NULL
+							 WHERE a.app_id = $1 AND a.deleted_at IS NULL AND r.deleted_at IS NULL
 							 ORDER BY r.created_at DESC`, appID)
 	if err != nil {
 		return nil, err
@@ -158,6 +211,52 @@ func (r *ResourceRepo) AppList(appID string) ([]*ct.Resource, error) {
 	return resourceList(rows)
 }
 
+// PingProvider checks that a provider is reachable by making a request to
+// the /ping endpoint on the provider's host.
+// UpdateProvider changes the URL or plans of a provider, see
+// ProviderRepo.Update.
+func (c *controllerAPI) UpdateProvider(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var p ct.Provider
+	if err := httphelper.DecodeJSON(req, &p); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := schema.Validate(&p); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	provider, err := c.providerRepo.Update(params.ByName("providers_id"), &p)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, provider)
+}
+
+func (c *controllerAPI) PingProvider(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	p, err := c.getProvider(ctx)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	start := time.Now()
+	status, err := resource.Ping(p.URL)
+	if err != nil {
+		respondWithError(w, httphelper.JSONError{
+			Code:    httphelper.ServiceUnavailableError,
+			Message: fmt.Sprintf("provider %s is unreachable: %s", p.Name, err),
+		})
+		return
+	}
+	httphelper.JSON(w, 200, &ct.ProviderStatus{
+		ProviderID: p.ID,
+		LatencyMs:  time.Since(start).Seconds() * 1000,
+		Version:    status.Version,
+	})
+}
+
 func (c *controllerAPI) ProvisionResource(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	p, err := c.getProvider(ctx)
 	if err != nil {
@@ -170,7 +269,43 @@ func (c *controllerAPI) ProvisionResource(ctx context.Context, w http.ResponseWr
 		respondWithError(w, err)
 		return
 	}
+	if err := applyPlan(p, &rr); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if respondAsync(req) {
+		// associate the operation with the app if there is only one, apps
+		// may be given by name so look up its ID
+		var appID string
+		if len(rr.Apps) == 1 {
+			app, err := c.appRepo.Get(rr.Apps[0])
+			if err != nil {
+				respondWithError(w, err)
+				return
+			}
+			appID = app.(*ct.App).ID
+		}
+		op, err := c.runOperation(ct.OperationTypeProvisionResource, appID, func() (interface{}, error) {
+			return c.provisionResource(p, &rr)
+		})
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		respondWithOperation(w, op)
+		return
+	}
+
+	res, err := c.provisionResource(p, &rr)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, res)
+}
 
+func (c *controllerAPI) provisionResource(p *ct.Provider, rr *ct.ResourceReq) (*ct.Resource, error) {
 	var config []byte
 	if rr.Config != nil {
 		config = *rr.Config
@@ -179,8 +314,7 @@ func (c *controllerAPI) ProvisionResource(ctx context.Context, w http.ResponseWr
 	}
 	data, err := resource.Provision(p.URL, config)
 	if err != nil {
-		respondWithError(w, err)
-		return
+		return nil, err
 	}
 
 	res := &ct.Resource{
@@ -191,16 +325,107 @@ func (c *controllerAPI) ProvisionResource(ctx context.Context, w http.ResponseWr
 	}
 
 	if err := schema.Validate(res); err != nil {
+		return nil, err
+	}
+
+	if err := c.resourceRepo.Add(res); err != nil {
+		// deprovision the resource so it isn't orphaned, if this fails
+		// it can be found by syncing the provider's resources
+		if err := resource.Deprovision(p.URL, data.ID); err != nil {
+			log.Printf("Error deprovisioning resource %s of provider %s: %s", data.ID, p.Name, err)
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// resourceSyncGrace is how long after being provisioned a resource is
+// considered to be in flight, as a provider has the resource before the
+// controller records it.
+var resourceSyncGrace = 10 * time.Minute
+
+// SyncProviderResources compares the resources the provider has with those
+// recorded by the controller, responding with the resources found on only
+// one side. If the repair parameter is true, orphaned resources are
+// deprovisioned and missing ones are removed from the controller. Missing
+// resources which are still bound to apps are reported rather than removed,
+// as the apps may still use their env. Resources created within
+// resourceSyncGrace, or orphaned resources the provider doesn't report a
+// creation time for, are not repaired.
+func (c *controllerAPI) SyncProviderResources(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	p, err := c.getProvider(ctx)
+	if err != nil {
 		respondWithError(w, err)
 		return
 	}
 
-	if err := c.resourceRepo.Add(res); err != nil {
-		// TODO: attempt to "rollback" provisioning
+	live, err := resource.List(p.URL)
+	if err == resource.ErrNotSupported {
+		respondWithError(w, ct.ValidationError{Message: fmt.Sprintf("provider %s doesn't support listing resources", p.Name)})
+		return
+	} else if err != nil {
+		respondWithError(w, httphelper.JSONError{
+			Code:    httphelper.ServiceUnavailableError,
+			Message: fmt.Sprintf("error listing resources of provider %s: %s", p.Name, err),
+		})
+		return
+	}
+	recorded, err := c.resourceRepo.ProviderList(p.ID)
+	if err != nil {
 		respondWithError(w, err)
 		return
 	}
-	httphelper.JSON(w, 200, res)
+
+	sync := &ct.ResourceSync{ProviderID: p.ID, Orphaned: []string{}, Missing: []*ct.Resource{}}
+	liveIDs := make(map[string]struct{}, len(live))
+	for _, r := range live {
+		liveIDs[r.ID] = struct{}{}
+	}
+	recordedIDs := make(map[string]struct{}, len(recorded))
+	for _, r := range recorded {
+		recordedIDs[r.ExternalID] = struct{}{}
+		if _, ok := liveIDs[r.ExternalID]; !ok {
+			sync.Missing = append(sync.Missing, r)
+		}
+	}
+	for _, r := range live {
+		if _, ok := recordedIDs[r.ID]; !ok {
+			sync.Orphaned = append(sync.Orphaned, r.ID)
+		}
+	}
+
+	if req.URL.Query().Get("repair") == "true" {
+		cutoff := time.Now().Add(-resourceSyncGrace)
+		for _, r := range live {
+			if _, ok := recordedIDs[r.ID]; ok {
+				continue
+			}
+			if r.CreatedAt == nil || r.CreatedAt.After(cutoff) {
+				sync.Skipped = append(sync.Skipped, r.ID)
+				continue
+			}
+			if err := resource.Deprovision(p.URL, r.ID); err != nil {
+				respondWithError(w, fmt.Errorf("error deprovisioning resource %s: %s", r.ID, err))
+				return
+			}
+		}
+		for _, r := range sync.Missing {
+			if r.CreatedAt == nil || r.CreatedAt.After(cutoff) {
+				sync.Skipped = append(sync.Skipped, r.ExternalID)
+				continue
+			}
+			removed, err := c.resourceRepo.RemoveUnbound(r.ID)
+			if err != nil {
+				respondWithError(w, err)
+				return
+			}
+			if !removed {
+				sync.Bound = append(sync.Bound, r.ExternalID)
+			}
+		}
+		sync.Repaired = true
+	}
+	httphelper.JSON(w, 200, sync)
 }
 
 func (c *controllerAPI) GetProviderResources(ctx context.Context, w http.ResponseWriter, req *http.Request) {
@@ -273,3 +498,146 @@ func (c *controllerAPI) GetAppResources(ctx context.Context, w http.ResponseWrit
 	}
 	httphelper.JSON(w, 200, res)
 }
+
+// PutAppResource binds an existing resource to the app and deploys a new
+// release with the resource's env merged into the app's env.
+func (c *controllerAPI) PutAppResource(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	app := c.getApp(ctx)
+
+	res, err := c.resourceRepo.Get(params.ByName("resources_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	// binding a resource copies its credentials into the app's env, so
+	// resources bound to apps the token can't access can't be bound, and
+	// resources not bound to any app can only be bound by full scope tokens
+	bound := false
+	for _, id := range res.Apps {
+		boundApp, err := c.appRepo.Get(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		if !authorizedForApp(ctx, boundApp.(*ct.App)) {
+			respondWithError(w, ErrNotFound)
+			return
+		}
+		bound = true
+	}
+	if !bound && !fullScope(ctx) {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	// the env change is deployed, so check the deploy lock before binding
+	holder := deployLockHolder(ctx, req.URL.Query().Get("lock_owner"))
+	if err := c.checkDeployLock(app, holder); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.resourceRepo.AddApp(res.ID, app.ID); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.updateAppEnv(app, res.Env, nil, holder); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	res, err = c.resourceRepo.Get(res.ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, res)
+}
+
+// DeleteAppResource unbinds a resource from the app and deploys a new release
+// with the resource's env removed from the app's env.
+func (c *controllerAPI) DeleteAppResource(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	app := c.getApp(ctx)
+
+	res, err := c.resourceRepo.Get(params.ByName("resources_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	bound := false
+	for _, id := range res.Apps {
+		if id == app.ID {
+			bound = true
+			break
+		}
+	}
+	if !bound {
+		respondWithError(w, ErrNotFound)
+		return
+	}
+	holder := deployLockHolder(ctx, req.URL.Query().Get("lock_owner"))
+	if err := c.checkDeployLock(app, holder); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.resourceRepo.RemoveApp(res.ID, app.ID); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.updateAppEnv(app, nil, res.Env, holder); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	res, err = c.resourceRepo.Get(res.ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, res)
+}
+
+// updateAppEnv deploys a new release for app with set merged into the env of
+// the current release, and the keys in unset removed if they still have the
+// given values. Nothing is deployed if the env is unchanged. lockHolder is
+// passed to createDeployment.
+func (c *controllerAPI) updateAppEnv(app *ct.App, set, unset map[string]string, lockHolder *ct.DeployLock) error {
+	release, err := c.appRepo.GetRelease(app.ID)
+	if err == ErrNotFound {
+		release = &ct.Release{}
+	} else if err != nil {
+		return err
+	}
+	env := make(map[string]string, len(release.Env)+len(set))
+	for k, v := range release.Env {
+		env[k] = v
+	}
+	changed := false
+	for k, v := range set {
+		if current, ok := env[k]; !ok || current != v {
+			env[k] = v
+			changed = true
+		}
+	}
+	for k, v := range unset {
+		if current, ok := env[k]; ok && current == v {
+			delete(env, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	newRelease := *release
+	newRelease.ID = ""
+	newRelease.CreatedAt = nil
+	newRelease.Env = env
+	if err := c.releaseRepo.Add(&newRelease); err != nil {
+		return err
+	}
+	_, err = c.createDeployment(app, &newRelease, nil, lockHolder)
+	return err
+}
@@ -6,11 +6,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/resource"
 )
 
 func (s *S) provisionTestResource(c *C, name string, apps []string) (*ct.Resource, *ct.Provider) {
@@ -33,6 +38,29 @@ func (s *S) provisionTestResource(c *C, name string, apps []string) (*ct.Resourc
 	return out, p
 }
 
+func (s *S) TestPingProvider(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, Equals, "/ping")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":"v1"}`))
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	p := s.createTestProvider(c, &ct.Provider{URL: fmt.Sprintf("http://%s/things", srv.Listener.Addr()), Name: "ping-provider"})
+	status, err := s.c.PingProvider(p.ID)
+	c.Assert(err, IsNil)
+	c.Assert(status.ProviderID, Equals, p.ID)
+	c.Assert(status.Version, Equals, "v1")
+	c.Assert(status.LatencyMs > 0, Equals, true)
+
+	// an unreachable provider is reported as unavailable
+	srv.Close()
+	_, err = s.c.PingProvider(p.ID)
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ServiceUnavailableError)
+}
+
 func (s *S) TestProvisionResource(c *C) {
 	app1 := s.createTestApp(c, &ct.App{Name: "provision-resource1"})
 	app2 := s.createTestApp(c, &ct.App{Name: "provision-resource2"})
@@ -52,6 +80,52 @@ func (s *S) TestProvisionResource(c *C) {
 	c.Assert(err, Equals, controller.ErrNotFound)
 }
 
+func (s *S) TestAppResourceBinding(c *C) {
+	resource, _ := s.provisionTestResource(c, "app-resource-binding", []string{})
+	app := s.createTestApp(c, &ct.App{Name: "app-resource-binding"})
+	release := s.createTestRelease(c, &ct.Release{Env: map[string]string{"BAR": "qux"}})
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+
+	res, err := s.c.AddResourceApp(app.ID, resource.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.Apps, DeepEquals, []string{app.ID})
+	appRelease, err := s.c.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(appRelease.ID, Not(Equals), release.ID)
+	c.Assert(appRelease.ArtifactID, Equals, release.ArtifactID)
+	c.Assert(appRelease.Env, DeepEquals, map[string]string{"BAR": "qux", "foo": "baz"})
+
+	resources, err := s.c.AppResourceList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(resources, HasLen, 1)
+	c.Assert(resources[0].ID, Equals, resource.ID)
+
+	c.Assert(s.c.DeleteResourceApp(app.ID, resource.ID), IsNil)
+	appRelease, err = s.c.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(appRelease.Env, DeepEquals, map[string]string{"BAR": "qux"})
+	resources, err = s.c.AppResourceList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(resources, HasLen, 0)
+
+	// unbinding a resource which isn't bound is not found
+	c.Assert(s.c.DeleteResourceApp(app.ID, resource.ID), Equals, controller.ErrNotFound)
+
+	// the resource can be bound again
+	res, err = s.c.AddResourceApp(app.ID, resource.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.Apps, DeepEquals, []string{app.ID})
+
+	// but not by tokens of apps which can't access the apps it is bound to
+	other := s.createTestApp(c, &ct.App{Name: "app-resource-binding-other"})
+	token := s.createTestAuthToken(c, &ct.AuthToken{Name: "app-resource-binding", Scope: ct.AuthTokenScopeApp, AppID: other.ID})
+	c.Assert(s.authTokenStatus(c, token, "PUT", "/apps/"+other.ID+"/resources/"+resource.ID), Equals, 404)
+
+	// nor can unbound resources be bound by scoped tokens
+	c.Assert(s.c.DeleteResourceApp(app.ID, resource.ID), IsNil)
+	c.Assert(s.authTokenStatus(c, token, "PUT", "/apps/"+other.ID+"/resources/"+resource.ID), Equals, 404)
+}
+
 func (s *S) TestPutResource(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "put-resource"})
 	provider := s.createTestProvider(c, &ct.Provider{URL: "https://example.ca", Name: "put-resource"})
@@ -93,3 +167,184 @@ func (s *S) TestResourceLists(c *C) {
 	check(s.c.AppResourceList(app1.ID))
 	check(s.c.AppResourceList(app1.ID))
 }
+
+func (s *S) TestProvisionResourceAsync(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "provision-resource-async"})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"id":"/things/provision-resource-async","env":{"foo":"baz"}}`))
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	p := s.createTestProvider(c, &ct.Provider{URL: fmt.Sprintf("http://%s/things", srv.Listener.Addr()), Name: "provision-resource-async"})
+	op, err := s.c.ProvisionResourceAsync(&ct.ResourceReq{ProviderID: p.ID, Apps: []string{app.Name}})
+	c.Assert(err, IsNil)
+	c.Assert(op.ID, Not(Equals), "")
+	c.Assert(op.Type, Equals, ct.OperationTypeProvisionResource)
+	c.Assert(op.AppID, Equals, app.ID)
+	c.Assert(op.Status, Equals, ct.OperationStatusRunning)
+
+	var resource ct.Resource
+	c.Assert(s.c.WaitOperation(op.ID, &resource), IsNil)
+	c.Assert(resource.ProviderID, Equals, p.ID)
+	c.Assert(resource.ExternalID, Equals, "/things/provision-resource-async")
+	c.Assert(resource.Apps, DeepEquals, []string{app.ID})
+
+	op, err = s.c.GetOperation(op.ID)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, ct.OperationStatusComplete)
+
+	// failures are reported by the operation
+	srv.Close()
+	op, err = s.c.ProvisionResourceAsync(&ct.ResourceReq{ProviderID: p.ID})
+	c.Assert(err, IsNil)
+	c.Assert(s.c.WaitOperation(op.ID, nil), NotNil)
+	op, err = s.c.GetOperation(op.ID)
+	c.Assert(err, IsNil)
+	c.Assert(op.Status, Equals, ct.OperationStatusFailed)
+	c.Assert(op.Error, Not(Equals), "")
+
+	_, err = s.c.GetOperation(random.UUID())
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (s *S) TestProvisionResourcePlan(c *C) {
+	var provisioned map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(json.NewDecoder(req.Body).Decode(&provisioned), IsNil)
+		w.Write([]byte(fmt.Sprintf(`{"id":"/things/%s","env":{"foo":"baz"}}`, random.String(8))))
+	}))
+	defer srv.Close()
+
+	small := json.RawMessage(`{"memory":"512MB"}`)
+	large := json.RawMessage(`{"memory":"4GB","replicas":"2"}`)
+	p := s.createTestProvider(c, &ct.Provider{
+		URL:   fmt.Sprintf("http://%s/things", srv.Listener.Addr()),
+		Name:  "provision-resource-plan",
+		Plans: map[string]*json.RawMessage{"small": &small, "large": &large},
+	})
+	gotProvider, err := s.c.GetProvider(p.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotProvider.Plans, HasLen, 2)
+
+	// the plan config is merged with the request config
+	conf := json.RawMessage(`{"version":"9.4"}`)
+	_, err = s.c.ProvisionResource(&ct.ResourceReq{ProviderID: p.ID, Plan: "large", Config: &conf})
+	c.Assert(err, IsNil)
+	c.Assert(provisioned, DeepEquals, map[string]string{"memory": "4GB", "replicas": "2", "version": "9.4"})
+
+	_, err = s.c.ProvisionResource(&ct.ResourceReq{ProviderID: p.ID, Plan: "small"})
+	c.Assert(err, IsNil)
+	c.Assert(provisioned, DeepEquals, map[string]string{"memory": "512MB"})
+
+	// values set by the plan can't be overridden
+	conf = json.RawMessage(`{"memory":"64GB"}`)
+	_, err = s.c.ProvisionResource(&ct.ResourceReq{ProviderID: p.ID, Plan: "small", Config: &conf})
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+
+	_, err = s.c.ProvisionResource(&ct.ResourceReq{ProviderID: p.ID, Plan: "huge"})
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+}
+
+func (s *S) TestUpdateProvider(c *C) {
+	p := s.createTestProvider(c, &ct.Provider{URL: "https://example.com/update-provider", Name: "update-provider"})
+
+	// plans can be added to an existing provider, leaving the URL
+	small := json.RawMessage(`{"memory":"512MB"}`)
+	c.Assert(s.c.UpdateProvider(&ct.Provider{ID: p.ID, Plans: map[string]*json.RawMessage{"small": &small}}), IsNil)
+	gotProvider, err := s.c.GetProvider(p.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotProvider.URL, Equals, p.URL)
+	c.Assert(gotProvider.Plans, HasLen, 1)
+	c.Assert(string(*gotProvider.Plans["small"]), Equals, string(small))
+
+	// the URL can be changed, leaving the plans
+	c.Assert(s.c.UpdateProvider(&ct.Provider{ID: p.ID, URL: "https://example.com/update-provider-2"}), IsNil)
+	gotProvider, err = s.c.GetProvider(p.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotProvider.URL, Equals, "https://example.com/update-provider-2")
+	c.Assert(gotProvider.Plans, HasLen, 1)
+
+	// plans must be JSON objects
+	invalid := json.RawMessage(`"512MB"`)
+	err = s.c.UpdateProvider(&ct.Provider{ID: p.ID, Plans: map[string]*json.RawMessage{"small": &invalid}})
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationError)
+}
+
+func (s *S) TestSyncProviderResources(c *C) {
+	var mtx sync.Mutex
+	created := time.Now().Add(-time.Hour)
+	live := map[string]*time.Time{"/things/orphaned": &created, "/things/unknown": nil}
+	var deleted []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch req.Method {
+		case "POST":
+			now := time.Now()
+			live["/things/recorded"] = &now
+			w.Write([]byte(`{"id":"/things/recorded","env":{"foo":"bar"}}`))
+		case "GET":
+			resources := make([]*resource.Resource, 0, len(live))
+			for id, t := range live {
+				resources = append(resources, &resource.Resource{ID: id, CreatedAt: t})
+			}
+			json.NewEncoder(w).Encode(resources)
+		case "DELETE":
+			deleted = append(deleted, req.URL.Path)
+		}
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	p := s.createTestProvider(c, &ct.Provider{URL: fmt.Sprintf("http://%s/things", srv.Listener.Addr()), Name: "sync-resources"})
+	recorded, err := s.c.ProvisionResource(&ct.ResourceReq{ProviderID: p.ID})
+	c.Assert(err, IsNil)
+	missing := &ct.Resource{ID: random.UUID(), ProviderID: p.ID, ExternalID: "/things/missing"}
+	c.Assert(s.c.PutResource(missing), IsNil)
+	app := s.createTestApp(c, &ct.App{Name: "sync-resources"})
+	bound := &ct.Resource{ID: random.UUID(), ProviderID: p.ID, ExternalID: "/things/bound", Apps: []string{app.ID}}
+	c.Assert(s.c.PutResource(bound), IsNil)
+
+	// without repair nothing is changed
+	res, err := s.c.SyncProviderResources(p.ID, false)
+	c.Assert(err, IsNil)
+	sort.Strings(res.Orphaned)
+	c.Assert(res.Orphaned, DeepEquals, []string{"/things/orphaned", "/things/unknown"})
+	c.Assert(res.Missing, HasLen, 2)
+	c.Assert(res.Repaired, Equals, false)
+	c.Assert(deleted, HasLen, 0)
+
+	// resources which may still be being provisioned are not repaired
+	res, err = s.c.SyncProviderResources(p.ID, true)
+	c.Assert(err, IsNil)
+	c.Assert(res.Repaired, Equals, true)
+	sort.Strings(res.Skipped)
+	c.Assert(res.Skipped, DeepEquals, []string{"/things/bound", "/things/missing", "/things/unknown"})
+	c.Assert(deleted, DeepEquals, []string{"/things/orphaned"})
+	_, err = s.c.GetResource(p.ID, missing.ID)
+	c.Assert(err, IsNil)
+
+	defer func(grace time.Duration) { resourceSyncGrace = grace }(resourceSyncGrace)
+	resourceSyncGrace = 0
+	mtx.Lock()
+	delete(live, "/things/orphaned")
+	mtx.Unlock()
+	res, err = s.c.SyncProviderResources(p.ID, true)
+	c.Assert(err, IsNil)
+	c.Assert(res.Skipped, DeepEquals, []string{"/things/unknown"})
+	c.Assert(deleted, HasLen, 1)
+	_, err = s.c.GetResource(p.ID, missing.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// missing resources which are bound to apps are reported rather than
+	// removed
+	c.Assert(res.Bound, DeepEquals, []string{"/things/bound"})
+	_, err = s.c.GetResource(p.ID, bound.ID)
+	c.Assert(err, IsNil)
+	_, err = s.c.GetResource(p.ID, recorded.ID)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+)
+
+// routeCollector removes routes which reference apps that no longer exist, as
+// deleting an app leaves its routes in the router.
+type routeCollector struct {
+	db       *postgres.DB
+	router   routerc.Client
+	interval time.Duration
+}
+
+func (r *routeCollector) Run() {
+	for range time.Tick(r.interval) {
+		routes, err := r.Collect(false)
+		if err != nil {
+			log.Printf("Error removing orphaned routes: %s", err)
+		}
+		for _, route := range routes {
+			log.Printf("Removed orphaned route %s for %s", route.ID, route.ParentRef)
+		}
+	}
+}
+
+// Collect removes the routes whose parent app doesn't exist or has been
+// deleted and returns them, if dryRun is true they are returned without being
+// removed. Routes which weren't created by the controller are ignored.
+func (r *routeCollector) Collect(dryRun bool) ([]*router.Route, error) {
+	routes, err := r.router.ListRoutes("")
+	if err != nil {
+		return nil, err
+	}
+	prefix := routeParentRef("")
+	exists := make(map[string]bool)
+	orphaned := []*router.Route{}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.ParentRef, prefix) {
+			continue
+		}
+		appID := strings.TrimPrefix(route.ParentRef, prefix)
+		ok, checked := exists[appID]
+		if !checked {
+			if idPattern.MatchString(appID) {
+				if err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM apps WHERE app_id = $1 AND deleted_at IS NULL)", appID).Scan(&ok); err != nil {
+					return nil, err
+				}
+			}
+			exists[appID] = ok
+		}
+		if ok {
+			continue
+		}
+		if !dryRun {
+			if err := r.router.DeleteRoute(route.Type, route.ID); err != nil && err != routerc.ErrNotFound {
+				return orphaned, err
+			}
+		}
+		orphaned = append(orphaned, route)
+	}
+	return orphaned, nil
+}
+
+// CollectRoutes removes orphaned routes and responds with the routes removed,
+// or with the routes which would be removed if the dry_run parameter is true.
+func (c *controllerAPI) CollectRoutes(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	routes, err := c.routeCollector.Collect(req.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, routes)
+}
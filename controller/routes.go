@@ -2,9 +2,11 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/httphelper"
 	routerc "github.com/flynn/flynn/router/client"
 	"github.com/flynn/flynn/router/types"
@@ -17,14 +19,24 @@ func (c *controllerAPI) CreateRoute(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
-	route.ParentRef = routeParentRef(c.getApp(ctx).ID)
+	app := c.getApp(ctx)
+	route.ParentRef = routeParentRef(app.ID)
+	if route.Type == "http" && app.Maintenance != nil {
+		route.Maintenance = true
+		route.MaintenancePage = app.Maintenance.Page
+	}
 
 	if err := schema.Validate(route); err != nil {
 		respondWithError(w, err)
 		return
 	}
 
-	if err := c.routerc.CreateRoute(&route); err != nil {
+	if err := c.verifyRouteDomain(app, &route); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err := c.createRoute(&route); err != nil {
 		respondWithError(w, err)
 		return
 	}
@@ -51,6 +63,10 @@ func (c *controllerAPI) GetRouteList(ctx context.Context, w http.ResponseWriter,
 }
 
 func (c *controllerAPI) DeleteRoute(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if app := c.getApp(ctx); app.Policy != nil && app.Policy.LockRoutes {
+		respondWithError(w, errRoutesLocked)
+		return
+	}
 	route, err := c.getRoute(ctx)
 	if err != nil {
 		respondWithError(w, err)
@@ -67,3 +83,50 @@ func (c *controllerAPI) DeleteRoute(ctx context.Context, w http.ResponseWriter,
 	}
 	w.WriteHeader(200)
 }
+
+// createRoute creates route in the router, returning a validation error if
+// its domain, or port or server name for TCP routes, is already used by
+// another route. The
+// router enforces this with unique indexes, so it holds for concurrent
+// requests.
+func (c *controllerAPI) createRoute(route *router.Route) error {
+	if route.Type == "http" {
+		// domains are case insensitive, but the router's index is not
+		route.Domain = strings.ToLower(route.Domain)
+	}
+	err := c.routerc.CreateRoute(route)
+	if err == routerc.ErrConflict {
+		field := "domain"
+		if route.Type == "tcp" {
+			field = "port"
+			if route.ServerName != "" {
+				field = "server_name"
+			}
+		}
+		return ct.ValidationError{Field: field, Message: "is already used by another route"}
+	}
+	return err
+}
+
+// verifyRouteDomain checks the domain of an HTTP route is verified for app if
+// domain verification is enabled.
+func (c *controllerAPI) verifyRouteDomain(app *ct.App, route *router.Route) error {
+	if c.domainVerifier == nil || route.Type != "http" {
+		return nil
+	}
+	routes, err := c.routerc.ListRoutes(routeParentRef(app.ID))
+	if err != nil {
+		return err
+	}
+	domains := make([]string, 0, len(routes))
+	for _, r := range routes {
+		if r.Type == "http" {
+			domains = append(domains, r.Domain)
+		}
+	}
+	defaultDomain, err := c.appRepo.appDefaultRouteDomain(app)
+	if err != nil {
+		return err
+	}
+	return c.domainVerifier.Verify(app.ID, defaultDomain, route.Domain, domains)
+}
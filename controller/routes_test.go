@@ -2,12 +2,14 @@ package main
 
 import (
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
+	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
 	routerc "github.com/flynn/flynn/router/client"
@@ -21,11 +23,17 @@ func newFakeRouter() routerc.Client {
 type fakeRouter struct {
 	mtx    sync.RWMutex
 	routes map[string]*router.Route
+	stats  []*router.HTTPRouteStats
 }
 
 func (r *fakeRouter) CreateRoute(route *router.Route) error {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
+	for _, existing := range r.routes {
+		if existing.Type == "http" && route.Type == "http" && existing.Domain == route.Domain {
+			return routerc.ErrConflict
+		}
+	}
 	route.ID = route.Type + "/" + postgres.FormatUUID(random.UUID())
 	now := time.Now()
 	route.CreatedAt = now
@@ -55,7 +63,18 @@ func (r *fakeRouter) GetRoute(routeType, id string) (*router.Route, error) {
 	return route, nil
 }
 
-func (r *fakeRouter) UpdateRoute(*router.Route) error { return nil }
+func (r *fakeRouter) UpdateRoute(route *router.Route) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, exists := r.routes[route.ID]; !exists {
+		return routerc.ErrNotFound
+	}
+	route.UpdatedAt = time.Now()
+	r.routes[route.ID] = route
+	return nil
+}
+
+func (r *fakeRouter) ApplyRoutes(string, *router.RouteBatch) error { return nil }
 
 type sortedRoutes []*router.Route
 
@@ -78,6 +97,24 @@ func (r *fakeRouter) ListRoutes(parentRef string) ([]*router.Route, error) {
 	return routes, nil
 }
 
+func (r *fakeRouter) HTTPStats() ([]*router.HTTPRouteStats, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.stats, nil
+}
+
+func (r *fakeRouter) DrainBackend(addr string, timeout time.Duration) (*router.BackendStatus, error) {
+	return &router.BackendStatus{Addr: addr, Draining: true}, nil
+}
+
+func (r *fakeRouter) UndrainBackend(addr string) error { return nil }
+
+func (r *fakeRouter) GetBackend(addr string) (*router.BackendStatus, error) {
+	return &router.BackendStatus{Addr: addr}, nil
+}
+
+func (r *fakeRouter) RotateCookieKeys() error { return nil }
+
 func (r *fakeRouter) Close() error { return nil }
 
 func (s *S) createTestRoute(c *C, appID string, in *router.Route) *router.Route {
@@ -121,3 +158,134 @@ func (s *S) TestListRoutes(c *C) {
 	c.Assert(routes[1].ID, Equals, route0.ID)
 	c.Assert(routes[0].ID, Equals, route1.ID)
 }
+
+func (s *S) TestAppMaintenance(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "maintenance"})
+	httpRoute := s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "maintenance.example.com", Service: "maintenance-web"}).ToRoute())
+	s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "maintenance-tcp"}).ToRoute())
+
+	c.Assert(s.c.SetAppMaintenance(app.ID, &ct.AppMaintenance{Enabled: true, Page: "back soon"}), IsNil)
+	gotApp, err := s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Maintenance, DeepEquals, &ct.AppMaintenance{Enabled: true, Page: "back soon"})
+
+	routes, err := s.c.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+	for _, route := range routes {
+		if route.Type == "http" {
+			c.Assert(route.Maintenance, Equals, true)
+			c.Assert(route.MaintenancePage, Equals, "back soon")
+		} else {
+			c.Assert(route.Maintenance, Equals, false)
+		}
+	}
+
+	// routes created in maintenance mode inherit it
+	newRoute := s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "maintenance2.example.com", Service: "maintenance-web"}).ToRoute())
+	c.Assert(newRoute.Maintenance, Equals, true)
+
+	c.Assert(s.c.SetAppMaintenance(app.ID, &ct.AppMaintenance{Enabled: false}), IsNil)
+	gotApp, err = s.c.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Maintenance, IsNil)
+	gotRoute, err := s.c.GetRoute(app.ID, httpRoute.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRoute.Maintenance, Equals, false)
+	c.Assert(gotRoute.MaintenancePage, Equals, "")
+
+	// the page size is limited
+	err = s.c.SetAppMaintenance(app.ID, &ct.AppMaintenance{Enabled: true, Page: strings.Repeat("a", maxMaintenancePageSize+1)})
+	c.Assert(err, NotNil)
+	c.Assert(err.(hh.JSONError).Code, Equals, hh.ValidationError)
+	gotRoute, err = s.c.GetRoute(app.ID, httpRoute.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRoute.Maintenance, Equals, false)
+}
+
+func (s *S) TestCreateRouteDomainConflict(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "route-conflict"})
+	other := s.createTestApp(c, &ct.App{Name: "route-conflict-other"})
+	s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "route-conflict.example.com"}).ToRoute())
+
+	// the domain can't be claimed by another app, regardless of case
+	err := s.c.CreateRoute(other.ID, (&router.HTTPRoute{Domain: "Route-Conflict.example.com"}).ToRoute())
+	c.Assert(err, NotNil)
+	jsonErr := err.(hh.JSONError)
+	c.Assert(jsonErr.Code, Equals, hh.ValidationError)
+	c.Assert(jsonErr.Field, Equals, "domain")
+
+	routes, err := s.c.RouteList(other.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 0)
+
+	// other domains are unaffected
+	s.createTestRoute(c, other.ID, (&router.HTTPRoute{Domain: "route-conflict-other.example.com"}).ToRoute())
+}
+
+func (s *S) TestVerifyRouteDomain(c *C) {
+	v := newDomainVerifier("test", func() string { return "cluster.example.com" })
+	txt := map[string][]string{}
+	cnames := map[string]string{}
+	v.lookupTXT = func(name string) ([]string, error) { return txt[name], nil }
+	v.lookupCNAME = func(name string) (string, error) { return cnames[name], nil }
+	appID := random.UUID()
+
+	// the app's default domain doesn't need verifying, but other names
+	// under the default domain can't be routed
+	appDomain := "app.cluster.example.com"
+	c.Assert(v.Verify(appID, appDomain, appDomain, nil), IsNil)
+	c.Assert(v.Verify(appID, appDomain, "other.cluster.example.com", nil), NotNil)
+	c.Assert(v.Verify(appID, appDomain, "app.team.cluster.example.com", nil), NotNil)
+	c.Assert(v.Verify(appID, appDomain, "*.cluster.example.com", nil), NotNil)
+	c.Assert(v.Verify(appID, appDomain, "*.app.cluster.example.com", nil), NotNil)
+	c.Assert(v.Verify(appID, "", appDomain, nil), NotNil)
+
+	err := v.Verify(appID, appDomain, "verify.example.org", nil)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(err.(ct.ValidationError).Field, Equals, "domain")
+
+	txt["_flynn-verification.verify.example.org"] = []string{v.Token(appID, "verify.example.org")}
+	c.Assert(v.Verify(appID, appDomain, "verify.example.org", nil), IsNil)
+	c.Assert(v.Verify(appID, appDomain, "*.Verify.example.org", nil), IsNil)
+	// the token is only valid for the app it was created for
+	c.Assert(v.Verify(random.UUID(), appDomain, "verify.example.org", nil), NotNil)
+
+	cnames["cname.example.org"] = "app.cluster.example.com."
+	c.Assert(v.Verify(appID, appDomain, "cname.example.org", nil), NotNil)
+	c.Assert(v.Verify(appID, appDomain, "cname.example.org", []string{"app.cluster.example.com"}), IsNil)
+}
+
+func (s *S) TestCollectRoutes(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "collect-routes"})
+	deleted := s.createTestApp(c, &ct.App{Name: "collect-routes-deleted"})
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "foo"}).ToRoute())
+	orphan := s.createTestRoute(c, deleted.ID, (&router.TCPRoute{Service: "bar"}).ToRoute())
+	c.Assert(s.c.DeleteApp(deleted.ID), IsNil)
+
+	// routes not created by the controller are left alone
+	rtr := s.hc.sc.(*fakeRouter)
+	other := (&router.TCPRoute{Service: "baz"}).ToRoute()
+	other.ParentRef = "other/thing"
+	c.Assert(rtr.CreateRoute(other), IsNil)
+	defer rtr.DeleteRoute(other.Type, other.ID)
+
+	routes, err := s.c.CollectRoutes(true)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].ID, Equals, orphan.ID)
+	_, err = rtr.GetRoute(orphan.Type, strings.TrimPrefix(orphan.ID, orphan.Type+"/"))
+	c.Assert(err, IsNil)
+
+	routes, err = s.c.CollectRoutes(false)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].ID, Equals, orphan.ID)
+	_, err = rtr.GetRoute(orphan.Type, strings.TrimPrefix(orphan.ID, orphan.Type+"/"))
+	c.Assert(err, Equals, routerc.ErrNotFound)
+
+	_, err = s.c.GetRoute(app.ID, route.ID)
+	c.Assert(err, IsNil)
+	_, err = rtr.GetRoute(other.Type, strings.TrimPrefix(other.ID, other.Type+"/"))
+	c.Assert(err, IsNil)
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
 	"github.com/flynn/flynn/discoverd/client"
@@ -22,6 +23,10 @@ import (
 
 var backoffPeriod = 10 * time.Minute
 
+// hostDownTimeout is how long a host may go without heartbeating to discoverd
+// before it is considered lost and its jobs are restarted on other hosts.
+var hostDownTimeout = 30 * time.Second
+
 func main() {
 	defer shutdown.Exit()
 
@@ -36,6 +41,14 @@ func main() {
 		}
 		grohl.Log(grohl.Data{"at": "backoff_period", "period": backoffPeriod.String()})
 	}
+	if timeout := os.Getenv("HOST_DOWN_TIMEOUT"); timeout != "" {
+		var err error
+		hostDownTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+		grohl.Log(grohl.Data{"at": "host_down_timeout", "timeout": hostDownTimeout.String()})
+	}
 
 	cc, err := controller.NewClient("", os.Getenv("AUTH_KEY"))
 	if err != nil {
@@ -46,6 +59,11 @@ func main() {
 		shutdown.Fatal(err)
 	}
 	c := newContext(cc, cl)
+	c.spreadTag = os.Getenv("SPREAD_HOST_TAG")
+	c.secretsKey, err = secrets.ParseKey(os.Getenv("SECRETS_KEY"))
+	if err != nil {
+		shutdown.Fatal(err)
+	}
 
 	c.watchHosts()
 
@@ -75,6 +93,8 @@ func main() {
 
 	grohl.Log(grohl.Data{"at": "leader"})
 
+	go c.watchSettings()
+
 	// TODO: periodic full cluster sync for anti-entropy
 	c.watchFormations()
 }
@@ -87,6 +107,8 @@ func newContext(cc controllerClient, cl clusterClient) *context {
 		hosts:            newHostClients(),
 		jobs:             newJobMap(),
 		omni:             make(map[*Formation]struct{}),
+		downHosts:        make(map[string]*time.Timer),
+		lostJobs:         make(map[string][]string),
 	}
 }
 
@@ -100,6 +122,27 @@ type context struct {
 	hosts *hostClients
 	jobs  *jobMap
 	mtx   sync.RWMutex
+
+	// downHosts are the hosts which have stopped heartbeating, which are
+	// considered lost if they don't come back within hostDownTimeout.
+	// lostJobs are the IDs of the jobs of lost hosts which were replaced,
+	// which are stopped if their host comes back.
+	downHosts map[string]*time.Timer
+	lostJobs  map[string][]string
+	downMtx   sync.Mutex
+
+	// secretsKey opens the secret env vars of releases when starting jobs.
+	secretsKey *secrets.Key
+
+	// spreadTag is an optional host metadata key, such as a zone, whose
+	// values jobs of the same app and type are spread across before they
+	// are spread across hosts.
+	spreadTag string
+
+	// strategy is the scheduling_strategy setting, which is polled by
+	// watchSettings as settings changes are not streamed.
+	strategy    string
+	strategyMtx sync.RWMutex
 }
 
 type clusterClient interface {
@@ -113,8 +156,11 @@ type controllerClient interface {
 	GetRelease(releaseID string) (*ct.Release, error)
 	GetArtifact(artifactID string) (*ct.Artifact, error)
 	GetFormation(appID, releaseID string) (*ct.Formation, error)
+	GetSetting(key string) (*ct.Setting, error)
 	StreamFormations(since *time.Time, output chan<- *ct.ExpandedFormation) (stream.Stream, error)
 	PutJob(job *ct.Job) error
+	VolumeList(appID string) ([]*ct.Volume, error)
+	CreateVolume(appID string, vol *ct.Volume) error
 }
 
 func jobMetaFromMetadata(metadata map[string]string) map[string]string {
@@ -249,6 +295,10 @@ func (c *context) watchFormations() {
 			f := c.formations.Get(ef.App.ID, ef.Release.ID)
 			if f != nil {
 				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "update"})
+				// the artifact of formations added by syncCluster lacks
+				// the pull credentials of its registry
+				f.SetArtifact(ef.Artifact)
+				f.SetSchedulingStrategy(ef.App.SchedulingStrategy)
 				f.SetProcesses(ef.Processes)
 			} else {
 				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "new"})
@@ -279,10 +329,16 @@ func (c *context) watchHosts() {
 		// TODO: log/handle error
 	}
 
+	go c.watchHeartbeats()
+
 	go func() { // watch for new hosts
 		ch := make(chan *host.HostEvent)
 		c.StreamHostEvents(ch)
 		for event := range ch {
+			if event.Event == "remove" {
+				go c.hostRemoved(event.HostID)
+				continue
+			}
 			if event.Event != "add" {
 				continue
 			}
@@ -360,76 +416,334 @@ func (c *context) watchHost(id string, ready chan struct{}) {
 
 	g.Log(grohl.Data{"at": "start"})
 
-	ch := make(chan *host.Event)
-	h.StreamEvents("all", ch)
+	var ch chan *host.Event
+	var lastID int64
+	var missed bool
+	streamEvents := func() (err error) {
+		ch = make(chan *host.Event)
+		_, err = h.StreamEventsSince("all", lastID, ch)
+		if err == cluster.ErrEventsMissed {
+			// the host no longer has the events since the last one
+			// received, so stream new events and resync its jobs
+			missed = true
+			lastID = 0
+			ch = make(chan *host.Event)
+			_, err = h.StreamEventsSince("all", 0, ch)
+		}
+		return
+	}
+	err := streamEvents()
 	if ready != nil {
 		ready <- struct{}{}
 	}
+	if err != nil {
+		g.Log(grohl.Data{"at": "stream_events_error", "err": err})
+		return
+	}
 
-	for event := range ch {
-		meta := event.Job.Job.Metadata
-		appID := meta["flynn-controller.app"]
-		releaseID := meta["flynn-controller.release"]
-		jobType := meta["flynn-controller.type"]
+	for {
+		for event := range ch {
+			lastID = event.ID
+			c.handleHostEvent(g, id, event)
+		}
 
-		if appID == "" || releaseID == "" {
-			continue
+		// the stream was dropped, so resume it from the last event
+		// received, giving up if the host has gone away
+		g.Log(grohl.Data{"at": "reconnect", "last_id": lastID})
+		if err := dialHostAttempts.Run(streamEvents); err != nil {
+			g.Log(grohl.Data{"at": "reconnect_error", "err": err})
+			return
 		}
+		if missed {
+			missed = false
+			g.Log(grohl.Data{"at": "events_missed"})
+			go c.resyncHost(id, h)
+		}
+	}
+}
+
+// resyncHost brings the jobs of a host in line with those it is running after
+// its events have been missed, restarting the jobs which have stopped and
+// adding those which were started.
+func (c *context) resyncHost(id string, h cluster.Host) {
+	g := grohl.NewContext(grohl.Data{"fn": "resyncHost", "host.id": id})
 
-		job := &ct.Job{
-			ID:        id + "-" + event.JobID,
-			AppID:     appID,
-			ReleaseID: releaseID,
-			Type:      jobType,
-			State:     jobState(event),
-			Meta:      jobMetaFromMetadata(meta),
+	active, err := h.ListJobs()
+	if err != nil {
+		g.Log(grohl.Data{"at": "list_jobs_error", "err": err})
+		return
+	}
+	c.mtx.RLock()
+	jobs := c.jobs.ByHost(id)
+	c.mtx.RUnlock()
+	for _, j := range jobs {
+		if job, ok := active[j.ID]; ok && (job.Status == host.StatusStarting || job.Status == host.StatusRunning) {
+			continue
+		}
+		// the stop event may have been received since listing the jobs
+		if c.jobs.Get(id, j.ID) != j {
+			continue
 		}
-		g.Log(grohl.Data{"at": "event", "job.id": event.JobID, "event": event.Event})
+		g.Log(grohl.Data{"at": "remove", "job.id": j.ID})
+		go c.putJobDown(g, j)
+		c.jobs.Remove(id, j.ID)
+		go func(j *Job) {
+			c.mtx.RLock()
+			j.Formation.RestartJob(j.Type, id, j.ID)
+			c.mtx.RUnlock()
+		}(j)
+	}
+	c.syncCluster()
+}
 
-		// Call PutJob in a goroutine as it may be the controller which has died
-		go func(event *host.Event) {
-			putJobAttempts.Run(func() error {
-				if err := c.PutJob(job); err != nil {
-					g.Log(grohl.Data{"at": "error", "job.id": event.JobID, "event": event.Event, "err": err})
-					return err
-				}
-				g.Log(grohl.Data{"at": "put_job", "job.id": event.JobID, "event": event.Event})
-				return nil
-			})
-		}(event)
+// handleHostEvent updates the controller with the job described by event and
+// restarts the job if it has stopped.
+func (c *context) handleHostEvent(g *grohl.Context, id string, event *host.Event) {
+	meta := event.Job.Job.Metadata
+	appID := meta["flynn-controller.app"]
+	releaseID := meta["flynn-controller.release"]
+	jobType := meta["flynn-controller.type"]
+
+	if appID == "" || releaseID == "" {
+		return
+	}
+	if event.Event == "health_check_failed" {
+		// the job is killed by the host, and restarted once it
+		// stops like any other job
+		g.Log(grohl.Data{"at": "health_check_failed", "job.id": event.JobID})
+		return
+	}
+
+	job := &ct.Job{
+		ID:        id + "-" + event.JobID,
+		AppID:     appID,
+		ReleaseID: releaseID,
+		Type:      jobType,
+		State:     jobState(event),
+		Meta:      jobMetaFromMetadata(meta),
+	}
+	g.Log(grohl.Data{"at": "event", "job.id": event.JobID, "event": event.Event})
+
+	// Call PutJob in a goroutine as it may be the controller which has died
+	go func(event *host.Event) {
+		putJobAttempts.Run(func() error {
+			if err := c.PutJob(job); err != nil {
+				g.Log(grohl.Data{"at": "error", "job.id": event.JobID, "event": event.Event, "err": err})
+				return err
+			}
+			g.Log(grohl.Data{"at": "put_job", "job.id": event.JobID, "event": event.Event})
+			return nil
+		})
+	}(event)
+
+	// get a read lock on the mutex to ensure we are not currently
+	// syncing with the cluster
+	c.mtx.RLock()
+	j := c.jobs.Get(id, event.JobID)
+	c.mtx.RUnlock()
+	if j == nil {
+		return
+	}
+	j.startedAt = event.Job.StartedAt
 
-		// get a read lock on the mutex to ensure we are not currently
-		// syncing with the cluster
+	if event.Event != "error" && event.Event != "stop" {
+		return
+	}
+	g.Log(grohl.Data{"at": "remove", "job.id": event.JobID, "event": event.Event})
+
+	c.jobs.Remove(id, event.JobID)
+	go func(event *host.Event) {
 		c.mtx.RLock()
-		j := c.jobs.Get(id, event.JobID)
+		j.Formation.RestartJob(jobType, id, event.JobID)
 		c.mtx.RUnlock()
-		if j == nil {
-			continue
-		}
-		j.startedAt = event.Job.StartedAt
+	}(event)
+}
 
-		if event.Event != "error" && event.Event != "stop" {
+// watchHeartbeats watches the discoverd registrations of hosts, which expire
+// when hosts stop heartbeating, for hosts going down and coming back.
+func (c *context) watchHeartbeats() {
+	g := grohl.NewContext(grohl.Data{"fn": "watchHeartbeats"})
+	for {
+		events := make(chan *discoverd.Event)
+		stream, err := discoverd.NewService("flynn-host").Watch(events)
+		if err != nil {
+			g.Log(grohl.Data{"at": "error", "err": err})
+			time.Sleep(time.Second)
 			continue
 		}
-		g.Log(grohl.Data{"at": "remove", "job.id": event.JobID, "event": event.Event})
+		for event := range events {
+			if event.Instance == nil || event.Instance.Meta["id"] == "" {
+				continue
+			}
+			switch event.Kind {
+			case discoverd.EventKindDown:
+				c.hostDown(event.Instance.Meta["id"])
+			case discoverd.EventKindUp:
+				c.hostUp(event.Instance.Meta["id"])
+			}
+		}
+		g.Log(grohl.Data{"at": "disconnect", "err": stream.Err()})
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *context) hostDown(id string) {
+	c.downMtx.Lock()
+	defer c.downMtx.Unlock()
+	if _, ok := c.downHosts[id]; ok {
+		return
+	}
+	grohl.Log(grohl.Data{"fn": "hostDown", "host.id": id, "timeout": hostDownTimeout.String()})
+	c.downHosts[id] = time.AfterFunc(hostDownTimeout, func() { c.hostLost(id) })
+}
+
+func (c *context) hostUp(id string) {
+	c.downMtx.Lock()
+	timer, ok := c.downHosts[id]
+	if ok {
+		timer.Stop()
+		delete(c.downHosts, id)
+	}
+	lost := c.lostJobs[id]
+	delete(c.lostJobs, id)
+	c.downMtx.Unlock()
+	if !ok {
+		return
+	}
+
+	grohl.Log(grohl.Data{"fn": "hostUp", "host.id": id, "lost_jobs": len(lost)})
+	if len(lost) > 0 {
+		go c.stopLostJobs(id, lost)
+	}
+	// the event stream of the host may have been given up on while it
+	// was down
+	go c.watchHost(id, nil)
+}
+
+// hostIsDown returns whether the host has stopped heartbeating, in which case
+// new jobs are not scheduled on it.
+func (c *context) hostIsDown(id string) bool {
+	c.downMtx.Lock()
+	defer c.downMtx.Unlock()
+	_, ok := c.downHosts[id]
+	return ok
+}
 
-		c.jobs.Remove(id, event.JobID)
-		go func(event *host.Event) {
+// hostLost marks the jobs of a host which has not heartbeated for
+// hostDownTimeout as down, and restarts them on other hosts.
+func (c *context) hostLost(id string) {
+	if !c.hostIsDown(id) {
+		return
+	}
+	g := grohl.NewContext(grohl.Data{"fn": "hostLost", "host.id": id})
+
+	c.mtx.RLock()
+	jobs := c.jobs.ByHost(id)
+	c.mtx.RUnlock()
+	g.Log(grohl.Data{"at": "start", "jobs": len(jobs)})
+
+	ids := make([]string, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.ID
+		go c.putJobDown(g, j)
+
+		c.jobs.Remove(id, j.ID)
+		go func(j *Job) {
 			c.mtx.RLock()
-			j.Formation.RestartJob(jobType, id, event.JobID)
+			j.Formation.RestartJob(j.Type, id, j.ID)
 			c.mtx.RUnlock()
-		}(event)
+		}(j)
+	}
+
+	c.downMtx.Lock()
+	_, down := c.downHosts[id]
+	if down {
+		c.lostJobs[id] = append(c.lostJobs[id], ids...)
+	}
+	c.downMtx.Unlock()
+	if !down && len(ids) > 0 {
+		// the host came back while its jobs were being replaced
+		go c.stopLostJobs(id, ids)
+	}
+}
+
+// hostRemoved forgets the omni jobs of a host which has left the cluster, as
+// they are not replaced on other hosts. Its other jobs are restarted elsewhere
+// once they stop or the host is lost.
+func (c *context) hostRemoved(id string) {
+	g := grohl.NewContext(grohl.Data{"fn": "hostRemoved", "host.id": id})
+
+	c.mtx.RLock()
+	jobs := c.jobs.ByHost(id)
+	c.mtx.RUnlock()
+
+	for _, j := range jobs {
+		if !j.Formation.Release.Processes[j.Type].Omni {
+			continue
+		}
+		g.Log(grohl.Data{"at": "remove", "job.id": j.ID})
+		c.jobs.Remove(id, j.ID)
+		c.mtx.RLock()
+		j.Formation.RemoveJob(j.Type, id, j.ID)
+		c.mtx.RUnlock()
+		go c.putJobDown(g, j)
+	}
+}
+
+// putJobDown marks a job which has gone away with its host as down in the
+// controller.
+func (c *context) putJobDown(g *grohl.Context, j *Job) {
+	job := &ct.Job{
+		ID:        j.HostID + "-" + j.ID,
+		AppID:     j.Formation.AppID,
+		ReleaseID: j.Formation.Release.ID,
+		Type:      j.Type,
+		State:     "down",
+	}
+	putJobAttempts.Run(func() error {
+		if err := c.PutJob(job); err != nil {
+			g.Log(grohl.Data{"at": "error", "job.id": j.ID, "err": err})
+			return err
+		}
+		g.Log(grohl.Data{"at": "put_job", "job.id": j.ID})
+		return nil
+	})
+}
+
+// stopLostJobs stops the jobs of a lost host which came back, as they have
+// been replaced by jobs on other hosts.
+func (c *context) stopLostJobs(id string, jobs []string) {
+	g := grohl.NewContext(grohl.Data{"fn": "stopLostJobs", "host.id": id})
+
+	var h cluster.Host
+	if err := dialHostAttempts.Run(func() (err error) {
+		h, err = c.DialHost(id)
+		return
+	}); err != nil {
+		g.Log(grohl.Data{"at": "dial_host_error", "err": err})
+		return
+	}
+	for _, jobID := range jobs {
+		// the jobs are gone if the host was restarted
+		if err := h.StopJob(jobID); err != nil {
+			g.Log(grohl.Data{"at": "stop_job_error", "job.id": jobID, "err": err})
+			continue
+		}
+		g.Log(grohl.Data{"at": "stop_job", "job.id": jobID})
 	}
-	// TODO: check error/reconnect
 }
 
 func newHostClients() *hostClients {
-	return &hostClients{hosts: make(map[string]cluster.Host)}
+	return &hostClients{
+		hosts:  make(map[string]cluster.Host),
+		memory: make(map[string]uint64),
+	}
 }
 
 type hostClients struct {
-	hosts map[string]cluster.Host
-	mtx   sync.RWMutex
+	hosts  map[string]cluster.Host
+	memory map[string]uint64
+	mtx    sync.RWMutex
 }
 
 func (h *hostClients) Add(id string) bool {
@@ -451,9 +765,33 @@ func (h *hostClients) Set(id string, client cluster.Host) {
 func (h *hostClients) Remove(id string) {
 	h.mtx.Lock()
 	delete(h.hosts, id)
+	delete(h.memory, id)
 	h.mtx.Unlock()
 }
 
+// MemoryTotal returns the memory in bytes of the host, which is fetched from
+// the host the first time as it doesn't change while the host is running. It
+// returns zero if the host can't be reached.
+func (h *hostClients) MemoryTotal(id string) uint64 {
+	h.mtx.RLock()
+	total, ok := h.memory[id]
+	client := h.hosts[id]
+	h.mtx.RUnlock()
+	if ok || client == nil {
+		return total
+	}
+	metrics, err := client.Metrics()
+	if err != nil {
+		return 0
+	}
+	h.mtx.Lock()
+	if _, exists := h.hosts[id]; exists {
+		h.memory[id] = metrics.MemoryTotal
+	}
+	h.mtx.Unlock()
+	return metrics.MemoryTotal
+}
+
 func (h *hostClients) Get(id string) cluster.Host {
 	h.mtx.RLock()
 	defer h.mtx.RUnlock()
@@ -487,6 +825,33 @@ func (m *jobMap) Get(host, job string) *Job {
 	return m.jobs[jobKey{host, job}]
 }
 
+// CountByHost returns the number of jobs of the given app and type on each
+// host, across all of the app's releases.
+func (m *jobMap) CountByHost(appID, typ string) map[string]int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	counts := make(map[string]int)
+	for _, job := range m.jobs {
+		if job.Type == typ && job.Formation != nil && job.Formation.AppID == appID {
+			counts[job.HostID]++
+		}
+	}
+	return counts
+}
+
+// ByHost returns the jobs on the given host.
+func (m *jobMap) ByHost(hostID string) []*Job {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	var jobs []*Job
+	for _, job := range m.jobs {
+		if job.HostID == hostID {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
 func (m *jobMap) Len() int {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -547,6 +912,8 @@ func NewFormation(c *context, ef *ct.ExpandedFormation) *Formation {
 		Processes: ef.Processes,
 		jobs:      make(jobTypeMap),
 		c:         c,
+
+		SchedulingStrategy: ef.App.SchedulingStrategy,
 	}
 }
 
@@ -601,6 +968,10 @@ type Formation struct {
 	Artifact  *ct.Artifact
 	Processes map[string]int
 
+	// SchedulingStrategy is the strategy of the app, which overrides the
+	// scheduling_strategy setting if set.
+	SchedulingStrategy string
+
 	jobs jobTypeMap
 	c    *context
 }
@@ -615,6 +986,18 @@ func (f *Formation) SetProcesses(p map[string]int) {
 	f.mtx.Unlock()
 }
 
+func (f *Formation) SetArtifact(a *ct.Artifact) {
+	f.mtx.Lock()
+	f.Artifact = a
+	f.mtx.Unlock()
+}
+
+func (f *Formation) SetSchedulingStrategy(strategy string) {
+	f.mtx.Lock()
+	f.SchedulingStrategy = strategy
+	f.mtx.Unlock()
+}
+
 func (f *Formation) Rectify() {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
@@ -655,6 +1038,16 @@ func (f *Formation) RestartJob(typ, hostID, jobID string) {
 	}
 }
 
+// RemoveJob forgets a job without restarting it.
+func (f *Formation) RemoveJob(typ, hostID, jobID string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if job := f.jobs.Get(typ, hostID, jobID); job != nil {
+		f.jobs.Remove(job)
+	}
+}
+
 func (f *Formation) rectify() {
 	g := grohl.NewContext(grohl.Data{"fn": "rectify", "app.id": f.AppID, "release.id": f.Release.ID})
 
@@ -675,6 +1068,9 @@ func (f *Formation) rectify() {
 			// get job counts per host
 			hostCounts := make(map[string]int, len(hosts))
 			for _, h := range hosts {
+				if f.c.hostIsDown(h.ID) {
+					continue
+				}
 				hostCounts[h.ID] = 0
 				for _, job := range h.Jobs {
 					if f.jobType(job) != t {
@@ -739,6 +1135,11 @@ func (f *Formation) restart(stoppedJob *Job) error {
 
 	var hostID string
 	if f.Release.Processes[stoppedJob.Type].Omni {
+		// omni jobs of lost hosts are not replaced, as the other
+		// hosts already run one each
+		if f.c.hostIsDown(stoppedJob.HostID) {
+			return nil
+		}
 		hostID = stoppedJob.HostID
 	}
 	newJob, err := f.start(stoppedJob.Type, hostID)
@@ -751,7 +1152,10 @@ func (f *Formation) restart(stoppedJob *Job) error {
 }
 
 func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
-	config := f.jobConfig(typ)
+	config, err := f.jobConfig(typ)
+	if err != nil {
+		return nil, err
+	}
 
 	hosts, err := f.c.ListHosts()
 	if err != nil {
@@ -761,6 +1165,23 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 		return nil, errors.New("scheduler: no online hosts")
 	}
 
+	// jobs with volumes are started where there are free volumes for them
+	// if possible, so that they keep the data of the jobs they replace
+	volumes := f.Release.Processes[typ].Volumes
+	var free map[string]map[string]*ct.Volume
+	preferFree := false
+	if len(volumes) > 0 {
+		free, err = f.freeVolumes(typ, hosts)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			if !host.Unschedulable && hasVolumes(free[host.ID], volumes) {
+				preferFree = true
+			}
+		}
+	}
+
 	var h host.Host
 	if hostID != "" {
 		for _, host := range hosts {
@@ -769,20 +1190,75 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 				break
 			}
 		}
+		// the host may have left the cluster, e.g. when restarting
+		// an omni job
+		if h.ID == "" {
+			return nil, errors.New("scheduler: host not found")
+		}
 	} else {
-		sh := make(sortHosts, 0, len(hosts))
+		// the scheduling strategy either packs jobs onto few hosts, or
+		// spreads the jobs of each app and type across hosts, and across
+		// the values of the spread tag if there is one, so that losing a
+		// host or zone doesn't stop all of them
+		counts := f.c.jobs.CountByHost(f.AppID, typ)
+		tagCounts := make(map[string]int)
+		if f.c.spreadTag != "" {
+			for _, host := range hosts {
+				tagCounts[host.Metadata[f.c.spreadTag]] += counts[host.ID]
+			}
+		}
+		strategy := f.schedulingStrategy()
+		sh := sortHosts{
+			hosts: make([]sortHost, 0, len(hosts)),
+			less:  schedulingStrategies[strategy],
+		}
 		for _, host := range hosts {
-			var count int
-			for _, job := range h.Jobs {
-				if f.jobType(job) != typ {
-					continue
+			// unschedulable hosts are being drained, so jobs
+			// which are stopped there are restarted elsewhere
+			if host.Unschedulable {
+				continue
+			}
+			// hosts which have stopped heartbeating may be lost
+			if f.c.hostIsDown(host.ID) {
+				continue
+			}
+			if preferFree && !hasVolumes(free[host.ID], volumes) {
+				continue
+			}
+			s := sortHost{
+				Host:    host,
+				Jobs:    counts[host.ID],
+				TagJobs: tagCounts[host.Metadata[f.c.spreadTag]],
+			}
+			if strategy == ct.SchedulingStrategyBinPack {
+				for _, job := range host.Jobs {
+					s.Reserved += jobMemory(job)
 				}
-				count++
+				total := f.c.hosts.MemoryTotal(host.ID)
+				s.Fits = s.Reserved+jobMemory(config) <= total
 			}
-			sh = append(sh, sortHost{host, count})
+			sh.hosts = append(sh.hosts, s)
+		}
+		if len(sh.hosts) == 0 {
+			return nil, errors.New("scheduler: no schedulable hosts")
 		}
 		sh.Sort()
-		h = sh[0].Host
+		h = sh.hosts[0].Host
+	}
+
+	for _, req := range volumes {
+		vol, ok := free[h.ID][req.Path]
+		if !ok {
+			vol = &ct.Volume{HostID: h.ID, Type: typ, Path: req.Path}
+			if err := f.c.CreateVolume(f.AppID, vol); err != nil {
+				return nil, err
+			}
+		}
+		config.Config.Volumes = append(config.Config.Volumes, host.VolumeBinding{
+			Target:    req.Path,
+			VolumeID:  vol.ID,
+			Writeable: true,
+		})
 	}
 
 	job = f.jobs.Add(typ, h.ID, config.ID)
@@ -798,6 +1274,50 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 	return job, nil
 }
 
+// freeVolumes returns the app's volumes for the process type typ which are
+// not mounted into running jobs, keyed by host ID and path.
+func (f *Formation) freeVolumes(typ string, hosts []host.Host) (map[string]map[string]*ct.Volume, error) {
+	volumes, err := f.c.VolumeList(f.AppID)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]struct{})
+	for _, h := range hosts {
+		for _, job := range h.Jobs {
+			// stopped jobs may not have been removed from the host yet
+			if f.c.jobs.Get(h.ID, job.ID) == nil {
+				continue
+			}
+			for _, v := range job.Config.Volumes {
+				used[v.VolumeID] = struct{}{}
+			}
+		}
+	}
+	free := make(map[string]map[string]*ct.Volume)
+	for _, vol := range volumes {
+		if _, ok := used[vol.ID]; ok || vol.Type != typ {
+			continue
+		}
+		if free[vol.HostID] == nil {
+			free[vol.HostID] = make(map[string]*ct.Volume)
+		}
+		if _, ok := free[vol.HostID][vol.Path]; !ok {
+			free[vol.HostID][vol.Path] = vol
+		}
+	}
+	return free, nil
+}
+
+// hasVolumes reports whether free has a volume for each of volumes.
+func hasVolumes(free map[string]*ct.Volume, volumes []ct.VolumeReq) bool {
+	for _, req := range volumes {
+		if _, ok := free[req.Path]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (f *Formation) jobType(job *host.Job) string {
 	if job.Metadata["flynn-controller.app"] != f.AppID ||
 		job.Metadata["flynn-controller.release"] != f.Release.ID {
@@ -853,30 +1373,119 @@ func (f *Formation) remove(n int, name string, hostID string) {
 	}
 }
 
-func (f *Formation) jobConfig(name string) *host.Job {
-	return utils.JobConfig(&ct.ExpandedFormation{
+func (f *Formation) jobConfig(name string) (*host.Job, error) {
+	job := utils.JobConfig(&ct.ExpandedFormation{
 		App:      &ct.App{ID: f.AppID, Name: f.AppName},
 		Release:  f.Release,
 		Artifact: f.Artifact,
 	}, name)
+	if err := secrets.OpenEnv(f.c.secretsKey, secrets.AppContext(f.AppID), job.Config.Env); err != nil {
+		return nil, err
+	}
+	creds, err := utils.OpenCredentials(f.c.secretsKey, f.Artifact.URI, f.Artifact.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	job.Artifact.Credentials = creds
+	return job, nil
 }
 
 type sortHost struct {
 	Host host.Host
-	Jobs int
+	// Jobs is the number of jobs of the app and type being started on the
+	// host, and TagJobs the number on all hosts with the same spread tag.
+	Jobs    int
+	TagJobs int
+	// Reserved is the memory in bytes reserved by the jobs on the host,
+	// and Fits whether the job being started fits in the rest, they are
+	// only set when bin-packing.
+	Reserved uint64
+	Fits     bool
 }
 
-type sortHosts []sortHost
+// schedulingStrategies order the candidate hosts for a new job, which is
+// started on the first one.
+var schedulingStrategies = map[string]func(a, b *sortHost) bool{
+	ct.SchedulingStrategySpread:  spreadLess,
+	ct.SchedulingStrategyBinPack: binPackLess,
+}
 
-func (h sortHosts) Len() int      { return len(h) }
-func (h sortHosts) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-func (h sortHosts) Sort()         { sort.Sort(h) }
+// spreadLess prefers the hosts running the fewest jobs of the app and type,
+// and then the fewest jobs overall.
+func spreadLess(a, b *sortHost) bool {
+	if a.TagJobs != b.TagJobs {
+		return a.TagJobs < b.TagJobs
+	}
+	if a.Jobs == b.Jobs {
+		return len(a.Host.Jobs) < len(b.Host.Jobs)
+	}
+	return a.Jobs < b.Jobs
+}
+
+// binPackLess prefers the fullest hosts the job fits on, so that jobs are
+// packed onto as few hosts as possible. Once no host fits the job, the
+// emptiest host is preferred.
+func binPackLess(a, b *sortHost) bool {
+	if a.Fits != b.Fits {
+		return a.Fits
+	}
+	if a.Reserved == b.Reserved {
+		return spreadLess(a, b)
+	}
+	if a.Fits {
+		return a.Reserved > b.Reserved
+	}
+	return a.Reserved < b.Reserved
+}
 
-func (h sortHosts) Less(i, j int) bool {
-	if h[i].Jobs == h[j].Jobs {
-		return len(h[i].Host.Jobs) < len(h[j].Host.Jobs)
+type sortHosts struct {
+	hosts []sortHost
+	less  func(a, b *sortHost) bool
+}
+
+func (h sortHosts) Len() int           { return len(h.hosts) }
+func (h sortHosts) Swap(i, j int)      { h.hosts[i], h.hosts[j] = h.hosts[j], h.hosts[i] }
+func (h sortHosts) Less(i, j int) bool { return h.less(&h.hosts[i], &h.hosts[j]) }
+func (h sortHosts) Sort()              { sort.Sort(h) }
+
+// jobMemory returns the memory in bytes reserved by job.
+func jobMemory(job *host.Job) uint64 {
+	if job.Resources.Memory > 0 {
+		return uint64(job.Resources.Memory) * 1024
+	}
+	return host.DefaultJobMemory
+}
+
+// schedulingStrategy returns the scheduling strategy of the app, which is the
+// scheduling_strategy setting unless the app overrides it.
+func (f *Formation) schedulingStrategy() string {
+	if _, ok := schedulingStrategies[f.SchedulingStrategy]; ok {
+		return f.SchedulingStrategy
+	}
+	f.c.strategyMtx.RLock()
+	defer f.c.strategyMtx.RUnlock()
+	if _, ok := schedulingStrategies[f.c.strategy]; ok {
+		return f.c.strategy
+	}
+	return ct.SchedulingStrategySpread
+}
+
+var settingsPollInterval = 30 * time.Second
+
+// watchSettings polls the scheduling_strategy setting, keeping the last value
+// read if the controller can't be reached.
+func (c *context) watchSettings() {
+	g := grohl.NewContext(grohl.Data{"fn": "watchSettings"})
+	for {
+		if s, err := c.GetSetting(ct.SettingSchedulingStrategy); err != nil {
+			g.Log(grohl.Data{"at": "error", "err": err})
+		} else {
+			c.strategyMtx.Lock()
+			c.strategy = s.Value
+			c.strategyMtx.Unlock()
+		}
+		time.Sleep(settingsPollInterval)
 	}
-	return h[i].Jobs < h[j].Jobs
 }
 
 type FormationEvent struct {
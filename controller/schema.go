@@ -6,6 +6,13 @@ import (
 )
 
 func migrateDB(db *sql.DB) error {
+	return migrations().Migrate(db)
+}
+
+// migrations returns the migrations of the controller schema. Migrations which
+// can be reverted by a down migration make it possible to roll back to an
+// older version of the controller, see RollbackMigrations.
+func migrations() *postgres.Migrations {
 	m := postgres.NewMigrations()
 	m.Add(1,
 		`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`,
@@ -186,5 +193,488 @@ $$ LANGUAGE plpgsql`,
     CONSTRAINT que_jobs_pkey PRIMARY KEY (queue, priority, run_at, job_id))`,
 		`COMMENT ON TABLE que_jobs IS '3'`,
 	)
-	return m.Migrate(db)
+	m.Add(3,
+		`CREATE SEQUENCE event_ids`,
+		`CREATE TABLE events (
+    event_id bigint PRIMARY KEY DEFAULT nextval('event_ids'),
+    app_id uuid,
+    object_type text NOT NULL,
+    object_id text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON events (app_id)`,
+		`CREATE FUNCTION notify_event() RETURNS TRIGGER AS $$
+    BEGIN
+    PERFORM pg_notify('events', NEW.event_id || '');
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_event
+    AFTER INSERT ON events
+    FOR EACH ROW EXECUTE PROCEDURE notify_event()`,
+
+		`CREATE FUNCTION app_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'app', replace(NEW.app_id::text, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER app_event
+    AFTER INSERT OR UPDATE ON apps
+    FOR EACH ROW EXECUTE PROCEDURE app_event()`,
+
+		`CREATE FUNCTION release_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (object_type, object_id) VALUES ('release', replace(NEW.release_id::text, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER release_event
+    AFTER INSERT ON releases
+    FOR EACH ROW EXECUTE PROCEDURE release_event()`,
+
+		`CREATE FUNCTION formation_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'formation', replace(NEW.app_id || ':' || NEW.release_id, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER formation_event
+    AFTER INSERT OR UPDATE ON formations
+    FOR EACH ROW EXECUTE PROCEDURE formation_event()`,
+
+		`CREATE FUNCTION deployment_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'deployment', replace(NEW.deployment_id::text, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER deployment_event
+    AFTER INSERT OR UPDATE ON deployments
+    FOR EACH ROW EXECUTE PROCEDURE deployment_event()`,
+
+		`CREATE FUNCTION deployment_status_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id)
+        SELECT app_id, 'deployment', replace(deployment_id::text, '-', '') FROM deployments WHERE deployment_id = NEW.deployment_id;
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER deployment_status_event
+    AFTER INSERT ON deployment_events
+    FOR EACH ROW EXECUTE PROCEDURE deployment_status_event()`,
+
+		`CREATE FUNCTION job_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'job', NEW.host_id || '-' || NEW.job_id);
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER job_event
+    AFTER INSERT OR UPDATE ON job_cache
+    FOR EACH ROW EXECUTE PROCEDURE job_event()`,
+	)
+	m.Add(4,
+		`CREATE TYPE auth_token_scope AS ENUM ('read-only', 'app', 'full')`,
+		`CREATE TABLE auth_tokens (
+    token_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    scope auth_token_scope NOT NULL,
+    app_id uuid REFERENCES apps (app_id),
+    expires_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz,
+    CHECK ((scope = 'app') = (app_id IS NOT NULL))
+)`,
+		`CREATE UNIQUE INDEX ON auth_tokens (name) WHERE deleted_at IS NULL`,
+	)
+	m.Add(5,
+		`CREATE TABLE idempotency_keys (
+    owner text NOT NULL,
+    key text NOT NULL,
+    fingerprint text NOT NULL,
+    status integer,
+    content_type text,
+    body bytea,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (owner, key)
+)`,
+		`CREATE INDEX ON idempotency_keys (created_at)`,
+	)
+	m.Add(6,
+		`ALTER TABLE apps ADD COLUMN quota text`,
+	)
+	m.Add(7,
+		`ALTER TABLE apps ADD COLUMN maintenance text`,
+	)
+	m.Add(8,
+		`CREATE TABLE deploy_locks (
+    app_id uuid PRIMARY KEY REFERENCES apps (app_id),
+    owner text NOT NULL,
+    expires_at timestamptz NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+	)
+	m.Add(9,
+		`ALTER TABLE auth_tokens ADD COLUMN rate_limit double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE auth_tokens ADD COLUMN rate_burst integer NOT NULL DEFAULT 0`,
+	)
+	m.Add(10,
+		`ALTER TABLE artifacts ADD COLUMN digest text`,
+		`CREATE UNIQUE INDEX ON artifacts (type, digest) WHERE deleted_at IS NULL AND digest IS NOT NULL`,
+	)
+	m.Add(11,
+		`ALTER TABLE keys ADD COLUMN labels hstore`,
+	)
+	m.Add(12,
+		`CREATE TABLE operations (
+    operation_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    type text NOT NULL,
+    app_id uuid REFERENCES apps (app_id),
+    status text NOT NULL,
+    result text,
+    error text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE FUNCTION notify_operation() RETURNS TRIGGER AS $$
+    BEGIN
+    PERFORM pg_notify('operations', NEW.operation_id || '');
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_operation
+    AFTER INSERT OR UPDATE ON operations
+    FOR EACH ROW EXECUTE PROCEDURE notify_operation()`,
+	)
+	m.Add(13,
+		`CREATE TABLE namespaces (
+    namespace_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE UNIQUE INDEX ON namespaces (name)`,
+		`ALTER TABLE apps ADD COLUMN namespace_id uuid REFERENCES namespaces (namespace_id)`,
+		`DROP INDEX apps_name_idx`,
+		`CREATE UNIQUE INDEX apps_name_idx ON apps (name) WHERE deleted_at IS NULL AND namespace_id IS NULL`,
+		`CREATE UNIQUE INDEX apps_namespace_name_idx ON apps (namespace_id, name) WHERE deleted_at IS NULL AND namespace_id IS NOT NULL`,
+		`ALTER TABLE auth_tokens ADD COLUMN namespace_id uuid REFERENCES namespaces (namespace_id)`,
+		// enum values can't be added in a transaction, so the type is
+		// replaced, and the check which refers to it recreated
+		`ALTER TABLE auth_tokens DROP CONSTRAINT auth_tokens_check`,
+		`ALTER TYPE auth_token_scope RENAME TO auth_token_scope_old`,
+		`CREATE TYPE auth_token_scope AS ENUM ('read-only', 'app', 'namespace', 'full')`,
+		`ALTER TABLE auth_tokens ALTER COLUMN scope TYPE auth_token_scope USING scope::text::auth_token_scope`,
+		`DROP TYPE auth_token_scope_old`,
+		`ALTER TABLE auth_tokens ADD CHECK ((scope = 'app') = (app_id IS NOT NULL))`,
+		`ALTER TABLE auth_tokens ADD CHECK ((scope = 'namespace') = (namespace_id IS NOT NULL))`,
+	)
+	m.Add(14,
+		`ALTER TABLE auth_tokens DROP CONSTRAINT auth_tokens_check`,
+		`ALTER TYPE auth_token_scope RENAME TO auth_token_scope_old`,
+		`CREATE TYPE auth_token_scope AS ENUM ('read-only', 'app', 'deploy', 'namespace', 'full')`,
+		`ALTER TABLE auth_tokens ALTER COLUMN scope TYPE auth_token_scope USING scope::text::auth_token_scope`,
+		`DROP TYPE auth_token_scope_old`,
+		`ALTER TABLE auth_tokens ADD CONSTRAINT auth_tokens_app_check CHECK ((scope IN ('app', 'deploy')) = (app_id IS NOT NULL))`,
+		`CREATE INDEX ON auth_tokens (app_id) WHERE deleted_at IS NULL`,
+	)
+	m.Add(15,
+		`CREATE TABLE formation_history (
+    change_id bigserial PRIMARY KEY,
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    release_id uuid NOT NULL REFERENCES releases (release_id),
+    old_processes hstore,
+    new_processes hstore,
+    actor text,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON formation_history (app_id, release_id, created_at)`,
+	)
+	m.AddDown(15,
+		`DROP TABLE formation_history`,
+	)
+	m.Add(16,
+		`CREATE FUNCTION release_deletion_event() RETURNS TRIGGER AS $$
+    BEGIN
+    IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        INSERT INTO events (object_type, object_id) VALUES ('release_deletion', replace(NEW.release_id::text, '-', ''));
+    END IF;
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER release_deletion_event
+    AFTER UPDATE ON releases
+    FOR EACH ROW EXECUTE PROCEDURE release_deletion_event()`,
+	)
+	m.AddDown(16,
+		`DROP TRIGGER release_deletion_event ON releases`,
+		`DROP FUNCTION release_deletion_event()`,
+	)
+	m.Add(17,
+		`CREATE TABLE app_usage (
+    usage_id bigserial PRIMARY KEY,
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    jobs integer NOT NULL,
+    memory bigint NOT NULL,
+    requests bigint NOT NULL,
+    period_seconds integer NOT NULL,
+    collected_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON app_usage (app_id, collected_at)`,
+		`CREATE TABLE router_request_counts (
+    router_addr text NOT NULL,
+    route_id text NOT NULL,
+    requests bigint NOT NULL,
+    PRIMARY KEY (router_addr, route_id)
+)`,
+	)
+	m.AddDown(17,
+		`DROP TABLE router_request_counts`,
+		`DROP TABLE app_usage`,
+	)
+	m.Add(18,
+		`CREATE TABLE settings (
+    key text PRIMARY KEY,
+    value text NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE FUNCTION notify_settings() RETURNS TRIGGER AS $$
+    BEGIN
+    PERFORM pg_notify('settings', '');
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_settings
+    AFTER INSERT OR UPDATE OR DELETE ON settings
+    FOR EACH STATEMENT EXECUTE PROCEDURE notify_settings()`,
+	)
+	m.AddDown(18,
+		`DROP TRIGGER notify_settings ON settings`,
+		`DROP FUNCTION notify_settings()`,
+		`DROP TABLE settings`,
+	)
+	m.Add(19,
+		`ALTER TABLE providers ADD COLUMN plans text`,
+	)
+	m.AddDown(19,
+		`ALTER TABLE providers DROP COLUMN plans`,
+	)
+	m.Add(20,
+		`ALTER TABLE apps ADD COLUMN policy text`,
+	)
+	m.AddDown(20,
+		`ALTER TABLE apps DROP COLUMN policy`,
+	)
+	m.Add(21,
+		`ALTER TABLE events ADD COLUMN kind text`,
+		`CREATE FUNCTION event_kind(op text) RETURNS text AS $$
+    SELECT CASE op WHEN 'INSERT' THEN 'create' WHEN 'UPDATE' THEN 'update' ELSE 'delete' END
+$$ LANGUAGE sql IMMUTABLE`,
+		`CREATE OR REPLACE FUNCTION app_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id, kind) VALUES (NEW.app_id, 'app', replace(NEW.app_id::text, '-', ''), event_kind(TG_OP));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION release_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (object_type, object_id, kind) VALUES ('release', replace(NEW.release_id::text, '-', ''), 'create');
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION formation_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id, kind) VALUES (NEW.app_id, 'formation', replace(NEW.app_id || ':' || NEW.release_id, '-', ''), event_kind(TG_OP));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION deployment_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id, kind) VALUES (NEW.app_id, 'deployment', replace(NEW.deployment_id::text, '-', ''), event_kind(TG_OP));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION deployment_status_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id, kind)
+        SELECT app_id, 'deployment', replace(deployment_id::text, '-', ''), 'update' FROM deployments WHERE deployment_id = NEW.deployment_id;
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION job_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id, kind) VALUES (NEW.app_id, 'job', NEW.host_id || '-' || NEW.job_id, event_kind(TG_OP));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION release_deletion_event() RETURNS TRIGGER AS $$
+    BEGIN
+    IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        INSERT INTO events (object_type, object_id, kind) VALUES ('release_deletion', replace(NEW.release_id::text, '-', ''), 'delete');
+    END IF;
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+	)
+	m.AddDown(21,
+		`CREATE OR REPLACE FUNCTION app_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'app', replace(NEW.app_id::text, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION release_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (object_type, object_id) VALUES ('release', replace(NEW.release_id::text, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION formation_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'formation', replace(NEW.app_id || ':' || NEW.release_id, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION deployment_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'deployment', replace(NEW.deployment_id::text, '-', ''));
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION deployment_status_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id)
+        SELECT app_id, 'deployment', replace(deployment_id::text, '-', '') FROM deployments WHERE deployment_id = NEW.deployment_id;
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION job_event() RETURNS TRIGGER AS $$
+    BEGIN
+    INSERT INTO events (app_id, object_type, object_id) VALUES (NEW.app_id, 'job', NEW.host_id || '-' || NEW.job_id);
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE FUNCTION release_deletion_event() RETURNS TRIGGER AS $$
+    BEGIN
+    IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        INSERT INTO events (object_type, object_id) VALUES ('release_deletion', replace(NEW.release_id::text, '-', ''));
+    END IF;
+    RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+		`DROP FUNCTION event_kind(text)`,
+		`ALTER TABLE events DROP COLUMN kind`,
+	)
+	m.Add(22,
+		`ALTER TYPE deployment_strategy RENAME TO deployment_strategy_old`,
+		`CREATE TYPE deployment_strategy AS ENUM ('all-at-once', 'one-by-one', 'in-batches')`,
+		`ALTER TABLE apps ALTER COLUMN strategy DROP DEFAULT`,
+		`ALTER TABLE apps ALTER COLUMN strategy TYPE deployment_strategy USING strategy::text::deployment_strategy`,
+		`ALTER TABLE apps ALTER COLUMN strategy SET DEFAULT 'all-at-once'`,
+		`ALTER TABLE deployments ALTER COLUMN strategy TYPE deployment_strategy USING strategy::text::deployment_strategy`,
+		`DROP TYPE deployment_strategy_old`,
+		`ALTER TABLE apps ADD COLUMN deploy_batch_size integer`,
+		`ALTER TABLE deployments ADD COLUMN batch_size integer`,
+	)
+	m.AddDown(22,
+		`ALTER TABLE deployments DROP COLUMN batch_size`,
+		`ALTER TABLE apps DROP COLUMN deploy_batch_size`,
+		`UPDATE apps SET strategy = 'one-by-one' WHERE strategy = 'in-batches'`,
+		`UPDATE deployments SET strategy = 'one-by-one' WHERE strategy = 'in-batches'`,
+		`ALTER TYPE deployment_strategy RENAME TO deployment_strategy_old`,
+		`CREATE TYPE deployment_strategy AS ENUM ('all-at-once', 'one-by-one')`,
+		`ALTER TABLE apps ALTER COLUMN strategy DROP DEFAULT`,
+		`ALTER TABLE apps ALTER COLUMN strategy TYPE deployment_strategy USING strategy::text::deployment_strategy`,
+		`ALTER TABLE apps ALTER COLUMN strategy SET DEFAULT 'all-at-once'`,
+		`ALTER TABLE deployments ALTER COLUMN strategy TYPE deployment_strategy USING strategy::text::deployment_strategy`,
+		`DROP TYPE deployment_strategy_old`,
+	)
+	m.Add(23,
+		`ALTER TABLE deployment_events ADD COLUMN step text`,
+		`ALTER TABLE deployment_events ADD COLUMN expected_jobs text`,
+		`ALTER TABLE deployment_events ADD COLUMN current_jobs text`,
+		`ALTER TABLE deployment_events ADD COLUMN percent integer NOT NULL DEFAULT 0`,
+	)
+	m.AddDown(23,
+		`ALTER TABLE deployment_events DROP COLUMN percent`,
+		`ALTER TABLE deployment_events DROP COLUMN current_jobs`,
+		`ALTER TABLE deployment_events DROP COLUMN expected_jobs`,
+		`ALTER TABLE deployment_events DROP COLUMN step`,
+	)
+	m.Add(24,
+		`ALTER TABLE deployments ADD COLUMN max_failures integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE deployments ADD COLUMN no_rollback bool NOT NULL DEFAULT false`,
+	)
+	m.AddDown(24,
+		`ALTER TABLE deployments DROP COLUMN no_rollback`,
+		`ALTER TABLE deployments DROP COLUMN max_failures`,
+	)
+	m.Add(25,
+		`ALTER TABLE deployments ADD COLUMN processes hstore`,
+	)
+	m.AddDown(25,
+		`ALTER TABLE deployments DROP COLUMN processes`,
+	)
+	m.Add(26,
+		`ALTER TABLE deployments ADD COLUMN old_processes hstore`,
+	)
+	m.AddDown(26,
+		`ALTER TABLE deployments DROP COLUMN old_processes`,
+	)
+	m.Add(27,
+		`CREATE TABLE volumes (
+    volume_id uuid PRIMARY KEY,
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    host_id text NOT NULL,
+    process_type text NOT NULL,
+    path text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE INDEX ON volumes (app_id) WHERE deleted_at IS NULL`,
+	)
+	m.AddDown(27,
+		`DROP TABLE volumes`,
+	)
+	m.Add(28,
+		`ALTER TABLE artifacts ADD COLUMN registry_username text`,
+		`ALTER TABLE artifacts ADD COLUMN registry_password text`,
+		`CREATE TABLE registries (
+    host text PRIMARY KEY,
+    username text NOT NULL,
+    password text NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+)`,
+	)
+	m.AddDown(28,
+		`DROP TABLE registries`,
+		`ALTER TABLE artifacts DROP COLUMN registry_password`,
+		`ALTER TABLE artifacts DROP COLUMN registry_username`,
+	)
+	m.Add(29,
+		`ALTER TABLE apps ADD COLUMN scheduling_strategy text`,
+	)
+	m.AddDown(29,
+		`ALTER TABLE apps DROP COLUMN scheduling_strategy`,
+	)
+	m.Add(30,
+		`ALTER TABLE router_request_counts ADD COLUMN instance_id text NOT NULL DEFAULT ''`,
+	)
+	m.AddDown(30,
+		`ALTER TABLE router_request_counts DROP COLUMN instance_id`,
+	)
+	m.Add(31,
+		`ALTER TABLE providers ALTER COLUMN plans TYPE json USING plans::json`,
+	)
+	m.AddDown(31,
+		`ALTER TABLE providers ALTER COLUMN plans TYPE text`,
+	)
+	m.Add(32,
+		`ALTER TABLE deploy_locks ADD COLUMN token_id text NOT NULL DEFAULT ''`,
+	)
+	m.AddDown(32,
+		`ALTER TABLE deploy_locks DROP COLUMN token_id`,
+	)
+	return m
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// searchLimit is the maximum number of apps and routes returned by a search
+// whose query only partially matches them.
+const searchLimit = 20
+
+type SearchRepo struct {
+	db *postgres.DB
+}
+
+func NewSearchRepo(db *postgres.DB) *SearchRepo {
+	return &SearchRepo{db}
+}
+
+// Search returns the apps whose name contains q, and the app, release and
+// job whose ID is q.
+func (r *SearchRepo) Search(q string) ([]*ct.SearchResult, error) {
+	results := []*ct.SearchResult{}
+	add := func(typ, query string, args ...interface{}) error {
+		rows, err := r.db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			res := &ct.SearchResult{Type: typ}
+			var appID, name *string
+			if err := rows.Scan(&res.ID, &appID, &name); err != nil {
+				return err
+			}
+			if appID != nil {
+				res.AppID = postgres.CleanUUID(*appID)
+			}
+			if name != nil {
+				res.Name = *name
+			}
+			if typ != ct.SearchResultTypeJob {
+				res.ID = postgres.CleanUUID(res.ID)
+			}
+			results = append(results, res)
+		}
+		return rows.Err()
+	}
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q)) + "%"
+	if idPattern.MatchString(q) {
+		if err := add(ct.SearchResultTypeApp, "SELECT app_id, NULL, name FROM apps WHERE deleted_at IS NULL AND (app_id = $1 OR name LIKE $2) ORDER BY name LIMIT $3", q, pattern, searchLimit); err != nil {
+			return nil, err
+		}
+		if err := add(ct.SearchResultTypeRelease, "SELECT r.release_id, a.app_id, NULL FROM releases r LEFT JOIN apps a ON a.release_id = r.release_id AND a.deleted_at IS NULL WHERE r.release_id = $1 AND r.deleted_at IS NULL", q); err != nil {
+			return nil, err
+		}
+	} else if err := add(ct.SearchResultTypeApp, "SELECT app_id, NULL, name FROM apps WHERE deleted_at IS NULL AND name LIKE $1 ORDER BY name LIMIT $2", pattern, searchLimit); err != nil {
+		return nil, err
+	}
+	// jobs can be found by either their full ID or the ID on their host
+	if err := add(ct.SearchResultTypeJob, "SELECT concat(host_id, '-', job_id), app_id, process_type FROM job_cache WHERE concat(host_id, '-', job_id) = $1 OR job_id = $1", q); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Search finds the objects matching the q parameter, see SearchRepo.Search.
+// Routes whose domain contains q are also included.
+func (c *controllerAPI) Search(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+	if q == "" {
+		respondWithError(w, ct.ValidationError{Field: "q", Message: "must not be empty"})
+		return
+	}
+	results, err := c.searchRepo.Search(q)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	routes, err := c.routerc.ListRoutes("")
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	prefix := routeParentRef("")
+	lower := strings.ToLower(q)
+	n := 0
+	for _, route := range routes {
+		if n == searchLimit {
+			break
+		}
+		if route.Type != "http" || !strings.Contains(strings.ToLower(route.Domain), lower) {
+			continue
+		}
+		res := &ct.SearchResult{Type: ct.SearchResultTypeRoute, ID: route.ID, Name: route.Domain}
+		if strings.HasPrefix(route.ParentRef, prefix) {
+			res.AppID = strings.TrimPrefix(route.ParentRef, prefix)
+		}
+		results = append(results, res)
+		n++
+	}
+	httphelper.JSON(w, 200, results)
+}
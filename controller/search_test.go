@@ -0,0 +1,50 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/router/types"
+)
+
+func (s *S) TestSearch(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "search-app"})
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(s.c.SetAppRelease(app.ID, release.ID), IsNil)
+	route := s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "search-app.example.com", Service: "search-app-web"}).ToRoute())
+	job := s.createTestJob(c, &ct.Job{ID: "host0-search-job", AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+
+	type result struct{ typ, id string }
+	search := func(q string) map[result]*ct.SearchResult {
+		results, err := s.c.Search(q)
+		c.Assert(err, IsNil)
+		m := make(map[result]*ct.SearchResult, len(results))
+		for _, r := range results {
+			m[result{r.Type, r.ID}] = r
+		}
+		return m
+	}
+
+	results := search("search-ap")
+	res, ok := results[result{ct.SearchResultTypeApp, app.ID}]
+	c.Assert(ok, Equals, true)
+	c.Assert(res.Name, Equals, "search-app")
+	res, ok = results[result{ct.SearchResultTypeRoute, route.ID}]
+	c.Assert(ok, Equals, true)
+	c.Assert(res.AppID, Equals, app.ID)
+	c.Assert(res.Name, Equals, "search-app.example.com")
+
+	results = search(release.ID)
+	res, ok = results[result{ct.SearchResultTypeRelease, release.ID}]
+	c.Assert(ok, Equals, true)
+	c.Assert(res.AppID, Equals, app.ID)
+
+	for _, id := range []string{"host0-search-job", "search-job"} {
+		results = search(id)
+		res, ok = results[result{ct.SearchResultTypeJob, job.ID}]
+		c.Assert(ok, Equals, true)
+		c.Assert(res.AppID, Equals, app.ID)
+	}
+
+	_, err := s.c.Search("")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,144 @@
+// Package secrets seals the values of secret release env vars with the
+// cluster secrets key, so they are stored and returned by the controller API
+// encrypted and only opened when jobs are started.
+package secrets
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/crypto/nacl/secretbox"
+)
+
+// Prefix is the prefix of sealed values.
+const Prefix = "flynn-secret:"
+
+var (
+	ErrNoKey   = errors.New("secrets: no secrets key is configured")
+	ErrInvalid = errors.New("secrets: invalid sealed value")
+)
+
+// Key is a NaCl secretbox key.
+type Key [32]byte
+
+// ParseKey parses a hex encoded key, as set in the SECRETS_KEY environment
+// variable of the controller. It returns nil if s is empty.
+func ParseKey(s string) (*Key, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != len(Key{}) {
+		return nil, errors.New("secrets: key must be 32 hex encoded bytes")
+	}
+	key := &Key{}
+	copy(key[:], data)
+	return key, nil
+}
+
+// IsSealed reports whether v is a sealed value.
+func IsSealed(v string) bool {
+	return strings.HasPrefix(v, Prefix)
+}
+
+// AppContext returns the context of the secrets of an app's releases.
+func AppContext(appID string) string {
+	return "app:" + strings.Replace(appID, "-", "", -1)
+}
+
+// RegistryContext returns the context of the passwords of a registry host, so
+// they can't be used to pull from other hosts.
+func RegistryContext(host string) string {
+	return "registry:" + strings.ToLower(host)
+}
+
+// ExportContext returns the context of the secrets of an object in a cluster
+// export, e.g. the env of a resource, so they can only be opened for the same
+// object.
+func ExportContext(kind, id string) string {
+	return "export:" + kind + ":" + strings.Replace(id, "-", "", -1)
+}
+
+// OperationContext returns the context of the result of an operation, which
+// may contain credentials, e.g. of a provisioned resource.
+func OperationContext(id string) string {
+	return "operation:" + strings.Replace(id, "-", "", -1)
+}
+
+// Seal encrypts v with a random nonce. The value is bound to context, which
+// is authenticated along with it, so it can only be opened with the same
+// context, e.g. the app whose release it was sealed for.
+func (k *Key) Seal(context, v string) string {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(nonce), len(nonce)+len(v)+secretbox.Overhead)
+	copy(out, nonce[:])
+	out = secretbox.Seal(out, []byte(v), &nonce, k.contextKey(context))
+	return Prefix + base64.URLEncoding.EncodeToString(out)
+}
+
+// Open decrypts the sealed value v, which must have been sealed with the same
+// context.
+func (k *Key) Open(context, v string) (string, error) {
+	if !IsSealed(v) {
+		return "", ErrInvalid
+	}
+	data, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(v, Prefix))
+	if err != nil {
+		return "", ErrInvalid
+	}
+	var nonce [24]byte
+	if len(data) < len(nonce) {
+		return "", ErrInvalid
+	}
+	copy(nonce[:], data)
+	res, ok := secretbox.Open(nil, data[len(nonce):], &nonce, k.contextKey(context))
+	if !ok {
+		return "", ErrInvalid
+	}
+	return string(res), nil
+}
+
+// contextKey derives the key values bound to context are sealed with, so
+// that values sealed for one context fail to open with any other.
+func (k *Key) contextKey(context string) *[32]byte {
+	mac := hmac.New(sha256.New, k[:])
+	mac.Write([]byte(context))
+	key := &[32]byte{}
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// OpenValue returns the decrypted value of v if it is sealed, and v otherwise.
+// It returns ErrNoKey if v is sealed and k is nil.
+func OpenValue(k *Key, context, v string) (string, error) {
+	if !IsSealed(v) {
+		return v, nil
+	}
+	if k == nil {
+		return "", ErrNoKey
+	}
+	return k.Open(context, v)
+}
+
+// OpenEnv replaces the sealed values in env with their decrypted values, which
+// must have been sealed with context. It returns ErrNoKey if env has sealed
+// values and k is nil.
+func OpenEnv(k *Key, context string, env map[string]string) error {
+	for name, v := range env {
+		opened, err := OpenValue(k, context, v)
+		if err != nil {
+			return err
+		}
+		env[name] = opened
+	}
+	return nil
+}
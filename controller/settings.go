@@ -0,0 +1,372 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cors"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// settingKeys are the keys of the known settings, in the order they are
+// listed.
+var settingKeys = []string{
+	ct.SettingDefaultRouteDomain,
+	ct.SettingDefaultDeployStrategy,
+	ct.SettingGCRetention,
+	ct.SettingDeploymentRetentionCount,
+	ct.SettingDeploymentRetentionAge,
+	ct.SettingCORSAllowedOrigins,
+	ct.SettingFormationCapacityCheck,
+	ct.SettingDeploymentConcurrency,
+	ct.SettingSchedulingStrategy,
+}
+
+// builtinSettingDefaults are the defaults of settings which aren't given one
+// when the repo is created.
+var builtinSettingDefaults = map[string]string{
+	ct.SettingDefaultDeployStrategy:  "all-at-once",
+	ct.SettingFormationCapacityCheck: "off",
+	ct.SettingSchedulingStrategy:     ct.SchedulingStrategySpread,
+}
+
+var deployStrategies = map[string]struct{}{
+	"all-at-once": {},
+	"one-by-one":  {},
+	"in-batches":  {},
+}
+
+// SettingsRepo stores cluster settings, which override the defaults the
+// controller was started with.
+//
+// Settings are read on every request which depends on them, so they are
+// cached while the repo is listening for changes made by other controller
+// instances.
+type SettingsRepo struct {
+	db       *postgres.DB
+	notifier *notifier
+	defaults map[string]string
+
+	mtx      sync.RWMutex
+	values   map[string]*ct.Setting
+	watching bool
+	// gen is incremented each time the cache is invalidated, so that a
+	// load which races with an invalidation doesn't cache stale values.
+	gen int
+}
+
+func NewSettingsRepo(db *postgres.DB, notifier *notifier, defaults map[string]string) *SettingsRepo {
+	r := &SettingsRepo{db: db, notifier: notifier, defaults: defaults}
+	go r.watch()
+	return r
+}
+
+func (r *SettingsRepo) watch() {
+	for {
+		ch := make(chan *pq.Notification, notificationBufferSize)
+		if err := r.notifier.Subscribe("settings", ch); err != nil {
+			log.Printf("Error listening for settings changes: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		r.invalidate(true)
+		for range ch {
+			r.invalidate(true)
+		}
+		// changes may have been missed, so stop caching until listening
+		// again
+		r.invalidate(false)
+	}
+}
+
+func (r *SettingsRepo) invalidate(watching bool) {
+	r.mtx.Lock()
+	r.values = nil
+	r.watching = watching
+	r.gen++
+	r.mtx.Unlock()
+}
+
+func (r *SettingsRepo) load() (map[string]*ct.Setting, error) {
+	r.mtx.RLock()
+	values, gen := r.values, r.gen
+	r.mtx.RUnlock()
+	if values != nil {
+		return values, nil
+	}
+
+	rows, err := r.db.Query("SELECT key, value, updated_at FROM settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values = make(map[string]*ct.Setting)
+	for rows.Next() {
+		s := &ct.Setting{}
+		if err := rows.Scan(&s.Key, &s.Value, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		values[s.Key] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	if r.watching && r.gen == gen {
+		r.values = values
+	}
+	r.mtx.Unlock()
+	return values, nil
+}
+
+func knownSetting(key string) bool {
+	for _, k := range settingKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the setting with the given key, or its default if it has not
+// been set.
+func (r *SettingsRepo) Get(key string) (*ct.Setting, error) {
+	if !knownSetting(key) {
+		return nil, ErrNotFound
+	}
+	values, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := values[key]; ok {
+		setting := *s
+		return &setting, nil
+	}
+	return &ct.Setting{Key: key, Value: r.defaultValue(key), Default: true}, nil
+}
+
+// Value returns the value of the setting with the given key, falling back to
+// its default if it can't be read.
+func (r *SettingsRepo) Value(key string) string {
+	s, err := r.Get(key)
+	if err != nil {
+		log.Printf("Error getting setting %s: %s", key, err)
+		return r.defaultValue(key)
+	}
+	return s.Value
+}
+
+func (r *SettingsRepo) defaultValue(key string) string {
+	if v, ok := r.defaults[key]; ok {
+		return v
+	}
+	return builtinSettingDefaults[key]
+}
+
+func (r *SettingsRepo) List() ([]*ct.Setting, error) {
+	settings := make([]*ct.Setting, len(settingKeys))
+	for i, key := range settingKeys {
+		s, err := r.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		settings[i] = s
+	}
+	return settings, nil
+}
+
+func (r *SettingsRepo) Set(s *ct.Setting) error {
+	if !knownSetting(s.Key) {
+		return ErrNotFound
+	}
+	s.Value = strings.TrimSpace(s.Value)
+	if err := validateSetting(s); err != nil {
+		return err
+	}
+
+	err := r.set(s)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		// the setting was inserted concurrently, so update it instead
+		err = r.set(s)
+	}
+	if err != nil {
+		return err
+	}
+	s.Default = false
+	r.invalidateLocal()
+	return nil
+}
+
+func (r *SettingsRepo) set(s *ct.Setting) error {
+	err := r.db.QueryRow("UPDATE settings SET value = $2, updated_at = now() WHERE key = $1 RETURNING updated_at", s.Key, s.Value).Scan(&s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = r.db.QueryRow("INSERT INTO settings (key, value) VALUES ($1, $2) RETURNING updated_at", s.Key, s.Value).Scan(&s.UpdatedAt)
+	}
+	return err
+}
+
+// Delete resets the setting with the given key to its default.
+func (r *SettingsRepo) Delete(key string) error {
+	if !knownSetting(key) {
+		return ErrNotFound
+	}
+	if err := r.db.Exec("DELETE FROM settings WHERE key = $1", key); err != nil {
+		return err
+	}
+	r.invalidateLocal()
+	return nil
+}
+
+// invalidateLocal drops the cache after a change made by this controller, so
+// it is seen immediately rather than once the notification arrives.
+func (r *SettingsRepo) invalidateLocal() {
+	r.mtx.Lock()
+	r.values = nil
+	r.gen++
+	r.mtx.Unlock()
+}
+
+func validateSetting(s *ct.Setting) error {
+	switch s.Key {
+	case ct.SettingDefaultRouteDomain:
+		if strings.ContainsAny(s.Value, "/: ") {
+			return ct.ValidationError{Field: "value", Message: "must be a domain name"}
+		}
+	case ct.SettingDefaultDeployStrategy:
+		if _, ok := deployStrategies[s.Value]; !ok {
+			return ct.ValidationError{Field: "value", Message: "must be all-at-once, one-by-one or in-batches"}
+		}
+	case ct.SettingGCRetention:
+		if s.Value == "" {
+			return nil
+		}
+		if d, err := time.ParseDuration(s.Value); err != nil || d <= 0 {
+			return ct.ValidationError{Field: "value", Message: "must be a positive duration such as 720h"}
+		}
+	case ct.SettingDeploymentRetentionCount, ct.SettingDeploymentConcurrency:
+		if s.Value == "" {
+			return nil
+		}
+		if n, err := strconv.Atoi(s.Value); err != nil || n < 1 {
+			return ct.ValidationError{Field: "value", Message: "must be a positive integer"}
+		}
+	case ct.SettingDeploymentRetentionAge:
+		if s.Value == "" {
+			return nil
+		}
+		if d, err := time.ParseDuration(s.Value); err != nil || d <= 0 {
+			return ct.ValidationError{Field: "value", Message: "must be a positive duration such as 720h"}
+		}
+	case ct.SettingFormationCapacityCheck:
+		switch s.Value {
+		case "off", "warn", "reject":
+		default:
+			return ct.ValidationError{Field: "value", Message: "must be off, warn or reject"}
+		}
+	case ct.SettingSchedulingStrategy:
+		if !validSchedulingStrategy(s.Value) {
+			return ct.ValidationError{Field: "value", Message: "must be spread or bin-pack"}
+		}
+	}
+	return nil
+}
+
+func validSchedulingStrategy(s string) bool {
+	return s == ct.SchedulingStrategySpread || s == ct.SchedulingStrategyBinPack
+}
+
+// settingsCORSHandler applies base, restricted to the origins allowed by the
+// cors_allowed_origins setting, rebuilding the handler when it changes.
+func settingsCORSHandler(base *cors.Options, settings *SettingsRepo) http.HandlerFunc {
+	var mtx sync.Mutex
+	var origins string
+	var handler http.HandlerFunc
+	return func(w http.ResponseWriter, req *http.Request) {
+		value := settings.Value(ct.SettingCORSAllowedOrigins)
+		mtx.Lock()
+		if handler == nil || value != origins {
+			origins = value
+			handler = cors.Allow(corsOptionsWithOrigins(base, value))
+		}
+		h := handler
+		mtx.Unlock()
+		h(w, req)
+	}
+}
+
+func corsOptionsWithOrigins(base *cors.Options, origins string) *cors.Options {
+	opts := &cors.Options{
+		AllowAllOrigins:  true,
+		AllowCredentials: base.AllowCredentials,
+		AllowMethods:     base.AllowMethods,
+		AllowHeaders:     base.AllowHeaders,
+		ExposeHeaders:    base.ExposeHeaders,
+		MaxAge:           base.MaxAge,
+	}
+	var list []string
+	for _, s := range strings.Split(origins, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	if len(list) > 0 && !(len(list) == 1 && list[0] == "*") {
+		opts.AllowAllOrigins = false
+		opts.AllowOrigins = list
+	}
+	return opts
+}
+
+func (c *controllerAPI) ListSettings(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	settings, err := c.settingsRepo.List()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, settings)
+}
+
+func (c *controllerAPI) GetSetting(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	setting, err := c.settingsRepo.Get(params.ByName("settings_key"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, setting)
+}
+
+func (c *controllerAPI) PutSetting(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var setting ct.Setting
+	if err := httphelper.DecodeJSON(req, &setting); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	setting.Key = params.ByName("settings_key")
+	if err := c.settingsRepo.Set(&setting); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &setting)
+}
+
+// DeleteSetting resets a setting to its default.
+func (c *controllerAPI) DeleteSetting(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	if err := c.settingsRepo.Delete(params.ByName("settings_key")); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestSettings(c *C) {
+	settings, err := s.c.SettingList()
+	c.Assert(err, IsNil)
+	c.Assert(settings, HasLen, len(settingKeys))
+	for _, setting := range settings {
+		c.Assert(setting.Default, Equals, true)
+	}
+
+	setting, err := s.c.GetSetting(ct.SettingDefaultDeployStrategy)
+	c.Assert(err, IsNil)
+	c.Assert(setting.Value, Equals, "all-at-once")
+	c.Assert(setting.Default, Equals, true)
+
+	// new apps use the default strategy
+	setting, err = s.c.SetSetting(ct.SettingDefaultDeployStrategy, "one-by-one")
+	c.Assert(err, IsNil)
+	c.Assert(setting.Value, Equals, "one-by-one")
+	c.Assert(setting.Default, Equals, false)
+	c.Assert(setting.UpdatedAt, NotNil)
+	defer s.c.DeleteSetting(ct.SettingDefaultDeployStrategy)
+	app := s.createTestApp(c, &ct.App{Name: "settings-strategy"})
+	c.Assert(app.Strategy, Equals, "one-by-one")
+
+	// and default routes are created under the default domain
+	_, err = s.c.SetSetting(ct.SettingDefaultRouteDomain, "settings.example.com")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingDefaultRouteDomain)
+	app = s.createTestApp(c, &ct.App{Name: "settings-domain"})
+	routes, err := s.c.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].Domain, Equals, "settings-domain.settings.example.com")
+
+	// invalid values and unknown settings are rejected
+	_, err = s.c.SetSetting(ct.SettingDefaultDeployStrategy, "sideways")
+	c.Assert(err, NotNil)
+	_, err = s.c.SetSetting(ct.SettingGCRetention, "-1h")
+	c.Assert(err, NotNil)
+	_, err = s.c.SetSetting(ct.SettingDeploymentConcurrency, "0")
+	c.Assert(err, NotNil)
+	_, err = s.c.SetSetting(ct.SettingSchedulingStrategy, "random")
+	c.Assert(err, NotNil)
+	_, err = s.c.SetSetting("unknown", "value")
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = s.c.GetSetting("unknown")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// deleting a setting restores its default
+	c.Assert(s.c.DeleteSetting(ct.SettingDefaultDeployStrategy), IsNil)
+	setting, err = s.c.GetSetting(ct.SettingDefaultDeployStrategy)
+	c.Assert(err, IsNil)
+	c.Assert(setting.Value, Equals, "all-at-once")
+	c.Assert(setting.Default, Equals, true)
+}
+
+func (s *S) TestCORSOriginsSetting(c *C) {
+	preflight := func(origin string) string {
+		req, err := http.NewRequest("OPTIONS", s.srv.URL+"/apps", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res.Header.Get("Access-Control-Allow-Origin")
+	}
+	c.Assert(preflight("https://evil.example.com"), Equals, "https://evil.example.com")
+
+	_, err := s.c.SetSetting(ct.SettingCORSAllowedOrigins, "https://dashboard.example.com, https://*.dashboard.example.com")
+	c.Assert(err, IsNil)
+	defer s.c.DeleteSetting(ct.SettingCORSAllowedOrigins)
+	c.Assert(preflight("https://dashboard.example.com"), Equals, "https://dashboard.example.com")
+	c.Assert(preflight("https://eu.dashboard.example.com"), Equals, "https://eu.dashboard.example.com")
+	c.Assert(preflight("https://evil.example.com"), Equals, "")
+
+	_, err = s.c.SetSetting(ct.SettingCORSAllowedOrigins, "*")
+	c.Assert(err, IsNil)
+	c.Assert(preflight("https://evil.example.com"), Equals, "https://evil.example.com")
+}
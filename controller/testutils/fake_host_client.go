@@ -10,21 +10,27 @@ import (
 	"github.com/flynn/flynn/host/volume"
 	"github.com/flynn/flynn/pinkerton/layer"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/stream"
 )
 
 func NewFakeHostClient(hostID string) *FakeHostClient {
 	return &FakeHostClient{
-		hostID:  hostID,
-		stopped: make(map[string]bool),
-		attach:  make(map[string]attachFunc),
+		hostID:   hostID,
+		stopped:  make(map[string]bool),
+		stopOpts: make(map[string]*host.StopOptions),
+		attach:   make(map[string]attachFunc),
+		volumes:  make(map[string]struct{}),
 	}
 }
 
 type FakeHostClient struct {
 	hostID    string
 	stopped   map[string]bool
+	stopOpts  map[string]*host.StopOptions
 	attach    map[string]attachFunc
+	volumes   map[string]struct{}
+	metrics   *host.HostMetrics
 	cluster   *FakeCluster
 	listeners []chan<- *host.Event
 	listenMtx sync.RWMutex
@@ -65,8 +71,17 @@ func (c *FakeHostClient) StreamEvents(id string, ch chan<- *host.Event) (stream.
 	return &FakeHostEventStream{ch: ch}, nil
 }
 
+func (c *FakeHostClient) StreamEventsSince(id string, since int64, ch chan<- *host.Event) (stream.Stream, error) {
+	return c.StreamEvents(id, ch)
+}
+
 func (c *FakeHostClient) StopJob(id string) error {
+	return c.StopJobWithOptions(id, nil)
+}
+
+func (c *FakeHostClient) StopJobWithOptions(id string, opts *host.StopOptions) error {
 	c.stopped[id] = true
+	c.stopOpts[id] = opts
 	c.cluster.RemoveJob(c.hostID, id, false)
 	return nil
 }
@@ -75,6 +90,11 @@ func (c *FakeHostClient) IsStopped(id string) bool {
 	return c.stopped[id]
 }
 
+// StopOptions returns the options the job was stopped with.
+func (c *FakeHostClient) StopOptions(id string) *host.StopOptions {
+	return c.stopOpts[id]
+}
+
 func (c *FakeHostClient) SetAttach(id string, ac cluster.AttachClient) {
 	c.attach[id] = func(*host.AttachReq, bool) (cluster.AttachClient, error) {
 		return ac, nil
@@ -98,6 +118,22 @@ func (c *FakeHostClient) SendEvent(event, id string) {
 	}
 }
 
+func (c *FakeHostClient) Metrics() (*host.HostMetrics, error) {
+	if c.metrics == nil {
+		return &host.HostMetrics{HostID: c.hostID, Time: time.Now().UTC()}, nil
+	}
+	return c.metrics, nil
+}
+
+// SetMetrics sets the metrics returned by Metrics.
+func (c *FakeHostClient) SetMetrics(m *host.HostMetrics) {
+	c.metrics = m
+}
+
+func (c *FakeHostClient) Ports() (*host.HostPorts, error) {
+	return &host.HostPorts{}, nil
+}
+
 func (c *FakeHostClient) PullImages(repository, driver, root string, tufDB io.Reader, ch chan<- *layer.PullInfo) (stream.Stream, error) {
 	return nil, nil
 }
@@ -118,5 +154,20 @@ func (h *FakeHostEventStream) Err() error {
 }
 
 func (c *FakeHostClient) CreateVolume(providerId string) (*volume.Info, error) {
-	return nil, nil
+	id := random.UUID()
+	c.volumes[id] = struct{}{}
+	return &volume.Info{ID: id}, nil
+}
+
+func (c *FakeHostClient) DestroyVolume(id string) error {
+	if _, ok := c.volumes[id]; !ok {
+		return cluster.ErrNotFound
+	}
+	delete(c.volumes, id)
+	return nil
+}
+
+func (c *FakeHostClient) HasVolume(id string) bool {
+	_, ok := c.volumes[id]
+	return ok
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/router/types"
 )
 
 type ExpandedFormation struct {
@@ -18,21 +19,107 @@ type ExpandedFormation struct {
 }
 
 type App struct {
-	ID        string            `json:"id,omitempty"`
-	Name      string            `json:"name,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	// NamespaceID is the namespace which owns the app, app names are unique
+	// within a namespace.
+	NamespaceID string `json:"namespace,omitempty"`
+	// Protected prevents every formation of the app from being scaled to
+	// zero processes of any type.
 	Protected bool              `json:"protected"`
+	Policy    *AppPolicy        `json:"policy,omitempty"`
 	Meta      map[string]string `json:"meta,omitempty"`
 	Strategy  string            `json:"strategy,omitempty"`
-	CreatedAt *time.Time        `json:"created_at,omitempty"`
-	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+	// DeployBatchSize is the number of processes of each type replaced at
+	// a time by the in-batches strategy, see DefaultDeployBatchSize.
+	DeployBatchSize int             `json:"deploy_batch_size,omitempty"`
+	Quota           *AppQuota       `json:"quota,omitempty"`
+	Maintenance     *AppMaintenance `json:"maintenance,omitempty"`
+	CreatedAt       *time.Time      `json:"created_at,omitempty"`
+	UpdatedAt       *time.Time      `json:"updated_at,omitempty"`
+	// SchedulingStrategy overrides the scheduling_strategy setting for the
+	// jobs of the app if set.
+	SchedulingStrategy string `json:"scheduling_strategy,omitempty"`
+}
+
+// AppWebService returns the name of the discoverd service of the web
+// processes of the app with the given ID. It is derived from the ID rather than
+// the name, as app names are only unique within a namespace and can be
+// changed, so apps would otherwise be able to share a service.
+func AppWebService(appID string) string {
+	return "app-" + appID + "-web"
+}
+
+// Namespace is a team which owns apps. Auth tokens scoped to a namespace can
+// only see and modify the apps in it.
+type Namespace struct {
+	ID        string     `json:"id,omitempty"`
+	Name      string     `json:"name,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// AppPolicy restricts changes to an app which could take it offline.
+type AppPolicy struct {
+	// MinProcesses maps process types to the number of processes which
+	// formations must keep running.
+	MinProcesses map[string]int `json:"min_processes,omitempty"`
+	// LockRelease prevents the app's release from being changed, either
+	// directly or by a deployment.
+	LockRelease bool `json:"lock_release,omitempty"`
+	// LockRoutes prevents the app's routes from being removed.
+	LockRoutes bool `json:"lock_routes,omitempty"`
+}
+
+// MinProcessCount returns the number of processes of type typ which the
+// policy of app requires it to run across all of its formations.
+func (a *App) MinProcessCount(typ string) int {
+	if a.Policy == nil {
+		return 0
+	}
+	return a.Policy.MinProcesses[typ]
+}
+
+// AppQuota limits the processes and jobs an app can run, zero values are
+// unlimited.
+type AppQuota struct {
+	// MaxProcesses is the maximum total number of processes in a formation.
+	MaxProcesses int `json:"max_processes,omitempty"`
+	// MaxProcessType is the maximum number of processes of a single type in
+	// a formation.
+	MaxProcessType int `json:"max_process_type,omitempty"`
+	// MaxJobs is the maximum number of one-off jobs running at once.
+	MaxJobs int `json:"max_jobs,omitempty"`
+}
+
+// AppMaintenance is the maintenance mode of an app. The routes of an app in
+// maintenance mode return a 503 maintenance page rather than being proxied to
+// the app.
+type AppMaintenance struct {
+	Enabled bool `json:"enabled"`
+	// Page is an optional HTML page returned instead of the router's default
+	// maintenance page.
+	Page string `json:"page,omitempty"`
 }
 
 type Release struct {
-	ID         string                 `json:"id,omitempty"`
-	ArtifactID string                 `json:"artifact,omitempty"`
-	Env        map[string]string      `json:"env,omitempty"`
-	Processes  map[string]ProcessType `json:"processes,omitempty"`
-	CreatedAt  *time.Time             `json:"created_at,omitempty"`
+	ID         string `json:"id,omitempty"`
+	ArtifactID string `json:"artifact,omitempty"`
+	// AppID is the app the secrets of the release are sealed for, which
+	// is then the only app that can use it. It must be set if the release
+	// has secrets.
+	AppID string `json:"app_id,omitempty"`
+	// Description is a summary of the changes in the release, e.g. the
+	// commit message it was built from.
+	Description string `json:"description,omitempty"`
+	// CreatedBy is the person or system which created the release.
+	CreatedBy string            `json:"created_by,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	// Secrets are the names of the env vars whose values are secret, they
+	// are encrypted when the release is created and only decrypted when
+	// jobs are started, so the controller API returns them sealed.
+	Secrets   []string               `json:"secrets,omitempty"`
+	Processes map[string]ProcessType `json:"processes,omitempty"`
+	CreatedAt *time.Time             `json:"created_at,omitempty"`
 }
 
 type ProcessType struct {
@@ -44,19 +131,114 @@ type ProcessType struct {
 	Omni        bool              `json:"omni,omitempty"` // omnipresent - present on all hosts
 	HostNetwork bool              `json:"host_network,omitempty"`
 	Service     string            `json:"service,omitempty"`
+	// Readiness is checked against the service discovery address of new
+	// jobs during deployments, which only count a job as up once the check
+	// passes. It requires Service to be set.
+	Readiness *ReadinessCheck `json:"readiness,omitempty"`
+	// StopFirst makes one-by-one deployments stop each old job before
+	// starting its replacement rather than after, for processes which
+	// can't run two copies at once.
+	StopFirst bool `json:"stop_first,omitempty"`
+	// StartTimeout is how long deployments wait for jobs of the type to
+	// come up or go down before failing, it defaults to
+	// DefaultStartTimeout.
+	StartTimeout time.Duration `json:"start_timeout,omitempty"`
+	// KillTimeout is how long jobs of the type are given to exit after
+	// being sent SIGTERM before they are killed, so they can finish their
+	// work and close connections. It defaults to
+	// host.DefaultStopGracePeriod.
+	KillTimeout time.Duration `json:"kill_timeout,omitempty"`
+	// Memory is the most memory in bytes each job of the type may use
+	// before it is killed, it defaults to 1GiB.
+	Memory int64 `json:"memory,omitempty"`
+	// CPUShares is the relative share of CPU time each job of the type gets
+	// when the host's CPUs are contended, it defaults to 1024.
+	CPUShares int64 `json:"cpu_shares,omitempty"`
+	// IngressBandwidth and EgressBandwidth are the most bytes per second
+	// each job of the type may receive and send over the network, so that
+	// a single job can't saturate the host's network interface. They are
+	// not limited by default, and can't be set for jobs using the host
+	// network.
+	IngressBandwidth int64 `json:"ingress_bandwidth,omitempty"`
+	EgressBandwidth  int64 `json:"egress_bandwidth,omitempty"`
+	// Volumes are persistent volumes mounted into each job of the type.
+	// New jobs are started on a host with free volumes of the type if there
+	// is one, so that restarted jobs keep their data.
+	Volumes []VolumeReq `json:"volumes,omitempty"`
+	// Liveness is checked periodically by the host against each running
+	// job of the type, which is restarted if the check keeps failing.
+	Liveness *host.LivenessCheck `json:"liveness,omitempty"`
+}
+
+// VolumeReq is a request for a persistent volume mounted at Path.
+type VolumeReq struct {
+	Path string `json:"path"`
+}
+
+const DefaultStartTimeout = 60 * time.Second
+
+// ReadinessCheck is a check that a job is serving requests.
+type ReadinessCheck struct {
+	// Type is either http or tcp.
+	Type string `json:"type"`
+	// Path is the path requested by http checks, it defaults to /.
+	Path string `json:"path,omitempty"`
+	// Status is the response status expected by http checks, it defaults
+	// to 200.
+	Status int `json:"status,omitempty"`
+	// Timeout is how long a job has to pass the check after coming up
+	// before the deployment fails, it defaults to DefaultReadinessTimeout.
+	Timeout time.Duration `json:"timeout,omitempty"`
 }
 
+const DefaultReadinessTimeout = 30 * time.Second
+
+// MaxJobLogLines is the most recent log lines which can be requested from a
+// job, as hosts buffer them in memory.
+const MaxJobLogLines = 10000
+
 type Port struct {
+	// Name identifies the port within the process type, the allocated port
+	// is set in the PORT_<NAME> environment variable and the name is added
+	// to the port's service discovery metadata.
+	Name    string        `json:"name,omitempty"`
 	Port    int           `json:"port"`
 	Proto   string        `json:"proto"`
 	Service *host.Service `json:"service,omitempty"`
 }
 
 type Artifact struct {
-	ID        string     `json:"id,omitempty"`
-	Type      string     `json:"type,omitempty"`
-	URI       string     `json:"uri,omitempty"`
-	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type,omitempty"`
+	URI  string `json:"uri,omitempty"`
+	// Digest is the SHA-256 digest of the image in the form
+	// "sha256:<hex>". If set, hosts verify the image when fetching it and
+	// artifacts with the same digest are deduplicated.
+	Digest string `json:"digest,omitempty"`
+	// Credentials authenticate pulls of the image from a private
+	// registry. If not set, the credentials of the image's registry are
+	// used if there are any.
+	Credentials *RegistryCredentials `json:"credentials,omitempty"`
+	CreatedAt   *time.Time           `json:"created_at,omitempty"`
+}
+
+// RegistryCredentials authenticate pulls from a private Docker registry. The
+// password is sealed with the cluster secrets key for the registry host when
+// it is stored, and only opened when jobs are started. It is never returned
+// by the API.
+type RegistryCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Registry holds the credentials used to pull the images of artifacts hosted
+// on a private registry which don't have credentials of their own. The
+// password is never returned by the API.
+type Registry struct {
+	Host      string     `json:"host,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Password  string     `json:"password,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 }
 
 type Formation struct {
@@ -67,13 +249,80 @@ type Formation struct {
 	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
 }
 
+// ProcessScale is a change of the number of processes of a single process
+// type.
+type ProcessScale struct {
+	// Count is the number of processes to scale to, if it is nil Delta is
+	// added to the current number instead.
+	Count *int `json:"count,omitempty"`
+	Delta int  `json:"delta,omitempty"`
+}
+
+// FormationChange is a change of the process counts of a formation.
+type FormationChange struct {
+	AppID        string         `json:"app,omitempty"`
+	ReleaseID    string         `json:"release,omitempty"`
+	OldProcesses map[string]int `json:"old_processes"`
+	NewProcesses map[string]int `json:"new_processes"`
+	// Actor is the name of the auth token which made the change, it is
+	// empty for changes made with the controller auth key.
+	Actor     string     `json:"actor,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
 type Key struct {
-	ID        string     `json:"fingerprint,omitempty"`
-	Key       string     `json:"key,omitempty"`
-	Comment   string     `json:"comment,omitempty"`
+	ID      string `json:"fingerprint,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// Labels are arbitrary key-value pairs, e.g. the source a key was
+	// imported from, which keys can be listed by.
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt *time.Time        `json:"created_at,omitempty"`
+}
+
+// AuthToken is a named API key with a limited scope that can be revoked
+// independently of other keys.
+type AuthToken struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Token is the secret used to authenticate, it is only returned when the
+	// token is created.
+	Token string `json:"token,omitempty"`
+	// Scope is one of AuthTokenScopeReadOnly, AuthTokenScopeApp,
+	// AuthTokenScopeDeploy, AuthTokenScopeNamespace or AuthTokenScopeFull.
+	Scope string `json:"scope,omitempty"`
+	// AppID is the app that a token with AuthTokenScopeApp or
+	// AuthTokenScopeDeploy can access.
+	AppID string `json:"app,omitempty"`
+	// NamespaceID is the namespace whose apps a token with
+	// AuthTokenScopeNamespace can access.
+	NamespaceID string `json:"namespace,omitempty"`
+	// RateLimit is the number of requests per second the token can make,
+	// and RateBurst the number it can make at once. If RateLimit is zero,
+	// the controller's default limit applies.
+	RateLimit float64    `json:"rate_limit,omitempty"`
+	RateBurst int        `json:"rate_burst,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
+const (
+	// AuthTokenScopeReadOnly tokens can only make GET requests.
+	AuthTokenScopeReadOnly = "read-only"
+	// AuthTokenScopeApp tokens can only access a single app, and create the
+	// artifacts and releases needed to deploy it.
+	AuthTokenScopeApp = "app"
+	// AuthTokenScopeDeploy tokens can only create releases and deployments
+	// of a single app, for use by CI systems.
+	AuthTokenScopeDeploy = "deploy"
+	// AuthTokenScopeNamespace tokens can only access the apps in a single
+	// namespace, create apps in it, and create the artifacts and releases
+	// needed to deploy them.
+	AuthTokenScopeNamespace = "namespace"
+	// AuthTokenScopeFull tokens can access all of the API.
+	AuthTokenScopeFull = "full"
+)
+
 type Job struct {
 	ID        string            `json:"id,omitempty"`
 	AppID     string            `json:"app,omitempty"`
@@ -86,20 +335,169 @@ type Job struct {
 	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
 }
 
+const (
+	// APIVersion is the current version of the controller API. It is
+	// incremented when the API changes incompatibly, and clients select the
+	// version they were written against with the APIVersionHeader.
+	APIVersion = 1
+	// MinAPIVersion is the oldest API version the controller still
+	// supports.
+	MinAPIVersion = 1
+
+	APIVersionHeader = "Flynn-API-Version"
+)
+
+// Version is the version of a running controller.
+type Version struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	APIVersion    int    `json:"api_version"`
+	MinAPIVersion int    `json:"min_api_version"`
+}
+
+// AppUsage is the resource usage of an app over a time window, which is
+// collected periodically by the controller.
+type AppUsage struct {
+	AppID string    `json:"app"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// MaxJobs is the largest number of jobs the app was running at once.
+	MaxJobs int `json:"max_jobs"`
+	// JobHours is the total running time of the app's jobs.
+	JobHours float64 `json:"job_hours"`
+	// MemoryMBHours is the memory reserved by the app's jobs in megabytes
+	// multiplied by their running time.
+	MemoryMBHours float64 `json:"memory_mb_hours"`
+	// Requests is the number of HTTP requests routed to the app.
+	Requests int64 `json:"requests"`
+}
+
+// AppMetrics is a sample of the resource utilization of an app's running jobs,
+// taken from the hosts they run on.
+type AppMetrics struct {
+	AppID string    `json:"app"`
+	Time  time.Time `json:"time"`
+	// Total is the utilization of all of the app's jobs.
+	Total host.ResourceUsage `json:"total"`
+	// Processes is the utilization of the app's jobs of each process type.
+	Processes map[string]*host.ResourceUsage `json:"processes"`
+	Jobs      []*JobMetrics                  `json:"jobs"`
+}
+
+// JobMetrics is the resource utilization of a running job.
+type JobMetrics struct {
+	JobID     string `json:"job_id"`
+	HostID    string `json:"host_id"`
+	ReleaseID string `json:"release"`
+	Type      string `json:"type"`
+	host.ResourceUsage
+}
+
+// SearchResult is a controller object matching a search query.
+type SearchResult struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// AppID is the app which owns the object, for releases it is the app
+	// whose current release it is.
+	AppID string `json:"app,omitempty"`
+	// Name is a readable description of the object, such as an app name
+	// or route domain.
+	Name string `json:"name,omitempty"`
+}
+
+const (
+	SearchResultTypeApp     = "app"
+	SearchResultTypeRelease = "release"
+	SearchResultTypeRoute   = "route"
+	SearchResultTypeJob     = "job"
+)
+
+// Setting is a cluster wide configuration value which is read by the
+// controller at runtime, so it can be changed without restarting it.
+type Setting struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Default is true if the setting has not been set, so Value is its
+	// default.
+	Default   bool       `json:"default,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+const (
+	// SettingDefaultRouteDomain is the domain which default routes of new
+	// apps are created under.
+	SettingDefaultRouteDomain = "default_route_domain"
+	// SettingDefaultDeployStrategy is the deploy strategy of new apps
+	// which don't specify one.
+	SettingDefaultDeployStrategy = "default_deploy_strategy"
+	// SettingGCRetention is how long usage samples are kept, as a
+	// duration such as "720h". They are kept forever if it is empty.
+	SettingGCRetention = "gc_retention"
+	// SettingDeploymentRetentionCount is the number of finished
+	// deployments kept for each app, and SettingDeploymentRetentionAge how
+	// long they are kept as a duration such as "720h". Deployments which
+	// exceed either are removed, an empty setting doesn't limit them.
+	SettingDeploymentRetentionCount = "deployment_retention_count"
+	SettingDeploymentRetentionAge   = "deployment_retention_age"
+	// SettingCORSAllowedOrigins is a comma separated list of the origins
+	// allowed to make cross-origin requests, all origins are allowed if it
+	// is empty or "*".
+	SettingCORSAllowedOrigins = "cors_allowed_origins"
+	// SettingFormationCapacityCheck is whether formations are checked
+	// against the capacity of the cluster, either "off", "warn" (the
+	// formation is accepted with a Warning header) or "reject".
+	SettingFormationCapacityCheck = "formation_capacity_check"
+	// SettingDeploymentConcurrency is the maximum number of deployments
+	// performed at once across the cluster, deployments over the limit wait
+	// in the queue. The number of deployer workers is the only limit if it
+	// is empty.
+	SettingDeploymentConcurrency = "deployment_concurrency"
+	// SettingSchedulingStrategy is how the scheduler places jobs on hosts,
+	// either SchedulingStrategySpread or SchedulingStrategyBinPack.
+	SettingSchedulingStrategy = "scheduling_strategy"
+)
+
+const (
+	// SchedulingStrategySpread spreads the jobs of each app and type
+	// evenly across hosts, so that losing a host stops few of them.
+	SchedulingStrategySpread = "spread"
+	// SchedulingStrategyBinPack packs jobs onto as few hosts as the
+	// memory of the hosts allows.
+	SchedulingStrategyBinPack = "bin-pack"
+)
+
+// ClusterJob is a running job along with the host it is running on.
+type ClusterJob struct {
+	*Job
+	HostID    string     `json:"host_id,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// Uptime is the number of seconds since the job started.
+	Uptime int64 `json:"uptime,omitempty"`
+}
+
 type JobEvent struct {
 	Job
 	ID    int64  `json:"id"`
 	JobID string `json:"job_id,omitempty"`
 }
 
+func (e *JobEvent) EventID() string {
+	return strconv.FormatInt(e.ID, 10)
+}
+
 func (e *JobEvent) IsDown() bool {
 	return e.State == "failed" || e.State == "crashed" || e.State == "down"
 }
 
 type NewJob struct {
-	ReleaseID  string            `json:"release,omitempty"`
-	Cmd        []string          `json:"cmd,omitempty"`
+	ReleaseID string   `json:"release,omitempty"`
+	Cmd       []string `json:"cmd,omitempty"`
+	// Entrypoint, WorkingDir and User override those of the artifact's
+	// image, e.g. to debug a container whose entrypoint doesn't accept
+	// arbitrary commands.
 	Entrypoint []string          `json:"entrypoint,omitempty"`
+	WorkingDir string            `json:"working_dir,omitempty"`
+	User       string            `json:"user,omitempty"`
 	Env        map[string]string `json:"env,omitempty"`
 	Meta       map[string]string `json:"meta,omitempty"`
 	TTY        bool              `json:"tty,omitempty"`
@@ -107,14 +505,161 @@ type NewJob struct {
 	Lines      int               `json:"tty_lines,omitempty"`
 }
 
+// JobLogOptions filters the log returned by the job log endpoint.
+type JobLogOptions struct {
+	// Follow streams new log lines after the buffered log.
+	Follow bool
+	// Lines limits the buffered log to the most recent lines, all lines are
+	// returned if zero.
+	Lines int
+	// Since skips log lines written before the given time.
+	Since *time.Time
+	// Wait waits for the job to be created rather than returning not found.
+	Wait bool
+}
+
+// JobAttachOptions are the options of an attach to a running job.
+type JobAttachOptions struct {
+	// Stdin forwards the input written to the attached stream to the job.
+	Stdin bool `json:"stdin,omitempty"`
+	// Logs sends the job's buffered output before new output.
+	Logs bool `json:"logs,omitempty"`
+	// Height and Width are the initial size of the terminal of TTY jobs.
+	Height uint16 `json:"height,omitempty"`
+	Width  uint16 `json:"width,omitempty"`
+}
+
 type Deployment struct {
-	ID           string     `json:"id,omitempty"`
-	AppID        string     `json:"app,omitempty"`
-	OldReleaseID string     `json:"old_release,omitempty"`
-	NewReleaseID string     `json:"new_release,omitempty"`
-	Strategy     string     `json:"strategy,omitempty"`
-	CreatedAt    *time.Time `json:"created_at,omitempty"`
-	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	ID           string `json:"id,omitempty"`
+	AppID        string `json:"app,omitempty"`
+	OldReleaseID string `json:"old_release,omitempty"`
+	NewReleaseID string `json:"new_release,omitempty"`
+	Strategy     string `json:"strategy,omitempty"`
+	BatchSize    int    `json:"batch_size,omitempty"`
+	// MaxFailures is the number of failed jobs tolerated before the
+	// deployment fails, failed jobs are replaced by the scheduler.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// NoRollback leaves the formations of a failed deployment as they
+	// are rather than restoring the old formation.
+	NoRollback bool `json:"no_rollback,omitempty"`
+	// Processes override the process counts of the old release for the
+	// types they include when scaling the new release.
+	Processes map[string]int `json:"processes,omitempty"`
+	// OldProcesses are the process counts of the old release when the
+	// deployment was created, which a failed deployment is rolled back to.
+	OldProcesses map[string]int `json:"old_processes,omitempty"`
+	Status       string         `json:"status,omitempty"`
+	CreatedAt    *time.Time     `json:"created_at,omitempty"`
+	FinishedAt   *time.Time     `json:"finished_at,omitempty"`
+}
+
+// NewProcesses returns the process counts the new release of the deployment
+// is scaled to, given old, the process counts of the old release.
+func (d *Deployment) NewProcesses(old map[string]int) map[string]int {
+	procs := make(map[string]int, len(old)+len(d.Processes))
+	for typ, n := range old {
+		procs[typ] = n
+	}
+	for typ, n := range d.Processes {
+		procs[typ] = n
+	}
+	return procs
+}
+
+// DefaultDeployBatchSize returns the batch size of an in-batches deployment of
+// n processes of a type when the app doesn't set one, which is a quarter of
+// the processes rounded up.
+func DefaultDeployBatchSize(n int) int {
+	if n < 4 {
+		return 1
+	}
+	return (n + 3) / 4
+}
+
+const (
+	DeploymentStatusPending  = "pending"
+	DeploymentStatusRunning  = "running"
+	DeploymentStatusComplete = "complete"
+	DeploymentStatusFailed   = "failed"
+)
+
+// DeploymentFilter restricts a list of deployments, zero fields match all
+// deployments.
+type DeploymentFilter struct {
+	AppID  string
+	Status string
+	// Since and Until restrict the list to deployments created in the
+	// given time range.
+	Since *time.Time
+	Until *time.Time
+	// Limit is the maximum number of deployments to return.
+	Limit int
+}
+
+// Operation is a long-running request which completes asynchronously, its
+// status can be polled or streamed until it is complete or failed.
+type Operation struct {
+	ID    string `json:"id,omitempty"`
+	Type  string `json:"type,omitempty"`
+	AppID string `json:"app,omitempty"`
+	// Status is one of OperationStatusRunning, OperationStatusComplete or
+	// OperationStatusFailed.
+	Status string `json:"status,omitempty"`
+	// Result is the response of the operation once it is complete, e.g. the
+	// provisioned resource.
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt *time.Time      `json:"created_at,omitempty"`
+	UpdatedAt *time.Time      `json:"updated_at,omitempty"`
+}
+
+// Done reports whether the operation has completed or failed.
+func (o *Operation) Done() bool {
+	return o.Status == OperationStatusComplete || o.Status == OperationStatusFailed
+}
+
+const (
+	OperationStatusRunning  = "running"
+	OperationStatusComplete = "complete"
+	OperationStatusFailed   = "failed"
+)
+
+const OperationTypeProvisionResource = "provision_resource"
+
+// DeployLock prevents deployments of an app by anyone other than its owner
+// until it expires or is released.
+type DeployLock struct {
+	AppID string `json:"app,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	// TokenID is the ID of the auth token the lock was acquired with, it is
+	// set by the controller. Only requests made with the same token can
+	// use the lock.
+	TokenID   string     `json:"token_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Volume is a persistent volume on a host which is mounted into jobs of an
+// app's process type. A volume is only mounted into one job at a time, and is
+// reused by the jobs which replace it.
+type Volume struct {
+	ID        string     `json:"id,omitempty"`
+	AppID     string     `json:"app,omitempty"`
+	HostID    string     `json:"host_id,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// DeploymentOptions are the options of a new deployment.
+type DeploymentOptions struct {
+	ReleaseID   string `json:"id"`
+	MaxFailures int    `json:"max_failures,omitempty"`
+	NoRollback  bool   `json:"no_rollback,omitempty"`
+	// Processes scales the new release to these process counts as part of
+	// the deployment, types which aren't included keep the counts of the
+	// old release.
+	Processes map[string]int `json:"processes,omitempty"`
 }
 
 type DeployID struct {
@@ -122,25 +667,92 @@ type DeployID struct {
 }
 
 type DeploymentEvent struct {
-	ID           int64      `json:"id"`
-	DeploymentID string     `json:"deployment"`
-	ReleaseID    string     `json:"release"`
-	Status       string     `json:"status"`
-	JobType      string     `json:"job_type"`
-	JobState     string     `json:"job_state"`
-	CreatedAt    *time.Time `json:"created_at"`
+	ID           int64  `json:"id"`
+	DeploymentID string `json:"deployment"`
+	ReleaseID    string `json:"release"`
+	Status       string `json:"status"`
+	JobType      string `json:"job_type"`
+	JobState     string `json:"job_state"`
+	// Step is the step of the deployment being performed, one of the
+	// DeploymentStep constants.
+	Step string `json:"step,omitempty"`
+	// Expected is the number of jobs of each type the new release runs once
+	// the deployment is complete, and Current the number which are up.
+	Expected map[string]int `json:"expected,omitempty"`
+	Current  map[string]int `json:"current,omitempty"`
+	// Percent is how much of the whole deployment is complete.
+	Percent   int        `json:"percent"`
+	CreatedAt *time.Time `json:"created_at"`
 }
 
+const (
+	// DeploymentStepStart is starting jobs of the new release.
+	DeploymentStepStart = "start"
+	// DeploymentStepStop is stopping jobs of the old release.
+	DeploymentStepStop = "stop"
+	// DeploymentStepRollback is restoring the old formation after a
+	// failed deployment.
+	DeploymentStepRollback = "rollback"
+	// DeploymentStepFailed is the end of a failed deployment which isn't
+	// rolled back.
+	DeploymentStepFailed = "failed"
+	// DeploymentStepDone is the end of a successful deployment.
+	DeploymentStepDone = "done"
+)
+
 func (de *DeploymentEvent) EventID() string {
 	return strconv.FormatInt(de.ID, 10)
 }
 
+// Event is a change to an object in the controller, the current state of the
+// object can be retrieved using its type and ID.
+type Event struct {
+	ID         int64  `json:"id"`
+	AppID      string `json:"app,omitempty"`
+	ObjectType string `json:"object_type"`
+	ObjectID   string `json:"object_id"`
+	// Kind is one of EventKindCreate, EventKindUpdate or EventKindDelete,
+	// it is empty for events created before kinds were recorded.
+	Kind      string     `json:"kind,omitempty"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+const (
+	EventKindCreate = "create"
+	EventKindUpdate = "update"
+	EventKindDelete = "delete"
+)
+
+// StreamEventsOptions restricts an event stream to events after SinceID which
+// match any of the values of each non-empty filter.
+type StreamEventsOptions struct {
+	SinceID     int64
+	AppIDs      []string
+	ObjectTypes []string
+	Kinds       []string
+}
+
+func (e *Event) EventID() string {
+	return strconv.FormatInt(e.ID, 10)
+}
+
 type Provider struct {
-	ID        string     `json:"id,omitempty"`
-	URL       string     `json:"url,omitempty"`
-	Name      string     `json:"name,omitempty"`
-	CreatedAt *time.Time `json:"created_at,omitempty"`
-	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	ID   string `json:"id,omitempty"`
+	URL  string `json:"url,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Plans maps plan names to the provisioning config they set, so
+	// resources can be requested by plan rather than raw config.
+	Plans     map[string]*json.RawMessage `json:"plans,omitempty"`
+	CreatedAt *time.Time                  `json:"created_at,omitempty"`
+	UpdatedAt *time.Time                  `json:"updated_at,omitempty"`
+}
+
+// ProviderStatus is the result of pinging a provider.
+type ProviderStatus struct {
+	ProviderID string `json:"provider"`
+	// LatencyMs is the round trip time of the ping in milliseconds.
+	LatencyMs float64 `json:"latency_ms"`
+	Version   string  `json:"version,omitempty"`
 }
 
 type Resource struct {
@@ -152,10 +764,96 @@ type Resource struct {
 	CreatedAt  *time.Time        `json:"created_at,omitempty"`
 }
 
+// ResourceSync is the result of comparing the resources of a provider with
+// those the controller has recorded.
+type ResourceSync struct {
+	ProviderID string `json:"provider"`
+	// Orphaned are the external IDs of resources which the provider has
+	// but the controller doesn't, e.g. because recording a provisioned
+	// resource failed.
+	Orphaned []string `json:"orphaned"`
+	// Missing are the resources the controller has recorded which the
+	// provider no longer has.
+	Missing []*Resource `json:"missing"`
+	// Repaired is true if orphaned resources were deprovisioned and missing
+	// resources removed from the controller.
+	Repaired bool `json:"repaired"`
+	// Skipped are the external IDs of orphaned and missing resources which
+	// were not repaired as they may still be being provisioned.
+	Skipped []string `json:"skipped,omitempty"`
+	// Bound are the external IDs of missing resources which were not
+	// removed as they are still bound to apps, they must be removed from
+	// the apps first.
+	Bound []string `json:"bound,omitempty"`
+}
+
 type ResourceReq struct {
-	ProviderID string           `json:"-"`
-	Apps       []string         `json:"apps,omitempty"`
-	Config     *json.RawMessage `json:"config"`
+	ProviderID string   `json:"-"`
+	Apps       []string `json:"apps,omitempty"`
+	// Plan is the name of a plan of the provider whose config is merged
+	// into Config, which may not override the values the plan sets.
+	Plan   string           `json:"plan,omitempty"`
+	Config *json.RawMessage `json:"config"`
+}
+
+// ClusterExport is a portable copy of the state of a cluster which can be
+// imported into another cluster.
+type ClusterExport struct {
+	Version    int          `json:"version"`
+	Namespaces []*Namespace `json:"namespaces,omitempty"`
+	Apps       []*App       `json:"apps"`
+	// AppReleases maps app IDs to the IDs of their current releases.
+	AppReleases map[string]string `json:"app_releases"`
+	Releases    []*Release        `json:"releases"`
+	Artifacts   []*Artifact       `json:"artifacts"`
+	Formations  []*Formation      `json:"formations"`
+	Providers   []*Provider       `json:"providers"`
+	Resources   []*Resource       `json:"resources"`
+	Routes      []*router.Route   `json:"routes"`
+}
+
+// AppDefinition is the desired state of an app in a bulk app import, the app
+// is created if it doesn't exist and updated to match otherwise.
+type AppDefinition struct {
+	Name       string                 `json:"name"`
+	ArtifactID string                 `json:"artifact,omitempty"`
+	Env        map[string]string      `json:"env,omitempty"`
+	Secrets    []string               `json:"secrets,omitempty"`
+	Processes  map[string]ProcessType `json:"processes,omitempty"`
+	Formation  map[string]int         `json:"formation,omitempty"`
+	// Routes are added to the app if it has no route for the same domain
+	// (or port for TCP routes), existing routes are left in place.
+	Routes []*router.Route `json:"routes,omitempty"`
+}
+
+// AppImportResult is the outcome of importing a single AppDefinition. If
+// Error is set none of the changes to the app were applied.
+type AppImportResult struct {
+	Name           string          `json:"name"`
+	AppID          string          `json:"app,omitempty"`
+	Created        bool            `json:"created"`
+	ReleaseID      string          `json:"release,omitempty"`
+	ReleaseCreated bool            `json:"release_created"`
+	DeploymentID   string          `json:"deployment,omitempty"`
+	Routes         []*router.Route `json:"routes,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// MigrationStatus is the state of a controller database migration.
+type MigrationStatus struct {
+	ID      int  `json:"id"`
+	Applied bool `json:"applied"`
+	// Known is false for migrations applied by a newer controller.
+	Known      bool `json:"known"`
+	Reversible bool `json:"reversible"`
+}
+
+// MigrationRollback is a request to revert the database migrations applied
+// after Version, the response lists the reverted migrations in Migrations.
+type MigrationRollback struct {
+	Version    int   `json:"version"`
+	DryRun     bool  `json:"dry_run,omitempty"`
+	Migrations []int `json:"migrations,omitempty"`
 }
 
 type ValidationError struct {
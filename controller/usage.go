@@ -0,0 +1,289 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+)
+
+type UsageRepo struct {
+	db *postgres.DB
+}
+
+func NewUsageRepo(db *postgres.DB) *UsageRepo {
+	return &UsageRepo{db}
+}
+
+// Get returns the usage of the app collected in the given time window.
+func (r *UsageRepo) Get(appID string, since, until time.Time) (*ct.AppUsage, error) {
+	usage := &ct.AppUsage{AppID: appID, Since: since, Until: until}
+	var jobSeconds, memorySeconds int64
+	err := r.db.QueryRow(`
+SELECT COALESCE(max(jobs), 0), COALESCE(sum(jobs * period_seconds), 0), COALESCE(sum(memory * period_seconds), 0), COALESCE(sum(requests), 0)
+FROM app_usage WHERE app_id = $1 AND collected_at >= $2 AND collected_at < $3`,
+		appID, since, until).Scan(&usage.MaxJobs, &jobSeconds, &memorySeconds, &usage.Requests)
+	if err != nil {
+		return nil, err
+	}
+	usage.JobHours = float64(jobSeconds) / 3600
+	// memory is reserved in KiB
+	usage.MemoryMBHours = float64(memorySeconds) / 1024 / 3600
+	return usage, nil
+}
+
+func (c *controllerAPI) GetAppUsage(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	until := time.Now()
+	since := until.Add(-24 * time.Hour)
+	q := req.URL.Query()
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"since", &since},
+		{"until", &until},
+	} {
+		s := q.Get(param.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			respondWithError(w, ct.ValidationError{Field: param.name, Message: "must be an RFC 3339 timestamp"})
+			return
+		}
+		*param.t = t
+	}
+	if !since.Before(until) {
+		respondWithError(w, ct.ValidationError{Field: "since", Message: "must be before until"})
+		return
+	}
+
+	usage, err := c.usageRepo.Get(c.getApp(ctx).ID, since, until)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, usage)
+}
+
+// usageLockID is the advisory lock held while collecting usage, so only one
+// controller instance collects each period.
+const usageLockID = 0x75736167
+
+// usageCollector periodically records the jobs and memory reservations of
+// every app from the cluster, and the number of requests routed to it from
+// the request counts of each router instance.
+type usageCollector struct {
+	db *postgres.DB
+	cc clusterClient
+	// settings provides the gc_retention setting, samples older than it
+	// are deleted after each collection. They are kept if it is nil.
+	settings *SettingsRepo
+	interval time.Duration
+	// routers returns a client for each router instance, keyed by its
+	// address.
+	routers func() (map[string]routerc.Client, error)
+}
+
+// discoverdRouters returns a client for each router API instance registered
+// in service discovery.
+func discoverdRouters() (map[string]routerc.Client, error) {
+	addrs, err := discoverd.NewService("router-api").Addrs()
+	if err != nil {
+		return nil, err
+	}
+	routers := make(map[string]routerc.Client, len(addrs))
+	for _, addr := range addrs {
+		routers[addr] = routerc.NewWithAddr(addr)
+	}
+	return routers, nil
+}
+
+type appUsageSample struct {
+	jobs     int
+	memory   int64
+	requests int64
+}
+
+func (u *usageCollector) Run() {
+	for range time.Tick(u.interval) {
+		if err := u.Collect(); err != nil {
+			log.Printf("Error collecting app usage: %s", err)
+		}
+	}
+}
+
+// Collect records a usage sample for each app, unless another controller has
+// already done so in the current period. The cluster and routers are queried
+// before the advisory lock is taken, so that the lock and transaction aren't
+// held during the requests.
+func (u *usageCollector) Collect() error {
+	if recent, err := u.recentlyCollected(u.db); err != nil || recent {
+		return err
+	}
+
+	samples := make(map[string]*appUsageSample)
+	sample := func(appID string) *appUsageSample {
+		s, ok := samples[appID]
+		if !ok {
+			s = &appUsageSample{}
+			samples[appID] = s
+		}
+		return s
+	}
+
+	hosts, err := u.cc.ListHosts()
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		for _, job := range h.Jobs {
+			appID := job.Metadata["flynn-controller.app"]
+			if appID == "" {
+				continue
+			}
+			s := sample(appID)
+			s.jobs++
+			s.memory += int64(job.Resources.Memory)
+		}
+	}
+
+	routers, err := u.routers()
+	if err != nil {
+		return err
+	}
+	// the counts of routers which can't be reached are kept until they
+	// can be reached again, those of routers which are no longer
+	// registered are deleted
+	addrs := make([]string, 0, len(routers))
+	routerStats := make(map[string][]*router.HTTPRouteStats, len(routers))
+	for addr, client := range routers {
+		addrs = append(addrs, addr)
+		stats, err := client.HTTPStats()
+		if err != nil {
+			log.Printf("Error getting request counts from router %s: %s", addr, err)
+			continue
+		}
+		routerStats[addr] = stats
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", usageLockID).Scan(&locked); err != nil || !locked {
+		tx.Rollback()
+		return err
+	}
+	if recent, err := u.recentlyCollected(tx); err != nil || recent {
+		tx.Rollback()
+		return err
+	}
+
+	for addr, stats := range routerStats {
+		routeIDs := make([]string, 0, len(stats))
+		for _, stat := range stats {
+			routeIDs = append(routeIDs, stat.RouteID)
+			var prev int64
+			var instanceID string
+			err := tx.QueryRow("SELECT requests, instance_id FROM router_request_counts WHERE router_addr = $1 AND route_id = $2", addr, stat.RouteID).Scan(&prev, &instanceID)
+			if err == sql.ErrNoRows {
+				_, err = tx.Exec("INSERT INTO router_request_counts (router_addr, route_id, requests, instance_id) VALUES ($1, $2, $3, $4)", addr, stat.RouteID, int64(stat.Requests), stat.InstanceID)
+			} else if err == nil {
+				_, err = tx.Exec("UPDATE router_request_counts SET requests = $3, instance_id = $4 WHERE router_addr = $1 AND route_id = $2", addr, stat.RouteID, int64(stat.Requests), stat.InstanceID)
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			delta := int64(stat.Requests) - prev
+			if instanceID != stat.InstanceID || delta < 0 {
+				// the router restarted, so its counts were reset
+				delta = int64(stat.Requests)
+			}
+			appID := strings.TrimPrefix(stat.ParentRef, routeParentRef(""))
+			if appID == stat.ParentRef || appID == "" {
+				continue
+			}
+			sample(appID).requests += delta
+		}
+		// counts of routes which the router no longer reports have
+		// either been removed or belong to a previous run of it
+		if _, err := tx.Exec("DELETE FROM router_request_counts WHERE router_addr = $1 AND NOT (route_id = ANY($2::text[]))", addr, textArray(routeIDs)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM router_request_counts WHERE NOT (router_addr = ANY($1::text[]))", textArray(addrs)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	period := int64(u.interval / time.Second)
+	for appID, s := range samples {
+		if !idPattern.MatchString(appID) {
+			continue
+		}
+		_, err := tx.Exec(`
+INSERT INTO app_usage (app_id, jobs, memory, requests, period_seconds)
+SELECT app_id, $2::integer, $3::bigint, $4::bigint, $5::integer FROM apps WHERE app_id = $1`,
+			appID, s.jobs, s.memory, s.requests, period)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if retention := u.retention(); retention > 0 {
+		if _, err := tx.Exec("DELETE FROM app_usage WHERE collected_at < $1", time.Now().Add(-retention)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var textArrayEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// textArray returns values as a postgres text array literal.
+func textArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + textArrayEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// recentlyCollected reports whether a sample has been collected in the
+// current period.
+func (u *usageCollector) recentlyCollected(q rowQueryer) (bool, error) {
+	var recent bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM app_usage WHERE collected_at > $1)", time.Now().Add(-u.interval/2)).Scan(&recent)
+	return recent, err
+}
+
+func (u *usageCollector) retention() time.Duration {
+	if u.settings == nil {
+		return 0
+	}
+	s := u.settings.Value(ct.SettingGCRetention)
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("Error parsing %s setting: %s", ct.SettingGCRetention, err)
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+)
+
+func (s *S) TestAppUsage(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-usage"})
+	hostID := random.UUID()
+	jobMeta := map[string]string{"flynn-controller.app": app.ID}
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID, Jobs: []*host.Job{
+		{ID: "job0", Metadata: jobMeta, Resources: host.JobResources{Memory: 512 * 1024}},
+		{ID: "job1", Metadata: jobMeta, Resources: host.JobResources{Memory: 512 * 1024}},
+	}}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+
+	rtr := s.hc.sc.(*fakeRouter)
+	setRequests := func(instanceID string, n uint64) {
+		rtr.mtx.Lock()
+		rtr.stats = []*router.HTTPRouteStats{{RouteID: "http/app-usage", ParentRef: routeParentRef(app.ID), Requests: n, InstanceID: instanceID}}
+		rtr.mtx.Unlock()
+	}
+	collector := &usageCollector{
+		db:       s.hc.db,
+		cc:       s.cc,
+		interval: time.Hour,
+		routers: func() (map[string]routerc.Client, error) {
+			return map[string]routerc.Client{"router0": rtr}, nil
+		},
+	}
+	collect := func() {
+		c.Assert(collector.Collect(), IsNil)
+		// make the sample old enough for the next one to be collected
+		c.Assert(s.hc.db.Exec("UPDATE app_usage SET collected_at = collected_at - interval '1 hour'"), IsNil)
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	setRequests("a", 10)
+	collect()
+	setRequests("a", 25)
+	collect()
+	// a router restart resets its counts, which may have already passed
+	// the previous count
+	setRequests("b", 30)
+	collect()
+
+	usage, err := s.c.AppUsage(app.ID, since, time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(usage.AppID, Equals, app.ID)
+	c.Assert(usage.MaxJobs, Equals, 2)
+	c.Assert(usage.JobHours, Equals, float64(6))
+	c.Assert(usage.MemoryMBHours, Equals, float64(3*1024))
+	c.Assert(usage.Requests, Equals, int64(55))
+
+	// usage outside the window is excluded
+	usage, err = s.c.AppUsage(app.ID, time.Now().Add(-time.Minute), time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(usage.MaxJobs, Equals, 0)
+
+	// counts of routes which are no longer reported are deleted
+	rtr.mtx.Lock()
+	rtr.stats = []*router.HTTPRouteStats{}
+	rtr.mtx.Unlock()
+	collect()
+	var counts int
+	c.Assert(s.hc.db.QueryRow("SELECT count(*) FROM router_request_counts WHERE router_addr = 'router0'").Scan(&counts), IsNil)
+	c.Assert(counts, Equals, 0)
+}
@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"net/url"
+	"strings"
+
+	"github.com/flynn/flynn/controller/secrets"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
@@ -29,13 +33,16 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 			"flynn-controller.type":     name,
 		},
 		Artifact: host.Artifact{
-			Type: f.Artifact.Type,
-			URI:  f.Artifact.URI,
+			Type:   f.Artifact.Type,
+			URI:    f.Artifact.URI,
+			Digest: f.Artifact.Digest,
 		},
 		Config: host.ContainerConfig{
 			Cmd:         t.Cmd,
 			Env:         env,
 			HostNetwork: t.HostNetwork,
+			Liveness:    t.Liveness,
+			KillTimeout: t.KillTimeout,
 		},
 	}
 	if len(t.Entrypoint) > 0 {
@@ -43,12 +50,51 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 	}
 	job.Config.Ports = make([]host.Port, len(t.Ports))
 	for i, p := range t.Ports {
+		job.Config.Ports[i].Name = p.Name
 		job.Config.Ports[i].Proto = p.Proto
 		job.Config.Ports[i].Port = p.Port
 		job.Config.Ports[i].Service = p.Service
 	}
+	job.Resources = host.JobResources{
+		Memory:           int(t.Memory / 1024),
+		CPUShares:        t.CPUShares,
+		IngressBandwidth: kibibytes(t.IngressBandwidth),
+		EgressBandwidth:  kibibytes(t.EgressBandwidth),
+	}
 	if t.Data {
 		job.Config.Mounts = []host.Mount{{Location: "/data", Writeable: true}}
 	}
 	return job
 }
+
+// kibibytes rounds n bytes up to KiB, so that small limits aren't dropped.
+func kibibytes(n int64) int64 {
+	return (n + 1023) / 1024
+}
+
+// RegistryHost returns the registry host of a Docker image URI, or an empty
+// string if it doesn't have one.
+func RegistryHost(uri string) string {
+	if !strings.Contains(uri, "://") {
+		uri = "https://" + uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// OpenCredentials returns the registry credentials c of the image uri with the
+// password opened, to be passed to the host in the artifact of a job. It
+// returns nil if c is nil.
+func OpenCredentials(k *secrets.Key, uri string, c *ct.RegistryCredentials) (*host.RegistryCredentials, error) {
+	if c == nil {
+		return nil, nil
+	}
+	password, err := secrets.OpenValue(k, secrets.RegistryContext(RegistryHost(uri)), c.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &host.RegistryCredentials{Username: c.Username, Password: password}, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/version"
+)
+
+func serveVersion(w http.ResponseWriter) {
+	httphelper.JSON(w, 200, &ct.Version{
+		Version:       version.String(),
+		Commit:        version.Commit(),
+		APIVersion:    ct.APIVersion,
+		MinAPIVersion: ct.MinAPIVersion,
+	})
+}
+
+// apiVersionHandler negotiates the API version of the request from the
+// Flynn-API-Version header. Requests for a newer version than the controller
+// supports are served with the current version, which is set in the response
+// header so clients can detect it, and requests without the header use the
+// current version.
+func apiVersionHandler(main http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		v := ct.APIVersion
+		if s := req.Header.Get(ct.APIVersionHeader); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < ct.MinAPIVersion {
+				respondWithError(w, httphelper.JSONError{
+					Code:    httphelper.PreconditionFailedError,
+					Message: fmt.Sprintf("unsupported API version %q, versions %d to %d are supported", s, ct.MinAPIVersion, ct.APIVersion),
+				})
+				return
+			}
+			if n < v {
+				v = n
+			}
+		}
+		w.Header().Set(ct.APIVersionHeader, strconv.Itoa(v))
+		main.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+type VolumeRepo struct {
+	db *postgres.DB
+}
+
+func NewVolumeRepo(db *postgres.DB) *VolumeRepo {
+	return &VolumeRepo{db}
+}
+
+const volumeColumns = "volume_id, app_id, host_id, process_type, path, created_at"
+
+func (r *VolumeRepo) Add(vol *ct.Volume) error {
+	err := r.db.QueryRow("INSERT INTO volumes (volume_id, app_id, host_id, process_type, path) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		vol.ID, vol.AppID, vol.HostID, vol.Type, vol.Path).Scan(&vol.CreatedAt)
+	vol.ID = postgres.CleanUUID(vol.ID)
+	return err
+}
+
+func scanVolume(s postgres.Scanner) (*ct.Volume, error) {
+	vol := &ct.Volume{}
+	err := s.Scan(&vol.ID, &vol.AppID, &vol.HostID, &vol.Type, &vol.Path, &vol.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	vol.ID = postgres.CleanUUID(vol.ID)
+	vol.AppID = postgres.CleanUUID(vol.AppID)
+	return vol, err
+}
+
+func (r *VolumeRepo) Get(appID, id string) (*ct.Volume, error) {
+	row := r.db.QueryRow("SELECT "+volumeColumns+" FROM volumes WHERE app_id = $1 AND volume_id = $2 AND deleted_at IS NULL", appID, id)
+	return scanVolume(row)
+}
+
+func (r *VolumeRepo) Remove(id string) error {
+	return r.db.Exec("UPDATE volumes SET deleted_at = now() WHERE volume_id = $1 AND deleted_at IS NULL", id)
+}
+
+// Restore undoes Remove.
+func (r *VolumeRepo) Restore(id string) error {
+	return r.db.Exec("UPDATE volumes SET deleted_at = NULL WHERE volume_id = $1", id)
+}
+
+// AppList returns the volumes of the app, oldest first.
+func (r *VolumeRepo) AppList(appID string) ([]*ct.Volume, error) {
+	rows, err := r.db.Query("SELECT "+volumeColumns+" FROM volumes WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at", appID)
+	if err != nil {
+		return nil, err
+	}
+	volumes := []*ct.Volume{}
+	for rows.Next() {
+		vol, err := scanVolume(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		volumes = append(volumes, vol)
+	}
+	return volumes, rows.Err()
+}
+
+// volumeInUse reports whether a job in the cluster has the volume mounted.
+func (c *controllerAPI) volumeInUse(id string) (bool, error) {
+	hosts, err := c.clusterClient.ListHosts()
+	if err != nil {
+		return false, err
+	}
+	for _, h := range hosts {
+		for _, job := range h.Jobs {
+			for _, v := range job.Config.Volumes {
+				if v.VolumeID == id {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// CreateVolume provisions a volume on a host for a process type of the app,
+// it is used by the scheduler when there is no free volume for a new job.
+func (c *controllerAPI) CreateVolume(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var vol ct.Volume
+	if err := httphelper.DecodeJSON(req, &vol); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	vol.AppID = c.getApp(ctx).ID
+	switch {
+	case vol.HostID == "":
+		respondWithError(w, ct.ValidationError{Field: "host_id", Message: "must be set"})
+		return
+	case vol.Type == "":
+		respondWithError(w, ct.ValidationError{Field: "type", Message: "must be set"})
+		return
+	case vol.Path == "":
+		respondWithError(w, ct.ValidationError{Field: "path", Message: "must be set"})
+		return
+	}
+
+	client, err := c.clusterClient.DialHost(vol.HostID)
+	if err != nil {
+		respondWithError(w, ct.ValidationError{Field: "host_id", Message: "is not a host in the cluster"})
+		return
+	}
+	info, err := client.CreateVolume("default")
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	vol.ID = info.ID
+	if err := c.volumeRepo.Add(&vol); err != nil {
+		client.DestroyVolume(info.ID)
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &vol)
+}
+
+func (c *controllerAPI) ListVolumes(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	volumes, err := c.volumeRepo.AppList(c.getApp(ctx).ID)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, volumes)
+}
+
+func (c *controllerAPI) getVolume(ctx context.Context) (*ct.Volume, error) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+	id := params.ByName("volume_id")
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	return c.volumeRepo.Get(c.getApp(ctx).ID, id)
+}
+
+func (c *controllerAPI) GetVolume(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	vol, err := c.getVolume(ctx)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, vol)
+}
+
+// DeleteVolume destroys a volume and its data, which must not be mounted into
+// a running job. A volume which its host no longer has, or whose host has left
+// the cluster, is just forgotten.
+//
+// The volume is removed before checking whether it is in use, so that the
+// scheduler, which only mounts listed volumes, can't start a job with it
+// between the check and the volume being destroyed.
+func (c *controllerAPI) DeleteVolume(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	vol, err := c.getVolume(ctx)
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if err := c.volumeRepo.Remove(vol.ID); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	restore := func(err error) {
+		if rerr := c.volumeRepo.Restore(vol.ID); rerr != nil {
+			err = rerr
+		}
+		respondWithError(w, err)
+	}
+	inUse, err := c.volumeInUse(vol.ID)
+	if err != nil {
+		restore(err)
+		return
+	}
+	if inUse {
+		restore(ct.ValidationError{Field: "volume", Message: "is mounted into a running job"})
+		return
+	}
+	if client, err := c.clusterClient.DialHost(vol.HostID); err == nil {
+		if err := client.DestroyVolume(vol.ID); err != nil && err != cluster.ErrNotFound {
+			restore(err)
+			return
+		}
+	}
+	w.WriteHeader(200)
+}
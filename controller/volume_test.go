@@ -0,0 +1,48 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/controller/client"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestVolumes(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "volumes"})
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+
+	// volumes can only be created on hosts in the cluster
+	c.Assert(s.c.CreateVolume(app.ID, &ct.Volume{HostID: "unknown", Type: "db", Path: "/data"}), NotNil)
+
+	vol := &ct.Volume{HostID: hostID, Type: "db", Path: "/data"}
+	c.Assert(s.c.CreateVolume(app.ID, vol), IsNil)
+	c.Assert(vol.ID, Not(Equals), "")
+	c.Assert(vol.AppID, Equals, app.ID)
+	c.Assert(hc.HasVolume(vol.ID), Equals, true)
+
+	list, err := s.c.VolumeList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, vol.ID)
+	got, err := s.c.GetVolume(app.ID, vol.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Path, Equals, "/data")
+
+	// mounted volumes can't be deleted
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID, Jobs: []*host.Job{{
+		ID:     random.UUID(),
+		Config: host.ContainerConfig{Volumes: []host.VolumeBinding{{Target: "/data", VolumeID: vol.ID}}},
+	}}}})
+	defer s.cc.SetHosts(map[string]host.Host{})
+	c.Assert(s.c.DeleteVolume(app.ID, vol.ID), NotNil)
+
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID}})
+	c.Assert(s.c.DeleteVolume(app.ID, vol.ID), IsNil)
+	c.Assert(hc.HasVolume(vol.ID), Equals, false)
+	_, err = s.c.GetVolume(app.ID, vol.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os/exec"
 	"time"
 )
 
@@ -18,6 +19,7 @@ type Check interface {
 
 var _ Check = &TCPCheck{}
 var _ Check = &HTTPCheck{}
+var _ Check = &ExecCheck{}
 
 type TCPCheck struct {
 	Addr    string
@@ -105,3 +107,33 @@ func (c *HTTPCheck) Check() error {
 	}
 	return nil
 }
+
+// ExecCheck runs a command, passing if it exits zero before the timeout.
+type ExecCheck struct {
+	Cmd     []string
+	Timeout time.Duration
+}
+
+func (c *ExecCheck) Check() error {
+	if len(c.Cmd) == 0 {
+		return fmt.Errorf("healthcheck: no command to run")
+	}
+	cmd := exec.Command(c.Cmd[0], c.Cmd[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("healthcheck: command timed out after %s", timeout)
+	}
+}
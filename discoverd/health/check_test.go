@@ -145,3 +145,12 @@ func (CheckSuite) TestHTTPInvalidURL(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), "invalid URL escape"), Equals, true, Commentf("err = %s", err))
 }
+
+func (CheckSuite) TestExec(c *C) {
+	c.Assert((&ExecCheck{Cmd: []string{"true"}}).Check(), IsNil)
+	c.Assert((&ExecCheck{Cmd: []string{"false"}}).Check(), NotNil)
+
+	err := (&ExecCheck{Cmd: []string{"sleep", "1"}, Timeout: 10 * time.Millisecond}).Check()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "timed out"), Equals, true, Commentf("err = %s", err))
+}
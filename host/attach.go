@@ -77,8 +77,12 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 		Stream:   req.Flags&host.AttachFlagStream != 0,
 		Height:   req.Height,
 		Width:    req.Width,
+		Lines:    req.Lines,
 		Attached: attached,
 	}
+	if req.Since != nil {
+		opts.Since = *req.Since
+	}
 	var stdinW *io.PipeWriter
 	if req.Flags&host.AttachFlagStdin != 0 {
 		opts.Stdin, stdinW = io.Pipe()
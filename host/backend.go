@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"time"
 
 	"github.com/flynn/flynn/host/types"
 )
@@ -12,6 +13,8 @@ type AttachRequest struct {
 	Stream bool
 	Height uint16
 	Width  uint16
+	Lines  int
+	Since  time.Time
 
 	Attached chan struct{}
 
@@ -22,13 +25,14 @@ type AttachRequest struct {
 
 type Backend interface {
 	Run(*host.Job) error
-	Stop(string) error
+	Stop(string, *host.StopOptions) error
 	Signal(string, int) error
 	ResizeTTY(id string, height, width uint16) error
 	Attach(*AttachRequest) error
 	Cleanup() error
 	UnmarshalState(map[string]*host.ActiveJob, map[string][]byte, []byte) error
 	ConfigureNetworking(strategy NetworkStrategy, job string) (*NetworkInfo, error)
+	JobMetrics(id string) (*host.ResourceUsage, error)
 }
 
 type NetworkInfo struct {
@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+func init() {
+	Register("drain", runDrain, `
+usage: flynn-host drain [-t <timeout>] ID
+       flynn-host drain --undo ID
+
+Drain a host before it is upgraded or retired.
+
+The host is marked as unschedulable so that the scheduler places no new jobs
+on it, then its controller jobs are stopped one at a time. Before each job is
+stopped it is drained from every router and its in-flight requests are given
+up to the timeout to finish. Once it is stopped the scheduler starts a
+replacement on another host, which must be running before the next job is
+stopped. Jobs which run on every host are restarted in place.
+
+Options:
+  -t, --timeout=<timeout>  time to wait for in-flight requests to each job [default: 30s]
+  --undo                   mark the host as schedulable again`)
+}
+
+// replaceTimeout is how long to wait for the replacement of a stopped job to
+// start running.
+var replaceTimeout = 5 * time.Minute
+
+func runDrain(args *docopt.Args, client *cluster.Client) error {
+	hostID := args.String["ID"]
+	if args.Bool["--undo"] {
+		if err := client.SetHostUnschedulable(hostID, false); err != nil {
+			return fmt.Errorf("could not mark host %s as schedulable: %s", hostID, err)
+		}
+		fmt.Println(hostID, "marked as schedulable")
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(args.String["--timeout"])
+	if err != nil {
+		return fmt.Errorf("invalid timeout: %s", err)
+	}
+
+	if err := client.SetHostUnschedulable(hostID, true); err != nil {
+		return fmt.Errorf("could not mark host %s as unschedulable: %s", hostID, err)
+	}
+	fmt.Println(hostID, "marked as unschedulable")
+
+	h, err := client.DialHost(hostID)
+	if err != nil {
+		return fmt.Errorf("could not connect to host %s: %s", hostID, err)
+	}
+	activeJobs, err := h.ListJobs()
+	if err != nil {
+		return fmt.Errorf("could not get jobs for host %s: %s", hostID, err)
+	}
+	jobs := make(sortJobs, 0, len(activeJobs))
+	for _, job := range activeJobs {
+		if job.Status == host.StatusStarting || job.Status == host.StatusRunning {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Sort(jobs)
+
+	var routers []routerc.Client
+	if addrs, err := discoverd.NewService("router-api").Addrs(); err == nil {
+		for _, addr := range addrs {
+			routers = append(routers, routerc.NewWithAddr(addr))
+		}
+	} else {
+		fmt.Printf("could not get router addresses, jobs will not be drained from routers: %s\n", err)
+	}
+
+	success := true
+	for _, job := range jobs {
+		if job.Job.Metadata["flynn-controller.type"] == "" {
+			fmt.Println(job.Job.ID, "skipped, it is not restarted by the scheduler")
+			continue
+		}
+		if err := migrateJob(client, h, job.Job, routers, timeout); err != nil {
+			fmt.Printf("could not migrate job %s: %s\n", job.Job.ID, err)
+			success = false
+			continue
+		}
+	}
+	if !success {
+		return errors.New("could not migrate all jobs")
+	}
+	fmt.Println(hostID, "drained")
+	return nil
+}
+
+// migrateJob drains job from the routers, stops it and waits for the
+// scheduler to start its replacement.
+func migrateJob(client *cluster.Client, h cluster.Host, job *host.Job, routers []routerc.Client, timeout time.Duration) error {
+	existing, err := controllerJobs(client, job)
+	if err != nil {
+		return err
+	}
+
+	addrs := jobAddrs(job)
+	inFlight := routerc.DrainBackends(routers, addrs, timeout, func(addr string, err error) {
+		fmt.Printf("could not drain %s from router: %s\n", addr, err)
+	})
+	defer routerc.UndrainBackends(routers, addrs, nil)
+	if inFlight > 0 {
+		fmt.Printf("timed out with %d requests in flight to %v\n", inFlight, addrs)
+	}
+
+	if err := h.StopJob(job.ID); err != nil {
+		return err
+	}
+	fmt.Println(job.ID, "stopped")
+
+	id, err := waitForReplacement(client, job, existing)
+	if err != nil {
+		return err
+	}
+	fmt.Println(job.ID, "replaced by", id)
+	return nil
+}
+
+// jobAddrs returns the addresses job is registered at in its services.
+func jobAddrs(job *host.Job) []string {
+	var addrs []string
+	for _, port := range job.Config.Ports {
+		if port.Service == nil {
+			continue
+		}
+		instances, err := discoverd.NewService(port.Service.Name).Instances()
+		if err != nil {
+			continue
+		}
+		for _, inst := range instances {
+			if inst.Meta["FLYNN_JOB_ID"] == job.ID {
+				addrs = append(addrs, inst.Addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// controllerJobs returns the cluster IDs of the jobs in the cluster which have
+// the same app, release and process type as job.
+func controllerJobs(client *cluster.Client, job *host.Job) (map[string]struct{}, error) {
+	hosts, err := client.ListHosts()
+	if err != nil {
+		return nil, fmt.Errorf("could not list hosts: %s", err)
+	}
+	jobs := make(map[string]struct{})
+	for _, h := range hosts {
+		for _, j := range h.Jobs {
+			if sameProcess(j, job) {
+				jobs[h.ID+"-"+j.ID] = struct{}{}
+			}
+		}
+	}
+	return jobs, nil
+}
+
+func sameProcess(a, b *host.Job) bool {
+	for _, key := range []string{"flynn-controller.app", "flynn-controller.release", "flynn-controller.type"} {
+		if a.Metadata[key] != b.Metadata[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForReplacement waits for a job of the same process as job which is not
+// in existing to start running, and returns its cluster ID.
+func waitForReplacement(client *cluster.Client, job *host.Job, existing map[string]struct{}) (string, error) {
+	deadline := time.Now().Add(replaceTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		jobs, err := controllerJobs(client, job)
+		if err != nil {
+			continue
+		}
+		for id := range jobs {
+			if _, ok := existing[id]; ok {
+				continue
+			}
+			hostID, jobID, err := cluster.ParseJobID(id)
+			if err != nil {
+				continue
+			}
+			h, err := client.DialHost(hostID)
+			if err != nil {
+				continue
+			}
+			if j, err := h.GetJob(jobID); err == nil && j.Status == host.StatusRunning {
+				return id, nil
+			}
+		}
+	}
+	return "", errors.New("timed out waiting for a replacement job")
+}
@@ -28,6 +28,7 @@ options:
   --join              join an existing cluster
   --external=IP       external IP address of host, defaults to the first IPv4 address of eth0
   --no-consensus      don't participate in cluster consensus
+  --auth-key=KEY      key which clients must give to use the host API, the same on all hosts
   --file=NAME         file to write to [default: /etc/flynn/host.json]
   `)
 }
@@ -128,6 +129,9 @@ func runInit(args *docopt.Args) error {
 	} else {
 		c.Env["ETCD_DISCOVERY"] = discoveryToken
 	}
+	if key := args.String["--auth-key"]; key != "" {
+		c.Env["CLUSTER_AUTH_KEY"] = key
+	}
 	if args.Bool["--no-consensus"] {
 		c.Env["ETCD_PROXY"] = "on"
 	} else if args.Bool["--join"] {
@@ -55,5 +55,7 @@ func (c *Config) WriteTo(name string) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(name, append(data, '\n'), 0644)
+	// the file is only readable by its owner as the env may contain the
+	// cluster auth key
+	return ioutil.WriteFile(name, append(data, '\n'), 0600)
 }
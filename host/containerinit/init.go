@@ -25,6 +25,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -52,6 +53,7 @@ type Config struct {
 	Env       map[string]string
 	Args      []string
 	Ports     []host.Port
+	Liveness  *host.LivenessCheck
 }
 
 const SharedPath = "/.container-shared"
@@ -97,6 +99,9 @@ type StateChange struct {
 	State      State
 	Error      string
 	ExitStatus int
+	// HealthCheckError is set when the liveness check has failed, just
+	// before the job is killed.
+	HealthCheckError string
 }
 
 func (c *Client) StreamState() <-chan *StateChange {
@@ -289,6 +294,17 @@ func (c *ContainerInit) changeState(state State, err string, exitStatus int) {
 	}
 }
 
+// healthCheckFailed tells the streams that the liveness check failed with err,
+// and kills the process so that it is restarted. Caller must hold lock.
+func (c *ContainerInit) healthCheckFailed(err string) {
+	c.streamsMtx.RLock()
+	for ch := range c.streams {
+		ch <- StateChange{State: c.state, ExitStatus: c.exitStatus, HealthCheckError: err}
+	}
+	c.streamsMtx.RUnlock()
+	c.process.Signal(syscall.SIGKILL)
+}
+
 func (c *ContainerInit) exit(status int) {
 	// Wait for the client to call Resume() again. This gives the client a
 	// chance to get the exit code from the RPC socket call interface
@@ -351,21 +367,26 @@ func setupNetworking(c *Config) error {
 	return nil
 }
 
+// getCredential looks up c.User, which is either a user name or a UID, in the
+// container's /etc/passwd. Like Docker, UIDs which are not in it are used with
+// the root group.
 func getCredential(c *Config) (*syscall.Credential, error) {
 	if c.User == "" {
 		return nil, nil
 	}
 	users, err := user.ParsePasswdFileFilter("/etc/passwd", func(u user.User) bool {
-		return u.Name == c.User
+		return u.Name == c.User || strconv.Itoa(u.Uid) == c.User
 	})
-	if err != nil || len(users) == 0 {
-		if err == nil {
-			err = errors.New("unknown user")
-		}
-		return nil, fmt.Errorf("Unable to find user %v: %v", c.User, err)
+	if err == nil && len(users) > 0 {
+		return &syscall.Credential{Uid: uint32(users[0].Uid), Gid: uint32(users[0].Gid)}, nil
 	}
-
-	return &syscall.Credential{Uid: uint32(users[0].Uid), Gid: uint32(users[0].Gid)}, nil
+	if uid, err := strconv.ParseUint(c.User, 10, 32); err == nil {
+		return &syscall.Credential{Uid: uint32(uid)}, nil
+	}
+	if err == nil {
+		err = errors.New("unknown user")
+	}
+	return nil, fmt.Errorf("Unable to find user %v: %v", c.User, err)
 }
 
 func setupCommon(c *Config) error {
@@ -416,6 +437,9 @@ func monitor(port host.Port, container *ContainerInit, env map[string]string) (d
 		Addr:  fmt.Sprintf("%s:%v", env["EXTERNAL_IP"], port.Port),
 		Proto: port.Proto,
 	}
+	if port.Name != "" {
+		inst.Meta = map[string]string{"FLYNN_PORT_NAME": port.Name}
+	}
 	// add discoverd.EnvInstanceMeta if present
 	for k, v := range env {
 		if _, ok := discoverd.EnvInstanceMeta[k]; !ok {
@@ -498,6 +522,68 @@ func monitor(port host.Port, container *ContainerInit, env map[string]string) (d
 	return reg.Register(), nil
 }
 
+// checkLiveness runs the liveness check until it fails config.Threshold times
+// in a row, then reports the failure and kills the process. It returns early
+// once done is closed.
+func checkLiveness(config *host.LivenessCheck, ports []host.Port, container *ContainerInit, done <-chan struct{}) {
+	port := config.Port
+	if port == 0 && len(ports) > 0 {
+		port = ports[0].Port
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var check health.Check
+	switch config.Type {
+	case "tcp":
+		check = &health.TCPCheck{Addr: addr, Timeout: config.Timeout}
+	case "http":
+		check = &health.HTTPCheck{URL: "http://" + addr + config.Path, Timeout: config.Timeout}
+	case "exec":
+		check = &health.ExecCheck{Cmd: config.Cmd, Timeout: config.Timeout}
+	default:
+		log.Printf("Unsupported liveness check type: %s", config.Type)
+		return
+	}
+
+	interval := config.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	threshold := config.Threshold
+	if threshold == 0 {
+		threshold = 3
+	}
+	startTimeout := config.StartTimeout
+	if startTimeout == 0 {
+		startTimeout = 30 * time.Second
+	}
+
+	select {
+	case <-time.After(startTimeout):
+	case <-done:
+		return
+	}
+	failures := 0
+	for {
+		if err := check.Check(); err != nil {
+			failures++
+			log.Printf("Liveness check failed (%d/%d): %s", failures, threshold, err)
+			if failures >= threshold {
+				container.mtx.Lock()
+				container.healthCheckFailed(err.Error())
+				container.mtx.Unlock()
+				return
+			}
+		} else {
+			failures = 0
+		}
+		select {
+		case <-time.After(interval):
+		case <-done:
+			return
+		}
+	}
+}
+
 func babySit(process *os.Process) int {
 	// Forward all signals to the app
 	sigchan := make(chan os.Signal, 1)
@@ -629,7 +715,12 @@ func containerInitApp(c *Config) error {
 		}
 		hbs = append(hbs, hb)
 	}
+	exited := make(chan struct{})
+	if c.Liveness != nil {
+		go checkLiveness(c.Liveness, c.Ports, init, exited)
+	}
 	exitCode := babySit(init.process)
+	close(exited)
 	init.mtx.Lock()
 	for _, hb := range hbs {
 		hb.Close()
@@ -50,6 +50,8 @@ options:
   --meta=<KEY=VAL>...    key=value pair to add as metadata
   --bind=IP              bind containers to IP
   --flynn-init=PATH      path to flynn-init binary [default: /usr/local/bin/flynn-init]
+  --port-range=RANGE     range of host ports allocated to jobs using the host network [default: 5000-5999]
+  --reserve-ports=PORTS  comma separated ports and port ranges which are never allocated to jobs
 	`)
 }
 
@@ -72,6 +74,7 @@ Commands:
   log                        Get the logs of a job
   ps                         List jobs
   stop                       Stop running jobs
+  drain                      Move jobs off a host before it is upgraded or retired
   upload-debug-info          Upload debug information to an anonymous gist
 
 See 'flynn-host help <command>' for more information on a specific command.
@@ -113,7 +116,13 @@ See 'flynn-host help <command>' for more information on a specific command.
 		for k, v := range c.Env {
 			os.Setenv(k, v)
 		}
+	} else if os.Getenv("CLUSTER_AUTH_KEY") == "" {
+		// other commands authenticate with the key of the daemon
+		if c, err := config.Open(configFile); err == nil && c.Env["CLUSTER_AUTH_KEY"] != "" {
+			os.Setenv("CLUSTER_AUTH_KEY", c.Env["CLUSTER_AUTH_KEY"])
+		}
 	}
+	cluster.AuthKey = os.Getenv("CLUSTER_AUTH_KEY")
 
 	if err := cli.Run(cmd, cmdArgs); err != nil {
 		shutdown.Fatal(err)
@@ -132,6 +141,19 @@ func runDaemon(args *docopt.Args) {
 	backendName := args.String["--backend"]
 	flynnInit := args.String["--flynn-init"]
 	metadata := args.All["--meta"].([]string)
+	portStart, portEnd, err := parsePortRange(args.String["--port-range"])
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	reservedPorts, err := parsePorts(args.String["--reserve-ports"])
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+
+	// the auth key is removed from the environment so that it isn't
+	// passed to the jobs in the manifest
+	authKey := os.Getenv("CLUSTER_AUTH_KEY")
+	os.Unsetenv("CLUSTER_AUTH_KEY")
 
 	grohl.AddContext("app", "host")
 	grohl.Log(grohl.Data{"at": "start"})
@@ -152,8 +174,8 @@ func runDaemon(args *docopt.Args) {
 	}
 
 	state := NewState(hostID, stateFile)
+	ports := newPortAllocator(portStart, portEnd, reservedPorts)
 	var backend Backend
-	var err error
 
 	// create volume manager
 	vman, err := volumemanager.New(func() (volume.Provider, error) {
@@ -171,7 +193,7 @@ func runDaemon(args *docopt.Args) {
 
 	switch backendName {
 	case "libvirt-lxc":
-		backend, err = NewLibvirtLXCBackend(state, vman, volPath, "/tmp/flynn-host-logs", flynnInit)
+		backend, err = NewLibvirtLXCBackend(state, vman, ports, volPath, "/tmp/flynn-host-logs", flynnInit)
 	default:
 		log.Fatalf("unknown backend %q", backendName)
 	}
@@ -179,7 +201,7 @@ func runDaemon(args *docopt.Args) {
 		shutdown.Fatal(err)
 	}
 
-	router, err := serveHTTP(&Host{state: state, backend: backend}, &attachHandler{state: state, backend: backend}, vman)
+	router, err := serveHTTP(&Host{state: state, backend: backend, ports: ports}, &attachHandler{state: state, backend: backend}, vman, authKey)
 	if err != nil {
 		shutdown.Fatal(err)
 	}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
@@ -22,29 +24,91 @@ import (
 type Host struct {
 	state   *State
 	backend Backend
+	ports   *portAllocator
 }
 
-func (h *Host) StopJob(id string) error {
+// StopJob stops the job, jobs which are still starting are stopped with opts
+// once they are running. It returns once the job has been signalled, without
+// waiting for the grace period or for the job to exit.
+func (h *Host) StopJob(id string, opts *host.StopOptions) error {
 	job := h.state.GetJob(id)
 	if job == nil {
 		return errors.New("host: unknown job")
 	}
 	switch job.Status {
 	case host.StatusStarting:
-		h.state.SetForceStop(id)
+		h.state.SetForceStop(id, opts)
 		return nil
 	case host.StatusRunning:
-		return h.backend.Stop(id)
+		return h.backend.Stop(id, opts)
 	default:
 		return errors.New("host: job is already stopped")
 	}
 }
 
-func (h *Host) streamEvents(id string, w http.ResponseWriter) error {
+// streamEvents streams the events of the job with the given id, or of all jobs
+// if id is "all". If the since parameter or the Last-Event-Id header is set,
+// the buffered events after that ID are sent first so that a client can resume
+// the stream after reconnecting. If events after that ID are no longer
+// buffered a precondition failed error is returned, so the client knows to
+// resync the state of the host's jobs.
+func (h *Host) streamEvents(id string, w http.ResponseWriter, r *http.Request) error {
+	var since int64
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return httphelper.JSONError{Code: httphelper.ValidationError, Message: "since must be an integer"}
+		}
+	} else if s := r.Header.Get("Last-Event-Id"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return httphelper.JSONError{Code: httphelper.ValidationError, Message: "Last-Event-Id must be an integer"}
+		}
+	}
+
 	ch := h.state.AddListener(id)
 	defer h.state.RemoveListener(id, ch)
-	sse.ServeStream(w, ch, nil)
-	return nil
+	if since == 0 {
+		sse.ServeStream(w, ch, nil)
+		return nil
+	}
+
+	// the listener is added before reading the buffered events so that
+	// none are missed, events which are both buffered and sent to the
+	// listener are skipped
+	events, err := h.state.EventsSince(id, since)
+	if err == ErrEventsMissed {
+		return httphelper.JSONError{Code: httphelper.PreconditionFailedError, Message: err.Error()}
+	} else if err != nil {
+		return err
+	}
+	out := make(chan host.Event)
+	stream := sse.NewStream(w, out, nil)
+	stream.Serve()
+	var last int64
+	for _, e := range events {
+		select {
+		case out <- e:
+			last = e.ID
+		case <-stream.Done:
+			return nil
+		}
+	}
+	for {
+		select {
+		case e := <-ch:
+			if e.ID <= last {
+				continue
+			}
+			select {
+			case out <- e:
+			case <-stream.Done:
+				return nil
+			}
+		case <-stream.Done:
+			return nil
+		}
+	}
 }
 
 type jobAPI struct {
@@ -53,7 +117,7 @@ type jobAPI struct {
 
 func (h *jobAPI) ListJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		if err := h.host.streamEvents("all", w); err != nil {
+		if err := h.host.streamEvents("all", w, r); err != nil {
 			httphelper.Error(w, err)
 		}
 		return
@@ -67,7 +131,7 @@ func (h *jobAPI) GetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 	id := ps.ByName("id")
 
 	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		if err := h.host.streamEvents(id, w); err != nil {
+		if err := h.host.streamEvents(id, w, r); err != nil {
 			httphelper.Error(w, err)
 		}
 		return
@@ -78,11 +142,17 @@ func (h *jobAPI) GetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 
 func (h *jobAPI) StopJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	id := ps.ByName("id")
-	if err := h.host.StopJob(id); err != nil {
+	opts, err := host.StopOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		httphelper.Error(w, httphelper.JSONError{Code: httphelper.ValidationError, Message: err.Error()})
+		return
+	}
+	if err := h.host.StopJob(id, opts); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
-	w.WriteHeader(200)
+	// the job may not have exited yet, its stop event is sent once it has
+	w.WriteHeader(202)
 }
 
 func (h *jobAPI) PullImages(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -123,15 +193,32 @@ func extractTufDB(r *http.Request) (string, error) {
 	return tmp.Name(), nil
 }
 
+func (h *jobAPI) Metrics(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	metrics, err := h.host.Metrics()
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, metrics)
+}
+
+func (h *jobAPI) Ports(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	httphelper.JSON(w, 200, h.host.ports.Ports())
+}
+
 func (h *jobAPI) RegisterRoutes(r *httprouter.Router) error {
 	r.GET("/host/jobs", h.ListJobs)
 	r.GET("/host/jobs/:id", h.GetJob)
 	r.DELETE("/host/jobs/:id", h.StopJob)
 	r.POST("/host/pull-images", h.PullImages)
+	r.GET("/host/metrics", h.Metrics)
+	r.GET("/host/ports", h.Ports)
 	return nil
 }
 
-func serveHTTP(host *Host, attach *attachHandler, vman *volumemanager.Manager) (*httprouter.Router, error) {
+// serveHTTP serves the host API, requiring authKey as the password of Basic
+// auth unless it is empty.
+func serveHTTP(host *Host, attach *attachHandler, vman *volumemanager.Manager, authKey string) (*httprouter.Router, error) {
 	l, err := net.Listen("tcp", ":1113")
 	if err != nil {
 		return nil, err
@@ -146,7 +233,27 @@ func serveHTTP(host *Host, attach *attachHandler, vman *volumemanager.Manager) (
 	volAPI := volumeapi.NewHTTPAPI(vman)
 	volAPI.RegisterRoutes(r)
 
-	go http.Serve(l, httphelper.ContextInjector("host", httphelper.NewRequestLogger(r)))
+	var h http.Handler = r
+	if authKey != "" {
+		h = authHandler(h, authKey)
+	}
+	go http.Serve(l, httphelper.ContextInjector("host", httphelper.NewRequestLogger(h)))
 
 	return r, nil
 }
+
+// authHandler rejects requests which don't give key as the password of Basic
+// auth, so that containers on the network can't control the host.
+func authHandler(h http.Handler, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ := r.BasicAuth()
+		if len(password) != len(key) || subtle.ConstantTimeCompare([]byte(password), []byte(key)) != 1 {
+			httphelper.Error(w, httphelper.JSONError{
+				Code:    httphelper.UnauthorizedError,
+				Message: "invalid cluster auth key",
+			})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
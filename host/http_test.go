@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+func (S) TestAuthHandler(c *C) {
+	h := authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), "secret")
+	status := func(key string) int {
+		req, err := http.NewRequest("GET", "/host/jobs", nil)
+		c.Assert(err, IsNil)
+		if key != "" {
+			req.SetBasicAuth("", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	c.Assert(status("secret"), Equals, 200)
+	c.Assert(status(""), Equals, 401)
+	c.Assert(status("secre"), Equals, 401)
+	c.Assert(status("secreT"), Equals, 401)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pinkerton"
+	"github.com/flynn/flynn/pinkerton/store"
+)
+
+// imageGCInterval is how often the disk usage of the image filesystem is
+// checked.
+const imageGCInterval = time.Minute
+
+// Unused layers are removed once more than imageGCHighWatermark of the image
+// filesystem is used, until no more than imageGCLowWatermark is used.
+const (
+	imageGCHighWatermark = 0.85
+	imageGCLowWatermark  = 0.75
+)
+
+// imageGCKeepReleases is the number of the most recent releases of each app
+// whose images are kept, so that scaling up and rolling back doesn't need to
+// pull them again.
+const imageGCKeepReleases = 2
+
+func (l *LibvirtLXCBackend) setCheckout(jobID, imageID string) {
+	l.checkoutsMtx.Lock()
+	defer l.checkoutsMtx.Unlock()
+	if imageID == "" {
+		delete(l.checkouts, jobID)
+	} else {
+		l.checkouts[jobID] = imageID
+	}
+}
+
+// runImageGC removes unused layers when the image filesystem is running out of
+// space.
+func (l *LibvirtLXCBackend) runImageGC() {
+	g := grohl.NewContext(grohl.Data{"backend": "libvirt-lxc", "fn": "image_gc"})
+	for range time.Tick(imageGCInterval) {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(imageRoot, &fs); err != nil {
+			g.Log(grohl.Data{"at": "statfs", "status": "error", "err": err})
+			continue
+		}
+		total := float64(fs.Blocks * uint64(fs.Bsize))
+		used := float64((fs.Blocks - fs.Bfree) * uint64(fs.Bsize))
+		if used < imageGCHighWatermark*total {
+			continue
+		}
+		target := int64(used - imageGCLowWatermark*total)
+		g.Log(grohl.Data{"at": "start", "used": int64(used), "target": target})
+		removed, freed, err := l.collectImages(target)
+		if err != nil {
+			g.Log(grohl.Data{"at": "remove", "status": "error", "err": err})
+		}
+		g.Log(grohl.Data{"at": "finish", "removed": len(removed), "freed": freed})
+	}
+}
+
+// collectImages removes the least recently used layers which are not needed by
+// a job or a recent release until at least target bytes have been freed, and
+// returns the IDs of the removed layers.
+func (l *LibvirtLXCBackend) collectImages(target int64) ([]string, int64, error) {
+	l.imageMtx.Lock()
+	defer l.imageMtx.Unlock()
+
+	layers, err := l.pinkerton.Layers()
+	if err != nil {
+		return nil, 0, err
+	}
+	keep := recentReleaseImages(l.state.Get(), imageGCKeepReleases)
+	l.checkoutsMtx.Lock()
+	for _, id := range l.checkouts {
+		keep[id] = struct{}{}
+	}
+	l.checkoutsMtx.Unlock()
+
+	var removed []string
+	var freed int64
+	for _, layer := range evictionOrder(layers, keep) {
+		if freed >= target {
+			break
+		}
+		if err := l.pinkerton.Remove(layer.ID); err != nil {
+			return removed, freed, err
+		}
+		removed = append(removed, layer.ID)
+		freed += layer.Size
+	}
+	return removed, freed, nil
+}
+
+// recentReleaseImages returns the IDs of the images of the n releases of each
+// app which most recently had a job started on the host. Images are identified
+// by the id parameter of the artifact URI, jobs without one are skipped.
+func recentReleaseImages(jobs map[string]host.ActiveJob, n int) map[string]struct{} {
+	apps := make(map[string]map[string]*appRelease)
+	for _, job := range jobs {
+		appID := job.Job.Metadata["flynn-controller.app"]
+		releaseID := job.Job.Metadata["flynn-controller.release"]
+		if appID == "" || releaseID == "" {
+			continue
+		}
+		imageID, err := pinkerton.ImageID(job.Job.Artifact.URI)
+		if err != nil {
+			continue
+		}
+		if apps[appID] == nil {
+			apps[appID] = make(map[string]*appRelease)
+		}
+		r, ok := apps[appID][releaseID]
+		if !ok {
+			r = &appRelease{imageID: imageID}
+			apps[appID][releaseID] = r
+		}
+		if job.StartedAt.After(r.started) {
+			r.started = job.StartedAt
+		}
+	}
+
+	images := make(map[string]struct{})
+	for _, releases := range apps {
+		sorted := make(releasesByStarted, 0, len(releases))
+		for _, r := range releases {
+			sorted = append(sorted, r)
+		}
+		sort.Sort(sorted)
+		for i, r := range sorted {
+			if i == n {
+				break
+			}
+			images[r.imageID] = struct{}{}
+		}
+	}
+	return images
+}
+
+type appRelease struct {
+	imageID string
+	started time.Time
+}
+
+// releasesByStarted sorts releases with the most recently started first.
+type releasesByStarted []*appRelease
+
+func (s releasesByStarted) Len() int           { return len(s) }
+func (s releasesByStarted) Less(i, j int) bool { return s[i].started.After(s[j].started) }
+func (s releasesByStarted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// evictionOrder returns the layers which are not an image in keep or one of
+// their ancestors, least recently used first. Layers always come after their
+// children, so they can be removed in order.
+func evictionOrder(layers []*store.Layer, keep map[string]struct{}) []*store.Layer {
+	byID := make(map[string]*store.Layer, len(layers))
+	for _, l := range layers {
+		byID[l.ID] = l
+	}
+	kept := make(map[string]struct{})
+	for id := range keep {
+		for l, ok := byID[id]; ok; l, ok = byID[l.ParentID] {
+			if _, seen := kept[l.ID]; seen {
+				break
+			}
+			kept[l.ID] = struct{}{}
+		}
+	}
+
+	var candidates []*store.Layer
+	children := make(map[string]int)
+	for _, l := range layers {
+		if _, ok := kept[l.ID]; !ok {
+			candidates = append(candidates, l)
+		}
+		children[l.ParentID]++
+	}
+	sort.Sort(layersByLastUsed(candidates))
+
+	order := make([]*store.Layer, 0, len(candidates))
+	removed := make(map[string]struct{}, len(candidates))
+	for len(order) < len(candidates) {
+		next := -1
+		for i, l := range candidates {
+			if _, ok := removed[l.ID]; !ok && children[l.ID] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// the remaining layers have children which aren't known
+			// to the store
+			break
+		}
+		l := candidates[next]
+		order = append(order, l)
+		removed[l.ID] = struct{}{}
+		children[l.ParentID]--
+	}
+	return order
+}
+
+type layersByLastUsed []*store.Layer
+
+func (s layersByLastUsed) Len() int           { return len(s) }
+func (s layersByLastUsed) Less(i, j int) bool { return s[i].LastUsed.Before(s[j].LastUsed) }
+func (s layersByLastUsed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
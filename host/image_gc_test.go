@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pinkerton/store"
+)
+
+func (S) TestEvictionOrder(c *C) {
+	now := time.Now()
+	layer := func(id, parent string, age int) *store.Layer {
+		return &store.Layer{ID: id, ParentID: parent, LastUsed: now.Add(-time.Duration(age) * time.Hour)}
+	}
+	// base <- a1 <- a2 (kept)
+	// base <- b1 <- b2
+	// c1 <- c2
+	layers := []*store.Layer{
+		layer("base", "", 10),
+		layer("a1", "base", 9),
+		layer("a2", "a1", 1),
+		layer("b1", "base", 8),
+		layer("b2", "b1", 2),
+		layer("c1", "", 5),
+		layer("c2", "c1", 3),
+	}
+	order := evictionOrder(layers, map[string]struct{}{"a2": {}})
+	ids := make([]string, len(order))
+	for i, l := range order {
+		ids[i] = l.ID
+	}
+	// children are evicted before their parents, least recently used first
+	c.Assert(ids, DeepEquals, []string{"c2", "c1", "b2", "b1"})
+
+	c.Assert(evictionOrder(layers, map[string]struct{}{"a2": {}, "b2": {}, "c2": {}}), HasLen, 0)
+}
+
+func (S) TestRecentReleaseImages(c *C) {
+	now := time.Now()
+	job := func(app, release, image string, age int) host.ActiveJob {
+		return host.ActiveJob{
+			Job: &host.Job{
+				Metadata: map[string]string{"flynn-controller.app": app, "flynn-controller.release": release},
+				Artifact: host.Artifact{URI: "https://registry.hub.docker.com/flynn/app?id=" + image},
+			},
+			StartedAt: now.Add(-time.Duration(age) * time.Hour),
+		}
+	}
+	jobs := map[string]host.ActiveJob{
+		"1": job("app1", "r1", "img1", 30),
+		"2": job("app1", "r2", "img2", 20),
+		"3": job("app1", "r3", "img3", 10),
+		"4": job("app1", "r1", "img1", 15),
+		"5": job("app2", "r4", "img4", 40),
+		"6": {Job: &host.Job{Artifact: host.Artifact{URI: "https://registry.hub.docker.com/flynn/other?id=img5"}}},
+	}
+	c.Assert(recentReleaseImages(jobs, 2), DeepEquals, map[string]struct{}{
+		"img3": {},
+		"img1": {},
+		"img4": {},
+	})
+}
@@ -13,8 +13,9 @@ type Domain struct {
 	OS    OS     `xml:"os"`
 	IDMap *IDMap `xml:"idmap,omitempty"`
 
-	Memory UnitInt `xml:"memory"`
-	VCPU   int     `xml:"vcpu"`
+	Memory  UnitInt  `xml:"memory"`
+	VCPU    int      `xml:"vcpu"`
+	CPUTune *CPUTune `xml:"cputune,omitempty"`
 
 	OnPoweroff string `xml:"on_poweroff,omitempty"`
 	OnReboot   string `xml:"on_reboot,omitempty"`
@@ -51,6 +52,10 @@ type IDMapping struct {
 	Count  int `xml:"count,attr"`
 }
 
+type CPUTune struct {
+	Shares int64 `xml:"shares,omitempty"`
+}
+
 type UnitInt struct {
 	Value int    `xml:",chardata"`
 	Unit  string `xml:"unit,attr,omitempty"`
@@ -91,9 +96,21 @@ type HostDev struct {
 }
 
 type Interface struct {
-	Type   string        `xml:"type,attr"`
-	Source InterfaceSrc  `xml:"source"`
-	Target *InterfaceSrc `xml:"target,omitempty"`
+	Type      string        `xml:"type,attr"`
+	Source    InterfaceSrc  `xml:"source"`
+	Target    *InterfaceSrc `xml:"target,omitempty"`
+	Bandwidth *Bandwidth    `xml:"bandwidth,omitempty"`
+}
+
+// Bandwidth limits the traffic of an interface, inbound being the traffic
+// received by the domain.
+type Bandwidth struct {
+	Inbound  *BandwidthLimit `xml:"inbound,omitempty"`
+	Outbound *BandwidthLimit `xml:"outbound,omitempty"`
+}
+
+type BandwidthLimit struct {
+	Average int64 `xml:"average,attr"` // in KiB/s
 }
 
 type InterfaceSrc struct {
@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -43,7 +44,7 @@ const (
 	imageRoot      = "/var/lib/docker"
 )
 
-func NewLibvirtLXCBackend(state *State, vman *volumemanager.Manager, volPath, logPath, initPath string) (Backend, error) {
+func NewLibvirtLXCBackend(state *State, vman *volumemanager.Manager, ports *portAllocator, volPath, logPath, initPath string) (Backend, error) {
 	libvirtc, err := libvirt.NewVirConnection("lxc:///")
 	if err != nil {
 		return nil, err
@@ -54,18 +55,23 @@ func NewLibvirtLXCBackend(state *State, vman *volumemanager.Manager, volPath, lo
 		return nil, err
 	}
 
-	return &LibvirtLXCBackend{
+	l := &LibvirtLXCBackend{
 		LogPath:    logPath,
 		VolPath:    volPath,
 		InitPath:   initPath,
 		libvirt:    libvirtc,
 		state:      state,
 		vman:       vman,
+		ports:      ports,
 		pinkerton:  pinkertonCtx,
+		logMux:     newLogMux(state.id),
 		logs:       make(map[string]*logbuf.Log),
 		containers: make(map[string]*libvirtContainer),
+		checkouts:  make(map[string]string),
 		resolvConf: "/etc/resolv.conf",
-	}, nil
+	}
+	go l.runImageGC()
+	return l, nil
 }
 
 type LibvirtLXCBackend struct {
@@ -75,7 +81,9 @@ type LibvirtLXCBackend struct {
 	libvirt   libvirt.VirConnection
 	state     *State
 	vman      *volumemanager.Manager
+	ports     *portAllocator
 	pinkerton *pinkerton.Context
+	logMux    *logMux
 
 	ifaceMTU   int
 	bridgeAddr net.IP
@@ -87,11 +95,19 @@ type LibvirtLXCBackend struct {
 
 	containersMtx sync.RWMutex
 	containers    map[string]*libvirtContainer
+
+	// imageMtx is held for reading while jobs are started, and for writing
+	// while unused layers are removed
+	imageMtx     sync.RWMutex
+	checkoutsMtx sync.Mutex
+	checkouts    map[string]string // job ID -> ID of the checked out image
 }
 
 type libvirtContainer struct {
 	RootPath string
 	IP       net.IP
+	Veth     string // host side of the container's network interface
+	ImageID  string
 	job      *host.Job
 	l        *LibvirtLXCBackend
 	done     chan struct{}
@@ -341,6 +357,15 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	g := grohl.NewContext(grohl.Data{"backend": "libvirt-lxc", "fn": "run", "job.id": job.ID})
 	g.Log(grohl.Data{"at": "start", "job.artifact.uri": job.Artifact.URI, "job.cmd": job.Config.Cmd})
 
+	// the credentials are only needed to pull the image, so they are
+	// removed before the job is added to the state and persisted
+	pullURI, err := artifactPullURI(job.Artifact)
+	if err != nil {
+		g.Log(grohl.Data{"at": "parse_uri", "status": "error", "err": err})
+		return err
+	}
+	job.Artifact.Credentials = nil
+
 	container := &libvirtContainer{
 		l:    l,
 		job:  job,
@@ -359,8 +384,12 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		}
 	}()
 
+	// layers must not be removed between pulling and checking out the image
+	l.imageMtx.RLock()
+	defer l.imageMtx.RUnlock()
+
 	g.Log(grohl.Data{"at": "pull_image"})
-	layers, err := l.pinkertonPull(job.Artifact.URI)
+	layers, err := l.pinkertonPull(pullURI)
 	if err != nil {
 		g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
 		return err
@@ -373,6 +402,20 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		return err
 	}
 
+	if job.Artifact.Digest != "" {
+		g.Log(grohl.Data{"at": "verify_digest", "digest": job.Artifact.Digest})
+		digest, err := l.pinkerton.ImageDigest(imageID)
+		if err != nil {
+			g.Log(grohl.Data{"at": "verify_digest", "status": "error", "err": err})
+			return err
+		}
+		if digest != job.Artifact.Digest {
+			err := fmt.Errorf("host: image %s has digest %s, expected %s", imageID, digest, job.Artifact.Digest)
+			g.Log(grohl.Data{"at": "verify_digest", "status": "error", "err": err})
+			return err
+		}
+	}
+
 	g.Log(grohl.Data{"at": "read_config"})
 	imageConfig, err := readDockerImageConfig(imageID)
 	if err != nil {
@@ -386,6 +429,8 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		g.Log(grohl.Data{"at": "checkout", "status": "error", "err": err})
 		return err
 	}
+	container.ImageID = imageID
+	l.setCheckout(job.ID, imageID)
 	container.RootPath = rootPath
 
 	g.Log(grohl.Data{"at": "mount"})
@@ -461,13 +506,30 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 			return fmt.Errorf("unknown port proto %q", p.Proto)
 		}
 
-		if p.Port == 0 {
+		if job.Config.HostNetwork {
+			// the ports of jobs using the host network are host
+			// ports, so they must not clash with those of other jobs
+			if p.Port == 0 {
+				port, err := l.ports.Allocate(job.ID, p.Proto)
+				if err != nil {
+					g.Log(grohl.Data{"at": "allocate_port", "status": "error", "err": err})
+					return err
+				}
+				job.Config.Ports[i].Port = port
+			} else if err := l.ports.Claim(job.ID, p.Proto, p.Port); err != nil {
+				g.Log(grohl.Data{"at": "claim_port", "status": "error", "err": err})
+				return err
+			}
+		} else if p.Port == 0 {
 			job.Config.Ports[i].Port = 5000 + i
 		}
 		if i == 0 {
 			job.Config.Env["PORT"] = strconv.Itoa(job.Config.Ports[i].Port)
 		}
 		job.Config.Env[fmt.Sprintf("PORT_%d", i)] = strconv.Itoa(job.Config.Ports[i].Port)
+		if p.Name != "" {
+			job.Config.Env[host.PortEnv(p.Name)] = strconv.Itoa(job.Config.Ports[i].Port)
+		}
 	}
 
 	if !job.Config.HostNetwork {
@@ -486,7 +548,9 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	if config.WorkDir == "" {
 		config.WorkDir = imageConfig.WorkingDir
 	}
-	if job.Config.Uid > 0 {
+	if job.Config.User != "" {
+		config.User = job.Config.User
+	} else if job.Config.Uid > 0 {
 		config.User = strconv.Itoa(job.Config.Uid)
 	} else if imageConfig.User != "" {
 		// TODO: check and lookup user from image config
@@ -505,6 +569,7 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	for _, port := range job.Config.Ports {
 		config.Ports = append(config.Ports, port)
 	}
+	config.Liveness = job.Config.Liveness
 
 	g.Log(grohl.Data{"at": "write_config"})
 	err = writeContainerConfig(filepath.Join(rootPath, ".containerconfig"), config,
@@ -524,10 +589,16 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	}
 
 	l.state.AddJob(job, container.IP.String())
+	// libvirt enforces the memory and CPU shares of the domain with the
+	// container's cgroups, and the bandwidth of its interface with tc
+	memory := lt.UnitInt{Value: host.DefaultJobMemory >> 10, Unit: "KiB"}
+	if job.Resources.Memory > 0 {
+		memory = lt.UnitInt{Value: job.Resources.Memory, Unit: "KiB"}
+	}
 	domain := &lt.Domain{
 		Type:   "lxc",
 		Name:   job.ID,
-		Memory: lt.UnitInt{Value: 1, Unit: "GiB"},
+		Memory: memory,
 		VCPU:   1,
 		OS: lt.OS{
 			Type: lt.OSType{Value: "exe"},
@@ -545,10 +616,15 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		OnCrash:    "preserve",
 	}
 
+	if job.Resources.CPUShares > 0 {
+		domain.CPUTune = &lt.CPUTune{Shares: job.Resources.CPUShares}
+	}
+
 	if !job.Config.HostNetwork {
 		domain.Devices.Interfaces = []lt.Interface{{
-			Type:   "network",
-			Source: lt.InterfaceSrc{Network: libvirtNetName},
+			Type:      "network",
+			Source:    lt.InterfaceSrc{Network: libvirtNetName},
+			Bandwidth: interfaceBandwidth(job.Resources),
 		}}
 	}
 
@@ -582,6 +658,9 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		g.Log(grohl.Data{"at": "unmarshal_domain_xml", "status": "error", "err": err})
 		return err
 	}
+	if ifaces := domain.Devices.Interfaces; len(ifaces) > 0 && ifaces[0].Target != nil {
+		container.Veth = ifaces[0].Target.Dev
+	}
 
 	go container.watch(nil)
 
@@ -589,6 +668,23 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	return nil
 }
 
+// interfaceBandwidth returns the limits of the container's interface, which
+// libvirt enforces with tc qdiscs on the host side of the veth pair, or nil if
+// the job's bandwidth isn't limited.
+func interfaceBandwidth(r host.JobResources) *lt.Bandwidth {
+	if r.IngressBandwidth <= 0 && r.EgressBandwidth <= 0 {
+		return nil
+	}
+	b := &lt.Bandwidth{}
+	if r.IngressBandwidth > 0 {
+		b.Inbound = &lt.BandwidthLimit{Average: r.IngressBandwidth}
+	}
+	if r.EgressBandwidth > 0 {
+		b.Outbound = &lt.BandwidthLimit{Average: r.EgressBandwidth}
+	}
+	return b
+}
+
 func (l *LibvirtLXCBackend) openLog(id string) *logbuf.Log {
 	l.logsMtx.Lock()
 	defer l.logsMtx.Unlock()
@@ -669,10 +765,22 @@ func (c *libvirtContainer) watch(ready chan<- error) error {
 		// TODO: log errors from these
 		go log.Follow(1, stdout)
 		go log.Follow(2, stderr)
+		// forward the whole log of new jobs, but only new lines of jobs
+		// which are being restored after a restart
+		lines := -1
+		if ready != nil {
+			lines = 0
+		}
+		go c.l.logMux.Follow(log, lines, c.job)
 	}
 
 	g.Log(grohl.Data{"at": "watch_changes"})
 	for change := range c.Client.StreamState() {
+		if change.HealthCheckError != "" {
+			g.Log(grohl.Data{"at": "health_check_failed", "err": change.HealthCheckError})
+			c.l.state.SetHealthCheckFailed(c.job.ID)
+			continue
+		}
 		g.Log(grohl.Data{"at": "change", "state": change.State.String()})
 		if change.Error != "" {
 			err := errors.New(change.Error)
@@ -692,8 +800,8 @@ func (c *libvirtContainer) watch(ready chan<- error) error {
 			c.l.state.SetStatusRunning(c.job.ID)
 
 			// if the job was stopped before it started, exit
-			if c.l.state.GetJob(c.job.ID).ForceStop {
-				c.Stop()
+			if job := c.l.state.GetJob(c.job.ID); job.ForceStop {
+				c.Stop(job.StopOptions)
 			}
 		case containerinit.StateExited:
 			g.Log(grohl.Data{"at": "exited", "status": change.ExitStatus})
@@ -725,6 +833,8 @@ func (c *libvirtContainer) cleanup() error {
 	}
 	if err := c.l.pinkerton.Cleanup(c.job.ID); err != nil {
 		g.Log(grohl.Data{"at": "pinkerton", "status": "error", "err": err})
+	} else {
+		c.l.setCheckout(c.job.ID, "")
 	}
 	for _, m := range c.job.Config.Mounts {
 		if err := syscall.Unmount(filepath.Join(c.RootPath, m.Location), 0); err != nil {
@@ -739,6 +849,7 @@ func (c *libvirtContainer) cleanup() error {
 	if !c.job.Config.HostNetwork && c.l.bridgeNet != nil {
 		ipallocator.ReleaseIP(c.l.bridgeNet, c.IP)
 	}
+	c.l.ports.Release(c.job.ID)
 	g.Log(grohl.Data{"at": "finish"})
 	return nil
 }
@@ -756,22 +867,72 @@ func (c *libvirtContainer) WaitStop(timeout time.Duration) error {
 	}
 }
 
-func (c *libvirtContainer) Stop() error {
-	if err := c.Signal(int(syscall.SIGTERM)); err != nil {
-		return err
+// Stop sends the container the signal in opts, sending SIGKILL if it hasn't
+// exited after the grace period, which defaults to the job's kill timeout.
+//
+// The grace period is waited for in the background so that stopping a job
+// doesn't block for up to host.MaxStopGracePeriod, the returned channel
+// receives the result once the container has exited or been killed.
+func (c *libvirtContainer) Stop(opts *host.StopOptions) (<-chan error, error) {
+	sig := opts.Sig()
+	if err := c.Signal(int(sig)); err != nil {
+		return nil, err
 	}
-	if err := c.WaitStop(10 * time.Second); err != nil {
-		return c.Signal(int(syscall.SIGKILL))
+	done := make(chan error, 1)
+	if sig == syscall.SIGKILL {
+		done <- nil
+		return done, nil
 	}
-	return nil
+	go func() {
+		if err := c.WaitStop(opts.Grace(&c.job.Config)); err != nil {
+			done <- c.Signal(int(syscall.SIGKILL))
+			return
+		}
+		done <- nil
+	}()
+	return done, nil
 }
 
-func (l *LibvirtLXCBackend) Stop(id string) error {
+func (l *LibvirtLXCBackend) Stop(id string, opts *host.StopOptions) error {
 	c, err := l.getContainer(id)
 	if err != nil {
 		return err
 	}
-	return c.Stop()
+	_, err = c.Stop(opts)
+	return err
+}
+
+// JobMetrics returns the resource utilization of a running job. The disk usage
+// is the size of the files the job has written outside of its volumes.
+func (l *LibvirtLXCBackend) JobMetrics(id string) (*host.ResourceUsage, error) {
+	c, err := l.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	d, err := l.libvirt.LookupDomainByName(id)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Free()
+	info, err := d.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	usage := &host.ResourceUsage{
+		CPUTime: info.GetCpuTime(),
+		Memory:  info.GetMemory() * 1024,
+	}
+	if c.Veth != "" {
+		// the host side of the interface receives what the job transmits
+		// and the other way around
+		if usage.NetTxBytes, usage.NetRxBytes, err = interfaceBytes(c.Veth); err != nil {
+			return nil, err
+		}
+	}
+	if usage.Disk, err = dirSize(filepath.Join(imageRoot, "aufs", "diff", "tmp-"+id)); err != nil {
+		return nil, err
+	}
+	return usage, nil
 }
 
 func (l *LibvirtLXCBackend) getContainer(id string) (*libvirtContainer, error) {
@@ -865,12 +1026,14 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 	lines := -1
 	if !req.Logs {
 		lines = 0
+	} else if req.Lines > 0 {
+		lines = req.Lines
 	}
 
 	log := l.openLog(req.Job.Job.ID)
 	ch := make(chan logbuf.Data)
 	done := make(chan struct{})
-	go log.Read(lines, req.Stream, ch, done)
+	go log.ReadSince(lines, req.Since, req.Stream, ch, done)
 	defer close(done)
 
 	for data := range ch {
@@ -892,6 +1055,20 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 	return io.EOF
 }
 
+// stopAndWait stops the container with the given ID and waits for it to exit
+// or be killed.
+func (l *LibvirtLXCBackend) stopAndWait(id string) error {
+	c, err := l.getContainer(id)
+	if err != nil {
+		return err
+	}
+	done, err := c.Stop(nil)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
 func (l *LibvirtLXCBackend) Cleanup() error {
 	g := grohl.NewContext(grohl.Data{"backend": "libvirt-lxc", "fn": "Cleanup"})
 	l.containersMtx.Lock()
@@ -905,7 +1082,8 @@ func (l *LibvirtLXCBackend) Cleanup() error {
 	for _, id := range ids {
 		go func(id string) {
 			g.Log(grohl.Data{"at": "stop", "job.id": id})
-			err := l.Stop(id)
+			// wait for the containers to stop before the host exits
+			err := l.stopAndWait(id)
 			if err != nil {
 				g.Log(grohl.Data{"at": "error", "job.id": id, "err": err.Error()})
 			}
@@ -948,6 +1126,14 @@ func (l *LibvirtLXCBackend) UnmarshalState(jobs map[string]*host.ActiveJob, jobB
 		container.l = l
 		container.job = j.Job
 		container.done = make(chan struct{})
+		if container.ImageID != "" {
+			l.setCheckout(j.Job.ID, container.ImageID)
+		}
+		if j.Job.Config.HostNetwork {
+			for _, p := range j.Job.Config.Ports {
+				l.ports.Claim(j.Job.ID, p.Proto, p.Port)
+			}
+		}
 		readySignals[j.Job.ID] = make(chan error)
 		go container.watch(readySignals[j.Job.ID])
 	}
@@ -977,6 +1163,20 @@ func (l *LibvirtLXCBackend) MarshalJobState(jobID string) ([]byte, error) {
 	return nil, nil
 }
 
+// artifactPullURI returns the URI of a, with its credentials as the userinfo if
+// it has any.
+func artifactPullURI(a host.Artifact) (string, error) {
+	if a.Credentials == nil {
+		return a.URI, nil
+	}
+	u, err := url.Parse(a.URI)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(a.Credentials.Username, a.Credentials.Password)
+	return u.String(), nil
+}
+
 func (l *LibvirtLXCBackend) pinkertonPull(url string) ([]layer.PullInfo, error) {
 	var layers []layer.PullInfo
 	info := make(chan layer.PullInfo)
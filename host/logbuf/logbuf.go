@@ -1,6 +1,7 @@
 package logbuf
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"io"
@@ -87,9 +88,22 @@ func (l *Log) Write(data Data) error {
 	return json.NewEncoder(l.l).Encode(data)
 }
 
-// Read old log lines from a logfile.
+// MaxLines is the most recent lines Read buffers, as they are held in memory.
+const MaxLines = 10000
+
+// Read old log lines from a logfile. If lines is -1 all lines are read, if it
+// is positive only the most recent lines are read, up to MaxLines.
 func (l *Log) Read(lines int, follow bool, ch chan Data, done chan struct{}) error {
+	return l.ReadSince(lines, time.Time{}, follow, ch, done)
+}
+
+// ReadSince is like Read but skips lines written before since, so that lines
+// counts only the lines which are sent.
+func (l *Log) ReadSince(lines int, since time.Time, follow bool, ch chan Data, done chan struct{}) error {
 	name := l.l.Filename
+	if lines > MaxLines {
+		lines = MaxLines
+	}
 
 	var seek int64
 	if lines == 0 {
@@ -103,20 +117,12 @@ func (l *Log) Read(lines int, follow bool, ch chan Data, done chan struct{}) err
 		}
 	} else if lines == -1 {
 		// return all lines
-		dir := filepath.Dir(name)
-		files, err := ioutil.ReadDir(dir)
+		files, err := l.rotatedFiles()
 		if err != nil {
 			return err
 		}
-		basename := filepath.Base(name)
-		ext := filepath.Ext(basename)
-		id := strings.TrimSuffix(basename, ext)
 		for _, f := range files {
-			if !(strings.HasPrefix(f.Name(), id+"-") && strings.HasSuffix(f.Name(), ext)) {
-				continue
-			}
-
-			t, err := tail.TailFile(filepath.Join(dir, f.Name()), tail.Config{
+			t, err := tail.TailFile(f, tail.Config{
 				Logger: tail.DiscardingLogger,
 			})
 			if err != nil {
@@ -127,9 +133,43 @@ func (l *Log) Read(lines int, follow bool, ch chan Data, done chan struct{}) err
 				if err := json.Unmarshal([]byte(line.Text), &data); err != nil {
 					return err
 				}
+				if data.Timestamp.Before(since) {
+					continue
+				}
 				ch <- data
 			}
 		}
+	} else {
+		// buffer the most recent lines from the rotated and current logfiles,
+		// then continue from the end of the current logfile
+		ring := make([]Data, lines)
+		n := 0
+		add := func(data Data) {
+			if data.Timestamp.Before(since) {
+				return
+			}
+			ring[n%lines] = data
+			n++
+		}
+		files, err := l.rotatedFiles()
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if _, err := readFile(f, add); err != nil {
+				return err
+			}
+		}
+		if seek, err = readFile(name, add); err != nil {
+			return err
+		}
+		start := 0
+		if n > lines {
+			start = n - lines
+		}
+		for i := start; i < n; i++ {
+			ch <- ring[i%lines]
+		}
 	}
 
 	t, err := tail.TailFile(name, tail.Config{
@@ -157,6 +197,9 @@ outer:
 			if err := json.Unmarshal([]byte(line.Text), &data); err != nil {
 				return err
 			}
+			if data.Timestamp.Before(since) {
+				continue
+			}
 			ch <- data
 		case <-done:
 			break outer
@@ -172,6 +215,52 @@ outer:
 	return nil
 }
 
+// rotatedFiles returns the paths of the rotated logfiles, oldest first.
+func (l *Log) rotatedFiles() ([]string, error) {
+	name := l.l.Filename
+	dir := filepath.Dir(name)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	basename := filepath.Base(name)
+	ext := filepath.Ext(basename)
+	id := strings.TrimSuffix(basename, ext)
+	var paths []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), id+"-") && strings.HasSuffix(f.Name(), ext) {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// readFile calls fn for each complete line in the logfile at path, returning
+// the offset after the last complete line.
+func readFile(path string, fn func(Data)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return 0, err
+		}
+		data := Data{}
+		if err := json.Unmarshal(line, &data); err != nil {
+			return 0, err
+		}
+		fn(data)
+		offset += int64(len(line))
+	}
+}
+
 func (l *Log) Close() error {
 	close(l.closed)
 	return l.l.Close()
@@ -80,6 +80,62 @@ func (s *S) TestLogWriteRead(c *C) {
 	}
 }
 
+func (s *S) TestReadLines(c *C) {
+	l := NewLog(&lumberjack.Logger{})
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		if i == 3 {
+			l.l.Rotate()
+		}
+		c.Assert(l.Write(Data{Stream: 1, Timestamp: UnixTime{time.Now()}, Message: strconv.Itoa(i)}), IsNil)
+	}
+
+	for _, t := range []struct {
+		lines    int
+		expected []string
+	}{
+		{lines: 2, expected: []string{"3", "4"}},
+		{lines: 4, expected: []string{"1", "2", "3", "4"}},
+		{lines: 10, expected: []string{"0", "1", "2", "3", "4"}},
+	} {
+		ch := make(chan Data)
+		go l.Read(t.lines, false, ch, nil)
+		var messages []string
+		for data := range ch {
+			messages = append(messages, data.Message)
+		}
+		c.Assert(messages, DeepEquals, t.expected)
+	}
+}
+
+func (s *S) TestReadSince(c *C) {
+	l := NewLog(&lumberjack.Logger{})
+	defer l.Close()
+	since := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	for i := 0; i < 5; i++ {
+		ts := since.Add(time.Duration(i-2) * time.Second)
+		c.Assert(l.Write(Data{Stream: 1, Timestamp: UnixTime{ts}, Message: strconv.Itoa(i)}), IsNil)
+	}
+
+	// lines written before since don't count towards lines
+	for _, t := range []struct {
+		lines    int
+		expected []string
+	}{
+		{lines: 2, expected: []string{"3", "4"}},
+		{lines: 4, expected: []string{"2", "3", "4"}},
+		{lines: -1, expected: []string{"2", "3", "4"}},
+	} {
+		ch := make(chan Data)
+		go l.ReadSince(t.lines, since, false, ch, nil)
+		var messages []string
+		for data := range ch {
+			messages = append(messages, data.Message)
+		}
+		c.Assert(messages, DeepEquals, t.expected)
+	}
+}
+
 func (s *S) TestStreaming(c *C) {
 	l := NewLog(&lumberjack.Logger{})
 	pipeR, pipeW := io.Pipe()
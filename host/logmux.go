@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+	logaggc "github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/logaggregator/types"
+)
+
+// logMuxBufferSize is the number of messages which are held while the log
+// aggregator can't be reached, further messages are dropped so that jobs are
+// never blocked on writing their output.
+const logMuxBufferSize = 10000
+
+// logMux forwards the output of the jobs of controller apps to the log
+// aggregator.
+type logMux struct {
+	hostID string
+	msgs   chan *logagg.Message
+}
+
+func newLogMux(hostID string) *logMux {
+	m := &logMux{
+		hostID: hostID,
+		msgs:   make(chan *logagg.Message, logMuxBufferSize),
+	}
+	go m.run()
+	return m
+}
+
+// run forwards messages to the log aggregator, reconnecting when the
+// connection fails.
+func (m *logMux) run() {
+	g := grohl.NewContext(grohl.Data{"fn": "logmux"})
+	for {
+		addr, err := discoverd.NewService("logaggregator").Leader()
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := logaggc.NewWithAddr(addr.Addr).Forward(m.msgs); err != nil {
+			g.Log(grohl.Data{"at": "forward", "addr": addr.Addr, "status": "error", "err": err})
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Follow forwards the lines written to log by job, starting with the most
+// recent lines already in log, until log is closed. Jobs which are not part of
+// a controller app are ignored.
+func (m *logMux) Follow(log *logbuf.Log, lines int, job *host.Job) {
+	appID := job.Metadata["flynn-controller.app"]
+	if appID == "" {
+		return
+	}
+	ch := make(chan logbuf.Data)
+	go log.Read(lines, true, ch, nil)
+	for data := range ch {
+		stream := logagg.StreamStdout
+		if data.Stream == 2 {
+			stream = logagg.StreamStderr
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(data.Message, "\n"), "\n") {
+			msg := &logagg.Message{
+				AppID:       appID,
+				HostID:      m.hostID,
+				JobID:       m.hostID + "-" + job.ID,
+				ReleaseID:   job.Metadata["flynn-controller.release"],
+				ProcessType: job.Metadata["flynn-controller.type"],
+				Stream:      stream,
+				Timestamp:   data.Timestamp.Time,
+				Msg:         line,
+			}
+			select {
+			case m.msgs <- msg:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// Metrics samples the resource utilization of the host and of its running
+// jobs. Jobs which stop while being sampled are left out.
+func (h *Host) Metrics() (*host.HostMetrics, error) {
+	m := &host.HostMetrics{
+		HostID: h.state.id,
+		Time:   time.Now().UTC(),
+		CPUs:   runtime.NumCPU(),
+		Jobs:   make(map[string]*host.ResourceUsage),
+	}
+
+	if err := readProc("/proc/stat", func(r io.Reader) (err error) {
+		m.Host.CPUTime, err = parseCPUTime(r)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := readProc("/proc/meminfo", func(r io.Reader) (err error) {
+		m.MemoryTotal, m.Host.Memory, err = parseMemInfo(r)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := readProc("/proc/net/dev", func(r io.Reader) (err error) {
+		m.Host.NetRxBytes, m.Host.NetTxBytes, err = parseNetDev(r, isHostInterface)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(imageRoot, &fs); err != nil {
+		return nil, err
+	}
+	m.DiskTotal = fs.Blocks * uint64(fs.Bsize)
+	m.Host.Disk = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+
+	for id, job := range h.state.Get() {
+		if job.Status != host.StatusRunning {
+			continue
+		}
+		usage, err := h.backend.JobMetrics(id)
+		if err != nil {
+			continue
+		}
+		m.Jobs[id] = usage
+	}
+	return m, nil
+}
+
+func readProc(path string, parse func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+// userHZ is the unit of the times in /proc/stat, which is 100 on all
+// architectures the host runs on.
+const userHZ = 100
+
+// parseCPUTime returns the CPU time spent on all CPUs, except when idle or
+// waiting for IO, from the contents of /proc/stat.
+func parseCPUTime(r io.Reader) (uint64, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || fields[0] != "cpu" {
+			continue
+		}
+		var total uint64
+		for i, field := range fields[1:] {
+			// the 4th and 5th fields are the idle and iowait times
+			if i == 3 || i == 4 {
+				continue
+			}
+			n, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("host: invalid /proc/stat cpu field %q", field)
+			}
+			total += n
+		}
+		return total * uint64(time.Second) / userHZ, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("host: missing cpu line in /proc/stat")
+}
+
+// parseMemInfo returns the total and used memory in bytes from the contents
+// of /proc/meminfo. Memory used by the page cache is counted as free.
+func parseMemInfo(r io.Reader) (total, used uint64, err error) {
+	values := make(map[string]uint64)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = n * 1024
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+	total, ok := values["MemTotal"]
+	if !ok {
+		return 0, 0, errors.New("host: missing MemTotal in /proc/meminfo")
+	}
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// kernels before 3.14 don't report MemAvailable
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if available > total {
+		available = total
+	}
+	return total, total - available, nil
+}
+
+// parseNetDev returns the bytes received and transmitted by the interfaces
+// matched by include from the contents of /proc/net/dev.
+func parseNetDev(r io.Reader, include func(string) bool) (rx, tx uint64, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		i := strings.Index(line, ":")
+		if i < 0 {
+			// header line
+			continue
+		}
+		if !include(strings.TrimSpace(line[:i])) {
+			continue
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) < 9 {
+			return 0, 0, fmt.Errorf("host: invalid /proc/net/dev line %q", line)
+		}
+		r, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		t, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		rx += r
+		tx += t
+	}
+	return rx, tx, s.Err()
+}
+
+// isHostInterface reports whether traffic on the interface goes in or out of
+// the host, rather than staying on the host or being counted elsewhere.
+func isHostInterface(name string) bool {
+	return name != "lo" && name != bridgeName && !strings.HasPrefix(name, "vnet") && !strings.HasPrefix(name, "veth")
+}
+
+// interfaceBytes returns the bytes received and transmitted by the interface
+// with the given name.
+func interfaceBytes(name string) (rx, tx uint64, err error) {
+	dir := filepath.Join("/sys/class/net", name, "statistics")
+	if rx, err = readUint(filepath.Join(dir, "rx_bytes")); err != nil {
+		return 0, 0, err
+	}
+	tx, err = readUint(filepath.Join(dir, "tx_bytes"))
+	return rx, tx, err
+}
+
+func readUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// dirSize returns the total size of the files in dir.
+func dirSize(dir string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files may be removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
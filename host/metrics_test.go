@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+)
+
+func (S) TestParseCPUTime(c *C) {
+	stat := `cpu  100 20 30 1000 50 5 5 0 0 0
+cpu0 100 20 30 1000 50 5 5 0 0 0
+intr 12345
+`
+	n, err := parseCPUTime(strings.NewReader(stat))
+	c.Assert(err, IsNil)
+	// 160 jiffies, skipping the idle and iowait times
+	c.Assert(n, Equals, uint64(1600000000))
+
+	_, err = parseCPUTime(strings.NewReader("intr 12345\n"))
+	c.Assert(err, NotNil)
+}
+
+func (S) TestParseMemInfo(c *C) {
+	total, used, err := parseMemInfo(strings.NewReader(`MemTotal:        2048 kB
+MemFree:          512 kB
+MemAvailable:    1024 kB
+Buffers:          128 kB
+Cached:           256 kB
+`))
+	c.Assert(err, IsNil)
+	c.Assert(total, Equals, uint64(2048*1024))
+	c.Assert(used, Equals, uint64(1024*1024))
+
+	// without MemAvailable, buffers and the page cache are counted as free
+	total, used, err = parseMemInfo(strings.NewReader(`MemTotal:        2048 kB
+MemFree:          512 kB
+Buffers:          128 kB
+Cached:           256 kB
+`))
+	c.Assert(err, IsNil)
+	c.Assert(used, Equals, uint64(1152*1024))
+}
+
+func (S) TestParseNetDev(c *C) {
+	dev := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0
+  eth0:    2000      20    0    0    0     0          0         0     3000      30    0    0    0     0       0          0
+flynnbr0:   500       5    0    0    0     0          0         0      600       6    0    0    0     0       0          0
+ vnet0:     400       4    0    0    0     0          0         0      700       7    0    0    0     0       0          0
+  eth1:      10       1    0    0    0     0          0         0       20       2    0    0    0     0       0          0
+`
+	rx, tx, err := parseNetDev(strings.NewReader(dev), isHostInterface)
+	c.Assert(err, IsNil)
+	c.Assert(rx, Equals, uint64(2010))
+	c.Assert(tx, Equals, uint64(3020))
+}
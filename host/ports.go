@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+var errNoPorts = errors.New("host: no free ports in the allocation range")
+
+// portAllocator hands out the host ports of jobs using the host network. Jobs
+// which don't request a specific port get one from the allocation range,
+// skipping ports which are reserved for system services and other software
+// running on the host.
+type portAllocator struct {
+	mtx        sync.Mutex
+	start, end int
+	reserved   map[int]struct{}
+	allocated  map[portKey]string // port -> job ID
+}
+
+type portKey struct {
+	proto string
+	port  int
+}
+
+func newPortAllocator(start, end int, reserved []int) *portAllocator {
+	a := &portAllocator{
+		start:     start,
+		end:       end,
+		reserved:  make(map[int]struct{}, len(reserved)),
+		allocated: make(map[portKey]string),
+	}
+	for _, p := range reserved {
+		a.reserved[p] = struct{}{}
+	}
+	return a
+}
+
+// Allocate returns a free port in the allocation range for jobID.
+func (a *portAllocator) Allocate(jobID, proto string) (int, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for port := a.start; port <= a.end; port++ {
+		if _, ok := a.reserved[port]; ok {
+			continue
+		}
+		key := portKey{proto, port}
+		if _, ok := a.allocated[key]; !ok {
+			a.allocated[key] = jobID
+			return port, nil
+		}
+	}
+	return 0, errNoPorts
+}
+
+// Claim allocates a port requested by jobID, which may be outside of the
+// allocation range or reserved. It fails if the port is allocated to another
+// job.
+func (a *portAllocator) Claim(jobID, proto string, port int) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	key := portKey{proto, port}
+	if id, ok := a.allocated[key]; ok && id != jobID {
+		return fmt.Errorf("host: %s port %d is already allocated to job %s", proto, port, id)
+	}
+	a.allocated[key] = jobID
+	return nil
+}
+
+// Release frees the ports of jobID.
+func (a *portAllocator) Release(jobID string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for key, id := range a.allocated {
+		if id == jobID {
+			delete(a.allocated, key)
+		}
+	}
+}
+
+func (a *portAllocator) Ports() *host.HostPorts {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	ports := &host.HostPorts{
+		RangeStart: a.start,
+		RangeEnd:   a.end,
+		Reserved:   make([]int, 0, len(a.reserved)),
+		Allocated:  make([]host.PortAllocation, 0, len(a.allocated)),
+	}
+	for port := range a.reserved {
+		ports.Reserved = append(ports.Reserved, port)
+	}
+	sort.Ints(ports.Reserved)
+	for key, id := range a.allocated {
+		ports.Allocated = append(ports.Allocated, host.PortAllocation{Port: key.port, Proto: key.proto, JobID: id})
+	}
+	sort.Sort(portAllocations(ports.Allocated))
+	return ports
+}
+
+type portAllocations []host.PortAllocation
+
+func (p portAllocations) Len() int      { return len(p) }
+func (p portAllocations) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p portAllocations) Less(i, j int) bool {
+	if p[i].Port == p[j].Port {
+		return p[i].Proto < p[j].Proto
+	}
+	return p[i].Port < p[j].Port
+}
+
+// parsePorts parses a comma separated list of ports and port ranges, e.g.
+// "80,443,8000-8080".
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		start, end, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		for port := start; port <= end; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// parsePortRange parses a port range in the form "start-end", or a single
+// port.
+func parsePortRange(s string) (start, end int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("host: invalid port %q", parts[0])
+	}
+	end = start
+	if len(parts) == 2 {
+		end, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("host: invalid port %q", parts[1])
+		}
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("host: invalid port range %q", s)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/host/types"
+)
+
+func (S) TestPortAllocator(c *C) {
+	a := newPortAllocator(5000, 5003, []int{5001})
+
+	port, err := a.Allocate("job1", "tcp")
+	c.Assert(err, IsNil)
+	c.Assert(port, Equals, 5000)
+	// reserved ports are skipped
+	port, err = a.Allocate("job1", "tcp")
+	c.Assert(err, IsNil)
+	c.Assert(port, Equals, 5002)
+	// tcp and udp ports are allocated separately
+	port, err = a.Allocate("job2", "udp")
+	c.Assert(err, IsNil)
+	c.Assert(port, Equals, 5000)
+
+	// requested ports may be reserved, but not allocated to another job
+	c.Assert(a.Claim("job2", "tcp", 5001), IsNil)
+	c.Assert(a.Claim("job2", "tcp", 5003), IsNil)
+	c.Assert(a.Claim("job2", "tcp", 5003), IsNil)
+	c.Assert(a.Claim("job3", "tcp", 5000), NotNil)
+	_, err = a.Allocate("job3", "tcp")
+	c.Assert(err, Equals, errNoPorts)
+
+	c.Assert(a.Ports(), DeepEquals, &host.HostPorts{
+		RangeStart: 5000,
+		RangeEnd:   5003,
+		Reserved:   []int{5001},
+		Allocated: []host.PortAllocation{
+			{Port: 5000, Proto: "tcp", JobID: "job1"},
+			{Port: 5000, Proto: "udp", JobID: "job2"},
+			{Port: 5001, Proto: "tcp", JobID: "job2"},
+			{Port: 5002, Proto: "tcp", JobID: "job1"},
+			{Port: 5003, Proto: "tcp", JobID: "job2"},
+		},
+	})
+
+	a.Release("job1")
+	port, err = a.Allocate("job3", "tcp")
+	c.Assert(err, IsNil)
+	c.Assert(port, Equals, 5000)
+}
+
+func (S) TestParsePorts(c *C) {
+	ports, err := parsePorts("80, 443,8000-8002")
+	c.Assert(err, IsNil)
+	c.Assert(ports, DeepEquals, []int{80, 443, 8000, 8001, 8002})
+
+	ports, err = parsePorts("")
+	c.Assert(err, IsNil)
+	c.Assert(ports, HasLen, 0)
+
+	for _, s := range []string{"http", "0", "8002-8000", "1-70000", "80-"} {
+		_, err = parsePorts(s)
+		c.Assert(err, NotNil, Commentf("ports = %q", s))
+	}
+}
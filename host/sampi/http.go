@@ -67,6 +67,20 @@ func (s *Cluster) RemoveJobs(hostID string, jobIDs ...string) error {
 	return nil
 }
 
+// SetUnschedulable marks a host as unschedulable so that the scheduler stops
+// placing jobs on it, or as schedulable again.
+func (s *Cluster) SetUnschedulable(hostID string, unschedulable bool) error {
+	l := s.logger.New("fn", "SetUnschedulable", "host.id", hostID)
+	s.state.Begin()
+	if err := s.state.SetUnschedulable(hostID, unschedulable); err != nil {
+		l.Error("error setting unschedulable", "err", err)
+		s.state.Rollback()
+		return err
+	}
+	s.state.Commit()
+	return nil
+}
+
 func (s *Cluster) StreamHostEvents(ch chan host.HostEvent, done chan bool) error {
 	l := s.logger.New("fn", "StreamHostEvents")
 	l.Debug("adding host event listener", "at", "add_listener")
@@ -185,6 +199,26 @@ func (c *HTTPAPI) RemoveJob(w http.ResponseWriter, r *http.Request, ps httproute
 	w.WriteHeader(200)
 }
 
+func (c *HTTPAPI) SetUnschedulable(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	l := c.logger.New("fn", "SetUnschedulable")
+	if err := c.Cluster.SetUnschedulable(ps.ByName("id"), true); err != nil {
+		l.Error("set_unschedulable error", "err", err)
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (c *HTTPAPI) SetSchedulable(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	l := c.logger.New("fn", "SetSchedulable")
+	if err := c.Cluster.SetUnschedulable(ps.ByName("host_id"), false); err != nil {
+		l.Error("set_unschedulable error", "err", err)
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
 func (c *HTTPAPI) StreamHostEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	l := c.logger.New("fn", "StreamHostEvents")
 	ch := make(chan host.HostEvent)
@@ -203,8 +237,10 @@ func (c *HTTPAPI) StreamHostEvents(w http.ResponseWriter, r *http.Request, ps ht
 func (c *HTTPAPI) RegisterRoutes(r *httprouter.Router) error {
 	r.GET("/cluster/hosts", c.ListHosts)
 	r.PUT("/cluster/hosts/:id", c.RegisterHost)
+	r.PUT("/cluster/hosts/:id/unschedulable", c.SetUnschedulable)
 	r.POST("/cluster/jobs", c.AddJobs)
 	r.DELETE("/cluster/hosts/:host_id/jobs/:job_id", c.RemoveJob)
+	r.DELETE("/cluster/hosts/:host_id/unschedulable", c.SetSchedulable)
 	r.GET("/cluster/events", c.StreamHostEvents)
 	return nil
 }
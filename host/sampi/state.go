@@ -101,7 +101,16 @@ func (s *State) AddJobs(hostID string, jobs []*host.Job) error {
 	l.Debug("adding new jobs", "at", "ok")
 	newJobs := make([]*host.Job, len(h.Jobs), len(h.Jobs)+len(jobs))
 	copy(newJobs, h.Jobs)
-	newJobs = append(newJobs, jobs...)
+	for _, job := range jobs {
+		// registry credentials are only sent to the host which pulls
+		// the image, the state is returned to any client of the API
+		if job.Artifact.Credentials != nil {
+			stored := *job
+			stored.Artifact.Credentials = nil
+			job = &stored
+		}
+		newJobs = append(newJobs, job)
+	}
 	h.Jobs = newJobs
 
 	s.next[hostID] = h
@@ -153,6 +162,21 @@ outer:
 	s.nextModified = true
 }
 
+func (s *State) SetUnschedulable(hostID string, unschedulable bool) error {
+	l := s.logger.New("fn", "SetUnschedulable", "host.id", hostID)
+	h, ok := s.host(hostID)
+	if !ok {
+		l.Error("host not found")
+		return fmt.Errorf("sampi: Unknown host %s", hostID)
+	}
+	l.Debug("setting unschedulable", "unschedulable", unschedulable)
+	h.Unschedulable = unschedulable
+	s.next[hostID] = h
+	l.Debug("marking state as modified")
+	s.nextModified = true
+	return nil
+}
+
 func (s *State) HostExists(id string) bool {
 	_, exists := s.next[id]
 	s.logger.Debug("checking if host exists", "fn", "HostExists", "host.id", id, "exists", exists)
@@ -45,3 +45,49 @@ func TestStateRace(t *testing.T) {
 		t.Log("Got '2'")
 	}
 }
+
+func TestStateSetUnschedulable(t *testing.T) {
+	state := NewState()
+	addHost("foo", state)
+
+	state.Begin()
+	if err := state.SetUnschedulable("foo", true); err != nil {
+		t.Fatal(err)
+	}
+	state.Commit()
+	if !state.Get()["foo"].Unschedulable {
+		t.Error("Expected 'foo' to be unschedulable")
+	}
+
+	state.Begin()
+	if err := state.SetUnschedulable("bar", true); err == nil {
+		t.Error("Expected an error for unknown host 'bar'")
+	}
+	state.Rollback()
+}
+
+func TestStateAddJobsWithoutCredentials(t *testing.T) {
+	state := NewState()
+	addHost("foo", state)
+
+	job := &host.Job{ID: "job1", Artifact: host.Artifact{
+		URI:         "https://registry.example.com?name=app",
+		Credentials: &host.RegistryCredentials{Username: "user", Password: "secret"},
+	}}
+	state.Begin()
+	if err := state.AddJobs("foo", []*host.Job{job}); err != nil {
+		t.Fatal(err)
+	}
+	state.Commit()
+
+	jobs := state.Get()["foo"].Jobs
+	if len(jobs) != 1 || jobs[0].ID != "job1" {
+		t.Fatalf("expected job1 in state, got %v", jobs)
+	}
+	if jobs[0].Artifact.Credentials != nil {
+		t.Error("expected credentials not to be stored")
+	}
+	if job.Artifact.Credentials == nil {
+		t.Error("expected the credentials of the job sent to the host to be kept")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -15,6 +16,10 @@ import (
 
 // TODO: prune old jobs?
 
+// eventBufferSize is the number of recent events which are kept so that event
+// streams can be resumed.
+const eventBufferSize = 1000
+
 type State struct {
 	id string
 
@@ -26,6 +31,17 @@ type State struct {
 	listenMtx  sync.RWMutex
 	attachers  map[string]map[chan struct{}]struct{}
 
+	// events holds the most recent events, oldest first, so that streams
+	// can be resumed after reconnecting. eventSent is closed once the last
+	// event has been sent to the listeners, so that events are sent in
+	// order. Event IDs start from eventBase, the time the state was
+	// created, so that IDs from before a restart are not reused.
+	events    []host.Event
+	eventBase int64
+	eventID   int64
+	eventSent chan struct{}
+	eventMtx  sync.Mutex
+
 	stateFilePath string
 	stateDB       *bolt.DB
 
@@ -40,7 +56,9 @@ func NewState(id string, stateFilePath string) *State {
 		containers:    make(map[string]*host.ActiveJob),
 		listeners:     make(map[string]map[chan host.Event]struct{}),
 		attachers:     make(map[string]map[chan struct{}]struct{}),
+		eventBase:     time.Now().UnixNano(),
 	}
+	s.eventID = s.eventBase
 	s.initializePersistence()
 	return s
 }
@@ -245,7 +263,9 @@ func (s *State) SetManifestID(jobID, manifestID string) {
 	s.persist(jobID)
 }
 
-func (s *State) SetForceStop(jobID string) {
+// SetForceStop marks a job which is starting to be stopped with opts once it
+// is running.
+func (s *State) SetForceStop(jobID string, opts *host.StopOptions) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -255,6 +275,7 @@ func (s *State) SetForceStop(jobID string) {
 	}
 
 	job.ForceStop = true
+	job.StopOptions = opts
 	s.persist(jobID)
 }
 
@@ -326,6 +347,18 @@ func (s *State) SetStatusFailed(jobID string, err error) {
 	go s.WaitAttach(jobID)
 }
 
+// SetHealthCheckFailed emits a health_check_failed event for the job, whose
+// liveness check has failed so it is about to be killed.
+func (s *State) SetHealthCheckFailed(jobID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	job, ok := s.jobs[jobID]
+	if !ok || job.Status != host.StatusRunning {
+		return
+	}
+	s.sendEvent(job, "health_check_failed")
+}
+
 func (s *State) AddAttacher(jobID string, ch chan struct{}) *host.ActiveJob {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -392,10 +425,27 @@ func (s *State) RemoveListener(jobID string, ch chan host.Event) {
 
 func (s *State) sendEvent(job *host.ActiveJob, event string) {
 	j := *job
+
+	s.eventMtx.Lock()
+	s.eventID++
+	e := host.Event{ID: s.eventID, JobID: job.Job.ID, Job: &j, Event: event}
+	if len(s.events) == eventBufferSize {
+		copy(s.events, s.events[1:])
+		s.events = s.events[:len(s.events)-1]
+	}
+	s.events = append(s.events, e)
+	prev := s.eventSent
+	sent := make(chan struct{})
+	s.eventSent = sent
+	s.eventMtx.Unlock()
+
 	go func() {
+		defer close(sent)
+		if prev != nil {
+			<-prev
+		}
 		s.listenMtx.RLock()
 		defer s.listenMtx.RUnlock()
-		e := host.Event{JobID: job.Job.ID, Job: &j, Event: event}
 		for ch := range s.listeners["all"] {
 			ch <- e
 		}
@@ -404,3 +454,30 @@ func (s *State) sendEvent(job *host.ActiveJob, event string) {
 		}
 	}()
 }
+
+// ErrEventsMissed is returned by EventsSince when events after since are no
+// longer buffered, either because the host has restarted since the event was
+// sent or because too many events have been sent since.
+var ErrEventsMissed = errors.New("host: events have been missed since the given event ID")
+
+// EventsSince returns the buffered events for jobID (which may be "all") with
+// an ID greater than since, oldest first. Events which are sent to a listener
+// added before calling EventsSince may also be returned.
+func (s *State) EventsSince(jobID string, since int64) ([]host.Event, error) {
+	s.eventMtx.Lock()
+	defer s.eventMtx.Unlock()
+	oldest := s.eventBase
+	if len(s.events) > 0 {
+		oldest = s.events[0].ID - 1
+	}
+	if since < oldest || since > s.eventID {
+		return nil, ErrEventsMissed
+	}
+	var events []host.Event
+	for _, e := range s.events {
+		if e.ID > since && (jobID == "all" || e.JobID == jobID) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
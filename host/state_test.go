@@ -29,7 +29,7 @@ func (S) TestStateHostID(c *C) {
 type MockBackend struct{}
 
 func (MockBackend) Run(*host.Job) error                             { return nil }
-func (MockBackend) Stop(string) error                               { return nil }
+func (MockBackend) Stop(string, *host.StopOptions) error            { return nil }
 func (MockBackend) Signal(string, int) error                        { return nil }
 func (MockBackend) ResizeTTY(id string, height, width uint16) error { return nil }
 func (MockBackend) Attach(*AttachRequest) error                     { return nil }
@@ -39,6 +39,8 @@ func (MockBackend) UnmarshalState(map[string]*host.ActiveJob, map[string][]byte,
 }
 func (MockBackend) ConfigureNetworking(NetworkStrategy, string) (*NetworkInfo, error) { return nil, nil }
 
+func (MockBackend) JobMetrics(string) (*host.ResourceUsage, error) { return nil, nil }
+
 func (S) TestStatePersistRestore(c *C) {
 	workdir := c.MkDir()
 	hostID := "abc123"
@@ -58,3 +60,39 @@ func (S) TestStatePersistRestore(c *C) {
 		c.Errorf("expected job.HostID to equal %s, got %s", hostID, job.HostID)
 	}
 }
+
+func (S) TestStateEventsSince(c *C) {
+	workdir := c.MkDir()
+	state := NewState("abc123", filepath.Join(workdir, "host-state-db"))
+	defer state.persistenceDBClose()
+	events := state.AddListener("all")
+	defer state.RemoveListener("all", events)
+
+	state.AddJob(&host.Job{ID: "a"}, "1.1.1.1")
+	state.AddJob(&host.Job{ID: "b"}, "1.1.1.1")
+	state.SetStatusRunning("a")
+	for i := int64(1); i <= 3; i++ {
+		e := <-events
+		c.Assert(e.ID, Equals, state.eventBase+i)
+	}
+
+	ids := func(events []host.Event, err error) []int64 {
+		c.Assert(err, IsNil)
+		res := make([]int64, len(events))
+		for i, e := range events {
+			res[i] = e.ID - state.eventBase
+		}
+		return res
+	}
+	base := state.eventBase
+	c.Assert(ids(state.EventsSince("all", base)), DeepEquals, []int64{1, 2, 3})
+	c.Assert(ids(state.EventsSince("all", base+1)), DeepEquals, []int64{2, 3})
+	c.Assert(ids(state.EventsSince("a", base)), DeepEquals, []int64{1, 3})
+	c.Assert(ids(state.EventsSince("all", base+3)), HasLen, 0)
+
+	// IDs from before the host restarted are not in the buffer
+	_, err := state.EventsSince("all", 3)
+	c.Assert(err, Equals, ErrEventsMissed)
+	_, err = state.EventsSince("all", base+10)
+	c.Assert(err, Equals, ErrEventsMissed)
+}
@@ -1,6 +1,11 @@
 package host
 
 import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -56,8 +61,18 @@ func (j *Job) Dup() *Job {
 	return &job
 }
 
+// DefaultJobMemory is the memory limit in bytes of jobs which don't set one.
+const DefaultJobMemory = 1 << 30
+
 type JobResources struct {
-	Memory int `json:"memory,omitempty"` // in KiB
+	Memory    int   `json:"memory,omitempty"`     // in KiB
+	CPUShares int64 `json:"cpu_shares,omitempty"` // relative weight, 1024 by default
+
+	// IngressBandwidth and EgressBandwidth limit the network traffic
+	// received and sent by the job, they are not limited if zero and
+	// ignored for jobs using the host network.
+	IngressBandwidth int64 `json:"ingress_bandwidth,omitempty"` // in KiB/s
+	EgressBandwidth  int64 `json:"egress_bandwidth,omitempty"`  // in KiB/s
 }
 
 type ContainerConfig struct {
@@ -73,6 +88,13 @@ type ContainerConfig struct {
 	WorkingDir  string            `json:"working_dir,omitempty"`
 	Uid         int               `json:"uid,omitempty"`
 	HostNetwork bool              `json:"host_network,omitempty"`
+	Liveness    *LivenessCheck    `json:"liveness,omitempty"`
+	// KillTimeout is the grace period of the job when it is stopped
+	// without one being given, it defaults to DefaultStopGracePeriod.
+	KillTimeout time.Duration `json:"kill_timeout,omitempty"`
+	// User is the name or UID of the user the job runs as, it takes
+	// precedence over Uid and the user of the image.
+	User string `json:"user,omitempty"`
 }
 
 // Apply 'y' to 'x', returning a new structure.  'y' trumps.
@@ -112,16 +134,32 @@ func (x ContainerConfig) Merge(y ContainerConfig) ContainerConfig {
 	if y.Uid != 0 {
 		x.Uid = y.Uid
 	}
+	if y.User != "" {
+		x.User = y.User
+	}
 	x.HostNetwork = x.HostNetwork || y.HostNetwork
+	if y.Liveness != nil {
+		x.Liveness = y.Liveness
+	}
+	if y.KillTimeout != 0 {
+		x.KillTimeout = y.KillTimeout
+	}
 	return x
 }
 
 type Port struct {
+	Name    string   `json:"name,omitempty"`
 	Port    int      `json:"port,omitempty"`
 	Proto   string   `json:"proto,omitempty"`
 	Service *Service `json:"service,omitempty"`
 }
 
+// PortEnv returns the environment variable which is set to the allocated
+// port with the given name, e.g. PORT_METRICS for "metrics".
+func PortEnv(name string) string {
+	return "PORT_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
 type Service struct {
 	Name string `json:"name,omitempty"`
 	// Create the service in service discovery
@@ -153,6 +191,33 @@ type HealthCheck struct {
 	Status int    `json:"status.omitempty"`
 }
 
+// LivenessCheck is a check which is run periodically against a running job.
+// Once it fails Threshold times in a row the job is killed, so that it is
+// restarted, and a health_check_failed event is emitted.
+type LivenessCheck struct {
+	// Type is one of tcp, http or exec
+	Type string `json:"type,omitempty"`
+	// Port is the port tcp and http checks connect to, it defaults to the
+	// first port of the job.
+	Port int `json:"port,omitempty"`
+	// Path is the path requested by http checks, which pass if it responds
+	// with a 200 status.
+	Path string `json:"path,omitempty"`
+	// Cmd is the command exec checks run in the container, which pass if it
+	// exits zero.
+	Cmd []string `json:"cmd,omitempty"`
+	// Interval is the time between checks. It defaults to ten seconds.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Timeout is how long each check may take. It defaults to two seconds.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Threshold is the number of consecutive failures after which the job
+	// is killed. It defaults to 3.
+	Threshold int `json:"threshold,omitempty"`
+	// StartTimeout is how long after the job starts checks begin. It
+	// defaults to thirty seconds.
+	StartTimeout time.Duration `json:"start_timeout,omitempty"`
+}
+
 type Mount struct {
 	Location  string `json:"location,omitempty"`
 	Target    string `json:"target,omitempty"`
@@ -170,6 +235,35 @@ type VolumeBinding struct {
 type Artifact struct {
 	URI  string `json:"url,omitempty"`
 	Type string `json:"type,omitempty"`
+	// Digest is the SHA-256 digest of the image in the form
+	// "sha256:<hex>", the job fails to start if the fetched image doesn't
+	// match it.
+	Digest string `json:"digest,omitempty"`
+	// Credentials authenticate pulls of the image from a private
+	// registry, they are not persisted by the host.
+	Credentials *RegistryCredentials `json:"credentials,omitempty"`
+}
+
+type RegistryCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// HostPorts are the host ports allocated to jobs using the host network.
+type HostPorts struct {
+	// RangeStart and RangeEnd bound the ports allocated to jobs which
+	// don't request a specific port.
+	RangeStart int `json:"range_start"`
+	RangeEnd   int `json:"range_end"`
+	// Reserved ports are never allocated to jobs which don't request them.
+	Reserved  []int            `json:"reserved"`
+	Allocated []PortAllocation `json:"allocated"`
+}
+
+type PortAllocation struct {
+	Port  int    `json:"port"`
+	Proto string `json:"proto"`
+	JobID string `json:"job_id"`
 }
 
 type Host struct {
@@ -177,14 +271,48 @@ type Host struct {
 
 	Jobs     []*Job            `json:"jobs,omitempty"`
 	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Unschedulable hosts are not given new jobs by the scheduler, except
+	// for jobs which run on every host. It is set while a host is drained.
+	Unschedulable bool `json:"unschedulable,omitempty"`
+}
+
+// ResourceUsage is the resource utilization of a job or of a whole host. CPU
+// time and network bytes are counters, so rates are found by comparing two
+// samples.
+type ResourceUsage struct {
+	CPUTime    uint64 `json:"cpu_time"`     // in nanoseconds
+	Memory     uint64 `json:"memory"`       // in bytes
+	Disk       uint64 `json:"disk"`         // in bytes
+	NetRxBytes uint64 `json:"net_rx_bytes"` // received
+	NetTxBytes uint64 `json:"net_tx_bytes"` // transmitted
+}
+
+// HostMetrics is a sample of the resource utilization of a host and of each
+// of its running jobs.
+type HostMetrics struct {
+	HostID      string                    `json:"host_id,omitempty"`
+	Time        time.Time                 `json:"time"`
+	Host        ResourceUsage             `json:"host"`
+	MemoryTotal uint64                    `json:"memory_total"` // in bytes
+	DiskTotal   uint64                    `json:"disk_total"`   // in bytes
+	CPUs        int                       `json:"cpus"`
+	Jobs        map[string]*ResourceUsage `json:"jobs"`
 }
 
+// Event is a job state change. Events have monotonically increasing IDs which
+// start from the time the host started, so IDs are not reused after a restart.
 type Event struct {
+	ID    int64      `json:"id,omitempty"`
 	Event string     `json:"event,omitempty"`
 	JobID string     `json:"job_id,omitempty"`
 	Job   *ActiveJob `json:"job,omitempty"`
 }
 
+func (e Event) EventID() string {
+	return strconv.FormatInt(e.ID, 10)
+}
+
 type HostEvent struct {
 	Event  string `json:"event,omitempty"`
 	HostID string `json:"host_id,omitempty"`
@@ -202,6 +330,10 @@ type ActiveJob struct {
 	ExitStatus  int       `json:"exit_status,omitempty"`
 	Error       *string   `json:"error,omitempty"`
 	ManifestID  string    `json:"manifest_id,omitempty"`
+
+	// StopOptions are the options a job which was stopped while it was
+	// starting is stopped with once it is running.
+	StopOptions *StopOptions `json:"stop_options,omitempty"`
 }
 
 type AttachReq struct {
@@ -209,6 +341,103 @@ type AttachReq struct {
 	Flags  AttachFlag `json:"flags,omitempty"`
 	Height uint16     `json:"height,omitempty"`
 	Width  uint16     `json:"width,omitempty"`
+
+	// Lines limits the buffered log to the most recent lines when
+	// AttachFlagLogs is set.
+	Lines int `json:"lines,omitempty"`
+	// Since skips buffered log lines written before the given time.
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// DefaultStopGracePeriod is how long a stopped job is given to exit before it
+// is killed.
+const DefaultStopGracePeriod = 10 * time.Second
+
+// MaxStopGracePeriod is the longest a stopped job is given to exit, so that a
+// job can't be left running indefinitely once it has been stopped.
+const MaxStopGracePeriod = 10 * time.Minute
+
+var stopSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+}
+
+// StopOptions control how a job is stopped, a nil *StopOptions sends SIGTERM
+// and kills the job after its KillTimeout or DefaultStopGracePeriod.
+type StopOptions struct {
+	// Signal is the name of the signal the job is sent, TERM, QUIT or KILL.
+	Signal string `json:"signal,omitempty"`
+	// GracePeriod is how long the job is given to exit before it is sent
+	// SIGKILL.
+	GracePeriod time.Duration `json:"grace_period,omitempty"`
+}
+
+// StopOptionsFromQuery parses the signal and grace_period parameters of a stop
+// request, it returns nil if neither is set.
+func StopOptionsFromQuery(q url.Values) (*StopOptions, error) {
+	if q.Get("signal") == "" && q.Get("grace_period") == "" {
+		return nil, nil
+	}
+	opts := &StopOptions{Signal: strings.ToUpper(strings.TrimPrefix(q.Get("signal"), "SIG"))}
+	if opts.Signal != "" {
+		if _, ok := stopSignals[opts.Signal]; !ok {
+			return nil, fmt.Errorf("signal must be TERM, QUIT or KILL, got %q", q.Get("signal"))
+		}
+	}
+	if s := q.Get("grace_period"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("grace_period must be a duration such as 30s, got %q", s)
+		}
+		if d > MaxStopGracePeriod {
+			return nil, fmt.Errorf("grace_period must be at most %s, got %q", MaxStopGracePeriod, s)
+		}
+		opts.GracePeriod = d
+	}
+	return opts, nil
+}
+
+// Query returns the parameters of a stop request with the options.
+func (o *StopOptions) Query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	if o.Signal != "" {
+		q.Set("signal", o.Signal)
+	}
+	if o.GracePeriod > 0 {
+		q.Set("grace_period", o.GracePeriod.String())
+	}
+	return q
+}
+
+// Sig returns the signal the job is sent, SIGTERM by default.
+func (o *StopOptions) Sig() syscall.Signal {
+	if o == nil || o.Signal == "" {
+		return syscall.SIGTERM
+	}
+	if sig, ok := stopSignals[o.Signal]; ok {
+		return sig
+	}
+	return syscall.SIGTERM
+}
+
+// Grace returns the grace period before a job with the given config is
+// killed, which is at most MaxStopGracePeriod.
+func (o *StopOptions) Grace(config *ContainerConfig) time.Duration {
+	grace := DefaultStopGracePeriod
+	switch {
+	case o != nil && o.GracePeriod > 0:
+		grace = o.GracePeriod
+	case config != nil && config.KillTimeout > 0:
+		grace = config.KillTimeout
+	}
+	if grace > MaxStopGracePeriod {
+		grace = MaxStopGracePeriod
+	}
+	return grace
 }
 
 type AttachFlag uint8
@@ -25,6 +25,7 @@ func (api *HTTPAPI) RegisterRoutes(r *httprouter.Router) {
 	r.POST("/storage/providers/:provider_id/volumes", api.Create)
 	r.GET("/storage/volumes", api.List)
 	r.GET("/storage/volumes/:volume_id", api.Inspect)
+	r.DELETE("/storage/volumes/:volume_id", api.Destroy)
 	r.PUT("/storage/volumes/:volume_id/snapshot", api.Snapshot)
 }
 
@@ -109,6 +110,21 @@ func (api *HTTPAPI) Inspect(w http.ResponseWriter, r *http.Request, ps httproute
 	httphelper.JSON(w, 200, vol.Info())
 }
 
+func (api *HTTPAPI) Destroy(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	volumeID := ps.ByName("volume_id")
+	if err := api.vman.DestroyVolume(volumeID); err == volumemanager.NoSuchVolume {
+		httphelper.Error(w, httphelper.JSONError{
+			Code:    httphelper.ObjectNotFoundError,
+			Message: fmt.Sprintf("No volume by id %q", volumeID),
+		})
+		return
+	} else if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
 func (api *HTTPAPI) Snapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// TODO
 }
@@ -47,6 +47,7 @@ func New(defProvFn func() (volume.Provider, error)) (*Manager, error) {
 }
 
 var NoSuchProvider = errors.New("no such provider")
+var NoSuchVolume = errors.New("no such volume")
 var ProviderAlreadyExists = errors.New("that provider id already exists")
 
 func (m *Manager) AddProvider(id string, p volume.Provider) error {
@@ -106,6 +107,28 @@ func (m *Manager) GetVolume(id string) volume.Volume {
 	return m.volumes[id]
 }
 
+/*
+	Destroys the volume with the given id and its data, and forgets any name it was given.
+*/
+func (m *Manager) DestroyVolume(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	v, ok := m.volumes[id]
+	if !ok {
+		return NoSuchVolume
+	}
+	if err := v.Destroy(); err != nil {
+		return err
+	}
+	delete(m.volumes, id)
+	for name, volID := range m.namedVolumes {
+		if volID == id {
+			delete(m.namedVolumes, name)
+		}
+	}
+	return nil
+}
+
 /*
 	Proxies `volume.Provider` while making sure the manager remains
 	apprised of all volume lifecycle events.
@@ -24,6 +24,9 @@ type Volume interface {
 	Mount(jobId, path string) (string, error)
 
 	TakeSnapshot() (Volume, error)
+
+	// Destroy permanently removes the volume and its data.
+	Destroy() error
 }
 
 /*
@@ -149,6 +149,14 @@ func (v *zfsVolume) Mount(jobId, path string) (string, error) {
 	return v.basemount, nil
 }
 
+func (v *zfsVolume) Destroy() error {
+	dataset, err := zfs.GetDataset(path.Join(v.poolName, v.info.ID))
+	if err != nil {
+		return err
+	}
+	return dataset.Destroy(zfs.DestroyRecursive | zfs.DestroyForceUmount)
+}
+
 func (v1 *zfsVolume) TakeSnapshot() (volume.Volume, error) {
 	id := random.UUID()
 	v2 := &zfsVolume{
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/julienschmidt/httprouter"
+	"github.com/flynn/flynn/logaggregator/types"
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// Aggregator buffers the log messages forwarded by the hosts in a ring buffer
+// per app.
+type Aggregator struct {
+	bufferSize int
+
+	mtx     sync.Mutex
+	buffers map[string]*Buffer
+}
+
+// NewAggregator returns an aggregator which buffers up to bufferSize messages
+// of each app.
+func NewAggregator(bufferSize int) *Aggregator {
+	return &Aggregator{
+		bufferSize: bufferSize,
+		buffers:    make(map[string]*Buffer),
+	}
+}
+
+// Buffer returns the buffer of the app, creating it if create is set and
+// it doesn't exist.
+func (a *Aggregator) Buffer(appID string, create bool) *Buffer {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	b, ok := a.buffers[appID]
+	if !ok && create {
+		b = NewBuffer(a.bufferSize)
+		a.buffers[appID] = b
+	}
+	return b
+}
+
+func (a *Aggregator) Handler() http.Handler {
+	r := httprouter.New()
+	r.POST("/log", a.ForwardLog)
+	r.GET("/log/:app_id", a.GetLog)
+	return r
+}
+
+// ForwardLog adds the newline separated messages in the request body to the
+// buffers of their apps. Hosts keep the request open to forward the output of
+// their jobs as it is written.
+func (a *Aggregator) ForwardLog(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	dec := json.NewDecoder(req.Body)
+	for {
+		msg := &logagg.Message{}
+		if err := dec.Decode(msg); err != nil {
+			if err != io.EOF {
+				httphelper.Error(w, httphelper.JSONError{Code: httphelper.ValidationError, Message: err.Error()})
+				return
+			}
+			break
+		}
+		if msg.AppID == "" {
+			continue
+		}
+		a.Buffer(msg.AppID, true).Add(msg)
+	}
+	w.WriteHeader(200)
+}
+
+// GetLog streams the buffered messages of an app as newline separated JSON
+// objects, the most recent ones if the lines parameter is set. If the follow
+// parameter is set, new messages are streamed until the client disconnects.
+func (a *Aggregator) GetLog(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	var lines int
+	if s := req.FormValue("lines"); s != "" {
+		var err error
+		lines, err = strconv.Atoi(s)
+		if err != nil || lines < 1 {
+			httphelper.Error(w, httphelper.JSONError{Code: httphelper.ValidationError, Message: "lines must be a positive integer"})
+			return
+		}
+	}
+	follow := req.FormValue("follow") == "true"
+
+	appID := params.ByName("app_id")
+	buf := a.Buffer(appID, follow)
+	if buf == nil {
+		httphelper.Error(w, httphelper.JSONError{Code: httphelper.NotFoundError, Message: "no log for app " + appID})
+		return
+	}
+
+	var ch chan *logagg.Message
+	var messages []*logagg.Message
+	if follow {
+		ch = make(chan *logagg.Message, 1000)
+		messages = buf.ReadAndSubscribe(lines, ch)
+		defer buf.Unsubscribe(ch)
+	} else {
+		messages = buf.Read(lines)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	enc := json.NewEncoder(httphelper.FlushWriter{Writer: w, Enabled: follow})
+	for _, msg := range messages {
+		if err := enc.Encode(msg); err != nil {
+			return
+		}
+	}
+	if !follow {
+		return
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				// the client fell behind, it reconnects to continue
+				return
+			}
+			if err := enc.Encode(msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
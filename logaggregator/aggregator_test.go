@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
+	"github.com/flynn/flynn/logaggregator/client"
+	"github.com/flynn/flynn/logaggregator/types"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func newMessage(appID, msg string, t time.Time) *logagg.Message {
+	return &logagg.Message{AppID: appID, Stream: logagg.StreamStdout, Timestamp: t, Msg: msg}
+}
+
+func messageText(messages []*logagg.Message) []string {
+	res := make([]string, len(messages))
+	for i, m := range messages {
+		res[i] = m.Msg
+	}
+	return res
+}
+
+func (S) TestBufferCapacity(c *C) {
+	b := NewBuffer(3)
+	now := time.Now()
+	for i, msg := range []string{"a", "b", "c", "d", "e"} {
+		b.Add(newMessage("app", msg, now.Add(time.Duration(i)*time.Second)))
+	}
+	c.Assert(messageText(b.Read(0)), DeepEquals, []string{"c", "d", "e"})
+	c.Assert(messageText(b.Read(2)), DeepEquals, []string{"d", "e"})
+	c.Assert(messageText(b.Read(10)), DeepEquals, []string{"c", "d", "e"})
+}
+
+func (S) TestBufferOrder(c *C) {
+	b := NewBuffer(4)
+	now := time.Now()
+	b.Add(newMessage("app", "b", now.Add(2*time.Second)))
+	b.Add(newMessage("app", "c", now.Add(3*time.Second)))
+	// a message from a host whose clock is behind
+	b.Add(newMessage("app", "a", now.Add(time.Second)))
+	b.Add(newMessage("app", "d", now.Add(4*time.Second)))
+	c.Assert(messageText(b.Read(0)), DeepEquals, []string{"a", "b", "c", "d"})
+
+	// the oldest message is replaced once the buffer is full
+	b.Add(newMessage("app", "e", now.Add(5*time.Second)))
+	c.Assert(messageText(b.Read(0)), DeepEquals, []string{"b", "c", "d", "e"})
+}
+
+func (S) TestBufferSubscribe(c *C) {
+	b := NewBuffer(10)
+	now := time.Now()
+	b.Add(newMessage("app", "a", now))
+
+	ch := make(chan *logagg.Message, 1)
+	c.Assert(messageText(b.ReadAndSubscribe(0, ch)), DeepEquals, []string{"a"})
+	b.Add(newMessage("app", "b", now.Add(time.Second)))
+	c.Assert((<-ch).Msg, Equals, "b")
+
+	// slow subscribers are dropped
+	b.Add(newMessage("app", "c", now.Add(2*time.Second)))
+	b.Add(newMessage("app", "d", now.Add(3*time.Second)))
+	c.Assert((<-ch).Msg, Equals, "c")
+	_, ok := <-ch
+	c.Assert(ok, Equals, false)
+}
+
+func (S) TestForwardAndGetLog(c *C) {
+	srv := httptest.NewServer(NewAggregator(100).Handler())
+	defer srv.Close()
+	client := client.NewWithAddr(strings.TrimPrefix(srv.URL, "http://"))
+
+	_, err := client.GetLog("app1", nil)
+	c.Assert(err, NotNil)
+
+	now := time.Now().UTC()
+	msgs := make(chan *logagg.Message, 3)
+	msgs <- newMessage("app1", "one", now)
+	msgs <- newMessage("app2", "other", now)
+	msgs <- newMessage("app1", "two", now.Add(time.Second))
+	close(msgs)
+	c.Assert(client.Forward(msgs), IsNil)
+
+	read := func(opts *logagg.LogOpts, n int) []string {
+		rc, err := client.GetLog("app1", opts)
+		c.Assert(err, IsNil)
+		defer rc.Close()
+		dec := json.NewDecoder(rc)
+		var messages []*logagg.Message
+		for i := 0; i < n; i++ {
+			msg := &logagg.Message{}
+			c.Assert(dec.Decode(msg), IsNil)
+			messages = append(messages, msg)
+		}
+		return messageText(messages)
+	}
+	c.Assert(read(nil, 2), DeepEquals, []string{"one", "two"})
+	c.Assert(read(&logagg.LogOpts{Lines: 1}, 1), DeepEquals, []string{"two"})
+
+	// followers receive new messages
+	rc, err := client.GetLog("app1", &logagg.LogOpts{Lines: 1, Follow: true})
+	c.Assert(err, IsNil)
+	defer rc.Close()
+	dec := json.NewDecoder(rc)
+	msg := &logagg.Message{}
+	c.Assert(dec.Decode(msg), IsNil)
+	c.Assert(msg.Msg, Equals, "two")
+	msgs = make(chan *logagg.Message, 1)
+	msgs <- newMessage("app1", "three", now.Add(2*time.Second))
+	close(msgs)
+	c.Assert(client.Forward(msgs), IsNil)
+	c.Assert(dec.Decode(msg), IsNil)
+	c.Assert(msg.Msg, Equals, "three")
+}
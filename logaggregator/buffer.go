@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/flynn/flynn/logaggregator/types"
+)
+
+// Buffer is a bounded ring buffer of the most recent log messages of an app,
+// ordered by their timestamp.
+type Buffer struct {
+	mtx sync.RWMutex
+	// messages holds the buffered messages, starting at head once it is
+	// full
+	messages []*logagg.Message
+	head     int
+	capacity int
+
+	subscribers map[chan *logagg.Message]struct{}
+}
+
+// NewBuffer returns a buffer which holds up to capacity messages.
+func NewBuffer(capacity int) *Buffer {
+	return &Buffer{
+		messages:    make([]*logagg.Message, 0, capacity),
+		capacity:    capacity,
+		subscribers: make(map[chan *logagg.Message]struct{}),
+	}
+}
+
+// Add adds msg to the buffer, replacing the oldest message if the buffer is
+// full, and sends it to the subscribers. A message which is older than the
+// newest buffered messages, for example because it was sent by a host whose
+// clock is behind, is inserted in order.
+func (b *Buffer) Add(msg *logagg.Message) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if len(b.messages) < b.capacity {
+		b.messages = append(b.messages, msg)
+	} else {
+		b.messages[b.head] = msg
+		b.head = (b.head + 1) % b.capacity
+	}
+	// move the message back until it is in order
+	n := len(b.messages)
+	for i := n - 1; i > 0; i-- {
+		cur, prev := b.index(i), b.index(i-1)
+		if !b.messages[cur].Timestamp.Before(b.messages[prev].Timestamp) {
+			break
+		}
+		b.messages[cur], b.messages[prev] = b.messages[prev], b.messages[cur]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			// the subscriber is too slow to keep up, so close its
+			// channel rather than holding up the other subscribers
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// index returns the index in b.messages of the ith oldest message.
+func (b *Buffer) index(i int) int {
+	return (b.head + i) % len(b.messages)
+}
+
+// Read returns up to lines of the most recent messages, oldest first. All
+// buffered messages are returned if lines is zero.
+func (b *Buffer) Read(lines int) []*logagg.Message {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	return b.read(lines)
+}
+
+func (b *Buffer) read(lines int) []*logagg.Message {
+	n := len(b.messages)
+	if lines <= 0 || lines > n {
+		lines = n
+	}
+	res := make([]*logagg.Message, lines)
+	for i := range res {
+		res[i] = b.messages[b.index(n-lines+i)]
+	}
+	return res
+}
+
+// ReadAndSubscribe returns up to lines of the most recent messages like Read,
+// and sends the messages added after them to ch. ch is closed if it isn't
+// ready to receive a message when it is added.
+func (b *Buffer) ReadAndSubscribe(lines int, ch chan *logagg.Message) []*logagg.Message {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.subscribers[ch] = struct{}{}
+	return b.read(lines)
+}
+
+// Unsubscribe stops sending messages to ch.
+func (b *Buffer) Unsubscribe(ch chan *logagg.Message) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
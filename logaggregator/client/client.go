@@ -0,0 +1,96 @@
+// Package client provides a client for the log aggregator API.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/flynn/flynn/logaggregator/types"
+	"github.com/flynn/flynn/pkg/httpclient"
+)
+
+// ErrNotFound is returned when the log aggregator has no log for an app.
+var ErrNotFound = errors.New("logaggregator: log not found")
+
+type client struct {
+	*httpclient.Client
+}
+
+// New returns a client for the leader of the log aggregator service, which
+// is the instance the hosts forward messages to.
+func New() Client {
+	return newClient("http://leader.logaggregator.discoverd")
+}
+
+// NewWithAddr returns a client for the log aggregator at addr.
+func NewWithAddr(addr string) Client {
+	return newClient(fmt.Sprintf("http://%s", addr))
+}
+
+func newClient(url string) *client {
+	return &client{Client: &httpclient.Client{
+		ErrNotFound: ErrNotFound,
+		URL:         url,
+		HTTP:        http.DefaultClient,
+	}}
+}
+
+// Client is a client for the log aggregator API.
+type Client interface {
+	// GetLog returns a stream of the buffered log messages of an app,
+	// encoded as newline separated JSON objects. If opts.Follow is set, new
+	// messages are streamed until the stream is closed.
+	GetLog(appID string, opts *logagg.LogOpts) (io.ReadCloser, error)
+	// Forward sends the messages received from msgs to the log aggregator
+	// until msgs is closed, returning an error if the connection fails.
+	Forward(msgs <-chan *logagg.Message) error
+}
+
+func (c *client) GetLog(appID string, opts *logagg.LogOpts) (io.ReadCloser, error) {
+	path := fmt.Sprintf("/log/%s", appID)
+	if opts != nil {
+		q := make(url.Values)
+		if opts.Lines > 0 {
+			q.Set("lines", strconv.Itoa(opts.Lines))
+		}
+		if opts.Follow {
+			q.Set("follow", "true")
+		}
+		if len(q) > 0 {
+			path += "?" + q.Encode()
+		}
+	}
+	res, err := c.RawReq("GET", path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (c *client) Forward(msgs <-chan *logagg.Message) error {
+	r, w := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(w)
+		for msg := range msgs {
+			if err := enc.Encode(msg); err != nil {
+				// the request failed, the error is returned by
+				// RawReq
+				return
+			}
+		}
+		w.Close()
+	}()
+	res, err := c.RawReq("POST", "/log", nil, r, nil)
+	// unblock the encoder if the request failed before the body was read
+	r.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/shutdown"
+)
+
+var (
+	listenPort = flag.String("p", "5000", "Port to listen on")
+	bufferSize = flag.Int("n", 10000, "Number of messages to buffer per app")
+)
+
+func main() {
+	defer shutdown.Exit()
+
+	flag.Parse()
+
+	addr := os.Getenv("PORT")
+	if addr == "" {
+		addr = *listenPort
+	}
+	addr = ":" + addr
+
+	hb, err := discoverd.AddServiceAndRegister("logaggregator", addr)
+	if err != nil {
+		shutdown.Fatal(err)
+	}
+	shutdown.BeforeExit(func() { hb.Close() })
+
+	log.Printf("Log aggregator listening on %s, buffering %d messages per app", addr, *bufferSize)
+	shutdown.Fatal(http.ListenAndServe(addr, NewAggregator(*bufferSize).Handler()))
+}
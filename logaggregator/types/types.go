@@ -0,0 +1,40 @@
+// Package logagg contains the types of the log aggregator API.
+package logagg
+
+import "time"
+
+// Message is a line of output written by a job, or by a platform component
+// if Source is set.
+type Message struct {
+	AppID     string `json:"app_id"`
+	HostID    string `json:"host_id,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	ReleaseID string `json:"release_id,omitempty"`
+	// ProcessType is empty for one-off jobs.
+	ProcessType string    `json:"process_type,omitempty"`
+	Stream      Stream    `json:"stream"`
+	Timestamp   time.Time `json:"timestamp"`
+	Msg         string    `json:"msg"`
+	// Source is the platform component which wrote the message, such as
+	// SourceDeployer, it is empty for the output of jobs.
+	Source string `json:"source,omitempty"`
+}
+
+// SourceDeployer is the source of deployment progress messages.
+const SourceDeployer = "deployer"
+
+type Stream string
+
+const (
+	StreamStdout Stream = "stdout"
+	StreamStderr Stream = "stderr"
+)
+
+// LogOpts are the options of a request for the log of an app.
+type LogOpts struct {
+	// Lines is the number of the most recent buffered messages which are
+	// returned, all of them are returned if it is zero.
+	Lines int
+	// Follow streams new messages after the buffered ones.
+	Follow bool
+}
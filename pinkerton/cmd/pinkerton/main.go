@@ -17,12 +17,14 @@ Usage:
   pinkerton pull [options] <image-url>
   pinkerton checkout [options] <id> <image-id>
   pinkerton cleanup [options] <id>
+  pinkerton digest [options] <image-id>
   pinkerton -h | --help
 
 Commands:
   pull      Download a Docker image
   checkout  Create a working copy of an image
   cleanup   Destroy a working copy of an image
+  digest    Print the SHA-256 digest of a pulled image
 
 Examples:
   pinkerton pull https://registry.hub.docker.com?name=redis
@@ -30,6 +32,7 @@ Examples:
   pinkerton pull https://registry.hub.docker.com?name=flynn/slugrunner&id=1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton checkout slugrunner-test 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton cleanup slugrunner-test
+  pinkerton digest 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
 
 Options:
   -h, --help       show this message and exit
@@ -71,6 +74,12 @@ Options:
 		if err := ctx.Cleanup(args.String["<id>"]); err != nil {
 			log.Fatal(err)
 		}
+	case args.Bool["digest"]:
+		digest, err := ctx.ImageDigest(args.String["<image-id>"])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(digest)
 	}
 }
 
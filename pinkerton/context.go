@@ -78,9 +78,15 @@ func (c *Context) pull(url string, session registry.Session, progress chan<- lay
 		}
 	}
 
+	// touching layers only affects the order in which they are evicted, so
+	// errors are ignored. Images with layers which have no digest are
+	// pulled so that the digests are recorded.
 	if id := session.ImageID(); id != "" && c.Exists(id) {
-		sendProgress(id, layer.StatusExists)
-		return nil
+		if _, err := c.ImageDigest(id); err == nil {
+			c.Touch(id)
+			sendProgress(id, layer.StatusExists)
+			return nil
+		}
 	}
 
 	image, err := session.GetImage()
@@ -96,6 +102,9 @@ func (c *Context) pull(url string, session registry.Session, progress chan<- lay
 	for i := len(layers) - 1; i >= 0; i-- {
 		l := layers[i]
 		if c.Exists(l.ID) {
+			if err := c.AddDigest(l); err != nil {
+				return err
+			}
 			sendProgress(l.ID, layer.StatusExists)
 			continue
 		}
@@ -110,6 +119,9 @@ func (c *Context) pull(url string, session registry.Session, progress chan<- lay
 		}
 		sendProgress(l.ID, status)
 	}
+	if len(layers) > 0 {
+		c.Touch(layers[0].ID)
+	}
 
 	// TODO: update sizes
 
@@ -117,6 +129,7 @@ func (c *Context) pull(url string, session registry.Session, progress chan<- lay
 }
 
 func (c *Context) Checkout(id, imageID string) (string, error) {
+	c.Touch(imageID)
 	id = "tmp-" + id
 	if err := c.driver.Create(id, imageID); err != nil {
 		return "", err
@@ -1,14 +1,20 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/graphdriver"
 	"github.com/flynn/flynn/pinkerton/registry"
@@ -66,7 +72,10 @@ func (s *Store) Add(img *registry.Image) (err error) {
 		return err
 	}
 
-	size, err := s.driver.ApplyDiff(img.ID, img.ParentID, img)
+	// the layer is hashed as it is applied so that image digests can be
+	// verified, see ImageDigest
+	h := sha256.New()
+	size, err := s.driver.ApplyDiff(img.ID, img.ParentID, io.TeeReader(img, h))
 	if err != nil {
 		return err
 	}
@@ -74,6 +83,9 @@ func (s *Store) Add(img *registry.Image) (err error) {
 	if err := ioutil.WriteFile(filepath.Join(tmp, "layersize"), strconv.AppendInt(nil, size, 10), 0600); err != nil {
 		return err
 	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "digest"), []byte(hex.EncodeToString(h.Sum(nil))), 0600); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(filepath.Join(tmp, "json"), os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return err
@@ -86,6 +98,155 @@ func (s *Store) Add(img *registry.Image) (err error) {
 	return os.Rename(tmp, s.root(img.ID))
 }
 
+var ErrNoDigest = errors.New("store: layer has no digest")
+
+// ImageDigest returns the SHA-256 digest of the image with the given ID, in
+// the form "sha256:<hex>". It is the hash of the digests of the image's layers
+// (as downloaded from the registry), in order from the base layer, so it
+// changes if the content of any layer changes.
+//
+// Layers which were added before digests were recorded have no digest until
+// it is recorded by AddDigest, and ErrNoDigest is returned.
+func (s *Store) ImageDigest(id string) (string, error) {
+	var digests []string
+	for id != "" {
+		digest, err := ioutil.ReadFile(filepath.Join(s.root(id), "digest"))
+		if os.IsNotExist(err) {
+			return "", ErrNoDigest
+		} else if err != nil {
+			return "", err
+		}
+		digests = append(digests, string(digest))
+
+		img, err := s.image(id)
+		if err != nil {
+			return "", err
+		}
+		id = img.ParentID
+	}
+
+	h := sha256.New()
+	for i := len(digests) - 1; i >= 0; i-- {
+		fmt.Fprintln(h, digests[i])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AddDigest records the digest of a layer which was added before digests were
+// recorded, by downloading it again and hashing it as Add does, so that the
+// digests of images don't depend on whether their layers were cached. It does
+// nothing if the layer already has a digest.
+func (s *Store) AddDigest(img *registry.Image) error {
+	defer img.Close()
+	if err := s.lock(img.ID); err != nil {
+		return err
+	}
+	defer s.unlock(img.ID)
+
+	path := filepath.Join(s.root(img.ID), "digest")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, img); err != nil {
+		return err
+	}
+	tmp, err := s.tempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "digest"), []byte(hex.EncodeToString(h.Sum(nil))), 0600); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(tmp, "digest"), path)
+}
+
+// Layer describes a layer in the store.
+type Layer struct {
+	ID       string
+	ParentID string
+	// Size is the size of the layer's diff in bytes
+	Size int64
+	// LastUsed is when the layer was last pulled, added or checked out
+	LastUsed time.Time
+}
+
+// Layers returns the layers in the store.
+func (s *Store) Layers() ([]*Layer, error) {
+	entries, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]*Layer, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), "_") {
+			continue
+		}
+		img, err := s.image(e.Name())
+		if err != nil {
+			// the layer is being removed
+			continue
+		}
+		l := &Layer{ID: img.ID, ParentID: img.ParentID, LastUsed: e.ModTime()}
+		if size, err := ioutil.ReadFile(filepath.Join(s.root(l.ID), "layersize")); err == nil {
+			l.Size, _ = strconv.ParseInt(string(size), 10, 64)
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+// Touch records that the layer with the given ID and its ancestors have been
+// used, so that they are evicted after layers which haven't been used since.
+func (s *Store) Touch(id string) error {
+	now := time.Now()
+	for id != "" {
+		if err := os.Chtimes(s.root(id), now, now); err != nil {
+			return err
+		}
+		img, err := s.image(id)
+		if err != nil {
+			return err
+		}
+		id = img.ParentID
+	}
+	return nil
+}
+
+// Remove removes the layer with the given ID. The caller must ensure that the
+// layer has no children and is not checked out.
+func (s *Store) Remove(id string) error {
+	if err := s.lock(id); err != nil {
+		return err
+	}
+	defer s.unlock(id)
+
+	// the metadata is removed first so that a partially removed layer is
+	// no longer considered to exist
+	tmp, err := s.tempDir()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(s.root(id), filepath.Join(tmp, id)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	return s.driver.Remove(id)
+}
+
+func (s *Store) image(id string) (*registry.Image, error) {
+	f, err := os.Open(filepath.Join(s.root(id), "json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img := &registry.Image{}
+	return img, json.NewDecoder(f).Decode(img)
+}
+
 func (s *Store) Exists(id string) bool {
 	_, err := os.Stat(s.root(id))
 	return err == nil
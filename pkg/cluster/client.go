@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -26,6 +27,14 @@ var Attempts = attempt.Strategy{
 	Delay: 200 * time.Millisecond,
 }
 
+// AuthKey is the key used to authenticate with hosts, which require it if
+// they were started with CLUSTER_AUTH_KEY set. It defaults to the value of
+// CLUSTER_AUTH_KEY and must not be modified after the first client is created.
+//
+// The key is sent as Basic authentication over plain HTTP, so it can be read
+// by anything which sees the traffic to hosts.
+var AuthKey = os.Getenv("CLUSTER_AUTH_KEY")
+
 // NewClient uses discoverd to dial the local cluster leader and returns
 // a client.
 func NewClient() (*Client, error) {
@@ -58,6 +67,7 @@ func newClient(services ServiceFunc) (*Client, error) {
 	c := &httpclient.Client{
 		ErrNotFound: ErrNotFound,
 		HTTP:        http.DefaultClient,
+		Key:         AuthKey,
 	}
 	return &Client{service: s, c: c, leaderChange: make(chan struct{})}, nil
 }
@@ -186,6 +196,16 @@ func (c *Client) RemoveJob(hostID, jobID string) error {
 	return c.c.Delete(fmt.Sprintf("/cluster/hosts/%s/jobs/%s", hostID, jobID))
 }
 
+// SetHostUnschedulable marks the host with the given id as unschedulable, so
+// the scheduler stops placing new jobs on it, or as schedulable again.
+func (c *Client) SetHostUnschedulable(id string, unschedulable bool) error {
+	path := fmt.Sprintf("/cluster/hosts/%s/unschedulable", id)
+	if unschedulable {
+		return c.c.Put(path, nil, nil)
+	}
+	return c.c.Delete(path)
+}
+
 // StreamHostEvents sends a stream of host events from the host to the provided channel.
 func (c *Client) StreamHostEvents(output chan<- *host.HostEvent) (stream.Stream, error) {
 	return c.c.Stream("GET", "/cluster/events", nil, output)
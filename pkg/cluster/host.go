@@ -1,14 +1,17 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/host/volume"
 	"github.com/flynn/flynn/pinkerton/layer"
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/stream"
 )
 
@@ -23,13 +26,25 @@ type Host interface {
 	// GetJob retrieves job details by ID.
 	GetJob(id string) (*host.ActiveJob, error)
 
-	// StopJob stops a running job.
+	// StopJob stops a running job. It returns once the job has been
+	// signalled, the job's stop event is sent once it has exited.
 	StopJob(id string) error
 
+	// StopJobWithOptions stops a running job, sending it the given signal
+	// and killing it if it hasn't exited after the grace period. Like
+	// StopJob it doesn't wait for the job to exit.
+	StopJobWithOptions(id string, opts *host.StopOptions) error
+
 	// StreamEvents about job state changes to ch. id may be "all" or a single
 	// job ID.
 	StreamEvents(id string, ch chan<- *host.Event) (stream.Stream, error)
 
+	// StreamEventsSince streams events like StreamEvents, sending the
+	// recent events after the event with ID since first so that a dropped
+	// stream can be resumed without missing events. ErrEventsMissed is
+	// returned if the host no longer has the events after since.
+	StreamEventsSince(id string, since int64, ch chan<- *host.Event) (stream.Stream, error)
+
 	// Attach attaches to a job, optionally waiting for it to start before
 	// attaching.
 	Attach(req *host.AttachReq, wait bool) (AttachClient, error)
@@ -38,6 +53,17 @@ type Host interface {
 	// When in doubt, use a providerId of "default".
 	CreateVolume(providerId string) (*volume.Info, error)
 
+	// DestroyVolume destroys the volume with the given ID and its data.
+	DestroyVolume(id string) error
+
+	// Metrics samples the resource utilization of the host and its running
+	// jobs.
+	Metrics() (*host.HostMetrics, error)
+
+	// Ports returns the allocation range and reserved ports of the host,
+	// and the host ports allocated to jobs using the host network.
+	Ports() (*host.HostPorts, error)
+
 	// PullImages pulls images from a TUF repository using the local TUF file in tufDB
 	PullImages(repository, driver, root string, tufDB io.Reader, ch chan<- *layer.PullInfo) (stream.Stream, error)
 }
@@ -59,6 +85,7 @@ func NewHostClient(id string, addr string, h *http.Client) Host {
 			ErrNotFound: ErrNotFound,
 			URL:         addr,
 			HTTP:        h,
+			Key:         AuthKey,
 		},
 	}
 }
@@ -80,23 +107,63 @@ func (c *hostClient) GetJob(id string) (*host.ActiveJob, error) {
 }
 
 func (c *hostClient) StopJob(id string) error {
-	return c.c.Delete(fmt.Sprintf("/host/jobs/%s", id))
+	return c.StopJobWithOptions(id, nil)
+}
+
+func (c *hostClient) StopJobWithOptions(id string, opts *host.StopOptions) error {
+	path := fmt.Sprintf("/host/jobs/%s", id)
+	if q := opts.Query(); len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return c.c.Delete(path)
 }
 
 func (c *hostClient) StreamEvents(id string, ch chan<- *host.Event) (stream.Stream, error) {
+	return c.StreamEventsSince(id, 0, ch)
+}
+
+func (c *hostClient) StreamEventsSince(id string, since int64, ch chan<- *host.Event) (stream.Stream, error) {
 	r := fmt.Sprintf("/host/jobs/%s", id)
 	if id == "all" {
 		r = "/host/jobs"
 	}
-	return c.c.Stream("GET", r, nil, ch)
+	if since > 0 {
+		r += "?since=" + strconv.FormatInt(since, 10)
+	}
+	stream, err := c.c.Stream("GET", r, nil, ch)
+	if e, ok := err.(httphelper.JSONError); ok && e.Code == httphelper.PreconditionFailedError {
+		return nil, ErrEventsMissed
+	}
+	return stream, err
 }
 
+// ErrEventsMissed is returned by StreamEventsSince when the host no longer has
+// the events after the given ID, e.g. because it has restarted, so the state
+// of its jobs must be fetched again.
+var ErrEventsMissed = errors.New("cluster: host events have been missed")
+
 func (c *hostClient) CreateVolume(providerId string) (*volume.Info, error) {
 	var res volume.Info
 	err := c.c.Post(fmt.Sprintf("/storage/providers/%s/volumes", providerId), nil, &res)
 	return &res, err
 }
 
+func (c *hostClient) DestroyVolume(id string) error {
+	return c.c.Delete(fmt.Sprintf("/storage/volumes/%s", id))
+}
+
+func (c *hostClient) Metrics() (*host.HostMetrics, error) {
+	var res host.HostMetrics
+	err := c.c.Get("/host/metrics", &res)
+	return &res, err
+}
+
+func (c *hostClient) Ports() (*host.HostPorts, error) {
+	var res host.HostPorts
+	err := c.c.Get("/host/ports", &res)
+	return &res, err
+}
+
 func (c *hostClient) PullImages(repository, driver, root string, tufDB io.Reader, ch chan<- *layer.PullInfo) (stream.Stream, error) {
 	header := http.Header{"Content-Type": {"application/octet-stream"}}
 	path := fmt.Sprintf("/host/pull-images?repository=%s&driver=%s&root=%s", repository, driver, root)
@@ -38,11 +38,7 @@ const (
 	headerRequestHeaders = "Access-Control-Request-Headers"
 )
 
-var (
-	defaultAllowHeaders = []string{"Origin", "Accept", "Content-Type", "Authorization"}
-	// Regex patterns are generated from AllowOrigins. These are used and generated internally.
-	allowOriginPatterns = []string{}
-)
+var defaultAllowHeaders = []string{"Origin", "Accept", "Content-Type", "Authorization"}
 
 // Represents Access Control options.
 type Options struct {
@@ -60,6 +56,10 @@ type Options struct {
 	ExposeHeaders []string
 	// Max age of the CORS headers.
 	MaxAge time.Duration
+
+	// Regex patterns are generated from AllowOrigins by Allow. These are
+	// used and generated internally.
+	allowOriginPatterns []*regexp.Regexp
 }
 
 // Converts options into CORS headers.
@@ -102,13 +102,12 @@ func (o *Options) Header(origin string) (headers map[string]string) {
 // Looks up if the origin matches one of the patterns
 // generated from Options.AllowOrigins patterns.
 func (o *Options) IsOriginAllowed(origin string) (allowed bool) {
-	for _, pattern := range allowOriginPatterns {
-		allowed, _ = regexp.MatchString(pattern, origin)
-		if allowed {
-			return
+	for _, pattern := range o.allowOriginPatterns {
+		if pattern.MatchString(origin) {
+			return true
 		}
 	}
-	return
+	return false
 }
 
 // Allows CORS for requests those match the provided options.
@@ -122,7 +121,7 @@ func Allow(opts *Options) http.HandlerFunc {
 		pattern := regexp.QuoteMeta(origin)
 		pattern = strings.Replace(pattern, "\\*", ".*", -1)
 		pattern = strings.Replace(pattern, "\\?", ".", -1)
-		allowOriginPatterns = append(allowOriginPatterns, "^"+pattern+"$")
+		opts.allowOriginPatterns = append(opts.allowOriginPatterns, regexp.MustCompile("^"+pattern+"$"))
 	}
 
 	return func(res http.ResponseWriter, req *http.Request) {
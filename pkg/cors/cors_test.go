@@ -78,6 +78,26 @@ func Test_AllowRegexNoMatch(t *testing.T) {
 	}
 }
 
+func Test_AllowOriginsNotShared(t *testing.T) {
+	Allow(&Options{
+		AllowOrigins: []string{"https://aaa.com"},
+	})
+	recorder := httptest.NewRecorder()
+	m := martini.New()
+	m.Use(Allow(&Options{
+		AllowOrigins: []string{"https://bbb.com"},
+	}))
+
+	r, _ := http.NewRequest("PUT", "foo", nil)
+	r.Header.Add("Origin", "https://aaa.com")
+	m.ServeHTTP(recorder, r)
+
+	headerValue := recorder.HeaderMap.Get(headerAllowOrigin)
+	if headerValue != "" {
+		t.Errorf("Allow-Origin header should not exist, found %v", headerValue)
+	}
+}
+
 func Test_OtherHeaders(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	m := martini.New()
@@ -29,11 +29,16 @@ type ReadWriteCloser interface {
 }
 
 type Client struct {
+	// ErrNotFound is returned for 404 responses which don't have a JSON error
+	// body or have a not found error code.
 	ErrNotFound error
 	URL         string
 	Key         string
 	HTTP        *http.Client
 	HijackDial  DialFunc
+	// Header is sent with every request unless the request sets the same
+	// header itself.
+	Header http.Header
 }
 
 func ToJSON(v interface{}) (io.Reader, error) {
@@ -65,6 +70,11 @@ func (c *Client) prepareReq(method, path string, header http.Header, in interfac
 	if header.Get("Content-Type") == "" {
 		header.Set("Content-Type", "application/json")
 	}
+	for k, v := range c.Header {
+		if _, ok := header[k]; !ok {
+			header[k] = v
+		}
+	}
 	req.Header = header
 	if c.Key != "" {
 		req.SetBasicAuth("", c.Key)
@@ -81,11 +91,14 @@ func (c *Client) RawReq(method, path string, header http.Header, in, out interfa
 	if err != nil {
 		return nil, err
 	}
-	if res.StatusCode != 200 {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
 		defer res.Body.Close()
 		if strings.Contains(res.Header.Get("Content-Type"), "application/json") {
 			var jsonErr httphelper.JSONError
 			if err := json.NewDecoder(res.Body).Decode(&jsonErr); err == nil {
+				if res.StatusCode == 404 && c.ErrNotFound != nil && isNotFound(jsonErr) {
+					return res, c.ErrNotFound
+				}
 				return res, jsonErr
 			}
 		}
@@ -190,3 +203,7 @@ func (c *Client) Get(path string, out interface{}) error {
 func (c *Client) Delete(path string) error {
 	return c.Send("DELETE", path, nil, nil)
 }
+
+func isNotFound(err httphelper.JSONError) bool {
+	return err.Code == httphelper.NotFoundError || err.Code == httphelper.ObjectNotFoundError
+}
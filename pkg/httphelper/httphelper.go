@@ -3,7 +3,10 @@ package httphelper
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"reflect"
 	"time"
@@ -21,9 +24,16 @@ const (
 	NotFoundError           ErrorCode = "not_found"
 	ObjectNotFoundError     ErrorCode = "object_not_found"
 	ObjectExistsError       ErrorCode = "object_exists"
+	UnauthorizedError       ErrorCode = "unauthorized"
+	ForbiddenError          ErrorCode = "forbidden"
+	RateLimitedError        ErrorCode = "rate_limited"
 	SyntaxError             ErrorCode = "syntax_error"
 	ValidationError         ErrorCode = "validation_error"
 	PreconditionFailedError ErrorCode = "precondition_failed"
+	RequestTimeoutError     ErrorCode = "request_timeout"
+	RequestTooLargeError    ErrorCode = "request_too_large"
+	CapacityError           ErrorCode = "insufficient_capacity"
+	ServiceUnavailableError ErrorCode = "service_unavailable"
 	UnknownError            ErrorCode = "unknown_error"
 )
 
@@ -31,26 +41,64 @@ var errorResponseCodes = map[ErrorCode]int{
 	NotFoundError:           404,
 	ObjectNotFoundError:     404,
 	ObjectExistsError:       409,
+	UnauthorizedError:       401,
+	ForbiddenError:          403,
+	RateLimitedError:        429,
 	PreconditionFailedError: 412,
+	RequestTimeoutError:     408,
+	RequestTooLargeError:    413,
+	CapacityError:           409,
+	ServiceUnavailableError: 503,
 	SyntaxError:             400,
 	ValidationError:         400,
 	UnknownError:            500,
 }
 
+// retryableErrors are the error codes of transient failures, requests which
+// fail with them can be retried.
+var retryableErrors = map[ErrorCode]bool{
+	ServiceUnavailableError: true,
+	RateLimitedError:        true,
+}
+
+// JSONError is the body of an error response. Code identifies the kind of
+// error so that clients can handle it programmatically.
 type JSONError struct {
-	Code    ErrorCode       `json:"code"`
-	Message string          `json:"message"`
-	Detail  json.RawMessage `json:"detail,omitempty"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Field is the request field which caused a validation error, if any.
+	Field string `json:"field,omitempty"`
+	// Retryable is whether the request can be retried, as the error is
+	// transient.
+	Retryable bool            `json:"retryable,omitempty"`
+	Detail    json.RawMessage `json:"detail,omitempty"`
+}
+
+// IsRetryable reports whether err is a JSONError for a transient failure.
+func IsRetryable(err error) bool {
+	switch v := err.(type) {
+	case JSONError:
+		return v.Retryable
+	case *JSONError:
+		return v.Retryable
+	}
+	return false
+}
+
+// CORSOptions returns the default CORS policy of the API servers, which allows
+// all origins.
+func CORSOptions() *cors.Options {
+	return &cors.Options{
+		AllowAllOrigins:  true,
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
+		AllowHeaders:     []string{"Authorization", "Accept", "Content-Type", "If-Match", "If-None-Match", "Idempotency-Key", "Flynn-API-Version"},
+		ExposeHeaders:    []string{"ETag", "Idempotent-Replayed", "Flynn-API-Version", "Warning"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
 }
 
-var CORSAllowAllHandler = cors.Allow(&cors.Options{
-	AllowAllOrigins:  true,
-	AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
-	AllowHeaders:     []string{"Authorization", "Accept", "Content-Type", "If-Match", "If-None-Match"},
-	ExposeHeaders:    []string{"ETag"},
-	AllowCredentials: true,
-	MaxAge:           time.Hour,
-})
+var CORSAllowAllHandler = cors.Allow(CORSOptions())
 
 // Handler is an extended version of http.Handler that also takes a context
 // argument ctx.
@@ -118,7 +166,8 @@ func buildJSONError(err error) *JSONError {
 	case JSONError:
 		jsonError = &v
 	case *JSONError:
-		jsonError = v
+		e := *v
+		jsonError = &e
 	default:
 		jsonError = &JSONError{
 			Code:    UnknownError,
@@ -134,6 +183,9 @@ func Error(w http.ResponseWriter, err error) {
 		if jsonError.Code == UnknownError {
 			logError(w, err)
 		}
+		if retryableErrors[jsonError.Code] {
+			jsonError.Retryable = true
+		}
 		responseCode, ok := errorResponseCodes[jsonError.Code]
 		if !ok {
 			responseCode = 500
@@ -163,7 +215,75 @@ func JSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Write(result)
 }
 
+// MaxJSONBodySize is the maximum size of a request body decoded by
+// DecodeJSON.
+var MaxJSONBodySize int64 = 10 << 20
+
+// DecodeJSON decodes the JSON request body into i. Bodies larger than
+// MaxJSONBodySize are rejected with a RequestTooLargeError, and a timeout
+// reading the body is returned as a RequestTimeoutError.
 func DecodeJSON(req *http.Request, i interface{}) error {
-	dec := json.NewDecoder(req.Body)
-	return dec.Decode(i)
+	body, err := limitJSONBody(req)
+	if err != nil {
+		return err
+	}
+	return readBodyError(json.NewDecoder(body).Decode(i))
+}
+
+// ReadJSONBody reads a JSON request body which isn't decoded by DecodeJSON,
+// e.g. to inspect it first, with the same size limit and errors.
+func ReadJSONBody(req *http.Request) ([]byte, error) {
+	body, err := limitJSONBody(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(body)
+	return data, readBodyError(err)
+}
+
+// limitJSONBody returns the request body limited to MaxJSONBodySize.
+func limitJSONBody(req *http.Request) (io.Reader, error) {
+	if req.ContentLength > MaxJSONBodySize {
+		return nil, requestTooLarge()
+	}
+	return &maxBytesReader{r: req.Body, remaining: MaxJSONBodySize}, nil
+}
+
+// readBodyError converts a timeout reading a request body (e.g. because the
+// read deadline of the connection passed) to a RequestTimeoutError.
+func readBodyError(err error) error {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return JSONError{Code: RequestTimeoutError, Message: "timed out reading the request body"}
+	}
+	return err
+}
+
+func requestTooLarge() error {
+	return JSONError{
+		Code:    RequestTooLargeError,
+		Message: fmt.Sprintf("the request body must be at most %d bytes", MaxJSONBodySize),
+	}
+}
+
+// maxBytesReader reads from r, returning a RequestTooLargeError if it has more
+// than remaining bytes.
+type maxBytesReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.remaining <= 0 {
+		var b [1]byte
+		if n, _ := m.r.Read(b[:]); n > 0 {
+			return 0, requestTooLarge()
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > m.remaining {
+		p = p[:m.remaining]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	return n, err
 }
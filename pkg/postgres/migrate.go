@@ -1,10 +1,18 @@
 package postgres
 
-import "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+import (
+	"fmt"
+	"sort"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+)
 
 type Migration struct {
 	ID    int
 	Stmts []string
+	// Down are the statements which revert the migration, migrations
+	// without them can't be rolled back.
+	Down []string
 }
 
 func NewMigrations() *Migrations {
@@ -18,6 +26,18 @@ func (m *Migrations) Add(id int, stmts ...string) {
 	*m = append(*m, Migration{ID: id, Stmts: stmts})
 }
 
+// AddDown sets the statements which revert the migration with the given ID,
+// which must already have been added.
+func (m Migrations) AddDown(id int, stmts ...string) {
+	for i := range m {
+		if m[i].ID == id {
+			m[i].Down = stmts
+			return
+		}
+	}
+	panic(fmt.Sprintf("postgres: AddDown called for unknown migration %d", id))
+}
+
 func (m Migrations) Migrate(db *sql.DB) error {
 	var initialized bool
 	for _, migration := range m {
@@ -63,3 +83,135 @@ func (m Migrations) Migrate(db *sql.DB) error {
 	}
 	return nil
 }
+
+// MigrationStatus is the state of a migration in a database.
+type MigrationStatus struct {
+	ID      int
+	Applied bool
+	// Known is false for migrations which have been applied to the
+	// database but aren't in the list, e.g. those added by a newer version
+	// of the program.
+	Known      bool
+	Reversible bool
+}
+
+// Status returns the status of the migrations in the list and of any other
+// migrations applied to db, ordered by ID.
+func (m Migrations) Status(db *sql.DB) ([]*MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[int]*MigrationStatus, len(m))
+	for _, migration := range m {
+		_, ok := applied[migration.ID]
+		statuses[migration.ID] = &MigrationStatus{
+			ID:         migration.ID,
+			Applied:    ok,
+			Known:      true,
+			Reversible: len(migration.Down) > 0,
+		}
+	}
+	for id := range applied {
+		if _, ok := statuses[id]; !ok {
+			statuses[id] = &MigrationStatus{ID: id, Applied: true}
+		}
+	}
+	list := make([]*MigrationStatus, 0, len(statuses))
+	for _, s := range statuses {
+		list = append(list, s)
+	}
+	sort.Sort(migrationStatusesByID(list))
+	return list, nil
+}
+
+type migrationStatusesByID []*MigrationStatus
+
+func (s migrationStatusesByID) Len() int           { return len(s) }
+func (s migrationStatusesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s migrationStatusesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func appliedMigrations(db *sql.DB) (map[int]struct{}, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (id bigint PRIMARY KEY)"); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT id FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]struct{})
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		applied[id] = struct{}{}
+	}
+	return applied, rows.Err()
+}
+
+// Rollback reverts the applied migrations with IDs greater than target, newest
+// first, and returns their IDs. The migrations are reverted in a single
+// transaction, so if any of them is unknown or can't be reverted none are, and
+// if dryRun is true the transaction is always rolled back, which checks the
+// down migrations succeed without changing the database.
+func (m Migrations) Rollback(db *sql.DB, target int, dryRun bool) ([]int, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (id bigint PRIMARY KEY)"); err != nil {
+		return nil, err
+	}
+	migrations := make(map[int]Migration, len(m))
+	for _, migration := range m {
+		migrations[migration.ID] = migration
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE schema_migrations IN ACCESS EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT id FROM schema_migrations WHERE id > $1 ORDER BY id DESC", target)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		migration, ok := migrations[id]
+		if !ok {
+			return nil, fmt.Errorf("postgres: migration %d is unknown", id)
+		}
+		if len(migration.Down) == 0 {
+			return nil, fmt.Errorf("postgres: migration %d can't be rolled back", id)
+		}
+	}
+	for _, id := range ids {
+		for _, s := range migrations[id].Down {
+			if _, err := tx.Exec(s); err != nil {
+				return nil, fmt.Errorf("postgres: error rolling back migration %d: %s", id, err)
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM schema_migrations WHERE id = $1", id); err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return ids, nil
+	}
+	return ids, tx.Commit()
+}
@@ -3,15 +3,26 @@ package resource
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type Resource struct {
 	ID  string            `json:"id"`
 	Env map[string]string `json:"env"`
+	// CreatedAt is set by providers which record when resources were
+	// provisioned, it is only returned when listing resources.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
+// client is used for requests to providers which should return quickly, so that
+// an unresponsive provider doesn't block callers indefinitely.
+var client = &http.Client{Timeout: 30 * time.Second}
+
 func Provision(uri string, config []byte) (*Resource, error) {
 	res, err := http.Post(uri, "application/json", bytes.NewBuffer(config))
 	if err != nil {
@@ -28,3 +39,91 @@ func Provision(uri string, config []byte) (*Resource, error) {
 	}
 	return resource, nil
 }
+
+// ErrNotSupported is returned when a provider doesn't support listing or
+// deprovisioning resources.
+var ErrNotSupported = errors.New("resource: not supported by the provider")
+
+// List makes a GET request to the provider uri, which responds with the
+// resources it has provisioned. The env of listed resources may omit secrets
+// such as passwords.
+func List(uri string) ([]*Resource, error) {
+	res, err := client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 || res.StatusCode == 405 {
+		return nil, ErrNotSupported
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	}
+
+	var resources []*Resource
+	if err := json.NewDecoder(res.Body).Decode(&resources); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// Deprovision makes a DELETE request to the resource's ID, which providers set
+// to a path on the host of the provider uri.
+func Deprovision(uri, id string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(id)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", u.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200, 204:
+		return nil
+	case 405:
+		return ErrNotSupported
+	}
+	return fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+}
+
+// Status is returned by a provider's ping endpoint.
+type Status struct {
+	Version string `json:"version,omitempty"`
+}
+
+// Ping makes a GET request to the /ping endpoint on the host of the provider
+// uri. Providers may optionally respond with a JSON encoded Status.
+func Ping(uri string) (*Status, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/ping"
+	u.RawQuery = ""
+	res, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	}
+
+	status := &Status{}
+	if strings.Contains(res.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
@@ -4,6 +4,12 @@ import "fmt"
 
 var commit, branch, tag, dirty string
 
+// Commit returns the git commit the binary was built from, which is empty
+// for development builds.
+func Commit() string {
+	return commit
+}
+
 func String() string {
 	if commit == "" {
 		return "dev"
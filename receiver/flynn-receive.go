@@ -97,18 +97,30 @@ func main() {
 
 	release := &ct.Release{
 		ArtifactID: artifact.ID,
+		AppID:      prevRelease.AppID,
 		Env:        prevRelease.Env,
+		CreatedBy:  "git push",
+	}
+	if len(os.Args) > 2 {
+		release.Description = "Build of git revision " + os.Args[2]
 	}
 	procs := make(map[string]ct.ProcessType)
 	for _, t := range types {
 		proc := prevRelease.Processes[t]
 		proc.Cmd = []string{"start", t}
 		if t == "web" {
+			// keep the service name of the previous release, so that
+			// routes of apps created before web services were named
+			// after app IDs keep working
+			service := ct.AppWebService(app.ID)
+			if ports := prevRelease.Processes["web"].Ports; len(ports) > 0 && ports[0].Service != nil {
+				service = ports[0].Service.Name
+			}
 			proc.Ports = []ct.Port{{
 				Port:  8080,
 				Proto: "tcp",
 				Service: &host.Service{
-					Name:   app.Name + "-web",
+					Name:   service,
 					Create: true,
 					Check:  &host.HealthCheck{Type: "tcp"},
 				},
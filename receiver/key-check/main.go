@@ -1,28 +1,30 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"log"
 	"os"
 
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/crypto/ssh"
 	"github.com/flynn/flynn/controller/client"
 )
 
 func main() {
-	key := os.Args[2]
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(os.Args[2]))
+	if err != nil {
+		log.Fatalln("Error parsing key:", err)
+	}
+	digest := md5.Sum(pubKey.Marshal())
 
 	client, err := controller.NewClient("", os.Getenv("CONTROLLER_AUTH_KEY"))
 	if err != nil {
 		log.Fatalln("Unable to connect to controller:", err)
 	}
-	keys, err := client.KeyList()
-	if err != nil {
-		log.Fatalln("Error retrieving key list:", err)
-	}
-
-	for _, authKey := range keys {
-		if key == authKey.Key {
-			os.Exit(0)
-		}
+	if _, err := client.GetKeyByFingerprint(hex.EncodeToString(digest[:])); err == controller.ErrNotFound {
+		os.Exit(1)
+	} else if err != nil {
+		log.Fatalln("Error retrieving key:", err)
 	}
-	os.Exit(1)
+	os.Exit(0)
 }
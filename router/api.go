@@ -5,10 +5,12 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/binding"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/render"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/pprof"
 	"github.com/flynn/flynn/router/types"
 )
@@ -25,8 +27,14 @@ func apiHandler(rtr *Router) http.Handler {
 
 	r.Post("/routes", binding.Bind(router.Route{}), createRoute)
 	r.Put("/routes/:route_type/:id", binding.Bind(router.Route{}), updateRoute)
+	r.Post("/routes/:route_type/batch", binding.Bind(router.RouteBatch{}), applyRoutes)
 	r.Get("/routes", getRoutes)
 	r.Get("/routes/:route_type/:id", getRoute)
+	r.Get("/stats/http", getHTTPStats)
+	r.Get("/backends/:addr", getBackend)
+	r.Put("/backends/:addr/drain", drainBackend)
+	r.Delete("/backends/:addr/drain", undrainBackend)
+	r.Post("/cookie_keys/rotate", rotateCookieKeys)
 	r.Delete("/routes/:route_type/:id", deleteRoute)
 	r.Any("/debug/**", pprof.Handler.ServeHTTP)
 	return m
@@ -40,6 +48,14 @@ func createRoute(req *http.Request, route router.Route, router *Router, r render
 	}
 
 	if err := l.AddRoute(&route); err != nil {
+		if _, ok := err.(invalidRouteError); ok {
+			r.JSON(400, err.Error())
+			return
+		}
+		if err == ErrConflict {
+			r.JSON(409, conflictError())
+			return
+		}
 		log.Println(err)
 		r.JSON(500, "unknown error")
 		return
@@ -58,6 +74,10 @@ func updateRoute(params martini.Params, route router.Route, router *Router, r re
 	}
 
 	if err := l.UpdateRoute(&route); err != nil {
+		if _, ok := err.(invalidRouteError); ok {
+			r.JSON(400, err.Error())
+			return
+		}
 		log.Println(err)
 		r.JSON(500, "unknown error")
 		return
@@ -65,6 +85,55 @@ func updateRoute(params martini.Params, route router.Route, router *Router, r re
 	r.JSON(200, route)
 }
 
+func applyRoutes(params martini.Params, batch router.RouteBatch, rtr *Router, r render.Render) {
+	routeType := params["route_type"]
+	l := listenerFor(rtr, routeType)
+	if l == nil {
+		r.JSON(400, "Invalid route type")
+		return
+	}
+	for _, routes := range [][]*router.Route{batch.Add, batch.Update, batch.Remove} {
+		for _, route := range routes {
+			if route.Type == "" {
+				route.Type = routeType
+			}
+			if route.Type != routeType {
+				r.JSON(400, "Route type does not match batch")
+				return
+			}
+		}
+	}
+
+	if err := l.ApplyRoutes(&batch); err != nil {
+		if _, ok := err.(invalidRouteError); ok {
+			r.JSON(400, err.Error())
+			return
+		}
+		if err == ErrConflict {
+			r.JSON(409, conflictError())
+			return
+		}
+		if err == ErrNotFound {
+			r.JSON(404, "not found")
+			return
+		}
+		log.Println(err)
+		r.JSON(500, "unknown error")
+		return
+	}
+	r.JSON(200, batch)
+}
+
+// conflictError returns the body of the response to a request which adds a
+// route whose domain or port is already used, it is a JSON error so that
+// clients can tell it apart from other errors.
+func conflictError() httphelper.JSONError {
+	return httphelper.JSONError{
+		Code:    httphelper.ObjectExistsError,
+		Message: ErrConflict.Error(),
+	}
+}
+
 func listenerFor(router *Router, typ string) Listener {
 	switch typ {
 	case "http":
@@ -152,3 +221,79 @@ func deleteRoute(params martini.Params, router *Router, r render.Render) {
 
 	r.JSON(200, "unknown error")
 }
+
+func getHTTPStats(rtr *Router, r render.Render) {
+	l, ok := rtr.HTTP.(interface {
+		Stats() []*router.HTTPRouteStats
+	})
+	if !ok {
+		r.JSON(200, []*router.HTTPRouteStats{})
+		return
+	}
+	r.JSON(200, l.Stats())
+}
+
+// maxDrainTimeout is the longest a backend can be drained for, so that a
+// backend which is never stopped doesn't stay drained.
+const maxDrainTimeout = 10 * time.Minute
+
+func backendStatus(rtr *Router, addr string) *router.BackendStatus {
+	draining, inFlight := rtr.Backends.Status(addr)
+	return &router.BackendStatus{Addr: addr, Draining: draining, InFlight: inFlight}
+}
+
+func getBackend(params martini.Params, rtr *Router, r render.Render) {
+	if rtr.Backends == nil {
+		r.JSON(404, "not found")
+		return
+	}
+	r.JSON(200, backendStatus(rtr, params["addr"]))
+}
+
+func drainBackend(req *http.Request, params martini.Params, rtr *Router, r render.Render) {
+	if rtr.Backends == nil {
+		r.JSON(404, "not found")
+		return
+	}
+	timeout := maxDrainTimeout
+	if s := req.URL.Query().Get("timeout"); s != "" {
+		t, err := time.ParseDuration(s)
+		if err != nil || t <= 0 {
+			r.JSON(400, "Invalid drain timeout")
+			return
+		}
+		if t < timeout {
+			timeout = t
+		}
+	}
+	rtr.Backends.Drain(params["addr"], timeout)
+	r.JSON(200, backendStatus(rtr, params["addr"]))
+}
+
+func undrainBackend(params martini.Params, rtr *Router, r render.Render) {
+	if rtr.Backends == nil {
+		r.JSON(404, "not found")
+		return
+	}
+	rtr.Backends.Undrain(params["addr"])
+	r.JSON(200, backendStatus(rtr, params["addr"]))
+}
+
+func rotateCookieKeys(rtr *Router, r render.Render) {
+	l, ok := rtr.HTTP.(interface {
+		RotateCookieKeys() error
+	})
+	if !ok {
+		r.JSON(404, "not found")
+		return
+	}
+	if err := l.RotateCookieKeys(); err != nil {
+		if err == errNoCookieKeyStore {
+			r.JSON(400, err.Error())
+			return
+		}
+		r.JSON(500, "unknown error")
+		return
+	}
+	r.JSON(200, struct{}{})
+}
@@ -96,6 +96,10 @@ func (s *S) TestAPIAddHTTPRoute(c *C) {
 	c.Assert(getHTTPRoute.Service, Equals, "test")
 	c.Assert(getHTTPRoute.Domain, Equals, "example.com")
 
+	// the domain can't be used by another route
+	err = srv.CreateRoute(router.HTTPRoute{Domain: "example.com", Service: "other"}.ToRoute())
+	c.Assert(err, Equals, client.ErrConflict)
+
 	err = srv.DeleteRoute("http", route.ID)
 	c.Assert(err, IsNil)
 	_, err = srv.GetRoute("http", route.ID)
@@ -148,3 +152,49 @@ func (s *S) TestAPIListRoutes(c *C) {
 	c.Assert(routes[1].ID, Equals, r1.ID)
 	c.Assert(routes[0].ID, Equals, r3.ID)
 }
+
+func (s *S) TestAPIApplyHTTPRoutes(c *C) {
+	srv := s.newTestAPIServer(c)
+	defer srv.Close()
+
+	r0 := router.HTTPRoute{Domain: "example.com", Service: "foo"}.ToRoute()
+	c.Assert(srv.CreateRoute(r0), IsNil)
+
+	// move example.com to a new route and add another domain
+	batch := &router.RouteBatch{
+		Remove: []*router.Route{{ID: r0.ID}},
+		Add: []*router.Route{
+			router.HTTPRoute{Domain: "example.com", Service: "bar"}.ToRoute(),
+			router.HTTPRoute{Domain: "example.net", Service: "bar"}.ToRoute(),
+		},
+	}
+	c.Assert(srv.ApplyRoutes("http", batch), IsNil)
+	c.Assert(batch.Add[0].ID, Not(Equals), "")
+	c.Assert(batch.Add[1].ID, Not(Equals), "")
+
+	routes, err := srv.ListRoutes("")
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+	for _, r := range routes {
+		c.Assert(r.Service, Equals, "bar")
+	}
+
+	// none of the changes are applied if any of them fail
+	err = srv.ApplyRoutes("http", &router.RouteBatch{
+		Remove: []*router.Route{{ID: r0.ID}},
+		Add:    []*router.Route{router.HTTPRoute{Domain: "example.org", Service: "bar"}.ToRoute()},
+	})
+	c.Assert(err, Equals, client.ErrNotFound)
+	err = srv.ApplyRoutes("http", &router.RouteBatch{
+		Update: []*router.Route{router.HTTPRoute{ID: batch.Add[0].ID, Domain: "example.com", Service: "baz"}.ToRoute()},
+		Add:    []*router.Route{router.HTTPRoute{Domain: "example.net", Service: "baz"}.ToRoute()},
+	})
+	c.Assert(err, Not(IsNil))
+
+	routes, err = srv.ListRoutes("")
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+	for _, r := range routes {
+		c.Assert(r.Service, Equals, "bar")
+	}
+}
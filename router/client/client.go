@@ -6,14 +6,20 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/router/types"
 )
 
 // ErrNotFound is returned when no route was found.
 var ErrNotFound = errors.New("router: route not found")
 
+// ErrConflict is returned when creating a route whose domain, or port or
+// server name for TCP routes, is already used by another route.
+var ErrConflict = errors.New("router: a route with the same domain, port or server name already exists")
+
 type client struct {
 	*httpclient.Client
 }
@@ -48,11 +54,16 @@ func NewWithAddr(addr string) Client {
 
 // Client is a client for the router API.
 type Client interface {
-	// CreateRoute creates a new route.
+	// CreateRoute creates a new route. It returns ErrConflict if the domain,
+	// or port or server name for TCP routes, is already used by another
+	// route.
 	CreateRoute(*router.Route) error
 	// UpdateRoute updates an existing route by overwriting all fields on the route
 	// except ID and Domain.
 	UpdateRoute(*router.Route) error
+	// ApplyRoutes atomically applies a batch of route changes for routes of the
+	// specified routeType, either all of the changes are applied or none are.
+	ApplyRoutes(routeType string, batch *router.RouteBatch) error
 	// DeleteRoute deletes the route with the specified routeType and id.
 	DeleteRoute(routeType, id string) error
 	// GetRoute returns a route with the specified routeType and id.
@@ -60,16 +71,44 @@ type Client interface {
 	// ListRoutes returns a list of routes. If parentRef is not empty, routes
 	// are filtered by the reference (ex: "controller/apps/myapp").
 	ListRoutes(parentRef string) ([]*router.Route, error)
+	// HTTPStats returns the number of requests the router instance has
+	// served for each HTTP route since it started.
+	HTTPStats() ([]*router.HTTPRouteStats, error)
+	// DrainBackend stops the router instance sending new requests to the
+	// backend with the specified addr for up to timeout, and returns the
+	// backend's status so that callers can wait for its in-flight requests.
+	DrainBackend(addr string, timeout time.Duration) (*router.BackendStatus, error)
+	// UndrainBackend resumes sending new requests to the backend with the
+	// specified addr.
+	UndrainBackend(addr string) error
+	// GetBackend returns the status of the backend with the specified addr.
+	GetBackend(addr string) (*router.BackendStatus, error)
+	// RotateCookieKeys adds a new key used to encrypt sticky session cookies,
+	// which all router instances sharing the database pick up.
+	RotateCookieKeys() error
 }
 
 func (c *client) CreateRoute(r *router.Route) error {
-	return c.Post("/routes", r, r)
+	return conflictError(c.Post("/routes", r, r))
 }
 
 func (c *client) UpdateRoute(r *router.Route) error {
 	return c.Put("/routes/"+r.Type+"/"+r.ID, r, r)
 }
 
+func (c *client) ApplyRoutes(routeType string, batch *router.RouteBatch) error {
+	return conflictError(c.Post("/routes/"+routeType+"/batch", batch, batch))
+}
+
+// conflictError returns ErrConflict if err is the error the router responds
+// with when a route conflicts with an existing one, and err otherwise.
+func conflictError(err error) error {
+	if e, ok := err.(httphelper.JSONError); ok && e.Code == httphelper.ObjectExistsError {
+		return ErrConflict
+	}
+	return err
+}
+
 func (c *client) DeleteRoute(routeType, id string) error {
 	return c.Delete("/routes/" + routeType + "/" + id)
 }
@@ -91,3 +130,29 @@ func (c *client) ListRoutes(parentRef string) ([]*router.Route, error) {
 	err := c.Get(path, &res)
 	return res, err
 }
+
+func (c *client) HTTPStats() ([]*router.HTTPRouteStats, error) {
+	var stats []*router.HTTPRouteStats
+	return stats, c.Get("/stats/http", &stats)
+}
+
+func (c *client) DrainBackend(addr string, timeout time.Duration) (*router.BackendStatus, error) {
+	q := make(url.Values)
+	q.Set("timeout", timeout.String())
+	res := &router.BackendStatus{}
+	err := c.Put("/backends/"+addr+"/drain?"+q.Encode(), nil, res)
+	return res, err
+}
+
+func (c *client) UndrainBackend(addr string) error {
+	return c.Delete("/backends/" + addr + "/drain")
+}
+
+func (c *client) GetBackend(addr string) (*router.BackendStatus, error) {
+	res := &router.BackendStatus{}
+	return res, c.Get("/backends/"+addr, res)
+}
+
+func (c *client) RotateCookieKeys() error {
+	return c.Post("/cookie_keys/rotate", nil, nil)
+}
@@ -0,0 +1,57 @@
+package client
+
+import "time"
+
+// DrainPollInterval is how often routers are polled for the requests in
+// flight to draining backends.
+var DrainPollInterval = 500 * time.Millisecond
+
+// DrainBackends drains the backends with the given addrs from every router so
+// they get no new requests, then waits up to timeout for their in-flight
+// requests to finish, returning how many are still in flight. Errors draining
+// a backend are passed to onError if it is not nil rather than stopping the
+// drain, since draining only reduces dropped requests.
+//
+// UndrainBackends should be called once the backends are stopped.
+func DrainBackends(routers []Client, addrs []string, timeout time.Duration, onError func(addr string, err error)) int {
+	if len(routers) == 0 || len(addrs) == 0 {
+		return 0
+	}
+	for _, r := range routers {
+		for _, addr := range addrs {
+			// the router stops draining on its own if the backend isn't
+			// stopped shortly after the timeout
+			if _, err := r.DrainBackend(addr, 2*timeout); err != nil && onError != nil {
+				onError(addr, err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := 0
+		for _, r := range routers {
+			for _, addr := range addrs {
+				if status, err := r.GetBackend(addr); err == nil {
+					inFlight += status.InFlight
+				}
+			}
+		}
+		if inFlight == 0 || time.Now().After(deadline) {
+			return inFlight
+		}
+		time.Sleep(DrainPollInterval)
+	}
+}
+
+// UndrainBackends resumes sending new requests to the backends with the given
+// addrs from every router, passing errors to onError if it is not nil.
+func UndrainBackends(routers []Client, addrs []string, onError func(addr string, err error)) {
+	for _, r := range routers {
+		for _, addr := range addrs {
+			if err := r.UndrainBackend(addr); err != nil && onError != nil {
+				onError(addr, err)
+			}
+		}
+	}
+}
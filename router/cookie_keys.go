@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/proxy"
+)
+
+// maxCookieKeys is the number of keys that are used to decrypt sticky cookies,
+// the newest key is used to encrypt cookies and the rest are kept so that
+// cookies encrypted before a rotation remain valid. Older keys are deleted
+// when the keys are rotated.
+const maxCookieKeys = 3
+
+// CookieKeyStore stores the keys used to encrypt sticky session cookies so
+// that a cookie set by one router instance can be decrypted by all of them.
+type CookieKeyStore interface {
+	// List returns the current keys, newest first.
+	List() ([]*[32]byte, error)
+	// Rotate adds a new key that is used to encrypt cookies, the previous keys
+	// are still used to decrypt cookies until they expire from the list.
+	Rotate() error
+	// Sync sets keys from the store, and updates them when the stored keys
+	// change until ctx is done.
+	Sync(ctx context.Context, keys *proxy.StickyKeys, startc chan<- struct{}) error
+}
+
+type pgCookieKeyStore struct {
+	pgx *pgx.ConnPool
+}
+
+const tableNameCookieKeys = "sticky_cookie_keys"
+
+// NewPostgresCookieKeyStore returns a CookieKeyStore that stores keys in a
+// Postgres database, generating an initial key if none exist.
+func NewPostgresCookieKeyStore(pgx *pgx.ConnPool) (*pgCookieKeyStore, error) {
+	d := &pgCookieKeyStore{pgx: pgx}
+	if _, err := d.pgx.Exec(sqlInitCookieKey, newCookieKey()); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func newCookieKey() string {
+	return base64.StdEncoding.EncodeToString(random.Bytes(32))
+}
+
+const sqlInitCookieKey = `
+INSERT INTO ` + tableNameCookieKeys + ` (key)
+	SELECT $1 WHERE NOT EXISTS (SELECT 1 FROM ` + tableNameCookieKeys + `)`
+
+const sqlLockCookieKeys = `LOCK TABLE ` + tableNameCookieKeys + ` IN SHARE ROW EXCLUSIVE MODE`
+
+const sqlRotateCookieKey = `INSERT INTO ` + tableNameCookieKeys + ` (key) VALUES ($1)`
+
+const sqlPruneCookieKeys = `
+DELETE FROM ` + tableNameCookieKeys + ` WHERE id NOT IN (
+	SELECT id FROM ` + tableNameCookieKeys + ` ORDER BY created_at DESC, id LIMIT $1
+)`
+
+// Rotate adds a new key and deletes the keys which are no longer in the newest
+// maxCookieKeys. The table is locked so that concurrent rotations don't prune
+// each other's keys.
+func (d *pgCookieKeyStore) Rotate() error {
+	tx, err := d.pgx.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{sqlLockCookieKeys, nil},
+		{sqlRotateCookieKey, []interface{}{newCookieKey()}},
+		{sqlPruneCookieKeys, []interface{}{maxCookieKeys}},
+	} {
+		if _, err := tx.Exec(q.sql, q.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const sqlListCookieKeys = `SELECT key FROM ` + tableNameCookieKeys + ` ORDER BY created_at DESC, id LIMIT $1`
+
+func (d *pgCookieKeyStore) List() ([]*[32]byte, error) {
+	rows, err := d.pgx.Query(sqlListCookieKeys, maxCookieKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*[32]byte
+	for rows.Next() {
+		var encoded string
+		if err := rows.Scan(&encoded); err != nil {
+			return nil, err
+		}
+		key, err := decodeCookieKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (d *pgCookieKeyStore) Sync(ctx context.Context, keys *proxy.StickyKeys, startc chan<- struct{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	idc, errc, err := startPGListener(ctx, d.pgx, tableNameCookieKeys)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if err := d.setKeys(keys); err != nil {
+		cancel()
+		return err
+	}
+	close(startc)
+
+	for {
+		select {
+		case <-idc:
+			if err := d.setKeys(keys); err != nil {
+				cancel()
+				return err
+			}
+		case err = <-errc:
+			return err
+		case <-ctx.Done():
+			<-idc
+			return nil
+		}
+	}
+}
+
+func (d *pgCookieKeyStore) setKeys(keys *proxy.StickyKeys) error {
+	list, err := d.List()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	keys.Set(list[0], list[1:]...)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -12,12 +13,17 @@ import (
 
 var ErrNotFound = errors.New("router: route not found")
 
+// ErrConflict is returned when adding a route whose domain, or port or server
+// name for TCP routes, is already used by another route.
+var ErrConflict = errors.New("router: a route with the same domain, port or server name already exists")
+
 type DataStore interface {
 	Add(route *router.Route) error
 	Update(route *router.Route) error
 	Get(id string) (*router.Route, error)
 	List() ([]*router.Route, error)
 	Remove(id string) error
+	Apply(batch *router.RouteBatch) error
 	Sync(ctx context.Context, h SyncHandler, startc chan<- struct{}) error
 }
 
@@ -29,6 +35,15 @@ type DataStoreReader interface {
 type SyncHandler interface {
 	Set(route *router.Route) error
 	Remove(id string) error
+	// Apply sets and removes the given routes as a single change.
+	Apply(set []*router.Route, remove []string) error
+}
+
+// pgQueryer is implemented by both *pgx.ConnPool and *pgx.Tx so that routes
+// can be changed either individually or as part of a batch.
+type pgQueryer interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+	QueryRow(sql string, args ...interface{}) *pgx.Row
 }
 
 type pgDataStore struct {
@@ -66,19 +81,30 @@ func NewPostgresDataStore(routeType string, pgx *pgx.ConnPool) *pgDataStore {
 }
 
 const sqlAddRouteHTTP = `
-INSERT INTO ` + tableNameHTTP + ` (parent_ref, service, domain, tls_cert, tls_key, sticky)
-	VALUES ($1, $2, $3, $4, $5, $6)
+INSERT INTO ` + tableNameHTTP + ` (parent_ref, service, domain, tls_cert, tls_key, sticky, path_rewrite_prefix, path_rewrite_replacement, mirror_service, mirror_percent, match_rules, filter_rules, maintenance, maintenance_page)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 	RETURNING id, created_at, updated_at`
 
 const sqlAddRouteTCP = `
-INSERT INTO ` + tableNameTCP + ` (parent_ref, service, port)
-	VALUES ($1, $2, $3)
+INSERT INTO ` + tableNameTCP + ` (parent_ref, service, port, server_name)
+	VALUES ($1, $2, $3, $4)
 	RETURNING id, created_at, updated_at`
 
-func (d *pgDataStore) Add(r *router.Route) (err error) {
+func (d *pgDataStore) Add(r *router.Route) error {
+	return d.add(d.pgx, r)
+}
+
+func (d *pgDataStore) add(q pgQueryer, r *router.Route) (err error) {
 	switch d.tableName {
 	case tableNameHTTP:
-		err = d.pgx.QueryRow(
+		var matchRules, filterRules string
+		if matchRules, err = marshalJSONColumn(r.MatchRules); err != nil {
+			return err
+		}
+		if filterRules, err = marshalJSONColumn(r.FilterRules); err != nil {
+			return err
+		}
+		err = q.QueryRow(
 			sqlAddRouteHTTP,
 			r.ParentRef,
 			r.Service,
@@ -86,51 +112,86 @@ func (d *pgDataStore) Add(r *router.Route) (err error) {
 			r.TLSCert,
 			r.TLSKey,
 			r.Sticky,
+			r.PathRewritePrefix,
+			r.PathRewriteReplacement,
+			r.MirrorService,
+			r.MirrorPercent,
+			matchRules,
+			filterRules,
+			r.Maintenance,
+			r.MaintenancePage,
 		).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
 	case tableNameTCP:
-		err = d.pgx.QueryRow(
+		err = q.QueryRow(
 			sqlAddRouteTCP,
 			r.ParentRef,
 			r.Service,
 			r.Port,
+			r.ServerName,
 		).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
 	}
 	r.Type = d.routeType
+	if e, ok := err.(pgx.PgError); ok && e.Code == "23505" {
+		// unique_violation of http_routes_domain_key, tcp_routes_port_key or
+		// tcp_routes_server_name_key
+		return ErrConflict
+	}
 	return err
 }
 
 const sqlUpdateRouteHTTP = `
-UPDATE ` + tableNameHTTP + ` SET parent_ref = $1, service = $2, tls_cert = $3, tls_key = $4, sticky = $5
-	WHERE id = $6 AND domain = $7 AND deleted_at IS NULL
+UPDATE ` + tableNameHTTP + ` SET parent_ref = $1, service = $2, tls_cert = $3, tls_key = $4, sticky = $5, path_rewrite_prefix = $6, path_rewrite_replacement = $7, mirror_service = $8, mirror_percent = $9, match_rules = $10, filter_rules = $11, maintenance = $12, maintenance_page = $13
+	WHERE id = $14 AND domain = $15 AND deleted_at IS NULL
 	RETURNING %s`
 
 const sqlUpdateRouteTCP = `
 UPDATE ` + tableNameTCP + ` SET parent_ref = $1, service = $2
-	WHERE id = $3 AND port = $4 AND deleted_at IS NULL
+	WHERE id = $3 AND port = $4 AND server_name = $5 AND deleted_at IS NULL
 	RETURNING %s`
 
 func (d *pgDataStore) Update(r *router.Route) error {
+	return d.update(d.pgx, r)
+}
+
+func (d *pgDataStore) update(q pgQueryer, r *router.Route) error {
 	var row *pgx.Row
 
 	switch d.tableName {
 	case tableNameHTTP:
-		row = d.pgx.QueryRow(
+		matchRules, err := marshalJSONColumn(r.MatchRules)
+		if err != nil {
+			return err
+		}
+		filterRules, err := marshalJSONColumn(r.FilterRules)
+		if err != nil {
+			return err
+		}
+		row = q.QueryRow(
 			fmt.Sprintf(sqlUpdateRouteHTTP, d.columnNames()),
 			r.ParentRef,
 			r.Service,
 			r.TLSCert,
 			r.TLSKey,
 			r.Sticky,
+			r.PathRewritePrefix,
+			r.PathRewriteReplacement,
+			r.MirrorService,
+			r.MirrorPercent,
+			matchRules,
+			filterRules,
+			r.Maintenance,
+			r.MaintenancePage,
 			r.ID,
 			r.Domain,
 		)
 	case tableNameTCP:
-		row = d.pgx.QueryRow(
+		row = q.QueryRow(
 			fmt.Sprintf(sqlUpdateRouteTCP, d.columnNames()),
 			r.ParentRef,
 			r.Service,
 			r.ID,
 			r.Port,
+			r.ServerName,
 		)
 	}
 	err := d.scanRoute(r, row)
@@ -140,10 +201,71 @@ func (d *pgDataStore) Update(r *router.Route) error {
 	return err
 }
 
-const sqlRemoveRoute = `UPDATE %s SET deleted_at = now() WHERE id = $1`
+const sqlRemoveRoute = `UPDATE %s SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL`
 
 func (d *pgDataStore) Remove(id string) error {
-	_, err := d.pgx.Exec(fmt.Sprintf(sqlRemoveRoute, d.tableName), id)
+	_, err := d.remove(d.pgx, id)
+	return err
+}
+
+// remove marks the route as deleted, returning whether it existed.
+func (d *pgDataStore) remove(q pgQueryer, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	tag, err := q.Exec(fmt.Sprintf(sqlRemoveRoute, d.tableName), id)
+	return tag.RowsAffected() > 0, err
+}
+
+// The notifications of a transaction are delivered together once it commits,
+// so the route notifications of a batch are sent between these two payloads
+// to allow listeners to apply them together.
+const (
+	notifyBatchBegin = "batch-begin"
+	notifyBatchEnd   = "batch-end"
+)
+
+const sqlNotify = `SELECT pg_notify($1, $2)`
+
+// Apply removes, updates and adds the routes in batch in a single
+// transaction. If any of the changes fail, none of them are applied.
+func (d *pgDataStore) Apply(batch *router.RouteBatch) error {
+	tx, err := d.pgx.Begin()
+	if err != nil {
+		return err
+	}
+	if err := d.apply(tx, batch); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *pgDataStore) apply(tx *pgx.Tx, batch *router.RouteBatch) error {
+	if _, err := tx.Exec(sqlNotify, d.tableName, notifyBatchBegin); err != nil {
+		return err
+	}
+	for _, r := range batch.Remove {
+		existed, err := d.remove(tx, r.ID)
+		if err != nil {
+			return err
+		}
+		if !existed {
+			return ErrNotFound
+		}
+		r.Type = d.routeType
+	}
+	for _, r := range batch.Update {
+		if err := d.update(tx, r); err != nil {
+			return err
+		}
+	}
+	for _, r := range batch.Add {
+		if err := d.add(tx, r); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(sqlNotify, d.tableName, notifyBatchEnd)
 	return err
 }
 
@@ -214,10 +336,24 @@ func (d *pgDataStore) Sync(ctx context.Context, h SyncHandler, startc chan<- str
 	}
 	close(startc)
 
+	// batch is non-nil while the notifications of a batch are being received
+	var batch []string
 	for {
 		select {
 		case id := <-idc:
-			if err := d.handleUpdate(h, id); err != nil {
+			var err error
+			switch {
+			case id == notifyBatchBegin:
+				batch = []string{}
+			case id == notifyBatchEnd:
+				err = d.handleBatch(h, batch)
+				batch = nil
+			case batch != nil:
+				batch = append(batch, id)
+			default:
+				err = d.handleUpdate(h, id)
+			}
+			if err != nil {
 				cancel()
 				return err
 			}
@@ -245,21 +381,44 @@ func (d *pgDataStore) handleUpdate(h SyncHandler, id string) error {
 	return h.Set(route)
 }
 
+func (d *pgDataStore) handleBatch(h SyncHandler, ids []string) error {
+	var set []*router.Route
+	var remove []string
+	for _, id := range ids {
+		route, err := d.Get(id)
+		if err == ErrNotFound {
+			remove = append(remove, id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		set = append(set, route)
+	}
+	return h.Apply(set, remove)
+}
+
 func (d *pgDataStore) startListener(ctx context.Context) (<-chan string, <-chan error, error) {
+	return startPGListener(ctx, d.pgx, d.tableName)
+}
+
+// startPGListener listens for notifications on channel, sending the payload of
+// each notification to the returned string channel until ctx is done.
+func startPGListener(ctx context.Context, pool *pgx.ConnPool, channel string) (<-chan string, <-chan error, error) {
 	idc := make(chan string)
 	errc := make(chan error)
 
-	conn, err := d.pgx.Acquire()
+	conn, err := pool.Acquire()
 	if err != nil {
 		return nil, nil, err
 	}
-	if err = conn.Listen(d.tableName); err != nil {
-		d.pgx.Release(conn)
+	if err = conn.Listen(channel); err != nil {
+		pool.Release(conn)
 		return nil, nil, err
 	}
 
 	go func() {
-		defer unlistenAndRelease(d.pgx, conn, d.tableName)
+		defer unlistenAndRelease(pool, conn, channel)
 		defer close(idc)
 
 		for {
@@ -285,8 +444,8 @@ func (d *pgDataStore) startListener(ctx context.Context) (<-chan string, <-chan
 }
 
 const (
-	selectColumnsHTTP = "id, parent_ref, service, domain, sticky, tls_cert, tls_key, created_at, updated_at"
-	selectColumnsTCP  = "id, parent_ref, service, port, created_at, updated_at"
+	selectColumnsHTTP = "id, parent_ref, service, domain, sticky, path_rewrite_prefix, path_rewrite_replacement, mirror_service, mirror_percent, match_rules, filter_rules, maintenance, maintenance_page, tls_cert, tls_key, created_at, updated_at"
+	selectColumnsTCP  = "id, parent_ref, service, port, server_name, created_at, updated_at"
 )
 
 func (d *pgDataStore) columnNames() string {
@@ -308,23 +467,40 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 	route.Type = d.routeType
 	switch d.tableName {
 	case tableNameHTTP:
-		return s.Scan(
+		var matchRules, filterRules string
+		err := s.Scan(
 			&route.ID,
 			&route.ParentRef,
 			&route.Service,
 			&route.Domain,
 			&route.Sticky,
+			&route.PathRewritePrefix,
+			&route.PathRewriteReplacement,
+			&route.MirrorService,
+			&route.MirrorPercent,
+			&matchRules,
+			&filterRules,
+			&route.Maintenance,
+			&route.MaintenancePage,
 			&route.TLSCert,
 			&route.TLSKey,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 		)
+		if err != nil {
+			return err
+		}
+		if err := unmarshalJSONColumn(matchRules, &route.MatchRules); err != nil {
+			return err
+		}
+		return unmarshalJSONColumn(filterRules, &route.FilterRules)
 	case tableNameTCP:
 		return s.Scan(
 			&route.ID,
 			&route.ParentRef,
 			&route.Service,
 			&route.Port,
+			&route.ServerName,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 		)
@@ -332,6 +508,29 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 	panic("unknown tableName: " + d.tableName)
 }
 
+// marshalJSONColumn encodes v for storage in a text column, with empty values
+// stored as an empty string.
+func marshalJSONColumn(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	switch string(data) {
+	case "null", "[]", "{}":
+		return "", nil
+	}
+	return string(data), nil
+}
+
+// unmarshalJSONColumn decodes data from a text column encoded with
+// marshalJSONColumn into v.
+func unmarshalJSONColumn(data string, v interface{}) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
 const sqlUnlisten = `UNLISTEN %s`
 
 func unlistenAndRelease(pool *pgx.ConnPool, conn *pgx.Conn, channel string) {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// invalidRouteError is returned when a route is rejected because it is not
+// valid.
+type invalidRouteError struct {
+	error
+}
+
+// A compiled filter rule of a route.
+type httpFilterRule struct {
+	methods     map[string]struct{}
+	path        *regexp.Regexp
+	userAgent   *regexp.Regexp
+	header      string
+	headerValue *regexp.Regexp
+}
+
+var errEmptyFilterRule = errors.New("router: filter rules must have at least one condition")
+
+func compileFilterRules(rules []router.FilterRule) ([]*httpFilterRule, error) {
+	res := make([]*httpFilterRule, 0, len(rules))
+	for i, rule := range rules {
+		r := &httpFilterRule{header: rule.Header}
+		if len(rule.Methods) > 0 {
+			r.methods = make(map[string]struct{}, len(rule.Methods))
+			for _, m := range rule.Methods {
+				r.methods[strings.ToUpper(m)] = struct{}{}
+			}
+		}
+		var err error
+		if r.path, err = compileFilterPattern(rule.Path); err != nil {
+			return nil, fmt.Errorf("router: invalid path in filter rule %d: %s", i, err)
+		}
+		if r.userAgent, err = compileFilterPattern(rule.UserAgent); err != nil {
+			return nil, fmt.Errorf("router: invalid user_agent in filter rule %d: %s", i, err)
+		}
+		if r.headerValue, err = compileFilterPattern(rule.HeaderValue); err != nil {
+			return nil, fmt.Errorf("router: invalid header_value in filter rule %d: %s", i, err)
+		}
+		if (rule.Header == "") != (rule.HeaderValue == "") {
+			return nil, fmt.Errorf("router: header and header_value must be set together in filter rule %d", i)
+		}
+		if r.methods == nil && r.path == nil && r.userAgent == nil && r.header == "" {
+			return nil, errEmptyFilterRule
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func compileFilterPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// matches reports whether req matches all of the conditions of the rule.
+func (r *httpFilterRule) matches(req *http.Request) bool {
+	if r.methods != nil {
+		if _, ok := r.methods[req.Method]; !ok {
+			return false
+		}
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.userAgent != nil && !r.userAgent.MatchString(req.UserAgent()) {
+		return false
+	}
+	if r.header != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(r.header)]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, v := range values {
+			if r.headerValue.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// blocked reports whether req matches any of the filter rules of the route.
+func (r *httpRoute) blocked(req *http.Request) bool {
+	for _, rule := range r.filters {
+		if rule.matches(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHTTPRoute(r *router.Route) error {
+	if err := validateMatchRules(r.MatchRules); err != nil {
+		return invalidRouteError{err}
+	}
+	if _, err := compileFilterRules(r.FilterRules); err != nil {
+		return invalidRouteError{err}
+	}
+	return nil
+}
+
+// validateMatchRules checks each rule matches either a header or a cookie and
+// routes to a service, as rules which don't would never match or would route
+// requests nowhere.
+func validateMatchRules(rules []router.MatchRule) error {
+	for i, rule := range rules {
+		if (rule.Header == "") == (rule.Cookie == "") {
+			return fmt.Errorf("router: exactly one of header or cookie must be set in match rule %d", i)
+		}
+		if rule.Service == "" {
+			return fmt.Errorf("router: service must be set in match rule %d", i)
+		}
+	}
+	return nil
+}
@@ -1,17 +1,39 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	fwdForHeaderName   = "X-Forwarded-For"
 	fwdProtoHeaderName = "X-Forwarded-Proto"
 	fwdPortHeaderName  = "X-Forwarded-Port"
+
+	fwdSSLHeaderName              = "X-Forwarded-Ssl"
+	fwdSSLProtocolHeaderName      = "X-Forwarded-Ssl-Protocol"
+	fwdSSLCipherHeaderName        = "X-Forwarded-Ssl-Cipher"
+	fwdSSLClientSubjectHeaderName = "X-Forwarded-Ssl-Client-Subject"
+	fwdSSLClientCertHeaderName    = "X-Forwarded-Ssl-Client-Cert"
 )
 
+var fwdSSLHeaderNames = []string{
+	fwdSSLHeaderName,
+	fwdSSLProtocolHeaderName,
+	fwdSSLCipherHeaderName,
+	fwdSSLClientSubjectHeaderName,
+	fwdSSLClientCertHeaderName,
+}
+
 // fwdProtoHandler is an http.Handler that sets the X-Forwarded-For header on
 // inbound requests to match the remote IP address, and sets X-Forwarded-Proto
 // and X-Forwarded-Port headers to match the values in Proto and Port. If those
@@ -42,5 +64,195 @@ func (h fwdProtoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Header.Set(fwdProtoHeaderName, proto)
 	r.Header.Set(fwdPortHeaderName, port)
 
+	setFwdSSLHeaders(r)
+
 	h.Handler.ServeHTTP(w, r)
 }
+
+// setFwdSSLHeaders sets X-Forwarded-Ssl-* headers describing the TLS
+// connection that r was received on, including the subject and URL-escaped
+// PEM encoding of the verified client certificate if there is one. Any
+// existing values are removed so that they cannot be spoofed by clients.
+func setFwdSSLHeaders(r *http.Request) {
+	for _, name := range fwdSSLHeaderNames {
+		r.Header.Del(name)
+	}
+	if r.TLS == nil {
+		return
+	}
+
+	r.Header.Set(fwdSSLHeaderName, "on")
+	r.Header.Set(fwdSSLProtocolHeaderName, tlsVersionName(r.TLS.Version))
+	r.Header.Set(fwdSSLCipherHeaderName, tlsCipherSuiteName(r.TLS.CipherSuite))
+	if len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		r.Header.Set(fwdSSLClientSubjectHeaderName, formatDN(cert.Subject))
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		r.Header.Set(fwdSSLClientCertHeaderName, url.QueryEscape(string(certPEM)))
+	}
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSLv3",
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// tlsVersionName returns the OpenSSL name of the TLS version v, falling back
+// to the Go name for versions without one.
+func tlsVersionName(v uint16) string {
+	if name, ok := tlsVersionNames[v]; ok {
+		return name
+	}
+	return tls.VersionName(v)
+}
+
+// tlsCipherSuiteName returns the OpenSSL name of the cipher suite id, falling
+// back to the IANA name, which OpenSSL also uses for TLS 1.3 suites.
+func tlsCipherSuiteName(id uint16) string {
+	if name, ok := tlsCipherSuiteNames[id]; ok {
+		return name
+	}
+	return tls.CipherSuiteName(id)
+}
+
+var tlsCipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "RC4-SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "DES-CBC3-SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "AES128-SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "AES256-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "ECDHE-ECDSA-RC4-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "ECDHE-ECDSA-AES128-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "ECDHE-ECDSA-AES256-SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "ECDHE-RSA-RC4-SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "ECDHE-RSA-DES-CBC3-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "ECDHE-RSA-AES128-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "ECDHE-RSA-AES256-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "ECDHE-RSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "ECDHE-ECDSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "ECDHE-RSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "ECDHE-ECDSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "ECDHE-RSA-CHACHA20-POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "ECDHE-ECDSA-CHACHA20-POLY1305",
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// formatDN formats name as an RFC 2253 style distinguished name, from most to
+// least specific.
+func formatDN(name pkix.Name) string {
+	var parts []string
+	add := func(key string, values ...string) {
+		for _, v := range values {
+			if v != "" {
+				parts = append(parts, key+"="+escapeDNValue(v))
+			}
+		}
+	}
+	add("CN", name.CommonName)
+	add("SERIALNUMBER", name.SerialNumber)
+	add("OU", name.OrganizationalUnit...)
+	add("O", name.Organization...)
+	add("STREET", name.StreetAddress...)
+	add("L", name.Locality...)
+	add("ST", name.Province...)
+	add("POSTALCODE", name.PostalCode...)
+	add("C", name.Country...)
+	return strings.Join(parts, ",")
+}
+
+// escapeDNValue escapes an attribute value of a distinguished name as
+// described in RFC 2253 section 2.4, so that values can't add attributes to
+// the name. '=' is escaped too, which RFC 4514 allows.
+func escapeDNValue(v string) string {
+	var buf bytes.Buffer
+	for i, r := range v {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			r == '#' && i == 0,
+			r == ' ' && (i == 0 || i == len(v)-1):
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < ' ':
+			fmt.Fprintf(&buf, "\\%02X", r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// connLimits enforces the idle, header read and per-connection request limits
+// of an HTTPListener on the connections of an http.Server, using its ConnState
+// hook to set read deadlines and count requests.
+type connLimits struct {
+	IdleTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	MaxRequests       int
+
+	mtx sync.Mutex
+	// requests is the number of requests served on each open connection,
+	// keyed by remote address
+	requests map[string]int
+}
+
+func newConnLimits(idleTimeout, readHeaderTimeout time.Duration, maxRequests int) *connLimits {
+	return &connLimits{
+		IdleTimeout:       idleTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		MaxRequests:       maxRequests,
+		requests:          make(map[string]int),
+	}
+}
+
+// ConnState is used as the ConnState hook of an http.Server. New connections
+// must send their request headers within ReadHeaderTimeout, and idle keep-alive
+// connections must send the next request headers within IdleTimeout plus
+// ReadHeaderTimeout.
+func (l *connLimits) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		setReadTimeout(conn, l.ReadHeaderTimeout)
+	case http.StateActive:
+		// the request headers have been read, reading the body is not limited
+		conn.SetReadDeadline(time.Time{})
+	case http.StateIdle:
+		if l.IdleTimeout > 0 {
+			setReadTimeout(conn, l.IdleTimeout+l.ReadHeaderTimeout)
+		}
+	case http.StateHijacked, http.StateClosed:
+		if l.MaxRequests > 0 {
+			l.mtx.Lock()
+			delete(l.requests, conn.RemoteAddr().String())
+			l.mtx.Unlock()
+		}
+	}
+}
+
+func setReadTimeout(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// Handler returns an http.Handler that closes client connections once
+// MaxRequests have been served on them by setting the Connection: close
+// response header. If MaxRequests is zero, connections are not limited.
+func (l *connLimits) Handler(h http.Handler) http.Handler {
+	if l.MaxRequests <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mtx.Lock()
+		l.requests[r.RemoteAddr]++
+		n := l.requests[r.RemoteAddr]
+		l.mtx.Unlock()
+		if n >= l.MaxRequests {
+			w.Header().Set("Connection", "close")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-check"
 )
@@ -32,3 +37,52 @@ func (s *S) TestFwdProtoHandler(c *C) {
 	c.Assert(request.Header.Get("X-Forwarded-Proto"), Equals, prevForwardedProto+", https")
 	c.Assert(request.Header.Get("X-Forwarded-Port"), Equals, prevForwardedPort+", 443")
 }
+
+func (s *S) TestFwdSSLHeaders(c *C) {
+	block, _ := pem.Decode(localhostCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, IsNil)
+
+	h := fwdProtoHandler{Handler: nopHandler, Proto: "https", Port: "443"}
+
+	// TLS details are set for TLS requests
+	request, _ := http.NewRequest("GET", "https://test.com", nil)
+	request.RemoteAddr = "1.2.3.4:5678"
+	request.TLS = &tls.ConnectionState{
+		Version:        tls.VersionTLS12,
+		CipherSuite:    tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		VerifiedChains: [][]*x509.Certificate{{cert}},
+	}
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(request.Header.Get("X-Forwarded-Ssl"), Equals, "on")
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Protocol"), Equals, "TLSv1.2")
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Cipher"), Equals, "ECDHE-RSA-AES128-GCM-SHA256")
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Client-Subject"), Equals, "O=Acme Co")
+	certPEM, err := url.QueryUnescape(request.Header.Get("X-Forwarded-Ssl-Client-Cert"))
+	c.Assert(err, IsNil)
+	c.Assert(certPEM, Equals, string(localhostCert)+"\n")
+
+	// values are escaped so they can't add attributes to the subject
+	cert.Subject = pkix.Name{CommonName: "evil,O=Trusted", Organization: []string{" #a+b\\ "}}
+	request.Header.Del("X-Forwarded-Ssl-Client-Subject")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Client-Subject"), Equals, `CN=evil\,O\=Trusted,O=\ #a\+b\\\ `)
+
+	// TLS 1.3 connections are described too
+	request, _ = http.NewRequest("GET", "https://test.com", nil)
+	request.TLS = &tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+	}
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Protocol"), Equals, "TLSv1.3")
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Cipher"), Equals, "TLS_AES_128_GCM_SHA256")
+
+	// client provided values are removed from non-TLS requests
+	request, _ = http.NewRequest("GET", "http://test.com", nil)
+	request.Header.Set("X-Forwarded-Ssl", "on")
+	request.Header.Set("X-Forwarded-Ssl-Client-Subject", "CN=spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(request.Header.Get("X-Forwarded-Ssl"), Equals, "")
+	c.Assert(request.Header.Get("X-Forwarded-Ssl-Client-Subject"), Equals, "")
+}
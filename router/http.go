@@ -3,14 +3,17 @@ package main
 import (
 	"crypto/md5"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
-	"log"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kavu/go_reuseport"
@@ -30,6 +33,38 @@ type HTTPListener struct {
 	Addr    string
 	TLSAddr string
 
+	// MaxHeaderBytes is the maximum size of request headers, requests with
+	// larger headers are rejected. If zero, http.DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+	// ClientCAs is an optional pool of CAs used to verify TLS client
+	// certificates. If set, clients may present a certificate, and the
+	// verified certificate is forwarded to the backend in request headers.
+	ClientCAs *x509.CertPool
+	// MaxConns is the maximum number of concurrent connections for each of
+	// the HTTP and HTTPS listeners. Connections over the limit are closed
+	// immediately, with a 503 response for HTTP. If zero, there is no limit.
+	MaxConns int
+	// IdleTimeout is the maximum amount of time to wait for the next request
+	// on a keep-alive connection. If zero, idle connections are kept open
+	// indefinitely.
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout is the maximum amount of time allowed to read the
+	// request headers. On keep-alive connections it is added to IdleTimeout.
+	// If zero, there is no timeout.
+	ReadHeaderTimeout time.Duration
+	// MaxRequestsPerConn is the maximum number of requests served on a single
+	// client connection before it is closed. If zero, there is no limit.
+	MaxRequestsPerConn int
+	// MaintenancePage is the HTML page returned for routes in maintenance
+	// mode which don't have their own page. If empty, defaultMaintenancePage
+	// is used.
+	MaintenancePage string
+	// ServerNameService optionally returns the service of the TCP route for a
+	// TLS server name, connections to the TLS port which request the server
+	// name are proxied to it without being terminated. It is usually the
+	// ServerNameService method of the router's TCPListener.
+	ServerNameService func(serverName string) connServer
+
 	mtx      sync.RWMutex
 	domains  map[string]*httpRoute
 	routes   map[string]*httpRoute
@@ -43,8 +78,36 @@ type HTTPListener struct {
 	listener    net.Listener
 	tlsListener net.Listener
 	closed      bool
-	cookieKey   *[32]byte
+	cookieKeys  *proxy.StickyKeys
 	keypair     tls.Certificate
+	backends    *proxy.BackendTracker
+
+	// cookieKeyStore is an optional store that cookieKeys are synced from so
+	// that they are shared by all router instances
+	cookieKeyStore CookieKeyStore
+
+	// requests are the request counters of each route, keyed by route ID,
+	// which are kept when routes are updated, and for
+	// routeRequestsRetention after they are removed
+	requestsMtx sync.Mutex
+	requests    map[string]*routeRequests
+	// instanceID identifies the run of the listener in its stats
+	instanceID string
+}
+
+// routeRequestsRetention is how long the request counter of a removed route is
+// kept, which is longer than the usage collection interval of the controller
+// so that the final count is collected.
+const routeRequestsRetention = 10 * time.Minute
+
+// routeRequests counts the requests served for a route. The count is updated
+// atomically by the requests, and read when the stats are gathered.
+type routeRequests struct {
+	count     uint64 // must be first for 64-bit alignment
+	parentRef string
+	// removedAt is when the route was removed, it is zero while the route
+	// exists
+	removedAt time.Time
 }
 
 type DiscoverdClient interface {
@@ -84,14 +147,29 @@ func (s *HTTPListener) Start() error {
 	s.routes = make(map[string]*httpRoute)
 	s.domains = make(map[string]*httpRoute)
 	s.services = make(map[string]*httpService)
+	s.instanceID = random.UUID()
 
-	if s.cookieKey == nil {
-		s.cookieKey = &[32]byte{}
+	if s.cookieKeys == nil {
+		s.cookieKeys = proxy.NewStickyKeys(nil)
+	}
+
+	if s.cookieKeyStore != nil {
+		err := startSync(ctx, "cookie key", func(ctx context.Context, startc chan<- struct{}) error {
+			return s.cookieKeyStore.Sync(ctx, s.cookieKeys, startc)
+		})
+		if err != nil {
+			s.stopSync()
+			return err
+		}
 	}
 
 	// TODO(benburkert): the sync API cannot handle routes deleted while the
 	// listen/notify connection is disconnected
-	if err := s.startSync(ctx); err != nil {
+	err := startSync(ctx, "http", func(ctx context.Context, startc chan<- struct{}) error {
+		return s.ds.Sync(ctx, &httpSyncHandler{l: s}, startc)
+	})
+	if err != nil {
+		s.stopSync()
 		return err
 	}
 
@@ -103,42 +181,6 @@ func (s *HTTPListener) Start() error {
 	return nil
 }
 
-func (s *HTTPListener) startSync(ctx context.Context) error {
-	errc := make(chan error)
-	startc := s.doSync(ctx, errc)
-
-	select {
-	case err := <-errc:
-		return err
-	case <-startc:
-		go s.runSync(ctx, errc)
-		return nil
-	}
-}
-
-func (s *HTTPListener) runSync(ctx context.Context, errc chan error) {
-	err := <-errc
-
-	for {
-		if err == nil {
-			return
-		}
-		log.Printf("router: sync error: %s", err)
-
-		s.doSync(ctx, errc)
-
-		err = <-errc
-	}
-}
-
-func (s *HTTPListener) doSync(ctx context.Context, errc chan<- error) <-chan struct{} {
-	startc := make(chan struct{})
-
-	go func() { errc <- s.ds.Sync(ctx, &httpSyncHandler{l: s}, startc) }()
-
-	return startc
-}
-
 func (s *HTTPListener) startListen() error {
 	if err := s.listenAndServe(); err != nil {
 		return err
@@ -156,12 +198,27 @@ func (s *HTTPListener) startListen() error {
 
 var ErrClosed = errors.New("router: listener has been closed")
 
+var errNoCookieKeyStore = errors.New("router: sticky cookie keys are not stored in the database")
+
+// RotateCookieKeys adds a new sticky cookie key to the key store, which is then
+// synced to every router. Cookies encrypted with the previous keys remain
+// valid until those keys expire from the store.
+func (s *HTTPListener) RotateCookieKeys() error {
+	if s.cookieKeyStore == nil {
+		return errNoCookieKeyStore
+	}
+	return s.cookieKeyStore.Rotate()
+}
+
 func (s *HTTPListener) AddRoute(r *router.Route) error {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	if s.closed {
 		return ErrClosed
 	}
+	if err := validateHTTPRoute(r); err != nil {
+		return err
+	}
 	return s.ds.Add(r)
 }
 
@@ -171,6 +228,9 @@ func (s *HTTPListener) UpdateRoute(r *router.Route) error {
 	if s.closed {
 		return ErrClosed
 	}
+	if err := validateHTTPRoute(r); err != nil {
+		return err
+	}
 	return s.ds.Update(r)
 }
 
@@ -188,58 +248,161 @@ func (s *HTTPListener) RemoveRoute(id string) error {
 	return s.ds.Remove(id)
 }
 
+// ApplyRoutes applies batch atomically, after validating the routes being
+// added or updated.
+func (s *HTTPListener) ApplyRoutes(batch *router.RouteBatch) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, routes := range [][]*router.Route{batch.Add, batch.Update} {
+		for _, r := range routes {
+			if err := validateHTTPRoute(r); err != nil {
+				return err
+			}
+		}
+	}
+	return s.ds.Apply(batch)
+}
+
 type httpSyncHandler struct {
 	l *HTTPListener
 }
 
 func (h *httpSyncHandler) Set(data *router.Route) error {
-	route := data.HTTPRoute()
-	r := &httpRoute{HTTPRoute: route}
+	r, err := newHTTPRoute(data)
+	if err != nil {
+		return err
+	}
+
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+	if err := h.set(data.ID, r); err != nil {
+		return err
+	}
+
+	go h.l.wm.Send(&router.Event{Event: "set", ID: r.Domain})
+	return nil
+}
+
+// newHTTPRoute returns an httpRoute for data with its TLS keypair and filter
+// rules parsed.
+func newHTTPRoute(data *router.Route) (*httpRoute, error) {
+	r := &httpRoute{HTTPRoute: data.HTTPRoute()}
+
+	filters, err := compileFilterRules(r.FilterRules)
+	if err != nil {
+		return nil, err
+	}
+	r.filters = filters
 
 	if r.TLSCert != "" && r.TLSKey != "" {
 		kp, err := tls.X509KeyPair([]byte(r.TLSCert), []byte(r.TLSKey))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		r.keypair = &kp
 		r.TLSCert = ""
 		r.TLSKey = ""
 	}
+	return r, nil
+}
 
-	h.l.mtx.Lock()
-	defer h.l.mtx.Unlock()
-	if h.l.closed {
-		return nil
+// set adds or replaces the route with the given ID. The listener mutex must be
+// held by the caller.
+func (h *httpSyncHandler) set(id string, r *httpRoute) error {
+	if err := h.getRouteServices(r); err != nil {
+		return err
 	}
+	h.install(id, r)
+	return nil
+}
 
-	service := h.l.services[r.Service]
-	if service != nil && service.name != r.Service {
-		service.refs--
-		if service.refs <= 0 {
-			service.sc.Close()
-			delete(h.l.services, service.name)
+// getRouteServices gets the services r proxies to, releasing those it already
+// got if one fails, so that r can be installed without failing. The listener
+// mutex must be held by the caller.
+func (h *httpSyncHandler) getRouteServices(r *httpRoute) error {
+	service, err := h.l.getService(r.Service, r.Sticky)
+	if err != nil {
+		return err
+	}
+	r.service = service
+	if r.MirrorService != "" {
+		mirror, err := h.l.getService(r.MirrorService, false)
+		if err != nil {
+			h.l.releaseService(service)
+			return err
 		}
-		service = nil
+		r.mirror = mirror
 	}
-	if service == nil {
-		sc, err := NewDiscoverdServiceCache(h.l.discoverd.Service(r.Service))
+	r.rules = make([]*httpMatchRule, 0, len(r.MatchRules))
+	for _, rule := range r.MatchRules {
+		service, err := h.l.getService(rule.Service, r.Sticky)
 		if err != nil {
+			h.l.releaseRouteServices(r)
 			return err
 		}
+		r.rules = append(r.rules, &httpMatchRule{MatchRule: rule, service: service})
+	}
+	return nil
+}
+
+// install adds or replaces the route with the given ID, whose services have
+// been got by getRouteServices. The listener mutex must be held by the caller.
+func (h *httpSyncHandler) install(id string, r *httpRoute) {
+	if old, ok := h.l.routes[id]; ok {
+		h.l.releaseRouteServices(old)
+	}
+	r.requests = h.l.routeRequests(id, r.ParentRef)
+	h.l.routes[id] = r
+	h.l.domains[strings.ToLower(r.Domain)] = r
+}
+
+// getService returns the service with the given name, starting a new service
+// cache if it is not already in use, and increments its reference count. The
+// listener mutex must be held by the caller.
+func (s *HTTPListener) getService(name string, sticky bool) (*httpService, error) {
+	service := s.services[name]
+	if service == nil {
+		sc, err := NewDiscoverdServiceCache(s.discoverd.Service(name))
+		if err != nil {
+			return nil, err
+		}
 		service = &httpService{
-			name: r.Service,
+			name: name,
 			sc:   sc,
-			rp:   proxy.NewReverseProxy(sc.Addrs, h.l.cookieKey, r.Sticky),
+			rp:   proxy.NewReverseProxy(sc.Addrs, s.cookieKeys, sticky, s.backends),
 		}
-		h.l.services[r.Service] = service
+		s.services[name] = service
 	}
 	service.refs++
-	r.service = service
-	h.l.routes[data.ID] = r
-	h.l.domains[strings.ToLower(r.Domain)] = r
+	return service, nil
+}
 
-	go h.l.wm.Send(&router.Event{Event: "set", ID: r.Domain})
-	return nil
+// releaseService decrements the reference count of service, closing it once
+// there are no more references. The listener mutex must be held by the caller.
+func (s *HTTPListener) releaseService(service *httpService) {
+	service.refs--
+	if service.refs <= 0 {
+		service.sc.Close()
+		delete(s.services, service.name)
+	}
+}
+
+// releaseRouteServices releases all of the services referenced by r. The
+// listener mutex must be held by the caller.
+func (s *HTTPListener) releaseRouteServices(r *httpRoute) {
+	s.releaseService(r.service)
+	if r.mirror != nil {
+		s.releaseService(r.mirror)
+	}
+	for _, rule := range r.rules {
+		s.releaseService(rule.service)
+	}
 }
 
 func (h *httpSyncHandler) Remove(id string) error {
@@ -248,41 +411,82 @@ func (h *httpSyncHandler) Remove(id string) error {
 	if h.l.closed {
 		return nil
 	}
+	if err := h.remove(id); err != nil {
+		return err
+	}
+	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
+	return nil
+}
+
+// remove removes the route with the given ID. The listener mutex must be held
+// by the caller.
+func (h *httpSyncHandler) remove(id string) error {
 	r, ok := h.l.routes[id]
 	if !ok {
 		return ErrNotFound
 	}
 
-	r.service.refs--
-	if r.service.refs <= 0 {
-		r.service.sc.Close()
-		delete(h.l.services, r.service.name)
-	}
+	h.l.releaseRouteServices(r)
+	h.l.removeRouteRequests(id)
 
 	delete(h.l.routes, id)
 	delete(h.l.domains, r.Domain)
-	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
+	return nil
+}
+
+// Apply removes and then sets the given routes while holding the listener
+// mutex so that requests are never routed using a partially applied batch.
+// The services of the routes being set are got before anything is changed, so
+// a batch which fails leaves the routes as they were.
+func (h *httpSyncHandler) Apply(set []*router.Route, remove []string) error {
+	routes := make([]*httpRoute, len(set))
+	for i, data := range set {
+		r, err := newHTTPRoute(data)
+		if err != nil {
+			return err
+		}
+		routes[i] = r
+	}
+
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+
+	for i, r := range routes {
+		if err := h.getRouteServices(r); err != nil {
+			for _, r := range routes[:i] {
+				h.l.releaseRouteServices(r)
+			}
+			return err
+		}
+	}
+
+	ids := make([]string, 0, len(set)+len(remove))
+	for _, id := range remove {
+		// routes which don't exist are already removed
+		h.remove(id)
+		ids = append(ids, id)
+	}
+	for i, r := range routes {
+		h.install(set[i].ID, r)
+		ids = append(ids, set[i].ID)
+	}
+
+	go h.l.wm.Send(&router.Event{Event: "batch", IDs: ids})
 	return nil
 }
 
 func (s *HTTPListener) listenAndServe() error {
-	var err error
-	s.listener, err = reuseport.NewReusablePortListener("tcp4", s.Addr)
+	l, err := reuseport.NewReusablePortListener("tcp4", s.Addr)
 	if err != nil {
 		return err
 	}
-
-	server := &http.Server{
-		Addr: s.listener.Addr().String(),
-		Handler: fwdProtoHandler{
-			Handler: s,
-			Proto:   "http",
-			Port:    mustPortFromAddr(s.listener.Addr().String()),
-		},
-	}
+	s.listener = newLimitListener(l, s.MaxConns, rejectHTTPConn)
 
 	// TODO: log error
-	go server.Serve(s.listener)
+	go s.newServer(s.listener, "http").Serve(s.listener)
 	return nil
 }
 
@@ -300,27 +504,39 @@ func (s *HTTPListener) listenAndServeTLS() error {
 		GetCertificate: certForHandshake,
 		Certificates:   []tls.Certificate{s.keypair},
 	})
+	if s.ClientCAs != nil {
+		tlsConfig.ClientCAs = s.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 
 	l, err := reuseport.NewReusablePortListener("tcp4", s.TLSAddr)
 	if err != nil {
 		return err
 	}
-	s.tlsListener = tls.NewListener(l, tlsConfig)
-
-	server := &http.Server{
-		Addr: s.tlsListener.Addr().String(),
-		Handler: fwdProtoHandler{
-			Handler: s,
-			Proto:   "https",
-			Port:    mustPortFromAddr(s.tlsListener.Addr().String()),
-		},
-	}
+	s.tlsListener = newSNIListener(newLimitListener(l, s.MaxConns, nil), tlsConfig, s.ServerNameService)
 
 	// TODO: log error
-	go server.Serve(s.tlsListener)
+	go s.newServer(s.tlsListener, "https").Serve(s.tlsListener)
 	return nil
 }
 
+// newServer returns an http.Server that serves requests accepted by l with
+// the configured limits and timeouts applied.
+func (s *HTTPListener) newServer(l net.Listener, proto string) *http.Server {
+	addr := l.Addr().String()
+	limits := newConnLimits(s.IdleTimeout, s.ReadHeaderTimeout, s.MaxRequestsPerConn)
+	return &http.Server{
+		Addr:           addr,
+		MaxHeaderBytes: s.MaxHeaderBytes,
+		ConnState:      limits.ConnState,
+		Handler: limits.Handler(fwdProtoHandler{
+			Handler: s,
+			Proto:   proto,
+			Port:    mustPortFromAddr(addr),
+		}),
+	}
+}
+
 func (s *HTTPListener) findRouteForHost(host string) *httpRoute {
 	host = strings.ToLower(host)
 	if strings.Contains(host, ":") {
@@ -354,6 +570,30 @@ func fail(w http.ResponseWriter, code int) {
 	w.Write(msg)
 }
 
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body><h1>Down for maintenance</h1><p>This site is undergoing maintenance, please try again soon.</p></body>
+</html>
+`
+
+// serveMaintenancePage responds to a request for a route in maintenance mode
+// with a 503 maintenance page.
+func (s *HTTPListener) serveMaintenancePage(w http.ResponseWriter, r *httpRoute) {
+	page := r.MaintenancePage
+	if page == "" {
+		page = s.MaintenancePage
+	}
+	if page == "" {
+		page = defaultMaintenancePage
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(503)
+	io.WriteString(w, page)
+}
+
 func (s *HTTPListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ctx := context.Background()
 	ctx = ctxhelper.NewContextStartTime(ctx, time.Now())
@@ -362,8 +602,78 @@ func (s *HTTPListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		fail(w, 404)
 		return
 	}
+	s.countRequest(r)
+	if r.Maintenance {
+		s.serveMaintenancePage(w, r)
+		return
+	}
+	if r.blocked(req) {
+		fail(w, 403)
+		return
+	}
+
+	r.rewritePath(req)
+	if r.shouldMirror(req) {
+		r.mirror.Mirror(ctx, req)
+	}
+	r.serviceFor(req).ServeHTTP(ctx, w, req)
+}
+
+func (s *HTTPListener) countRequest(r *httpRoute) {
+	atomic.AddUint64(&r.requests.count, 1)
+}
 
-	r.service.ServeHTTP(ctx, w, req)
+// routeRequests returns the request counter of the route with the given ID,
+// creating it if the route hasn't been set before.
+func (s *HTTPListener) routeRequests(id, parentRef string) *routeRequests {
+	s.requestsMtx.Lock()
+	defer s.requestsMtx.Unlock()
+	if s.requests == nil {
+		s.requests = make(map[string]*routeRequests)
+	}
+	r, ok := s.requests[id]
+	if !ok {
+		r = &routeRequests{}
+		s.requests[id] = r
+	}
+	r.parentRef = parentRef
+	r.removedAt = time.Time{}
+	return r
+}
+
+// removeRouteRequests marks the request counter of the route with the given
+// ID as removed, so that it is deleted once routeRequestsRetention has passed.
+func (s *HTTPListener) removeRouteRequests(id string) {
+	s.requestsMtx.Lock()
+	defer s.requestsMtx.Unlock()
+	if r, ok := s.requests[id]; ok {
+		r.removedAt = time.Now()
+	}
+}
+
+// Stats returns the number of requests served for each route since the
+// listener started, deleting the counters of routes which were removed
+// more than routeRequestsRetention ago.
+func (s *HTTPListener) Stats() []*router.HTTPRouteStats {
+	return s.stats(time.Now())
+}
+
+func (s *HTTPListener) stats(now time.Time) []*router.HTTPRouteStats {
+	s.requestsMtx.Lock()
+	defer s.requestsMtx.Unlock()
+	stats := make([]*router.HTTPRouteStats, 0, len(s.requests))
+	for id, r := range s.requests {
+		if !r.removedAt.IsZero() && now.Sub(r.removedAt) > routeRequestsRetention {
+			delete(s.requests, id)
+			continue
+		}
+		n := atomic.LoadUint64(&r.count)
+		if n == 0 {
+			continue
+		}
+		stats = append(stats, &router.HTTPRouteStats{RouteID: id, ParentRef: r.parentRef, Requests: n, InstanceID: s.instanceID})
+	}
+	return stats
 }
 
 // A domain served by a listener, associated TLS certs,
@@ -371,10 +681,96 @@ func (s *HTTPListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 type httpRoute struct {
 	*router.HTTPRoute
 
-	keypair *tls.Certificate
+	keypair  *tls.Certificate
+	service  *httpService
+	mirror   *httpService
+	requests *routeRequests
+	rules    []*httpMatchRule
+	filters  []*httpFilterRule
+}
+
+// A match rule of a route and the service that matching requests are routed
+// to.
+type httpMatchRule struct {
+	router.MatchRule
+
 	service *httpService
 }
 
+func (r *httpMatchRule) matches(req *http.Request) bool {
+	if r.Header != "" {
+		for _, v := range req.Header[http.CanonicalHeaderKey(r.Header)] {
+			if v == r.Value {
+				return true
+			}
+		}
+		return false
+	}
+	if r.Cookie != "" {
+		cookie, err := req.Cookie(r.Cookie)
+		return err == nil && cookie.Value == r.Value
+	}
+	return false
+}
+
+// serviceFor returns the service of the first match rule that matches req,
+// falling back to the service of the route.
+func (r *httpRoute) serviceFor(req *http.Request) *httpService {
+	for _, rule := range r.rules {
+		if rule.matches(req) {
+			return rule.service
+		}
+	}
+	return r.service
+}
+
+// rewritePath replaces the PathRewritePrefix of the request path with
+// PathRewriteReplacement. The request URI is rewritten in place so that the
+// change is seen by both regular and upgraded proxied requests.
+func (r *httpRoute) rewritePath(req *http.Request) {
+	prefix := r.PathRewritePrefix
+	if prefix == "" {
+		return
+	}
+
+	// absolute-form request URIs include the scheme and host
+	var authority string
+	uri := req.RequestURI
+	if req.URL.Scheme != "" {
+		authority = req.URL.Scheme + "://" + req.URL.Host
+		uri = strings.TrimPrefix(uri, authority)
+	}
+
+	path, query := uri, ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		path, query = uri[:i], uri[i:]
+	}
+	if !hasPathPrefix(path, prefix) {
+		return
+	}
+
+	rest := strings.TrimPrefix(path, prefix)
+	path = strings.TrimSuffix(r.PathRewriteReplacement, "/")
+	if rest == "" || rest[0] != '/' {
+		path += "/"
+	}
+	path += rest
+
+	req.RequestURI = authority + path + query
+	if u, err := url.ParseRequestURI(path); err == nil {
+		req.URL.Path = u.Path
+	}
+}
+
+// hasPathPrefix reports whether path begins with prefix, only matching at path
+// segment boundaries so that "/api" matches "/api/foo" but not "/apifoo".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
 // A service definition: name, and set of backends.
 type httpService struct {
 	name string
@@ -72,6 +72,12 @@ func newHTTPClient(serverName string) *http.Client {
 }
 
 func (s *S) newHTTPListener(t etcdrunner.TestingT) *HTTPListener {
+	return s.newHTTPListenerWith(t, nil)
+}
+
+// newHTTPListenerWith returns a started HTTPListener, calling configure (if
+// not nil) before it is started.
+func (s *S) newHTTPListenerWith(t etcdrunner.TestingT, configure func(*HTTPListener)) *HTTPListener {
 	pair, err := tls.X509KeyPair(localhostCert, localhostKey)
 	if err != nil {
 		t.Fatal(err)
@@ -83,6 +89,9 @@ func (s *S) newHTTPListener(t etcdrunner.TestingT) *HTTPListener {
 		ds:        NewPostgresDataStore("http", s.pgx),
 		discoverd: s.discoverd,
 	}
+	if configure != nil {
+		configure(l)
+	}
 	if err := l.Start(); err != nil {
 		t.Fatal(err)
 	}
@@ -230,6 +239,34 @@ func (s *S) TestWildcardRouting(c *C) {
 	assertGet(c, "http://"+l.Addr, "dev.foo.bar", "3")
 }
 
+func (s *S) TestHTTPRouteStats(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	route := router.HTTPRoute{Domain: "example.com", Service: "test", ParentRef: "stats"}.ToRoute()
+	r := addRoute(c, l, route)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	for i := 0; i < 3; i++ {
+		assertGet(c, "http://"+l.Addr, "example.com", "1")
+	}
+	stats := l.Stats()
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].RouteID, Equals, r.ID)
+	c.Assert(stats[0].ParentRef, Equals, "stats")
+	c.Assert(stats[0].Requests, Equals, uint64(3))
+	c.Assert(stats[0].InstanceID, Not(Equals), "")
+
+	// the counts of removed routes are kept for a while
+	removeHTTPRoute(c, l, r.ID)
+	c.Assert(l.Stats(), HasLen, 1)
+	c.Assert(l.stats(time.Now().Add(routeRequestsRetention+time.Second)), HasLen, 0)
+	c.Assert(l.requests, HasLen, 0)
+}
+
 func (s *S) TestHTTPInitialSync(c *C) {
 	l := s.newHTTPListener(c)
 	addHTTPRoute(c, l)
@@ -620,6 +657,99 @@ func (s *S) TestStickyHTTPRoute(c *C) {
 	}
 }
 
+func (s *S) TestStickyHTTPRouteKeyRotation(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	oldKey, newKey := &[32]byte{1}, &[32]byte{2}
+	l.cookieKeys.Set(oldKey)
+
+	addStickyHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	cookies := assertGet(c, "http://"+l.Addr, "example.com", "1")
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	// cookies encrypted with a secondary key are accepted and re-encrypted
+	// with the new primary key
+	l.cookieKeys.Set(newKey, oldKey)
+	resCookies := assertGetCookies(c, "http://"+l.Addr, "example.com", "1", cookies)
+	c.Assert(resCookies, HasLen, 1)
+	httpClient.Transport.(*http.Transport).CloseIdleConnections()
+
+	// once the old key is removed, the re-encrypted cookie is still valid
+	l.cookieKeys.Set(newKey)
+	for i := 0; i < 10; i++ {
+		res := assertGetCookies(c, "http://"+l.Addr, "example.com", "1", resCookies)
+		c.Assert(res, HasLen, 0)
+		httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+func (s *S) TestStickyHTTPRouteSharedKeys(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	newListener := func() *HTTPListener {
+		store, err := NewPostgresCookieKeyStore(s.pgx)
+		c.Assert(err, IsNil)
+		return s.newHTTPListenerWith(c, func(l *HTTPListener) {
+			l.cookieKeyStore = store
+		})
+	}
+	l1 := newListener()
+	defer l1.Close()
+	l2 := newListener()
+	defer l2.Close()
+	c.Assert(l1.cookieKeys.Primary(), Equals, l2.cookieKeys.Primary())
+
+	addStickyHTTPRoute(c, l1)
+	discoverdRegisterHTTP(c, l1, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l2, srv1.Listener.Addr().String())
+	cookies := assertGet(c, "http://"+l1.Addr, "example.com", "1")
+	discoverdRegisterHTTP(c, l1, srv2.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l2, srv2.Listener.Addr().String())
+
+	// a cookie set by one listener is valid for the other
+	for i := 0; i < 10; i++ {
+		resCookies := assertGetCookies(c, "http://"+l2.Addr, "example.com", "1", cookies)
+		c.Assert(resCookies, HasLen, 0)
+		httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	}
+
+	// rotated keys are distributed to all listeners
+	primary := l1.cookieKeys.Primary()
+	c.Assert(l1.RotateCookieKeys(), IsNil)
+	for _, l := range []*HTTPListener{l1, l2} {
+		start := time.Now()
+		for l.cookieKeys.Primary() == primary {
+			if time.Now().Sub(start) > 5*time.Second {
+				c.Fatal("timed out waiting for cookie key rotation")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	resCookies := assertGetCookies(c, "http://"+l2.Addr, "example.com", "1", cookies)
+	c.Assert(resCookies, HasLen, 1)
+}
+
+func (s *S) TestCookieKeyRotationPrunesOldKeys(c *C) {
+	store, err := NewPostgresCookieKeyStore(s.pgx)
+	c.Assert(err, IsNil)
+	for i := 0; i <= maxCookieKeys; i++ {
+		c.Assert(store.Rotate(), IsNil)
+	}
+	var count int
+	c.Assert(s.pgx.QueryRow("SELECT count(*) FROM "+tableNameCookieKeys).Scan(&count), IsNil)
+	c.Assert(count, Equals, maxCookieKeys)
+}
+
 func wsHandshakeTestHandler(id string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
@@ -955,6 +1085,207 @@ func (s *S) TestRequestURIEscaping(c *C) {
 	}
 }
 
+func (s *S) TestHTTPPathRewrite(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.RequestURI))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:            "example.com",
+		Service:           "test",
+		PathRewritePrefix: "/api",
+	}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{
+		Domain:                 "foo.example.com",
+		Service:                "test",
+		PathRewritePrefix:      "/api/",
+		PathRewriteReplacement: "/v2/",
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	for _, t := range []struct {
+		host     string
+		uri      string
+		upgrade  bool
+		expected string
+	}{
+		{host: "example.com", uri: "/api/foo?bar=baz", expected: "/foo?bar=baz"},
+		{host: "example.com", uri: "/api", expected: "/"},
+		{host: "example.com", uri: "/apifoo", expected: "/apifoo"},
+		{host: "example.com", uri: "/other/api/foo", expected: "/other/api/foo"},
+		{host: "example.com", uri: "/api/foo", upgrade: true, expected: "/foo"},
+		{host: "foo.example.com", uri: "/api/foo", expected: "/v2/foo"},
+		{host: "foo.example.com", uri: "/api/foo", upgrade: true, expected: "/v2/foo"},
+	} {
+		conn, err := net.Dial("tcp", l.Addr)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n", t.uri, t.host)
+		if t.upgrade {
+			fmt.Fprint(conn, "Connection: upgrade\r\nUpgrade: websocket\r\n")
+		}
+		fmt.Fprint(conn, "\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, t.expected)
+	}
+}
+
+func (s *S) TestHTTPMirror(c *C) {
+	mirrored := make(chan string, 1)
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mirrored <- req.RequestURI + " " + string(body)
+		w.Write([]byte("2"))
+	}))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:        "example.com",
+		Service:       "test",
+		MirrorService: "test-mirror",
+		MirrorPercent: 100,
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "test", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-mirror", srv2.Listener.Addr().String())
+
+	req, err := http.NewRequest("POST", "http://"+l.Addr+"/mirror", strings.NewReader("body"))
+	c.Assert(err, IsNil)
+	req.Host = "example.com"
+	res, err := newHTTPClient("example.com").Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "1")
+
+	select {
+	case m := <-mirrored:
+		c.Assert(m, Equals, "/mirror body")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for mirrored request")
+	}
+}
+
+func (s *S) TestHTTPMatchRules(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	srv3 := httptest.NewServer(httpTestHandler("3"))
+	defer srv1.Close()
+	defer srv2.Close()
+	defer srv3.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "1",
+		MatchRules: []router.MatchRule{
+			{Header: "X-Beta", Value: "1", Service: "2"},
+			{Cookie: "beta", Value: "yes", Service: "3"},
+		},
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "1", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "2", srv2.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "3", srv3.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	req := newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("X-Beta", "1")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "2")
+
+	assertGetCookies(c, "http://"+l.Addr, "example.com", "3", []*http.Cookie{{Name: "beta", Value: "yes"}})
+	assertGetCookies(c, "http://"+l.Addr, "example.com", "1", []*http.Cookie{{Name: "beta", Value: "no"}})
+
+	// invalid rules are rejected
+	for _, rule := range []router.MatchRule{
+		{Value: "1", Service: "2"},
+		{Header: "X-Beta", Cookie: "beta", Value: "1", Service: "2"},
+		{Header: "X-Beta", Value: "1"},
+	} {
+		err := l.AddRoute(router.HTTPRoute{
+			Domain:     "invalid.example.com",
+			Service:    "1",
+			MatchRules: []router.MatchRule{rule},
+		}.ToRoute())
+		c.Assert(err, FitsTypeOf, invalidRouteError{})
+	}
+}
+
+func (s *S) TestHTTPFilterRules(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		FilterRules: []router.FilterRule{
+			{Methods: []string{"delete"}, Path: "^/admin"},
+			{UserAgent: "(?i)badbot"},
+			{Header: "X-Scanner", HeaderValue: ".+"},
+		},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	for _, t := range []struct {
+		method string
+		path   string
+		header http.Header
+		status int
+	}{
+		{method: "GET", path: "/admin", status: 200},
+		{method: "DELETE", path: "/admin/users", status: 403},
+		{method: "DELETE", path: "/users", status: 200},
+		{method: "GET", path: "/", header: http.Header{"User-Agent": {"BadBot/1.0"}}, status: 403},
+		{method: "GET", path: "/", header: http.Header{"User-Agent": {"GoodBot/1.0"}}, status: 200},
+		{method: "GET", path: "/", header: http.Header{"X-Scanner": {"yes"}}, status: 403},
+	} {
+		req, err := http.NewRequest(t.method, "http://"+l.Addr+t.path, nil)
+		c.Assert(err, IsNil)
+		req.Host = "example.com"
+		for k, v := range t.header {
+			req.Header[k] = v
+		}
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, t.status, Commentf("%s %s %v", t.method, t.path, t.header))
+	}
+
+	// invalid rules are rejected
+	err := l.AddRoute(router.HTTPRoute{
+		Domain:      "invalid.example.com",
+		Service:     "test",
+		FilterRules: []router.FilterRule{{Path: "("}},
+	}.ToRoute())
+	c.Assert(err, FitsTypeOf, invalidRouteError{})
+}
+
 func (s *S) TestRequestQueryParams(c *C) {
 	l := s.newHTTPListener(c)
 	defer l.Close()
@@ -1004,6 +1335,45 @@ func (s *S) TestDefaultServerKeypair(c *C) {
 	assertGet(c, "https://"+l.TLSAddr, "foo.example.com", "2")
 }
 
+func (s *S) TestTCPServerNameRoute(c *C) {
+	pair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	c.Assert(err, IsNil)
+	srv1 := httptest.NewUnstartedServer(httpTestHandler("1"))
+	srv1.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	srv1.StartTLS()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	tl := s.newTCPListener(c)
+	defer tl.Close()
+	l := s.newHTTPListenerWith(c, func(l *HTTPListener) {
+		l.ServerNameService = tl.ServerNameService
+	})
+	defer l.Close()
+
+	addRoute(c, tl, router.TCPRoute{
+		Service:    "passthrough-example-com",
+		ServerName: "Passthrough.example.com",
+	}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "example-com",
+	}.ToRoute())
+
+	discoverdRegisterTCPService(c, tl, "passthrough-example-com", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "example-com", srv2.Listener.Addr().String())
+
+	// the backend terminates TLS for the server name of the TCP route
+	assertGet(c, "https://"+l.TLSAddr, "passthrough.example.com", "1")
+	// other routes are still terminated by the router
+	assertGet(c, "https://"+l.TLSAddr, "example.com", "2")
+
+	// a port can't be set along with a server name
+	err = tl.AddRoute(router.TCPRoute{Service: "test", Port: firstTCPPort, ServerName: "other.example.com"}.ToRoute())
+	c.Assert(err, FitsTypeOf, invalidRouteError{})
+}
+
 func (s *S) TestCaseInsensitiveDomain(c *C) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte(req.Host))
@@ -1131,3 +1501,53 @@ func (s *S) TestHTTPHijackUpgrade(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(string(pong), Equals, "pong!\n")
 }
+
+func (s *S) TestHTTPMaintenance(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	r := addRoute(c, l, router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		Maintenance: true,
+	}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{
+		Domain:          "custom.example.com",
+		Service:         "test",
+		Maintenance:     true,
+		MaintenancePage: "back soon",
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(host string) (int, string) {
+		req, err := http.NewRequest("GET", "http://"+l.Addr, nil)
+		c.Assert(err, IsNil)
+		req.Host = host
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return res.StatusCode, string(data)
+	}
+
+	status, body := get("example.com")
+	c.Assert(status, Equals, 503)
+	c.Assert(body, Equals, defaultMaintenancePage)
+
+	status, body = get("custom.example.com")
+	c.Assert(status, Equals, 503)
+	c.Assert(body, Equals, "back soon")
+
+	// disabling maintenance mode proxies requests to the service again
+	r.Maintenance = false
+	wait := waitForEvent(c, l, "set", r.ID)
+	c.Assert(l.UpdateRoute(r), IsNil)
+	wait()
+	status, body = get("example.com")
+	c.Assert(status, Equals, 200)
+	c.Assert(body, Equals, "1")
+}
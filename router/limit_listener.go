@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitListener is a net.Listener that limits the number of concurrently open
+// connections. Connections accepted while the limit is reached are passed to
+// reject, which is responsible for closing them.
+type limitListener struct {
+	net.Listener
+
+	sem    chan struct{}
+	reject func(net.Conn)
+}
+
+// newLimitListener returns l wrapped by a limitListener if max is greater than
+// zero, otherwise l is returned unchanged.
+func newLimitListener(l net.Listener, max int, reject func(net.Conn)) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	if reject == nil {
+		reject = closeConn
+	}
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, max),
+		reject:   reject,
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: conn, release: l.release}, nil
+		default:
+			go l.reject(conn)
+		}
+	}
+}
+
+func (l *limitListener) release() { <-l.sem }
+
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+func closeConn(conn net.Conn) {
+	conn.Close()
+}
+
+var serviceUnavailableResponse = []byte("HTTP/1.1 503 Service Unavailable\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: " + strconv.Itoa(len(http.StatusText(503))+1) + "\r\n" +
+	"\r\n" +
+	http.StatusText(503) + "\n")
+
+// rejectHTTPConn responds to a plaintext HTTP connection with a 503 without
+// reading the request and closes it.
+func rejectHTTPConn(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(serviceUnavailableResponse)
+	conn.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// mirrorMaxBodySize is the largest request body that will be buffered so that
+// the request can be mirrored. Requests with larger or unknown length bodies
+// are not mirrored.
+const mirrorMaxBodySize = 1 << 20
+
+// shouldMirror reports whether a copy of req should be sent to the mirror
+// service of the route.
+func (r *httpRoute) shouldMirror(req *http.Request) bool {
+	if r.mirror == nil || r.MirrorPercent <= 0 {
+		return false
+	}
+	if req.ContentLength < 0 || req.ContentLength > mirrorMaxBodySize {
+		return false
+	}
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return random.Math.Intn(100) < int(r.MirrorPercent)
+}
+
+// Mirror asynchronously sends a copy of req to the service, discarding the
+// response. The body of req is buffered and replaced so that it can still be
+// read by the caller.
+func (s *httpService) Mirror(ctx context.Context, req *http.Request) {
+	var body []byte
+	if req.Body != nil && req.ContentLength > 0 {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+	}
+
+	mirror := new(http.Request)
+	*mirror = *req
+	u := *req.URL
+	mirror.URL = &u
+	mirror.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		mirror.Header[k] = append([]string(nil), v...)
+	}
+	mirror.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	go s.ServeHTTP(ctx, discardResponseWriter{make(http.Header)}, mirror)
+}
+
+// discardResponseWriter is an http.ResponseWriter that discards the response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
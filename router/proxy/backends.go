@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackendTracker counts the requests and connections in flight to each
+// backend and keeps the set of backends which are being drained. A draining
+// backend is not picked for new requests unless they are part of a sticky
+// session, so that the backend can be stopped once its in-flight requests
+// finish. A nil BackendTracker tracks nothing.
+//
+// Requests only take the read lock to find the counter of their backend,
+// which is then updated atomically, so that requests to different backends
+// don't contend with each other.
+type BackendTracker struct {
+	// numDraining is the number of draining backends, which lets filter
+	// skip the lock while no backends are draining
+	numDraining int32
+
+	mtx      sync.RWMutex
+	inFlight map[string]*int64
+	// draining maps each draining backend to the time it stops draining
+	draining map[string]time.Time
+}
+
+func NewBackendTracker() *BackendTracker {
+	return &BackendTracker{
+		inFlight: make(map[string]*int64),
+		draining: make(map[string]time.Time),
+	}
+}
+
+// Drain stops new requests from being sent to addr for up to timeout, after
+// which it is treated as a normal backend again.
+func (t *BackendTracker) Drain(addr string, timeout time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.draining[addr] = time.Now().Add(timeout)
+	atomic.StoreInt32(&t.numDraining, int32(len(t.draining)))
+}
+
+// Undrain stops draining addr.
+func (t *BackendTracker) Undrain(addr string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.draining, addr)
+	atomic.StoreInt32(&t.numDraining, int32(len(t.draining)))
+}
+
+// Status returns whether addr is draining and the number of requests and
+// connections in flight to it.
+func (t *BackendTracker) Status(addr string) (draining bool, inFlight int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if until, ok := t.draining[addr]; ok && time.Now().After(until) {
+		// remove the expired drain
+		delete(t.draining, addr)
+		atomic.StoreInt32(&t.numDraining, int32(len(t.draining)))
+	}
+	if n, ok := t.inFlight[addr]; ok {
+		inFlight = int(atomic.LoadInt64(n))
+	}
+	return t.isDraining(addr, time.Now()), inFlight
+}
+
+// isDraining reports whether addr is draining at now. The mutex must be held
+// by the caller, at least for reading.
+func (t *BackendTracker) isDraining(addr string, now time.Time) bool {
+	until, ok := t.draining[addr]
+	return ok && !now.After(until)
+}
+
+// filter returns the backends which are not draining, keeping sticky even if
+// it is. If every backend is draining they are all returned, as draining
+// backends are better than none.
+func (t *BackendTracker) filter(backends []string, sticky string) []string {
+	if t == nil || atomic.LoadInt32(&t.numDraining) == 0 {
+		return backends
+	}
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	now := time.Now()
+	filtered := make([]string, 0, len(backends))
+	for _, addr := range backends {
+		if addr == sticky || !t.isDraining(addr, now) {
+			filtered = append(filtered, addr)
+		}
+	}
+	if len(filtered) == 0 {
+		return backends
+	}
+	return filtered
+}
+
+// start records a request to addr as in flight until the returned function
+// is called, which may be called more than once.
+func (t *BackendTracker) start(addr string) func() {
+	if t == nil {
+		return func() {}
+	}
+	// the counter is incremented while holding the lock so that it can't
+	// be removed by a concurrent finish in between
+	t.mtx.RLock()
+	n, ok := t.inFlight[addr]
+	if ok {
+		atomic.AddInt64(n, 1)
+	}
+	t.mtx.RUnlock()
+	if !ok {
+		t.mtx.Lock()
+		if n, ok = t.inFlight[addr]; !ok {
+			n = new(int64)
+			t.inFlight[addr] = n
+		}
+		atomic.AddInt64(n, 1)
+		t.mtx.Unlock()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if atomic.AddInt64(n, -1) > 0 {
+				return
+			}
+			// remove the counter once nothing is in flight, checking
+			// again with the lock held as a request may have started
+			t.mtx.Lock()
+			defer t.mtx.Unlock()
+			if atomic.LoadInt64(n) <= 0 && t.inFlight[addr] == n {
+				delete(t.inFlight, addr)
+			}
+		})
+	}
+}
+
+// trackedBody is a response body which finishes its request once closed.
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	defer b.done()
+	return b.ReadCloser.Close()
+}
+
+// trackedConn is a backend connection which is in flight until closed.
+type trackedConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	defer c.done()
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -59,14 +59,16 @@ type ReverseProxy struct {
 }
 
 // NewReverseProxy initializes a new ReverseProxy with a callback to get
-// backends, a stickyKey for encrypting sticky session cookies, and a flag
-// sticky to enable sticky sessions.
-func NewReverseProxy(bf BackendListFunc, stickyKey *[32]byte, sticky bool) *ReverseProxy {
+// backends, stickyKeys for encrypting and decrypting sticky session cookies,
+// a flag sticky to enable sticky sessions, and an optional tracker of the
+// requests in flight to each backend.
+func NewReverseProxy(bf BackendListFunc, stickyKeys *StickyKeys, sticky bool, tracker *BackendTracker) *ReverseProxy {
 	return &ReverseProxy{
 		transport: &transport{
 			getBackends:       bf,
-			stickyCookieKey:   stickyKey,
+			stickyCookieKeys:  stickyKeys,
 			useStickySessions: sticky,
+			tracker:           tracker,
 		},
 		FlushInterval: 10 * time.Millisecond,
 	}
@@ -4,7 +4,11 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
 )
@@ -31,11 +35,108 @@ func TestServeConnClientGone(t *testing.T) {
 	})
 
 	fn := func() []string { return []string{"127.0.0.1:0", "127.0.0.1:0"} }
-	prox := NewReverseProxy(fn, nil, false)
+	prox := NewReverseProxy(fn, nil, false, nil)
 
 	prox.ServeConn(context.Background(), cnConn)
 }
 
+func TestDrainBackend(t *testing.T) {
+	dialer = &net.Dialer{Timeout: time.Second}
+
+	release := make(chan struct{})
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/block" {
+				<-release
+			}
+			w.Write([]byte(name))
+		}
+	}
+	srv1 := httptest.NewServer(handler("srv1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(handler("srv2"))
+	defer srv2.Close()
+	addr1 := strings.TrimPrefix(srv1.URL, "http://")
+	addr2 := strings.TrimPrefix(srv2.URL, "http://")
+
+	tracker := NewBackendTracker()
+	fn := func() []string { return []string{addr1, addr2} }
+	prox := NewReverseProxy(fn, nil, false, tracker)
+
+	tracker.Drain(addr1, time.Minute)
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", strings.NewReader(""))
+		rec := httptest.NewRecorder()
+		prox.ServeHTTP(rec, req)
+		if body := rec.Body.String(); body != "srv2" {
+			t.Fatalf("expected request to be sent to srv2, got %q", body)
+		}
+	}
+
+	// requests in flight are counted until their response is finished
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("GET", "http://example.com/block", strings.NewReader(""))
+		prox.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	var inFlight int
+	for i := 0; i < 100; i++ {
+		if _, inFlight = tracker.Status(addr2); inFlight == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if inFlight != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", inFlight)
+	}
+	close(release)
+	<-done
+	if _, inFlight = tracker.Status(addr2); inFlight != 0 {
+		t.Fatalf("expected no requests in flight, got %d", inFlight)
+	}
+
+	// draining backends are used once the drain is removed or expires
+	tracker.Undrain(addr1)
+	if draining, _ := tracker.Status(addr1); draining {
+		t.Fatal("expected srv1 to not be draining")
+	}
+	tracker.Drain(addr1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if draining, _ := tracker.Status(addr1); draining {
+		t.Fatal("expected srv1 drain to expire")
+	}
+}
+
+func TestBackendTrackerConcurrent(t *testing.T) {
+	tracker := NewBackendTracker()
+	addrs := []string{"10.0.0.1:80", "10.0.0.2:80"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				done := tracker.start(addr)
+				tracker.filter(addrs, "")
+				done()
+				done()
+			}
+		}(addrs[i%len(addrs)])
+	}
+	tracker.Drain(addrs[0], time.Minute)
+	wg.Wait()
+
+	for _, addr := range addrs {
+		if _, inFlight := tracker.Status(addr); inFlight != 0 {
+			t.Fatalf("expected no requests in flight to %s, got %d", addr, inFlight)
+		}
+	}
+	if n := len(tracker.inFlight); n != 0 {
+		t.Fatalf("expected the counters to be removed, got %d", n)
+	}
+}
+
 type dialerFunc func(string, string) (net.Conn, error)
 
 func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// StickyKeys holds the keys used to encrypt and decrypt sticky session cookies.
+// New cookies are encrypted with the primary key, and cookies are decrypted
+// with the primary key or any of the secondary keys so that the primary key
+// can be rotated without invalidating existing sessions.
+type StickyKeys struct {
+	mtx       sync.RWMutex
+	primary   [32]byte
+	secondary [][32]byte
+}
+
+// NewStickyKeys returns StickyKeys with the given primary and secondary keys.
+// A nil primary key is treated as the zero key.
+func NewStickyKeys(primary *[32]byte, secondary ...*[32]byte) *StickyKeys {
+	k := &StickyKeys{}
+	k.Set(primary, secondary...)
+	return k
+}
+
+// Set replaces the primary and secondary keys.
+func (k *StickyKeys) Set(primary *[32]byte, secondary ...*[32]byte) {
+	keys := make([][32]byte, 0, len(secondary))
+	for _, key := range secondary {
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if primary != nil {
+		k.primary = *primary
+	} else {
+		k.primary = [32]byte{}
+	}
+	k.secondary = keys
+}
+
+// Primary returns the key that is used to encrypt new cookies.
+func (k *StickyKeys) Primary() [32]byte {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	return k.primary
+}
+
+func (k *StickyKeys) encrypt(data []byte) []byte {
+	return encrypt(data, k.Primary())
+}
+
+// decrypt attempts to decrypt data with each of the keys, returning nil if
+// none of them succeed. stale is true if data was decrypted with a secondary
+// key, which indicates that it should be encrypted again with the primary key.
+func (k *StickyKeys) decrypt(data []byte) (res []byte, stale bool) {
+	k.mtx.RLock()
+	primary, secondary := k.primary, k.secondary
+	k.mtx.RUnlock()
+
+	if res := decrypt(data, primary); res != nil {
+		return res, false
+	}
+	for _, key := range secondary {
+		if res := decrypt(data, key); res != nil {
+			return res, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestStickyKeysRotation(t *testing.T) {
+	oldKey, newKey := &[32]byte{1}, &[32]byte{2}
+	keys := NewStickyKeys(oldKey)
+	data := keys.encrypt([]byte("backend"))
+
+	keys.Set(newKey, oldKey)
+	res, stale := keys.decrypt(data)
+	if string(res) != "backend" {
+		t.Fatalf("expected data to be decrypted with secondary key, got %q", res)
+	}
+	if !stale {
+		t.Fatal("expected data decrypted with secondary key to be stale")
+	}
+
+	res, stale = keys.decrypt(keys.encrypt([]byte("backend")))
+	if string(res) != "backend" || stale {
+		t.Fatalf("expected data to be decrypted with primary key, got %q (stale=%t)", res, stale)
+	}
+
+	keys.Set(newKey)
+	if res, _ := keys.decrypt(data); res != nil {
+		t.Fatalf("expected data encrypted with removed key to fail, got %q", res)
+	}
+}
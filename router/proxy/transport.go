@@ -41,12 +41,14 @@ type BackendListFunc func() []string
 type transport struct {
 	getBackends BackendListFunc
 
-	stickyCookieKey   *[32]byte
+	stickyCookieKeys  *StickyKeys
 	useStickySessions bool
+
+	tracker *BackendTracker
 }
 
 func (t *transport) getOrderedBackends(stickyBackend string) []string {
-	backends := t.getBackends()
+	backends := t.tracker.filter(t.getBackends(), stickyBackend)
 	shuffle(backends)
 
 	if stickyBackend != "" {
@@ -55,19 +57,21 @@ func (t *transport) getOrderedBackends(stickyBackend string) []string {
 	return backends
 }
 
-func (t *transport) getStickyBackend(req *http.Request) string {
+// getStickyBackend returns the backend from the sticky session cookie of req,
+// stale is true if the cookie was encrypted with a secondary key.
+func (t *transport) getStickyBackend(req *http.Request) (backend string, stale bool) {
 	if t.useStickySessions {
-		return getStickyCookieBackend(req, *t.stickyCookieKey)
+		return getStickyCookieBackend(req, t.stickyCookieKeys)
 	}
-	return ""
+	return "", false
 }
 
-func (t *transport) setStickyBackend(res *http.Response, originalStickyBackend string) {
+func (t *transport) setStickyBackend(res *http.Response, originalStickyBackend string, stale bool) {
 	if !t.useStickySessions {
 		return
 	}
-	if backend := res.Request.URL.Host; backend != originalStickyBackend {
-		setStickyCookieBackend(res, backend, *t.stickyCookieKey)
+	if backend := res.Request.URL.Host; backend != originalStickyBackend || stale {
+		setStickyCookieBackend(res, backend, t.stickyCookieKeys)
 	}
 }
 
@@ -76,15 +80,18 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Body = &fakeCloseReadCloser{req.Body}
 	defer req.Body.(*fakeCloseReadCloser).RealClose()
 
-	stickyBackend := t.getStickyBackend(req)
+	stickyBackend, stale := t.getStickyBackend(req)
 	backends := t.getOrderedBackends(stickyBackend)
 	for _, backend := range backends {
 		req.URL.Host = backend
+		done := t.tracker.start(backend)
 		res, err := httpTransport.RoundTrip(req)
 		if err == nil {
-			t.setStickyBackend(res, stickyBackend)
+			t.setStickyBackend(res, stickyBackend, stale)
+			res.Body = &trackedBody{res.Body, done}
 			return res, nil
 		}
+		done()
 		if _, ok := err.(dialErr); !ok {
 			return nil, err
 		}
@@ -95,18 +102,21 @@ func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 func (t *transport) Connect(ctx context.Context) (net.Conn, error) {
 	backends := t.getOrderedBackends("")
-	conn, _, err := dialTCP(ctx, backends)
-	return conn, err
+	conn, addr, err := dialTCP(ctx, backends)
+	if err != nil {
+		return nil, err
+	}
+	return &trackedConn{conn, t.tracker.start(addr)}, nil
 }
 
 func (t *transport) UpgradeHTTP(req *http.Request) (*http.Response, net.Conn, error) {
-	stickyBackend := t.getStickyBackend(req)
+	stickyBackend, stale := t.getStickyBackend(req)
 	backends := t.getOrderedBackends(stickyBackend)
 	upconn, addr, err := dialTCP(context.Background(), backends)
 	if err != nil {
 		return nil, nil, err
 	}
-	conn := &streamConn{bufio.NewReader(upconn), upconn}
+	conn := &streamConn{bufio.NewReader(upconn), &trackedConn{upconn, t.tracker.start(addr)}}
 	req.URL.Host = addr
 
 	if err := req.Write(conn); err != nil {
@@ -118,7 +128,7 @@ func (t *transport) UpgradeHTTP(req *http.Request) (*http.Response, net.Conn, er
 		conn.Close()
 		return nil, nil, err
 	}
-	t.setStickyBackend(res, stickyBackend)
+	t.setStickyBackend(res, stickyBackend, stale)
 	return res, conn, nil
 }
 
@@ -181,23 +191,24 @@ func swapToFront(ss []string, s string) {
 	}
 }
 
-func getStickyCookieBackend(req *http.Request, cookieKey [32]byte) string {
+func getStickyCookieBackend(req *http.Request, cookieKeys *StickyKeys) (string, bool) {
 	cookie, err := req.Cookie(stickyCookie)
 	if err != nil {
-		return ""
+		return "", false
 	}
 
 	data, err := base64.StdEncoding.DecodeString(cookie.Value)
 	if err != nil {
-		return ""
+		return "", false
 	}
-	return string(decrypt(data, cookieKey))
+	backend, stale := cookieKeys.decrypt(data)
+	return string(backend), stale
 }
 
-func setStickyCookieBackend(res *http.Response, backend string, cookieKey [32]byte) {
+func setStickyCookieBackend(res *http.Response, backend string, cookieKeys *StickyKeys) {
 	cookie := http.Cookie{
 		Name:  stickyCookie,
-		Value: base64.StdEncoding.EncodeToString(encrypt([]byte(backend), cookieKey)),
+		Value: base64.StdEncoding.EncodeToString(cookieKeys.encrypt([]byte(backend))),
 		Path:  "/",
 	}
 	res.Header.Add("Set-Cookie", cookie.String())
@@ -81,5 +81,52 @@ CREATE TRIGGER notify_http_route_update
 	AFTER INSERT OR UPDATE OR DELETE ON http_routes
 	FOR EACH ROW EXECUTE PROCEDURE notify_http_route_update()`,
 	)
+	m.Add(2,
+		// TCP routes with a server name are served on the TLS port of the
+		// HTTP listener rather than their own port
+		`ALTER TABLE tcp_routes ADD COLUMN server_name varchar(255) NOT NULL DEFAULT ''`,
+		`ALTER TABLE tcp_routes DROP CONSTRAINT tcp_routes_port_check`,
+		`ALTER TABLE tcp_routes ADD CONSTRAINT tcp_routes_port_check CHECK ((server_name = '' AND port > 0 AND port < 65535) OR (server_name <> '' AND port = 0))`,
+		`DROP INDEX tcp_routes_port_key`,
+		`CREATE UNIQUE INDEX tcp_routes_port_key ON tcp_routes USING btree (port) WHERE deleted_at IS NULL AND server_name = ''`,
+		`CREATE UNIQUE INDEX tcp_routes_server_name_key ON tcp_routes USING btree (server_name) WHERE deleted_at IS NULL AND server_name <> ''`,
+	)
+	m.Add(3,
+		`ALTER TABLE http_routes ADD COLUMN path_rewrite_prefix text NOT NULL DEFAULT '' CHECK (path_rewrite_prefix = '' OR path_rewrite_prefix LIKE '/%')`,
+		`ALTER TABLE http_routes ADD COLUMN path_rewrite_replacement text NOT NULL DEFAULT ''`,
+	)
+	m.Add(4,
+		`ALTER TABLE http_routes ADD COLUMN mirror_service varchar(255) NOT NULL DEFAULT ''`,
+		`ALTER TABLE http_routes ADD COLUMN mirror_percent integer NOT NULL DEFAULT 0 CHECK (mirror_percent >= 0 AND mirror_percent <= 100)`,
+	)
+	m.Add(5,
+		`ALTER TABLE http_routes ADD COLUMN match_rules text NOT NULL DEFAULT ''`,
+	)
+	m.Add(6,
+		`
+CREATE TABLE sticky_cookie_keys (
+	id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+	key text NOT NULL CHECK (key <> ''),
+	created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`
+CREATE OR REPLACE FUNCTION notify_sticky_cookie_keys_update() RETURNS TRIGGER AS $$
+BEGIN
+	PERFORM pg_notify('sticky_cookie_keys', NEW.id::varchar);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+		`
+CREATE TRIGGER notify_sticky_cookie_keys_update
+	AFTER INSERT OR UPDATE OR DELETE ON sticky_cookie_keys
+	FOR EACH ROW EXECUTE PROCEDURE notify_sticky_cookie_keys_update()`,
+	)
+	m.Add(7,
+		`ALTER TABLE http_routes ADD COLUMN filter_rules text NOT NULL DEFAULT ''`,
+	)
+	m.Add(8,
+		`ALTER TABLE http_routes ADD COLUMN maintenance boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE http_routes ADD COLUMN maintenance_page text NOT NULL DEFAULT ''`,
+	)
 	return m.Migrate(db)
 }
@@ -2,18 +2,23 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/jackc/pgx"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kavu/go_reuseport"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/types"
 )
 
@@ -23,6 +28,7 @@ type Listener interface {
 	AddRoute(*router.Route) error
 	UpdateRoute(*router.Route) error
 	RemoveRoute(id string) error
+	ApplyRoutes(*router.RouteBatch) error
 	Watcher
 	DataStoreReader
 }
@@ -30,6 +36,10 @@ type Listener interface {
 type Router struct {
 	HTTP Listener
 	TCP  Listener
+
+	// Backends tracks the requests in flight to the backends of both
+	// listeners, and which backends are being drained.
+	Backends *proxy.BackendTracker
 }
 
 func (s *Router) Start() error {
@@ -51,13 +61,23 @@ func main() {
 	}
 	var cookieKey *[32]byte
 	if key := os.Getenv("COOKIE_KEY"); key != "" {
-		res, err := base64.StdEncoding.DecodeString(key)
+		k, err := decodeCookieKey(key)
 		if err != nil {
 			shutdown.Fatal("error decoding COOKIE_KEY:", err)
 		}
-		var k [32]byte
-		copy(k[:], res)
-		cookieKey = &k
+		cookieKey = k
+	}
+	// COOKIE_SECONDARY_KEYS is a comma separated list of keys that are only
+	// used to decrypt sticky cookies, allowing COOKIE_KEY to be rotated
+	var secondaryCookieKeys []*[32]byte
+	if keys := os.Getenv("COOKIE_SECONDARY_KEYS"); keys != "" {
+		for _, key := range strings.Split(keys, ",") {
+			k, err := decodeCookieKey(strings.TrimSpace(key))
+			if err != nil {
+				shutdown.Fatal("error decoding COOKIE_SECONDARY_KEYS:", err)
+			}
+			secondaryCookieKeys = append(secondaryCookieKeys, k)
+		}
 	}
 
 	httpAddr := flag.String("httpaddr", ":8080", "http listen address")
@@ -67,7 +87,14 @@ func main() {
 	tcpRangeEnd := flag.Int("tcp-range-end", 3500, "tcp port range end")
 	certFile := flag.String("tlscert", "", "TLS (SSL) cert file in pem format")
 	keyFile := flag.String("tlskey", "", "TLS (SSL) key file in pem format")
+	clientCAFile := flag.String("tls-client-ca", "", "TLS (SSL) client CA file in pem format, enables client certificate verification")
 	apiAddr := flag.String("apiaddr", ":"+apiPort, "api listen address")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of HTTP request headers")
+	maxConns := flag.Int("max-conns", 0, "maximum concurrent connections per HTTP listener (0 for no limit)")
+	idleTimeout := flag.Duration("idle-timeout", 90*time.Second, "maximum time to wait for the next request on a keep-alive HTTP connection (0 for no limit)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 30*time.Second, "maximum time to read HTTP request headers (0 for no limit)")
+	maxRequestsPerConn := flag.Int("max-requests-per-conn", 0, "maximum requests served on a single HTTP connection (0 for no limit)")
+	maintenancePageFile := flag.String("maintenance-page", "", "HTML file returned for routes in maintenance mode (defaults to a built-in page)")
 	flag.Parse()
 
 	keypair := tls.Certificate{}
@@ -85,6 +112,25 @@ func main() {
 		}
 	}
 
+	var clientCAs *x509.CertPool
+	if *clientCAFile != "" {
+		pem, err := ioutil.ReadFile(*clientCAFile)
+		if err != nil {
+			shutdown.Fatal(err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			shutdown.Fatal("error parsing TLS client CA file")
+		}
+	}
+
+	var maintenancePage []byte
+	if *maintenancePageFile != "" {
+		if maintenancePage, err = ioutil.ReadFile(*maintenancePageFile); err != nil {
+			shutdown.Fatal(err)
+		}
+	}
+
 	postgres.Wait("")
 	db, err := postgres.Open("", "")
 	if err != nil {
@@ -116,21 +162,44 @@ func main() {
 	}
 	shutdown.BeforeExit(func() { pgxpool.Close() })
 
+	// sticky cookie keys are shared by all routers via the database unless they
+	// are provided in the environment
+	var cookieKeyStore CookieKeyStore
+	if cookieKey == nil {
+		if cookieKeyStore, err = NewPostgresCookieKeyStore(pgxpool); err != nil {
+			shutdown.Fatal(err)
+		}
+	}
+
+	backends := proxy.NewBackendTracker()
+	tcpListener := &TCPListener{
+		IP:        *tcpIP,
+		startPort: *tcpRangeStart,
+		endPort:   *tcpRangeEnd,
+		ds:        NewPostgresDataStore("tcp", pgxpool),
+		discoverd: discoverd.DefaultClient,
+		backends:  backends,
+	}
 	r := Router{
-		TCP: &TCPListener{
-			IP:        *tcpIP,
-			startPort: *tcpRangeStart,
-			endPort:   *tcpRangeEnd,
-			ds:        NewPostgresDataStore("tcp", pgxpool),
-			discoverd: discoverd.DefaultClient,
-		},
+		Backends: backends,
+		TCP:      tcpListener,
 		HTTP: &HTTPListener{
-			Addr:      *httpAddr,
-			TLSAddr:   *httpsAddr,
-			cookieKey: cookieKey,
-			keypair:   keypair,
-			ds:        NewPostgresDataStore("http", pgxpool),
-			discoverd: discoverd.DefaultClient,
+			Addr:               *httpAddr,
+			TLSAddr:            *httpsAddr,
+			MaxHeaderBytes:     *maxHeaderBytes,
+			MaxConns:           *maxConns,
+			IdleTimeout:        *idleTimeout,
+			ReadHeaderTimeout:  *readHeaderTimeout,
+			MaxRequestsPerConn: *maxRequestsPerConn,
+			MaintenancePage:    string(maintenancePage),
+			ServerNameService:  tcpListener.ServerNameService,
+			ClientCAs:          clientCAs,
+			cookieKeys:         proxy.NewStickyKeys(cookieKey, secondaryCookieKeys...),
+			cookieKeyStore:     cookieKeyStore,
+			keypair:            keypair,
+			ds:                 NewPostgresDataStore("http", pgxpool),
+			discoverd:          discoverd.DefaultClient,
+			backends:           backends,
 		},
 	}
 
@@ -157,3 +226,13 @@ func main() {
 
 	shutdown.Fatal(http.Serve(listener, apiHandler(&r)))
 }
+
+func decodeCookieKey(key string) (*[32]byte, error) {
+	res, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	var k [32]byte
+	copy(k[:], res)
+	return &k, nil
+}
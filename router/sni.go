@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tlsRecordTypeHandshake   = 22
+	tlsHandshakeClientHello  = 1
+	tlsExtensionServerName   = 0
+	tlsServerNameTypeHost    = 0
+	tlsMaxRecordLength       = 16384 + 2048
+	clientHelloSniffDeadline = 10 * time.Second
+)
+
+var errInvalidClientHello = errors.New("router: invalid TLS ClientHello")
+
+// readServerName reads the first TLS record from r, which is expected to
+// contain a ClientHello, and returns the SNI server name along with all of the
+// bytes that were read so that they can be replayed to the real TLS server.
+func readServerName(r io.Reader) (string, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", header, err
+	}
+	if header[0] != tlsRecordTypeHandshake {
+		return "", header, errInvalidClientHello
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLength {
+		return "", header, errInvalidClientHello
+	}
+	record := make([]byte, length)
+	n, err := io.ReadFull(r, record)
+	data := append(header, record[:n]...)
+	if err != nil {
+		return "", data, err
+	}
+	name, err := parseClientHelloServerName(record)
+	return name, data, err
+}
+
+// parseClientHelloServerName returns the host_name from the server_name
+// extension of a ClientHello handshake message. An empty name is returned if
+// the client did not send the extension.
+func parseClientHelloServerName(msg []byte) (string, error) {
+	if len(msg) < 4 || msg[0] != tlsHandshakeClientHello {
+		return "", errInvalidClientHello
+	}
+	length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg)-4 < length {
+		return "", errInvalidClientHello
+	}
+	msg = msg[4 : 4+length]
+
+	// skip version (2) and random (32)
+	if len(msg) < 34 {
+		return "", errInvalidClientHello
+	}
+	msg = msg[34:]
+
+	// skip session id, cipher suites and compression methods
+	var ok bool
+	if msg, ok = skipVector(msg, 1); !ok {
+		return "", errInvalidClientHello
+	}
+	if msg, ok = skipVector(msg, 2); !ok {
+		return "", errInvalidClientHello
+	}
+	if msg, ok = skipVector(msg, 1); !ok {
+		return "", errInvalidClientHello
+	}
+
+	if len(msg) == 0 {
+		// no extensions
+		return "", nil
+	}
+	if len(msg) < 2 {
+		return "", errInvalidClientHello
+	}
+	extLen := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	if len(msg) < extLen {
+		return "", errInvalidClientHello
+	}
+	msg = msg[:extLen]
+
+	for len(msg) >= 4 {
+		typ := binary.BigEndian.Uint16(msg)
+		length := int(binary.BigEndian.Uint16(msg[2:]))
+		msg = msg[4:]
+		if len(msg) < length {
+			return "", errInvalidClientHello
+		}
+		data := msg[:length]
+		msg = msg[length:]
+		if typ != tlsExtensionServerName {
+			continue
+		}
+
+		if len(data) < 2 {
+			return "", errInvalidClientHello
+		}
+		data = data[2:]
+		for len(data) >= 3 {
+			nameType := data[0]
+			nameLen := int(binary.BigEndian.Uint16(data[1:]))
+			data = data[3:]
+			if len(data) < nameLen {
+				return "", errInvalidClientHello
+			}
+			if nameType == tlsServerNameTypeHost {
+				return string(data[:nameLen]), nil
+			}
+			data = data[nameLen:]
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// skipVector skips a variable length vector prefixed by a big-endian length
+// of size bytes.
+func skipVector(b []byte, size int) ([]byte, bool) {
+	if len(b) < size {
+		return nil, false
+	}
+	var length int
+	for i := 0; i < size; i++ {
+		length = length<<8 | int(b[i])
+	}
+	b = b[size:]
+	if len(b) < length {
+		return nil, false
+	}
+	return b[length:], true
+}
+
+// connServer serves raw connections, e.g. the service of a TCP route.
+type connServer interface {
+	ServeConn(net.Conn)
+}
+
+// sniListener is a net.Listener that reads the ClientHello of each inbound
+// connection before the TLS handshake. Connections with a server name that
+// lookup returns a connServer for, i.e. which matches a TCP route with that
+// server name, are proxied to it without being terminated, all others are
+// terminated with config and returned from Accept.
+type sniListener struct {
+	net.Listener
+
+	config *tls.Config
+	lookup func(serverName string) connServer
+
+	connc     chan net.Conn
+	errc      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSNIListener(l net.Listener, config *tls.Config, lookup func(string) connServer) *sniListener {
+	s := &sniListener{
+		Listener: l,
+		config:   config,
+		lookup:   lookup,
+		connc:    make(chan net.Conn),
+		errc:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go s.acceptLoop()
+	return s
+}
+
+func (s *sniListener) acceptLoop() {
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.errc <- err
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *sniListener) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloSniffDeadline))
+	serverName, data, err := readServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	conn = &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(data), conn)}
+
+	if err == nil && serverName != "" && s.lookup != nil {
+		if srv := s.lookup(serverName); srv != nil {
+			srv.ServeConn(conn)
+			return
+		}
+	}
+
+	// unknown server names and invalid handshakes are left for the TLS server
+	// to deal with
+	select {
+	case s.connc <- tls.Server(conn, s.config):
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+func (s *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.connc:
+		return conn, nil
+	case err := <-s.errc:
+		s.errc <- err
+		return nil, err
+	}
+}
+
+func (s *sniListener) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.Listener.Close()
+}
+
+// replayConn is a net.Conn that reads from r instead of directly from the
+// connection, used to replay bytes that have already been read.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// SyncFunc syncs state until ctx is done or an error occurs, closing startc
+// once the initial state has been loaded.
+type SyncFunc func(ctx context.Context, startc chan<- struct{}) error
+
+// startSync runs sync, returning once the initial sync has completed. If sync
+// subsequently fails, it is restarted until ctx is done.
+func startSync(ctx context.Context, name string, sync SyncFunc) error {
+	errc := make(chan error)
+	startc := doSync(ctx, sync, errc)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-startc:
+		go runSync(ctx, name, sync, errc)
+		return nil
+	}
+}
+
+func runSync(ctx context.Context, name string, sync SyncFunc, errc chan error) {
+	err := <-errc
+
+	for {
+		if err == nil {
+			return
+		}
+		log.Printf("router: %s sync error: %s", name, err)
+
+		doSync(ctx, sync, errc)
+
+		err = <-errc
+	}
+}
+
+func doSync(ctx context.Context, sync SyncFunc, errc chan<- error) <-chan struct{} {
+	startc := make(chan struct{})
+
+	go func() { errc <- sync(ctx, startc) }()
+
+	return startc
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/kavu/go_reuseport"
@@ -24,6 +25,7 @@ type TCPListener struct {
 	ds        DataStore
 	wm        *WatchManager
 	stopSync  func()
+	backends  *proxy.BackendTracker
 
 	startPort int
 	endPort   int
@@ -33,9 +35,14 @@ type TCPListener struct {
 	services map[string]*tcpService
 	routes   map[string]*tcpRoute
 	ports    map[int]*tcpRoute
-	closed   bool
+	// serverNames are the routes which are served on the TLS port of the
+	// HTTP listener, keyed by their lower case server name.
+	serverNames map[string]*tcpRoute
+	closed      bool
 }
 
+var errServerNamePort = invalidRouteError{errors.New("router: a port can't be specified for routes with a server name")}
+
 func (l *TCPListener) AddRoute(route *router.Route) error {
 	r := route.TCPRoute()
 	l.mtx.RLock()
@@ -43,6 +50,12 @@ func (l *TCPListener) AddRoute(route *router.Route) error {
 	if l.closed {
 		return ErrClosed
 	}
+	if r.ServerName != "" {
+		if err := validateTCPRoute(route); err != nil {
+			return err
+		}
+		return l.ds.Add(route)
+	}
 	if r.Port == 0 {
 		return l.addWithAllocatedPort(route)
 	}
@@ -51,19 +64,64 @@ func (l *TCPListener) AddRoute(route *router.Route) error {
 }
 
 func (l *TCPListener) UpdateRoute(route *router.Route) error {
-	r := route.TCPRoute()
 	l.mtx.RLock()
 	defer l.mtx.RUnlock()
 	if l.closed {
 		return ErrClosed
 	}
-	if r.Port == 0 {
-		return errors.New("router: a port number needs to be specified")
+	if err := validateTCPRoute(route); err != nil {
+		return err
+	}
+	if route.ServerName == "" {
+		route.ID = md5sum(strconv.Itoa(int(route.Port)))
 	}
-	route.ID = md5sum(strconv.Itoa(r.Port))
 	return l.ds.Update(route)
 }
 
+// ApplyRoutes applies batch atomically, all of the routes being added or
+// updated must specify a port or a server name.
+func (l *TCPListener) ApplyRoutes(batch *router.RouteBatch) error {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	for _, routes := range [][]*router.Route{batch.Add, batch.Update} {
+		for _, r := range routes {
+			if err := validateTCPRoute(r); err != nil {
+				return err
+			}
+		}
+	}
+	return l.ds.Apply(batch)
+}
+
+// validateTCPRoute checks exactly one of the port or server name of route is
+// set, and lower cases the server name as server names are case insensitive.
+func validateTCPRoute(route *router.Route) error {
+	switch {
+	case route.ServerName != "" && route.Port != 0:
+		return errServerNamePort
+	case route.ServerName == "" && route.Port == 0:
+		return invalidRouteError{errors.New("router: a port number or server name needs to be specified")}
+	}
+	route.ServerName = strings.ToLower(route.ServerName)
+	return nil
+}
+
+// ServerNameService returns the service of the route for the TLS server name,
+// or nil if there isn't one. It is used by the HTTP listener to proxy
+// connections to its TLS port which request the server name.
+func (l *TCPListener) ServerNameService(serverName string) connServer {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	r, ok := l.serverNames[strings.ToLower(serverName)]
+	if !ok {
+		return nil
+	}
+	return r.service
+}
+
 var ErrNoPorts = errors.New("router: no ports available")
 
 func (l *TCPListener) addWithAllocatedPort(route *router.Route) error {
@@ -109,6 +167,7 @@ func (l *TCPListener) Start() error {
 	l.services = make(map[string]*tcpService)
 	l.routes = make(map[string]*tcpRoute)
 	l.ports = make(map[int]*tcpRoute)
+	l.serverNames = make(map[string]*tcpRoute)
 	l.listeners = make(map[int]net.Listener)
 
 	if l.startPort != 0 && l.endPort != 0 {
@@ -124,49 +183,16 @@ func (l *TCPListener) Start() error {
 
 	// TODO(benburkert): the sync API cannot handle routes deleted while the
 	// listen/notify connection is disconnected
-	if err := l.startSync(ctx); err != nil {
+	err := startSync(ctx, "tcp", func(ctx context.Context, startc chan<- struct{}) error {
+		return l.ds.Sync(ctx, &tcpSyncHandler{l: l}, startc)
+	})
+	if err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (l *TCPListener) startSync(ctx context.Context) error {
-	errc := make(chan error)
-	startc := l.doSync(ctx, errc)
-
-	select {
-	case err := <-errc:
-		return err
-	case <-startc:
-		go l.runSync(ctx, errc)
-		return nil
-	}
-}
-
-func (l *TCPListener) runSync(ctx context.Context, errc chan error) {
-	err := <-errc
-
-	for {
-		if err == nil {
-			return
-		}
-		log.Printf("router: tcp sync error: %s", err)
-
-		l.doSync(ctx, errc)
-
-		err = <-errc
-	}
-}
-
-func (l *TCPListener) doSync(ctx context.Context, errc chan<- error) <-chan struct{} {
-	startc := make(chan struct{})
-
-	go func() { errc <- l.ds.Sync(ctx, &tcpSyncHandler{l: l}, startc) }()
-
-	return startc
-}
-
 func (l *TCPListener) Close() error {
 	l.mtx.Lock()
 	defer l.mtx.Unlock()
@@ -186,6 +212,26 @@ type tcpSyncHandler struct {
 }
 
 func (h *tcpSyncHandler) Set(data *router.Route) error {
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+	if err := h.set(data); err != nil {
+		return err
+	}
+
+	go h.l.wm.Send(&router.Event{Event: "set", ID: data.ID})
+	return nil
+}
+
+// set starts serving the route. The listener mutex must be held by the
+// caller.
+func (h *tcpSyncHandler) set(data *router.Route) error {
+	if old, ok := h.l.routes[data.ID]; ok && old.ServerName != "" {
+		// routes with a server name are replaced rather than added again
+		h.remove(data.ID)
+	}
 	route := data.TCPRoute()
 	r := &tcpRoute{
 		TCPRoute: route,
@@ -193,12 +239,6 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 		parent:   h.l,
 	}
 
-	h.l.mtx.Lock()
-	defer h.l.mtx.Unlock()
-	if h.l.closed {
-		return nil
-	}
-
 	service := h.l.services[r.Service]
 	if service != nil && service.name != r.Service {
 		service.refs--
@@ -216,11 +256,18 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 		service = &tcpService{
 			name: r.Service,
 			sc:   sc,
-			rp:   proxy.NewReverseProxy(sc.Addrs, nil, false),
+			rp:   proxy.NewReverseProxy(sc.Addrs, nil, false, h.l.backends),
 		}
 		h.l.services[r.Service] = service
 	}
 	r.service = service
+	if r.ServerName != "" {
+		// the route is served by the HTTP listener using ServerNameService
+		service.refs++
+		h.l.routes[data.ID] = r
+		h.l.serverNames[r.ServerName] = r
+		return nil
+	}
 	if listener, ok := h.l.listeners[r.Port]; ok {
 		r.l = listener
 		delete(h.l.listeners, r.Port)
@@ -236,8 +283,6 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 	service.refs++
 	h.l.routes[data.ID] = r
 	h.l.ports[r.Port] = r
-
-	go h.l.wm.Send(&router.Event{Event: "set", ID: data.ID})
 	return nil
 }
 
@@ -247,6 +292,16 @@ func (h *tcpSyncHandler) Remove(id string) error {
 	if h.l.closed {
 		return nil
 	}
+	if err := h.remove(id); err != nil {
+		return err
+	}
+	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
+	return nil
+}
+
+// remove stops serving the route with the given ID. The listener mutex must be
+// held by the caller.
+func (h *tcpSyncHandler) remove(id string) error {
 	r, ok := h.l.routes[id]
 	if !ok {
 		return ErrNotFound
@@ -260,8 +315,63 @@ func (h *tcpSyncHandler) Remove(id string) error {
 	}
 
 	delete(h.l.routes, id)
-	delete(h.l.ports, r.Port)
-	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
+	if r.ServerName != "" {
+		delete(h.l.serverNames, r.ServerName)
+	} else {
+		delete(h.l.ports, r.Port)
+	}
+	return nil
+}
+
+// Apply removes and then sets the given routes while holding the listener
+// mutex, so ports released by removed routes can be used by the new routes. If
+// a route can't be set, the routes the batch changed are restored.
+func (h *tcpSyncHandler) Apply(set []*router.Route, remove []string) error {
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+
+	// the routes being replaced or removed, to restore them if the batch
+	// fails
+	var prev []*router.Route
+	for _, id := range remove {
+		if r, ok := h.l.routes[id]; ok {
+			prev = append(prev, r.TCPRoute.ToRoute())
+		}
+	}
+	for _, data := range set {
+		if r, ok := h.l.routes[data.ID]; ok {
+			prev = append(prev, r.TCPRoute.ToRoute())
+		}
+	}
+
+	ids := make([]string, 0, len(set)+len(remove))
+	for _, id := range remove {
+		// routes which don't exist are already removed
+		h.remove(id)
+		ids = append(ids, id)
+	}
+	for i, data := range set {
+		if err := h.set(data); err != nil {
+			for _, data := range set[:i] {
+				h.remove(data.ID)
+			}
+			for _, data := range prev {
+				if _, ok := h.l.routes[data.ID]; ok {
+					continue
+				}
+				if err := h.set(data); err != nil {
+					log.Println("Error restoring route", data.ID, err)
+				}
+			}
+			return err
+		}
+		ids = append(ids, data.ID)
+	}
+
+	go h.l.wm.Send(&router.Event{Event: "batch", IDs: ids})
 	return nil
 }
 
@@ -296,6 +406,10 @@ func (r *tcpRoute) Serve(started chan<- error) {
 }
 
 func (r *tcpRoute) Close() {
+	if r.l == nil {
+		// routes with a server name don't have their own listener
+		return
+	}
 	if r.Port >= r.parent.startPort && r.Port <= r.parent.endPort {
 		// make a copy of the fd and create a new listener with it
 		fd, err := r.l.(*net.TCPListener).File()
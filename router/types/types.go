@@ -33,9 +33,44 @@ type Route struct {
 	// Sticky is whether or not to use sticky sessions for this route. It is only
 	// used for HTTP routes.
 	Sticky bool `json:"sticky,omitempty"`
+	// PathRewritePrefix is an optional request path prefix that is replaced
+	// with PathRewriteReplacement before the request is proxied to the service.
+	// It is only used for HTTP routes.
+	PathRewritePrefix string `json:"path_rewrite_prefix,omitempty"`
+	// PathRewriteReplacement replaces PathRewritePrefix in the request path. If
+	// it is empty, the prefix is stripped. It is only used for HTTP routes.
+	PathRewriteReplacement string `json:"path_rewrite_replacement,omitempty"`
+	// MirrorService is the optional ID of a service that a copy of requests is
+	// sent to. Responses from the mirror service are discarded. It is only used
+	// for HTTP routes.
+	MirrorService string `json:"mirror_service,omitempty"`
+	// MirrorPercent is the percentage of requests that are sent to
+	// MirrorService. It is only used for HTTP routes.
+	MirrorPercent int32 `json:"mirror_percent,omitempty"`
+	// MatchRules is an optional list of rules that route requests with a
+	// matching header or cookie value to a different service. The first
+	// matching rule is used, requests that do not match any rule are routed to
+	// Service. It is only used for HTTP routes.
+	MatchRules []MatchRule `json:"match_rules,omitempty"`
+	// FilterRules is an optional list of rules that block matching requests
+	// before they are proxied to the service. It is only used for HTTP routes.
+	FilterRules []FilterRule `json:"filter_rules,omitempty"`
+	// Maintenance is whether the route is in maintenance mode, in which case
+	// requests are not proxied to the service and a 503 maintenance page is
+	// returned instead. It is only used for HTTP routes.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// MaintenancePage is an optional HTML page returned in maintenance mode,
+	// if it is empty the router's default page is used. It is only used for
+	// HTTP routes.
+	MaintenancePage string `json:"maintenance_page,omitempty"`
 
 	// Port is the TCP port to listen on for TCP Routes.
 	Port int32 `json:"port,omitempty"`
+	// ServerName is the TLS server name that connections to the router's TLS
+	// port are matched on using SNI, the connections are proxied to the
+	// service without being terminated by the router. Port must not be set
+	// when it is used. It is only used for TCP routes.
+	ServerName string `json:"server_name,omitempty"`
 }
 
 func (r Route) FormattedID() string {
@@ -50,10 +85,18 @@ func (r Route) HTTPRoute() *HTTPRoute {
 		CreatedAt: r.CreatedAt,
 		UpdatedAt: r.UpdatedAt,
 
-		Domain:  r.Domain,
-		TLSCert: r.TLSCert,
-		TLSKey:  r.TLSKey,
-		Sticky:  r.Sticky,
+		Domain:                 r.Domain,
+		TLSCert:                r.TLSCert,
+		TLSKey:                 r.TLSKey,
+		Sticky:                 r.Sticky,
+		PathRewritePrefix:      r.PathRewritePrefix,
+		PathRewriteReplacement: r.PathRewriteReplacement,
+		MirrorService:          r.MirrorService,
+		MirrorPercent:          r.MirrorPercent,
+		MatchRules:             r.MatchRules,
+		FilterRules:            r.FilterRules,
+		Maintenance:            r.Maintenance,
+		MaintenancePage:        r.MaintenancePage,
 	}
 }
 
@@ -65,10 +108,33 @@ func (r Route) TCPRoute() *TCPRoute {
 		CreatedAt: r.CreatedAt,
 		UpdatedAt: r.UpdatedAt,
 
-		Port: int(r.Port),
+		Port:       int(r.Port),
+		ServerName: r.ServerName,
 	}
 }
 
+// HTTPRouteStats is the number of requests a router instance has served for
+// an HTTP route since it started.
+type HTTPRouteStats struct {
+	RouteID   string `json:"route_id"`
+	ParentRef string `json:"parent_ref,omitempty"`
+	Requests  uint64 `json:"requests"`
+	// InstanceID identifies the run of the router instance, it changes when
+	// the router restarts and its counts are reset.
+	InstanceID string `json:"instance_id"`
+}
+
+// BackendStatus is the state of a backend on a router instance.
+type BackendStatus struct {
+	Addr string `json:"addr"`
+	// Draining is true if new requests are not being sent to the backend,
+	// except those which are part of a sticky session.
+	Draining bool `json:"draining"`
+	// InFlight is the number of requests and connections which the router
+	// instance is currently proxying to the backend.
+	InFlight int `json:"in_flight"`
+}
+
 // HTTPRoute is an HTTP Route.
 type HTTPRoute struct {
 	ID        string
@@ -77,10 +143,18 @@ type HTTPRoute struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
-	Domain  string
-	TLSCert string
-	TLSKey  string
-	Sticky  bool
+	Domain                 string
+	TLSCert                string
+	TLSKey                 string
+	Sticky                 bool
+	PathRewritePrefix      string
+	PathRewriteReplacement string
+	MirrorService          string
+	MirrorPercent          int32
+	MatchRules             []MatchRule
+	FilterRules            []FilterRule
+	Maintenance            bool
+	MaintenancePage        string
 }
 
 func (r HTTPRoute) FormattedID() string {
@@ -102,13 +176,53 @@ func (r HTTPRoute) ToRoute() *Route {
 		UpdatedAt: r.UpdatedAt,
 
 		// http-specific fields
-		Domain:  r.Domain,
-		TLSCert: r.TLSCert,
-		TLSKey:  r.TLSKey,
-		Sticky:  r.Sticky,
+		Domain:                 r.Domain,
+		TLSCert:                r.TLSCert,
+		TLSKey:                 r.TLSKey,
+		Sticky:                 r.Sticky,
+		PathRewritePrefix:      r.PathRewritePrefix,
+		PathRewriteReplacement: r.PathRewriteReplacement,
+		MirrorService:          r.MirrorService,
+		MirrorPercent:          r.MirrorPercent,
+		MatchRules:             r.MatchRules,
+		FilterRules:            r.FilterRules,
+		Maintenance:            r.Maintenance,
+		MaintenancePage:        r.MaintenancePage,
 	}
 }
 
+// MatchRule routes HTTP requests that have a header or cookie with a given
+// value to a different service.
+type MatchRule struct {
+	// Header is the name of the request header to match. Either Header or
+	// Cookie must be set.
+	Header string `json:"header,omitempty"`
+	// Cookie is the name of the request cookie to match. Either Header or
+	// Cookie must be set.
+	Cookie string `json:"cookie,omitempty"`
+	// Value is the header or cookie value that matching requests have.
+	Value string `json:"value"`
+	// Service is the ID of the service that matching requests are routed to.
+	Service string `json:"service"`
+}
+
+// FilterRule blocks HTTP requests that match all of the conditions that are
+// set. Patterns are regular expressions in the syntax accepted by the regexp
+// package.
+type FilterRule struct {
+	// Methods is an optional list of request methods to match.
+	Methods []string `json:"methods,omitempty"`
+	// Path is an optional pattern that the request path must match.
+	Path string `json:"path,omitempty"`
+	// UserAgent is an optional pattern that the User-Agent header must match.
+	UserAgent string `json:"user_agent,omitempty"`
+	// Header is the name of an optional request header that must have a value
+	// matching HeaderValue.
+	Header string `json:"header,omitempty"`
+	// HeaderValue is the pattern that the value of Header must match.
+	HeaderValue string `json:"header_value,omitempty"`
+}
+
 // TCPRoute is a TCP Route.
 type TCPRoute struct {
 	ID        string
@@ -117,7 +231,8 @@ type TCPRoute struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
-	Port int
+	Port       int
+	ServerName string
 }
 
 func (r TCPRoute) FormattedID() string {
@@ -137,12 +252,26 @@ func (r TCPRoute) ToRoute() *Route {
 		CreatedAt: r.CreatedAt,
 		UpdatedAt: r.UpdatedAt,
 
-		Port: int32(r.Port),
+		Port:       int32(r.Port),
+		ServerName: r.ServerName,
 	}
 }
 
+// RouteBatch is a set of route changes that are applied atomically, either all
+// of the changes are applied or none of them are.
+type RouteBatch struct {
+	// Add is a list of routes to create.
+	Add []*Route `json:"add,omitempty"`
+	// Update is a list of existing routes to update.
+	Update []*Route `json:"update,omitempty"`
+	// Remove is a list of routes to remove, only the ID of each route is used.
+	Remove []*Route `json:"remove,omitempty"`
+}
+
 type Event struct {
 	Event string
 	ID    string
+	// IDs is the list of IDs of routes set or removed by a "batch" event.
+	IDs   []string
 	Error error
 }
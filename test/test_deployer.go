@@ -74,6 +74,12 @@ loop:
 	for i, e := range expected {
 		compare(t, actual[i], e)
 	}
+
+	if last := actual[len(actual)-1]; last.Status == "complete" {
+		t.Assert(last.Step, c.Equals, ct.DeploymentStepDone)
+		t.Assert(last.Percent, c.Equals, 100)
+		t.Assert(last.Current, c.DeepEquals, last.Expected)
+	}
 }
 
 func (s *DeployerSuite) TestOneByOneStrategy(t *c.C) {
@@ -99,6 +105,39 @@ func (s *DeployerSuite) TestOneByOneStrategy(t *c.C) {
 	waitForDeploymentEvents(t, events, expected)
 }
 
+func (s *DeployerSuite) TestOneByOneStopFirst(t *c.C) {
+	app, release := s.createRelease(t, "printer", "one-by-one")
+
+	// deploy a release whose printer jobs are stopped before being replaced
+	client := s.controllerClient(t)
+	oldReleaseID := release.ID
+	release.ID = ""
+	printer := release.Processes["printer"]
+	printer.StopFirst = true
+	release.Processes["printer"] = printer
+	t.Assert(client.CreateRelease(release), c.IsNil)
+	deployment, err := client.CreateDeployment(app.ID, release.ID)
+	t.Assert(err, c.IsNil)
+
+	events := make(chan *ct.DeploymentEvent)
+	stream, err := client.StreamDeployment(deployment.ID, events)
+	t.Assert(err, c.IsNil)
+	defer stream.Close()
+
+	expected := []*ct.DeploymentEvent{
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "stopping", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "down", Status: "running"},
+		{ReleaseID: release.ID, JobType: "printer", JobState: "starting", Status: "running"},
+		{ReleaseID: release.ID, JobType: "printer", JobState: "up", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "stopping", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "down", Status: "running"},
+		{ReleaseID: release.ID, JobType: "printer", JobState: "starting", Status: "running"},
+		{ReleaseID: release.ID, JobType: "printer", JobState: "up", Status: "running"},
+		{ReleaseID: release.ID, JobType: "", JobState: "", Status: "complete"},
+	}
+	waitForDeploymentEvents(t, events, expected)
+}
+
 func (s *DeployerSuite) TestAllAtOnceStrategy(t *c.C) {
 	deployment := s.createDeployment(t, "printer", "all-at-once")
 	events := make(chan *ct.DeploymentEvent)
@@ -122,6 +161,31 @@ func (s *DeployerSuite) TestAllAtOnceStrategy(t *c.C) {
 	waitForDeploymentEvents(t, events, expected)
 }
 
+func (s *DeployerSuite) TestInBatchesStrategy(t *c.C) {
+	deployment := s.createDeployment(t, "printer", "in-batches")
+	t.Assert(deployment.BatchSize, c.Equals, 0)
+	events := make(chan *ct.DeploymentEvent)
+	stream, err := s.controllerClient(t).StreamDeployment(deployment.ID, events)
+	t.Assert(err, c.IsNil)
+	defer stream.Close()
+	releaseID := deployment.NewReleaseID
+	oldReleaseID := deployment.OldReleaseID
+
+	// the default batch size for two processes is one
+	expected := []*ct.DeploymentEvent{
+		{ReleaseID: releaseID, JobType: "printer", JobState: "starting", Status: "running"},
+		{ReleaseID: releaseID, JobType: "printer", JobState: "up", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "stopping", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "down", Status: "running"},
+		{ReleaseID: releaseID, JobType: "printer", JobState: "starting", Status: "running"},
+		{ReleaseID: releaseID, JobType: "printer", JobState: "up", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "stopping", Status: "running"},
+		{ReleaseID: oldReleaseID, JobType: "printer", JobState: "down", Status: "running"},
+		{ReleaseID: releaseID, JobType: "", JobState: "", Status: "complete"},
+	}
+	waitForDeploymentEvents(t, events, expected)
+}
+
 func (s *DeployerSuite) TestServiceEvents(t *c.C) {
 	deployment := s.createDeployment(t, "echoer", "all-at-once")
 	events := make(chan *ct.DeploymentEvent)
@@ -369,8 +369,48 @@ func (s *SchedulerSuite) TestOmniJobs(t *c.C) {
 
 	// Check that new hosts get omni jobs
 	newHosts := s.addHosts(t, 2, false)
-	defer s.removeHosts(t, newHosts)
 	waitForJobEvents(t, stream, events, jobEvents{"omni": {"up": 2}})
+
+	// Check that the omni jobs of hosts which leave are marked down
+	s.removeHosts(t, newHosts)
+	waitForJobEvents(t, stream, events, jobEvents{"omni": {"down": 2}})
+}
+
+func (s *SchedulerSuite) TestSpreadJobs(t *c.C) {
+	if testCluster == nil || testCluster.Size() < 2 {
+		t.Skip("cannot boot new hosts")
+	}
+
+	app, release := s.createApp(t)
+	client := s.controllerClient(t)
+
+	events := make(chan *ct.JobEvent)
+	stream, err := client.StreamJobEvents(app.ID, 0, events)
+	t.Assert(err, c.IsNil)
+	defer stream.Close()
+
+	// jobs of the same type are started on different hosts while there are
+	// hosts without one
+	size := testCluster.Size()
+	t.Assert(client.PutFormation(&ct.Formation{
+		AppID:     app.ID,
+		ReleaseID: release.ID,
+		Processes: map[string]int{"printer": size},
+	}), c.IsNil)
+	waitForJobEvents(t, stream, events, jobEvents{"printer": {"up": size}})
+
+	jobs, err := client.JobList(app.ID)
+	t.Assert(err, c.IsNil)
+	hosts := make(map[string]struct{})
+	for _, job := range jobs {
+		if job.Type != "printer" || job.State != "up" {
+			continue
+		}
+		hostID, _, err := cluster.ParseJobID(job.ID)
+		t.Assert(err, c.IsNil)
+		hosts[hostID] = struct{}{}
+	}
+	t.Assert(hosts, c.HasLen, size)
 }
 
 func (s *SchedulerSuite) TestJobRestartBackoffPolicy(t *c.C) {